@@ -0,0 +1,187 @@
+package cache
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/emaballarin/rpget/pkg/cas"
+	"github.com/emaballarin/rpget/pkg/cli"
+	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+const longDesc = `
+'cache' maintains the content-addressed cache of --cache-dir, where downloaded files are stored by digest.
+`
+
+const gcLongDesc = `
+'cache gc' removes the files of the content cache unused for longer than --max-age, then the files --eviction-policy
+evicts first (those used least recently, or least often) until it is no larger than --max-size and holds at most
+--max-files files. Without any of them, the cache is emptied. Pinned files are never removed. Files removed from the
+cache only free their space once the destinations linked to them are removed too.
+`
+
+const gcExamples = `
+  rpget --cache-dir /var/cache/rpget cache gc --max-size 50GB
+  rpget --cache-dir /var/cache/rpget cache gc --max-size 50GB --max-files 10000 --eviction-policy lfu
+  rpget --cache-dir /var/cache/rpget cache gc --max-age 720h
+`
+
+const pinLongDesc = `
+'cache pin' pins the content of digests (sha256:<hex>) in the content cache, so that 'cache gc' never removes it,
+whether or not it is in the cache yet. Without digests, it lists the pinned ones. 'cache unpin' unpins them.
+`
+
+const pinExamples = `
+  rpget --cache-dir /var/cache/rpget cache pin sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae
+  rpget --cache-dir /var/cache/rpget cache pin
+`
+
+func GetCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "maintain the content cache of --cache-dir",
+		Long:  longDesc,
+		Args:  cobra.NoArgs,
+	}
+	cmd.AddCommand(gcCommand(), pinCommand(), unpinCommand())
+	cmd.SetUsageTemplate(cli.UsageTemplate)
+	return cmd
+}
+
+func gcCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "gc [flags]",
+		Short:   "shrink the content cache to a maximum size",
+		Long:    gcLongDesc,
+		Args:    cobra.NoArgs,
+		RunE:    runGCCMD,
+		Example: gcExamples,
+	}
+	cmd.Flags().String(config.OptMaxSize, "", "Maximum size of the content cache, e.g. 50GB (no limit if unset, unless no other limit is set)")
+	cmd.Flags().Int(config.OptMaxFiles, -1, "Maximum number of files in the content cache (-1 for no limit)")
+	cmd.Flags().Duration(config.OptMaxAge, 0, "Remove the files unused for longer than this, whatever the other limits, e.g. 720h (0 for no limit)")
+	cmd.Flags().String(config.OptEvictionPolicy, cas.PolicyLRU, "Files removed first to fit --max-size and --max-files: those used least recently (lru) or least often (lfu)")
+
+	err := viper.BindPFlags(cmd.Flags())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	cmd.SetUsageTemplate(cli.UsageTemplate)
+	return cmd
+}
+
+func runGCCMD(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+	logger := logging.GetLogger()
+	policy, err := cas.ParseEvictionPolicy(viper.GetString(config.OptEvictionPolicy))
+	if err != nil {
+		return err
+	}
+	opts := cas.GCOptions{
+		MaxSize:    -1,
+		MaxObjects: viper.GetInt(config.OptMaxFiles),
+		MaxAge:     viper.GetDuration(config.OptMaxAge),
+		Policy:     policy,
+	}
+	if value := viper.GetString(config.OptMaxSize); value != "" {
+		maxSize, err := humanize.ParseBytes(value)
+		if err != nil {
+			return fmt.Errorf("error parsing --%s: %w", config.OptMaxSize, err)
+		}
+		opts.MaxSize = int64(maxSize)
+	}
+	if opts.MaxSize < 0 && opts.MaxObjects < 0 && opts.MaxAge == 0 {
+		opts.MaxSize = 0
+	}
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	result, err := store.GCWith(opts)
+	logger.Info().
+		Int("removed", result.Removed).
+		Str("freed", humanize.Bytes(uint64(result.Freed))).
+		Int("objects", result.Objects).
+		Int("pinned", result.Pinned).
+		Str("size", humanize.Bytes(uint64(result.Size))).
+		Msg("Content cache GC")
+	return err
+}
+
+func pinCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "pin [flags] [<digest>...]",
+		Short:   "keep content in the content cache",
+		Long:    pinLongDesc,
+		Args:    cobra.ArbitraryArgs,
+		RunE:    runPinCMD,
+		Example: pinExamples,
+	}
+	cmd.SetUsageTemplate(cli.UsageTemplate)
+	return cmd
+}
+
+func unpinCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "unpin [flags] <digest>...",
+		Short: "let 'cache gc' remove pinned content again",
+		Long:  pinLongDesc,
+		Args:  cobra.MinimumNArgs(1),
+		RunE:  runUnpinCMD,
+	}
+	cmd.SetUsageTemplate(cli.UsageTemplate)
+	return cmd
+}
+
+// openStore opens the content cache of --cache-dir.
+func openStore() (*cas.Store, error) {
+	dir := viper.GetString(config.OptCacheDir)
+	if dir == "" {
+		return nil, fmt.Errorf("--%s is required", config.OptCacheDir)
+	}
+	return cas.Open(dir)
+}
+
+func runPinCMD(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		pins, err := store.Pins()
+		if err != nil {
+			return err
+		}
+		for _, digest := range pins {
+			fmt.Fprintln(cmd.OutOrStdout(), digest)
+		}
+		return nil
+	}
+	for _, digest := range args {
+		if err := store.Pin(digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runUnpinCMD(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+	store, err := openStore()
+	if err != nil {
+		return err
+	}
+	for _, digest := range args {
+		if err := store.Unpin(digest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
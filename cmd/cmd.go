@@ -3,14 +3,30 @@ package cmd
 import (
 	"github.com/spf13/cobra"
 
+	"github.com/emaballarin/rpget/cmd/cache"
+	"github.com/emaballarin/rpget/cmd/head"
+	"github.com/emaballarin/rpget/cmd/mirror"
 	"github.com/emaballarin/rpget/cmd/multifile"
+	"github.com/emaballarin/rpget/cmd/recovery"
+	"github.com/emaballarin/rpget/cmd/ring"
 	"github.com/emaballarin/rpget/cmd/root"
+	"github.com/emaballarin/rpget/cmd/serve"
+	"github.com/emaballarin/rpget/cmd/soak"
+	"github.com/emaballarin/rpget/cmd/verify"
 	"github.com/emaballarin/rpget/cmd/version"
 )
 
 func GetRootCommand() *cobra.Command {
 	rootCMD := root.GetCommand()
 	rootCMD.AddCommand(multifile.GetCommand())
+	rootCMD.AddCommand(mirror.GetCommand())
+	rootCMD.AddCommand(serve.GetCommand())
+	rootCMD.AddCommand(recovery.GetCommand())
+	rootCMD.AddCommand(cache.GetCommand())
+	rootCMD.AddCommand(ring.GetCommand())
+	rootCMD.AddCommand(soak.GetCommand())
+	rootCMD.AddCommand(verify.GetCommand())
+	rootCMD.AddCommand(head.GetCommand())
 	rootCMD.AddCommand(version.VersionCMD)
 	return rootCMD
 }
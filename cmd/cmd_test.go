@@ -0,0 +1,91 @@
+package cmd
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/config"
+)
+
+// TestMain runs the test binary as rpget when it is started as the agent, by agent.Start.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == config.ServeCMDName {
+		rootCMD := GetRootCommand()
+		rootCMD.SetArgs(os.Args[1:])
+		if err := rootCMD.Execute(); err != nil {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// execute runs rpget with args, as main does. Every run has its own PID file: the lock is only released on exit.
+func execute(t *testing.T, args ...string) error {
+	t.Helper()
+	viper.Reset()
+	rootCMD := GetRootCommand()
+	rootCMD.SetArgs(append([]string{"--pid-file", filepath.Join(t.TempDir(), "rpget.pid")}, args...))
+	rootCMD.SetOut(os.Stderr)
+	return rootCMD.Execute()
+}
+
+// TestSubcommandFlags checks that the flags multifile and ring share with verify, which is registered after them, are
+// the ones of the subcommand which runs.
+func TestSubcommandFlags(t *testing.T) {
+	defer viper.Reset()
+	dir := t.TempDir()
+	root := filepath.Join(dir, "out")
+	require.NoError(t, os.Mkdir(root, 0o755))
+
+	err := execute(t, "ring", "--hosts", "a,b", "--file-size", "1MB", "http://example.com/file")
+	assert.NoError(t, err)
+
+	manifest := filepath.Join(dir, "manifest.txt")
+	require.NoError(t, os.WriteFile(manifest, []byte("http://example.com/file /etc/file\n"), 0o644))
+	err = execute(t, "multifile", "--output-root", root, manifest)
+	assert.ErrorContains(t, err, "absolute destination /etc/file not allowed with an output root")
+
+	// parsed as JSON, not as lines
+	jsonManifest := filepath.Join(dir, "manifest.data")
+	require.NoError(t, os.WriteFile(jsonManifest, []byte(`[{"url": "http://example.com/file", "dest": "/etc/file"}]`), 0o644))
+	err = execute(t, "multifile", "--manifest-format", "json", "--output-root", root, jsonManifest)
+	assert.ErrorContains(t, err, "absolute destination /etc/file not allowed with an output root")
+
+	// entries without destinations, which only parse with the template
+	urls := filepath.Join(dir, "urls.txt")
+	require.NoError(t, os.WriteFile(urls, []byte("http://example.com/file\n"), 0o644))
+	err = execute(t, "multifile", "--dest-template", "/etc/{{.Name}}", "--output-root", root, urls)
+	assert.ErrorContains(t, err, "absolute destination /etc/file not allowed with an output root")
+}
+
+// TestAgentRelativeDest checks that relative destinations are relative to the directory rpget runs in, not to the one
+// of the invocation which started the agent.
+func TestAgentRelativeDest(t *testing.T) {
+	defer viper.Reset()
+	origin := httptest.NewServer(http.FileServer(http.FS(fstest.MapFS{"hello.txt": {Data: []byte("hello, world!")}})))
+	defer origin.Close()
+	runtimeDir := t.TempDir()
+	require.NoError(t, os.Chmod(runtimeDir, 0o700))
+	t.Setenv("XDG_RUNTIME_DIR", runtimeDir)
+
+	first := t.TempDir()
+	t.Chdir(first)
+	require.NoError(t, execute(t, "--agent", "--agent-idle-timeout", "2s", origin.URL+"/hello.txt", "first.txt"))
+	assert.FileExists(t, filepath.Join(first, "first.txt"))
+	assert.FileExists(t, filepath.Join(runtimeDir, "rpget-agent.sock"), "the agent was not started")
+
+	second := t.TempDir()
+	t.Chdir(second)
+	require.NoError(t, execute(t, "--agent", "--agent-idle-timeout", "2s", origin.URL+"/hello.txt", "second.txt"))
+	assert.FileExists(t, filepath.Join(second, "second.txt"))
+	assert.NoFileExists(t, filepath.Join(first, "second.txt"))
+}
@@ -0,0 +1,124 @@
+package head
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/spf13/cobra"
+	"golang.org/x/sync/errgroup"
+
+	"github.com/emaballarin/rpget/cmd/multifile"
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/cli"
+	"github.com/emaballarin/rpget/pkg/download"
+)
+
+const longDesc = `
+'head' describes the given URLs without downloading them: their size, ETag, Last-Modified time, whether they are
+served with ranges and, if their requests are routed to a cache host (e.g. with consistent hashing, the host of their
+first slice), that host. The URLs are requested as downloads would request them, with the same options (headers,
+credentials, cache hosts, proxies), so that placement decisions can be made before starting large downloads.
+
+A JSON array describing every URL, in order, is written to stdout. URLs which couldn't be described have an error
+instead, and the command fails.
+`
+
+const headExamples = `
+  rpget head https://example.com/model.tar
+
+  rpget head https://example.com/model-00001.safetensors https://example.com/model-00002.safetensors > sizes.json
+`
+
+// file is the JSON description of a URL.
+type file struct {
+	URL string `json:"url"`
+	// ResolvedURL is the URL the file was served from, if it isn't URL, e.g. after redirects or on a cache host
+	ResolvedURL  string `json:"resolved_url,omitempty"`
+	Size         int64  `json:"size"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+	AcceptRanges bool   `json:"accept_ranges"`
+	CacheHost    string `json:"cache_host,omitempty"`
+	Error        string `json:"error,omitempty"`
+}
+
+func GetCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "head [flags] <url> [<url>...]",
+		Short:   "print the size, ETag and cache host of files without downloading them",
+		Long:    longDesc,
+		Args:    cobra.MinimumNArgs(1),
+		RunE:    runHeadCMD,
+		Example: headExamples,
+	}
+	cmd.SetUsageTemplate(cli.UsageTemplate)
+	return cmd
+}
+
+func runHeadCMD(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+	downloadOpts, err := cli.DownloadOptions(args[0])
+	if err != nil {
+		return err
+	}
+	if err := cli.CheckURLPolicy(downloadOpts.Client.Policy, args...); err != nil {
+		return err
+	}
+	getter, err := rpget.New(rpget.WithDownloadOptions(downloadOpts))
+	if err != nil {
+		return err
+	}
+
+	files := make([]file, len(args))
+	var group errgroup.Group
+	if limit := multifile.MaxConcurrentFiles(); limit != 0 {
+		group.SetLimit(limit)
+	}
+	for i, url := range args {
+		group.Go(func() error {
+			info, err := getter.Stat(cmd.Context(), url)
+			files[i] = describe(url, info, err)
+			return nil
+		})
+	}
+	_ = group.Wait()
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(files); err != nil {
+		return err
+	}
+	failed := 0
+	for _, f := range files {
+		if f.Error != "" {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d of %d URL(s) couldn't be described", failed, len(files))
+	}
+	return nil
+}
+
+// describe returns the description of url, described by info or failed with err.
+func describe(url string, info download.FileInfo, err error) file {
+	if err != nil {
+		return file{URL: url, Error: err.Error()}
+	}
+	f := file{
+		URL:          url,
+		Size:         info.Size,
+		ETag:         info.ETag,
+		AcceptRanges: info.AcceptRanges,
+		CacheHost:    info.CacheHost,
+	}
+	if info.URL != url {
+		f.ResolvedURL = info.URL
+	}
+	if !info.LastModified.IsZero() {
+		f.LastModified = info.LastModified.UTC().Format(time.RFC3339)
+	}
+	return f
+}
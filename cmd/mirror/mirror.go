@@ -0,0 +1,115 @@
+package mirror
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/emaballarin/rpget/cmd/multifile"
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/cli"
+	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/logging"
+	"github.com/emaballarin/rpget/pkg/mirror"
+)
+
+const longDesc = `
+'mirror' downloads every file under a remote directory into a local directory, preserving relative paths. The
+directory listing is read from:
+
+  s3://bucket/prefix     an S3 bucket (ListObjectsV2, anonymous access)
+  gs://bucket/prefix     a GCS bucket (JSON API, anonymous access)
+  http(s)://host/path/   an HTML directory index, following links to subdirectories
+
+Files are downloaded in parallel as in 'multifile' mode. --include and --exclude take glob patterns; a pattern without
+a slash matches the file name, any other pattern the path relative to the listed directory.
+`
+
+const mirrorExamples = `
+  rpget mirror s3://my-bucket/models/llama ./llama
+
+  rpget mirror https://example.com/datasets/ ./datasets --include '*.parquet' --exclude 'tmp/*'
+`
+
+func GetCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "mirror [flags] <url> <dir>",
+		Short:   "download every file under a remote directory",
+		Long:    longDesc,
+		Args:    cobra.ExactArgs(2),
+		PreRunE: mirrorPreRunE,
+		RunE:    runMirrorCMD,
+		Example: mirrorExamples,
+	}
+	cmd.Flags().StringSlice(config.OptInclude, []string{}, "Only download files matching one of these glob patterns")
+	cmd.Flags().StringSlice(config.OptExclude, []string{}, "Skip files matching one of these glob patterns")
+
+	err := viper.BindPFlags(cmd.Flags())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	cmd.SetUsageTemplate(cli.UsageTemplate)
+	return cmd
+}
+
+func mirrorPreRunE(cmd *cobra.Command, args []string) error {
+	if viper.GetBool(config.OptExtract) {
+		return fmt.Errorf("cannot use --extract with mirror mode")
+	}
+	if viper.GetString(config.OptOutputConsumer) == config.ConsumerTarExtractor {
+		return fmt.Errorf("cannot use --output-consumer tar-extractor with mirror mode")
+	}
+	if viper.GetString(config.OptOutputConsumer) == config.ConsumerStdout {
+		return fmt.Errorf("cannot use --output-consumer stdout with mirror mode")
+	}
+	return nil
+}
+
+func runMirrorCMD(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+	logger := logging.GetLogger()
+	listURL, dir := args[0], args[1]
+
+	clientOpts, err := cli.ClientOptions(listURL)
+	if err != nil {
+		return err
+	}
+	objects, err := mirror.NewLister(clientOpts).List(cmd.Context(), listURL)
+	if err != nil {
+		return err
+	}
+	listed := len(objects)
+	objects, err = mirror.Filter(objects, viper.GetStringSlice(config.OptInclude), viper.GetStringSlice(config.OptExclude))
+	if err != nil {
+		return err
+	}
+	logger.Info().
+		Str("url", listURL).
+		Int("listed", listed).
+		Int("selected", len(objects)).
+		Msg("Mirror")
+
+	manifest, err := buildManifest(objects, dir)
+	if err != nil {
+		return err
+	}
+	return multifile.Execute(cmd.Context(), manifest, listURL)
+}
+
+func buildManifest(objects []mirror.Object, dir string) (rpget.Manifest, error) {
+	manifest := make(rpget.Manifest, 0, len(objects))
+	for _, object := range objects {
+		dest := filepath.Join(dir, filepath.FromSlash(object.Path))
+		if viper.GetString(config.OptOutputConsumer) != config.ConsumerNull {
+			if err := cli.EnsureDestinationNotExist(dest); err != nil {
+				return nil, err
+			}
+		}
+		manifest = manifest.AddEntry(object.URL, dest)
+	}
+	return manifest, nil
+}
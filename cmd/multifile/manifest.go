@@ -2,19 +2,26 @@ package multifile
 
 import (
 	"bufio"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"io/fs"
 	netUrl "net/url"
 	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/spf13/viper"
+	"go.yaml.in/yaml/v3"
 
 	rpget "github.com/emaballarin/rpget/pkg"
 	"github.com/emaballarin/rpget/pkg/cli"
 	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/download"
 	"github.com/emaballarin/rpget/pkg/logging"
 )
 
@@ -26,8 +33,109 @@ import (
 // A manifest may contain blank lines.
 // The pairs are separated by arbitrary whitespace.
 //
+// Optional further columns set per-entry options: a checksum verifying the downloaded file, either by digest
+// or by size, and any number of after=<dest> dependencies on other entries which must complete first:
+//
+// http://example.com/foo/SHA256SUMS  foo/SHA256SUMS  size=128
+// http://example.com/foo/bar.txt     foo/bar.txt     sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae after=foo/SHA256SUMS
+// http://example.com/foo/bar/baz.txt foo/bar/baz.txt size=1024
+//
+// A download_mode=<mode> column forces the entry to be fetched in buffer or consistent-hashing mode, whatever its
+// host:
+//
+// http://example.com/foo/bar.txt     foo/bar.txt     download_mode=buffer
+//
+// A consumer=<consumer> column consumes the entry with its own consumer instead of the one of --output: file,
+// tar-extract, null or pipe:<command> (see entryConsumer):
+//
+// http://example.com/foo/bar.tar     foo/bar         consumer=tar-extract
+//
+// Extracted entries may also set overwrite=true, to extract over an existing destination as --force does, and
+// strip_components=<n>, replacing --strip-components:
+//
+// http://example.com/foo/bar.tar     foo/bar         consumer=tar-extract overwrite=true strip_components=1
+//
+// With --dest-template, destinations are computed from the URLs, and lines have no destination column:
+//
+// http://example.com/foo/bar.txt     size=128
+//
 // When we parse a manifest, we group by URL base (ie scheme://hostname) so that
 // all URLs that may share a connection are grouped.
+//
+// Manifests may also be JSON or YAML lists of entries, which can carry per-file options:
+//
+// [{"url": "http://example.com/foo/bar.tar", "dest": "foo/bar", "headers": {"Authorization": "Bearer xyz"},
+//   "checksum": "size=1024", "mode": "0644", "extract": true}]
+//
+// Structured entries may also list post actions, run in order once the file has been downloaded:
+//
+// [{"url": "http://example.com/foo/bar.tar.gz", "dest": "foo/bar.tar.gz",
+//   "post": [{"extract": "{{.Dir}}/bar"}, {"run": ["rm", "{{.Dest}}"]}]}]
+
+const (
+	afterPrefix           = "after="
+	consumerPrefix        = "consumer="
+	downloadModePrefix    = "download_mode="
+	overwritePrefix       = "overwrite="
+	stripComponentsPrefix = "strip_components="
+)
+
+// The consumers of manifest entries, see entryConsumer.
+const (
+	entryConsumerFile       = "file"
+	entryConsumerTarExtract = "tar-extract"
+	entryConsumerNull       = "null"
+	entryConsumerPipePrefix = "pipe:"
+)
+
+// strictSchemes are the URL schemes --manifest-strict accepts.
+var strictSchemes = []string{"http", "https"}
+
+const (
+	manifestFormatText = "text"
+	manifestFormatJSON = "json"
+	manifestFormatYAML = "yaml"
+)
+
+// structuredEntry is a manifest entry in the JSON and YAML manifest formats.
+type structuredEntry struct {
+	URL      string            `json:"url" yaml:"url"`
+	Dest     string            `json:"dest" yaml:"dest"`
+	Headers  map[string]string `json:"headers,omitempty" yaml:"headers,omitempty"`
+	Checksum string            `json:"checksum,omitempty" yaml:"checksum,omitempty"`
+	// Mode is an octal file mode, e.g. "0755"
+	Mode    string `json:"mode,omitempty" yaml:"mode,omitempty"`
+	Extract bool   `json:"extract,omitempty" yaml:"extract,omitempty"`
+	// Consumer consumes the entry instead of the consumer of --output, see entryConsumer
+	Consumer string `json:"consumer,omitempty" yaml:"consumer,omitempty"`
+	// Overwrite and StripComponents configure the extraction of the entry, see withExtractOptions
+	Overwrite       bool `json:"overwrite,omitempty" yaml:"overwrite,omitempty"`
+	StripComponents *int `json:"strip_components,omitempty" yaml:"strip_components,omitempty"`
+	// After lists the destinations of entries which must complete first
+	After []string `json:"after,omitempty" yaml:"after,omitempty"`
+	// Post lists actions run once the entry has been downloaded
+	Post []postActionSpec `json:"post,omitempty" yaml:"post,omitempty"`
+	// Priority starts the entry before those of lower priority
+	Priority int `json:"priority,omitempty" yaml:"priority,omitempty"`
+	// VersionMarker is the URL of a file whose content identifies the version of the entry, which is only
+	// downloaded again once it changes
+	VersionMarker string `json:"version_marker,omitempty" yaml:"version_marker,omitempty"`
+	// VersionMarkerFile is where the version marker is stored, next to dest if unset
+	VersionMarkerFile string `json:"version_marker_file,omitempty" yaml:"version_marker_file,omitempty"`
+	// DownloadMode forces the entry to be fetched in buffer or consistent hashing mode
+	DownloadMode string `json:"download_mode,omitempty" yaml:"download_mode,omitempty"`
+}
+
+// postActionSpec is a single post action of a structured manifest entry; exactly one field must be set. String
+// values are templates over the entry, e.g. "{{.Dir}}/unpacked".
+type postActionSpec struct {
+	// Extract extracts the downloaded tar archive into the given directory, or next to it if empty
+	Extract *string `json:"extract,omitempty" yaml:"extract,omitempty"`
+	// Chmod is an octal file mode, e.g. "0755"
+	Chmod string `json:"chmod,omitempty" yaml:"chmod,omitempty"`
+	// Run is a command and its arguments
+	Run []string `json:"run,omitempty" yaml:"run,omitempty"`
+}
 
 var errDupeURLDestCombo = errors.New("duplicate destination with different URLs")
 
@@ -45,12 +153,99 @@ func manifestFile(manifestPath string) (*os.File, error) {
 	return file, err
 }
 
-func parseLine(line string) (url, dest string, err error) {
+// manifestFormat returns the format of the manifest at manifestPath: the --manifest-format option if set,
+// otherwise inferred from the file extension, defaulting to text.
+func manifestFormat(manifestPath string) (string, error) {
+	format := viper.GetString(config.OptManifestFormat)
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(manifestPath)) {
+		case ".json":
+			format = manifestFormatJSON
+		case ".yaml", ".yml":
+			format = manifestFormatYAML
+		default:
+			format = manifestFormatText
+		}
+	}
+	switch format {
+	case manifestFormatText, manifestFormatJSON, manifestFormatYAML:
+		return format, nil
+	default:
+		return "", fmt.Errorf("invalid manifest format %s, expected one of text, json, yaml", format)
+	}
+}
+
+func parseLine(line string) (rpget.ManifestEntry, error) {
 	fields := strings.Fields(line)
-	if len(fields) != 2 {
-		return "", "", fmt.Errorf("error parsing manifest invalid line format `%s`", line)
+	if len(fields) < 2 {
+		return rpget.ManifestEntry{}, fmt.Errorf("error parsing manifest invalid line format `%s`", line)
 	}
-	return fields[0], fields[1], nil
+	return parseOptions(line, rpget.ManifestEntry{URL: fields[0], Dest: fields[1]}, fields[2:])
+}
+
+// parseURLLine parses a line of a manifest whose destinations are computed with --dest-template: a URL, followed by
+// the options of parseLine.
+func parseURLLine(line string) (rpget.ManifestEntry, error) {
+	fields := strings.Fields(line)
+	return parseOptions(line, rpget.ManifestEntry{URL: fields[0]}, fields[1:])
+}
+
+// parseOptions sets the options of entry given by the further columns of its manifest line.
+func parseOptions(line string, entry rpget.ManifestEntry, options []string) (rpget.ManifestEntry, error) {
+	var overwrite bool
+	var stripComponents *int
+	for _, option := range options {
+		if after, ok := strings.CutPrefix(option, afterPrefix); ok {
+			if after == "" {
+				return rpget.ManifestEntry{}, fmt.Errorf("error parsing manifest line `%s`: empty %s", line, afterPrefix)
+			}
+			entry.After = append(entry.After, after)
+			continue
+		}
+		if name, ok := strings.CutPrefix(option, downloadModePrefix); ok {
+			mode, err := download.ParseMode(name)
+			if err != nil || mode == "" || entry.DownloadMode != "" {
+				return rpget.ManifestEntry{}, fmt.Errorf("error parsing manifest line `%s`: invalid %s", line, downloadModePrefix)
+			}
+			entry.DownloadMode = mode
+			continue
+		}
+		if name, ok := strings.CutPrefix(option, consumerPrefix); ok {
+			c, err := entryConsumer(name)
+			if err != nil || entry.Consumer != nil {
+				return rpget.ManifestEntry{}, fmt.Errorf("error parsing manifest line `%s`: invalid %s", line, consumerPrefix)
+			}
+			entry.Consumer = c
+			continue
+		}
+		if value, ok := strings.CutPrefix(option, overwritePrefix); ok {
+			var err error
+			if overwrite, err = strconv.ParseBool(value); err != nil {
+				return rpget.ManifestEntry{}, fmt.Errorf("error parsing manifest line `%s`: invalid %s", line, overwritePrefix)
+			}
+			continue
+		}
+		if value, ok := strings.CutPrefix(option, stripComponentsPrefix); ok {
+			n, err := strconv.Atoi(value)
+			if err != nil || stripComponents != nil {
+				return rpget.ManifestEntry{}, fmt.Errorf("error parsing manifest line `%s`: invalid %s", line, stripComponentsPrefix)
+			}
+			stripComponents = &n
+			continue
+		}
+		if entry.Checksum != "" {
+			return rpget.ManifestEntry{}, fmt.Errorf("error parsing manifest invalid line format `%s`", line)
+		}
+		if err := rpget.ValidateChecksum(option); err != nil {
+			return rpget.ManifestEntry{}, fmt.Errorf("error parsing manifest line `%s`: %w", line, err)
+		}
+		entry.Checksum = option
+	}
+	var err error
+	if entry.Consumer, err = withExtractOptions(entry.Consumer, overwrite, stripComponents); err != nil {
+		return rpget.ManifestEntry{}, fmt.Errorf("error parsing manifest line `%s`: %w", line, err)
+	}
+	return entry, nil
 }
 
 func checkSeenDestinations(destinations map[string]string, dest string, url string) error {
@@ -65,33 +260,381 @@ func checkSeenDestinations(destinations map[string]string, dest string, url stri
 }
 
 func parseManifest(file io.Reader) (rpget.Manifest, error) {
-	logger := logging.GetLogger()
-	seenDestinations := make(map[string]string)
-	manifest := make(rpget.Manifest, 0)
+	return parseManifestFormat(file, manifestFormatText)
+}
 
-	scanner := bufio.NewScanner(file)
+func parseManifestFormat(file io.Reader, format string) (rpget.Manifest, error) {
+	problems := &manifestProblems{strict: viper.GetBool(config.OptManifestStrict)}
+	var destTemplate *cli.DestTemplate
+	if text := viper.GetString(config.OptDestTemplate); text != "" {
+		var err error
+		if destTemplate, err = cli.ParseDestTemplate(text); err != nil {
+			return nil, err
+		}
+	}
+	var entries []rpget.ManifestEntry
+	var locations []string
+	var err error
+	if format == manifestFormatText {
+		entries, locations, err = parseTextEntries(file, destTemplate != nil, problems)
+	} else {
+		entries, locations, err = parseStructuredEntries(file, format, destTemplate != nil, problems)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if entries, locations, err = expandEntries(entries, locations, destTemplate, problems); err != nil {
+		return nil, err
+	}
+	if root := viper.GetString(config.OptOutputRoot); root != "" {
+		if entries, locations, err = confineToOutputRoot(entries, locations, root, problems); err != nil {
+			return nil, err
+		}
+	}
+	defaultConsumer, err := config.GetConsumer()
+	if err != nil {
+		return nil, err
+	}
+	if problems.strict {
+		validateStrict(entries, locations, defaultConsumer, problems)
+	}
+	if err := problems.err(); err != nil {
+		return nil, err
+	}
+	return buildManifest(entries, defaultConsumer)
+}
+
+// expandEntries expands the brace expressions of the URLs and destinations of entries (see cli.ExpandURLs) into an
+// entry per URL, with the options of the entry they come from. If destTemplate isn't nil, it computes the
+// destinations of the entries instead.
+func expandEntries(entries []rpget.ManifestEntry, locations []string, destTemplate *cli.DestTemplate, problems *manifestProblems) ([]rpget.ManifestEntry, []string, error) {
+	expanded := make([]rpget.ManifestEntry, 0, len(entries))
+	expandedLocations := make([]string, 0, len(locations))
+	for i, entry := range entries {
+		var urls, dests []string
+		var err error
+		if destTemplate != nil {
+			urls, dests, err = destTemplate.ExpandURLs(entry.URL)
+		} else {
+			urls, dests, err = cli.ExpandURLs(entry.URL, entry.Dest, false)
+		}
+		switch {
+		case err != nil || len(urls) == 1:
+		case entry.Consumer != nil && destTemplate == nil:
+			// the archives would otherwise be extracted into directories named after them
+			if ownDests, _ := cli.ExpandBraces(entry.Dest); len(ownDests) != len(urls) {
+				err = fmt.Errorf("dest %s of an extracted entry must expand to a destination per URL of %s", entry.Dest, entry.URL)
+			}
+		case entry.VersionMarkerFile != "":
+			err = fmt.Errorf("version_marker_file can't be shared by the %d entries %s expands to", len(urls), entry.URL)
+		}
+		if err != nil {
+			if problems.add(locations[i], err) {
+				return nil, nil, problems.err()
+			}
+			continue
+		}
+		for j := range urls {
+			entry.URL, entry.Dest = urls[j], dests[j]
+			expanded = append(expanded, entry)
+			expandedLocations = append(expandedLocations, locations[i])
+		}
+	}
+	return expanded, expandedLocations, nil
+}
+
+// manifestProblems collects the problems found in a manifest: by default parsing stops at the first one, in strict
+// mode every problem is collected, along with its location, to be reported at once.
+type manifestProblems struct {
+	strict bool
+	errs   []error
+}
 
-	for scanner.Scan() {
+// add records err, found at location (e.g. "line 3"), and reports whether parsing must stop.
+func (p *manifestProblems) add(location string, err error) bool {
+	if !p.strict {
+		p.errs = append(p.errs, err)
+		return true
+	}
+	p.errs = append(p.errs, fmt.Errorf("%s: %w", location, err))
+	return false
+}
+
+func (p *manifestProblems) err() error {
+	switch {
+	case len(p.errs) == 0:
+		return nil
+	case !p.strict:
+		return p.errs[0]
+	default:
+		return fmt.Errorf("%d problems found in manifest:\n%w", len(p.errs), errors.Join(p.errs...))
+	}
+}
+
+// parseTextEntries parses a text manifest, returning its entries and their line numbers. If computedDest is set,
+// lines have no destination column, see parseURLLine.
+func parseTextEntries(file io.Reader, computedDest bool, problems *manifestProblems) ([]rpget.ManifestEntry, []string, error) {
+	entries := make([]rpget.ManifestEntry, 0)
+	var locations []string
+	scanner := bufio.NewScanner(file)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
 		line := strings.TrimSpace(scanner.Text())
 		if line == "" {
 			continue
 		}
-		url, dest, err := parseLine(line)
+		location := fmt.Sprintf("line %d", lineNumber)
+		parse := parseLine
+		if computedDest {
+			parse = parseURLLine
+		}
+		entry, err := parse(line)
+		if err != nil {
+			if problems.add(location, err) {
+				return nil, nil, problems.err()
+			}
+			continue
+		}
+		entries = append(entries, entry)
+		locations = append(locations, location)
+	}
+	return entries, locations, scanner.Err()
+}
+
+// parseStructuredEntries parses a JSON or YAML manifest, returning its entries and their indices. If computedDest is
+// set, entries must not have a dest.
+func parseStructuredEntries(file io.Reader, format string, computedDest bool, problems *manifestProblems) ([]rpget.ManifestEntry, []string, error) {
+	var raw []structuredEntry
+	if format == manifestFormatJSON {
+		decoder := json.NewDecoder(file)
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&raw); err != nil {
+			return nil, nil, fmt.Errorf("error parsing JSON manifest: %w", err)
+		}
+	} else {
+		decoder := yaml.NewDecoder(file)
+		decoder.KnownFields(true)
+		if err := decoder.Decode(&raw); err != nil && !errors.Is(err, io.EOF) {
+			return nil, nil, fmt.Errorf("error parsing YAML manifest: %w", err)
+		}
+	}
+
+	entries := make([]rpget.ManifestEntry, 0, len(raw))
+	locations := make([]string, 0, len(raw))
+	for i, r := range raw {
+		location := fmt.Sprintf("manifest entry %d", i)
+		entry, err := r.entry(computedDest)
+		if err != nil {
+			if problems.add(location, err) {
+				return nil, nil, fmt.Errorf("%s: %w", location, err)
+			}
+			continue
+		}
+		entries = append(entries, entry)
+		locations = append(locations, location)
+	}
+	return entries, locations, nil
+}
+
+func (r structuredEntry) entry(computedDest bool) (rpget.ManifestEntry, error) {
+	switch {
+	case computedDest && r.URL == "":
+		return rpget.ManifestEntry{}, fmt.Errorf("url is required")
+	case computedDest && r.Dest != "":
+		return rpget.ManifestEntry{}, fmt.Errorf("dest can't be set with --%s", config.OptDestTemplate)
+	case !computedDest && (r.URL == "" || r.Dest == ""):
+		return rpget.ManifestEntry{}, fmt.Errorf("url and dest are required")
+	}
+	entry := rpget.ManifestEntry{
+		URL:               r.URL,
+		Dest:              r.Dest,
+		Checksum:          r.Checksum,
+		Headers:           r.Headers,
+		After:             r.After,
+		Priority:          r.Priority,
+		VersionMarker:     r.VersionMarker,
+		VersionMarkerFile: r.VersionMarkerFile,
+	}
+	if r.VersionMarkerFile != "" && r.VersionMarker == "" {
+		return rpget.ManifestEntry{}, fmt.Errorf("version_marker_file requires version_marker")
+	}
+	downloadMode, err := download.ParseMode(r.DownloadMode)
+	if err != nil {
+		return rpget.ManifestEntry{}, err
+	}
+	entry.DownloadMode = downloadMode
+	if r.Checksum != "" {
+		if err := rpget.ValidateChecksum(r.Checksum); err != nil {
+			return rpget.ManifestEntry{}, err
+		}
+	}
+	if r.Mode != "" {
+		mode, err := strconv.ParseUint(r.Mode, 8, 32)
+		if err != nil || mode > uint64(fs.ModePerm) {
+			return rpget.ManifestEntry{}, fmt.Errorf("invalid mode `%s`", r.Mode)
+		}
+		entry.Mode = fs.FileMode(mode)
+	}
+	for j, spec := range r.Post {
+		action, err := spec.action()
 		if err != nil {
+			return rpget.ManifestEntry{}, fmt.Errorf("post action %d: %w", j, err)
+		}
+		entry.Post = append(entry.Post, action)
+	}
+	switch {
+	case r.Extract && r.Consumer != "":
+		return rpget.ManifestEntry{}, fmt.Errorf("extract can't be set with consumer")
+	case r.Extract:
+		entry.Consumer, err = entryConsumer(entryConsumerTarExtract)
+	case r.Consumer != "":
+		entry.Consumer, err = entryConsumer(r.Consumer)
+	}
+	if err != nil {
+		return rpget.ManifestEntry{}, err
+	}
+	if entry.Consumer, err = withExtractOptions(entry.Consumer, r.Overwrite, r.StripComponents); err != nil {
+		return rpget.ManifestEntry{}, err
+	}
+	return entry, nil
+}
+
+// withExtractOptions returns c, the consumer of a manifest entry or nil for the consumer of --output, with the
+// extraction options of the entry: overwrite extracts over an existing destination, as --force does, and
+// stripComponents, if not nil, replaces --strip-components. They require the entry to be extracted.
+func withExtractOptions(c consumer.Consumer, overwrite bool, stripComponents *int) (consumer.Consumer, error) {
+	if !overwrite && stripComponents == nil {
+		return c, nil
+	}
+	if c == nil {
+		var err error
+		if c, err = config.GetConsumer(); err != nil {
 			return nil, err
 		}
+	}
+	extractor, ok := c.(*consumer.TarExtractor)
+	if !ok {
+		return nil, fmt.Errorf("overwrite and strip_components require the entry to be extracted")
+	}
+	if overwrite {
+		extractor.Options.Overwrite = true
+	}
+	if stripComponents != nil {
+		if *stripComponents < 0 {
+			return nil, fmt.Errorf("strip_components must not be negative")
+		}
+		extractor.Options.StripComponents = *stripComponents
+	}
+	return extractor, nil
+}
+
+// overwrites reports whether entry is extracted over its existing destination, see withExtractOptions.
+func overwrites(entry rpget.ManifestEntry) bool {
+	extractor, ok := entry.Consumer.(*consumer.TarExtractor)
+	return ok && extractor.Options.Overwrite
+}
+
+// entryConsumer returns the consumer of a manifest entry named name: file, tar-extract, null, or pipe:<command> to
+// pipe the file into a shell command (see consumer.Command). Files and extractions are configured as with --output.
+func entryConsumer(name string) (consumer.Consumer, error) {
+	switch name {
+	case entryConsumerFile:
+		return config.NewConsumer(config.ConsumerFile)
+	case entryConsumerTarExtract:
+		return config.NewConsumer(config.ConsumerTarExtractor)
+	case entryConsumerNull:
+		return config.NewConsumer(config.ConsumerNull)
+	}
+	if command, ok := strings.CutPrefix(name, entryConsumerPipePrefix); ok && strings.TrimSpace(command) != "" {
+		return &consumer.Command{Command: command}, nil
+	}
+	return nil, fmt.Errorf("invalid consumer %s, expected one of %s, %s, %s or %s<command>", name, entryConsumerFile, entryConsumerTarExtract, entryConsumerNull, entryConsumerPipePrefix)
+}
 
+// validateStrict records the problems --manifest-strict rejects on top of the usual checks: URLs which rpget can't
+// download, relative destinations escaping the current directory (or the output root, see confineToOutputRoot),
+// duplicate destinations and existing ones.
+func validateStrict(entries []rpget.ManifestEntry, locations []string, defaultConsumer consumer.Consumer, problems *manifestProblems) {
+	outputRoot := viper.GetString(config.OptOutputRoot) != ""
+	seenDestinations := make(map[string]string, len(entries))
+	for i, entry := range entries {
+		location := locations[i]
+		u, err := netUrl.Parse(entry.URL)
+		switch {
+		case err != nil:
+			problems.add(location, err)
+		case !slices.Contains(strictSchemes, u.Scheme):
+			problems.add(location, fmt.Errorf("unsupported scheme in URL %s, expected one of %s", entry.URL, strings.Join(strictSchemes, ", ")))
+		case u.Host == "":
+			problems.add(location, fmt.Errorf("missing host in URL %s", entry.URL))
+		}
+		// with an output root, destinations escaping it were already reported
+		if !outputRoot && !filepath.IsAbs(entry.Dest) && !filepath.IsLocal(entry.Dest) {
+			problems.add(location, fmt.Errorf("destination %s escapes the current directory", entry.Dest))
+		}
+		if !writesDestination(entry, defaultConsumer) {
+			continue
+		}
+		dest := filepath.Clean(entry.Dest)
+		if seen, ok := seenDestinations[dest]; ok {
+			problems.add(location, fmt.Errorf("duplicate destination %s, already used at %s", entry.Dest, seen))
+			continue
+		}
+		seenDestinations[dest] = location
+		// the version marker decides whether an existing destination is downloaded again
+		if entry.VersionMarker != "" || overwrites(entry) {
+			continue
+		}
+		if err := cli.EnsureDestinationNotExist(entry.Dest); err != nil {
+			problems.add(location, err)
+		}
+	}
+}
+
+func (s postActionSpec) action() (rpget.PostAction, error) {
+	set := 0
+	for _, ok := range []bool{s.Extract != nil, s.Chmod != "", len(s.Run) > 0} {
+		if ok {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, fmt.Errorf("expected exactly one of extract, chmod, run")
+	}
+	switch {
+	case s.Extract != nil:
+		return rpget.NewExtractAction(*s.Extract, viper.GetBool(config.OptForce))
+	case s.Chmod != "":
+		mode, err := strconv.ParseUint(s.Chmod, 8, 32)
+		if err != nil || mode > uint64(fs.ModePerm) {
+			return nil, fmt.Errorf("invalid mode `%s`", s.Chmod)
+		}
+		return &rpget.ChmodAction{Mode: fs.FileMode(mode)}, nil
+	default:
+		return rpget.NewRunAction(s.Run)
+	}
+}
+
+// buildManifest validates entries and returns them as a Manifest, skipping exact duplicates. The destinations of the
+// entries written by their consumer, defaultConsumer if they have none, must be unique and not exist yet.
+func buildManifest(entries []rpget.ManifestEntry, defaultConsumer consumer.Consumer) (rpget.Manifest, error) {
+	logger := logging.GetLogger()
+	seenDestinations := make(map[string]string)
+	manifest := make(rpget.Manifest, 0, len(entries))
+
+	for _, entry := range entries {
+		url, dest := entry.URL, entry.Dest
 		if _, err := netUrl.Parse(url); err != nil {
 			return nil, err
 
 		}
 
-		// THIS IS A BODGE - FIX ME MOVE THESE THINGS TO RPGET
-		// and make the consumer responsible for knowing if this
-		// is allowed/not allowed/etc
-		consumer := viper.GetString(config.OptOutputConsumer)
-		if consumer != config.ConsumerNull {
-			err = checkSeenDestinations(seenDestinations, dest, url)
+		if benchmarking(defaultConsumer) {
+			// benchmarking with the null consumer discards every entry, leaving nothing to post-process
+			entry.Consumer = nil
+			entry.Post = nil
+		}
+		if writesDestination(entry, defaultConsumer) {
+			err := checkSeenDestinations(seenDestinations, dest, url)
 			if err != nil {
 				if errors.Is(err, errDupeURLDestCombo) {
 					logger.Warn().
@@ -104,13 +647,30 @@ func parseManifest(file io.Reader) (rpget.Manifest, error) {
 			}
 			seenDestinations[dest] = url
 
-			err = cli.EnsureDestinationNotExist(dest)
-			if err != nil {
-				return nil, err
+			if entry.VersionMarker == "" && !overwrites(entry) {
+				if err := cli.EnsureDestinationNotExist(dest); err != nil {
+					return nil, err
+				}
 			}
 		}
-		manifest = manifest.AddEntry(url, dest)
+		manifest = append(manifest, entry)
 	}
 
 	return manifest, nil
 }
+
+// benchmarking reports whether defaultConsumer, the consumer of --output, discards every entry, whatever their own
+// consumer.
+func benchmarking(defaultConsumer consumer.Consumer) bool {
+	_, isNull := defaultConsumer.(*consumer.NullWriter)
+	return isNull
+}
+
+// writesDestination reports whether entry is written to its destination, by its own consumer or defaultConsumer,
+// see consumer.WritesDestination.
+func writesDestination(entry rpget.ManifestEntry, defaultConsumer consumer.Consumer) bool {
+	if entry.Consumer == nil || benchmarking(defaultConsumer) {
+		return consumer.WritesDestination(defaultConsumer)
+	}
+	return consumer.WritesDestination(entry.Consumer)
+}
@@ -2,11 +2,18 @@ package multifile
 
 import (
 	"os"
+	"path/filepath"
 	"strings"
 	"testing"
 
+	"github.com/spf13/viper"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/download"
 )
 
 // validManifest is a valid manifest file with additional empty lines
@@ -24,23 +31,157 @@ func TestParseLine(t *testing.T) {
 	validLineMultipleSpace := "https://example.com/file1.txt    /tmp/file1.txt"
 	invalidLine := "https://example.com/file1.txt"
 
-	urlString, dest, err := parseLine(validLine)
-	assert.Equal(t, "https://example.com/file1.txt", urlString)
-	assert.Equal(t, "/tmp/file1.txt", dest)
+	entry, err := parseLine(validLine)
+	assert.Equal(t, "https://example.com/file1.txt", entry.URL)
+	assert.Equal(t, "/tmp/file1.txt", entry.Dest)
 	assert.NoError(t, err)
-	urlString, dest, err = parseLine(validLineTabs)
-	assert.Equal(t, "https://example.com/file1.txt", urlString)
-	assert.Equal(t, "/tmp/file1.txt", dest)
+	entry, err = parseLine(validLineTabs)
+	assert.Equal(t, "https://example.com/file1.txt", entry.URL)
+	assert.Equal(t, "/tmp/file1.txt", entry.Dest)
 	assert.NoError(t, err)
-	urlString, dest, err = parseLine(validLineMultipleSpace)
-	assert.Equal(t, "https://example.com/file1.txt", urlString)
-	assert.Equal(t, "/tmp/file1.txt", dest)
+	entry, err = parseLine(validLineMultipleSpace)
+	assert.Equal(t, "https://example.com/file1.txt", entry.URL)
+	assert.Equal(t, "/tmp/file1.txt", entry.Dest)
 	assert.NoError(t, err)
 
-	_, _, err = parseLine(invalidLine)
+	_, err = parseLine(invalidLine)
+	assert.Error(t, err)
+}
+
+func TestParseLineChecksum(t *testing.T) {
+	digest := "sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae"
+
+	entry, err := parseLine("https://example.com/file1.txt /tmp/file1.txt " + digest)
+	require.NoError(t, err)
+	assert.Equal(t, "/tmp/file1.txt", entry.Dest)
+	assert.Equal(t, digest, entry.Checksum)
+
+	entry, err = parseLine("https://example.com/file1.txt /tmp/file1.txt size=1024")
+	require.NoError(t, err)
+	assert.Equal(t, "size=1024", entry.Checksum)
+
+	entry, err = parseLine("https://example.com/file1.txt /tmp/file1.txt")
+	require.NoError(t, err)
+	assert.Empty(t, entry.Checksum)
+
+	for _, invalid := range []string{"md5:abc", "sha256:zz", "sha256:abcd", "size=-1", "size=ten"} {
+		_, err = parseLine("https://example.com/file1.txt /tmp/file1.txt " + invalid)
+		assert.Error(t, err, invalid)
+	}
+	_, err = parseLine("https://example.com/file1.txt /tmp/file1.txt size=1 extra")
+	assert.Error(t, err)
+	_, err = parseLine("https://example.com/file1.txt /tmp/file1.txt size=1 size=2")
 	assert.Error(t, err)
 }
 
+func TestParseLineAfter(t *testing.T) {
+	entry, err := parseLine("https://example.com/file1.txt /tmp/file1.txt after=/tmp/SUMS size=1 after=/tmp/index")
+	require.NoError(t, err)
+	assert.Equal(t, "size=1", entry.Checksum)
+	assert.Equal(t, []string{"/tmp/SUMS", "/tmp/index"}, entry.After)
+
+	_, err = parseLine("https://example.com/file1.txt /tmp/file1.txt after=")
+	assert.Error(t, err)
+}
+
+func TestParseLineDownloadMode(t *testing.T) {
+	entry, err := parseLine("https://example.com/file1.txt /tmp/file1.txt download_mode=buffer size=1")
+	require.NoError(t, err)
+	assert.Equal(t, download.ModeBuffer, entry.DownloadMode)
+	assert.Equal(t, "size=1", entry.Checksum)
+
+	_, err = parseLine("https://example.com/file1.txt /tmp/file1.txt download_mode=cache")
+	assert.Error(t, err)
+	_, err = parseLine("https://example.com/file1.txt /tmp/file1.txt download_mode=buffer download_mode=consistent-hashing")
+	assert.Error(t, err)
+
+	manifest, err := parseManifestFormat(strings.NewReader(`[{"url": "https://example.com/a", "dest": "/data/a", "download_mode": "consistent-hashing"}]`), manifestFormatJSON)
+	require.NoError(t, err)
+	assert.Equal(t, download.ModeConsistentHashing, manifest[0].DownloadMode)
+	_, err = parseManifestFormat(strings.NewReader(`[{"url": "https://example.com/a", "dest": "/data/a", "download_mode": "cache"}]`), manifestFormatJSON)
+	assert.ErrorContains(t, err, "invalid download mode cache")
+}
+
+func TestParseManifestConsumer(t *testing.T) {
+	entry, err := parseLine("https://example.com/a.tar /tmp/a consumer=tar-extract")
+	require.NoError(t, err)
+	assert.IsType(t, &consumer.TarExtractor{}, entry.Consumer)
+	_, err = parseLine("https://example.com/a.tar /tmp/a consumer=unpack")
+	assert.Error(t, err)
+	_, err = parseLine("https://example.com/a.tar /tmp/a consumer=file consumer=null")
+	assert.Error(t, err)
+
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing")
+	require.NoError(t, os.WriteFile(existing, nil, 0644))
+	// entries piped into a command or discarded don't write their destination, which may exist or repeat
+	manifest, err := parseManifestFormat(strings.NewReader(`[
+		{"url": "https://example.com/a", "dest": "`+existing+`", "consumer": "pipe:sha256sum"},
+		{"url": "https://example.com/b", "dest": "`+existing+`", "consumer": "null"},
+		{"url": "https://example.com/c", "dest": "`+filepath.Join(dir, "c")+`", "consumer": "file"}
+	]`), manifestFormatJSON)
+	require.NoError(t, err)
+	require.Len(t, manifest, 3)
+	assert.Equal(t, &consumer.Command{Command: "sha256sum"}, manifest[0].Consumer)
+	assert.IsType(t, &consumer.NullWriter{}, manifest[1].Consumer)
+	assert.IsType(t, &consumer.FileWriter{}, manifest[2].Consumer)
+
+	_, err = parseManifestFormat(strings.NewReader(`[{"url": "https://example.com/a", "dest": "`+existing+`", "consumer": "file"}]`), manifestFormatJSON)
+	assert.Error(t, err)
+	_, err = parseManifestFormat(strings.NewReader(`[{"url": "https://example.com/a", "dest": "/tmp/a", "consumer": "pipe:"}]`), manifestFormatJSON)
+	assert.ErrorContains(t, err, "invalid consumer")
+	_, err = parseManifestFormat(strings.NewReader(`[{"url": "https://example.com/a", "dest": "/tmp/a", "consumer": "file", "extract": true}]`), manifestFormatJSON)
+	assert.ErrorContains(t, err, "extract can't be set with consumer")
+
+	// benchmarking with the null consumer discards every entry
+	viper.Set(config.OptOutputConsumer, config.ConsumerNull)
+	defer viper.Reset()
+	manifest, err = parseManifestFormat(strings.NewReader(`[{"url": "https://example.com/a", "dest": "`+existing+`", "consumer": "file"}]`), manifestFormatJSON)
+	require.NoError(t, err)
+	assert.Nil(t, manifest[0].Consumer)
+}
+
+func TestParseManifestExtractOptions(t *testing.T) {
+	entry, err := parseLine("https://example.com/a.tar /tmp/a strip_components=2 consumer=tar-extract overwrite=true")
+	require.NoError(t, err)
+	require.IsType(t, &consumer.TarExtractor{}, entry.Consumer)
+	assert.Equal(t, 2, entry.Consumer.(*consumer.TarExtractor).Options.StripComponents)
+	assert.True(t, entry.Consumer.(*consumer.TarExtractor).Options.Overwrite)
+	for _, line := range []string{
+		"https://example.com/a.tar /tmp/a strip_components=1",
+		"https://example.com/a.tar /tmp/a consumer=file overwrite=true",
+		"https://example.com/a.tar /tmp/a consumer=tar-extract strip_components=-1",
+		"https://example.com/a.tar /tmp/a consumer=tar-extract strip_components=one",
+		"https://example.com/a.tar /tmp/a consumer=tar-extract overwrite=sure",
+	} {
+		_, err = parseLine(line)
+		assert.Error(t, err, line)
+	}
+
+	// an existing destination is extracted over by the entries overwriting it only
+	dir := t.TempDir()
+	manifest, err := parseManifestFormat(strings.NewReader(`[
+		{"url": "https://example.com/a.tar", "dest": "`+dir+`", "extract": true, "overwrite": true, "strip_components": 1}
+	]`), manifestFormatJSON)
+	require.NoError(t, err)
+	extractor := manifest[0].Consumer.(*consumer.TarExtractor)
+	assert.True(t, extractor.Options.Overwrite)
+	assert.Equal(t, 1, extractor.Options.StripComponents)
+	_, err = parseManifestFormat(strings.NewReader(`[{"url": "https://example.com/a.tar", "dest": "`+dir+`", "extract": true}]`), manifestFormatJSON)
+	assert.ErrorContains(t, err, "already exists")
+	_, err = parseManifestFormat(strings.NewReader(`[{"url": "https://example.com/a", "dest": "/tmp/a", "strip_components": 1}]`), manifestFormatJSON)
+	assert.ErrorContains(t, err, "require the entry to be extracted")
+
+	// entries extracted by the consumer of --output get their own
+	viper.Set(config.OptOutputConsumer, config.ConsumerTarExtractor)
+	defer viper.Reset()
+	manifest, err = parseManifest(strings.NewReader("https://example.com/a.tar /tmp/a strip_components=3\nhttps://example.com/b.tar /tmp/b"))
+	require.NoError(t, err)
+	require.Len(t, manifest, 2)
+	assert.Equal(t, 3, manifest[0].Consumer.(*consumer.TarExtractor).Options.StripComponents)
+	assert.Nil(t, manifest[1].Consumer)
+}
+
 func TestCheckSeenDestinations(t *testing.T) {
 	seenDestinations := map[string]string{
 		"/tmp/file1.txt": "https://example.com/file1.txt",
@@ -69,6 +210,173 @@ func TestParseManifest(t *testing.T) {
 	assert.Len(t, parsedManifest, 0)
 }
 
+func TestParseManifestExpansion(t *testing.T) {
+	manifest, err := parseManifest(strings.NewReader("https://example.com/shard-{00..02}.tar /data size=1024\nhttps://example.com/{a,b}.bin /out/{x,y}.bin"))
+	require.NoError(t, err)
+	require.Len(t, manifest, 5)
+	assert.Equal(t, "https://example.com/shard-02.tar", manifest[2].URL)
+	assert.Equal(t, "/data/shard-02.tar", manifest[2].Dest)
+	assert.Equal(t, "size=1024", manifest[2].Checksum)
+	assert.Equal(t, "https://example.com/b.bin", manifest[4].URL)
+	assert.Equal(t, "/out/y.bin", manifest[4].Dest)
+
+	manifest, err = parseManifestFormat(strings.NewReader(`[
+  {"url": "https://example.com/shard-{0..1}.tar", "dest": "/data/shard-{0..1}", "extract": true}
+]`), manifestFormatJSON)
+	require.NoError(t, err)
+	require.Len(t, manifest, 2)
+	assert.Equal(t, "/data/shard-1", manifest[1].Dest)
+
+	for content, expected := range map[string]string{
+		`[{"url": "https://example.com/shard-{0..1}.tar", "dest": "/data", "extract": true}]`:                                                       "must expand to a destination per URL",
+		`[{"url": "https://example.com/{a,b}", "dest": "/data", "version_marker": "https://example.com/V", "version_marker_file": "/data/marker"}]`: "can't be shared",
+		`[{"url": "https://example.com/{a,b,c}", "dest": "/data/{a,b}"}]`:                                                                           "expands to 3 URLs",
+	} {
+		_, err := parseManifestFormat(strings.NewReader(content), manifestFormatJSON)
+		assert.ErrorContains(t, err, expected, content)
+	}
+}
+
+func TestParseManifestDestTemplate(t *testing.T) {
+	viper.Set(config.OptDestTemplate, "{{.Host}}/{{.Path}}")
+	defer viper.Set(config.OptDestTemplate, "")
+
+	manifest, err := parseManifest(strings.NewReader("https://example.com/models/a.bin size=1024\n\nhttps://mirror.example.com/shard-{0..1}.tar after=example.com/models/a.bin\n"))
+	require.NoError(t, err)
+	require.Len(t, manifest, 3)
+	assert.Equal(t, "example.com/models/a.bin", manifest[0].Dest)
+	assert.Equal(t, "size=1024", manifest[0].Checksum)
+	assert.Equal(t, "mirror.example.com/shard-1.tar", manifest[2].Dest)
+	assert.Equal(t, []string{"example.com/models/a.bin"}, manifest[2].After)
+
+	manifest, err = parseManifestFormat(strings.NewReader(`[{"url": "https://example.com/shard-{0..1}.tar", "extract": true}]`), manifestFormatJSON)
+	require.NoError(t, err)
+	require.Len(t, manifest, 2)
+	assert.Equal(t, "example.com/shard-1.tar", manifest[1].Dest)
+
+	_, err = parseManifestFormat(strings.NewReader(`[{"url": "https://example.com/a", "dest": "/data/a"}]`), manifestFormatJSON)
+	assert.ErrorContains(t, err, "dest can't be set")
+
+	// the query isn't part of the destination
+	_, err = parseManifest(strings.NewReader("https://example.com/a.bin?v=1\nhttps://example.com/a.bin?v=2\n"))
+	assert.ErrorContains(t, err, "duplicate destination example.com/a.bin")
+
+	viper.Set(config.OptDestTemplate, "{{.Name")
+	_, err = parseManifest(strings.NewReader("https://example.com/a.bin\n"))
+	assert.ErrorContains(t, err, "invalid destination template")
+}
+
+func TestParseManifestStrict(t *testing.T) {
+	viper.Set(config.OptManifestStrict, true)
+	defer viper.Set(config.OptManifestStrict, false)
+
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing.txt")
+	require.NoError(t, os.WriteFile(existing, nil, 0644))
+	content := strings.Join([]string{
+		"https://example.com/file1.txt " + filepath.Join(dir, "file1.txt"),
+		"https://example.com/file2.txt",
+		"ftp://example.com/file3.txt " + filepath.Join(dir, "file3.txt"),
+		"",
+		"https://example.com/file4.txt ../file4.txt",
+		"https://example.com/file5.txt " + filepath.Join(dir, "file1.txt"),
+		"https://example.com/file6.txt " + existing,
+		"https://example.com/file7.txt sub/file7.txt",
+	}, "\n")
+	_, err := parseManifest(strings.NewReader(content))
+	require.Error(t, err)
+	assert.ErrorContains(t, err, "5 problems found in manifest")
+	assert.ErrorContains(t, err, "line 2: error parsing manifest invalid line format")
+	assert.ErrorContains(t, err, "line 3: unsupported scheme in URL ftp://example.com/file3.txt")
+	assert.ErrorContains(t, err, "line 5: destination ../file4.txt escapes the current directory")
+	assert.ErrorContains(t, err, "line 6: duplicate destination "+filepath.Join(dir, "file1.txt")+", already used at line 1")
+	assert.ErrorContains(t, err, "line 7: destination "+existing+" already exists")
+	assert.NotContains(t, err.Error(), "line 8")
+
+	// identical duplicates, which are skipped by default, are errors too
+	_, err = parseManifest(strings.NewReader(validManifest + "\n" + strings.SplitN(validManifest, "\n", 3)[1]))
+	assert.ErrorContains(t, err, "line 6: duplicate destination /tmp/file1.txt, already used at line 2")
+
+	_, err = parseManifestFormat(strings.NewReader(`[
+  {"url": "https://example.com/file1.txt", "dest": "/tmp/rpget-json/file1.txt"},
+  {"url": "s3://bucket/file2.txt", "dest": "/tmp/rpget-json/file2.txt", "mode": "999"}
+]`), manifestFormatJSON)
+	assert.ErrorContains(t, err, "manifest entry 1: invalid mode `999`")
+	assert.NotContains(t, err.Error(), "s3://")
+
+	manifest, err := parseManifest(strings.NewReader(validManifest))
+	require.NoError(t, err)
+	assert.Len(t, manifest, 3)
+}
+
+func TestParseManifestOutputRoot(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "root")
+	outside := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "models"), 0755))
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "escape")))
+	require.NoError(t, os.Symlink(filepath.Join(outside, "missing"), filepath.Join(root, "dangling")))
+	viper.Set(config.OptOutputRoot, root)
+	defer viper.Set(config.OptOutputRoot, "")
+
+	manifest, err := parseManifestFormat(strings.NewReader(`[
+  {"url": "https://example.com/a.bin", "dest": "models/a.bin"},
+  {"url": "https://example.com/b.tar", "dest": "b.tar", "after": ["models/a.bin"], "post": [{"extract": "{{.Dir}}/b"}]}
+]`), manifestFormatJSON)
+	require.NoError(t, err)
+	require.Len(t, manifest, 2)
+	assert.Equal(t, filepath.Join(root, "models/a.bin"), manifest[0].Dest)
+	assert.Equal(t, filepath.Join(root, "b.tar"), manifest[1].Dest)
+	assert.Equal(t, []string{filepath.Join(root, "models/a.bin")}, manifest[1].After)
+
+	for dest, expected := range map[string]string{
+		"/etc/passwd":         "absolute destination /etc/passwd not allowed",
+		"../a.bin":            "destination ../a.bin escapes the output root",
+		"models/../../a.bin":  "escapes the output root",
+		"escape/a.bin":        "outside the output root",
+		"dangling":            "is a dangling symlink",
+		"dangling/nested.bin": "is a dangling symlink",
+	} {
+		_, err := parseManifest(strings.NewReader("https://example.com/a.bin " + dest))
+		assert.ErrorContains(t, err, expected, dest)
+	}
+	_, err = parseManifestFormat(strings.NewReader(`[
+  {"url": "https://example.com/b.tar", "dest": "b.tar", "post": [{"extract": "../b"}]}
+]`), manifestFormatJSON)
+	assert.ErrorContains(t, err, "extract directory ../b")
+	assert.NoDirExists(t, filepath.Join(outside, "missing"))
+	manifest, err = parseManifestFormat(strings.NewReader(`[
+  {"url": "https://example.com/a.bin", "dest": "a.bin", "version_marker": "https://example.com/VERSION", "version_marker_file": "models/a.version"}
+]`), manifestFormatJSON)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "models/a.version"), manifest[0].VersionMarkerFile)
+	// commands could write anywhere
+	_, err = parseManifestFormat(strings.NewReader(`[
+  {"url": "https://example.com/a.bin", "dest": "a.bin", "consumer": "pipe:cat > /tmp/a.bin"}
+]`), manifestFormatJSON)
+	assert.ErrorContains(t, err, "pipe consumer of a.bin not allowed with an output root")
+	_, err = parseManifestFormat(strings.NewReader(`[
+  {"url": "https://example.com/a.bin", "dest": "a.bin", "post": [{"run": ["cp", "{{.Dest}}", "/tmp/a.bin"]}]}
+]`), manifestFormatJSON)
+	assert.ErrorContains(t, err, "run post action of a.bin not allowed with an output root")
+	for markerFile, expected := range map[string]string{
+		"../a.version":     "version marker file ../a.version escapes the output root",
+		"escape/a.version": "outside the output root",
+	} {
+		_, err = parseManifestFormat(strings.NewReader(`[
+  {"url": "https://example.com/a.bin", "dest": "a.bin", "version_marker": "https://example.com/VERSION", "version_marker_file": "`+markerFile+`"}
+]`), manifestFormatJSON)
+		assert.ErrorContains(t, err, expected, markerFile)
+	}
+
+	// strict mode reports escapes with the other problems, once each
+	viper.Set(config.OptManifestStrict, true)
+	defer viper.Set(config.OptManifestStrict, false)
+	_, err = parseManifest(strings.NewReader("https://example.com/a.bin ../a.bin\nftp://example.com/b.bin b.bin"))
+	assert.ErrorContains(t, err, "2 problems found in manifest")
+	assert.ErrorContains(t, err, "line 1: destination ../a.bin escapes the output root")
+	assert.ErrorContains(t, err, "line 2: unsupported scheme")
+}
+
 func TestManifestFile(t *testing.T) {
 	tempFile, _ := os.CreateTemp("", "manifest")
 	defer func() {
@@ -87,3 +395,168 @@ func TestManifestFile(t *testing.T) {
 	_, err = manifestFile("/does/not/exist")
 	assert.Error(t, err)
 }
+
+const jsonManifest = `[
+  {"url": "https://example.com/file1.txt", "dest": "/tmp/rpget-json/file1.txt"},
+  {"url": "https://example.com/file2.tar", "dest": "/tmp/rpget-json/file2", "headers": {"Authorization": "Bearer xyz"},
+   "checksum": "size=1024", "mode": "0600", "extract": true}
+]`
+
+const yamlManifest = `
+- url: https://example.com/file1.txt
+  dest: /tmp/rpget-yaml/file1.txt
+- url: https://example.com/file2.tar
+  dest: /tmp/rpget-yaml/file2
+  headers:
+    Authorization: Bearer xyz
+  checksum: size=1024
+  mode: 0600
+  extract: true
+`
+
+func TestParseStructuredManifest(t *testing.T) {
+	for format, content := range map[string]string{manifestFormatJSON: jsonManifest, manifestFormatYAML: yamlManifest} {
+		manifest, err := parseManifestFormat(strings.NewReader(content), format)
+		require.NoError(t, err, format)
+		require.Len(t, manifest, 2, format)
+
+		assert.Equal(t, "https://example.com/file1.txt", manifest[0].URL)
+		assert.Nil(t, manifest[0].Consumer)
+		assert.Zero(t, manifest[0].Mode)
+
+		assert.Equal(t, map[string]string{"Authorization": "Bearer xyz"}, manifest[1].Headers, format)
+		assert.Equal(t, "size=1024", manifest[1].Checksum, format)
+		assert.Equal(t, os.FileMode(0600), manifest[1].Mode, format)
+		assert.IsType(t, &consumer.TarExtractor{}, manifest[1].Consumer, format)
+	}
+
+	invalid := []string{
+		`[{"url": "https://example.com/file1.txt"}]`,
+		`[{"url": "https://example.com/file1.txt", "dest": "/tmp/file1.txt", "unknown": true}]`,
+		`[{"url": "https://example.com/file1.txt", "dest": "/tmp/file1.txt", "mode": "999"}]`,
+		`[{"url": "https://example.com/file1.txt", "dest": "/tmp/file1.txt", "checksum": "md5:abc"}]`,
+		`[{"url": "https://example.com/file1.txt", "dest": "/tmp/file1.txt", "version_marker_file": "/tmp/file1.version"}]`,
+		`{"url": "https://example.com/file1.txt", "dest": "/tmp/file1.txt"}`,
+	}
+	for _, content := range invalid {
+		_, err := parseManifestFormat(strings.NewReader(content), manifestFormatJSON)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestParseStructuredManifestPost(t *testing.T) {
+	content := `
+- url: https://example.com/archive.tar.gz
+  dest: /tmp/archive.tar.gz
+  post:
+    - extract: "{{.Dir}}/archive"
+    - chmod: "0600"
+    - run: [rm, "{{.Dest}}"]
+`
+	manifest, err := parseManifestFormat(strings.NewReader(content), manifestFormatYAML)
+	require.NoError(t, err)
+	require.Len(t, manifest, 1)
+	require.Len(t, manifest[0].Post, 3)
+	assert.IsType(t, &rpget.ExtractAction{}, manifest[0].Post[0])
+	assert.Equal(t, &rpget.ChmodAction{Mode: 0600}, manifest[0].Post[1])
+	assert.IsType(t, &rpget.RunAction{}, manifest[0].Post[2])
+
+	invalid := []string{
+		`[{"url": "https://example.com/a", "dest": "/tmp/a", "post": [{}]}]`,
+		`[{"url": "https://example.com/a", "dest": "/tmp/a", "post": [{"chmod": "0600", "run": ["true"]}]}]`,
+		`[{"url": "https://example.com/a", "dest": "/tmp/a", "post": [{"chmod": "rwx"}]}]`,
+		`[{"url": "https://example.com/a", "dest": "/tmp/a", "post": [{"run": ["{{.Dest"]}]}]`,
+		`[{"url": "https://example.com/a", "dest": "/tmp/a", "post": [{"unknown": "x"}]}]`,
+	}
+	for _, content := range invalid {
+		_, err := parseManifestFormat(strings.NewReader(content), manifestFormatJSON)
+		assert.Error(t, err, content)
+	}
+}
+
+func TestManifestFormat(t *testing.T) {
+	for path, expected := range map[string]string{
+		"manifest.txt":  manifestFormatText,
+		"manifest":      manifestFormatText,
+		"-":             manifestFormatText,
+		"manifest.json": manifestFormatJSON,
+		"manifest.YAML": manifestFormatYAML,
+		"manifest.yml":  manifestFormatYAML,
+	} {
+		format, err := manifestFormat(path)
+		require.NoError(t, err)
+		assert.Equal(t, expected, format, path)
+	}
+
+	viper.Set(config.OptManifestFormat, manifestFormatJSON)
+	defer viper.Set(config.OptManifestFormat, "")
+	format, err := manifestFormat("manifest.txt")
+	require.NoError(t, err)
+	assert.Equal(t, manifestFormatJSON, format)
+
+	viper.Set(config.OptManifestFormat, "toml")
+	_, err = manifestFormat("manifest.txt")
+	assert.Error(t, err)
+}
+
+// FuzzParseLine checks that any line parseLine accepts is made of a URL, a destination and valid options, and
+// parses back to the same entry once written out again.
+func FuzzParseLine(f *testing.F) {
+	f.Add("https://example.com/file1.txt /tmp/file1.txt")
+	f.Add("https://example.com/file1.txt\t/tmp/file1.txt size=1024 after=/tmp/index")
+	f.Add("https://example.com/file1.txt /tmp/file1.txt sha256:2c26b46b68ffc68ff99b453c1d30413413422d706483bfa0f98a5e886266e7ae")
+	f.Add("https://example.com/file1.txt /tmp/file1.txt after=")
+	f.Fuzz(func(t *testing.T, line string) {
+		entry, err := parseLine(line)
+		if err != nil {
+			return
+		}
+		require.NotEmpty(t, entry.URL)
+		require.NotEmpty(t, entry.Dest)
+		if entry.Checksum != "" {
+			require.NoError(t, rpget.ValidateChecksum(entry.Checksum))
+		}
+		fields := []string{entry.URL, entry.Dest}
+		if entry.Checksum != "" {
+			fields = append(fields, entry.Checksum)
+		}
+		for _, after := range entry.After {
+			require.NotEmpty(t, after)
+			fields = append(fields, afterPrefix+after)
+		}
+		reparsed, err := parseLine(strings.Join(fields, " "))
+		require.NoError(t, err)
+		require.Equal(t, entry, reparsed)
+	})
+}
+
+// FuzzParseManifest checks that manifests of every format either fail to parse or yield entries with a URL, a
+// unique destination and a valid checksum.
+func FuzzParseManifest(f *testing.F) {
+	for _, format := range []string{manifestFormatText, manifestFormatJSON, manifestFormatYAML} {
+		f.Add(format, validManifest)
+		f.Add(format, invalidManifest)
+	}
+	f.Add(manifestFormatJSON, `[{"url": "https://example.com/a.tar", "dest": "/tmp/a", "checksum": "size=10", "mode": "0644", "after": ["/tmp/b"]}]`)
+	f.Add(manifestFormatJSON, `[{"url": "https://example.com/a.tar", "dest": "/tmp/a", "post": [{"chmod": "0755"}, {"run": ["true"]}]}]`)
+	f.Add(manifestFormatYAML, "- url: https://example.com/a.tar\n  dest: /tmp/a\n  headers:\n    X-Token: xyz\n")
+	f.Fuzz(func(t *testing.T, format, data string) {
+		if format != manifestFormatText && format != manifestFormatJSON && format != manifestFormatYAML {
+			t.Skip("unknown format")
+		}
+		manifest, err := parseManifestFormat(strings.NewReader(data), format)
+		if err != nil {
+			return
+		}
+		destinations := make(map[string]bool, len(manifest))
+		for _, entry := range manifest {
+			require.NotEmpty(t, entry.URL)
+			require.NotEmpty(t, entry.Dest)
+			require.False(t, destinations[entry.Dest], "duplicate destination %s", entry.Dest)
+			destinations[entry.Dest] = true
+			if entry.Checksum != "" {
+				require.NoError(t, rpget.ValidateChecksum(entry.Checksum))
+			}
+		}
+	})
+}
@@ -2,8 +2,12 @@ package multifile
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"path/filepath"
+	"slices"
 	"time"
 
 	"github.com/dustin/go-humanize"
@@ -12,7 +16,6 @@ import (
 
 	rpget "github.com/emaballarin/rpget/pkg"
 	"github.com/emaballarin/rpget/pkg/cli"
-	"github.com/emaballarin/rpget/pkg/client"
 	"github.com/emaballarin/rpget/pkg/config"
 	"github.com/emaballarin/rpget/pkg/download"
 	"github.com/emaballarin/rpget/pkg/logging"
@@ -25,8 +28,12 @@ The manifest is expected to be in the format of a newline-separated list of pair
 e.g.
 https://example.com/file1.txt /tmp/file1.txt
 
-'multifile'' will download files in parallel limited to the '--maximum-connections-per-host' limit for per-host limts and
-over-all limited to the '--max-concurrency' limit for overall concurrency.
+Manifests may also be JSON or YAML lists of entries with the fields url, dest, headers, checksum, mode, extract,
+consumer, overwrite, strip_components, after, post, priority, version_marker, version_marker_file and download_mode.
+The format is inferred from the file extension (.json, .yaml, .yml) or set with --manifest-format.
+
+'multifile' will download files in parallel, limited to '--max-connections-per-host' connections to each host and
+'--max-total-connections' connections overall. With a cache service, the hosts are the cache hosts.
 `
 
 const multifileExamples = `
@@ -35,6 +42,8 @@ const multifileExamples = `
   rpget multifile - < manifest.txt
 
   cat multifile.txt | rpget multifile -
+
+  rpget multifile manifest.yaml
 `
 
 // test seam
@@ -52,12 +61,28 @@ func GetCommand() *cobra.Command {
 		RunE:    runMultifileCMD,
 		Example: multifileExamples,
 	}
+	cmd.Flags().Bool(config.OptBatch, false, "Fetch files from origins supporting batch requests as a single tar stream per batch")
+	cmd.Flags().Bool(config.OptCoalesceSmallFiles, false, "Fetch files no larger than --chunk-size with a single streamed request on shared connections")
+	cmd.Flags().Bool(config.OptContinueOnError, false, "Keep downloading the other files when one fails, then exit with an error listing the failed URLs")
+	cmd.Flags().Int(config.OptManifestRetries, 0, "Retry the files which failed in up to this many more passes once the others are done, waiting 1s, then twice as long before each pass")
+	cmd.Flags().Int(config.OptMaxConcurrentFilesPerHost, 0, "Maximum number of files downloaded at once from each host (0 for no limit)")
+	cmd.Flags().String(config.OptSchedule, string(rpget.ScheduleManifest), "Order in which files of equal priority are started (manifest, largest-first, smallest-first)")
+	cmd.Flags().Int(config.OptMaxConcurrentExtracts, 0, "Maximum number of entries extracted at once, shared by all the archives of the manifest (0 for one per CPU)")
+	cmd.Flags().String(config.OptManifestFormat, "", "Manifest format (text, json, yaml), inferred from the file extension if unset")
+	cmd.Flags().Bool(config.OptManifestStrict, false, "Validate the whole manifest before downloading anything, reporting every problem with its location: only http(s) URLs, no relative destinations escaping the current directory, no duplicate destinations")
+	cmd.Flags().String(config.OptDestTemplate, "", "Compute the destination of every entry from its URL with this template (e.g. '{{.Host}}/{{.Path}}'), from .Scheme, .Host, .Port, .Path, .Dir, .Name and .Ext; manifest entries then have no destination")
+	cmd.Flags().String(config.OptOutputRoot, "", "Resolve every manifest destination inside this directory, rejecting absolute destinations, those escaping it with '..' or through a symlink, and entries running commands")
 
 	err := viper.BindPFlags(cmd.PersistentFlags())
 	if err != nil {
 		fmt.Println(err)
 		os.Exit(1)
 	}
+	err = viper.BindPFlags(cmd.Flags())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	cmd.SetUsageTemplate(cli.UsageTemplate)
 	return cmd
 }
@@ -69,26 +94,43 @@ func multifilePreRunE(cmd *cobra.Command, args []string) error {
 	if viper.GetString(config.OptOutputConsumer) == config.ConsumerTarExtractor {
 		return fmt.Errorf("cannot use --output-consumer tar-extractor with multifile mode")
 	}
+	if viper.GetString(config.OptOutputConsumer) == config.ConsumerStdout {
+		return fmt.Errorf("cannot use --output-consumer stdout with multifile mode")
+	}
 	return nil
 }
 
 func runMultifileCMD(cmd *cobra.Command, args []string) error {
 	cmd.SilenceUsage = true
-	manifestPath := args[0]
-	file, err := manifestFile(manifestPath)
+	manifest, err := ReadManifest(args[0])
 	if err != nil {
 		return err
 	}
+
+	return Execute(cmd.Context(), manifest, "")
+}
+
+// ReadManifest reads the manifest at manifestPath, or on stdin if it is -, with the manifest options configured on
+// the command line (--manifest-format, --manifest-strict, --dest-template and --output-root).
+func ReadManifest(manifestPath string) (rpget.Manifest, error) {
+	file, err := manifestFile(manifestPath)
+	if err != nil {
+		return nil, err
+	}
 	defer file.Close()
-	manifest, err := parseManifest(file)
+	format, err := manifestFormat(manifestPath)
 	if err != nil {
-		return fmt.Errorf("error processing manifest file %s: %w", manifestPath, err)
+		return nil, err
 	}
-
-	return multifileExecute(cmd.Context(), manifest)
+	manifest, err := parseManifestFormat(file, format)
+	if err != nil {
+		return nil, fmt.Errorf("error processing manifest file %s: %w", manifestPath, err)
+	}
+	return manifest, nil
 }
 
-func maxConcurrentFiles() int {
+// MaxConcurrentFiles returns the maximum number of files handled at once, 20 unless configured.
+func MaxConcurrentFiles() int {
 	maxConcurrentFiles := viper.GetInt(config.OptMaxConcurrentFiles)
 	if maxConcurrentFiles == 0 {
 		maxConcurrentFiles = 20
@@ -96,72 +138,96 @@ func maxConcurrentFiles() int {
 	return maxConcurrentFiles
 }
 
-func multifileExecute(ctx context.Context, manifest rpget.Manifest) error {
-	chunkSize, err := humanize.ParseBytes(viper.GetString(config.OptChunkSize))
+// Execute downloads every entry of manifest using the options configured on the command line. Credentials given
+// without a host are sent to the host of authURL; if it is empty, they are rejected.
+func Execute(ctx context.Context, manifest rpget.Manifest, authURL string) error {
+	downloadOpts, err := cli.DownloadOptions(authURL)
 	if err != nil {
 		return err
 	}
-
-	// Get the resolution overrides
-	resolveOverrides, err := config.ResolveOverridesToMap(viper.GetStringSlice(config.OptResolve))
-	if err != nil {
-		return fmt.Errorf("error parsing resolve overrides: %w", err)
-	}
-
-	clientOpts := client.Options{
-		MaxRetries: viper.GetInt(config.OptRetries),
-		TransportOpts: client.TransportOptions{
-			ForceHTTP2:       viper.GetBool(config.OptForceHTTP2),
-			ConnectTimeout:   viper.GetDuration(config.OptConnTimeout),
-			MaxConnPerHost:   viper.GetInt(config.OptMaxConnPerHost),
-			ResolveOverrides: resolveOverrides,
-		},
-	}
-	downloadOpts := download.Options{
-		MaxConcurrency: viper.GetInt(config.OptConcurrency),
-		ChunkSize:      int64(chunkSize),
-		Client:         clientOpts,
+	urls := make([]string, len(manifest))
+	hosts := make(map[string]bool)
+	for i, entry := range manifest {
+		urls[i] = entry.URL
+		if u, err := url.Parse(entry.URL); err == nil {
+			hosts[u.Host] = true
+		}
+		if entry.DownloadMode == download.ModeConsistentHashing && downloadOpts.SliceSize == 0 {
+			return fmt.Errorf("%s mode for %s requires cache hosts in consistent hashing mode", entry.DownloadMode, entry.Dest)
+		}
 	}
-	rpgetOpts := rpget.Options{
-		MaxConcurrentFiles: maxConcurrentFiles(),
-		MetricsEndpoint:    viper.GetString(config.OptMetricsEndpoint),
+	if err := cli.CheckURLPolicy(downloadOpts.Client.Policy, urls...); err != nil {
+		return err
 	}
-
 	consumer, err := config.GetConsumer()
 	if err != nil {
 		return fmt.Errorf("error getting consumer: %w", err)
 	}
-
-	getter := rpget.Getter{
-		Consumer: consumer,
-		Options:  rpgetOpts,
+	routes, err := cli.ConsumerRoutes()
+	if err != nil {
+		return err
 	}
-
-	// TODO DRY this
-	if srvName := config.GetCacheSRV(); srvName != "" {
-		downloadOpts.SliceSize = 500 * humanize.MiByte
-		downloadOpts.CacheableURIPrefixes = config.CacheableURIPrefixes()
-		downloadOpts.ForceCachePrefixRewrite = viper.GetBool(config.OptForceCachePrefixRewrite)
-		if downloadOpts.CacheHosts, err = cli.LookupCacheHosts(srvName); err != nil {
-			return err
-		}
-		getter.Downloader, err = download.GetConsistentHashingMode(downloadOpts)
-		if err != nil {
-			return err
-		}
-	} else if cacheHostname := config.CacheServiceHostname(); cacheHostname != "" {
-		downloadOpts.CacheHosts = []string{cacheHostname}
-		downloadOpts.CacheableURIPrefixes = config.CacheableURIPrefixes()
-		downloadOpts.ForceCachePrefixRewrite = viper.GetBool(config.OptForceCachePrefixRewrite)
+	schedule, err := rpget.ParseSchedule(viper.GetString(config.OptSchedule))
+	if err != nil {
+		return err
 	}
+	maxConcurrentFiles, concurrency := cli.FitOpenFileLimit(MaxConcurrentFiles(), downloadOpts.MaxConcurrency,
+		len(hosts), downloadOpts.MaxConnectionsPerHost)
+	downloadOpts.MaxConcurrency = concurrency
 
-	if getter.Downloader == nil {
-		getter.Downloader = download.GetBufferMode(downloadOpts)
+	opts := []rpget.Option{
+		rpget.WithDownloadOptions(downloadOpts),
+		rpget.WithConsumer(consumer),
+		rpget.WithConsumerRoutes(routes...),
+		rpget.WithMaxConcurrentFiles(maxConcurrentFiles),
+		rpget.WithMaxConcurrentFilesPerHost(viper.GetInt(config.OptMaxConcurrentFilesPerHost)),
+		rpget.WithSchedule(schedule),
+		rpget.WithMaxConcurrentExtracts(viper.GetInt(config.OptMaxConcurrentExtracts)),
+		rpget.WithIdempotent(viper.GetBool(config.OptIdempotent)),
+		rpget.WithSkipExisting(rpget.SkipExisting(viper.GetString(config.OptSkipExisting))),
+		rpget.WithHooks(cli.Hooks()),
+		rpget.WithContinueOnError(viper.GetBool(config.OptContinueOnError)),
+		rpget.WithManifestRetries(viper.GetInt(config.OptManifestRetries)),
+		rpget.WithOffsetWrites(viper.GetBool(config.OptOffsetWrites)),
+		rpget.WithContentCache(viper.GetString(config.OptCacheDir)),
+		rpget.WithMetricsEndpoint(viper.GetString(config.OptMetricsEndpoint)),
+	}
+	if viper.GetString(config.OptReportJSON) != "" {
+		opts = append(opts, rpget.WithReport(rpget.NewReport()))
+	}
+	getter, err := rpget.New(opts...)
+	if err != nil {
+		return err
+	}
+	if viper.GetBool(config.OptBatch) {
+		getter.Batcher = download.GetBatchMode(downloadOpts)
+	}
+	if err := cli.RunAs(); err != nil {
+		return err
+	}
+	if err := cli.Sandbox(destinationDirs(manifest)...); err != nil {
+		return err
+	}
+	if err := cli.WaitForFiles(ctx, getter, manifest); err != nil {
+		return err
+	}
+	if viper.GetBool(config.OptCoalesceSmallFiles) {
+		if downloadOpts.CacheHosts != nil {
+			logger := logging.GetLogger()
+			logger.Warn().Msg("--coalesce-small-files is not supported with a cache service, ignoring")
+		} else {
+			getter.Downloader = download.GetSmallFileMode(downloadOpts, downloadOpts.ChunkSize, getter.Downloader)
+		}
 	}
 
 	totalFileSize, elapsedTime, err := getter.DownloadFiles(ctx, manifest)
+	if getter.Report != nil {
+		if reportErr := getter.Report.WriteFile(viper.GetString(config.OptReportJSON)); reportErr != nil {
+			err = errors.Join(err, reportErr)
+		}
+	}
 	if err != nil {
-		return err
+		return cli.ExplainOpenFileLimit(err)
 	}
 
 	throughput := float64(totalFileSize) / elapsedTime.Seconds()
@@ -173,5 +239,27 @@ func multifileExecute(ctx context.Context, manifest rpget.Manifest) error {
 		Str("elapsed_time", fmt.Sprintf("%.3fs", elapsedTime.Seconds())).
 		Msg("Metrics")
 
+	cli.OnAllComplete(len(manifest), totalFileSize)
 	return nil
 }
+
+// destinationDirs returns the directories the entries of manifest are written to, including those their extract
+// post actions extract into and their version markers are stored in.
+func destinationDirs(manifest rpget.Manifest) []string {
+	dirs := make([]string, 0, len(manifest))
+	for _, entry := range manifest {
+		dirs = append(dirs, filepath.Dir(entry.Dest))
+		if entry.VersionMarker != "" {
+			dirs = append(dirs, filepath.Dir(rpget.VersionMarkerFile(entry)))
+		}
+		for _, action := range entry.Post {
+			if extract, ok := action.(*rpget.ExtractAction); ok {
+				if dir, err := extract.Dir(entry); err == nil {
+					dirs = append(dirs, dir)
+				}
+			}
+		}
+	}
+	slices.Sort(dirs)
+	return slices.Compact(dirs)
+}
@@ -0,0 +1,87 @@
+package multifile
+
+import (
+	"fmt"
+	"path/filepath"
+
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/fsutil"
+)
+
+// confineToOutputRoot resolves the destinations of entries, and of their After dependencies, inside root, for
+// --output-root. Absolute destinations and those escaping root, with `..` or through a symlink, are recorded as
+// problems and their entries dropped. The directories of extract post actions, and version marker files, must
+// resolve inside root too. Entries running commands, piped into by their consumer or run as post actions, are
+// rejected: they could write anywhere.
+func confineToOutputRoot(entries []rpget.ManifestEntry, locations []string, root string, problems *manifestProblems) ([]rpget.ManifestEntry, []string, error) {
+	resolvedRoot, err := fsutil.ResolveExisting(root)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error resolving output root %s: %w", root, err)
+	}
+	confined := make([]rpget.ManifestEntry, 0, len(entries))
+	confinedLocations := make([]string, 0, len(locations))
+	for i, entry := range entries {
+		if err := confineEntry(&entry, root, resolvedRoot); err != nil {
+			if problems.add(locations[i], err) {
+				return nil, nil, problems.err()
+			}
+			continue
+		}
+		confined = append(confined, entry)
+		confinedLocations = append(confinedLocations, locations[i])
+	}
+	return confined, confinedLocations, nil
+}
+
+func confineEntry(entry *rpget.ManifestEntry, root, resolvedRoot string) error {
+	if _, ok := entry.Consumer.(*consumer.Command); ok {
+		return fmt.Errorf("pipe consumer of %s not allowed with an output root", entry.Dest)
+	}
+	for _, action := range entry.Post {
+		if _, ok := action.(*rpget.RunAction); ok {
+			return fmt.Errorf("run post action of %s not allowed with an output root", entry.Dest)
+		}
+	}
+	dest, err := fsutil.InsideRoot(root, resolvedRoot, entry.Dest)
+	if err != nil {
+		return err
+	}
+	after := make([]string, len(entry.After))
+	for i, dependency := range entry.After {
+		// dependencies escaping the root can't name an entry, which is reported as for any unknown dependency
+		after[i] = dependency
+		if filepath.IsLocal(dependency) {
+			after[i] = filepath.Join(root, dependency)
+		}
+	}
+	if entry.VersionMarkerFile != "" {
+		if filepath.IsAbs(entry.VersionMarkerFile) || !filepath.IsLocal(entry.VersionMarkerFile) {
+			return fmt.Errorf("version marker file %s escapes the output root", entry.VersionMarkerFile)
+		}
+		entry.VersionMarkerFile = filepath.Join(root, entry.VersionMarkerFile)
+	}
+	entry.Dest = dest
+	if len(after) > 0 {
+		entry.After = after
+	}
+	if entry.VersionMarker != "" {
+		if err := fsutil.CheckInside(rpget.VersionMarkerFile(*entry), resolvedRoot); err != nil {
+			return fmt.Errorf("version marker file %s: %w", rpget.VersionMarkerFile(*entry), err)
+		}
+	}
+	for _, action := range entry.Post {
+		extract, ok := action.(*rpget.ExtractAction)
+		if !ok {
+			continue
+		}
+		dir, err := extract.Dir(*entry)
+		if err != nil {
+			return err
+		}
+		if err := fsutil.CheckInside(dir, resolvedRoot); err != nil {
+			return fmt.Errorf("extract directory %s: %w", dir, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,100 @@
+package recovery
+
+import (
+	"context"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/cli"
+	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/logging"
+	"github.com/emaballarin/rpget/pkg/scratch"
+	"github.com/emaballarin/rpget/pkg/wal"
+)
+
+const longDesc = `
+'recover' cleans up after rpget processes which crashed, using the write-ahead log they kept in --wal-dir. Files left
+incomplete by a crash are removed, and the downloads that were interrupted are listed, or downloaded again with
+--resume. Interrupted extractions are resumed from their extraction journal when there is one (see --extract-resume).
+
+The logs of rpget processes which are still running are left alone.
+`
+
+const recoverExamples = `
+  rpget --wal-dir /var/lib/rpget/wal https://example.com/model.tar ./model -x
+  # ... rpget crashes ...
+  rpget --wal-dir /var/lib/rpget/wal recover --resume
+`
+
+func GetCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "recover [flags]",
+		Short:   "clean up or resume the operations of crashed rpget processes",
+		Long:    longDesc,
+		Args:    cobra.NoArgs,
+		RunE:    runRecoverCMD,
+		Example: recoverExamples,
+	}
+	cmd.Flags().Bool(config.OptResume, false, "Download the interrupted downloads again, rather than only listing them")
+
+	err := viper.BindPFlags(cmd.Flags())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	cmd.SetUsageTemplate(cli.UsageTemplate)
+	return cmd
+}
+
+func runRecoverCMD(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+	logger := logging.GetLogger()
+	dir := viper.GetString(config.OptWALDir)
+	if dir == "" {
+		return fmt.Errorf("--%s is required to recover", config.OptWALDir)
+	}
+	var resume func(wal.Op) error
+	if viper.GetBool(config.OptResume) {
+		resume = func(op wal.Op) error {
+			return resumeDownload(cmd.Context(), op)
+		}
+	}
+	downloads, err := wal.Recover(dir, resume)
+	logger.Info().Int("interrupted_downloads", len(downloads)).Msg("Recovered")
+	return err
+}
+
+// resumeDownload downloads op again, overwriting whatever the interrupted download left at its destination.
+func resumeDownload(ctx context.Context, op wal.Op) error {
+	logger := logging.GetLogger()
+	logger.Info().Str("url", op.URL).Str("dest", op.Dest).Bool("extract", op.Extract).Msg("Resuming download")
+	downloadOpts, err := cli.DownloadOptions(op.URL)
+	if err != nil {
+		return err
+	}
+	var c consumer.Consumer = &consumer.FileWriter{Overwrite: true, TempDir: scratch.Dir()}
+	if op.Extract {
+		extractOpts, err := config.ExtractOptions()
+		if err != nil {
+			return err
+		}
+		extractOpts.Overwrite = true
+		extractOpts.Resume = true
+		c = &consumer.TarExtractor{Options: extractOpts}
+	}
+	getter, err := rpget.New(
+		rpget.WithDownloadOptions(downloadOpts),
+		rpget.WithConsumer(c),
+		rpget.WithMetricsEndpoint(viper.GetString(config.OptMetricsEndpoint)),
+	)
+	if err != nil {
+		return err
+	}
+	_, _, err = getter.DownloadFile(ctx, op.URL, op.Dest)
+	return err
+}
@@ -0,0 +1,209 @@
+package ring
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/emaballarin/rpget/pkg/cli"
+	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/consistent"
+	"github.com/emaballarin/rpget/pkg/download"
+)
+
+const longDesc = `
+'ring' prints which cache host every slice of a file is fetched from when downloading through a consistent hashing
+cache (with --ch-algorithm), without downloading anything, so that operators can check how evenly files are spread
+over the cache fleet before changing its hosts. Unavailable hosts, which keep their place in the ring, are given as
+empty entries of --hosts (e.g. 'cache-0,,cache-2'): their slices are fetched from the next host of the ring.
+
+The ring is written to stdout as JSON, or as a Graphviz DOT graph of files and hosts with --format dot.
+`
+
+const ringExamples = `
+  rpget ring --hosts cache-0,cache-1,cache-2 --file-size 20GB https://example.com/model.tar
+  rpget ring --hosts cache-0,cache-1,cache-2,cache-3 --file-size 20GB --format dot https://example.com/model.tar | dot -Tsvg > ring.svg
+`
+
+const (
+	formatJSON = "json"
+	formatDOT  = "dot"
+)
+
+// ring is the JSON export of the ring.
+type ring struct {
+	Algorithm string       `json:"algorithm"`
+	SliceSize int64        `json:"slice_size"`
+	Hosts     []hostShare  `json:"hosts"`
+	Files     []fileSlices `json:"files"`
+	// Fallback counts the slices of unavailable hosts without an available successor, fetched with --ch-fallback
+	Fallback hostShare `json:"fallback"`
+}
+
+// hostShare is the share of the files a cache host serves.
+type hostShare struct {
+	Host   string `json:"host,omitempty"`
+	Slices int    `json:"slices"`
+	Bytes  int64  `json:"bytes"`
+}
+
+type fileSlices struct {
+	URL    string                `json:"url"`
+	Size   int64                 `json:"size"`
+	Slices []download.SliceOwner `json:"slices"`
+}
+
+func GetCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "ring [flags] <url> [<url>...]",
+		Short:   "export which cache host serves every slice of files",
+		Long:    longDesc,
+		Args:    cobra.MinimumNArgs(1),
+		RunE:    runRingCMD,
+		Example: ringExamples,
+	}
+	cmd.Flags().StringSlice(config.OptHosts, []string{}, "Cache hosts of the ring, in order; an empty entry is an unavailable host")
+	cmd.Flags().String(config.OptFileSize, "", "Size of the files, e.g. 20GB")
+	cmd.Flags().String(config.OptSliceSize, humanize.IBytes(cli.SliceSize), "Size of the slices files are cached in")
+	cmd.Flags().String(config.OptFormat, formatJSON, "Output format (json, dot)")
+
+	err := viper.BindPFlags(cmd.Flags())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	cmd.SetUsageTemplate(cli.UsageTemplate)
+	return cmd
+}
+
+func runRingCMD(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+	hosts := viper.GetStringSlice(config.OptHosts)
+	if len(hosts) == 0 {
+		return fmt.Errorf("--%s is required", config.OptHosts)
+	}
+	fileSize, err := parseSize(config.OptFileSize)
+	if err != nil {
+		return err
+	}
+	sliceSize, err := parseSize(config.OptSliceSize)
+	if err != nil {
+		return err
+	}
+	format := viper.GetString(config.OptFormat)
+	if format != formatJSON && format != formatDOT {
+		return fmt.Errorf("invalid --%s %s, expected %s or %s", config.OptFormat, format, formatJSON, formatDOT)
+	}
+	algorithmName := viper.GetString(config.OptCHAlgorithm)
+	algorithm, err := consistent.ParseAlgorithm(algorithmName)
+	if err != nil {
+		return err
+	}
+	if algorithmName == "" {
+		algorithmName = consistent.AlgorithmJump
+	}
+
+	opts := download.Options{CacheHosts: hosts, SliceSize: sliceSize, RingAlgorithm: algorithm}
+	r := ring{Algorithm: algorithmName, SliceSize: sliceSize, Hosts: make([]hostShare, len(hosts))}
+	for i, host := range hosts {
+		r.Hosts[i].Host = host
+	}
+	for _, url := range args {
+		owners, err := download.RingOwners(opts, url, fileSize)
+		if err != nil {
+			return fmt.Errorf("%s: %w", url, err)
+		}
+		for _, owner := range owners {
+			share := &r.Fallback
+			if owner.Bucket >= 0 {
+				share = &r.Hosts[owner.Bucket]
+			}
+			share.Slices++
+			share.Bytes += owner.End - owner.Start + 1
+		}
+		r.Files = append(r.Files, fileSlices{URL: url, Size: fileSize, Slices: owners})
+	}
+
+	if format == formatDOT {
+		return writeDOT(os.Stdout, r)
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+func parseSize(opt string) (int64, error) {
+	value := viper.GetString(opt)
+	if value == "" {
+		return 0, fmt.Errorf("--%s is required", opt)
+	}
+	size, err := humanize.ParseBytes(value)
+	if err != nil {
+		return 0, fmt.Errorf("error parsing --%s: %w", opt, err)
+	}
+	if size == 0 {
+		return 0, fmt.Errorf("--%s must be positive", opt)
+	}
+	return int64(size), nil
+}
+
+// writeDOT writes r as a directed graph from every file to the hosts serving its slices, labelled with how many
+// slices they serve. Hosts are labelled with their share of all the files.
+func writeDOT(w io.Writer, r ring) error {
+	var total int64
+	for _, file := range r.Files {
+		total += file.Size
+	}
+	share := func(h hostShare) string {
+		return fmt.Sprintf("%d slices, %s (%.1f%%)", h.Slices, humanize.IBytes(uint64(h.Bytes)), 100*float64(h.Bytes)/float64(total))
+	}
+	bw := &errWriter{w: w}
+	bw.printf("digraph ring {\n\trankdir=LR;\n")
+	for i, host := range r.Hosts {
+		if host.Host == "" {
+			bw.printf("\thost%d [shape=box, style=dashed, label=%s];\n", i, strconv.Quote(fmt.Sprintf("#%d (unavailable)\n%s", i, share(host))))
+		} else {
+			bw.printf("\thost%d [shape=box, label=%s];\n", i, strconv.Quote(fmt.Sprintf("%s\n%s", host.Host, share(host))))
+		}
+	}
+	if r.Fallback.Slices > 0 {
+		bw.printf("\tfallback [shape=box, style=dashed, label=%s];\n", strconv.Quote("fallback\n"+share(r.Fallback)))
+	}
+	for i, file := range r.Files {
+		bw.printf("\tfile%d [label=%s];\n", i, strconv.Quote(fmt.Sprintf("%s\n%s", file.URL, humanize.IBytes(uint64(file.Size)))))
+		counts := make(map[int]int)
+		for _, owner := range file.Slices {
+			counts[owner.Bucket]++
+		}
+		for bucket := -1; bucket < len(r.Hosts); bucket++ {
+			if counts[bucket] == 0 {
+				continue
+			}
+			node := fmt.Sprintf("host%d", bucket)
+			if bucket < 0 {
+				node = "fallback"
+			}
+			bw.printf("\tfile%d -> %s [label=\"%d\"];\n", i, node, counts[bucket])
+		}
+	}
+	bw.printf("}\n")
+	return bw.err
+}
+
+// errWriter writes to w until a write fails, keeping the error.
+type errWriter struct {
+	w   io.Writer
+	err error
+}
+
+func (e *errWriter) printf(format string, args ...any) {
+	if e.err == nil {
+		_, e.err = fmt.Fprintf(e.w, format, args...)
+	}
+}
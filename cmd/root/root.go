@@ -2,23 +2,35 @@ package root
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"os"
+	"path/filepath"
 	"runtime"
 	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/rs/zerolog/log"
 	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
 	"github.com/spf13/viper"
 
+	"github.com/emaballarin/rpget/cmd/multifile"
 	"github.com/emaballarin/rpget/cmd/version"
 	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/agent"
 	"github.com/emaballarin/rpget/pkg/cli"
 	"github.com/emaballarin/rpget/pkg/client"
 	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/consistent"
+	"github.com/emaballarin/rpget/pkg/consumer"
 	"github.com/emaballarin/rpget/pkg/download"
+	"github.com/emaballarin/rpget/pkg/extract"
 	"github.com/emaballarin/rpget/pkg/logging"
+	"github.com/emaballarin/rpget/pkg/scratch"
+	"github.com/emaballarin/rpget/pkg/server"
+	"github.com/emaballarin/rpget/pkg/wal"
 )
 
 const rootLongDesc = `
@@ -42,6 +54,7 @@ efficient file extractor, providing a streamlined solution for fetching and unpa
 `
 
 var concurrency int
+var maxConnectionsPerHost int
 var pidFile *cli.PIDFile
 var chunkSize string
 
@@ -56,9 +69,19 @@ func GetCommand() *cobra.Command {
 		PersistentPostRunE: rootPersistentPostRunEFunc,
 		RunE:               runRootCMD,
 		Args:               validateArgs,
-		Example:            `  rpget https://example.com/file.tar ./target-dir`,
+		Example: `  rpget https://example.com/file.tar ./target-dir
+  rpget --input - --output-dir ./target-dir < urls.txt`,
 	}
-	cmd.Flags().BoolP(config.OptExtract, "x", false, "Extract archive after download")
+	cmd.Flags().BoolP(config.OptExtract, "x", false, "Extract archive (tar, compressed tar or zip) or decompress file after download")
+	cmd.Flags().Bool(config.OptExtractToStdout, false, "Write the (decompressed) tar archive to stdout instead of extracting it, <dest> is not needed")
+	cmd.Flags().String(config.OptDecompress, "", "With --extract or --extract-to-stdout, decompress with this format (gzip, bzip2, xz, lz4, zstd) instead of detecting it")
+	cmd.Flags().String(config.OptInput, "", "Download the URLs listed in this file, one per line, or on stdin if -, into --output-dir instead of <url> to <dest>")
+	cmd.Flags().String(config.OptOutputDir, ".", "With --input, directory the files are written to, named after the last element of their URL path (or extracted into, with --extract)")
+	cmd.Flags().String(config.OptVersionMarker, "", "URL of a small file identifying the version of the file (e.g. a version or digest); the file is only downloaded again once it changes")
+	cmd.Flags().String(config.OptVersionMarkerFile, "", "Where --version-marker is stored locally (default <dest>.marker)")
+	cmd.Flags().String(config.OptSample, "", "Download this percentage of the chunks of every <url>, chosen pseudo-randomly but always the same for the same file size, and write their SHA-256 checksums to stdout as JSON instead of downloading the files, e.g. 1%; fails if the files differ")
+	cmd.Flags().Bool(config.OptAgent, false, "Download through a background agent which keeps connections warm between invocations, starting it if needed")
+	cmd.Flags().Duration(config.OptAgentIdleTimeout, 5*time.Minute, "Time the background agent stays alive without downloads")
 	cmd.SetUsageTemplate(cli.UsageTemplate)
 	config.ViperInit()
 	if err := persistentFlags(cmd); err != nil {
@@ -111,7 +134,14 @@ func rootPersistentPreRunEFunc(cmd *cobra.Command, args []string) error {
 	if err := config.PersistentStartupProcessFlags(); err != nil {
 		return err
 	}
-	if cmd.CalledAs() != version.VersionCMDName {
+	if err := cli.SetOpenFileLimit(); err != nil {
+		return err
+	}
+	if err := cli.Background(); err != nil {
+		return err
+	}
+	// The daemon must not hold the PID lock, otherwise every other rpget invocation would block behind it
+	if cmd.CalledAs() != version.VersionCMDName && cmd.CalledAs() != config.ServeCMDName {
 		if err := pidFlock(viper.GetString(config.OptPIDFile)); err != nil {
 			return err
 		}
@@ -147,11 +177,51 @@ func rootPersistentPreRunEFunc(cmd *cobra.Command, args []string) error {
 		}
 	}
 
+	if err := scratch.Init(viper.GetString(config.OptTmpDir)); err != nil {
+		return err
+	}
+	if err := wal.Open(viper.GetString(config.OptWALDir)); err != nil {
+		return err
+	}
+
+	if readahead := viper.GetString(config.OptGzipReadahead); readahead != "" {
+		size, err := humanize.ParseBytes(readahead)
+		if err != nil {
+			return fmt.Errorf("invalid --%s %s: %w", config.OptGzipReadahead, readahead, err)
+		}
+		extract.Gzip.Readahead = size
+	}
+	extract.Zstd.Concurrency = viper.GetInt(config.OptZstdConcurrency)
+	if maxWindow := viper.GetString(config.OptZstdMaxWindow); maxWindow != "" {
+		size, err := humanize.ParseBytes(maxWindow)
+		if err != nil {
+			return fmt.Errorf("invalid --%s %s: %w", config.OptZstdMaxWindow, maxWindow, err)
+		}
+		extract.Zstd.MaxWindow = size
+	}
+
+	extractToStdout := viper.GetBool(config.OptExtractToStdout)
+	if viper.GetString(config.OptDecompress) != "" && !viper.GetBool(config.OptExtract) && !extractToStdout {
+		return fmt.Errorf("--%s requires --%s or --%s", config.OptDecompress, config.OptExtract, config.OptExtractToStdout)
+	}
+	if viper.GetBool(config.OptExtract) && extractToStdout {
+		return fmt.Errorf("--%s and --%s cannot be used at the same time", config.OptExtract, config.OptExtractToStdout)
+	}
+	if viper.GetString(config.OptSkipExisting) != "" && viper.GetBool(config.OptIdempotent) {
+		return fmt.Errorf("--%s and --%s cannot be used at the same time", config.OptSkipExisting, config.OptIdempotent)
+	}
 	if viper.GetBool(config.OptExtract) {
 		// TODO: decide what to do when --output is set *and* --extract is set
 		log.Debug().Msg("Tar Extract Enabled")
 		viper.Set(config.OptOutputConsumer, config.ConsumerTarExtractor)
 	}
+	if extractToStdout {
+		if viper.GetString(config.OptReportJSON) == "-" {
+			return fmt.Errorf("--%s cannot write the report to stdout with --%s", config.OptReportJSON, config.OptExtractToStdout)
+		}
+		log.Debug().Msg("Tar Stream To Stdout Enabled")
+		viper.Set(config.OptOutputConsumer, config.ConsumerTarStdout)
+	}
 
 	return nil
 }
@@ -165,20 +235,82 @@ func rootPersistentPostRunEFunc(cmd *cobra.Command, args []string) error {
 
 func persistentFlags(cmd *cobra.Command) error {
 	// Persistent Flags (applies to all commands/subcommands)
-	cmd.PersistentFlags().IntVarP(&concurrency, config.OptConcurrency, "c", runtime.GOMAXPROCS(0)*4, "Maximum number of concurrent downloads/maximum number of chunks for a given file")
+	cmd.PersistentFlags().IntVarP(&concurrency, config.OptMaxTotalConnections, "c", runtime.GOMAXPROCS(0)*4, "Maximum number of chunks downloaded at once, of all files and hosts together")
+	cmd.PersistentFlags().IntVar(&concurrency, config.OptConcurrency, runtime.GOMAXPROCS(0)*4, "Maximum number of concurrent downloads/maximum number of chunks for a given file")
 	cmd.PersistentFlags().IntVar(&concurrency, config.OptMaxChunks, runtime.GOMAXPROCS(0)*4, "Maximum number of chunks for a given file")
+	cmd.PersistentFlags().IntVar(&maxConnectionsPerHost, config.OptMaxConnectionsPerHost, 40, "Maximum number of chunks downloaded at once from the same host, so that a slow host doesn't hold up the files of other hosts (0 for no limit)")
 	cmd.PersistentFlags().Duration(config.OptConnTimeout, 5*time.Second, "Timeout for establishing a connection, format is <number><unit>, e.g. 10s")
 	cmd.PersistentFlags().StringVarP(&chunkSize, config.OptChunkSize, "m", chunkSizeDefault, "Chunk size (in bytes) to use when downloading a file (e.g. 10M)")
 	cmd.PersistentFlags().StringVar(&chunkSize, config.OptMinimumChunkSize, chunkSizeDefault, "Minimum chunk size (in bytes) to use when downloading a file (e.g. 10M)")
+	cmd.PersistentFlags().String(config.OptMaxBufferMemory, "", "Maximum memory the chunk buffers of all files may use at once (e.g. 2GiB); chunk requests wait for memory to be freed once it is reached (unlimited if unset)")
+	cmd.PersistentFlags().Duration(config.OptHedgeAfter, 0, "Send a duplicate request for a chunk whose response hasn't arrived after this long (to another cache host when using consistent hashing), using whichever arrives first, e.g. 500ms (0 to disable)")
 	cmd.PersistentFlags().BoolP(config.OptForce, "f", false, "Force download, overwriting existing file")
+	cmd.PersistentFlags().String(config.OptProxy, "", "Send requests through this proxy (http://, https://, socks5:// or socks5h://host:port) instead of those of HTTP_PROXY/HTTPS_PROXY; NO_PROXY still applies")
+	cmd.PersistentFlags().Int(config.OptPreconnect, 0, "Number of connections to establish to the host of the URL, or to each cache host, alongside the first request, so that the chunk requests which follow don't wait for TCP and TLS handshakes (0 to disable)")
+	cmd.PersistentFlags().String(config.OptIPVersion, string(client.IPVersionAuto), "Connect to hosts over IPv4 (4), IPv6 (6) or both (auto), trying the addresses of a host without waiting for an attempt to time out, so that a broken IPv6 network doesn't stall connections")
+	cmd.PersistentFlags().String(config.OptDoHURL, "", "Resolve hosts with this DNS-over-HTTPS (https://host/dns-query) or DNS-over-TLS (tls://host[:853]) server instead of the system resolver")
+	cmd.PersistentFlags().String(config.OptCacheSocket, "", "Connect to the cache service over this unix socket instead of TCP; without a cache service hostname, the socket is the cache service")
+	cmd.PersistentFlags().StringSlice(config.OptTLSCA, []string{}, "Trust the CA certificates of these PEM files, in addition to the system roots")
+	cmd.PersistentFlags().String(config.OptTLSCert, "", "PEM client certificate to present to servers requesting one (mutual TLS)")
+	cmd.PersistentFlags().String(config.OptTLSKey, "", "PEM private key of --tls-cert, if it isn't in the same file")
+	cmd.PersistentFlags().Bool(config.OptInsecureSkipVerify, false, "Don't verify the certificates of servers (insecure, for testing only)")
 	cmd.PersistentFlags().StringSlice(config.OptResolve, []string{}, "Resolve hostnames to specific IPs")
+	cmd.PersistentFlags().String(config.OptURLPolicy, "", "YAML or JSON file of host and scheme allow and deny lists (allow_hosts, deny_hosts, allow_schemes, deny_schemes) restricting the URLs requested")
+	cmd.PersistentFlags().StringSlice(config.OptAllowHost, []string{}, "Only request URLs of these hosts (e.g. example.com, *.example.com, 10.0.0.0/8), in addition to those of --url-policy")
+	cmd.PersistentFlags().StringSlice(config.OptDenyHost, []string{}, "Never request URLs of these hosts, even if allowed, in addition to those of --url-policy")
+	cmd.PersistentFlags().StringSlice(config.OptAllowScheme, []string{}, "Only request URLs with these schemes (e.g. https), in addition to those of --url-policy")
+	cmd.PersistentFlags().StringSlice(config.OptDenyScheme, []string{}, "Never request URLs with these schemes, in addition to those of --url-policy")
+	cmd.PersistentFlags().Bool(config.OptIdempotent, false, "Succeed without downloading when the destination already exists and matches the remote file (its checksum in a manifest, otherwise its size)")
+	cmd.PersistentFlags().String(config.OptOnComplete, "", "Shell command run once each file has completed, with {url} and {dest} replaced by the URL and destination of the file")
+	cmd.PersistentFlags().String(config.OptOnError, "", "Shell command run when a file fails, with {url}, {dest} and {error} replaced by the URL, destination and error of the file")
+	cmd.PersistentFlags().String(config.OptOnAllComplete, "", "Shell command run once all the files have completed, with {files} and {bytes} replaced by the number of files and of bytes downloaded")
+	cmd.PersistentFlags().String(config.OptSkipExisting, "", "Skip the files whose destination already exists and is unchanged on the server, asking it with a conditional request on the recorded ETag ('etag') or the modification time of the destination ('mtime'), or comparing sizes ('size'); other destinations are replaced")
+	cmd.PersistentFlags().StringArray(config.OptAuthToken, []string{}, "Send a bearer token to a host, format '[<host>=]<token>'; without a host, it is sent to the host of the URL (repeatable)")
+	cmd.PersistentFlags().StringArray(config.OptAuthBasic, []string{}, "Send basic auth credentials to a host, format '[<host>=]<user>:<password>'; without a host, they are sent to the host of the URL (repeatable)")
+	cmd.PersistentFlags().String(config.OptAWSSigV4, "", "Sign requests with AWS SigV4 for this '<region>/<service>' (e.g. us-east-1/s3), using the credentials of the environment or ~/.aws/credentials")
+	cmd.PersistentFlags().StringArray(config.OptHeader, []string{}, "Add a header to every request, format '<key>: <value>' (repeatable)")
+	cmd.PersistentFlags().Bool(config.OptCookies, false, "Keep the cookies set by responses, redirects included, and send them back with the requests which follow, for origins which set a cookie before serving the file")
+	cmd.PersistentFlags().String(config.OptCookieFile, "", "Load cookies from this Netscape cookie file (cookies.txt, as written by curl --cookie-jar or exported by browsers); implies --cookies")
 	cmd.PersistentFlags().IntP(config.OptRetries, "r", 5, "Number of retries when attempting to retrieve a file")
 	cmd.PersistentFlags().BoolP(config.OptVerbose, "v", false, "Verbose mode (equivalent to --log-level debug)")
 	cmd.PersistentFlags().String(config.OptLoggingLevel, "info", "Log level (debug, info, warn, error)")
 	cmd.PersistentFlags().Bool(config.OptForceHTTP2, false, "Force HTTP/2")
-	cmd.PersistentFlags().Int(config.OptMaxConnPerHost, 40, "Maximum number of (global) concurrent connections per host")
-	cmd.PersistentFlags().StringP(config.OptOutputConsumer, "o", "file", "Output Consumer (file, tar, null)")
+	cmd.PersistentFlags().String(config.OptCHAlgorithm, consistent.AlgorithmJump, "Algorithm mapping slices to cache hosts in consistent hashing mode (jump, rendezvous)")
+	cmd.PersistentFlags().StringArray(config.OptHostMode, []string{}, "Force the mode files of a host are fetched in with consistent hashing, format '<host>=<mode>' (buffer, consistent-hashing), whether or not it matches a cacheable URI prefix (repeatable)")
+	cmd.PersistentFlags().String(config.OptCHFallback, string(download.FallbackOrigin), "How files the cache hosts can't serve are fetched in consistent hashing mode (origin, single, mirror, fail)")
+	cmd.PersistentFlags().String(config.OptCHFallbackMirror, "", "With --ch-fallback mirror, base URL of the mirror files are fetched from instead of origin")
+	cmd.PersistentFlags().IntVar(&maxConnectionsPerHost, config.OptMaxConnPerHost, 40, "Maximum number of (global) concurrent connections per host")
+	cmd.PersistentFlags().StringP(config.OptOutputConsumer, "o", "file", "Output Consumer (file, tar, null, stdout)")
 	cmd.PersistentFlags().String(config.OptPIDFile, defaultPidFilePath(), "PID file path")
+	cmd.PersistentFlags().Uint64(config.OptOpenFileLimit, 0, "Set the limit on open files (RLIMIT_NOFILE) to this value on start; beyond the hard limit, this requires root. Concurrency is lowered to fit the limit either way")
+	cmd.PersistentFlags().Bool(config.OptDirectIO, false, "Write files bypassing the page cache (O_DIRECT on Linux, F_NOCACHE on macOS), so downloading very large files doesn't evict memory in use; filesystems without direct I/O are written to as usual")
+	cmd.PersistentFlags().Bool(config.OptOffsetWrites, false, "Write every chunk straight to its offset in the destination file as soon as it arrives, rather than reassembling chunks in order in memory; checksums are verified by reading the file back")
+	cmd.PersistentFlags().Bool(config.OptNoPreallocate, false, "Don't reserve the disk space of files before writing them (fallocate on Linux); preallocating avoids fragmentation and fails downloads which don't fit on the disk before they start")
+	cmd.PersistentFlags().String(config.OptTmpDir, "", "Directory for temporary files (partial downloads, spooled zip archives), removed on exit; by default they are created next to their destination")
+	cmd.PersistentFlags().String(config.OptSimulateBandwidth, "", "Testing: read response bodies at this rate per second (e.g. 10MB), shared by all requests, to simulate a slow network")
+	cmd.PersistentFlags().Duration(config.OptSimulateLatency, 0, "Testing: wait this long before sending every request, to simulate a slow network")
+	cmd.PersistentFlags().String(config.OptCacheDir, "", "Directory of a content-addressed cache: downloaded files are stored there by digest and destinations are clones of or hardlinks to them, so downloading the same content again is instant")
+	cmd.PersistentFlags().Bool(config.OptWaitForURL, false, "Before downloading, poll each URL with backoff until it exists, for artifacts still being published")
+	cmd.PersistentFlags().Duration(config.OptWaitTimeout, 0, "With --wait-for-url, give up waiting after this long (e.g. 10m, 0 for no limit)")
+	cmd.PersistentFlags().String(config.OptRunAs, "", "When started as root, drop privileges to this user, format '<user>[:<group>]', once TLS keys, credentials and the PID file are read and before downloading")
+	cmd.PersistentFlags().Bool(config.OptBackground, false, "Run at the lowest CPU and I/O priority (nice 19, and the idle I/O class on Linux), downloading fewer chunks and files at once unless configured, so that prefetching doesn't slow down latency-sensitive workloads on the same host")
+	cmd.PersistentFlags().Bool(config.OptSandbox, false, "Once started, only allow writes beneath the destinations and temporary directories (Landlock) and deny system calls rpget never needs (seccomp); Linux only")
+	cmd.PersistentFlags().String(config.OptWALDir, "", "Directory of the write-ahead log of in-progress downloads, which 'rpget recover' uses to clean up after a crash")
+	cmd.PersistentFlags().String(config.OptReportJSON, "", "Write a JSON report of the downloaded files to this path ('-' for stdout)")
+	cmd.PersistentFlags().String(config.OptExtractChecksums, "", "Write the SHA-256 of every extracted file to this path, relative to the extraction directory (default \""+extract.ChecksumsFileName+"\" if set without a value)")
+	cmd.PersistentFlags().Lookup(config.OptExtractChecksums).NoOptDefVal = extract.ChecksumsFileName
+	cmd.PersistentFlags().String(config.OptExtractCaseCollisions, string(extract.CaseCollisionsWarn), "When extracting on macOS or Windows, what to do with archive paths differing only by case (warn, fail)")
+	cmd.PersistentFlags().String(config.OptExtractDuplicates, string(extract.DuplicatesLastWins), "When extracting, what to do with paths found more than once in the archive (last-wins, first-wins, fail)")
+	cmd.PersistentFlags().StringSlice(config.OptExtractInclude, []string{}, "When extracting, only write archive entries matching one of these glob patterns")
+	cmd.PersistentFlags().StringSlice(config.OptExtractExclude, []string{}, "When extracting, skip archive entries matching one of these glob patterns")
+	cmd.PersistentFlags().String(config.OptExtractPreserve, "", "When extracting, comma separated archive metadata to apply to extracted files (owner, times, xattrs); owner requires root")
+	cmd.PersistentFlags().Bool(config.OptExtractResume, false, "When extracting, journal the extracted files so that extracting the same archive again after a failure skips the files already written")
+	cmd.PersistentFlags().Int(config.OptStripComponents, 0, "When extracting, strip this many leading components from archive paths, skipping shorter paths")
+	cmd.PersistentFlags().StringSlice(config.OptRoute, []string{}, "Hand the files whose Content-Type (e.g. application/x-tar or application/*) or sniffed format (e.g. zstd) matches to a consumer (extract, decompress, file), format <match>=<consumer> (repeatable)")
+	cmd.PersistentFlags().StringSlice(config.OptTransform, []string{}, "When extracting, replace the leading archive path prefix <old> with <new>, format <old>=<new> (repeatable)")
+	cmd.PersistentFlags().String(config.OptGzipReadahead, "", "How much of a gzip compressed archive is decoded ahead of the extraction (e.g. 64M), decoder default if unset")
+	cmd.PersistentFlags().Int(config.OptZstdConcurrency, 0, "Number of goroutines decoding a zstd compressed archive (0 for one per CPU)")
+	cmd.PersistentFlags().String(config.OptZstdMaxWindow, "", "Largest window size accepted when decoding a zstd compressed archive (e.g. 512M), decoder default if unset")
 
 	if err := hideAndDeprecateFlags(cmd); err != nil {
 		return err
@@ -189,13 +321,15 @@ func persistentFlags(cmd *cobra.Command) error {
 
 func hideAndDeprecateFlags(cmd *cobra.Command) error {
 	// Hide flags from help, these are intended to be used for testing/internal benchmarking/debugging only
-	if err := config.HideFlags(cmd, config.OptForceHTTP2, config.OptMaxConnPerHost, config.OptOutputConsumer); err != nil {
+	if err := config.HideFlags(cmd, config.OptForceHTTP2, config.OptOutputConsumer, config.OptSimulateBandwidth, config.OptSimulateLatency); err != nil {
 		return err
 	}
 
 	// DeprecatedFlag flags
 	err := config.DeprecateFlags(cmd,
-		config.DeprecatedFlag{Flag: config.OptMaxChunks, Msg: fmt.Sprintf("use --%s instead", config.OptConcurrency)},
+		config.DeprecatedFlag{Flag: config.OptConcurrency, Msg: fmt.Sprintf("use --%s instead", config.OptMaxTotalConnections)},
+		config.DeprecatedFlag{Flag: config.OptMaxChunks, Msg: fmt.Sprintf("use --%s instead", config.OptMaxTotalConnections)},
+		config.DeprecatedFlag{Flag: config.OptMaxConnPerHost, Msg: fmt.Sprintf("use --%s instead", config.OptMaxConnectionsPerHost)},
 		config.DeprecatedFlag{Flag: config.OptMinimumChunkSize, Msg: fmt.Sprintf("use --%s instead", config.OptChunkSize)},
 	)
 	if err != nil {
@@ -210,6 +344,16 @@ func runRootCMD(cmd *cobra.Command, args []string) error {
 	// on all errors
 	cmd.SilenceUsage = true
 
+	if viper.GetString(config.OptSample) != "" {
+		return sampleExecute(cmd.Context(), args)
+	}
+	if input := viper.GetString(config.OptInput); input != "" {
+		return inputExecute(cmd.Context(), input)
+	}
+	if cmd.Flags().Changed(config.OptOutputDir) {
+		return fmt.Errorf("--%s requires --%s", config.OptOutputDir, config.OptInput)
+	}
+
 	var url, dest string
 	url = args[0]
 	if len(args) > 1 {
@@ -221,13 +365,40 @@ func runRootCMD(cmd *cobra.Command, args []string) error {
 		Str("chunk_size", viper.GetString(config.OptChunkSize)).
 		Msg("Initiating")
 
-	// OMG BODGE FIX THIS
-	consumer := viper.GetString(config.OptOutputConsumer)
-	if consumer != config.ConsumerNull {
+	if dest == "-" && viper.GetString(config.OptOutputConsumer) == config.ConsumerFile {
+		if viper.GetString(config.OptReportJSON) == "-" {
+			return fmt.Errorf("--%s cannot write the report to stdout when the file is written to stdout", config.OptReportJSON)
+		}
+		log.Debug().Msg("Writing To Stdout")
+		viper.Set(config.OptOutputConsumer, config.ConsumerStdout)
+	}
+
+	c, err := config.GetConsumer()
+	if err != nil {
+		return err
+	}
+	_, extract := c.(*consumer.TarExtractor)
+	urls, dests, err := cli.ExpandURLs(url, dest, extract)
+	if err != nil {
+		return err
+	}
+	if len(urls) > 1 {
+		return urlsExecute(cmd.Context(), url, urls, dests)
+	}
+	// the version marker decides whether an existing destination is downloaded again
+	if consumer.WritesDestination(c) && viper.GetString(config.OptVersionMarker) == "" {
 		if err := cli.EnsureDestinationNotExist(dest); err != nil {
 			return err
 		}
 	}
+	if viper.GetBool(config.OptAgent) {
+		err := agentExecute(cmd.Context(), cmd.Flags(), url, dest)
+		if !errors.Is(err, agent.ErrUnavailable) {
+			return err
+		}
+		logger := logging.GetLogger()
+		logger.Warn().Err(err).Msg("Agent unavailable, downloading in-process")
+	}
 	if err := rootExecute(cmd.Context(), url, dest); err != nil {
 		return err
 	}
@@ -235,78 +406,268 @@ func runRootCMD(cmd *cobra.Command, args []string) error {
 	return nil
 }
 
-// rootExecute is the main function of the program and encapsulates the general logic
-// returns any/all errors to the caller.
-func rootExecute(ctx context.Context, urlString, dest string) error {
-	chunkSize, err := humanize.ParseBytes(viper.GetString(config.OptChunkSize))
+// inputExecute downloads the URLs listed in input, or on stdin if it is -, into --output-dir.
+func inputExecute(ctx context.Context, input string) error {
+	source, file := input, os.Stdin
+	if input == "-" {
+		source = "stdin"
+	} else {
+		var err error
+		if file, err = os.Open(input); err != nil {
+			return fmt.Errorf("error opening URL list: %w", err)
+		}
+		defer file.Close()
+	}
+	urls, err := cli.ReadURLs(file)
 	if err != nil {
-		return fmt.Errorf("error parsing chunk size: %w", err)
+		return fmt.Errorf("error reading URL list from %s: %w", source, err)
 	}
-
-	resolveOverrides, err := config.ResolveOverridesToMap(viper.GetStringSlice(config.OptResolve))
+	if len(urls) == 0 {
+		return fmt.Errorf("no URLs listed on %s", source)
+	}
+	extract := viper.GetString(config.OptOutputConsumer) == config.ConsumerTarExtractor
+	dests, err := cli.URLDestinations(urls, viper.GetString(config.OptOutputDir), extract)
 	if err != nil {
-		return fmt.Errorf("error parsing resolve overrides: %w", err)
+		return err
+	}
+	return urlsExecute(ctx, source, urls, dests)
+}
+
+// urlsExecute downloads urls, which source (a URL pattern or list) yields, to dests, as multifile mode would.
+func urlsExecute(ctx context.Context, source string, urls, dests []string) error {
+	consumer := viper.GetString(config.OptOutputConsumer)
+	if consumer == config.ConsumerStdout || consumer == config.ConsumerTarStdout {
+		return fmt.Errorf("the %d URLs of %s can't be written to stdout", len(urls), source)
+	}
+	if viper.GetString(config.OptVersionMarker) != "" {
+		return fmt.Errorf("--%s doesn't support downloading several URLs", config.OptVersionMarker)
 	}
-	clientOpts := client.Options{
-		MaxRetries: viper.GetInt(config.OptRetries),
-		TransportOpts: client.TransportOptions{
-			ForceHTTP2:       viper.GetBool(config.OptForceHTTP2),
-			ConnectTimeout:   viper.GetDuration(config.OptConnTimeout),
-			MaxConnPerHost:   viper.GetInt(config.OptMaxConnPerHost),
-			ResolveOverrides: resolveOverrides,
-		},
+	manifest := make(rpget.Manifest, 0, len(urls))
+	// urlOf maps the destinations seen so far to the URL written to them
+	urlOf := make(map[string]string, len(dests))
+	for i, url := range urls {
+		if seen, ok := urlOf[dests[i]]; ok {
+			if seen == url {
+				continue
+			}
+			if consumer != config.ConsumerNull && consumer != config.ConsumerTarExtractor {
+				return fmt.Errorf("%s and %s would both be written to %s", seen, url, dests[i])
+			}
+		} else if consumer != config.ConsumerNull {
+			if err := cli.EnsureDestinationNotExist(dests[i]); err != nil {
+				return err
+			}
+		}
+		urlOf[dests[i]] = url
+		manifest = manifest.AddEntry(url, dests[i])
 	}
+	log.Info().Str("source", source).Int("file_count", len(manifest)).Msg("Downloading URLs")
+	return multifile.Execute(ctx, manifest, urls[0])
+}
+
+// agentOptions are the options the agent honours: those sent along with the download (--extract, --force), and
+// those of the process rather than of the download. Downloads using any other option are made in-process, as the
+// agent would ignore it.
+var agentOptions = map[string]bool{
+	config.OptAgent:            true,
+	config.OptAgentIdleTimeout: true,
+	config.OptExtract:          true,
+	config.OptForce:            true,
+	config.OptLoggingLevel:     true,
+	config.OptOutputConsumer:   true,
+	config.OptPIDFile:          true,
+	config.OptVerbose:          true,
+	"help":                     true,
+}
 
-	downloadOpts := download.Options{
-		MaxConcurrency: viper.GetInt(config.OptConcurrency),
-		ChunkSize:      int64(chunkSize),
-		Client:         clientOpts,
+// agentUnsupportedOption returns the first option of flags set, on the command line or in the environment, which the
+// agent doesn't honour, or "" if there is none.
+func agentUnsupportedOption(flags *pflag.FlagSet) string {
+	var unsupported string
+	flags.VisitAll(func(flag *pflag.Flag) {
+		if unsupported == "" && !agentOptions[flag.Name] && viper.IsSet(flag.Name) {
+			unsupported = flag.Name
+		}
+	})
+	return unsupported
+}
+
+// agentExecute downloads url through the background agent, starting the agent if it isn't running. It returns
+// an error wrapping agent.ErrUnavailable if the agent can't be used, in which case the caller should download
+// in-process instead.
+func agentExecute(ctx context.Context, flags *pflag.FlagSet, urlString, dest string) error {
+	consumer := viper.GetString(config.OptOutputConsumer)
+	if consumer != config.ConsumerFile && consumer != config.ConsumerTarExtractor {
+		return fmt.Errorf("%w: the agent does not support the %s consumer", agent.ErrUnavailable, consumer)
+	}
+	if opt := agentUnsupportedOption(flags); opt != "" {
+		return fmt.Errorf("%w: the agent does not support --%s", agent.ErrUnavailable, opt)
 	}
 
-	consumer, err := config.GetConsumer()
+	// the agent runs in another working directory than this invocation
+	dest, err := filepath.Abs(dest)
+	if err != nil {
+		return fmt.Errorf("%w: %w", agent.ErrUnavailable, err)
+	}
+	socketPath, err := agent.SocketPath()
+	if err != nil {
+		return fmt.Errorf("%w: %w", agent.ErrUnavailable, err)
+	}
+	client := agent.NewClient(socketPath)
+	if err := client.Ping(ctx); err != nil {
+		if err := agent.Start(ctx, socketPath, viper.GetDuration(config.OptAgentIdleTimeout)); err != nil {
+			return err
+		}
+	}
+
+	startTime := time.Now()
+	d, err := client.Download(ctx, server.DownloadRequest{
+		URL:     urlString,
+		Dest:    dest,
+		Extract: consumer == config.ConsumerTarExtractor,
+		Force:   viper.GetBool(config.OptForce),
+	})
 	if err != nil {
 		return err
 	}
+	log.Info().
+		Str("dest", dest).
+		Str("url", urlString).
+		Str("size", humanize.Bytes(uint64(d.Size))).
+		Str("total_elapsed", fmt.Sprintf("%.3fs", time.Since(startTime).Seconds())).
+		Msg("Complete (agent)")
+	return nil
+}
 
-	rpgetOpts := rpget.Options{
-		MetricsEndpoint: viper.GetString(config.OptMetricsEndpoint),
+// rootExecute is the main function of the program and encapsulates the general logic
+// returns any/all errors to the caller.
+func rootExecute(ctx context.Context, urlString, dest string) error {
+	downloadOpts, err := cli.DownloadOptions(urlString)
+	if err != nil {
+		return err
+	}
+	if err := cli.CheckURLPolicy(downloadOpts.Client.Policy, urlString); err != nil {
+		return err
 	}
 
-	getter := rpget.Getter{
-		Consumer: consumer,
-		Options:  rpgetOpts,
+	consumer, err := config.GetConsumer()
+	if err != nil {
+		return err
+	}
+	routes, err := cli.ConsumerRoutes()
+	if err != nil {
+		return err
+	}
+	_, downloadOpts.MaxConcurrency = cli.FitOpenFileLimit(1, downloadOpts.MaxConcurrency, 1,
+		downloadOpts.MaxConnectionsPerHost)
+
+	opts := []rpget.Option{
+		rpget.WithDownloadOptions(downloadOpts),
+		rpget.WithConsumer(consumer),
+		rpget.WithConsumerRoutes(routes...),
+		rpget.WithIdempotent(viper.GetBool(config.OptIdempotent)),
+		rpget.WithSkipExisting(rpget.SkipExisting(viper.GetString(config.OptSkipExisting))),
+		rpget.WithHooks(cli.Hooks()),
+		rpget.WithOffsetWrites(viper.GetBool(config.OptOffsetWrites)),
+		rpget.WithContentCache(viper.GetString(config.OptCacheDir)),
+		rpget.WithMetricsEndpoint(viper.GetString(config.OptMetricsEndpoint)),
+	}
+	if viper.GetString(config.OptReportJSON) != "" {
+		opts = append(opts, rpget.WithReport(rpget.NewReport()))
+	}
+	getter, err := rpget.New(opts...)
+	if err != nil {
+		return err
+	}
+	entry := rpget.ManifestEntry{
+		URL:               urlString,
+		Dest:              dest,
+		VersionMarker:     viper.GetString(config.OptVersionMarker),
+		VersionMarkerFile: viper.GetString(config.OptVersionMarkerFile),
+	}
+	var destDirs []string
+	if dest != "" && dest != "-" {
+		destDirs = append(destDirs, filepath.Dir(dest))
+	}
+	if entry.VersionMarker != "" {
+		destDirs = append(destDirs, filepath.Dir(rpget.VersionMarkerFile(entry)))
+	}
+	if err := cli.RunAs(); err != nil {
+		return err
+	}
+	if err := cli.Sandbox(destDirs...); err != nil {
+		return err
+	}
+	if err := cli.WaitForFiles(ctx, getter, rpget.Manifest{entry}); err != nil {
+		return err
 	}
 
-	// TODO DRY this
-	if srvName := config.GetCacheSRV(); srvName != "" {
-		downloadOpts.SliceSize = 500 * humanize.MiByte
-		downloadOpts.CacheableURIPrefixes = config.CacheableURIPrefixes()
-		downloadOpts.CacheUsePathProxy = viper.GetBool(config.OptCacheUsePathProxy)
-		downloadOpts.ForceCachePrefixRewrite = viper.GetBool(config.OptForceCachePrefixRewrite)
-		if downloadOpts.CacheHosts, err = cli.LookupCacheHosts(srvName); err != nil {
-			return err
+	size, _, err := getter.DownloadEntry(ctx, entry)
+	if getter.Report != nil {
+		if reportErr := getter.Report.WriteFile(viper.GetString(config.OptReportJSON)); reportErr != nil {
+			return errors.Join(err, reportErr)
 		}
-		getter.Downloader, err = download.GetConsistentHashingMode(downloadOpts)
+	}
+	if err != nil {
+		return cli.ExplainOpenFileLimit(err)
+	}
+	cli.OnAllComplete(1, size)
+	return nil
+}
+
+// sampleExecute downloads --sample of the chunks of every URL, and writes their checksums to stdout as JSON. It
+// fails if the URLs, e.g. mirrors of the same file, don't match.
+func sampleExecute(ctx context.Context, urls []string) error {
+	percent, err := rpget.ParseSampleRate(viper.GetString(config.OptSample))
+	if err != nil {
+		return err
+	}
+	downloadOpts, err := cli.DownloadOptions(urls[0])
+	if err != nil {
+		return err
+	}
+	if err := cli.CheckURLPolicy(downloadOpts.Client.Policy, urls...); err != nil {
+		return err
+	}
+	getter, err := rpget.New(rpget.WithDownloadOptions(downloadOpts))
+	if err != nil {
+		return err
+	}
+	samples := make([]rpget.Sample, 0, len(urls))
+	for _, url := range urls {
+		sample, err := getter.Sample(ctx, url, downloadOpts.ChunkSize, percent)
 		if err != nil {
-			return err
+			return fmt.Errorf("%s: %w", url, err)
 		}
-	} else if cacheHostname := config.CacheServiceHostname(); cacheHostname != "" {
-		downloadOpts.CacheHosts = []string{cacheHostname}
-		downloadOpts.CacheableURIPrefixes = config.CacheableURIPrefixes()
-		downloadOpts.CacheUsePathProxy = viper.GetBool(config.OptCacheUsePathProxy)
-		downloadOpts.ForceCachePrefixRewrite = viper.GetBool(config.OptForceCachePrefixRewrite)
+		log.Info().
+			Str("url", url).
+			Int("chunks", len(sample.Chunks)).
+			Str("size", humanize.Bytes(uint64(sample.Size))).
+			Msg("Sampled")
+		samples = append(samples, sample)
 	}
 
-	if getter.Downloader == nil {
-		getter.Downloader = download.GetBufferMode(downloadOpts)
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(samples); err != nil {
+		return err
 	}
-
-	_, _, err = getter.DownloadFile(ctx, urlString, dest)
-	return err
+	for _, sample := range samples[1:] {
+		if err := samples[0].Match(sample); err != nil {
+			return err
+		}
+	}
+	return nil
 }
 
 func validateArgs(cmd *cobra.Command, args []string) error {
-	if viper.GetString(config.OptOutputConsumer) == config.ConsumerNull {
+	if viper.GetString(config.OptInput) != "" {
+		return cobra.NoArgs(cmd, args)
+	}
+	if viper.GetString(config.OptSample) != "" {
+		return cobra.MinimumNArgs(1)(cmd, args)
+	}
+	if viper.GetString(config.OptOutputConsumer) == config.ConsumerNull || viper.GetBool(config.OptExtractToStdout) {
 		return cobra.RangeArgs(1, 2)(cmd, args)
 	}
 	return cobra.ExactArgs(2)(cmd, args)
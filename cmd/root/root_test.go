@@ -0,0 +1,34 @@
+package root
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAgentUnsupportedOption(t *testing.T) {
+	for _, tc := range []struct {
+		args     []string
+		env      map[string]string
+		expected string
+	}{
+		{args: []string{"--agent", "--force", "--extract", "--log-level", "debug"}},
+		{args: []string{"--agent", "--chunk-size", "10M"}, expected: "chunk-size"},
+		{args: []string{"--agent", "--retries", "0"}, expected: "retries"},
+		{args: []string{"--agent", "--tmp-dir", "/tmp"}, expected: "tmp-dir"},
+		{args: []string{"--agent", "--report-json", "-"}, expected: "report-json"},
+		// options set in the environment aren't honoured either
+		{args: []string{"--agent"}, env: map[string]string{"RPGET_CONNECT_TIMEOUT": "1s"}, expected: "connect-timeout"},
+	} {
+		viper.Reset()
+		for key, value := range tc.env {
+			t.Setenv(key, value)
+		}
+		cmd := GetCommand()
+		require.NoError(t, cmd.ParseFlags(tc.args))
+		assert.Equal(t, tc.expected, agentUnsupportedOption(cmd.Flags()), tc.args)
+	}
+	viper.Reset()
+}
@@ -0,0 +1,235 @@
+package serve
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+	grpclib "google.golang.org/grpc"
+
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/cas"
+	"github.com/emaballarin/rpget/pkg/cli"
+	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/download"
+	"github.com/emaballarin/rpget/pkg/logging"
+	"github.com/emaballarin/rpget/pkg/server"
+	grpcserver "github.com/emaballarin/rpget/pkg/server/grpc"
+)
+
+const longDesc = `
+'serve' runs rpget as a long-lived daemon exposing a local HTTP API. Connections, DNS results and cache-host state are
+reused across requests, removing the cold-start cost of executing rpget once per file.
+
+  POST   /downloads       start a download: {"url": "...", "dest": "...", "extract": false, "force": false}
+  GET    /downloads       list all downloads
+  GET    /downloads/{id}  get the status of a download
+  DELETE /downloads/{id}  cancel a running download, or forget a finished one
+
+Finished downloads are forgotten an hour after they finish, or once 1000 more recent ones have finished.
+
+Without --api-token, --listen must be a loopback address or a unix socket, only accessible to the user. With it,
+every request must send it as a bearer token. Downloads must be posted as application/json, and requests from web
+pages, with an Origin header, are rejected, as are requests addressed to another host than localhost or a loopback
+address without --api-token, so that DNS rebinding can't reach the API. With --output-root, destinations are
+relative to it and may not escape it, over HTTP and gRPC. With --cache-dir, downloads go through the content cache.
+
+With --grpc-listen, the same downloads are also available as the gRPC service rpget.v1.DownloadService (see
+pkg/server/grpc/download.proto), which streams progress updates and cancels the download when the call is
+cancelled. Calls must send --api-token as a bearer token in their authorization metadata; without it, --grpc-listen
+must be a loopback address.
+`
+
+const serveExamples = `
+  rpget serve --listen 127.0.0.1:9099
+
+  rpget serve --listen unix:/run/rpget.sock
+
+  curl -X POST localhost:9099/downloads -H 'Content-Type: application/json' -d '{"url": "https://example.com/file.tar", "dest": "/tmp/file.tar"}'
+
+  RPGET_API_TOKEN=secret rpget serve --listen 0.0.0.0:9099 --output-root /srv/models
+
+  rpget serve --grpc-listen 127.0.0.1:9100
+
+  RPGET_API_TOKEN=secret rpget serve --grpc-listen 0.0.0.0:9100
+`
+
+func GetCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     config.ServeCMDName + " [flags]",
+		Short:   "run a daemon exposing a local HTTP download API",
+		Long:    longDesc,
+		Args:    cobra.NoArgs,
+		RunE:    runServeCMD,
+		Example: serveExamples,
+	}
+	cmd.Flags().String(config.OptListen, "127.0.0.1:9099", "Address for the HTTP API to listen on")
+	cmd.Flags().String(config.OptGRPCListen, "", "Address for the gRPC API to listen on (disabled if empty)")
+	cmd.Flags().Duration(config.OptIdleTimeout, 0, "Exit after this long without downloads (0 to never exit)")
+	cmd.Flags().String(config.OptAPIToken, "", "Require this bearer token from every request to the HTTP and gRPC APIs, which then accept requests to any host (also set by RPGET_API_TOKEN)")
+	// used by the background agent, see `rpget --agent`
+	if err := config.HideFlags(cmd, config.OptIdleTimeout); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+
+	err := viper.BindPFlags(cmd.Flags())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	// read from the flags rather than bound: binding it would replace the binding of multifile
+	cmd.Flags().String(config.OptOutputRoot, "", "Resolve the destination of every download inside this directory, rejecting absolute destinations and those escaping it with '..' or through a symlink")
+	cmd.SetUsageTemplate(cli.UsageTemplate)
+	return cmd
+}
+
+func runServeCMD(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+	logger := logging.GetLogger()
+
+	downloadOpts, err := cli.DownloadOptions("")
+	if err != nil {
+		return err
+	}
+	downloader, err := download.NewStrategy(downloadOpts)
+	if err != nil {
+		return err
+	}
+
+	ctx, stop := signal.NotifyContext(cmd.Context(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	getterOpts := rpget.Options{MetricsEndpoint: viper.GetString(config.OptMetricsEndpoint)}
+	if dir := viper.GetString(config.OptCacheDir); dir != "" {
+		if getterOpts.ContentCache, err = cas.Open(dir); err != nil {
+			return err
+		}
+	}
+	srv := server.New(ctx, downloader, getterOpts)
+	srv.Token = viper.GetString(config.OptAPIToken)
+	if srv.OutputRoot, err = cmd.Flags().GetString(config.OptOutputRoot); err != nil {
+		return err
+	}
+	httpServer := &http.Server{
+		Handler:           srv,
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	addr := viper.GetString(config.OptListen)
+	listener, err := listen(addr, srv.Token)
+	if err != nil {
+		return err
+	}
+
+	errCh := make(chan error, 2)
+	go func() {
+		logger.Info().Str("listen", addr).Msg("Serve")
+		errCh <- httpServer.Serve(listener)
+	}()
+
+	if idleTimeout := viper.GetDuration(config.OptIdleTimeout); idleTimeout > 0 {
+		go exitWhenIdle(ctx, cancel, srv, idleTimeout)
+	}
+
+	var grpcServer *grpclib.Server
+	if addr := viper.GetString(config.OptGRPCListen); addr != "" {
+		listener, err := listenTCP("gRPC", addr, srv.Token)
+		if err != nil {
+			return err
+		}
+		svc := &grpcserver.Service{Downloader: downloader, Options: getterOpts, OutputRoot: srv.OutputRoot, Token: srv.Token}
+		grpcServer = grpclib.NewServer(svc.ServerOptions()...)
+		svc.Register(grpcServer)
+		go func() {
+			logger.Info().Str("listen", addr).Msg("Serve gRPC")
+			errCh <- grpcServer.Serve(listener)
+		}()
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Info().Msg("Serve: shutting down")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if grpcServer != nil {
+		// in-flight calls are cancelled along with their stream contexts
+		grpcServer.Stop()
+	}
+	if err := httpServer.Shutdown(shutdownCtx); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	// running downloads were cancelled along with ctx, wait for them to clean up
+	srv.Wait()
+	return nil
+}
+
+// listen listens on addr, either a TCP address or unix:<path>, for the HTTP API. Without a token, requests can't be
+// authenticated, so a TCP address must be a loopback address. A stale socket left behind by a previous server is
+// replaced, but a socket another server is still listening on is not.
+func listen(addr, token string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return listenTCP("HTTP", addr, token)
+	}
+	if _, err := os.Stat(path); err == nil {
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("another server is already listening on %s", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("error removing stale socket %s: %w", path, err)
+		}
+	}
+	// the socket is only accessible to the user from the start, not once chmodded after other users could connect
+	oldUmask := syscall.Umask(0177)
+	defer syscall.Umask(oldUmask)
+	return net.Listen("unix", path)
+}
+
+// listenTCP listens on the TCP address addr for the api named api. Without a token, its calls can't be
+// authenticated, so addr must be a loopback address.
+func listenTCP(api, addr, token string) (net.Listener, error) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if tcpAddr, ok := listener.Addr().(*net.TCPAddr); token == "" && (!ok || !tcpAddr.IP.IsLoopback()) {
+		listener.Close()
+		return nil, fmt.Errorf("refusing to serve %s on non-loopback address %s without --%s", api, addr, config.OptAPIToken)
+	}
+	return listener, nil
+}
+
+func exitWhenIdle(ctx context.Context, cancel context.CancelFunc, srv *server.Server, idleTimeout time.Duration) {
+	logger := logging.GetLogger()
+	ticker := time.NewTicker(min(idleTimeout, time.Second))
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if srv.IdleFor() >= idleTimeout {
+				logger.Info().Str("idle_timeout", idleTimeout.String()).Msg("Serve: idle")
+				cancel()
+				return
+			}
+		}
+	}
+}
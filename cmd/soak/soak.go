@@ -0,0 +1,270 @@
+package soak
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/cli"
+	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+const longDesc = `
+'soak' downloads the given URLs over and over for --duration, discarding their content, to qualify a new release of
+a cache fleet (or of rpget) under sustained load. Every --interval, the downloads completed and failed, the
+throughput and the heap and goroutines of rpget are logged; at the end, a JSON summary of every interval is written
+to stdout along with the error rate, how much the throughput drifted and how much the heap and goroutines grew from
+the first complete interval to the last.
+
+Downloads are made with the same options as in the default mode, e.g. through the configured cache hosts or with
+--retries. The command fails if more than --max-error-rate of the downloads fail.
+`
+
+const soakExamples = `
+  rpget soak --duration 1h --interval 5m --workers 4 https://example.com/model.tar https://example.com/weights.bin
+
+  rpget soak --duration 30m --max-error-rate 0.001 https://example.com/model.tar > soak.json
+`
+
+// window is what was measured during one interval of a soak.
+type window struct {
+	Start time.Time `json:"start"`
+	// Partial is set on the last window, cut short by the end of the soak.
+	Partial        bool    `json:"partial,omitempty"`
+	Seconds        float64 `json:"seconds"`
+	Downloads      int64   `json:"downloads"`
+	Errors         int64   `json:"errors"`
+	Bytes          int64   `json:"bytes"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	// HeapBytes and Goroutines are measured at the end of the window, after a garbage collection.
+	HeapBytes  uint64 `json:"heap_bytes"`
+	Goroutines int    `json:"goroutines"`
+}
+
+// summary is the JSON summary of a soak.
+type summary struct {
+	Downloads      int64   `json:"downloads"`
+	Errors         int64   `json:"errors"`
+	ErrorRate      float64 `json:"error_rate"`
+	Bytes          int64   `json:"bytes"`
+	BytesPerSecond float64 `json:"bytes_per_second"`
+	// ThroughputDrift is the relative change of the throughput of the last complete window from the first one,
+	// e.g. -0.1 if it dropped by 10%.
+	ThroughputDrift float64 `json:"throughput_drift"`
+	// HeapGrowth and GoroutineGrowth are the growth of the heap and goroutines from the first complete window to
+	// the last one; steady growth over a long soak points to a leak.
+	HeapGrowth      int64    `json:"heap_growth"`
+	GoroutineGrowth int      `json:"goroutine_growth"`
+	Windows         []window `json:"windows"`
+}
+
+func GetCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "soak [flags] <url> [<url>...]",
+		Short:   "download files repeatedly to qualify a cache fleet under sustained load",
+		Long:    longDesc,
+		Args:    cobra.MinimumNArgs(1),
+		RunE:    runSoakCMD,
+		Example: soakExamples,
+	}
+	cmd.Flags().Duration(config.OptDuration, 10*time.Minute, "How long to keep downloading, e.g. 1h")
+	cmd.Flags().Duration(config.OptInterval, time.Minute, "How often to measure and log the downloads, e.g. 5m")
+	cmd.Flags().Int(config.OptWorkers, 1, "Number of files downloaded at once")
+	cmd.Flags().Float64(config.OptMaxErrorRate, 1, "Fail if more than this fraction of the downloads failed, e.g. 0.01")
+
+	err := viper.BindPFlags(cmd.Flags())
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	cmd.SetUsageTemplate(cli.UsageTemplate)
+	return cmd
+}
+
+func runSoakCMD(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+	duration := viper.GetDuration(config.OptDuration)
+	if duration <= 0 {
+		return fmt.Errorf("--%s must be positive", config.OptDuration)
+	}
+	interval := viper.GetDuration(config.OptInterval)
+	if interval <= 0 {
+		return fmt.Errorf("--%s must be positive", config.OptInterval)
+	}
+	workers := viper.GetInt(config.OptWorkers)
+	if workers < 1 {
+		return fmt.Errorf("--%s must be at least 1", config.OptWorkers)
+	}
+	maxErrorRate := viper.GetFloat64(config.OptMaxErrorRate)
+
+	downloadOpts, err := cli.DownloadOptions(args[0])
+	if err != nil {
+		return err
+	}
+	if err := cli.CheckURLPolicy(downloadOpts.Client.Policy, args...); err != nil {
+		return err
+	}
+	s := &soak{urls: args}
+	s.getter, err = rpget.New(
+		rpget.WithDownloadOptions(downloadOpts),
+		rpget.WithConsumer(&consumer.NullWriter{}),
+		rpget.WithProgress(s.progress),
+	)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(cmd.Context(), duration)
+	defer cancel()
+	result := s.run(ctx, workers, interval)
+
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(result); err != nil {
+		return err
+	}
+	if result.ErrorRate > maxErrorRate {
+		return fmt.Errorf("%d of %d downloads failed, more than --%s %g", result.Errors, result.Downloads+result.Errors, config.OptMaxErrorRate, maxErrorRate)
+	}
+	return nil
+}
+
+// soak downloads urls repeatedly, counting the downloads, errors and bytes of the current window.
+type soak struct {
+	getter    *rpget.Getter
+	urls      []string
+	downloads atomic.Int64
+	errors    atomic.Int64
+	bytes     atomic.Int64
+}
+
+// progress counts the bytes of every chunk as it is received, so that the bytes of a download are spread over the
+// windows it spans.
+func (s *soak) progress(event rpget.ProgressEvent) {
+	if event.Chunk != nil {
+		s.bytes.Add(event.Chunk.End - event.Chunk.Start + 1)
+	}
+}
+
+// run downloads with workers goroutines, cycling through the URLs, until ctx is done, and returns the summary of
+// the windows of interval it measured.
+func (s *soak) run(ctx context.Context, workers int, interval time.Duration) summary {
+	var wg sync.WaitGroup
+	for i := range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for n := i; ctx.Err() == nil; n += workers {
+				s.download(ctx, s.urls[n%len(s.urls)])
+			}
+		}()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	var windows []window
+	start := time.Now()
+	for {
+		select {
+		case now := <-ticker.C:
+			windows = append(windows, s.window(start, now, false))
+			start = now
+		case <-done:
+			if last := s.window(start, time.Now(), true); last.Downloads > 0 || last.Errors > 0 || last.Bytes > 0 {
+				windows = append(windows, last)
+			}
+			return summarize(windows)
+		}
+	}
+}
+
+func (s *soak) download(ctx context.Context, url string) {
+	if _, _, err := s.getter.DownloadFile(ctx, url, ""); err != nil {
+		if ctx.Err() != nil {
+			// the download was interrupted by the end of the soak
+			return
+		}
+		s.errors.Add(1)
+		logger := logging.GetLogger()
+		logger.Warn().Err(err).Str("url", url).Msg("Soak Download Failed")
+		return
+	}
+	s.downloads.Add(1)
+}
+
+// window closes the window from start to end, resetting its counters, and logs it.
+func (s *soak) window(start, end time.Time, partial bool) window {
+	runtime.GC()
+	var mem runtime.MemStats
+	runtime.ReadMemStats(&mem)
+	w := window{
+		Start:      start,
+		Partial:    partial,
+		Seconds:    end.Sub(start).Seconds(),
+		Downloads:  s.downloads.Swap(0),
+		Errors:     s.errors.Swap(0),
+		Bytes:      s.bytes.Swap(0),
+		HeapBytes:  mem.HeapAlloc,
+		Goroutines: runtime.NumGoroutine(),
+	}
+	if w.Seconds > 0 {
+		w.BytesPerSecond = float64(w.Bytes) / w.Seconds
+	}
+	logger := logging.GetLogger()
+	logger.Info().
+		Int64("downloads", w.Downloads).
+		Int64("errors", w.Errors).
+		Str("bytes_per_second", fmt.Sprintf("%s/s", humanize.Bytes(uint64(w.BytesPerSecond)))).
+		Str("heap", humanize.IBytes(w.HeapBytes)).
+		Int("goroutines", w.Goroutines).
+		Msg("Soak")
+	return w
+}
+
+// summarize totals windows, and compares their first and last complete ones.
+func summarize(windows []window) summary {
+	result := summary{Windows: windows}
+	var seconds float64
+	var complete []window
+	for _, w := range windows {
+		result.Downloads += w.Downloads
+		result.Errors += w.Errors
+		result.Bytes += w.Bytes
+		seconds += w.Seconds
+		if !w.Partial {
+			complete = append(complete, w)
+		}
+	}
+	if attempts := result.Downloads + result.Errors; attempts > 0 {
+		result.ErrorRate = float64(result.Errors) / float64(attempts)
+	}
+	if seconds > 0 {
+		result.BytesPerSecond = float64(result.Bytes) / seconds
+	}
+	if len(complete) >= 2 {
+		first, last := complete[0], complete[len(complete)-1]
+		if first.BytesPerSecond > 0 {
+			result.ThroughputDrift = last.BytesPerSecond/first.BytesPerSecond - 1
+		}
+		result.HeapGrowth = int64(last.HeapBytes) - int64(first.HeapBytes)
+		result.GoroutineGrowth = last.Goroutines - first.Goroutines
+	}
+	return result
+}
@@ -0,0 +1,117 @@
+package soak
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/consumer"
+)
+
+func TestSummarize(t *testing.T) {
+	result := summarize([]window{
+		{Seconds: 10, Downloads: 9, Errors: 1, Bytes: 1000, BytesPerSecond: 100, HeapBytes: 1000, Goroutines: 10},
+		{Seconds: 10, Downloads: 10, Bytes: 800, BytesPerSecond: 80, HeapBytes: 3000, Goroutines: 12},
+		// the partial window isn't compared
+		{Seconds: 5, Partial: true, Downloads: 5, Errors: 5, Bytes: 200, BytesPerSecond: 40, HeapBytes: 9000, Goroutines: 50},
+	})
+	assert.Equal(t, int64(24), result.Downloads)
+	assert.Equal(t, int64(6), result.Errors)
+	assert.InDelta(t, 0.2, result.ErrorRate, 1e-9)
+	assert.Equal(t, int64(2000), result.Bytes)
+	assert.InDelta(t, 80, result.BytesPerSecond, 1e-9)
+	assert.InDelta(t, -0.2, result.ThroughputDrift, 1e-9)
+	assert.Equal(t, int64(2000), result.HeapGrowth)
+	assert.Equal(t, 2, result.GoroutineGrowth)
+
+	// a single window has nothing to be compared with
+	result = summarize([]window{{Seconds: 10, Downloads: 1, Bytes: 10, BytesPerSecond: 1, HeapBytes: 1000}})
+	assert.Zero(t, result.ThroughputDrift)
+	assert.Zero(t, result.HeapGrowth)
+}
+
+func TestSoak(t *testing.T) {
+	content := bytes.Repeat([]byte("a"), 1024)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/file" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	s := &soak{urls: []string{ts.URL + "/file", ts.URL + "/missing"}}
+	var err error
+	s.getter, err = rpget.New(rpget.WithConsumer(&consumer.NullWriter{}), rpget.WithRetries(0), rpget.WithProgress(s.progress))
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	// the first worker only downloads the file, the second one only the missing file
+	result := s.run(ctx, 2, 100*time.Millisecond)
+	assert.Positive(t, result.Downloads)
+	assert.Positive(t, result.Errors)
+	assert.Greater(t, result.ErrorRate, 0.0)
+	assert.Less(t, result.ErrorRate, 1.0)
+	assert.GreaterOrEqual(t, result.Bytes, result.Downloads*int64(len(content)))
+
+	require.GreaterOrEqual(t, len(result.Windows), 2)
+	var downloads int64
+	for i, w := range result.Windows {
+		downloads += w.Downloads
+		if w.Partial {
+			assert.Equal(t, len(result.Windows)-1, i, "only the last window is partial")
+		}
+		assert.Positive(t, w.HeapBytes)
+	}
+	assert.Equal(t, result.Downloads, downloads)
+}
+
+func TestSoakChunkFailure(t *testing.T) {
+	content := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(content)
+	secondChunk := "bytes=100-199"
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/failing" && r.Header.Get("Range") == secondChunk {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	// the getter is shared by every iteration: the unread chunks of a failed download must not keep the workers
+	// and buffers the next ones need
+	s := &soak{urls: []string{ts.URL + "/failing", ts.URL + "/file"}}
+	var err error
+	s.getter, err = rpget.New(
+		rpget.WithConsumer(&consumer.NullWriter{}),
+		rpget.WithConcurrency(2),
+		rpget.WithChunkSize(100),
+		rpget.WithRetries(0),
+		rpget.WithProgress(s.progress),
+	)
+	require.NoError(t, err)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	done := make(chan summary, 1)
+	go func() { done <- s.run(ctx, 1, 100*time.Millisecond) }()
+	var result summary
+	select {
+	case result = <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("soak didn't return")
+	}
+	assert.Greater(t, result.Downloads, int64(1))
+	assert.Greater(t, result.Errors, int64(1))
+}
@@ -0,0 +1,146 @@
+package verify
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+
+	"github.com/emaballarin/rpget/cmd/multifile"
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/cli"
+	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+const longDesc = `
+'verify' checks the destinations of a manifest, already downloaded, without downloading them again: for integrity
+audits of model caches. Destinations are compared with the checksum of their entry (sha256 or size) if it has one,
+otherwise with the size of the remote file and, if the destination was downloaded with --skip-existing etag, with
+its ETag. Files are verified in parallel.
+
+Every missing or mismatching destination, or destination which couldn't be compared (e.g. because the remote file
+couldn't be reached), is written to stdout, and the command fails. With --format json, the result of every entry is
+written instead. Destinations which aren't the file as downloaded, e.g. extracted archives, are skipped.
+`
+
+const verifyExamples = `
+  rpget verify manifest.txt
+
+  rpget verify --format json manifest.yaml > audit.json
+`
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+func GetCommand() *cobra.Command {
+	cmd := &cobra.Command{
+		Use:     "verify [flags] <manifest-file>",
+		Short:   "check downloaded destinations against a manifest without downloading",
+		Long:    longDesc,
+		Args:    cobra.ExactArgs(1),
+		PreRunE: verifyPreRunE,
+		RunE:    runVerifyCMD,
+		Example: verifyExamples,
+	}
+	cmd.Flags().String(config.OptFormat, formatText, "Output format (text, json)")
+	cmd.Flags().String(config.OptManifestFormat, "", "Manifest format (text, json, yaml), inferred from the file extension if unset")
+	cmd.Flags().String(config.OptDestTemplate, "", "Compute the destination of every entry from its URL with this template, as in multifile mode")
+	cmd.Flags().String(config.OptOutputRoot, "", "Resolve every manifest destination inside this directory, as in multifile mode")
+	cmd.SetUsageTemplate(cli.UsageTemplate)
+	return cmd
+}
+
+// manifestFlags are the flags of verify which multifile also defines, and which multifile.ReadManifest reads with
+// viper. They are only bound when verify runs: binding them with the command would replace the bindings of multifile
+// and ring, whichever subcommand runs.
+var manifestFlags = []string{config.OptManifestFormat, config.OptDestTemplate, config.OptOutputRoot}
+
+func verifyPreRunE(cmd *cobra.Command, args []string) error {
+	for _, name := range manifestFlags {
+		if err := viper.BindPFlag(name, cmd.Flags().Lookup(name)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func runVerifyCMD(cmd *cobra.Command, args []string) error {
+	cmd.SilenceUsage = true
+	logger := logging.GetLogger()
+	format, err := cmd.Flags().GetString(config.OptFormat)
+	if err != nil {
+		return err
+	}
+	if format != formatText && format != formatJSON {
+		return fmt.Errorf("invalid --%s %s, expected %s or %s", config.OptFormat, format, formatText, formatJSON)
+	}
+	// the destinations are expected to exist: they are what is verified
+	viper.Set(config.OptForce, true)
+	manifest, err := multifile.ReadManifest(args[0])
+	if err != nil {
+		return err
+	}
+
+	downloadOpts, err := cli.DownloadOptions("")
+	if err != nil {
+		return err
+	}
+	urls := make([]string, len(manifest))
+	for i, entry := range manifest {
+		urls[i] = entry.URL
+	}
+	if err := cli.CheckURLPolicy(downloadOpts.Client.Policy, urls...); err != nil {
+		return err
+	}
+	getter, err := rpget.New(
+		rpget.WithDownloadOptions(downloadOpts),
+		rpget.WithMaxConcurrentFiles(multifile.MaxConcurrentFiles()),
+	)
+	if err != nil {
+		return err
+	}
+
+	results, err := getter.VerifyFiles(cmd.Context(), manifest)
+	if err != nil && !errors.Is(err, rpget.ErrVerificationFailed) {
+		return err
+	}
+	if format == formatJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if encodeErr := encoder.Encode(results); encodeErr != nil {
+			return encodeErr
+		}
+	} else {
+		for _, result := range results {
+			if result.Status == rpget.VerifyOK || result.Status == rpget.VerifySkipped {
+				continue
+			}
+			line := fmt.Sprintf("%s %s (%s)", result.Status, result.Dest, result.URL)
+			if result.Detail != "" {
+				line += ": " + result.Detail
+			}
+			if _, printErr := fmt.Println(line); printErr != nil {
+				return printErr
+			}
+		}
+	}
+	counts := make(map[rpget.VerifyStatus]int)
+	for _, result := range results {
+		counts[result.Status]++
+	}
+	logger.Info().
+		Int("files", len(results)).
+		Int("ok", counts[rpget.VerifyOK]).
+		Int("missing", counts[rpget.VerifyMissing]).
+		Int("mismatch", counts[rpget.VerifyMismatch]).
+		Int("error", counts[rpget.VerifyError]).
+		Int("skipped", counts[rpget.VerifySkipped]).
+		Msg("Verify")
+	return err
+}
@@ -5,13 +5,24 @@ import (
 
 	"github.com/emaballarin/rpget/cmd"
 	"github.com/emaballarin/rpget/pkg/logging"
+	"github.com/emaballarin/rpget/pkg/scratch"
+	"github.com/emaballarin/rpget/pkg/wal"
 )
 
 func main() {
 	logging.SetupLogger()
 	rootCMD := cmd.GetRootCommand()
 
-	if err := rootCMD.Execute(); err != nil {
+	err := rootCMD.Execute()
+	if cleanupErr := scratch.Cleanup(); cleanupErr != nil {
+		logger := logging.GetLogger()
+		logger.Warn().Err(cleanupErr).Msg("Error removing scratch directory")
+	}
+	if closeErr := wal.Close(); closeErr != nil {
+		logger := logging.GetLogger()
+		logger.Warn().Err(closeErr).Msg("Error closing WAL")
+	}
+	if err != nil {
 		os.Exit(1)
 	}
 }
@@ -0,0 +1,111 @@
+// Package agent talks to a background `rpget serve` process listening on a unix socket. The agent keeps its
+// connections and DNS results warm between invocations, so that bursts of sequential rpget calls from a script
+// only pay connection setup once. It exits by itself after a period of inactivity.
+package agent
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/emaballarin/rpget/pkg/server"
+)
+
+// ErrUnavailable is returned when no agent is listening on the socket.
+var ErrUnavailable = errors.New("rpget agent unavailable")
+
+// Client submits downloads to the agent listening on a unix socket. The socket must be owned by the current user.
+type Client struct {
+	http *http.Client
+}
+
+func NewClient(socketPath string) *Client {
+	dialer := &net.Dialer{Timeout: time.Second}
+	return &Client{
+		http: &http.Client{
+			Transport: &http.Transport{
+				DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+					if err := checkSocket(socketPath); err != nil {
+						return nil, err
+					}
+					return dialer.DialContext(ctx, "unix", socketPath)
+				},
+			},
+		},
+	}
+}
+
+// Ping returns ErrUnavailable if the agent cannot be reached.
+func (c *Client) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://localhost/downloads", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// Download submits req to the agent and waits for it to finish. Cancelling ctx cancels the download.
+func (c *Client) Download(ctx context.Context, req server.DownloadRequest) (server.Download, error) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return server.Download{}, err
+	}
+	created, err := c.do(ctx, http.MethodPost, "/downloads", body, http.StatusAccepted)
+	if err != nil {
+		return server.Download{}, err
+	}
+
+	d, err := c.do(ctx, http.MethodGet, "/downloads/"+created.ID+"?wait=true", nil, http.StatusOK)
+	if ctx.Err() != nil {
+		// don't leave the download running in the agent
+		cancelCtx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		_, _ = c.do(cancelCtx, http.MethodDelete, "/downloads/"+created.ID, nil, http.StatusAccepted)
+		return server.Download{}, ctx.Err()
+	}
+	if err != nil {
+		return server.Download{}, err
+	}
+	if d.Status != server.StatusCompleted {
+		return d, fmt.Errorf("download %s: %s", d.Status, d.Error)
+	}
+	return d, nil
+}
+
+func (c *Client) do(ctx context.Context, method, path string, body []byte, expectedStatus int) (server.Download, error) {
+	var d server.Download
+	// the server only accepts requests to localhost from clients without its token
+	req, err := http.NewRequestWithContext(ctx, method, "http://localhost"+path, bytes.NewReader(body))
+	if err != nil {
+		return d, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return d, fmt.Errorf("%w: %w", ErrUnavailable, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != expectedStatus {
+		var apiErr struct {
+			Error string `json:"error"`
+		}
+		_ = json.NewDecoder(resp.Body).Decode(&apiErr)
+		return d, fmt.Errorf("agent returned %s: %s", resp.Status, apiErr.Error)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&d); err != nil {
+		return d, fmt.Errorf("error decoding agent response: %w", err)
+	}
+	return d, nil
+}
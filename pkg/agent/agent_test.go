@@ -0,0 +1,103 @@
+package agent_test
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/agent"
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/download"
+	"github.com/emaballarin/rpget/pkg/server"
+)
+
+var testFS = fstest.MapFS{
+	"hello.txt": {Data: []byte("hello, world!")},
+}
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+func TestClientDownload(t *testing.T) {
+	origin := httptest.NewServer(http.FileServer(http.FS(testFS)))
+	defer origin.Close()
+
+	socketPath := filepath.Join(t.TempDir(), "agent.sock")
+	listener, err := net.Listen("unix", socketPath)
+	require.NoError(t, err)
+	srv := server.New(context.Background(), download.GetBufferMode(download.Options{Client: client.Options{}}), rpget.Options{})
+	httpServer := &http.Server{Handler: srv}
+	go func() { _ = httpServer.Serve(listener) }()
+	defer httpServer.Close()
+
+	c := agent.NewClient(socketPath)
+	require.NoError(t, c.Ping(context.Background()))
+
+	dest := filepath.Join(t.TempDir(), "hello.txt")
+	d, err := c.Download(context.Background(), server.DownloadRequest{URL: origin.URL + "/hello.txt", Dest: dest})
+	require.NoError(t, err)
+	assert.Equal(t, server.StatusCompleted, d.Status)
+	assert.Equal(t, int64(len(testFS["hello.txt"].Data)), d.Size)
+
+	content, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, testFS["hello.txt"].Data, content)
+
+	_, err = c.Download(context.Background(), server.DownloadRequest{URL: origin.URL + "/missing.txt", Dest: dest + ".missing"})
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, agent.ErrUnavailable)
+}
+
+func TestClientUnavailable(t *testing.T) {
+	c := agent.NewClient(filepath.Join(t.TempDir(), "missing.sock"))
+	assert.ErrorIs(t, c.Ping(context.Background()), agent.ErrUnavailable)
+	_, err := c.Download(context.Background(), server.DownloadRequest{URL: "http://example.com/file", Dest: "file"})
+	assert.ErrorIs(t, err, agent.ErrUnavailable)
+}
+
+func TestSocketPath(t *testing.T) {
+	t.Setenv("XDG_RUNTIME_DIR", "")
+	t.Setenv("TMPDIR", t.TempDir())
+
+	socketPath, err := agent.SocketPath()
+	require.NoError(t, err)
+	info, err := os.Stat(filepath.Dir(socketPath))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0700), info.Mode().Perm())
+
+	// A directory other users can access, or a symlink another user may have created in its place, is rejected
+	require.NoError(t, os.Chmod(filepath.Dir(socketPath), 0755))
+	_, err = agent.SocketPath()
+	assert.ErrorContains(t, err, "accessible to other users")
+
+	require.NoError(t, os.Remove(filepath.Dir(socketPath)))
+	require.NoError(t, os.Symlink(t.TempDir(), filepath.Dir(socketPath)))
+	_, err = agent.SocketPath()
+	assert.ErrorContains(t, err, "not a directory")
+
+	xdgPath := t.TempDir()
+	require.NoError(t, os.Chmod(xdgPath, 0700))
+	t.Setenv("XDG_RUNTIME_DIR", xdgPath)
+	socketPath, err = agent.SocketPath()
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(xdgPath, "rpget-agent.sock"), socketPath)
+}
+
+func TestClientRejectsNonSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "agent.sock")
+	require.NoError(t, os.WriteFile(path, nil, 0600))
+	err := agent.NewClient(path).Ping(context.Background())
+	assert.ErrorIs(t, err, agent.ErrUnavailable)
+	assert.ErrorContains(t, err, "is not a socket")
+}
@@ -0,0 +1,73 @@
+//go:build !windows
+
+package agent
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// SocketPath returns the agent socket path of the current user: in $XDG_RUNTIME_DIR if it is set, otherwise in a
+// directory of the user in the temporary directory, created if needed. Either directory must be owned by the user
+// and only accessible to them, so that another user can't create the socket first and receive their downloads.
+func SocketPath() (string, error) {
+	if xdgPath := os.Getenv("XDG_RUNTIME_DIR"); xdgPath != "" {
+		if err := checkPrivateDir(xdgPath); err != nil {
+			return "", err
+		}
+		return filepath.Join(xdgPath, "rpget-agent.sock"), nil
+	}
+	dir := filepath.Join(os.TempDir(), "rpget-agent-"+strconv.Itoa(os.Getuid()))
+	if err := os.Mkdir(dir, 0700); err != nil && !errors.Is(err, fs.ErrExist) {
+		return "", fmt.Errorf("error creating agent directory: %w", err)
+	}
+	if err := checkPrivateDir(dir); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "agent.sock"), nil
+}
+
+// checkPrivateDir returns an error unless dir is a directory, not a symlink, owned by the current user and only
+// accessible to them.
+func checkPrivateDir(dir string) error {
+	info, err := os.Lstat(dir)
+	if err != nil {
+		return err
+	}
+	if !info.IsDir() {
+		return fmt.Errorf("agent directory %s is not a directory", dir)
+	}
+	if !ownedByUser(info) {
+		return fmt.Errorf("agent directory %s is owned by another user", dir)
+	}
+	if info.Mode().Perm()&0077 != 0 {
+		return fmt.Errorf("agent directory %s is accessible to other users (mode %s)", dir, info.Mode().Perm())
+	}
+	return nil
+}
+
+// checkSocket returns an error unless path is a socket owned by the current user, so that the downloads of the user
+// aren't sent to a server another user listens on.
+func checkSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil {
+		return err
+	}
+	if info.Mode().Type() != fs.ModeSocket {
+		return fmt.Errorf("agent socket %s is not a socket", path)
+	}
+	if !ownedByUser(info) {
+		return fmt.Errorf("agent socket %s is owned by another user", path)
+	}
+	return nil
+}
+
+func ownedByUser(info fs.FileInfo) bool {
+	st, ok := info.Sys().(*syscall.Stat_t)
+	return ok && int(st.Uid) == os.Getuid()
+}
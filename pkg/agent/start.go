@@ -0,0 +1,55 @@
+//go:build !windows
+
+package agent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+const startTimeout = 5 * time.Second
+
+// Start launches `rpget serve` in the background, listening on socketPath and exiting after idleTimeout without
+// downloads, and waits for it to accept requests. The agent inherits the environment of the calling process, so
+// RPGET_* settings in effect when it starts apply to every download it serves. It runs in the root directory rather
+// than the working directory of the calling process, so the destinations sent to it must be absolute.
+func Start(ctx context.Context, socketPath string, idleTimeout time.Duration) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("error locating rpget executable: %w", err)
+	}
+	cmd := exec.Command(executable, "serve",
+		"--listen", "unix:"+socketPath,
+		"--idle-timeout", idleTimeout.String(),
+	)
+	// the agent serves invocations from any directory, relative destinations fail rather than land in the first one
+	cmd.Dir = "/"
+	// detach from the calling process group, so the agent outlives it and doesn't receive its signals
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setsid: true}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting rpget agent: %w", err)
+	}
+	// the agent is never waited on, release its resources
+	if err := cmd.Process.Release(); err != nil {
+		return err
+	}
+
+	client := NewClient(socketPath)
+	ctx, cancel := context.WithTimeout(ctx, startTimeout)
+	defer cancel()
+	for {
+		if err = client.Ping(ctx); err == nil {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Join(ErrUnavailable, err)
+		case <-time.After(50 * time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,207 @@
+package rpget
+
+import (
+	"archive/tar"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/download"
+	"github.com/emaballarin/rpget/pkg/logging"
+	"github.com/emaballarin/rpget/pkg/wal"
+)
+
+const defaultBatchSize = 256
+
+func (o Options) batchSize() int {
+	if o.BatchSize == 0 {
+		return defaultBatchSize
+	}
+	return o.BatchSize
+}
+
+// queueBatches negotiates batch support with the origin of every manifest entry and queues one batch download per
+// BatchSize entries of each supporting origin. It returns the entries which must be downloaded individually.
+func (g *Getter) queueBatches(ctx context.Context, eg *errgroup.Group, entries []ManifestEntry, run *multifileRun) []ManifestEntry {
+	logger := logging.GetLogger()
+	remaining := make([]ManifestEntry, 0, len(entries))
+	batches := make(map[string][]ManifestEntry)
+	endpoints := make([]string, 0)
+
+	for _, entry := range entries {
+		if !g.batchable(entry, run) {
+			remaining = append(remaining, entry)
+			continue
+		}
+		endpoint, ok := g.Batcher.Negotiate(ctx, entry.URL)
+		if !ok {
+			remaining = append(remaining, entry)
+			continue
+		}
+		if _, seen := batches[endpoint]; !seen {
+			endpoints = append(endpoints, endpoint)
+		}
+		batches[endpoint] = append(batches[endpoint], entry)
+	}
+
+	for _, endpoint := range endpoints {
+		batchEntries := batches[endpoint]
+		for len(batchEntries) > 0 {
+			n := min(len(batchEntries), g.Options.batchSize())
+			batch := batchEntries[:n]
+			batchEntries = batchEntries[n:]
+			logger.Debug().Str("endpoint", endpoint).Int("file_count", len(batch)).Msg("Queueing Batch")
+			eg.Go(func() error {
+				return g.downloadBatch(ctx, endpoint, batch, run)
+			})
+		}
+	}
+	return remaining
+}
+
+// batchable reports whether entry can be fetched in a batch. Per-entry headers and download modes can't be applied
+// to a shared batch request, and batched entries can't be ordered, post-processed, skipped (by version marker, as
+// up to date or as matching, see Options.Idempotent), linked from the content cache or followed by progress events.
+func (g *Getter) batchable(entry ManifestEntry, run *multifileRun) bool {
+	switch {
+	case len(entry.Headers) > 0, entry.DownloadMode != "", len(entry.After) > 0, len(entry.Post) > 0, entry.VersionMarker != "":
+		return false
+	case g.Options.SkipExisting != "", g.Options.Idempotent, g.onProgress != nil, run.states[entry.Dest] != nil:
+		return false
+	}
+	return g.contentCacheFor(g.consumerFor(entry)) == nil
+}
+
+// downloadBatch fetches entries as a single tar stream from endpoint and hands each file to the consumer. Files
+// missing from the stream, or the whole batch if the request fails, are downloaded individually instead.
+func (g *Getter) downloadBatch(ctx context.Context, endpoint string, entries []ManifestEntry, run *multifileRun) error {
+	logger := logging.GetLogger()
+
+	pending := make(map[string][]ManifestEntry)
+	urls := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		path, err := download.BatchPath(entry.URL)
+		if err != nil {
+			return err
+		}
+		if _, ok := pending[path]; !ok {
+			urls = append(urls, entry.URL)
+		}
+		pending[path] = append(pending[path], entry)
+	}
+
+	startTime := time.Now()
+	stream, err := g.Batcher.FetchBatch(ctx, endpoint, urls)
+	if err != nil {
+		logger.Warn().Err(err).Str("endpoint", endpoint).Msg("Batch request failed, downloading files individually")
+	} else {
+		defer stream.Close()
+		if err := g.consumeBatch(ctx, stream, pending, startTime, run); err != nil {
+			return err
+		}
+	}
+
+	for _, targets := range pending {
+		for _, entry := range targets {
+			if err := g.downloadAndMeasure(ctx, entry, run); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// consumeBatch writes every requested file in the tar stream to its destination, removing it from pending. A
+// file requested for several destinations is only written to the first one; the others stay pending.
+func (g *Getter) consumeBatch(ctx context.Context, stream io.Reader, pending map[string][]ManifestEntry, startTime time.Time, run *multifileRun) error {
+	logger := logging.GetLogger()
+	tarReader := tar.NewReader(stream)
+	for {
+		header, err := tarReader.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			// whatever has not been delivered yet is downloaded individually
+			logger.Warn().Err(err).Msg("Batch stream interrupted")
+			return nil
+		}
+		targets, ok := pending[header.Name]
+		if !ok || header.Typeflag != tar.TypeReg {
+			continue
+		}
+		entry := targets[0]
+		if len(targets) == 1 {
+			delete(pending, header.Name)
+		} else {
+			pending[header.Name] = targets[1:]
+		}
+
+		body, err := g.transformBody(ctx, ResponseBody{URL: entry.URL, Dest: entry.Dest, Size: header.Size, Reader: tarReader})
+		if err != nil {
+			g.recordResult(FileResult{URL: entry.URL, Dest: entry.Dest, Size: header.Size, Error: err.Error()})
+			if err := g.tolerate(ctx, run, entry, err); err != nil {
+				return err
+			}
+			continue
+		}
+		reader := body.Reader
+		hasher := sha256.New()
+		if g.Report != nil {
+			reader = io.TeeReader(reader, hasher)
+		}
+		var v *verifier
+		if entry.Checksum != "" {
+			if v, err = newVerifier(entry.Checksum); err != nil {
+				return err
+			}
+			reader = io.TeeReader(reader, v)
+		}
+		c := g.routeFor(entry, g.consumerFor(entry))
+		_, extract := c.(*consumer.TarExtractor)
+		journal := wal.Begin(wal.Op{Kind: wal.KindDownload, URL: entry.URL, Dest: entry.Dest, Extract: extract})
+		err = c.Consume(reader, entry.Dest, body.Size)
+		if err != nil {
+			err = fmt.Errorf("error writing file: %w", err)
+		} else {
+			err = g.finishEntry(entry, consumedBy(c), v)
+		}
+		journal.Done()
+		if err != nil {
+			g.recordResult(FileResult{URL: entry.URL, Dest: entry.Dest, Size: header.Size, Error: err.Error()})
+			if err := g.tolerate(ctx, run, entry, err); err != nil {
+				return err
+			}
+			continue
+		}
+		run.totalSize.Add(header.Size)
+		elapsed := time.Since(startTime)
+		g.recordResult(FileResult{
+			URL:             entry.URL,
+			Dest:            entry.Dest,
+			Size:            header.Size,
+			DurationSeconds: elapsed.Seconds(),
+			BytesPerSecond:  float64(header.Size) / elapsed.Seconds(),
+			Checksum:        checksumSHA256Prefix + hex.EncodeToString(hasher.Sum(nil)),
+		})
+		logger.Info().
+			Str("dest", entry.Dest).
+			Str("url", entry.URL).
+			Int64("size", header.Size).
+			Msg("Complete (batch)")
+		g.fileDone(ctx, entry, nil)
+	}
+}
+
+func (g *Getter) recordResult(result FileResult) {
+	if g.Report != nil {
+		g.Report.add(result)
+	}
+}
@@ -0,0 +1,664 @@
+// Package cas is a content-addressed store of downloaded files. Files are kept under the SHA-256 digest of their
+// content, and destinations are copy-on-write clones of them where the filesystem supports it (btrfs, XFS, APFS),
+// hardlinks to them otherwise, so downloading content which is already in the store doesn't fetch or copy it again.
+// The store also records the digest each URL was last downloaded as, along with its ETag, so that downloads without
+// a checksum can find their content too.
+//
+// A hardlinked destination and its object share their inode: modifying the destination in place modifies the
+// object. FileWriters writing destinations linked from a store unlink them first (see
+// consumer.FileWriter.BreakHardlinks), and destinations whose mode differs from their object's should be copied
+// instead (see Copy and AddCopy). VerifyChanged catches objects modified anyway, e.g. by other programs.
+//
+// The store may be shared by several nodes on network storage such as NFS, without locks: objects and records are
+// written to temporary files and only appear under their name once complete, so the name of an object is its
+// completion marker. Objects are published with link(2), which is atomic over NFS too and never replaces an object
+// another node may be reading.
+package cas
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/fsutil"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+const (
+	objectsDir   = "objects"
+	urlsDir      = "urls"
+	usesDir      = "uses"
+	pinsDir      = "pins"
+	verifiedDir  = "verified"
+	tmpDir       = "tmp"
+	digestPrefix = "sha256:"
+	// staleTempAge is the age past which GC removes the temporary files of writes which never completed
+	staleTempAge = time.Hour
+)
+
+// ErrNotFound is returned for content which isn't in the store.
+var ErrNotFound = errors.New("not in the content cache")
+
+// ErrCorrupt is returned by Verify for an object whose content doesn't match its digest.
+var ErrCorrupt = errors.New("corrupt content cache object")
+
+// Store is a content-addressed store in a directory. It is safe for concurrent use, including by several
+// processes.
+type Store struct {
+	dir string
+}
+
+// Open returns the store in dir, creating dir if needed.
+func Open(dir string) (*Store, error) {
+	for _, sub := range []string{objectsDir, urlsDir, usesDir, pinsDir, verifiedDir, tmpDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, fmt.Errorf("error creating content cache %s: %w", dir, err)
+		}
+	}
+	return &Store{dir: dir}, nil
+}
+
+// Dir returns the directory of the store.
+func (s *Store) Dir() string {
+	return s.dir
+}
+
+// ValidateDigest returns an error if digest is not of the form sha256:<hex>.
+func ValidateDigest(digest string) error {
+	sum, err := hex.DecodeString(strings.TrimPrefix(digest, digestPrefix))
+	if !strings.HasPrefix(digest, digestPrefix) || err != nil || len(sum) != sha256.Size || digest != strings.ToLower(digest) {
+		return fmt.Errorf("invalid digest `%s`, expected sha256:<hex>", digest)
+	}
+	return nil
+}
+
+// objectPath returns the path of the object of digest, which must be valid.
+func (s *Store) objectPath(digest string) string {
+	sum := strings.TrimPrefix(digest, digestPrefix)
+	return filepath.Join(s.dir, objectsDir, sum[:2], sum)
+}
+
+// Size returns the size of the content of digest, or ErrNotFound if it isn't in the store.
+func (s *Store) Size(digest string) (int64, error) {
+	if err := ValidateDigest(digest); err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(s.objectPath(digest))
+	if errors.Is(err, fs.ErrNotExist) {
+		return 0, fmt.Errorf("%w: %s", ErrNotFound, digest)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return info.Size(), nil
+}
+
+// Add stores the file at path, whose content has digest, as a clone of it, a hardlink to it, or failing both a copy
+// of it (see Link). Content already in the store is left as is.
+func (s *Store) Add(digest, path string) error {
+	return s.add(digest, path, true)
+}
+
+// AddCopy is Add, storing a clone or a copy of path but never a hardlink to it, for files whose mode differs from
+// the one other destinations should have.
+func (s *Store) AddCopy(digest, path string) error {
+	return s.add(digest, path, false)
+}
+
+func (s *Store) add(digest, path string, hardlink bool) error {
+	if err := ValidateDigest(digest); err != nil {
+		return err
+	}
+	object := s.objectPath(digest)
+	if _, err := os.Stat(object); err == nil {
+		s.recordUse(digest)
+		return nil
+	}
+	if err := os.MkdirAll(filepath.Dir(object), 0755); err != nil {
+		return fmt.Errorf("error adding %s to the content cache: %w", path, err)
+	}
+	// a copy is synced, so that a crash can't leave a partial object behind its completion marker; clones and
+	// hardlinks share the data of path
+	name, err := tempLinkOrCopy(path, object, filepath.Join(s.dir, tmpDir), hardlink, true)
+	if err == nil {
+		err = publish(name, object)
+	}
+	if err != nil {
+		return fmt.Errorf("error adding %s to the content cache: %w", path, err)
+	}
+	s.markVerified(digest)
+	s.recordUse(digest)
+	return nil
+}
+
+// publish moves the complete file name to object, unless there is an object already: another process, or node
+// sharing the store, added the same content meanwhile. Filesystems without hardlinks fall back to a rename, which
+// is atomic too but replaces an object added meanwhile.
+func publish(name, object string) error {
+	defer os.Remove(name)
+	err := os.Link(name, object)
+	if errors.Is(err, fs.ErrExist) {
+		return nil
+	}
+	if err != nil {
+		return os.Rename(name, object)
+	}
+	return nil
+}
+
+// Link makes dest a copy-on-write clone of the content of digest if the filesystem supports it, otherwise a
+// hardlink to it, or a copy of it if dest is on another filesystem, and returns its size. An existing dest is
+// replaced atomically. It returns ErrNotFound if the content isn't in the store.
+func (s *Store) Link(digest, dest string) (int64, error) {
+	return s.link(digest, dest, true)
+}
+
+// Copy is Link, making dest a clone or a copy of the content of digest but never a hardlink to it, for destinations
+// modified once linked, e.g. given a mode of their own.
+func (s *Store) Copy(digest, dest string) (int64, error) {
+	return s.link(digest, dest, false)
+}
+
+func (s *Store) link(digest, dest string, hardlink bool) (int64, error) {
+	size, err := s.Size(digest)
+	if err != nil {
+		return 0, err
+	}
+	object := s.objectPath(digest)
+	if err := os.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return 0, fmt.Errorf("error creating directory: %w", err)
+	}
+	if err := linkOrCopy(object, dest, filepath.Dir(dest), hardlink); err != nil {
+		return 0, fmt.Errorf("error linking %s from the content cache: %w", dest, err)
+	}
+	s.recordUse(digest)
+	return size, nil
+}
+
+// recordUse records a use of the object of digest, for eviction policies, in its use file: the modification time
+// of the file is the last use, and the use is counted by appending a byte to it, which needs no lock. The object
+// itself isn't touched, which would touch the destinations hardlinked to it.
+func (s *Store) recordUse(digest string) {
+	logger := logging.GetLogger()
+	f, err := os.OpenFile(s.usesPath(digest), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err == nil {
+		_, err = f.Write([]byte{'.'})
+		if closeErr := f.Close(); err == nil {
+			err = closeErr
+		}
+	}
+	if err != nil {
+		logger.Debug().Err(err).Str("digest", digest).Msg("Error counting content cache object use")
+	}
+}
+
+// usesPath returns the path of the use file of digest, which must be valid.
+func (s *Store) usesPath(digest string) string {
+	return filepath.Join(s.dir, usesDir, strings.TrimPrefix(digest, digestPrefix))
+}
+
+// usage returns the number of uses recorded of the object of digest, whose file is object, and its last use: when
+// it was added if none was recorded.
+func (s *Store) usage(digest string, object fs.FileInfo) (int64, time.Time) {
+	info, err := os.Stat(s.usesPath(digest))
+	if err != nil {
+		return 0, object.ModTime()
+	}
+	return info.Size(), info.ModTime()
+}
+
+// verifiedPath returns the path of the file recording the size and modification time the object of digest, which
+// must be valid, had when its content was last known to match digest.
+func (s *Store) verifiedPath(digest string) string {
+	return filepath.Join(s.dir, verifiedDir, strings.TrimPrefix(digest, digestPrefix))
+}
+
+// stamp returns what is recorded of the object of info to tell whether it changed since.
+func stamp(info fs.FileInfo) string {
+	return fmt.Sprintf("%d %d", info.Size(), info.ModTime().UnixNano())
+}
+
+// markVerified records the size and modification time of the object of digest, whose content matches digest. The
+// record is an optimisation of VerifyChanged, so failing to write it is only logged.
+func (s *Store) markVerified(digest string) {
+	if err := s.writeVerified(digest); err != nil {
+		logger := logging.GetLogger()
+		logger.Debug().Err(err).Str("digest", digest).Msg("Error recording content cache object as verified")
+	}
+}
+
+func (s *Store) writeVerified(digest string) error {
+	info, err := os.Stat(s.objectPath(digest))
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Join(s.dir, tmpDir), "verified-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(stamp(info)); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.verifiedPath(digest))
+}
+
+// VerifyChanged is Verify, skipping objects whose size and modification time are those they had when they were
+// added or last verified: an object written to, e.g. through a destination hardlinked to it, is verified again,
+// without reading every object linked from the store.
+func (s *Store) VerifyChanged(digest string) error {
+	if _, err := s.Size(digest); err != nil {
+		return err
+	}
+	info, err := os.Stat(s.objectPath(digest))
+	if err != nil {
+		return err
+	}
+	if recorded, err := os.ReadFile(s.verifiedPath(digest)); err == nil && string(recorded) == stamp(info) {
+		return nil
+	}
+	return s.Verify(digest)
+}
+
+// Verify checks that the object of digest still has the content of digest, removing it if it doesn't: it returns
+// ErrCorrupt then, and ErrNotFound if the content isn't in the store.
+func (s *Store) Verify(digest string) error {
+	if _, err := s.Size(digest); err != nil {
+		return err
+	}
+	object := s.objectPath(digest)
+	f, err := os.Open(object)
+	if err != nil {
+		return err
+	}
+	hash := sha256.New()
+	_, err = io.Copy(hash, f)
+	f.Close()
+	if err != nil {
+		return fmt.Errorf("error verifying %s in the content cache: %w", digest, err)
+	}
+	if digestPrefix+hex.EncodeToString(hash.Sum(nil)) == digest {
+		s.markVerified(digest)
+		return nil
+	}
+	if err := os.Remove(object); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		logger := logging.GetLogger()
+		logger.Warn().Err(err).Str("digest", digest).Msg("Error removing corrupt content cache object")
+	}
+	os.Remove(s.usesPath(digest))
+	os.Remove(s.verifiedPath(digest))
+	return fmt.Errorf("%w: %s", ErrCorrupt, digest)
+}
+
+// pinPath returns the path of the pin of digest, which must be valid.
+func (s *Store) pinPath(digest string) string {
+	return filepath.Join(s.dir, pinsDir, strings.TrimPrefix(digest, digestPrefix))
+}
+
+// Pin keeps the content of digest in the store: GC never removes it. Content may be pinned before it is added.
+func (s *Store) Pin(digest string) error {
+	if err := ValidateDigest(digest); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(s.pinPath(digest), os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return fmt.Errorf("error pinning %s in the content cache: %w", digest, err)
+	}
+	return f.Close()
+}
+
+// Unpin lets GC remove the content of digest again. Content which isn't pinned is left as is.
+func (s *Store) Unpin(digest string) error {
+	if err := ValidateDigest(digest); err != nil {
+		return err
+	}
+	if err := os.Remove(s.pinPath(digest)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("error unpinning %s in the content cache: %w", digest, err)
+	}
+	return nil
+}
+
+// Pins returns the pinned digests, sorted.
+func (s *Store) Pins() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.dir, pinsDir))
+	if err != nil {
+		return nil, fmt.Errorf("error listing the pins of the content cache: %w", err)
+	}
+	var pins []string
+	for _, entry := range entries {
+		if digest := digestPrefix + entry.Name(); ValidateDigest(digest) == nil {
+			pins = append(pins, digest)
+		}
+	}
+	return pins, nil
+}
+
+// linkOrCopy atomically creates dest as a clone of src, a hardlink to it if hardlink is set, or a copy of it if
+// they are on different filesystems, through a temporary file in tmp, which must be on the filesystem of dest.
+func linkOrCopy(src, dest, tmp string, hardlink bool) error {
+	name, err := tempLinkOrCopy(src, dest, tmp, hardlink, false)
+	if err != nil {
+		return err
+	}
+	if err := os.Rename(name, dest); err != nil {
+		os.Remove(name)
+		return err
+	}
+	return nil
+}
+
+// tempLinkOrCopy creates a temporary file in tmp, named after dest, as a clone of src, a hardlink to it if hardlink
+// is set, or a copy of it, synced to disk if sync is set, and returns its path.
+func tempLinkOrCopy(src, dest, tmp string, hardlink, sync bool) (string, error) {
+	name, err := tempName(tmp, filepath.Base(dest))
+	if err != nil {
+		return "", err
+	}
+	if !consumer.CanClone(filepath.Dir(src), tmp) || consumer.Clone(src, name) != nil {
+		err = errors.ErrUnsupported
+		if hardlink {
+			err = os.Link(src, name)
+		}
+	}
+	if err != nil {
+		if err := copyFile(src, name, sync); err != nil {
+			os.Remove(name)
+			return "", err
+		}
+	}
+	return name, nil
+}
+
+// tempName returns the path of a file in dir which doesn't exist.
+func tempName(dir, base string) (string, error) {
+	f, err := os.CreateTemp(dir, "."+base+".cas-*")
+	if err != nil {
+		return "", err
+	}
+	name := f.Name()
+	f.Close()
+	return name, os.Remove(name)
+}
+
+func copyFile(src, dest string, sync bool) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		return err
+	}
+	if sync {
+		if err := out.Sync(); err != nil {
+			out.Close()
+			return err
+		}
+	}
+	return out.Close()
+}
+
+// A Record is the content a URL was downloaded as.
+type Record struct {
+	URL    string `json:"url"`
+	Digest string `json:"digest"`
+	Size   int64  `json:"size"`
+	// ETag is the ETag of the response, which tells whether the URL still serves the same content.
+	ETag string `json:"etag,omitempty"`
+}
+
+// recordPath returns the path of the record of url.
+func (s *Store) recordPath(url string) string {
+	sum := sha256.Sum256([]byte(url))
+	return filepath.Join(s.dir, urlsDir, hex.EncodeToString(sum[:])+".json")
+}
+
+// Lookup returns the record of url, or ErrNotFound if there is none or its content is no longer in the store.
+func (s *Store) Lookup(url string) (Record, error) {
+	data, err := os.ReadFile(s.recordPath(url))
+	if errors.Is(err, syscall.ESTALE) {
+		// replaced by another node while it was read, over NFS
+		data, err = os.ReadFile(s.recordPath(url))
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return Record{}, fmt.Errorf("%w: %s", ErrNotFound, url)
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	var record Record
+	if err := json.Unmarshal(data, &record); err != nil || record.URL != url {
+		return Record{}, fmt.Errorf("%w: %s", ErrNotFound, url)
+	}
+	if _, err := s.Size(record.Digest); err != nil {
+		return Record{}, err
+	}
+	return record, nil
+}
+
+// Record records the content record.URL was downloaded as, replacing any previous record.
+func (s *Store) Record(record Record) error {
+	if err := ValidateDigest(record.Digest); err != nil {
+		return err
+	}
+	data, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Join(s.dir, tmpDir), "record-*")
+	if err != nil {
+		return fmt.Errorf("error recording %s in the content cache: %w", record.URL, err)
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(data); err != nil {
+		f.Close()
+		return fmt.Errorf("error recording %s in the content cache: %w", record.URL, err)
+	}
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("error recording %s in the content cache: %w", record.URL, err)
+	}
+	if err := os.Rename(f.Name(), s.recordPath(record.URL)); err != nil {
+		return fmt.Errorf("error recording %s in the content cache: %w", record.URL, err)
+	}
+	return nil
+}
+
+// GCResult summarises a garbage collection of the store.
+type GCResult struct {
+	// Objects and Size are the number and total size of the objects left in the store.
+	Objects int
+	Size    int64
+	// Removed is the number of objects removed, and Freed the total size of those which weren't linked to from
+	// destinations: the others only free their space once those are removed too.
+	Removed int
+	Freed   int64
+	// Pinned is the number of pinned objects left in the store, which are never removed.
+	Pinned int
+}
+
+// GCOptions are the limits GC shrinks the store to. The zero value empties the store of all but pinned objects.
+type GCOptions struct {
+	// MaxSize is the most bytes the objects left may total, and MaxObjects the most objects left; negative for no
+	// limit.
+	MaxSize    int64
+	MaxObjects int
+	// MaxAge, if non-zero, is how long objects are kept without being used: older ones are removed whatever the
+	// other limits.
+	MaxAge time.Duration
+	// Policy chooses the objects removed first to fit MaxSize and MaxObjects. If nil, LRU will be used.
+	Policy EvictionPolicy
+}
+
+type object struct {
+	ObjectInfo
+	path   string
+	pinned bool
+	// linked is set if destinations are hardlinked to the object
+	linked bool
+}
+
+// GC removes the objects used least recently until those left total at most maxSize bytes (see GCWith).
+func (s *Store) GC(maxSize int64) (GCResult, error) {
+	return s.GCWith(GCOptions{MaxSize: maxSize, MaxObjects: -1})
+}
+
+// GCWith removes the objects unused for longer than opts.MaxAge, then the objects opts.Policy evicts first until
+// those left fit opts.MaxSize and opts.MaxObjects, along with the records of the URLs whose content was removed
+// and the temporary files of writes which never completed. Pinned objects are never removed, but count towards
+// the limits.
+func (s *Store) GCWith(opts GCOptions) (GCResult, error) {
+	var result GCResult
+	policy := opts.Policy
+	if policy == nil {
+		policy = LRU{}
+	}
+	pins, err := s.Pins()
+	if err != nil {
+		return result, err
+	}
+	pinned := make(map[string]bool, len(pins))
+	for _, digest := range pins {
+		pinned[digest] = true
+	}
+	var objects []object
+	err = filepath.WalkDir(filepath.Join(s.dir, objectsDir), func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		digest := digestPrefix + d.Name()
+		if ValidateDigest(digest) != nil {
+			// e.g. a probe of clone support
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		uses, lastUse := s.usage(digest, info)
+		o := object{
+			ObjectInfo: ObjectInfo{Digest: digest, Size: info.Size(), LastUse: lastUse, Uses: uses},
+			path:       path,
+			pinned:     pinned[digest],
+			linked:     fsutil.LinkCount(info) > 1,
+		}
+		objects = append(objects, o)
+		result.Objects++
+		result.Size += o.Size
+		if o.pinned {
+			result.Pinned++
+		}
+		return nil
+	})
+	if err != nil {
+		return result, fmt.Errorf("error listing the content cache: %w", err)
+	}
+	remove := func(o object) error {
+		if err := os.Remove(o.path); err != nil {
+			return fmt.Errorf("error removing %s from the content cache: %w", o.path, err)
+		}
+		os.Remove(s.usesPath(o.Digest))
+		os.Remove(s.verifiedPath(o.Digest))
+		result.Objects--
+		result.Size -= o.Size
+		result.Removed++
+		if !o.linked {
+			result.Freed += o.Size
+		}
+		return nil
+	}
+	sort.Slice(objects, func(i, j int) bool { return policy.EvictBefore(objects[i].ObjectInfo, objects[j].ObjectInfo) })
+	kept := objects[:0]
+	for _, o := range objects {
+		if !o.pinned && opts.MaxAge > 0 && time.Since(o.LastUse) > opts.MaxAge {
+			if err := remove(o); err != nil {
+				return result, err
+			}
+			continue
+		}
+		kept = append(kept, o)
+	}
+	for _, o := range kept {
+		overSize := opts.MaxSize >= 0 && result.Size > opts.MaxSize
+		overObjects := opts.MaxObjects >= 0 && result.Objects > opts.MaxObjects
+		if !overSize && !overObjects {
+			break
+		}
+		if o.pinned {
+			continue
+		}
+		if err := remove(o); err != nil {
+			return result, err
+		}
+	}
+	if result.Removed > 0 {
+		s.removeDanglingRecords()
+	}
+	s.removeStaleTemp()
+	return result, nil
+}
+
+// removeDanglingRecords removes the records whose content is no longer in the store.
+func (s *Store) removeDanglingRecords() {
+	logger := logging.GetLogger()
+	entries, err := os.ReadDir(filepath.Join(s.dir, urlsDir))
+	if err != nil {
+		logger.Warn().Err(err).Msg("Error listing content cache records")
+		return
+	}
+	for _, entry := range entries {
+		path := filepath.Join(s.dir, urlsDir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		var record Record
+		if json.Unmarshal(data, &record) == nil {
+			if _, err := s.Size(record.Digest); !errors.Is(err, ErrNotFound) {
+				continue
+			}
+		}
+		if err := os.Remove(path); err != nil {
+			logger.Warn().Err(err).Str("path", path).Msg("Error removing content cache record")
+		}
+	}
+}
+
+// removeStaleTemp removes the temporary files left behind by writes to the store which never completed.
+func (s *Store) removeStaleTemp() {
+	logger := logging.GetLogger()
+	entries, err := os.ReadDir(filepath.Join(s.dir, tmpDir))
+	if err != nil {
+		logger.Warn().Err(err).Msg("Error listing content cache temporary files")
+		return
+	}
+	for _, entry := range entries {
+		info, err := entry.Info()
+		if err != nil || time.Since(info.ModTime()) < staleTempAge {
+			continue
+		}
+		path := filepath.Join(s.dir, tmpDir, entry.Name())
+		if err := os.Remove(path); err != nil {
+			logger.Warn().Err(err).Str("path", path).Msg("Error removing content cache temporary file")
+		}
+	}
+}
@@ -0,0 +1,317 @@
+package cas_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/cas"
+	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/fsutil"
+)
+
+// writeFile writes content to a file in dir, returning its path and digest.
+func writeFile(t *testing.T, dir, name, content string) (string, string) {
+	path := filepath.Join(dir, name)
+	require.NoError(t, os.WriteFile(path, []byte(content), 0644))
+	sum := sha256.Sum256([]byte(content))
+	return path, "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// setLastUse sets the last use of the object of digest, recorded by its use file or, failing one, by the object
+// itself, which path is hardlinked to.
+func setLastUse(t *testing.T, store *cas.Store, digest, path string, lastUse time.Time) {
+	uses := filepath.Join(store.Dir(), "uses", strings.TrimPrefix(digest, "sha256:"))
+	if _, err := os.Stat(uses); err == nil {
+		path = uses
+	}
+	require.NoError(t, os.Chtimes(path, lastUse, lastUse))
+}
+
+func TestStore(t *testing.T) {
+	store, err := cas.Open(filepath.Join(t.TempDir(), "cache"))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	path, digest := writeFile(t, dir, "a.txt", "hello")
+
+	_, err = store.Size(digest)
+	assert.ErrorIs(t, err, cas.ErrNotFound)
+	require.NoError(t, store.Add(digest, path))
+	size, err := store.Size(digest)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), size)
+
+	dest := filepath.Join(dir, "sub", "b.txt")
+	size, err = store.Link(digest, dest)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), size)
+	data, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	pathInfo, err := os.Stat(path)
+	require.NoError(t, err)
+	destInfo, err := os.Stat(dest)
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(pathInfo, destInfo))
+
+	_, err = store.Lookup("https://example.com/a.txt")
+	assert.ErrorIs(t, err, cas.ErrNotFound)
+	record := cas.Record{URL: "https://example.com/a.txt", Digest: digest, Size: 5, ETag: `"v1"`}
+	require.NoError(t, store.Record(record))
+	found, err := store.Lookup(record.URL)
+	require.NoError(t, err)
+	assert.Equal(t, record, found)
+
+	for _, invalid := range []string{"", "sha256:abc", "md5:" + digest[len("sha256:"):], "SHA256:" + digest[len("sha256:"):]} {
+		assert.Error(t, store.Add(invalid, path), invalid)
+	}
+}
+
+func TestStoreCopyAndVerify(t *testing.T) {
+	store, err := cas.Open(filepath.Join(t.TempDir(), "cache"))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	path, digest := writeFile(t, dir, "a.txt", "hello")
+	require.NoError(t, store.AddCopy(digest, path))
+	require.NoError(t, store.Verify(digest))
+	require.NoError(t, store.VerifyChanged(digest))
+
+	// neither the added file nor a copy share the inode of the object, so changing their mode leaves it as is
+	dest := filepath.Join(dir, "b.txt")
+	_, err = store.Copy(digest, dest)
+	require.NoError(t, err)
+	require.NoError(t, os.Chmod(path, 0755))
+	require.NoError(t, os.Chmod(dest, 0700))
+	linked := filepath.Join(dir, "c.txt")
+	_, err = store.Link(digest, linked)
+	require.NoError(t, err)
+	info, err := os.Stat(linked)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), info.Mode().Perm())
+
+	// an object modified through a destination hardlinked to it is caught and removed
+	if fsutil.LinkCount(info) < 2 {
+		t.Skip("the destination was cloned rather than hardlinked")
+	}
+	require.NoError(t, os.WriteFile(linked, []byte("world"), 0644))
+	assert.ErrorIs(t, store.VerifyChanged(digest), cas.ErrCorrupt)
+	assert.ErrorIs(t, store.Verify(digest), cas.ErrNotFound)
+}
+
+func TestStoreVerifyChanged(t *testing.T) {
+	store, err := cas.Open(filepath.Join(t.TempDir(), "cache"))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	path, digest := writeFile(t, dir, "a.txt", "hello")
+	require.NoError(t, store.AddCopy(digest, path))
+	dest := filepath.Join(dir, "b.txt")
+	_, err = store.Link(digest, dest)
+	require.NoError(t, err)
+	info, err := os.Stat(dest)
+	require.NoError(t, err)
+	if fsutil.LinkCount(info) < 2 {
+		t.Skip("the destination was cloned rather than hardlinked")
+	}
+
+	// an object of the size and modification time it was added with isn't read again
+	require.NoError(t, os.WriteFile(dest, []byte("world"), 0644))
+	require.NoError(t, os.Chtimes(dest, info.ModTime(), info.ModTime()))
+	assert.NoError(t, store.VerifyChanged(digest))
+	assert.ErrorIs(t, store.Verify(digest), cas.ErrCorrupt)
+}
+
+func TestStoreClone(t *testing.T) {
+	// the temporary directory may not support clones: RPGET_TEST_CLONE_DIR may be set to a directory on btrfs, XFS
+	// or APFS to run the test there
+	dir := t.TempDir()
+	if cloneDir := os.Getenv("RPGET_TEST_CLONE_DIR"); cloneDir != "" {
+		var err error
+		dir, err = os.MkdirTemp(cloneDir, "rpget-cas-")
+		require.NoError(t, err)
+		t.Cleanup(func() { os.RemoveAll(dir) })
+	}
+	if !consumer.CanClone(dir, dir) {
+		t.Skip("the filesystem doesn't support clones")
+	}
+	store, err := cas.Open(filepath.Join(dir, "cache"))
+	require.NoError(t, err)
+	path, digest := writeFile(t, dir, "a.txt", "hello")
+	require.NoError(t, store.Add(digest, path))
+
+	// the object and the destinations are clones, sharing no inode: writing a destination leaves the object as is
+	dest := filepath.Join(dir, "sub", "b.txt")
+	_, err = store.Link(digest, dest)
+	require.NoError(t, err)
+	for _, p := range []string{path, dest} {
+		info, err := os.Stat(p)
+		require.NoError(t, err)
+		assert.Equal(t, uint64(1), fsutil.LinkCount(info), p)
+	}
+	require.NoError(t, os.WriteFile(dest, []byte("world"), 0644))
+	assert.NoError(t, store.Verify(digest))
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestStoreShared(t *testing.T) {
+	// nodes sharing the store add the same content at once, from files of their own
+	dir := filepath.Join(t.TempDir(), "cache")
+	var wg sync.WaitGroup
+	var digest string
+	for i := range 8 {
+		store, err := cas.Open(dir)
+		require.NoError(t, err)
+		path, d := writeFile(t, t.TempDir(), "a.txt", "hello")
+		digest = d
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			assert.NoError(t, store.Add(d, path), i)
+		}()
+	}
+	wg.Wait()
+
+	store, err := cas.Open(dir)
+	require.NoError(t, err)
+	dest := filepath.Join(t.TempDir(), "b.txt")
+	_, err = store.Link(digest, dest)
+	require.NoError(t, err)
+	data, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+	// no temporary file is left behind
+	entries, err := os.ReadDir(filepath.Join(dir, "tmp"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestGC(t *testing.T) {
+	store, err := cas.Open(t.TempDir())
+	require.NoError(t, err)
+	dir := t.TempDir()
+	oldPath, oldDigest := writeFile(t, dir, "old", "0123456789")
+	newPath, newDigest := writeFile(t, dir, "new", "abcdefghij")
+	require.NoError(t, store.Add(oldDigest, oldPath))
+	require.NoError(t, store.Add(newDigest, newPath))
+	require.NoError(t, store.Record(cas.Record{URL: "https://example.com/old", Digest: oldDigest, Size: 10}))
+	// the old object was used an hour ago, the new one is used now
+	setLastUse(t, store, oldDigest, oldPath, time.Now().Add(-time.Hour))
+	require.NoError(t, os.Remove(oldPath))
+	linked := filepath.Join(dir, "linked")
+	_, err = store.Link(newDigest, linked)
+	require.NoError(t, err)
+
+	result, err := store.GC(15)
+	require.NoError(t, err)
+	assert.Equal(t, cas.GCResult{Objects: 1, Size: 10, Removed: 1, Freed: 10}, result)
+	_, err = store.Size(oldDigest)
+	assert.ErrorIs(t, err, cas.ErrNotFound)
+	_, err = store.Size(newDigest)
+	assert.NoError(t, err)
+	_, err = store.Lookup("https://example.com/old")
+	assert.ErrorIs(t, err, cas.ErrNotFound)
+	entries, err := os.ReadDir(filepath.Join(store.Dir(), "urls"))
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+
+	// the new object is still linked to from destinations, unless they are clones
+	info, err := os.Stat(linked)
+	require.NoError(t, err)
+	freed := int64(10)
+	if fsutil.LinkCount(info) > 1 {
+		freed = 0
+	}
+	result, err = store.GC(0)
+	require.NoError(t, err)
+	assert.Equal(t, cas.GCResult{Removed: 1, Freed: freed}, result)
+}
+
+func TestGCWith(t *testing.T) {
+	// a, b and c were last used 3, 2 and 1 hours ago; a was used the most often and c the least
+	setup := func(t *testing.T) (*cas.Store, []string) {
+		store, err := cas.Open(t.TempDir())
+		require.NoError(t, err)
+		dir := t.TempDir()
+		var digests []string
+		for i, content := range []string{"aaaaaaaaaa", "bbbbbbbbbb", "cccccccccc"} {
+			path, digest := writeFile(t, dir, content, content)
+			require.NoError(t, store.Add(digest, path))
+			for j := range 2 - i {
+				_, err := store.Link(digest, filepath.Join(dir, fmt.Sprintf("%s-%d", content, j)))
+				require.NoError(t, err)
+			}
+			setLastUse(t, store, digest, path, time.Now().Add(-time.Duration(3-i)*time.Hour))
+			digests = append(digests, digest)
+		}
+		return store, digests
+	}
+	remaining := func(t *testing.T, store *cas.Store, digests []string) []int {
+		var left []int
+		for i, digest := range digests {
+			if _, err := store.Size(digest); err == nil {
+				left = append(left, i)
+			}
+		}
+		return left
+	}
+
+	testCases := []struct {
+		name    string
+		opts    cas.GCOptions
+		pin     []int
+		left    []int
+		removed int
+	}{
+		{"lru by size", cas.GCOptions{MaxSize: 20, MaxObjects: -1}, nil, []int{1, 2}, 1},
+		{"lfu by size", cas.GCOptions{MaxSize: 20, MaxObjects: -1, Policy: cas.LFU{}}, nil, []int{0, 1}, 1},
+		{"lru by count", cas.GCOptions{MaxSize: -1, MaxObjects: 1}, nil, []int{2}, 2},
+		{"lfu by count", cas.GCOptions{MaxSize: -1, MaxObjects: 1, Policy: cas.LFU{}}, nil, []int{0}, 2},
+		{"max age", cas.GCOptions{MaxSize: -1, MaxObjects: -1, MaxAge: 150 * time.Minute}, nil, []int{1, 2}, 1},
+		{"pinned", cas.GCOptions{MaxSize: 10, MaxObjects: -1}, []int{0}, []int{0}, 2},
+		{"pinned and too old", cas.GCOptions{MaxSize: -1, MaxObjects: -1, MaxAge: time.Minute}, []int{0, 2}, []int{0, 2}, 1},
+		{"empty", cas.GCOptions{}, []int{1}, []int{1}, 2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			store, digests := setup(t)
+			for _, i := range tc.pin {
+				require.NoError(t, store.Pin(digests[i]))
+			}
+			result, err := store.GCWith(tc.opts)
+			require.NoError(t, err)
+			assert.Equal(t, tc.left, remaining(t, store, digests))
+			assert.Equal(t, tc.removed, result.Removed)
+			assert.Equal(t, len(tc.pin), result.Pinned)
+		})
+	}
+}
+
+func TestPins(t *testing.T) {
+	store, err := cas.Open(t.TempDir())
+	require.NoError(t, err)
+	_, a := writeFile(t, t.TempDir(), "a", "a")
+	_, b := writeFile(t, t.TempDir(), "b", "b")
+	require.NoError(t, store.Pin(b))
+	require.NoError(t, store.Pin(a))
+	require.NoError(t, store.Pin(a))
+	pins, err := store.Pins()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []string{a, b}, pins)
+
+	require.NoError(t, store.Unpin(a))
+	require.NoError(t, store.Unpin(a))
+	pins, err = store.Pins()
+	require.NoError(t, err)
+	assert.Equal(t, []string{b}, pins)
+	assert.Error(t, store.Pin("sha256:abc"))
+}
@@ -0,0 +1,58 @@
+package cas
+
+import (
+	"fmt"
+	"time"
+)
+
+// ObjectInfo describes an object of the store, for eviction policies.
+type ObjectInfo struct {
+	Digest string
+	Size   int64
+	// LastUse is when the object was last added or linked to a destination.
+	LastUse time.Time
+	// Uses is the number of times the object was added or linked to a destination. Uses by nodes sharing the store
+	// over a network filesystem at the same time may be missed.
+	Uses int64
+}
+
+// EvictionPolicy chooses the objects GC removes first to fit the limits of the store: EvictBefore reports whether
+// a should be removed before b.
+type EvictionPolicy interface {
+	EvictBefore(a, b ObjectInfo) bool
+}
+
+const (
+	PolicyLRU = "lru"
+	PolicyLFU = "lfu"
+)
+
+// ParseEvictionPolicy returns the EvictionPolicy named name, LRU if name is empty.
+func ParseEvictionPolicy(name string) (EvictionPolicy, error) {
+	switch name {
+	case "", PolicyLRU:
+		return LRU{}, nil
+	case PolicyLFU:
+		return LFU{}, nil
+	default:
+		return nil, fmt.Errorf("invalid eviction policy %s, expected %s or %s", name, PolicyLRU, PolicyLFU)
+	}
+}
+
+// LRU removes the objects used least recently first.
+type LRU struct{}
+
+func (LRU) EvictBefore(a, b ObjectInfo) bool {
+	return a.LastUse.Before(b.LastUse)
+}
+
+// LFU removes the objects used least often first, and of those the ones used least recently, so that content
+// downloaded once doesn't evict the content many destinations are linked from.
+type LFU struct{}
+
+func (LFU) EvictBefore(a, b ObjectInfo) bool {
+	if a.Uses != b.Uses {
+		return a.Uses < b.Uses
+	}
+	return LRU{}.EvictBefore(a, b)
+}
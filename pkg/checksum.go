@@ -0,0 +1,76 @@
+package rpget
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+)
+
+const (
+	checksumSHA256Prefix = "sha256:"
+	checksumSizePrefix   = "size="
+)
+
+// ErrChecksumMismatch is returned when a downloaded file does not match the checksum of its manifest entry.
+var ErrChecksumMismatch = errors.New("checksum mismatch")
+
+// verifier checks the bytes written to it against a manifest entry checksum, either "sha256:<hex>" or "size=<n>".
+type verifier struct {
+	checksum string
+	sha256   []byte
+	size     int64
+	hash     hash.Hash
+	written  int64
+}
+
+// ValidateChecksum returns an error if checksum is not a valid manifest entry checksum.
+func ValidateChecksum(checksum string) error {
+	_, err := newVerifier(checksum)
+	return err
+}
+
+func newVerifier(checksum string) (*verifier, error) {
+	v := &verifier{checksum: checksum, size: -1}
+	switch {
+	case strings.HasPrefix(checksum, checksumSHA256Prefix):
+		digest, err := hex.DecodeString(strings.TrimPrefix(checksum, checksumSHA256Prefix))
+		if err != nil || len(digest) != sha256.Size {
+			return nil, fmt.Errorf("invalid sha256 checksum `%s`", checksum)
+		}
+		v.sha256 = digest
+		v.hash = sha256.New()
+	case strings.HasPrefix(checksum, checksumSizePrefix):
+		size, err := strconv.ParseInt(strings.TrimPrefix(checksum, checksumSizePrefix), 10, 64)
+		if err != nil || size < 0 {
+			return nil, fmt.Errorf("invalid size checksum `%s`", checksum)
+		}
+		v.size = size
+	default:
+		return nil, fmt.Errorf("unsupported checksum `%s`, expected sha256:<hex> or size=<n>", checksum)
+	}
+	return v, nil
+}
+
+func (v *verifier) Write(p []byte) (int, error) {
+	v.written += int64(len(p))
+	if v.hash != nil {
+		v.hash.Write(p)
+	}
+	return len(p), nil
+}
+
+func (v *verifier) verify() error {
+	if v.size >= 0 && v.written != v.size {
+		return fmt.Errorf("%w: expected %d bytes, got %d", ErrChecksumMismatch, v.size, v.written)
+	}
+	if v.hash != nil {
+		if got := v.hash.Sum(nil); string(got) != string(v.sha256) {
+			return fmt.Errorf("%w: expected %s, got %s%s", ErrChecksumMismatch, v.checksum, checksumSHA256Prefix, hex.EncodeToString(got))
+		}
+	}
+	return nil
+}
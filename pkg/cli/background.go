@@ -0,0 +1,53 @@
+//go:build !windows
+
+package cli
+
+import (
+	"fmt"
+
+	"github.com/spf13/viper"
+
+	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+const (
+	// backgroundNice is the nice value of background runs, the lowest CPU priority.
+	backgroundNice = 19
+	// backgroundMaxTotalConnections and backgroundMaxConcurrentFiles replace the defaults of --max-total-connections
+	// and of the maximum number of files downloaded at once in background runs.
+	backgroundMaxTotalConnections = 4
+	backgroundMaxConcurrentFiles  = 2
+)
+
+// Background lowers the priority of rpget if --background is set, so that prefetching files doesn't slow down
+// latency-sensitive workloads on the same host: its nice value is raised to 19 and, on Linux, its I/O is only
+// scheduled when no other process needs the disk (the idle class of ionice). The number of chunks and files
+// downloaded at once are lowered too, unless they are configured. It must be called before the options are read.
+func Background() error {
+	if !viper.GetBool(config.OptBackground) {
+		return nil
+	}
+	if err := lowerPriority(); err != nil {
+		return fmt.Errorf("error lowering the priority with --%s: %w", config.OptBackground, err)
+	}
+	lowerConcurrency()
+	logger := logging.GetLogger()
+	logger.Debug().
+		Int("nice", backgroundNice).
+		Int("max_total_connections", viper.GetInt(config.OptMaxTotalConnections)).
+		Int("max_concurrent_files", viper.GetInt(config.OptMaxConcurrentFiles)).
+		Msg("Background Priority Set")
+	return nil
+}
+
+// lowerConcurrency lowers the number of chunks and files downloaded at once to those of background runs, unless they
+// are configured, with their deprecated options included.
+func lowerConcurrency() {
+	if !viper.IsSet(config.OptMaxTotalConnections) && !viper.IsSet(config.OptConcurrency) && !viper.IsSet(config.OptMaxChunks) {
+		viper.Set(config.OptMaxTotalConnections, backgroundMaxTotalConnections)
+	}
+	if !viper.IsSet(config.OptMaxConcurrentFiles) {
+		viper.Set(config.OptMaxConcurrentFiles, backgroundMaxConcurrentFiles)
+	}
+}
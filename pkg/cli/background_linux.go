@@ -0,0 +1,52 @@
+//go:build linux
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ioprioWhoProcess = 1
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+)
+
+// lowerPriority sets the nice value and the I/O scheduling class of every thread of rpget. Linux sets both per
+// thread, and threads inherit them from the thread creating them, so once every thread is lowered the threads the
+// runtime creates afterwards are too; the threads created meanwhile are caught by going over them again.
+func lowerPriority() error {
+	lowered := make(map[int]bool)
+	for {
+		tasks, err := os.ReadDir("/proc/self/task")
+		if err != nil {
+			return err
+		}
+		done := true
+		for _, task := range tasks {
+			tid, err := strconv.Atoi(task.Name())
+			if err != nil || lowered[tid] {
+				continue
+			}
+			done = false
+			lowered[tid] = true
+			// threads may exit meanwhile
+			if err := unix.Setpriority(unix.PRIO_PROCESS, tid, backgroundNice); err != nil && !errors.Is(err, syscall.ESRCH) {
+				return fmt.Errorf("setting the nice value: %w", err)
+			}
+			_, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassIdle<<ioprioClassShift)
+			if errno != 0 && errno != syscall.ESRCH {
+				return fmt.Errorf("setting the I/O priority: %w", errno)
+			}
+		}
+		if done {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !linux && !windows
+
+package cli
+
+import (
+	"fmt"
+	"syscall"
+)
+
+// lowerPriority sets the nice value of rpget. The I/O priority can't be set beyond Linux.
+func lowerPriority() error {
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, backgroundNice); err != nil {
+		return fmt.Errorf("setting the nice value: %w", err)
+	}
+	return nil
+}
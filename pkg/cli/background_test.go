@@ -0,0 +1,28 @@
+//go:build !windows
+
+package cli
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/emaballarin/rpget/pkg/config"
+)
+
+func TestLowerConcurrency(t *testing.T) {
+	defer viper.Reset()
+
+	lowerConcurrency()
+	assert.Equal(t, backgroundMaxTotalConnections, intOption(config.OptMaxTotalConnections, config.OptConcurrency))
+	assert.Equal(t, backgroundMaxConcurrentFiles, viper.GetInt(config.OptMaxConcurrentFiles))
+
+	// configured options are kept, deprecated ones included
+	viper.Reset()
+	viper.Set(config.OptConcurrency, 8)
+	viper.Set(config.OptMaxConcurrentFiles, 10)
+	lowerConcurrency()
+	assert.Equal(t, 8, intOption(config.OptMaxTotalConnections, config.OptConcurrency))
+	assert.Equal(t, 10, viper.GetInt(config.OptMaxConcurrentFiles))
+}
@@ -42,7 +42,12 @@ Additional help topics:{{range .Commands}}{{if .IsAdditionalHelpTopicCommand}}
 Use "{{.CommandPath}} [command] --help" for more information about a command.{{end}}
 `
 
+// EnsureDestinationNotExist returns an error if dest exists, unless --force is set or, with --idempotent or
+// --skip-existing, the download compares it with the remote file.
 func EnsureDestinationNotExist(dest string) error {
+	if viper.GetBool(config.OptIdempotent) || viper.GetString(config.OptSkipExisting) != "" {
+		return nil
+	}
 	_, err := os.Stat(dest)
 	if !viper.GetBool(config.OptForce) && !errors.Is(err, fs.ErrNotExist) {
 		return fmt.Errorf("destination %s already exists", dest)
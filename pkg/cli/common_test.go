@@ -20,20 +20,23 @@ func TestEnsureDestinationNotExist(t *testing.T) {
 	defer os.Remove(f.Name())
 
 	testCases := []struct {
-		name     string
-		fileName string
-		force    bool
-		err      bool
+		name       string
+		fileName   string
+		force      bool
+		idempotent bool
+		err        bool
 	}{
-		{"force true, file exists", f.Name(), true, false},
-		{"force false, file exists", f.Name(), false, true},
-		{"force true, file does not exist", f.Name(), true, false},
-		{"force false, file does not exist", "unknownFile", false, false},
+		{"force true, file exists", f.Name(), true, false, false},
+		{"force false, file exists", f.Name(), false, false, true},
+		{"force true, file does not exist", f.Name(), true, false, false},
+		{"force false, file does not exist", "unknownFile", false, false, false},
+		{"idempotent, file exists", f.Name(), false, true, false},
 	}
 
 	for _, tc := range testCases {
 		t.Run(tc.name, func(t *testing.T) {
 			viper.Set(config.OptForce, tc.force)
+			viper.Set(config.OptIdempotent, tc.idempotent)
 			err := EnsureDestinationNotExist(tc.fileName)
 			assert.Equal(t, tc.err, err != nil)
 		})
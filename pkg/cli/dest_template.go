@@ -0,0 +1,85 @@
+package cli
+
+import (
+	"bytes"
+	"fmt"
+	"net/url"
+	"path"
+	"path/filepath"
+	"text/template"
+)
+
+// DestTemplate computes the destinations of files from the components of their URL, e.g. `{{.Host}}/{{.Path}}`.
+type DestTemplate struct {
+	t *template.Template
+}
+
+// destTemplateData is the data available to destination templates.
+type destTemplateData struct {
+	Scheme string
+	// Host is the host name of the URL, without its port
+	Host string
+	Port string
+	// Path is the path of the URL, cleaned and without its leading slash, so it can't escape the directory it is
+	// joined to
+	Path string
+	// Dir is the directory of Path, "." if it has none, and Name its last element
+	Dir  string
+	Name string
+	// Ext is the extension of Name, e.g. ".tar"
+	Ext string
+}
+
+// ParseDestTemplate parses a destination template, see DestTemplate.
+func ParseDestTemplate(text string) (*DestTemplate, error) {
+	t, err := template.New("dest").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid destination template `%s`: %w", text, err)
+	}
+	return &DestTemplate{t: t}, nil
+}
+
+// Dest returns the destination of the file at rawURL.
+func (d *DestTemplate) Dest(rawURL string) (string, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	p := path.Clean("/" + u.Path)[1:]
+	data := destTemplateData{
+		Scheme: u.Scheme,
+		Host:   u.Hostname(),
+		Port:   u.Port(),
+		Path:   p,
+		Dir:    path.Dir(p),
+		Name:   path.Base(p),
+		Ext:    path.Ext(p),
+	}
+	if p == "" {
+		data.Name = ""
+	}
+	var buf bytes.Buffer
+	if err := d.t.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("error computing the destination of %s: %w", rawURL, err)
+	}
+	dest := filepath.Clean(buf.String())
+	if buf.Len() == 0 || dest == "." || dest == string(filepath.Separator) {
+		return "", fmt.Errorf("the destination of %s computed from its URL is empty", rawURL)
+	}
+	return dest, nil
+}
+
+// ExpandURLs expands the brace expressions of rawURL (see ExpandBraces), returning the URLs and their destinations.
+func (d *DestTemplate) ExpandURLs(rawURL string) ([]string, []string, error) {
+	urls, err := ExpandBraces(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	dests := make([]string, len(urls))
+	for i, u := range urls {
+		if dests[i], err = d.Dest(u); err != nil {
+			return nil, nil, err
+		}
+	}
+	return urls, dests, nil
+}
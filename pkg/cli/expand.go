@@ -0,0 +1,212 @@
+package cli
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/url"
+	"path"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// maxExpansions bounds the number of strings a pattern expands to, against typos such as {0..99999999}.
+const maxExpansions = 100_000
+
+var braceRangeRegexp = regexp.MustCompile(`^(-?[0-9]+)\.\.(-?[0-9]+)$`)
+
+// ExpandBraces expands the brace expressions of pattern as shells do: {a,b,c} expands to each alternative, and
+// {first..last} to the integers from first to last, zero-padded to the width of the bounds if one of them is, e.g.
+// shard-{00..02} to shard-00, shard-01 and shard-02. Expressions may be nested, and several expressions expand to
+// every combination, in order. Braces which aren't an expression, such as {x}, are kept as they are.
+func ExpandBraces(pattern string) ([]string, error) {
+	expanded, err := expandBraces(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("error expanding %s: %w", pattern, err)
+	}
+	return expanded, nil
+}
+
+func expandBraces(pattern string) ([]string, error) {
+	for start := 0; start < len(pattern); start++ {
+		if pattern[start] != '{' {
+			continue
+		}
+		end, alternatives := braceExpression(pattern, start)
+		if end < 0 {
+			continue
+		}
+		var choices []string
+		if alternatives != nil {
+			for _, alternative := range alternatives {
+				expanded, err := expandBraces(alternative)
+				if err != nil {
+					return nil, err
+				}
+				choices = append(choices, expanded...)
+			}
+		} else {
+			var err error
+			if choices, err = braceRange(pattern[start+1 : end]); err != nil {
+				return nil, err
+			}
+		}
+		suffixes, err := expandBraces(pattern[end+1:])
+		if err != nil {
+			return nil, err
+		}
+		if len(choices)*len(suffixes) > maxExpansions {
+			return nil, fmt.Errorf("expands to more than %d strings", maxExpansions)
+		}
+		expanded := make([]string, 0, len(choices)*len(suffixes))
+		for _, choice := range choices {
+			for _, suffix := range suffixes {
+				expanded = append(expanded, pattern[:start]+choice+suffix)
+			}
+		}
+		return expanded, nil
+	}
+	return []string{pattern}, nil
+}
+
+// braceExpression returns the index of the brace closing the expression opened at start in pattern, and its
+// alternatives if it is a list rather than a range. The index is -1 if the braces aren't an expression.
+func braceExpression(pattern string, start int) (int, []string) {
+	depth := 0
+	var alternatives []string
+	from := start + 1
+	for i := start; i < len(pattern); i++ {
+		switch pattern[i] {
+		case '{':
+			depth++
+		case ',':
+			if depth == 1 {
+				alternatives = append(alternatives, pattern[from:i])
+				from = i + 1
+			}
+		case '}':
+			depth--
+			if depth > 0 {
+				continue
+			}
+			if alternatives != nil {
+				return i, append(alternatives, pattern[from:i])
+			}
+			if braceRangeRegexp.MatchString(pattern[start+1 : i]) {
+				return i, nil
+			}
+			return -1, nil
+		}
+	}
+	return -1, nil
+}
+
+// braceRange expands the range expression first..last.
+func braceRange(expression string) ([]string, error) {
+	bounds := braceRangeRegexp.FindStringSubmatch(expression)
+	first, err := strconv.Atoi(bounds[1])
+	if err != nil {
+		return nil, fmt.Errorf("invalid range {%s}: %w", expression, err)
+	}
+	last, err := strconv.Atoi(bounds[2])
+	if err != nil {
+		return nil, fmt.Errorf("invalid range {%s}: %w", expression, err)
+	}
+	width := 0
+	for _, bound := range bounds[1:] {
+		digits := strings.TrimPrefix(bound, "-")
+		if len(digits) > 1 && digits[0] == '0' {
+			width = max(len(bounds[1]), len(bounds[2]))
+		}
+	}
+	step := 1
+	if last < first {
+		step = -1
+	}
+	n := (last-first)*step + 1
+	if n > maxExpansions {
+		return nil, fmt.Errorf("range {%s} expands to more than %d strings", expression, maxExpansions)
+	}
+	expanded := make([]string, 0, n)
+	for i := first; ; i += step {
+		expanded = append(expanded, fmt.Sprintf("%0*d", width, i))
+		if i == last {
+			return expanded, nil
+		}
+	}
+}
+
+// ExpandURLs expands the brace expressions of rawURL and dest (see ExpandBraces), pairing every URL with a
+// destination. dest must expand to as many destinations as rawURL expands to URLs, or to a single one: a directory
+// the files are written into, named after the last element of their URL path, or, if into is set, which every file
+// is written (e.g. extracted) into.
+func ExpandURLs(rawURL, dest string, into bool) ([]string, []string, error) {
+	urls, err := ExpandBraces(rawURL)
+	if err != nil {
+		return nil, nil, err
+	}
+	dests, err := ExpandBraces(dest)
+	if err != nil {
+		return nil, nil, err
+	}
+	switch {
+	case len(dests) == len(urls):
+		return urls, dests, nil
+	case len(dests) != 1:
+		return nil, nil, fmt.Errorf("%s expands to %d URLs but %s to %d destinations", rawURL, len(urls), dest, len(dests))
+	}
+	if dests, err = URLDestinations(urls, dest, into); err != nil {
+		return nil, nil, err
+	}
+	return urls, dests, nil
+}
+
+// ReadURLs reads a list of URLs, one per line, expanding their brace expressions (see ExpandBraces). Blank lines
+// are skipped.
+func ReadURLs(r io.Reader) ([]string, error) {
+	var urls []string
+	scanner := bufio.NewScanner(r)
+	for lineNumber := 1; scanner.Scan(); lineNumber++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" {
+			continue
+		}
+		if strings.ContainsFunc(line, unicode.IsSpace) {
+			return nil, fmt.Errorf("line %d: expected a single URL, got `%s`", lineNumber, line)
+		}
+		expanded, err := ExpandBraces(line)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %w", lineNumber, err)
+		}
+		if len(urls)+len(expanded) > maxExpansions {
+			return nil, fmt.Errorf("more than %d URLs listed", maxExpansions)
+		}
+		urls = append(urls, expanded...)
+	}
+	return urls, scanner.Err()
+}
+
+// URLDestinations returns the destinations of urls written into the directory dir: files named after the last
+// element of their URL path, or, if into is set, dir itself for every file, e.g. to extract them all into it.
+func URLDestinations(urls []string, dir string, into bool) ([]string, error) {
+	dests := make([]string, len(urls))
+	for i, u := range urls {
+		if into {
+			dests[i] = dir
+			continue
+		}
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		name := path.Base(parsed.Path)
+		if name == "/" || name == "." {
+			return nil, fmt.Errorf("can't name the destination of %s after its URL", u)
+		}
+		dests[i] = filepath.Join(dir, name)
+	}
+	return dests, nil
+}
@@ -0,0 +1,101 @@
+package cli
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExpandBraces(t *testing.T) {
+	for pattern, expected := range map[string][]string{
+		"shard-{00..02}.tar":   {"shard-00.tar", "shard-01.tar", "shard-02.tar"},
+		"shard-{8..10}.tar":    {"shard-8.tar", "shard-9.tar", "shard-10.tar"},
+		"shard-{2..0}":         {"shard-2", "shard-1", "shard-0"},
+		"{-1..1}":              {"-1", "0", "1"},
+		"{a,b}-{1..2}":         {"a-1", "a-2", "b-1", "b-2"},
+		"{train,val{0..1}}":    {"train", "val0", "val1"},
+		"model{,.index}":       {"model", "model.index"},
+		"{x}/{}/{1..}/{a,b":    {"{x}/{}/{1..}/{a,b"},
+		"{x{a,b}}":             {"{xa}", "{xb}"},
+		"https://example.com/": {"https://example.com/"},
+	} {
+		expanded, err := ExpandBraces(pattern)
+		require.NoError(t, err, pattern)
+		assert.Equal(t, expected, expanded, pattern)
+	}
+
+	_, err := ExpandBraces("{0..100000}")
+	assert.ErrorContains(t, err, "more than")
+	_, err = ExpandBraces("{0..999}{0..999}")
+	assert.ErrorContains(t, err, "more than")
+}
+
+func TestExpandURLs(t *testing.T) {
+	urls, dests, err := ExpandURLs("https://example.com/shard-{0..1}.tar", "/data/{a,b}.tar", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://example.com/shard-0.tar", "https://example.com/shard-1.tar"}, urls)
+	assert.Equal(t, []string{"/data/a.tar", "/data/b.tar"}, dests)
+
+	// a single destination is a directory
+	_, dests, err = ExpandURLs("https://example.com/shard-{0..1}.tar?v=1", "/data", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/data/shard-0.tar", "/data/shard-1.tar"}, dests)
+	_, dests, err = ExpandURLs("https://example.com/shard-{0..1}.tar", "/data", true)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/data", "/data"}, dests)
+
+	urls, dests, err = ExpandURLs("https://example.com/file.bin", "/data/file.bin", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://example.com/file.bin"}, urls)
+	assert.Equal(t, []string{"/data/file.bin"}, dests)
+
+	_, _, err = ExpandURLs("https://example.com/shard-{0..2}.tar", "/data/{a,b}.tar", false)
+	assert.ErrorContains(t, err, "expands to 3 URLs but /data/{a,b}.tar to 2 destinations")
+	_, _, err = ExpandURLs("https://{a,b}.example.com/", "/data", false)
+	assert.ErrorContains(t, err, "can't name the destination")
+}
+
+func TestReadURLs(t *testing.T) {
+	urls, err := ReadURLs(strings.NewReader("https://example.com/a.bin\n\n  https://example.com/shard-{0..1}.tar  \r\n"))
+	require.NoError(t, err)
+	assert.Equal(t, []string{"https://example.com/a.bin", "https://example.com/shard-0.tar", "https://example.com/shard-1.tar"}, urls)
+
+	dests, err := URLDestinations(urls, "/data", false)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/data/a.bin", "/data/shard-0.tar", "/data/shard-1.tar"}, dests)
+
+	_, err = ReadURLs(strings.NewReader("https://example.com/a.bin\nhttps://example.com/b.bin /data/b.bin\n"))
+	assert.ErrorContains(t, err, "line 2: expected a single URL")
+}
+
+func TestDestTemplate(t *testing.T) {
+	d, err := ParseDestTemplate("{{.Host}}/{{.Path}}")
+	require.NoError(t, err)
+	dest, err := d.Dest("https://example.com:8443/models/a/../b/weights.bin?sig=x")
+	require.NoError(t, err)
+	assert.Equal(t, "example.com/models/b/weights.bin", dest)
+	dest, err = d.Dest("https://example.com/../../etc/passwd")
+	require.NoError(t, err)
+	assert.Equal(t, "example.com/etc/passwd", dest)
+
+	d, err = ParseDestTemplate("/data/{{.Dir}}/{{.Port}}-{{.Name}}")
+	require.NoError(t, err)
+	urls, dests, err := d.ExpandURLs("http://example.com:8080/shard-{0..1}.tar")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"http://example.com:8080/shard-0.tar", "http://example.com:8080/shard-1.tar"}, urls)
+	assert.Equal(t, []string{"/data/8080-shard-0.tar", "/data/8080-shard-1.tar"}, dests)
+
+	d, err = ParseDestTemplate("{{.Path}}")
+	require.NoError(t, err)
+	_, err = d.Dest("https://example.com/")
+	assert.ErrorContains(t, err, "is empty")
+
+	_, err = ParseDestTemplate("{{.Host")
+	assert.ErrorContains(t, err, "invalid destination template")
+	d, err = ParseDestTemplate("{{.Hostname}}")
+	require.NoError(t, err)
+	_, err = d.Dest("https://example.com/a")
+	assert.Error(t, err)
+}
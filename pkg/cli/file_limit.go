@@ -0,0 +1,97 @@
+//go:build !windows
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"syscall"
+
+	"github.com/spf13/viper"
+
+	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// openFileReserve is the number of file descriptors left to everything but downloads: stdio, the PID file, the
+// write-ahead log, DNS lookups, hooks...
+const openFileReserve = 64
+
+// SetOpenFileLimit sets the soft limit on open files (RLIMIT_NOFILE) to --open-file-limit, if set, raising the hard
+// limit too if it is lower, which requires privileges. The Go runtime already raises the soft limit to the hard
+// limit on start, so it is only needed beyond the hard limit, or to lower it. It must be called before RunAs.
+func SetOpenFileLimit() error {
+	limit := viper.GetUint64(config.OptOpenFileLimit)
+	if limit == 0 {
+		return nil
+	}
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return fmt.Errorf("error getting the open file limit: %w", err)
+	}
+	rlimit.Cur = rlimitValue(limit)
+	rlimit.Max = max(rlimit.Max, rlimitValue(limit))
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return fmt.Errorf("error setting the open file limit to %d with --%s: %w", limit, config.OptOpenFileLimit, err)
+	}
+	logger := logging.GetLogger()
+	logger.Debug().Uint64("open_file_limit", limit).Msg("Open File Limit Set")
+	return nil
+}
+
+// OpenFileLimit returns the soft limit on open files, or 0 if it is unknown.
+func OpenFileLimit() uint64 {
+	var rlimit syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rlimit); err != nil {
+		return 0
+	}
+	return fromRlimit(rlimit.Cur)
+}
+
+// FitOpenFileLimit caps maxFiles, the number of files downloaded at once, and concurrency, the number of chunks of a
+// file downloaded at once, so that the destinations of the files and their connections to hosts, at most
+// maxConnPerHost per host if set, fit in the open file limit. Every file is capped to fit alone, so downloads still
+// make progress with a very low limit.
+func FitOpenFileLimit(maxFiles, concurrency, hosts, maxConnPerHost int) (int, int) {
+	limit := OpenFileLimit()
+	if limit == 0 {
+		return maxFiles, concurrency
+	}
+	files, chunks := fitOpenFileLimit(limit, maxFiles, concurrency, hosts, maxConnPerHost)
+	if files != maxFiles || chunks != concurrency {
+		logger := logging.GetLogger()
+		logger.Warn().
+			Uint64("open_file_limit", limit).
+			Int("max_concurrent_files", files).
+			Int("concurrency", chunks).
+			Msgf("Concurrency lowered to fit the open file limit, raise it with --%s", config.OptOpenFileLimit)
+	}
+	return files, chunks
+}
+
+func fitOpenFileLimit(limit uint64, maxFiles, concurrency, hosts, maxConnPerHost int) (int, int) {
+	budget := max(2, int(min(limit, 1<<30))-openFileReserve)
+	// a file has a connection per chunk and its destination open
+	if concurrency > 0 {
+		concurrency = min(concurrency, budget-1)
+	}
+	fitting := budget / (max(1, concurrency) + 1)
+	if maxConnPerHost > 0 && hosts > 0 {
+		// beyond maxConnPerHost, chunks wait for a connection instead of opening one
+		fitting = max(fitting, budget-hosts*maxConnPerHost)
+	}
+	if maxFiles == 0 || maxFiles > fitting {
+		maxFiles = max(1, fitting)
+	}
+	return maxFiles, concurrency
+}
+
+// ExplainOpenFileLimit adds to err, if it was caused by running out of file descriptors (EMFILE), the open file limit
+// and the options avoiding it.
+func ExplainOpenFileLimit(err error) error {
+	if !errors.Is(err, syscall.EMFILE) {
+		return err
+	}
+	return fmt.Errorf("%w (the open file limit is %d: lower --%s or --%s, or raise it with --%s)",
+		err, OpenFileLimit(), config.OptMaxConcurrentFiles, config.OptMaxTotalConnections, config.OptOpenFileLimit)
+}
@@ -0,0 +1,13 @@
+package cli
+
+import "math"
+
+// rlimitValue and fromRlimit convert limits to and from the fields of syscall.Rlimit, which are int64 on FreeBSD,
+// where RLIM_INFINITY is the largest int64.
+func rlimitValue(limit uint64) int64 {
+	return int64(min(limit, math.MaxInt64))
+}
+
+func fromRlimit(value int64) uint64 {
+	return uint64(max(value, 0))
+}
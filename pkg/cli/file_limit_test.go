@@ -0,0 +1,50 @@
+//go:build !windows
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFitOpenFileLimit(t *testing.T) {
+	testCases := []struct {
+		name                       string
+		limit                      uint64
+		maxFiles, concurrency      int
+		hosts, maxConnPerHost      int
+		wantFiles, wantConcurrency int
+	}{
+		{"fits", 1 << 20, 20, 32, 1, 40, 20, 32},
+		{"files capped", 1024, 40, 32, 10, 0, 29, 32},
+		{"connections per host capped", 1024, 40, 32, 2, 40, 40, 32},
+		{"many hosts", 1024, 100, 32, 100, 40, 29, 32},
+		{"no limit on files", 1024, 0, 32, 1, 0, 29, 32},
+		{"concurrency capped", 100, 20, 64, 1, 0, 1, 35},
+		{"tiny limit", 16, 20, 64, 1, 0, 1, 1},
+		{"unlimited", 1<<63 - 1, 500, 64, 1, 0, 500, 64},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			files, concurrency := fitOpenFileLimit(tc.limit, tc.maxFiles, tc.concurrency, tc.hosts, tc.maxConnPerHost)
+			assert.Equal(t, tc.wantFiles, files)
+			assert.Equal(t, tc.wantConcurrency, concurrency)
+		})
+	}
+}
+
+func TestExplainOpenFileLimit(t *testing.T) {
+	err := fmt.Errorf("failed to download: %w", &os.PathError{Op: "open", Path: "/tmp/x", Err: syscall.EMFILE})
+	explained := ExplainOpenFileLimit(err)
+	assert.ErrorIs(t, explained, syscall.EMFILE)
+	assert.Contains(t, explained.Error(), "--open-file-limit")
+
+	other := errors.New("not found")
+	assert.Equal(t, other, ExplainOpenFileLimit(other))
+	assert.NoError(t, ExplainOpenFileLimit(nil))
+}
@@ -0,0 +1,13 @@
+//go:build !windows && !freebsd
+
+package cli
+
+// rlimitValue and fromRlimit convert limits to and from the fields of syscall.Rlimit, which are uint64 but on
+// FreeBSD.
+func rlimitValue(limit uint64) uint64 {
+	return limit
+}
+
+func fromRlimit(value uint64) uint64 {
+	return value
+}
@@ -0,0 +1,70 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// Hooks returns the hooks running the commands of --on-complete and --on-error for every file.
+func Hooks() rpget.Hooks {
+	var hooks rpget.Hooks
+	if command := viper.GetString(config.OptOnComplete); command != "" {
+		hooks.OnComplete = func(_ context.Context, entry rpget.ManifestEntry) {
+			runHook(config.OptOnComplete, command, map[string]string{"url": entry.URL, "dest": entry.Dest})
+		}
+	}
+	if command := viper.GetString(config.OptOnError); command != "" {
+		hooks.OnError = func(_ context.Context, entry rpget.ManifestEntry, err error) {
+			runHook(config.OptOnError, command, map[string]string{"url": entry.URL, "dest": entry.Dest, "error": err.Error()})
+		}
+	}
+	return hooks
+}
+
+// OnAllComplete runs the command of --on-all-complete, if set, once all the files of a run, which downloaded size
+// bytes, have completed.
+func OnAllComplete(files int, size int64) {
+	if command := viper.GetString(config.OptOnAllComplete); command != "" {
+		runHook(config.OptOnAllComplete, command, map[string]string{"files": strconv.Itoa(files), "bytes": strconv.FormatInt(size, 10)})
+	}
+}
+
+// runHook runs command with sh. Every {<name>} placeholder of vars in it is replaced with a quoted reference to
+// the environment variable RPGET_<NAME>, which holds its value, so that values are never parsed by the shell. A
+// failing hook is only logged: the files it is run for are still downloaded.
+func runHook(opt, command string, vars map[string]string) {
+	logger := logging.GetLogger()
+	env := os.Environ()
+	for name, value := range vars {
+		variable := "RPGET_" + strings.ToUpper(name)
+		command = strings.ReplaceAll(command, "{"+name+"}", `"$`+variable+`"`)
+		env = append(env, variable+"="+value)
+	}
+	// a hook isn't interrupted by the failure of other files
+	cmd := exec.Command("/bin/sh", "-c", command)
+	cmd.Env = env
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		logger.Warn().
+			Err(err).
+			Str("hook", opt).
+			Str("command", command).
+			Str("output", strings.TrimSpace(string(output))).
+			Msg("Hook Failed")
+		return
+	}
+	logger.Debug().
+		Str("hook", opt).
+		Str("command", command).
+		Str("output", string(output)).
+		Msg("Hook")
+}
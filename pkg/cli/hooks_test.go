@@ -0,0 +1,32 @@
+package cli
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/config"
+)
+
+func TestHooks(t *testing.T) {
+	defer viper.Reset()
+	out := filepath.Join(t.TempDir(), "out")
+	viper.Set(config.OptOnComplete, "printf '%s %s\\n' {url} {dest} >> "+out)
+	viper.Set(config.OptOnAllComplete, "echo {files} {bytes} >> "+out)
+
+	hooks := Hooks()
+	assert.Nil(t, hooks.OnError)
+	// values are passed to the command as they are, never parsed by the shell
+	hooks.OnComplete(context.Background(), rpget.ManifestEntry{URL: "https://example.com/a?b=1&c=$HOME", Dest: "my file; rm -rf x"})
+	OnAllComplete(1, 42)
+
+	content, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "https://example.com/a?b=1&c=$HOME my file; rm -rf x\n1 42\n", string(content))
+}
@@ -0,0 +1,408 @@
+package cli
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/dustin/go-humanize"
+	"github.com/spf13/viper"
+
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/consistent"
+	"github.com/emaballarin/rpget/pkg/download"
+)
+
+// ClientOptions builds client.Options from the current configuration. Credentials given without a host are sent
+// to the host of authURL; if it is empty, they are rejected.
+func ClientOptions(authURL string) (client.Options, error) {
+	headers, err := config.HeadersToMap(viper.GetStringMapString(config.OptHeaders), viper.GetStringSlice(config.OptHeader))
+	if err != nil {
+		return client.Options{}, err
+	}
+	credentials, err := Credentials(authURL)
+	if err != nil {
+		return client.Options{}, err
+	}
+	var signer client.RequestSigner
+	if spec := viper.GetString(config.OptAWSSigV4); spec != "" {
+		creds, err := client.AmbientAWSCredentials()
+		if err != nil {
+			return client.Options{}, fmt.Errorf("--%s: %w", config.OptAWSSigV4, err)
+		}
+		if signer, err = client.ParseSigV4(spec, creds); err != nil {
+			return client.Options{}, err
+		}
+	}
+	simulation, err := networkSimulation()
+	if err != nil {
+		return client.Options{}, err
+	}
+	transportOpts, err := transportOptions()
+	if err != nil {
+		return client.Options{}, err
+	}
+	policy, err := URLPolicy()
+	if err != nil {
+		return client.Options{}, err
+	}
+	var jar http.CookieJar
+	cookieFile := viper.GetString(config.OptCookieFile)
+	if viper.GetBool(config.OptCookies) || cookieFile != "" {
+		jar = client.NewCookieJar()
+		if cookieFile != "" {
+			if err := client.LoadCookieFile(jar, cookieFile); err != nil {
+				return client.Options{}, err
+			}
+		}
+	}
+	return client.Options{
+		MaxRetries:    viper.GetInt(config.OptRetries),
+		Headers:       headers,
+		Credentials:   credentials,
+		Signer:        signer,
+		Policy:        policy,
+		Jar:           jar,
+		Simulation:    simulation,
+		TransportOpts: transportOpts,
+	}, nil
+}
+
+// URLPolicy builds the client.URLPolicy of the file of --url-policy and of the host and scheme lists of the command
+// line, which add to it. It is nil if there are no rules.
+func URLPolicy() (*client.URLPolicy, error) {
+	policy := &client.URLPolicy{}
+	if path := viper.GetString(config.OptURLPolicy); path != "" {
+		var err error
+		if policy, err = client.LoadURLPolicy(path); err != nil {
+			return nil, err
+		}
+	}
+	policy = policy.Merge(client.URLPolicy{
+		AllowHosts:   viper.GetStringSlice(config.OptAllowHost),
+		DenyHosts:    viper.GetStringSlice(config.OptDenyHost),
+		AllowSchemes: viper.GetStringSlice(config.OptAllowScheme),
+		DenySchemes:  viper.GetStringSlice(config.OptDenyScheme),
+	})
+	if err := policy.Validate(); err != nil {
+		return nil, err
+	}
+	if policy.Empty() {
+		return nil, nil
+	}
+	return policy, nil
+}
+
+// CheckURLPolicy returns an error listing the urls policy denies, if any, so that a download is refused before any
+// request is made rather than failing midway, and so that the URLs are checked as given rather than as rewritten
+// for a cache. policy may be nil.
+func CheckURLPolicy(policy *client.URLPolicy, urls ...string) error {
+	if policy == nil {
+		return nil
+	}
+	var errs []error
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			// left for the download to report
+			continue
+		}
+		if err := policy.Check(u); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// networkSimulation builds the client.NetworkSimulation of --simulate-bandwidth and --simulate-latency.
+func networkSimulation() (client.NetworkSimulation, error) {
+	simulation := client.NetworkSimulation{Latency: viper.GetDuration(config.OptSimulateLatency)}
+	if bandwidth := viper.GetString(config.OptSimulateBandwidth); bandwidth != "" {
+		rate, err := humanize.ParseBytes(bandwidth)
+		if err != nil {
+			return client.NetworkSimulation{}, fmt.Errorf("error parsing --%s: %w", config.OptSimulateBandwidth, err)
+		}
+		simulation.Bandwidth = int64(rate)
+	}
+	if simulation.Latency < 0 {
+		return client.NetworkSimulation{}, fmt.Errorf("invalid --%s %s", config.OptSimulateLatency, simulation.Latency)
+	}
+	return simulation, nil
+}
+
+// transportOptions builds the client.TransportOptions of ClientOptions.
+func transportOptions() (client.TransportOptions, error) {
+	resolveOverrides, err := config.ResolveOverridesToMap(viper.GetStringSlice(config.OptResolve))
+	if err != nil {
+		return client.TransportOptions{}, fmt.Errorf("error parsing resolve overrides: %w", err)
+	}
+	var proxy *url.URL
+	if proxyURL := viper.GetString(config.OptProxy); proxyURL != "" {
+		if proxy, err = client.ParseProxyURL(proxyURL); err != nil {
+			return client.TransportOptions{}, err
+		}
+	}
+	ipVersion, err := client.ParseIPVersion(viper.GetString(config.OptIPVersion))
+	if err != nil {
+		return client.TransportOptions{}, err
+	}
+	var resolver *net.Resolver
+	if dohURL := viper.GetString(config.OptDoHURL); dohURL != "" {
+		if resolver, err = client.NewResolver(dohURL); err != nil {
+			return client.TransportOptions{}, err
+		}
+	}
+	transportOpts := client.TransportOptions{
+		ForceHTTP2:         viper.GetBool(config.OptForceHTTP2),
+		ConnectTimeout:     viper.GetDuration(config.OptConnTimeout),
+		IPVersion:          ipVersion,
+		MaxConnPerHost:     intOption(config.OptMaxConnectionsPerHost, config.OptMaxConnPerHost),
+		Preconnect:         viper.GetInt(config.OptPreconnect),
+		ResolveOverrides:   resolveOverrides,
+		Proxy:              proxy,
+		Resolver:           resolver,
+		InsecureSkipVerify: viper.GetBool(config.OptInsecureSkipVerify),
+	}
+	if caFiles := viper.GetStringSlice(config.OptTLSCA); len(caFiles) > 0 {
+		if transportOpts.RootCAs, err = client.LoadCertPool(caFiles...); err != nil {
+			return client.TransportOptions{}, err
+		}
+	}
+	if certFile := viper.GetString(config.OptTLSCert); certFile != "" {
+		cert, err := client.LoadClientCertificate(certFile, viper.GetString(config.OptTLSKey))
+		if err != nil {
+			return client.TransportOptions{}, err
+		}
+		transportOpts.Certificates = []tls.Certificate{cert}
+	} else if viper.GetString(config.OptTLSKey) != "" {
+		return client.TransportOptions{}, fmt.Errorf("--%s requires --%s", config.OptTLSKey, config.OptTLSCert)
+	}
+	return transportOpts, nil
+}
+
+// DownloadOptions builds download.Options from the current configuration, including the cache settings. If a
+// cache SRV record is configured, it is resolved here. authURL is as for ClientOptions.
+func DownloadOptions(authURL string) (download.Options, error) {
+	chunkSize, err := humanize.ParseBytes(viper.GetString(config.OptChunkSize))
+	if err != nil {
+		return download.Options{}, fmt.Errorf("error parsing chunk size: %w", err)
+	}
+	var maxBufferMemory uint64
+	if budget := viper.GetString(config.OptMaxBufferMemory); budget != "" {
+		if maxBufferMemory, err = humanize.ParseBytes(budget); err != nil {
+			return download.Options{}, fmt.Errorf("error parsing maximum buffer memory: %w", err)
+		}
+	}
+	clientOpts, err := ClientOptions(authURL)
+	if err != nil {
+		return download.Options{}, err
+	}
+	ringAlgorithm, err := consistent.ParseAlgorithm(viper.GetString(config.OptCHAlgorithm))
+	if err != nil {
+		return download.Options{}, err
+	}
+	fallback, err := download.ParseFallbackMode(viper.GetString(config.OptCHFallback))
+	if err != nil {
+		return download.Options{}, err
+	}
+	hostModes, err := hostModes()
+	if err != nil {
+		return download.Options{}, err
+	}
+	downloadOpts := download.Options{
+		MaxConcurrency:        intOption(config.OptMaxTotalConnections, config.OptConcurrency),
+		MaxConnectionsPerHost: intOption(config.OptMaxConnectionsPerHost, config.OptMaxConnPerHost),
+		ChunkSize:             int64(chunkSize),
+		MaxBufferMemory:       int64(maxBufferMemory),
+		Client:                clientOpts,
+		HedgeAfter:            viper.GetDuration(config.OptHedgeAfter),
+		ProxyAuthHeader:       viper.GetString(config.OptProxyAuthHeader),
+		RingAlgorithm:         ringAlgorithm,
+		Fallback:              fallback,
+		FallbackMirrorURL:     viper.GetString(config.OptCHFallbackMirror),
+		HostModes:             hostModes,
+	}
+
+	if srvName := config.GetCacheSRV(); srvName != "" {
+		downloadOpts.SliceSize = SliceSize
+		downloadOpts.CacheableURIPrefixes = config.CacheableURIPrefixes()
+		downloadOpts.CacheUsePathProxy = viper.GetBool(config.OptCacheUsePathProxy)
+		downloadOpts.ForceCachePrefixRewrite = viper.GetBool(config.OptForceCachePrefixRewrite)
+		if downloadOpts.CacheHosts, err = LookupCacheHosts(srvName); err != nil {
+			return download.Options{}, err
+		}
+		if downloadOpts.HealthCheck, err = healthCheckOptions(); err != nil {
+			return download.Options{}, err
+		}
+		downloadOpts.CacheHostsRefresh = func() ([]string, error) { return LookupCacheHosts(srvName) }
+		downloadOpts.CacheHostsRefreshInterval = viper.GetDuration(config.OptCacheHostsRefreshInterval)
+		if viper.GetString(config.OptCacheSocket) != "" {
+			return download.Options{}, fmt.Errorf("--%s can't be used with a cache SRV record", config.OptCacheSocket)
+		}
+	} else if cacheHostname, socket, err := cacheService(); err != nil {
+		return download.Options{}, err
+	} else if cacheHostname != "" {
+		downloadOpts.CacheHosts = []string{cacheHostname}
+		downloadOpts.CacheableURIPrefixes = config.CacheableURIPrefixes()
+		downloadOpts.CacheUsePathProxy = viper.GetBool(config.OptCacheUsePathProxy)
+		downloadOpts.ForceCachePrefixRewrite = viper.GetBool(config.OptForceCachePrefixRewrite)
+		if socket != "" {
+			addr, err := cacheSocketAddr(cacheHostname)
+			if err != nil {
+				return download.Options{}, err
+			}
+			downloadOpts.Client.TransportOpts.UnixSockets = map[string]string{addr: socket}
+		}
+	}
+	return downloadOpts, nil
+}
+
+// cacheSocketHost is the host of the cache service when it is only given as a unix socket.
+const cacheSocketHost = "http://rpget-cache.invalid"
+
+// cacheService returns the URL of the cache service, and the unix socket to reach it over, if any: that of
+// --cache-socket, or of a cache service hostname given as http+unix:///path/to/socket. A socket without a cache
+// service hostname is the cache service.
+func cacheService() (string, string, error) {
+	socket := viper.GetString(config.OptCacheSocket)
+	cacheHostname := config.CacheServiceHostname()
+	if path, ok := strings.CutPrefix(cacheHostname, "http+unix://"); ok {
+		if socket != "" {
+			return "", "", fmt.Errorf("--%s can't be used with an http+unix cache service hostname", config.OptCacheSocket)
+		}
+		if !strings.HasPrefix(path, "/") {
+			return "", "", fmt.Errorf("invalid cache service hostname %s, expected http+unix:///path/to/socket", cacheHostname)
+		}
+		return cacheSocketHost, path, nil
+	}
+	if cacheHostname == "" && socket != "" {
+		cacheHostname = cacheSocketHost
+	}
+	return cacheHostname, socket, nil
+}
+
+// cacheSocketAddr returns the host:port address connections to the cache service at cacheHostname are made to.
+func cacheSocketAddr(cacheHostname string) (string, error) {
+	u, err := url.Parse(cacheHostname)
+	if err != nil || u.Host == "" {
+		return "", fmt.Errorf("invalid cache service hostname %s", cacheHostname)
+	}
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port), nil
+}
+
+// Credentials returns the credentials of --auth-token and --auth-basic, given as [<host>=]<credential>, on top of
+// those of the user's netrc file. Credentials without a host are sent to the host of authURL; if it is empty, they
+// are rejected, as there's no single host to send them to.
+func Credentials(authURL string) (client.Credentials, error) {
+	var authHost string
+	if u, err := url.Parse(authURL); err == nil {
+		authHost = u.Host
+	}
+	credentials, err := client.NetrcCredentials(client.NetrcPath())
+	if err != nil {
+		return nil, err
+	}
+	if credentials == nil {
+		credentials = make(client.Credentials)
+	}
+	for _, token := range viper.GetStringSlice(config.OptAuthToken) {
+		host, token, err := scopeCredential(config.OptAuthToken, token, authHost)
+		if err != nil {
+			return nil, err
+		}
+		credentials.Add(host, client.BearerAuth(token))
+	}
+	for _, basic := range viper.GetStringSlice(config.OptAuthBasic) {
+		host, basic, err := scopeCredential(config.OptAuthBasic, basic, authHost)
+		if err != nil {
+			return nil, err
+		}
+		username, password, ok := strings.Cut(basic, ":")
+		if !ok || username == "" {
+			return nil, fmt.Errorf("invalid --%s format, expected [<host>=]<user>:<password>", config.OptAuthBasic)
+		}
+		credentials.Add(host, client.BasicAuth(username, password))
+	}
+	if len(credentials) == 0 {
+		return nil, nil
+	}
+	return credentials, nil
+}
+
+// scopeCredential splits a credential given as [<host>=]<credential> into its host, defaulting to authHost, and
+// the credential itself. The credential is left out of errors so it doesn't end up in logs.
+func scopeCredential(opt, value, authHost string) (string, string, error) {
+	host, credential, ok := strings.Cut(value, "=")
+	if !ok {
+		host, credential = authHost, value
+		if host == "" {
+			return "", "", fmt.Errorf("--%s needs a host when downloading from more than one URL, expected <host>=<credential>", opt)
+		}
+	}
+	if host == "" || strings.ContainsAny(host, "/ \t@") {
+		return "", "", fmt.Errorf("invalid --%s host, expected [<host>=]<credential>", opt)
+	}
+	if credential == "" {
+		return "", "", fmt.Errorf("empty --%s for host %s", opt, host)
+	}
+	return host, credential, nil
+}
+
+// SliceSize is the size of the slices files are split into when downloading through a consistent hashing cache,
+// each cached by one of the cache hosts.
+const SliceSize = 500 * humanize.MiByte
+
+// hostModes returns the download modes --host-mode forces for hosts, given as <host>=<mode>.
+func hostModes() (map[string]download.Mode, error) {
+	values := viper.GetStringSlice(config.OptHostMode)
+	if len(values) == 0 {
+		return nil, nil
+	}
+	modes := make(map[string]download.Mode, len(values))
+	for _, value := range values {
+		host, name, ok := strings.Cut(value, "=")
+		if !ok || host == "" || name == "" || strings.ContainsAny(host, "/ \t@") {
+			return nil, fmt.Errorf("invalid --%s %s, expected <host>=<mode>", config.OptHostMode, value)
+		}
+		mode, err := download.ParseMode(name)
+		if err != nil {
+			return nil, err
+		}
+		modes[host] = mode
+	}
+	return modes, nil
+}
+
+// healthCheckOptions builds the health checking options of the cache hosts of a consistent hashing ring.
+func healthCheckOptions() (download.HealthCheckOptions, error) {
+	mode, err := download.ParseHealthCheckMode(viper.GetString(config.OptCacheHealthCheckMode))
+	if err != nil {
+		return download.HealthCheckOptions{}, err
+	}
+	return download.HealthCheckOptions{
+		Interval:  viper.GetDuration(config.OptCacheHealthCheckInterval),
+		Mode:      mode,
+		Threshold: viper.GetInt(config.OptCacheHealthCheckThreshold),
+	}, nil
+}
+
+// intOption returns the integer option opt, or the deprecated option it replaces if only that one is set, e.g. by its
+// environment variable.
+func intOption(opt, deprecated string) int {
+	if !viper.IsSet(opt) && viper.IsSet(deprecated) {
+		return viper.GetInt(deprecated)
+	}
+	return viper.GetInt(opt)
+}
@@ -0,0 +1,109 @@
+package cli
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/spf13/viper"
+	"github.com/stretchr/testify/assert"
+
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/config"
+)
+
+func TestCredentials(t *testing.T) {
+	defer viper.Reset()
+	t.Setenv("NETRC", filepath.Join(t.TempDir(), "missing"))
+
+	testCases := []struct {
+		name     string
+		authURL  string
+		tokens   []string
+		basics   []string
+		expected client.Credentials
+		err      bool
+	}{
+		{"none", "https://example.com/file", nil, nil, nil, false},
+		{"scoped to the URL", "https://Example.com:8443/file", []string{"abc"}, nil,
+			client.Credentials{"example.com:8443": client.BearerAuth("abc")}, false},
+		{"explicit hosts", "", []string{"a.example.com=abc"}, []string{"b.example.com=user:pa:ss"},
+			client.Credentials{"a.example.com": client.BearerAuth("abc"), "b.example.com": client.BasicAuth("user", "pa:ss")}, false},
+		{"no host without a URL", "", []string{"abc"}, nil, nil, true},
+		{"empty host", "https://example.com", []string{"=abc"}, nil, nil, true},
+		{"empty token", "https://example.com", []string{"example.com="}, nil, nil, true},
+		{"basic without password", "https://example.com", nil, []string{"user"}, nil, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			viper.Set(config.OptAuthToken, tc.tokens)
+			viper.Set(config.OptAuthBasic, tc.basics)
+			creds, err := Credentials(tc.authURL)
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, creds)
+		})
+	}
+}
+
+func TestCacheService(t *testing.T) {
+	defer viper.Reset()
+
+	testCases := []struct {
+		name         string
+		hostname     string
+		socket       string
+		expectedHost string
+		expectedSock string
+		err          bool
+	}{
+		{"none", "", "", "", "", false},
+		{"tcp", "http://cache.local", "", "http://cache.local", "", false},
+		{"socket only", "", "/run/cache.sock", cacheSocketHost, "/run/cache.sock", false},
+		{"hostname over a socket", "http://cache.local:8080", "/run/cache.sock", "http://cache.local:8080", "/run/cache.sock", false},
+		{"http+unix", "http+unix:///run/cache.sock", "", cacheSocketHost, "/run/cache.sock", false},
+		{"http+unix and a socket", "http+unix:///run/cache.sock", "/run/other.sock", "", "", true},
+		{"relative http+unix", "http+unix://run/cache.sock", "", "", "", true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			viper.Set(config.OptCacheServiceHostname, tc.hostname)
+			viper.Set(config.OptCacheSocket, tc.socket)
+			host, socket, err := cacheService()
+			if tc.err {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedHost, host)
+			assert.Equal(t, tc.expectedSock, socket)
+		})
+	}
+
+	for hostname, expected := range map[string]string{
+		cacheSocketHost:           "rpget-cache.invalid:80",
+		"http://cache.local:8080": "cache.local:8080",
+		"https://cache.local":     "cache.local:443",
+	} {
+		addr, err := cacheSocketAddr(hostname)
+		assert.NoError(t, err)
+		assert.Equal(t, expected, addr)
+	}
+}
+
+func TestIntOptionDeprecated(t *testing.T) {
+	defer viper.Reset()
+
+	assert.Equal(t, 0, intOption(config.OptMaxTotalConnections, config.OptConcurrency))
+
+	// e.g. from RPGET_CONCURRENCY
+	viper.Set(config.OptConcurrency, 8)
+	assert.Equal(t, 8, intOption(config.OptMaxTotalConnections, config.OptConcurrency))
+
+	viper.Set(config.OptMaxTotalConnections, 16)
+	assert.Equal(t, 16, intOption(config.OptMaxTotalConnections, config.OptConcurrency))
+}
@@ -0,0 +1,81 @@
+package cli
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/viper"
+
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/extract"
+)
+
+// The consumers files can be routed to with --route.
+const (
+	routeExtract    = "extract"
+	routeDecompress = "decompress"
+	routeFile       = "file"
+)
+
+// ConsumerRoutes returns the routes of --route, of the form <content-type>=<consumer> or <format>=<consumer>.
+func ConsumerRoutes() ([]rpget.ConsumerRoute, error) {
+	var routes []rpget.ConsumerRoute
+	for _, expr := range viper.GetStringSlice(config.OptRoute) {
+		route, err := parseRoute(expr)
+		if err != nil {
+			return nil, err
+		}
+		routes = append(routes, route)
+	}
+	return routes, nil
+}
+
+// parseRoute parses a route of --route. A match containing a slash is a content type, e.g. "application/x-tar" or
+// "application/*"; any other match is a format sniffed from the first bytes of the file, e.g. "zstd".
+func parseRoute(expr string) (rpget.ConsumerRoute, error) {
+	i := strings.LastIndex(expr, "=")
+	if i <= 0 {
+		return rpget.ConsumerRoute{}, fmt.Errorf("invalid route `%s`, expected <content-type>=<consumer> or <format>=<consumer>", expr)
+	}
+	match, target := strings.TrimSpace(expr[:i]), strings.TrimSpace(expr[i+1:])
+	var route rpget.ConsumerRoute
+	if strings.Contains(match, "/") {
+		route.ContentType = match
+	} else {
+		if err := checkRouteFormat(match); err != nil {
+			return rpget.ConsumerRoute{}, err
+		}
+		route.Format = match
+	}
+	var err error
+	switch target {
+	case routeExtract:
+		route.Consumer, err = config.NewConsumer(config.ConsumerTarExtractor)
+	case routeFile:
+		route.Consumer, err = config.NewConsumer(config.ConsumerFile)
+	case routeDecompress:
+		var opts extract.Options
+		opts, err = config.ExtractOptions()
+		route.Consumer = &consumer.Decompressor{Options: opts}
+	default:
+		return rpget.ConsumerRoute{}, fmt.Errorf("invalid consumer %s of route `%s`, expected one of %s, %s, %s", target, expr, routeExtract, routeDecompress, routeFile)
+	}
+	if err != nil {
+		return rpget.ConsumerRoute{}, err
+	}
+	return route, nil
+}
+
+// checkRouteFormat returns an error if format isn't one extract.Sniff reports.
+func checkRouteFormat(format string) error {
+	switch format {
+	case "tar", "zip", "lzw":
+		return nil
+	}
+	if _, err := extract.ParseCompression(format); err != nil || format == "" {
+		return fmt.Errorf("invalid route format %s, expected a content type, tar, zip, lzw or a compression (gzip, bzip2, xz, lz4, zstd)", format)
+	}
+	return nil
+}
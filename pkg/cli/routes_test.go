@@ -0,0 +1,34 @@
+package cli
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/consumer"
+)
+
+func TestParseRoute(t *testing.T) {
+	route, err := parseRoute("application/x-tar=extract")
+	require.NoError(t, err)
+	assert.Equal(t, "application/x-tar", route.ContentType)
+	assert.Empty(t, route.Format)
+	assert.IsType(t, &consumer.TarExtractor{}, route.Consumer)
+
+	route, err = parseRoute("zstd=decompress")
+	require.NoError(t, err)
+	assert.Empty(t, route.ContentType)
+	assert.Equal(t, "zstd", route.Format)
+	assert.IsType(t, &consumer.Decompressor{}, route.Consumer)
+
+	route, err = parseRoute("application/*=file")
+	require.NoError(t, err)
+	assert.Equal(t, "application/*", route.ContentType)
+	assert.IsType(t, &consumer.FileWriter{}, route.Consumer)
+
+	for _, expr := range []string{"application/x-tar", "=extract", "application/x-tar=unpack", "rar=extract"} {
+		_, err := parseRoute(expr)
+		assert.Error(t, err, expr)
+	}
+}
@@ -0,0 +1,156 @@
+//go:build !windows
+
+package cli
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/spf13/viper"
+
+	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/logging"
+	"github.com/emaballarin/rpget/pkg/scratch"
+	"github.com/emaballarin/rpget/pkg/wal"
+)
+
+// credential is the identity rpget runs as after RunAs.
+type credential struct {
+	name   string
+	uid    int
+	gid    int
+	groups []int
+}
+
+// RunAs drops the privileges of rpget to the user of --run-as, if set: its user and group IDs and supplementary
+// groups. It must be called once the resources only root may read (e.g. TLS keys, credentials, the PID file) are
+// open, and before anything is downloaded, so that downloads are written with the ownership of the user. The
+// scratch directory and write-ahead log of the process, and the content cache, created as root, are handed over to
+// the user.
+func RunAs() error {
+	spec := viper.GetString(config.OptRunAs)
+	if spec == "" {
+		return nil
+	}
+	cred, err := lookupCredential(spec)
+	if err != nil {
+		return err
+	}
+	if os.Geteuid() != 0 {
+		if os.Geteuid() == cred.uid && os.Getegid() == cred.gid {
+			return nil
+		}
+		return fmt.Errorf("--%s requires rpget to be started as root", config.OptRunAs)
+	}
+	if err := handOver(cred, viper.GetString(config.OptCacheDir), scratch.Dir(), wal.Path()); err != nil {
+		return err
+	}
+	// the groups must be changed while rpget is still root
+	if err := syscall.Setgroups(cred.groups); err != nil {
+		return fmt.Errorf("error setting supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(cred.gid); err != nil {
+		return fmt.Errorf("error setting group ID %d: %w", cred.gid, err)
+	}
+	if err := syscall.Setuid(cred.uid); err != nil {
+		return fmt.Errorf("error setting user ID %d: %w", cred.uid, err)
+	}
+	if cred.uid != 0 && syscall.Setuid(0) == nil {
+		return errors.New("root privileges could be regained after dropping them")
+	}
+	logger := logging.GetLogger()
+	logger.Info().Str("user", cred.name).Int("uid", cred.uid).Int("gid", cred.gid).Msg("Dropped privileges")
+	return nil
+}
+
+// handOver hands paths, and cacheDir and everything in it, over to cred, so that rpget can still write to them once it
+// runs as cred. Empty paths are skipped. The files of the cache are handed over too, as use records are appended to
+// in place.
+func handOver(cred credential, cacheDir string, paths ...string) error {
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		if err := os.Chown(path, cred.uid, cred.gid); err != nil {
+			return fmt.Errorf("error handing %s over to %s: %w", path, cred.name, err)
+		}
+	}
+	if cacheDir == "" {
+		return nil
+	}
+	err := filepath.WalkDir(cacheDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		return os.Lchown(path, cred.uid, cred.gid)
+	})
+	if err != nil {
+		return fmt.Errorf("error handing content cache %s over to %s: %w", cacheDir, cred.name, err)
+	}
+	return nil
+}
+
+// lookupCredential returns the credential of spec, a user name or ID optionally followed by a group name or ID,
+// format <user>[:<group>]. The group defaults to the primary group of the user; a user ID without an account uses
+// the group with the same ID.
+func lookupCredential(spec string) (credential, error) {
+	userSpec, groupSpec, hasGroup := strings.Cut(spec, ":")
+	if userSpec == "" || (hasGroup && groupSpec == "") {
+		return credential{}, fmt.Errorf("invalid user `%s`, expected <user>[:<group>]", spec)
+	}
+	cred := credential{name: userSpec}
+	u, err := user.Lookup(userSpec)
+	if err != nil {
+		u, err = user.LookupId(userSpec)
+	}
+	switch {
+	case err == nil:
+		if cred.uid, err = strconv.Atoi(u.Uid); err != nil {
+			return credential{}, fmt.Errorf("unsupported user ID %s of %s", u.Uid, userSpec)
+		}
+		if cred.gid, err = strconv.Atoi(u.Gid); err != nil {
+			return credential{}, fmt.Errorf("unsupported group ID %s of %s", u.Gid, userSpec)
+		}
+		cred.name = u.Username
+		if ids, err := u.GroupIds(); err == nil {
+			for _, id := range ids {
+				if gid, err := strconv.Atoi(id); err == nil {
+					cred.groups = append(cred.groups, gid)
+				}
+			}
+		}
+	default:
+		uid, convErr := strconv.Atoi(userSpec)
+		if convErr != nil || uid < 0 {
+			return credential{}, fmt.Errorf("unknown user %s: %w", userSpec, err)
+		}
+		cred.uid, cred.gid = uid, uid
+	}
+	if hasGroup {
+		g, err := user.LookupGroup(groupSpec)
+		if err != nil {
+			g, err = user.LookupGroupId(groupSpec)
+		}
+		if err == nil {
+			cred.gid, err = strconv.Atoi(g.Gid)
+		} else if gid, convErr := strconv.Atoi(groupSpec); convErr == nil && gid >= 0 {
+			cred.gid, err = gid, nil
+		}
+		if err != nil {
+			return credential{}, fmt.Errorf("unknown group %s: %w", groupSpec, err)
+		}
+		// an explicit group replaces the groups of the user
+		cred.groups = nil
+	}
+	if len(cred.groups) == 0 {
+		cred.groups = []int{cred.gid}
+	}
+	return cred, nil
+}
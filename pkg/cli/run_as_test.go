@@ -0,0 +1,73 @@
+//go:build !windows
+
+package cli
+
+import (
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/cas"
+)
+
+func TestLookupCredential(t *testing.T) {
+	cred, err := lookupCredential("root")
+	require.NoError(t, err)
+	assert.Equal(t, 0, cred.uid)
+	assert.Equal(t, 0, cred.gid)
+	assert.Contains(t, cred.groups, 0)
+
+	cred, err = lookupCredential("0:0")
+	require.NoError(t, err)
+	assert.Equal(t, credential{name: "root", uid: 0, gid: 0, groups: []int{0}}, cred)
+
+	// IDs without an account are used as they are
+	cred, err = lookupCredential("54321")
+	require.NoError(t, err)
+	assert.Equal(t, credential{name: "54321", uid: 54321, gid: 54321, groups: []int{54321}}, cred)
+	cred, err = lookupCredential("54321:54322")
+	require.NoError(t, err)
+	assert.Equal(t, credential{name: "54321", uid: 54321, gid: 54322, groups: []int{54322}}, cred)
+
+	for _, spec := range []string{"", ":0", "root:", "no-such-user", "root:no-such-group", "-1"} {
+		_, err := lookupCredential(spec)
+		assert.Error(t, err, spec)
+	}
+}
+
+func TestHandOver(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+	dir := t.TempDir()
+	scratchDir := filepath.Join(dir, "scratch")
+	require.NoError(t, os.Mkdir(scratchDir, 0700))
+	// the content cache is opened, creating its directories, before privileges are dropped
+	cacheDir := filepath.Join(dir, "cache")
+	_, err := cas.Open(cacheDir)
+	require.NoError(t, err)
+	// use records are appended to in place
+	usesFile := filepath.Join(cacheDir, "uses", "0123")
+	require.NoError(t, os.WriteFile(usesFile, []byte("1\n"), 0644))
+
+	cred := credential{name: "54321", uid: 54321, gid: 54322}
+	require.NoError(t, handOver(cred, cacheDir, scratchDir, ""))
+	paths := []string{scratchDir, cacheDir, usesFile}
+	entries, err := os.ReadDir(cacheDir)
+	require.NoError(t, err)
+	require.NotEmpty(t, entries)
+	for _, entry := range entries {
+		paths = append(paths, filepath.Join(cacheDir, entry.Name()))
+	}
+	for _, path := range paths {
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		stat := info.Sys().(*syscall.Stat_t)
+		assert.Equal(t, uint32(54321), stat.Uid, path)
+		assert.Equal(t, uint32(54322), stat.Gid, path)
+	}
+}
@@ -0,0 +1,45 @@
+package cli
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"github.com/spf13/viper"
+
+	"github.com/emaballarin/rpget/pkg/config"
+	"github.com/emaballarin/rpget/pkg/logging"
+	"github.com/emaballarin/rpget/pkg/sandbox"
+	"github.com/emaballarin/rpget/pkg/scratch"
+)
+
+// Sandbox applies the sandbox of --sandbox, if set. It must be called once everything rpget writes to, other than
+// downloads, is set up: files may afterwards only be written beneath dirs, the directories of the downloads, and
+// the directories of the temporary files, write-ahead log, content cache and report.
+func Sandbox(dirs ...string) error {
+	if !viper.GetBool(config.OptSandbox) {
+		return nil
+	}
+	writable := slices.Clone(dirs)
+	if dir := scratch.Dir(); dir != "" {
+		// the scratch directory is removed from its parent on exit
+		writable = append(writable, filepath.Dir(dir))
+	} else {
+		writable = append(writable, os.TempDir())
+	}
+	for _, opt := range []string{config.OptWALDir, config.OptCacheDir} {
+		if dir := viper.GetString(opt); dir != "" {
+			writable = append(writable, dir)
+		}
+	}
+	if path := viper.GetString(config.OptReportJSON); path != "" && path != "-" {
+		writable = append(writable, filepath.Dir(path))
+	}
+	if err := sandbox.Apply(sandbox.Policy{Writable: writable}); err != nil {
+		return fmt.Errorf("error applying --%s: %w", config.OptSandbox, err)
+	}
+	logger := logging.GetLogger()
+	logger.Debug().Strs("writable", writable).Msg("Sandboxed")
+	return nil
+}
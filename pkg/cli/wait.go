@@ -0,0 +1,24 @@
+package cli
+
+import (
+	"context"
+
+	"github.com/spf13/viper"
+
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/config"
+)
+
+// WaitForFiles waits with getter for the files of manifest to exist if --wait-for-url is set, for at most
+// --wait-timeout if set.
+func WaitForFiles(ctx context.Context, getter *rpget.Getter, manifest rpget.Manifest) error {
+	if !viper.GetBool(config.OptWaitForURL) {
+		return nil
+	}
+	if timeout := viper.GetDuration(config.OptWaitTimeout); timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return getter.WaitForFiles(ctx, manifest)
+}
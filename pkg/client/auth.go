@@ -0,0 +1,125 @@
+package client
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Credentials maps a host, with or without its port, to the Authorization header sent to it. A request is only
+// given the credentials of its own host, so downloads from several hosts never see each other's credentials; a
+// redirect to another host drops them.
+type Credentials map[string]string
+
+// BearerAuth returns the Authorization header of a bearer token.
+func BearerAuth(token string) string {
+	return "Bearer " + token
+}
+
+// BasicAuth returns the Authorization header of HTTP basic authentication.
+func BasicAuth(username, password string) string {
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(username+":"+password))
+}
+
+// Add sets the Authorization header sent to host.
+func (c Credentials) Add(host, authorization string) {
+	c[strings.ToLower(host)] = authorization
+}
+
+// authorization returns the Authorization header to send to u, preferring credentials given for its port.
+func (c Credentials) authorization(u *url.URL) (string, bool) {
+	if len(c) == 0 {
+		return "", false
+	}
+	if auth, ok := c[strings.ToLower(u.Host)]; ok {
+		return auth, true
+	}
+	auth, ok := c[strings.ToLower(u.Hostname())]
+	return auth, ok
+}
+
+// NetrcPath returns the path of the user's netrc file: $NETRC if set, otherwise ~/.netrc.
+func NetrcPath() string {
+	if path := os.Getenv("NETRC"); path != "" {
+		return path
+	}
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(home, ".netrc")
+}
+
+// NetrcCredentials returns the basic authentication credentials of the machines of the netrc file at path. A
+// missing file has no credentials. As with the go command, the default entry is ignored, so credentials are only
+// sent to the hosts named in the file.
+func NetrcCredentials(path string) (Credentials, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("reading netrc: %w", err)
+	}
+	return parseNetrc(string(data)), nil
+}
+
+func parseNetrc(data string) Credentials {
+	creds := make(Credentials)
+	var machine, login, password string
+	flush := func() {
+		if machine != "" && login != "" {
+			if _, ok := creds[strings.ToLower(machine)]; !ok {
+				// the first entry for a machine wins, as with curl
+				creds.Add(machine, BasicAuth(login, password))
+			}
+		}
+		machine, login, password = "", "", ""
+	}
+
+	inMacro := false
+	for _, line := range strings.Split(data, "\n") {
+		if inMacro {
+			// a macro definition runs until the next empty line
+			inMacro = strings.TrimSpace(line) != ""
+			continue
+		}
+		fields := strings.Fields(line)
+		for i := 0; i < len(fields); i++ {
+			switch fields[i] {
+			case "machine":
+				flush()
+				if i+1 < len(fields) {
+					i++
+					machine = fields[i]
+				}
+			case "default":
+				// ends the machine entries
+				flush()
+				return creds
+			case "login":
+				if i+1 < len(fields) {
+					i++
+					login = fields[i]
+				}
+			case "password":
+				if i+1 < len(fields) {
+					i++
+					password = fields[i]
+				}
+			case "macdef":
+				inMacro = true
+				i = len(fields)
+			}
+		}
+	}
+	flush()
+	return creds
+}
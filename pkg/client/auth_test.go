@@ -0,0 +1,85 @@
+package client_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/client"
+)
+
+func TestCredentials(t *testing.T) {
+	var seen []string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, "other:"+r.Header.Get("Authorization"))
+	}))
+	defer other.Close()
+	// reached as "localhost", a different host than the "127.0.0.1" of origin
+	otherURL := strings.Replace(other.URL, "127.0.0.1", "localhost", 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen = append(seen, "origin:"+r.Header.Get("Authorization"))
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, otherURL, http.StatusFound)
+		}
+	}))
+	defer origin.Close()
+
+	creds := client.Credentials{}
+	creds.Add(strings.TrimPrefix(origin.URL, "http://"), client.BearerAuth("secret"))
+	c := client.NewHTTPClient(client.Options{Credentials: creds})
+
+	get := func(url string, header string) {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		if header != "" {
+			req.Header.Set("Authorization", header)
+		}
+		resp, err := c.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+	}
+
+	get(origin.URL, "")
+	get(otherURL, "")
+	get(origin.URL+"/redirect", "")
+	get(origin.URL, "Basic explicit")
+	assert.Equal(t, []string{
+		"origin:Bearer secret",
+		"other:",
+		"origin:Bearer secret",
+		"other:",
+		"origin:Basic explicit",
+	}, seen)
+}
+
+func TestNetrcCredentials(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "netrc")
+	require.NoError(t, os.WriteFile(path, []byte(`machine example.com login alice password s3cret
+machine Other.example.com
+	login bob
+	password hunter2
+macdef init
+machine macro.example.com login mallory password nope
+
+machine example.com login eve password ignored
+default login anonymous password guest
+machine after.example.com login carol password ignored
+`), 0600))
+
+	creds, err := client.NetrcCredentials(path)
+	require.NoError(t, err)
+	assert.Equal(t, client.Credentials{
+		"example.com":       client.BasicAuth("alice", "s3cret"),
+		"other.example.com": client.BasicAuth("bob", "hunter2"),
+	}, creds)
+
+	creds, err = client.NetrcCredentials(filepath.Join(t.TempDir(), "missing"))
+	require.NoError(t, err)
+	assert.Nil(t, creds)
+}
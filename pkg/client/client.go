@@ -2,15 +2,17 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"fmt"
 	"net"
 	"net/http"
+	"net/url"
 	"strconv"
+	"sync/atomic"
 	"time"
 
-	"github.com/spf13/viper"
-
 	"github.com/hashicorp/go-retryablehttp"
 
 	"github.com/emaballarin/rpget/pkg/config"
@@ -27,6 +29,21 @@ const (
 
 var ErrStrategyFallback = errors.New("fallback to next strategy")
 
+type retryCounterKey struct{}
+
+// WithRetryCounter returns a context that causes every retried request made with it to increment counter.
+func WithRetryCounter(ctx context.Context, counter *atomic.Int64) context.Context {
+	return context.WithValue(ctx, retryCounterKey{}, counter)
+}
+
+type headersKey struct{}
+
+// WithHeaders returns a context that causes every request made with it to carry headers, in addition to (and
+// taking precedence over) the globally configured headers.
+func WithHeaders(ctx context.Context, headers map[string]string) context.Context {
+	return context.WithValue(ctx, headersKey{}, headers)
+}
+
 type HTTPClient interface {
 	Do(req *http.Request) (*http.Response, error)
 }
@@ -35,19 +52,46 @@ type HTTPClient interface {
 // utilizing a client pool. If the OptMaxConnPerHost option is not set, the client pool will not be used.
 type RPGetHTTPClient struct {
 	*http.Client
-	headers map[string]string
+	headers     map[string]string
+	credentials Credentials
+	preconnect  *preconnector
 }
 
 func (c *RPGetHTTPClient) Do(req *http.Request) (*http.Response, error) {
 	req.Header.Set("User-Agent", fmt.Sprintf("rpget/%s", version.GetVersion()))
+	if req.Header.Get("Authorization") == "" {
+		if auth, ok := c.credentials.authorization(req.URL); ok {
+			req.Header.Set("Authorization", auth)
+		}
+	}
 	for k, v := range c.headers {
 		req.Header.Set(k, v)
 	}
+	if headers, ok := req.Context().Value(headersKey{}).(map[string]string); ok {
+		for k, v := range headers {
+			req.Header.Set(k, v)
+		}
+	}
 	return c.Client.Do(req)
 }
 
 type Options struct {
-	MaxRetries    int
+	MaxRetries int
+	// Headers are set on every request, in addition to the headers of WithHeaders.
+	Headers map[string]string
+	// Credentials are sent to the host they are given for, unless the request already carries an Authorization
+	// header.
+	Credentials Credentials
+	// Signer, if set, signs every request just before it is sent (see SigV4 for AWS Signature Version 4).
+	Signer RequestSigner
+	// Policy, if set, restricts the URLs requests are made to, redirects included (see URLPolicy).
+	Policy *URLPolicy
+	// Jar, if set, keeps the cookies set by responses, redirects included, and sends them with the requests which
+	// follow, for origins which set a cookie in a redirect before serving the file (see NewCookieJar). Clients
+	// built with the same Jar share their cookies.
+	Jar http.CookieJar
+	// Simulation, if enabled, shapes the traffic of the client to reproduce a slow network.
+	Simulation    NetworkSimulation
 	Transport     http.RoundTripper
 	TransportOpts TransportOptions
 }
@@ -57,6 +101,35 @@ type TransportOptions struct {
 	ResolveOverrides map[string]string
 	MaxConnPerHost   int
 	ConnectTimeout   time.Duration
+	// IPVersion restricts connections to IPv4 or IPv6. If empty or IPVersionAuto, the addresses of a host are
+	// tried alternating IPv6 and IPv4, without waiting for an attempt to time out before trying the next address
+	// (Happy Eyeballs), so that a broken IPv6 network doesn't stall connections.
+	IPVersion IPVersion
+	// Proxy, if set, is the proxy requests are sent through, instead of those of HTTP_PROXY and HTTPS_PROXY (see
+	// ParseProxyURL).
+	Proxy *url.URL
+	// Resolver, if set, resolves the hosts connected to instead of the system resolver (see NewResolver).
+	Resolver *net.Resolver
+	// RootCAs, if set, are the certificate authorities servers are verified with instead of the system roots (see
+	// LoadCertPool).
+	RootCAs *x509.CertPool
+	// Certificates are presented to servers requesting a client certificate, for mutual TLS.
+	Certificates []tls.Certificate
+	// InsecureSkipVerify disables the verification of server certificates. PinnedSPKI still applies, to the
+	// certificates presented by the server.
+	InsecureSkipVerify bool
+	// PinnedSPKI, if set, only allows connecting to servers whose verified certificate chain includes a public key
+	// with one of these pins (see SPKIHash and ParseSPKIPin).
+	PinnedSPKI []string
+	// VerifyPeerCertificate, if set, is called once the certificate chain of a server has been verified (and
+	// checked against PinnedSPKI), as with tls.Config.VerifyPeerCertificate; returning an error aborts the
+	// connection. With InsecureSkipVerify, it is given no verified chains.
+	VerifyPeerCertificate func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error
+	// Preconnect is the number of connections WarmUp establishes to each host, at most MaxConnPerHost.
+	Preconnect int
+	// UnixSockets maps the host:port addresses of hosts, such as a node-local cache, to the unix sockets connections
+	// to them are made over instead of TCP. Requests to them are never proxied.
+	UnixSockets map[string]string
 }
 
 // NewHTTPClient factory function returns a new http.Client with the appropriate settings and can limit number of clients
@@ -64,47 +137,80 @@ type TransportOptions struct {
 func NewHTTPClient(opts Options) HTTPClient {
 
 	transport := opts.Transport
+	var preconnect *preconnector
 
 	if transport == nil {
 		topts := opts.TransportOpts
 		dialer := &transportDialer{
 			DNSOverrideMap: topts.ResolveOverrides,
+			UnixSockets:    topts.UnixSockets,
+			IPVersion:      topts.IPVersion,
 			Dialer: &net.Dialer{
 				Timeout:   topts.ConnectTimeout,
 				KeepAlive: 30 * time.Second,
+				Resolver:  topts.Resolver,
 			},
 		}
 
 		disableKeepAlives := topts.ForceHTTP2
-		transport = &http.Transport{
-			Proxy:                 http.ProxyFromEnvironment,
+		proxy := proxyFunc(topts.Proxy, topts.UnixSockets)
+		httpTransport := &http.Transport{
+			Proxy:                 proxy,
 			DialContext:           dialer.DialContext,
 			ForceAttemptHTTP2:     topts.ForceHTTP2,
 			MaxIdleConns:          100,
 			IdleConnTimeout:       90 * time.Second,
-			TLSHandshakeTimeout:   5 * time.Second,
+			TLSHandshakeTimeout:   tlsHandshakeTimeout,
 			ExpectContinueTimeout: 1 * time.Second,
 			DisableKeepAlives:     disableKeepAlives,
 			MaxConnsPerHost:       topts.MaxConnPerHost,
 			MaxIdleConnsPerHost:   topts.MaxConnPerHost,
+			TLSClientConfig:       topts.tlsConfig(),
 		}
+		if topts.Preconnect > 0 {
+			// the connections established ahead of requests are handed to the transport when it dials their host,
+			// which for TLS connections means dialing them itself
+			dialer.TLSConfig = httpTransport.TLSClientConfig
+			dialer.ForceHTTP2 = topts.ForceHTTP2
+			dialer.warm = &warmPool{}
+			httpTransport.DialTLSContext = dialer.DialTLSContext
+			conns := topts.Preconnect
+			if topts.MaxConnPerHost > 0 {
+				conns = min(conns, topts.MaxConnPerHost)
+			}
+			preconnect = &preconnector{dialer: dialer, proxy: proxy, conns: conns}
+		}
+		transport = httpTransport
+	}
+
+	if opts.Simulation.enabled() {
+		transport = newSimulatedTransport(transport, opts.Simulation)
+	}
+	if opts.Signer != nil {
+		transport = &signingTransport{base: transport, signer: opts.Signer}
+	}
+	if opts.Policy != nil {
+		transport = &policyTransport{base: transport, policy: opts.Policy}
 	}
 
 	retryClient := &retryablehttp.Client{
 		HTTPClient: &http.Client{
 			Transport:     transport,
 			CheckRedirect: checkRedirectFunc,
+			// redirects are followed by this client, within a single attempt of the retrying one
+			Jar: opts.Jar,
 		},
-		Logger:       nil,
-		RetryWaitMin: retryMinWait,
-		RetryWaitMax: retryMaxWait,
-		RetryMax:     opts.MaxRetries,
-		CheckRetry:   RetryPolicy,
-		Backoff:      linearJitterRetryAfterBackoff,
+		Logger:         nil,
+		RetryWaitMin:   retryMinWait,
+		RetryWaitMax:   retryMaxWait,
+		RetryMax:       opts.MaxRetries,
+		CheckRetry:     RetryPolicy,
+		Backoff:        linearJitterRetryAfterBackoff,
+		RequestLogHook: countRetries,
 	}
 
 	client := retryClient.StandardClient()
-	return &RPGetHTTPClient{Client: client, headers: viper.GetStringMapString(config.OptHeaders)}
+	return &RPGetHTTPClient{Client: client, headers: opts.Headers, credentials: opts.Credentials, preconnect: preconnect}
 }
 
 // RetryPolicy wraps retryablehttp.DefaultRetryPolicy and included additional logic:
@@ -130,6 +236,11 @@ func RetryPolicy(ctx context.Context, resp *http.Response, err error) (bool, err
 		}
 	}
 
+	// the signer would fail again, and the policy deny again
+	if errors.Is(err, ErrRequestSigning) || errors.Is(err, ErrURLDenied) {
+		return false, err
+	}
+
 	// Wrap the standard retry policy
 	return retryablehttp.DefaultRetryPolicy(ctx, resp, err)
 }
@@ -201,6 +312,17 @@ func shouldApplyRetryAfter(resp *http.Response) bool {
 	return resp != nil && resp.StatusCode == http.StatusTooManyRequests
 }
 
+// countRetries is a retryablehttp.RequestLogHook that increments the counter attached via WithRetryCounter
+// for every attempt after the first.
+func countRetries(_ retryablehttp.Logger, req *http.Request, attempt int) {
+	if attempt == 0 {
+		return
+	}
+	if counter, ok := req.Context().Value(retryCounterKey{}).(*atomic.Int64); ok {
+		counter.Add(1)
+	}
+}
+
 // checkRedirectFunc is a wrapper around http.Client.CheckRedirect that allows for printing out redirects
 func checkRedirectFunc(req *http.Request, via []*http.Request) error {
 	logger := logging.GetLogger()
@@ -215,14 +337,35 @@ func checkRedirectFunc(req *http.Request, via []*http.Request) error {
 
 type transportDialer struct {
 	DNSOverrideMap map[string]string
+	UnixSockets    map[string]string
+	IPVersion      IPVersion
 	Dialer         *net.Dialer
+	// TLSConfig and ForceHTTP2 are those of the transport, for DialTLSContext.
+	TLSConfig  *tls.Config
+	ForceHTTP2 bool
+
+	// warm, if set, holds the connections established by WarmUp
+	warm *warmPool
 }
 
 func (d *transportDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if d.warm != nil {
+		if conn := d.warm.take("http://" + addr); conn != nil {
+			return conn, nil
+		}
+	}
+	return d.dial(ctx, network, addr)
+}
+
+func (d *transportDialer) dial(ctx context.Context, network, addr string) (net.Conn, error) {
 	logger := logging.GetLogger()
+	if socket := d.UnixSockets[addr]; socket != "" {
+		logger.Trace().Str("addr", addr).Str("socket", socket).Msg("Unix Socket")
+		return d.Dialer.DialContext(ctx, "unix", socket)
+	}
 	if addrOverride := d.DNSOverrideMap[addr]; addrOverride != "" {
 		logger.Debug().Str("addr", addr).Str("override", addrOverride).Msg("DNS Override")
 		addr = addrOverride
 	}
-	return d.Dialer.DialContext(ctx, network, addr)
+	return d.dialHappyEyeballs(ctx, network, addr)
 }
@@ -0,0 +1,100 @@
+package client
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/cookiejar"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/net/publicsuffix"
+)
+
+// httpOnlyPrefix marks the HttpOnly cookies of a cookie file, which are otherwise commented out.
+const httpOnlyPrefix = "#HttpOnly_"
+
+// NewCookieJar returns an empty cookie jar (see Options.Jar), which scopes cookies to their domain as browsers do:
+// a host can't set cookies for a public suffix such as co.uk.
+func NewCookieJar() http.CookieJar {
+	// only fails for invalid options
+	jar, _ := cookiejar.New(&cookiejar.Options{PublicSuffixList: publicsuffix.List})
+	return jar
+}
+
+// LoadCookieFile adds the cookies of the Netscape cookie file at path to jar, the cookies.txt format written by curl
+// --cookie-jar and wget --save-cookies, and exported by browser extensions. Expired cookies are skipped.
+func LoadCookieFile(jar http.CookieJar, path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("reading cookie file: %w", err)
+	}
+	cookies, err := parseCookieFile(string(data), time.Now())
+	if err != nil {
+		return fmt.Errorf("parsing cookie file %s: %w", path, err)
+	}
+	for _, c := range cookies {
+		jar.SetCookies(c.url, []*http.Cookie{c.cookie})
+	}
+	return nil
+}
+
+// fileCookie is a cookie of a cookie file, with the URL it is set for.
+type fileCookie struct {
+	url    *url.URL
+	cookie *http.Cookie
+}
+
+// parseCookieFile parses the lines of a cookie file, seven tab-separated fields each: the domain, whether the cookie
+// is sent to its subdomains, the path, whether it is only sent over HTTPS, its expiry in seconds since the epoch (0
+// for session cookies), its name and its value.
+func parseCookieFile(data string, now time.Time) ([]fileCookie, error) {
+	var cookies []fileCookie
+	for i, line := range strings.Split(data, "\n") {
+		line = strings.TrimRight(line, "\r")
+		httpOnly := strings.HasPrefix(line, httpOnlyPrefix)
+		if httpOnly {
+			line = strings.TrimPrefix(line, httpOnlyPrefix)
+		}
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Split(line, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: expected 7 tab-separated fields, got %d", i+1, len(fields))
+		}
+		domain, subdomains, path, secure, expires, name, value := fields[0], fields[1], fields[2], fields[3], fields[4], fields[5], fields[6]
+		host := strings.TrimPrefix(domain, ".")
+		if host == "" {
+			return nil, fmt.Errorf("line %d: missing domain", i+1)
+		}
+		cookie := &http.Cookie{
+			Name:     name,
+			Value:    value,
+			Path:     path,
+			Secure:   strings.EqualFold(secure, "TRUE"),
+			HttpOnly: httpOnly,
+		}
+		if strings.EqualFold(subdomains, "TRUE") {
+			cookie.Domain = host
+		}
+		expiry, err := strconv.ParseInt(expires, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry %q", i+1, expires)
+		}
+		if expiry != 0 {
+			cookie.Expires = time.Unix(expiry, 0)
+			if cookie.Expires.Before(now) {
+				continue
+			}
+		}
+		scheme := "http"
+		if cookie.Secure {
+			scheme = "https"
+		}
+		cookies = append(cookies, fileCookie{url: &url.URL{Scheme: scheme, Host: host, Path: path}, cookie: cookie})
+	}
+	return cookies, nil
+}
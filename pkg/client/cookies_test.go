@@ -0,0 +1,85 @@
+package client_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/client"
+)
+
+func TestCookieJar(t *testing.T) {
+	mux := http.NewServeMux()
+	// the file is only served to clients which followed the cookie-setting redirect
+	mux.HandleFunc("/download", func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "abc", Path: "/"})
+		http.Redirect(w, r, "/file", http.StatusFound)
+	})
+	mux.HandleFunc("/file", func(w http.ResponseWriter, r *http.Request) {
+		if cookie, err := r.Cookie("session"); err != nil || cookie.Value != "abc" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		_, _ = w.Write([]byte("content"))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	get := func(c client.HTTPClient, path string) (int, string) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL+path, nil)
+		require.NoError(t, err)
+		resp, err := c.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return resp.StatusCode, string(body)
+	}
+
+	status, _ := get(client.NewHTTPClient(client.Options{}), "/download")
+	assert.Equal(t, http.StatusForbidden, status)
+
+	jar := client.NewCookieJar()
+	status, body := get(client.NewHTTPClient(client.Options{Jar: jar}), "/download")
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, "content", body)
+	// clients sharing the jar share its cookies
+	status, _ = get(client.NewHTTPClient(client.Options{Jar: jar}), "/file")
+	assert.Equal(t, http.StatusOK, status)
+}
+
+func TestLoadCookieFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "cookies.txt")
+	require.NoError(t, os.WriteFile(path, []byte("# Netscape HTTP Cookie File\n"+
+		"\n"+
+		".example.com\tTRUE\t/\tFALSE\t0\tdomain\t1\r\n"+
+		"example.com\tFALSE\t/data\tTRUE\t4102444800\tsecure\t2\n"+
+		"#HttpOnly_example.com\tFALSE\t/\tFALSE\t0\thttponly\t3\n"+
+		"example.com\tFALSE\t/\tFALSE\t1\texpired\t4\n"), 0600))
+	jar := client.NewCookieJar()
+	require.NoError(t, client.LoadCookieFile(jar, path))
+
+	names := func(rawURL string) []string {
+		u, err := url.Parse(rawURL)
+		require.NoError(t, err)
+		var names []string
+		for _, cookie := range jar.Cookies(u) {
+			names = append(names, cookie.Name+"="+cookie.Value)
+		}
+		return names
+	}
+	assert.ElementsMatch(t, []string{"domain=1", "secure=2", "httponly=3"}, names("https://example.com/data/file"))
+	assert.ElementsMatch(t, []string{"domain=1", "httponly=3"}, names("http://example.com/data/file"))
+	assert.ElementsMatch(t, []string{"domain=1"}, names("https://www.example.com/"))
+
+	require.NoError(t, os.WriteFile(path, []byte("example.com\tFALSE\t/\n"), 0600))
+	assert.ErrorContains(t, client.LoadCookieFile(jar, path), "line 1")
+	assert.Error(t, client.LoadCookieFile(jar, filepath.Join(t.TempDir(), "missing")))
+}
@@ -0,0 +1,170 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"time"
+)
+
+// IPVersion selects the IP versions connections to hosts are made over.
+type IPVersion string
+
+const (
+	// IPVersionAuto connects over IPv6 and IPv4, racing the addresses of a host (Happy Eyeballs).
+	IPVersionAuto IPVersion = "auto"
+	// IPVersion4 only connects over IPv4.
+	IPVersion4 IPVersion = "4"
+	// IPVersion6 only connects over IPv6.
+	IPVersion6 IPVersion = "6"
+)
+
+// attemptDelay is how long a connection attempt is given before the next address of the host is tried alongside
+// it, as recommended by RFC 8305.
+const attemptDelay = 250 * time.Millisecond
+
+// ParseIPVersion returns the IPVersion named name, IPVersionAuto if name is empty.
+func ParseIPVersion(name string) (IPVersion, error) {
+	switch version := IPVersion(name); version {
+	case "":
+		return IPVersionAuto, nil
+	case IPVersionAuto, IPVersion4, IPVersion6:
+		return version, nil
+	default:
+		return "", fmt.Errorf("invalid IP version %s, expected one of %s, %s, %s", name, IPVersion4, IPVersion6, IPVersionAuto)
+	}
+}
+
+// network returns the network to connect to hosts over, of the family network is, "tcp" or "udp", restricted to
+// version.
+func (version IPVersion) network(network string) string {
+	switch version {
+	case IPVersion4:
+		return network + "4"
+	case IPVersion6:
+		return network + "6"
+	default:
+		return network
+	}
+}
+
+// dialHappyEyeballs connects to addr, resolving its host and connecting to its addresses in turn, alternating
+// IPv6 and IPv4 in the order the resolver prefers them, without waiting for an attempt to fail for more than
+// attemptDelay before starting the next one (RFC 8305). A network where one of the IP versions is broken then
+// delays connections by attemptDelay rather than by the connect timeout.
+func (d *transportDialer) dialHappyEyeballs(ctx context.Context, network, addr string) (net.Conn, error) {
+	network = d.IPVersion.network(network)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || net.ParseIP(host) != nil {
+		return d.Dialer.DialContext(ctx, network, addr)
+	}
+	if d.Dialer.Timeout > 0 {
+		// the connect timeout covers resolving the host and all the attempts, as with net.Dialer
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Dialer.Timeout)
+		defer cancel()
+	}
+	resolver := d.Dialer.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	ips, err := resolver.LookupIP(ctx, d.IPVersion.network("ip"), host)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	addrs := make([]string, 0, len(ips))
+	for _, ip := range interleaveFamilies(ips) {
+		addrs = append(addrs, net.JoinHostPort(ip.String(), port))
+	}
+	return dialRace(ctx, addrs, func(ctx context.Context, addr string) (net.Conn, error) {
+		return d.Dialer.DialContext(ctx, network, addr)
+	})
+}
+
+// interleaveFamilies orders ips alternating IPv6 and IPv4 addresses, starting with the family of the first one and
+// otherwise keeping their order.
+func interleaveFamilies(ips []net.IP) []net.IP {
+	if len(ips) == 0 {
+		return ips
+	}
+	var first, second []net.IP
+	firstIs4 := ips[0].To4() != nil
+	for _, ip := range ips {
+		if (ip.To4() != nil) == firstIs4 {
+			first = append(first, ip)
+		} else {
+			second = append(second, ip)
+		}
+	}
+	interleaved := make([]net.IP, 0, len(ips))
+	for i := 0; i < len(first) || i < len(second); i++ {
+		if i < len(first) {
+			interleaved = append(interleaved, first[i])
+		}
+		if i < len(second) {
+			interleaved = append(interleaved, second[i])
+		}
+	}
+	return interleaved
+}
+
+// dialRace connects to addrs with dial in turn, starting the next attempt as soon as the previous one fails or once
+// it has been given attemptDelay, and returns the first connection made. The other attempts are cancelled and their
+// connections closed. If every attempt fails, the error of the first one is returned, as with net.Dialer.
+func dialRace(ctx context.Context, addrs []string, dial func(ctx context.Context, addr string) (net.Conn, error)) (net.Conn, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, len(addrs))
+	next, pending := 0, 0
+	timer := time.NewTimer(attemptDelay)
+	defer timer.Stop()
+	start := func() {
+		addr := addrs[next]
+		next++
+		pending++
+		go func() {
+			conn, err := dial(ctx, addr)
+			results <- result{conn, err}
+		}()
+		timer.Reset(attemptDelay)
+	}
+	if len(addrs) > 0 {
+		start()
+	}
+	var firstErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				// the attempts still pending are cancelled on return, but may connect meanwhile
+				go func(pending int) {
+					for range pending {
+						if r := <-results; r.conn != nil {
+							r.conn.Close()
+						}
+					}
+				}(pending)
+				return r.conn, nil
+			}
+			if firstErr == nil {
+				firstErr = r.err
+			}
+			if next < len(addrs) {
+				start()
+			}
+		case <-timer.C:
+			if next < len(addrs) {
+				start()
+			}
+		}
+	}
+	if firstErr == nil {
+		firstErr = &net.AddrError{Err: "no suitable address found"}
+	}
+	return nil, firstErr
+}
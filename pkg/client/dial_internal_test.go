@@ -0,0 +1,102 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInterleaveFamilies(t *testing.T) {
+	ips := func(addrs ...string) []net.IP {
+		var ips []net.IP
+		for _, addr := range addrs {
+			ips = append(ips, net.ParseIP(addr))
+		}
+		return ips
+	}
+	assert.Equal(t, ips("2001:db8::1", "192.0.2.1", "2001:db8::2", "192.0.2.2", "2001:db8::3"),
+		interleaveFamilies(ips("2001:db8::1", "2001:db8::2", "2001:db8::3", "192.0.2.1", "192.0.2.2")))
+	assert.Equal(t, ips("192.0.2.1", "2001:db8::1", "192.0.2.2"),
+		interleaveFamilies(ips("192.0.2.1", "192.0.2.2", "2001:db8::1")))
+	assert.Empty(t, interleaveFamilies(nil))
+}
+
+func TestDialRace(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+
+	// the first address is black-holed, the second refuses connections
+	var blackholeCancelled atomic.Bool
+	dial := func(ctx context.Context, addr string) (net.Conn, error) {
+		switch addr {
+		case "blackhole":
+			<-ctx.Done()
+			blackholeCancelled.Store(true)
+			return nil, ctx.Err()
+		case "refused":
+			return nil, errors.New("connection refused")
+		}
+		return (&net.Dialer{}).DialContext(ctx, "tcp", addr)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	conn, err := dialRace(ctx, []string{"blackhole", "refused", listener.Addr().String()}, dial)
+	require.NoError(t, err)
+	conn.Close()
+	// the black-holed address only delays the others by attemptDelay, and the refused one not at all
+	assert.Less(t, time.Since(start), 5*attemptDelay)
+	assert.Eventually(t, blackholeCancelled.Load, time.Second, 10*time.Millisecond)
+
+	// the error of the first attempt is returned if they all fail
+	_, err = dialRace(ctx, []string{"refused", "refused"}, dial)
+	assert.EqualError(t, err, "connection refused")
+	_, err = dialRace(ctx, nil, dial)
+	assert.Error(t, err)
+}
+
+func TestDialIPVersion(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	_, port, err := net.SplitHostPort(listener.Addr().String())
+	require.NoError(t, err)
+
+	for _, tc := range []struct {
+		version IPVersion
+		ok      bool
+	}{
+		{IPVersionAuto, true},
+		{IPVersion4, true},
+		{IPVersion6, false},
+	} {
+		d := &transportDialer{IPVersion: tc.version, Dialer: &net.Dialer{Timeout: time.Second}}
+		conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("127.0.0.1", port))
+		if !tc.ok {
+			assert.Error(t, err, tc.version)
+			continue
+		}
+		require.NoError(t, err, tc.version)
+		conn.Close()
+	}
+
+	// names are resolved to the addresses of the IP version only
+	d := &transportDialer{IPVersion: IPVersion4, Dialer: &net.Dialer{Timeout: time.Second}}
+	conn, err := d.DialContext(context.Background(), "tcp", net.JoinHostPort("localhost", port))
+	require.NoError(t, err)
+	conn.Close()
+
+	_, err = ParseIPVersion("5")
+	assert.Error(t, err)
+	version, err := ParseIPVersion("")
+	require.NoError(t, err)
+	assert.Equal(t, IPVersionAuto, version)
+}
@@ -0,0 +1,135 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+
+	"go.yaml.in/yaml/v3"
+)
+
+// ErrURLDenied is returned for requests to URLs a URLPolicy doesn't allow. Such requests aren't retried.
+var ErrURLDenied = errors.New("URL denied by policy")
+
+// URLPolicy restricts the URLs requests are made to, by host and scheme. Deny lists take precedence over allow
+// lists; an empty allow list allows everything not denied.
+//
+// Hosts are matched against the host of the URL, without its port, not against the addresses it resolves to. A
+// host pattern is either a hostname (example.com), a wildcard matching its subdomains (*.example.com, which doesn't
+// match example.com itself), an IP address, or a CIDR prefix matching IP addresses (10.0.0.0/8).
+type URLPolicy struct {
+	AllowHosts   []string `json:"allow_hosts,omitempty" yaml:"allow_hosts,omitempty"`
+	DenyHosts    []string `json:"deny_hosts,omitempty" yaml:"deny_hosts,omitempty"`
+	AllowSchemes []string `json:"allow_schemes,omitempty" yaml:"allow_schemes,omitempty"`
+	DenySchemes  []string `json:"deny_schemes,omitempty" yaml:"deny_schemes,omitempty"`
+}
+
+// LoadURLPolicy reads a URLPolicy from a YAML (or JSON) file.
+func LoadURLPolicy(path string) (*URLPolicy, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading URL policy: %w", err)
+	}
+	defer f.Close()
+	var p URLPolicy
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(&p); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error parsing URL policy %s: %w", path, err)
+	}
+	if err := p.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid URL policy %s: %w", path, err)
+	}
+	return &p, nil
+}
+
+// Merge returns a policy with the rules of both p and other.
+func (p *URLPolicy) Merge(other URLPolicy) *URLPolicy {
+	return &URLPolicy{
+		AllowHosts:   append(slices.Clone(p.AllowHosts), other.AllowHosts...),
+		DenyHosts:    append(slices.Clone(p.DenyHosts), other.DenyHosts...),
+		AllowSchemes: append(slices.Clone(p.AllowSchemes), other.AllowSchemes...),
+		DenySchemes:  append(slices.Clone(p.DenySchemes), other.DenySchemes...),
+	}
+}
+
+// Empty reports whether p has no rules, allowing every URL.
+func (p *URLPolicy) Empty() bool {
+	return len(p.AllowHosts) == 0 && len(p.DenyHosts) == 0 && len(p.AllowSchemes) == 0 && len(p.DenySchemes) == 0
+}
+
+// Validate returns an error if a host pattern of p is malformed.
+func (p *URLPolicy) Validate() error {
+	for _, pattern := range slices.Concat(p.AllowHosts, p.DenyHosts) {
+		if strings.Contains(pattern, "/") {
+			if _, err := netip.ParsePrefix(pattern); err != nil {
+				return fmt.Errorf("invalid host pattern %s: %w", pattern, err)
+			}
+			continue
+		}
+		if pattern == "" || strings.Contains(strings.TrimPrefix(pattern, "*."), "*") {
+			return fmt.Errorf("invalid host pattern `%s`", pattern)
+		}
+	}
+	return nil
+}
+
+// Check returns an error wrapping ErrURLDenied unless p allows u.
+func (p *URLPolicy) Check(u *url.URL) error {
+	scheme := strings.ToLower(u.Scheme)
+	host := strings.ToLower(strings.TrimSuffix(u.Hostname(), "."))
+	switch {
+	case slices.ContainsFunc(p.DenySchemes, func(s string) bool { return strings.EqualFold(s, scheme) }):
+		return fmt.Errorf("%w: scheme %s of %s is denied", ErrURLDenied, scheme, u.Redacted())
+	case len(p.AllowSchemes) > 0 && !slices.ContainsFunc(p.AllowSchemes, func(s string) bool { return strings.EqualFold(s, scheme) }):
+		return fmt.Errorf("%w: scheme %s of %s is not allowed", ErrURLDenied, scheme, u.Redacted())
+	case slices.ContainsFunc(p.DenyHosts, func(pattern string) bool { return matchHost(pattern, host) }):
+		return fmt.Errorf("%w: host %s of %s is denied", ErrURLDenied, host, u.Redacted())
+	case len(p.AllowHosts) > 0 && !slices.ContainsFunc(p.AllowHosts, func(pattern string) bool { return matchHost(pattern, host) }):
+		return fmt.Errorf("%w: host %s of %s is not allowed", ErrURLDenied, host, u.Redacted())
+	}
+	return nil
+}
+
+// matchHost reports whether host, lower-cased, matches pattern.
+func matchHost(pattern, host string) bool {
+	pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+	if strings.Contains(pattern, "/") {
+		prefix, err := netip.ParsePrefix(pattern)
+		if err != nil {
+			return false
+		}
+		addr, err := netip.ParseAddr(host)
+		return err == nil && prefix.Contains(addr.Unmap())
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && net.ParseIP(host) == nil
+	}
+	if addr, err := netip.ParseAddr(pattern); err == nil {
+		// IPv6 addresses may be written differently
+		hostAddr, err := netip.ParseAddr(host)
+		return err == nil && addr.Unmap() == hostAddr.Unmap()
+	}
+	return pattern == host
+}
+
+// policyTransport refuses the requests of an http.RoundTripper, redirects included, which a URLPolicy doesn't
+// allow, before they are sent.
+type policyTransport struct {
+	base   http.RoundTripper
+	policy *URLPolicy
+}
+
+func (t *policyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := t.policy.Check(req.URL); err != nil {
+		return nil, err
+	}
+	return t.base.RoundTrip(req)
+}
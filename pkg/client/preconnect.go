@@ -0,0 +1,181 @@
+package client
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// tlsHandshakeTimeout is the TLSHandshakeTimeout of the transport, which its own TLS connections are given.
+const tlsHandshakeTimeout = 5 * time.Second
+
+// warmConnTimeout is how long a connection established by WarmUp is kept for the transport before it is closed.
+// Servers close connections which don't send a request soon, and the transport doesn't retry requests on new
+// connections, so they are only worth keeping for the requests which follow.
+const warmConnTimeout = 10 * time.Second
+
+// warmPool holds the connections established ahead of requests, by scheme://host:port, until the transport dials
+// their host.
+type warmPool struct {
+	mu    sync.Mutex
+	conns map[string][]*warmConn
+}
+
+type warmConn struct {
+	net.Conn
+	expiry *time.Timer
+}
+
+func (p *warmPool) put(key string, conn net.Conn) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conns == nil {
+		p.conns = make(map[string][]*warmConn)
+	}
+	w := &warmConn{Conn: conn}
+	w.expiry = time.AfterFunc(warmConnTimeout, func() {
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		conns := p.conns[key]
+		for i, c := range conns {
+			if c == w {
+				p.conns[key] = append(conns[:i], conns[i+1:]...)
+				break
+			}
+		}
+		w.Close()
+	})
+	p.conns[key] = append(p.conns[key], w)
+}
+
+// take returns a connection established to key, or nil if there is none left.
+func (p *warmPool) take(key string) net.Conn {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for conns := p.conns[key]; len(conns) > 0; conns = p.conns[key] {
+		w := conns[len(conns)-1]
+		p.conns[key] = conns[:len(conns)-1]
+		if w.expiry.Stop() {
+			return w.Conn
+		}
+	}
+	return nil
+}
+
+// DialTLSContext connects to addr and completes the TLS handshake as the transport would, unless a connection was
+// already established to it by WarmUp. It is only used by transports with a warmPool, so that the others verify
+// servers exactly as http.Transport does.
+func (d *transportDialer) DialTLSContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	if conn := d.warm.take("https://" + addr); conn != nil {
+		return conn, nil
+	}
+	return d.dialTLS(ctx, network, addr)
+}
+
+func (d *transportDialer) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := d.dial(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{}
+	if d.TLSConfig != nil {
+		config = d.TLSConfig.Clone()
+	}
+	if config.ServerName == "" {
+		host, _, err := net.SplitHostPort(addr)
+		if err != nil {
+			host = addr
+		}
+		config.ServerName = host
+	}
+	if d.ForceHTTP2 {
+		config.NextProtos = []string{"h2", "http/1.1"}
+	}
+	ctx, cancel := context.WithTimeout(ctx, tlsHandshakeTimeout)
+	defer cancel()
+	tlsConn := tls.Client(conn, config)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return tlsConn, nil
+}
+
+// preconnect establishes n connections to addr in parallel, TLS connections if scheme is https, and keeps them for
+// the transport.
+func (d *transportDialer) preconnect(ctx context.Context, scheme, addr string, n int) error {
+	dial := d.dial
+	if scheme == "https" {
+		dial = d.dialTLS
+	}
+	errs := make(chan error, n)
+	for range n {
+		go func() {
+			conn, err := dial(ctx, "tcp", addr)
+			if err == nil {
+				d.warm.put(scheme+"://"+addr, conn)
+			}
+			errs <- err
+		}()
+	}
+	var all []error
+	for range n {
+		all = append(all, <-errs)
+	}
+	return errors.Join(all...)
+}
+
+// preconnector warms up the connections of an RPGetHTTPClient to hosts (see WarmUp).
+type preconnector struct {
+	dialer *transportDialer
+	proxy  func(*http.Request) (*url.URL, error)
+	// conns is the number of connections established to each host
+	conns int
+}
+
+// WarmUp establishes TransportOptions.Preconnect connections to each of hosts, in parallel, and keeps them for the
+// requests which follow, so that they don't wait for the TCP and TLS handshakes. hosts are URLs, of which only the
+// scheme and host matter, e.g. https://example.com. Hosts requests to which are sent through a proxy are skipped.
+//
+// WarmUp returns once the connections are established, with the errors of those which couldn't be. It does nothing
+// if Preconnect is zero, or if the client was built with its own Transport.
+func (c *RPGetHTTPClient) WarmUp(ctx context.Context, hosts []string) error {
+	p := c.preconnect
+	if p == nil {
+		return nil
+	}
+	errs := make(chan error, len(hosts))
+	for _, host := range hosts {
+		go func() {
+			errs <- p.warmUp(ctx, host)
+		}()
+	}
+	var all []error
+	for range hosts {
+		all = append(all, <-errs)
+	}
+	return errors.Join(all...)
+}
+
+func (p *preconnector) warmUp(ctx context.Context, host string) error {
+	u, err := url.Parse(host)
+	if err != nil {
+		return err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("can't preconnect to %s: unsupported scheme %q", host, u.Scheme)
+	}
+	if proxy, err := p.proxy(&http.Request{URL: u}); err != nil || proxy != nil {
+		return err
+	}
+	if err := p.dialer.preconnect(ctx, u.Scheme, hostPort(u), p.conns); err != nil {
+		return fmt.Errorf("preconnecting to %s: %w", host, err)
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWarmUp(t *testing.T) {
+	var conns atomic.Int64
+	server := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	}))
+	server.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	server.StartTLS()
+	defer server.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	c := NewHTTPClient(Options{TransportOpts: TransportOptions{RootCAs: roots, Preconnect: 3, MaxConnPerHost: 2}}).(*RPGetHTTPClient)
+	defer c.CloseIdleConnections()
+	require.NoError(t, c.WarmUp(context.Background(), []string{server.URL}))
+	// at most MaxConnPerHost connections are established
+	assert.Equal(t, int64(2), conns.Load())
+
+	// requests use the connections established ahead of them, which are verified like the others
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			req, err := http.NewRequest(http.MethodGet, server.URL, nil)
+			require.NoError(t, err)
+			resp, err := c.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			body, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, "ok", string(body))
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, int64(2), conns.Load())
+
+	// servers which can't be verified aren't connected to
+	untrusted := NewHTTPClient(Options{TransportOpts: TransportOptions{Preconnect: 1}}).(*RPGetHTTPClient)
+	assert.Error(t, untrusted.WarmUp(context.Background(), []string{server.URL}))
+	assert.Error(t, untrusted.WarmUp(context.Background(), []string{"ftp://example.com"}))
+
+	// without Preconnect, WarmUp does nothing
+	disabled := NewHTTPClient(Options{TransportOpts: TransportOptions{RootCAs: roots}}).(*RPGetHTTPClient)
+	require.NoError(t, disabled.WarmUp(context.Background(), []string{server.URL}))
+	// the third is the one which failed verification
+	assert.Equal(t, int64(3), conns.Load())
+}
+
+func TestWarmPool(t *testing.T) {
+	var p warmPool
+	a, b := net.Pipe()
+	defer b.Close()
+	p.put("http://host:80", a)
+	assert.Nil(t, p.take("https://host:80"))
+	assert.Equal(t, a, p.take("http://host:80"))
+	assert.Nil(t, p.take("http://host:80"))
+}
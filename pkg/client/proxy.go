@@ -0,0 +1,98 @@
+package client
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"golang.org/x/net/http/httpproxy"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// ParseProxyURL parses the URL of a proxy: http, https, socks5 or socks5h (for which the proxy resolves host names,
+// as it does for socks5). A URL without a scheme is an http proxy, as with curl.
+func ParseProxyURL(rawURL string) (*url.URL, error) {
+	if !strings.Contains(rawURL, "://") {
+		rawURL = "http://" + rawURL
+	}
+	proxyURL, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	switch proxyURL.Scheme {
+	case "http", "https", "socks5", "socks5h":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %q, expected http, https, socks5 or socks5h", proxyURL.Scheme)
+	}
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %s: missing host", rawURL)
+	}
+	return proxyURL, nil
+}
+
+// proxyFunc returns the Proxy of the transport: proxyURL if set, otherwise the proxies of HTTP_PROXY and
+// HTTPS_PROXY. Either way, the hosts of NO_PROXY, and loopback addresses, are connected to directly.
+//
+// Consistent hashing sends requests to a cache host with the Host header of the origin, which HTTP proxies don't
+// preserve: they forward plain http requests to the host of their URL, and may rewrite the Host header to match.
+// Such requests are made directly instead. SOCKS proxies relay connections without looking at the requests, so they
+// are used for every request.
+//
+// Hosts reached over a unix socket (see TransportOptions.UnixSockets) are local, so they aren't proxied either.
+func proxyFunc(proxyURL *url.URL, unixSockets map[string]string) func(*http.Request) (*url.URL, error) {
+	proxy := http.ProxyFromEnvironment
+	if proxyURL != nil {
+		config := httpproxy.Config{
+			HTTPProxy:  proxyURL.String(),
+			HTTPSProxy: proxyURL.String(),
+			NoProxy:    noProxy(),
+		}
+		envProxy := config.ProxyFunc()
+		proxy = func(req *http.Request) (*url.URL, error) {
+			return envProxy(req.URL)
+		}
+	}
+	return func(req *http.Request) (*url.URL, error) {
+		if _, ok := unixSockets[hostPort(req.URL)]; ok {
+			return nil, nil
+		}
+		target, err := proxy(req)
+		if err != nil || target == nil {
+			return target, err
+		}
+		overridesHost := req.Host != "" && !strings.EqualFold(req.Host, req.URL.Host)
+		if req.URL.Scheme == "http" && overridesHost && (target.Scheme == "http" || target.Scheme == "https") {
+			logger := logging.GetLogger()
+			logger.Debug().
+				Str("url", req.URL.String()).
+				Str("host", req.Host).
+				Str("proxy", target.Redacted()).
+				Msg("Bypassing HTTP proxy to preserve the Host header")
+			return nil, nil
+		}
+		return target, nil
+	}
+}
+
+func noProxy() string {
+	if noProxy := os.Getenv("NO_PROXY"); noProxy != "" {
+		return noProxy
+	}
+	return os.Getenv("no_proxy")
+}
+
+// hostPort returns the host:port address a request to u connects to.
+func hostPort(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
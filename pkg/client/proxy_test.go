@@ -0,0 +1,73 @@
+package client_test
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/client"
+)
+
+func TestParseProxyURL(t *testing.T) {
+	for raw, expected := range map[string]string{
+		"proxy.local:3128":            "http://proxy.local:3128",
+		"https://proxy.local":         "https://proxy.local",
+		"socks5://user:pw@proxy:1080": "socks5://user:pw@proxy:1080",
+		"socks5h://proxy:1080":        "socks5h://proxy:1080",
+	} {
+		proxyURL, err := client.ParseProxyURL(raw)
+		require.NoError(t, err, raw)
+		assert.Equal(t, expected, proxyURL.String())
+	}
+	for _, raw := range []string{"ftp://proxy.local", "http://", "socks4://proxy:1080"} {
+		_, err := client.ParseProxyURL(raw)
+		assert.Error(t, err, raw)
+	}
+}
+
+func TestProxy(t *testing.T) {
+	serve := func(name string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, name+" "+r.Host)
+		}))
+	}
+	proxy := serve("proxy")
+	defer proxy.Close()
+	origin := serve("origin")
+	defer origin.Close()
+	port := origin.URL[strings.LastIndex(origin.URL, ":")+1:]
+	addr := strings.TrimPrefix(origin.URL, "http://")
+
+	t.Setenv("NO_PROXY", "direct.test")
+	proxyURL, err := client.ParseProxyURL(proxy.URL)
+	require.NoError(t, err)
+	c := client.NewHTTPClient(client.Options{TransportOpts: client.TransportOptions{
+		Proxy: proxyURL,
+		// the test hosts aren't loopback names, which are never proxied
+		ResolveOverrides: map[string]string{"cache.test:" + port: addr, "direct.test:" + port: addr},
+	}})
+
+	get := func(url, host string) string {
+		req, err := http.NewRequest(http.MethodGet, url, nil)
+		require.NoError(t, err)
+		if host != "" {
+			req.Host = host
+		}
+		resp, err := c.Do(req)
+		require.NoError(t, err)
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		require.NoError(t, err)
+		return string(body)
+	}
+
+	assert.Equal(t, "proxy example.test", get("http://example.test/file", ""))
+	assert.Equal(t, "origin direct.test:"+port, get("http://direct.test:"+port+"/file", ""))
+	// a request keeping the Host header of another host, as consistent hashing does, bypasses the proxy
+	assert.Equal(t, "origin example.test", get("http://cache.test:"+port+"/file", "example.test"))
+}
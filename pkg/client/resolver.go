@@ -0,0 +1,143 @@
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	dohContentType = "application/dns-message"
+	dohTimeout     = 10 * time.Second
+	dotDefaultPort = "853"
+	// dnsMaxMessageSize is the largest DNS message, whose length must fit the 2 byte prefix of DNS over TCP
+	dnsMaxMessageSize = 65535
+)
+
+// NewResolver returns a resolver sending its queries to rawURL rather than the nameservers of the system: either
+// a DNS-over-HTTPS endpoint (https://host/dns-query) or a DNS-over-TLS server (tls://host[:853]). The host of rawURL
+// is itself resolved by the system, so it should be an IP address where plaintext DNS is blocked.
+func NewResolver(rawURL string) (*net.Resolver, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid resolver URL: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid resolver URL %s: missing host", rawURL)
+	}
+	switch u.Scheme {
+	case "https":
+		doh := &dohDialer{url: u.String(), client: &http.Client{Timeout: dohTimeout}}
+		return &net.Resolver{PreferGo: true, Dial: doh.dial}, nil
+	case "tls":
+		addr := u.Host
+		if u.Port() == "" {
+			addr = net.JoinHostPort(u.Hostname(), dotDefaultPort)
+		}
+		dialer := &tls.Dialer{Config: &tls.Config{ServerName: u.Hostname()}}
+		return &net.Resolver{
+			PreferGo: true,
+			// the Go resolver speaks DNS over TCP to connections which aren't net.PacketConns, which over TLS is DoT
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return dialer.DialContext(ctx, "tcp", addr)
+			},
+		}, nil
+	default:
+		return nil, fmt.Errorf("unsupported resolver scheme %q, expected https (DNS-over-HTTPS) or tls (DNS-over-TLS)", u.Scheme)
+	}
+}
+
+// dohDialer connects the Go resolver to a DNS-over-HTTPS endpoint.
+type dohDialer struct {
+	url    string
+	client *http.Client
+}
+
+// dial ignores the nameserver the resolver asks for, returning a connection to the DoH endpoint instead.
+func (d *dohDialer) dial(ctx context.Context, _, _ string) (net.Conn, error) {
+	return &dohConn{ctx: ctx, dialer: d}, nil
+}
+
+// dohConn is a net.Conn speaking DNS over TCP, as the Go resolver does with connections which aren't
+// net.PacketConns, by posting every query written to it to a DoH endpoint and queueing the response to be read.
+type dohConn struct {
+	ctx      context.Context
+	dialer   *dohDialer
+	query    bytes.Buffer
+	response bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	c.query.Write(b)
+	for c.query.Len() >= 2 {
+		size := int(binary.BigEndian.Uint16(c.query.Bytes()))
+		if c.query.Len() < 2+size {
+			break
+		}
+		query := make([]byte, size)
+		copy(query, c.query.Bytes()[2:2+size])
+		c.query.Next(2 + size)
+		answer, err := c.exchange(query)
+		if err != nil {
+			return 0, err
+		}
+		var prefix [2]byte
+		binary.BigEndian.PutUint16(prefix[:], uint16(len(answer)))
+		c.response.Write(prefix[:])
+		c.response.Write(answer)
+	}
+	return len(b), nil
+}
+
+// exchange posts query to the DoH endpoint, returning its answer (RFC 8484).
+func (c *dohConn) exchange(query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.dialer.url, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	resp, err := c.dialer.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("DNS-over-HTTPS query: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("DNS-over-HTTPS query: unexpected status %s", resp.Status)
+	}
+	answer, err := io.ReadAll(io.LimitReader(resp.Body, dnsMaxMessageSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("DNS-over-HTTPS query: %w", err)
+	}
+	if len(answer) > dnsMaxMessageSize {
+		return nil, fmt.Errorf("DNS-over-HTTPS query: answer larger than %d bytes", dnsMaxMessageSize)
+	}
+	return answer, nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	if c.response.Len() == 0 {
+		return 0, io.EOF
+	}
+	return c.response.Read(b)
+}
+
+func (c *dohConn) Close() error                     { return nil }
+func (c *dohConn) LocalAddr() net.Addr              { return dohAddr{} }
+func (c *dohConn) RemoteAddr() net.Addr             { return dohAddr{url: c.dialer.url} }
+func (c *dohConn) SetDeadline(time.Time) error      { return nil }
+func (c *dohConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(time.Time) error { return nil }
+
+type dohAddr struct{ url string }
+
+func (a dohAddr) Network() string { return "doh" }
+func (a dohAddr) String() string  { return strings.TrimPrefix(a.url, "https://") }
@@ -0,0 +1,89 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+// dohServer answers the A queries for origin.test with 127.0.0.1, and every other query with NXDOMAIN.
+func dohServer(t *testing.T) *httptest.Server {
+	return httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, dohContentType, r.Header.Get("Content-Type"))
+		body, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		var query dnsmessage.Message
+		require.NoError(t, query.Unpack(body))
+		answer := dnsmessage.Message{
+			Header:    dnsmessage.Header{ID: query.ID, Response: true, RecursionAvailable: true},
+			Questions: query.Questions,
+		}
+		question := query.Questions[0]
+		switch {
+		case question.Name.String() != "origin.test.":
+			answer.RCode = dnsmessage.RCodeNameError
+		case question.Type == dnsmessage.TypeA:
+			answer.Answers = []dnsmessage.Resource{{
+				Header: dnsmessage.ResourceHeader{Name: question.Name, Type: dnsmessage.TypeA, Class: dnsmessage.ClassINET, TTL: 60},
+				Body:   &dnsmessage.AResource{A: [4]byte{127, 0, 0, 1}},
+			}}
+		}
+		packed, err := answer.Pack()
+		require.NoError(t, err)
+		w.Header().Set("Content-Type", dohContentType)
+		_, _ = w.Write(packed)
+	}))
+}
+
+func TestDoHResolver(t *testing.T) {
+	doh := dohServer(t)
+	defer doh.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "resolved")
+	}))
+	defer origin.Close()
+
+	// the test server's certificate isn't trusted by the system, so use its client
+	dialer := &dohDialer{url: doh.URL + "/dns-query", client: doh.Client()}
+	resolver := &net.Resolver{PreferGo: true, Dial: dialer.dial}
+
+	addrs, err := resolver.LookupHost(context.Background(), "origin.test")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"127.0.0.1"}, addrs)
+	_, err = resolver.LookupHost(context.Background(), "missing.test")
+	assert.Error(t, err)
+
+	c := NewHTTPClient(Options{TransportOpts: TransportOptions{Resolver: resolver}})
+	port := origin.URL[strings.LastIndex(origin.URL, ":")+1:]
+	resp, err := c.Do(mustRequest(t, "http://origin.test:"+port+"/"))
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "resolved", string(body))
+}
+
+func TestNewResolver(t *testing.T) {
+	for _, rawURL := range []string{"https://1.1.1.1/dns-query", "tls://1.1.1.1", "tls://dns.example:8853"} {
+		_, err := NewResolver(rawURL)
+		assert.NoError(t, err, rawURL)
+	}
+	for _, rawURL := range []string{"http://1.1.1.1/dns-query", "udp://1.1.1.1", "https:///dns-query"} {
+		_, err := NewResolver(rawURL)
+		assert.Error(t, err, rawURL)
+	}
+}
+
+func mustRequest(t *testing.T, url string) *http.Request {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	return req
+}
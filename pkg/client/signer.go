@@ -0,0 +1,45 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ErrRequestSigning is returned when a RequestSigner fails to sign a request. Such requests aren't retried.
+var ErrRequestSigning = errors.New("error signing request")
+
+// A RequestSigner signs requests, e.g. by adding the headers of a CDN's HMAC scheme. Sign is called just before
+// every request is sent: chunk requests, resumed chunks and retries are signed again, with the headers they are
+// sent with. Sign is given a copy of the request, which it may modify; it is called concurrently, so it must be
+// safe for concurrent use.
+type RequestSigner interface {
+	Sign(req *http.Request) error
+}
+
+// RequestSignerFunc adapts a function to a RequestSigner.
+type RequestSignerFunc func(req *http.Request) error
+
+func (f RequestSignerFunc) Sign(req *http.Request) error {
+	return f(req)
+}
+
+// signingTransport signs the requests of an http.RoundTripper.
+type signingTransport struct {
+	base   http.RoundTripper
+	signer RequestSigner
+}
+
+func (t *signingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Response != nil && !strings.EqualFold(req.Response.Request.URL.Host, req.URL.Host) {
+		// a redirect to another host, which the signature isn't meant for
+		return t.base.RoundTrip(req)
+	}
+	// a RoundTripper must not modify its request, and retries must be signed afresh
+	signed := req.Clone(req.Context())
+	if err := t.signer.Sign(signed); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrRequestSigning, err)
+	}
+	return t.base.RoundTrip(signed)
+}
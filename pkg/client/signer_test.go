@@ -0,0 +1,82 @@
+package client_test
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/client"
+)
+
+func TestRequestSigner(t *testing.T) {
+	key := []byte("cdn-secret")
+	sign := func(path, rangeHeader string) string {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(path + "\n" + rangeHeader))
+		return hex.EncodeToString(mac.Sum(nil))
+	}
+	var requests atomic.Int32
+	var ts *httptest.Server
+	ts = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if requests.Add(1) == 1 {
+			// fail the first request, so it is retried
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("X-Signature") != sign(r.URL.Path, r.Header.Get("Range")) {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, strings.Replace(ts.URL, "127.0.0.1", "localhost", 1)+"/other", http.StatusFound)
+		}
+	}))
+	defer ts.Close()
+
+	var signed atomic.Int32
+	signer := client.RequestSignerFunc(func(req *http.Request) error {
+		signed.Add(1)
+		req.Header.Set("X-Signature", sign(req.URL.Path, req.Header.Get("Range")))
+		return nil
+	})
+	c := client.NewHTTPClient(client.Options{MaxRetries: 1, Signer: signer})
+
+	req, err := http.NewRequest(http.MethodGet, ts.URL+"/file", nil)
+	require.NoError(t, err)
+	req.Header.Set("Range", "bytes=0-9")
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int32(2), signed.Load(), "the retry is signed again")
+	assert.Empty(t, req.Header.Get("X-Signature"), "the request of the caller is left alone")
+
+	// a redirect to another host isn't signed
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/redirect", nil)
+	require.NoError(t, err)
+	resp, err = c.Do(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	assert.Equal(t, int32(3), signed.Load())
+
+	// signing errors aren't retried
+	failing := client.NewHTTPClient(client.Options{MaxRetries: 3, Signer: client.RequestSignerFunc(func(*http.Request) error {
+		signed.Add(1)
+		return errors.New("no key")
+	})})
+	req, err = http.NewRequest(http.MethodGet, ts.URL+"/file", nil)
+	require.NoError(t, err)
+	_, err = failing.Do(req)
+	assert.ErrorIs(t, err, client.ErrRequestSigning)
+	assert.Equal(t, int32(4), signed.Load())
+}
@@ -0,0 +1,234 @@
+package client
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	sigV4Algorithm = "AWS4-HMAC-SHA256"
+	// sigV4EmptyPayload is the SHA-256 of the empty body of the GET requests rpget makes.
+	sigV4EmptyPayload = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	sigV4TimeFormat   = "20060102T150405Z"
+)
+
+var ErrNoAWSCredentials = errors.New("no AWS credentials found")
+
+// AWSCredentials are the credentials SigV4 signs requests with.
+type AWSCredentials struct {
+	AccessKeyID     string
+	SecretAccessKey string
+	// SessionToken is set for temporary credentials.
+	SessionToken string
+}
+
+// AmbientAWSCredentials returns the AWS credentials of the environment: AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and
+// AWS_SESSION_TOKEN if set, otherwise the AWS_PROFILE profile ("default" if unset) of the shared credentials file
+// (AWS_SHARED_CREDENTIALS_FILE, ~/.aws/credentials by default).
+func AmbientAWSCredentials() (AWSCredentials, error) {
+	if id, secret := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && secret != "" {
+		return AWSCredentials{AccessKeyID: id, SecretAccessKey: secret, SessionToken: os.Getenv("AWS_SESSION_TOKEN")}, nil
+	}
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return AWSCredentials{}, ErrNoAWSCredentials
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+	return sharedAWSCredentials(path, profile)
+}
+
+// sharedAWSCredentials reads the credentials of profile from the shared credentials file at path.
+func sharedAWSCredentials(path, profile string) (AWSCredentials, error) {
+	file, err := os.Open(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return AWSCredentials{}, ErrNoAWSCredentials
+	}
+	if err != nil {
+		return AWSCredentials{}, fmt.Errorf("reading AWS credentials: %w", err)
+	}
+	defer file.Close()
+
+	var creds AWSCredentials
+	inProfile := false
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, ";") {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inProfile = strings.TrimSpace(line[1:len(line)-1]) == profile
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !inProfile || !ok {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.SessionToken = strings.TrimSpace(value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return AWSCredentials{}, fmt.Errorf("reading AWS credentials: %w", err)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return AWSCredentials{}, fmt.Errorf("%w in profile %s of %s", ErrNoAWSCredentials, profile, path)
+	}
+	return creds, nil
+}
+
+// SigV4 is a RequestSigner signing requests with AWS Signature Version 4, so that S3-compatible object stores can
+// be fetched directly without presigned URLs.
+type SigV4 struct {
+	Region      string
+	Service     string
+	Credentials AWSCredentials
+}
+
+// ParseSigV4 parses the <region>/<service> of --aws-sigv4.
+func ParseSigV4(spec string, creds AWSCredentials) (*SigV4, error) {
+	region, service, ok := strings.Cut(spec, "/")
+	if !ok || region == "" || service == "" || strings.Contains(service, "/") {
+		return nil, fmt.Errorf("invalid SigV4 scope, expected <region>/<service>, got: %s", spec)
+	}
+	return &SigV4{Region: region, Service: service, Credentials: creds}, nil
+}
+
+// Sign signs req with the current time, unless it already carries other credentials.
+func (s *SigV4) Sign(req *http.Request) error {
+	if req.Header.Get("Authorization") == "" {
+		s.SignAt(req, time.Now())
+	}
+	return nil
+}
+
+// SignAt signs req as made at now, setting its Authorization header. The Range header is signed along with the
+// host, so a range request can't be replayed for another range.
+func (s *SigV4) SignAt(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format(sigV4TimeFormat)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", sigV4EmptyPayload)
+	if s.Credentials.SessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", s.Credentials.SessionToken)
+	} else {
+		req.Header.Del("X-Amz-Security-Token")
+	}
+
+	host := req.Host
+	if host == "" {
+		host = req.URL.Host
+	}
+	headers := map[string]string{"host": host}
+	for _, name := range []string{"Range", "X-Amz-Content-Sha256", "X-Amz-Date", "X-Amz-Security-Token"} {
+		if value := req.Header.Get(name); value != "" {
+			headers[strings.ToLower(name)] = strings.TrimSpace(value)
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		sigV4CanonicalPath(req.URL),
+		sigV4CanonicalQuery(req.URL),
+		canonicalHeaders.String(),
+		signedHeaders,
+		sigV4EmptyPayload,
+	}, "\n")
+	scope := amzDate[:8] + "/" + s.Region + "/" + s.Service + "/aws4_request"
+	hash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := sigV4Algorithm + "\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hash[:])
+
+	key := hmacSHA256([]byte("AWS4"+s.Credentials.SecretAccessKey), amzDate[:8])
+	for _, part := range []string{s.Region, s.Service, "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("%s Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		sigV4Algorithm, s.Credentials.AccessKeyID, scope, signedHeaders, signature))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+// sigV4CanonicalPath returns the path of u, URI-encoded once, as S3 expects.
+func sigV4CanonicalPath(u *url.URL) string {
+	path := u.Path
+	if path == "" {
+		return "/"
+	}
+	return sigV4Escape(path, false)
+}
+
+// sigV4CanonicalQuery returns the query of u with its parameters URI-encoded and sorted.
+func sigV4CanonicalQuery(u *url.URL) string {
+	var params [][2]string
+	for key, values := range u.Query() {
+		for _, value := range values {
+			params = append(params, [2]string{sigV4Escape(key, true), sigV4Escape(value, true)})
+		}
+	}
+	sort.Slice(params, func(i, j int) bool {
+		if params[i][0] != params[j][0] {
+			return params[i][0] < params[j][0]
+		}
+		return params[i][1] < params[j][1]
+	})
+	encoded := make([]string, len(params))
+	for i, param := range params {
+		encoded[i] = param[0] + "=" + param[1]
+	}
+	return strings.Join(encoded, "&")
+}
+
+// sigV4Escape percent-encodes every byte of s other than the unreserved characters, and slashes unless
+// encodeSlash is set.
+func sigV4Escape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
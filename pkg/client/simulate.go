@@ -0,0 +1,114 @@
+package client
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// simulatedReadDivisor caps the reads of a simulated link to a tenth of a second of its bandwidth, so bodies are
+// delivered smoothly rather than in bursts.
+const simulatedReadDivisor = 10
+
+// NetworkSimulation shapes the traffic of a client to reproduce a slow network deterministically, for tests and
+// demos. The zero value doesn't shape anything.
+type NetworkSimulation struct {
+	// Bandwidth is the rate, in bytes per second, at which response bodies are read, shared by every request of
+	// the client as if they went through a single link. Zero means unlimited.
+	Bandwidth int64
+	// Latency is added before every request, retries and redirects included, is sent.
+	Latency time.Duration
+}
+
+func (s NetworkSimulation) enabled() bool {
+	return s.Bandwidth > 0 || s.Latency > 0
+}
+
+// simulatedTransport applies a NetworkSimulation to the requests of base.
+type simulatedTransport struct {
+	base    http.RoundTripper
+	latency time.Duration
+	link    *simulatedLink
+}
+
+func newSimulatedTransport(base http.RoundTripper, sim NetworkSimulation) *simulatedTransport {
+	t := &simulatedTransport{base: base, latency: sim.Latency}
+	if sim.Bandwidth > 0 {
+		t.link = &simulatedLink{bandwidth: sim.Bandwidth}
+	}
+	return t
+}
+
+func (t *simulatedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := sleep(req.Context(), t.latency); err != nil {
+		return nil, err
+	}
+	resp, err := t.base.RoundTrip(req)
+	if err != nil || t.link == nil {
+		return resp, err
+	}
+	resp.Body = &simulatedBody{ReadCloser: resp.Body, ctx: req.Context(), link: t.link}
+	return resp, nil
+}
+
+// simulatedLink is the link shared by the bodies read through a simulatedTransport.
+type simulatedLink struct {
+	bandwidth int64
+
+	mu sync.Mutex
+	// free is when the bytes read so far have gone through the link
+	free time.Time
+}
+
+// transfer waits for n bytes to go through the link, after those read before them.
+func (l *simulatedLink) transfer(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	if l.free.Before(now) {
+		l.free = now
+	}
+	l.free = l.free.Add(time.Duration(n) * time.Second / time.Duration(l.bandwidth))
+	until := l.free
+	l.mu.Unlock()
+	return sleep(ctx, time.Until(until))
+}
+
+func (l *simulatedLink) readSize() int {
+	return int(max(l.bandwidth/simulatedReadDivisor, 1))
+}
+
+type simulatedBody struct {
+	io.ReadCloser
+	ctx  context.Context
+	link *simulatedLink
+}
+
+func (b *simulatedBody) Read(p []byte) (int, error) {
+	if len(p) > b.link.readSize() {
+		p = p[:b.link.readSize()]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		if waitErr := b.link.transfer(b.ctx, n); waitErr != nil {
+			return n, waitErr
+		}
+	}
+	return n, err
+}
+
+// sleep waits for d, or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,57 @@
+package client_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/client"
+)
+
+func TestNetworkSimulation(t *testing.T) {
+	body := bytes.Repeat([]byte("x"), 20_000)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(body)
+	}))
+	defer ts.Close()
+	c := client.NewHTTPClient(client.Options{Simulation: client.NetworkSimulation{
+		Bandwidth: 100_000,
+		Latency:   100 * time.Millisecond,
+	}})
+
+	// two bodies of 20 kB share the 100 kB/s link, after 100ms of latency: 500ms in all
+	start := time.Now()
+	var wg sync.WaitGroup
+	for range 2 {
+		wg.Go(func() {
+			req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+			require.NoError(t, err)
+			resp, err := c.Do(req)
+			require.NoError(t, err)
+			defer resp.Body.Close()
+			data, err := io.ReadAll(resp.Body)
+			require.NoError(t, err)
+			assert.Equal(t, body, data)
+		})
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	assert.GreaterOrEqual(t, elapsed, 450*time.Millisecond)
+	assert.Less(t, elapsed, 2*time.Second)
+
+	// the latency is cut short by cancellation
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ts.URL, nil)
+	require.NoError(t, err)
+	_, err = client.NewHTTPClient(client.Options{Simulation: client.NetworkSimulation{Latency: time.Hour}}).Do(req)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,119 @@
+package client
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+var ErrCertificateNotPinned = errors.New("no certificate of the chain matches the pinned public keys")
+
+// SPKIHash returns the pin of cert: the base64 SHA-256 of its DER-encoded SubjectPublicKeyInfo, as produced by
+// `openssl x509 -pubkey -noout | openssl pkey -pubin -outform der | openssl dgst -sha256 -binary | base64`.
+func SPKIHash(cert *x509.Certificate) string {
+	sum := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// ParseSPKIPin returns the base64 hash of pin, which is either that hash or, as with HPKP and curl,
+// sha256/<hash>.
+func ParseSPKIPin(pin string) (string, error) {
+	hash := strings.TrimPrefix(strings.TrimPrefix(pin, "sha256//"), "sha256/")
+	if raw, err := base64.StdEncoding.DecodeString(hash); err != nil || len(raw) != sha256.Size {
+		return "", fmt.Errorf("invalid SPKI pin %q, expected the base64 of a SHA-256 hash", pin)
+	}
+	return hash, nil
+}
+
+// LoadCertPool returns the system roots along with the PEM certificates of the files at paths.
+func LoadCertPool(paths ...string) (*x509.CertPool, error) {
+	pool, err := x509.SystemCertPool()
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+	for _, path := range paths {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("reading CA certificates: %w", err)
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no PEM certificates found in %s", path)
+		}
+	}
+	return pool, nil
+}
+
+// LoadClientCertificate loads the PEM certificate and key of a client certificate. If keyPath is empty, the key
+// is read from the certificate file.
+func LoadClientCertificate(certPath, keyPath string) (tls.Certificate, error) {
+	if keyPath == "" {
+		keyPath = certPath
+	}
+	cert, err := tls.LoadX509KeyPair(certPath, keyPath)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("loading client certificate: %w", err)
+	}
+	return cert, nil
+}
+
+// tlsConfig returns the TLS configuration of the transport built for opts, or nil if it doesn't need one. Invalid
+// pins never match, so they fail closed.
+func (opts TransportOptions) tlsConfig() *tls.Config {
+	config := &tls.Config{
+		RootCAs:            opts.RootCAs,
+		Certificates:       opts.Certificates,
+		InsecureSkipVerify: opts.InsecureSkipVerify,
+	}
+	if len(opts.PinnedSPKI) == 0 && opts.VerifyPeerCertificate == nil {
+		if config.RootCAs == nil && len(config.Certificates) == 0 && !config.InsecureSkipVerify {
+			return nil
+		}
+		return config
+	}
+	pins := make(map[string]bool, len(opts.PinnedSPKI))
+	for _, pin := range opts.PinnedSPKI {
+		if hash, err := ParseSPKIPin(pin); err == nil {
+			pins[hash] = true
+		}
+	}
+	verify := opts.VerifyPeerCertificate
+	// runs after the chain has been verified, unless verification is skipped
+	config.VerifyPeerCertificate = func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error {
+		if len(opts.PinnedSPKI) > 0 && !chainPinned(rawCerts, verifiedChains, pins) {
+			return ErrCertificateNotPinned
+		}
+		if verify != nil {
+			return verify(rawCerts, verifiedChains)
+		}
+		return nil
+	}
+	return config
+}
+
+// chainPinned reports whether a certificate of one of the verified chains has one of the pinned public keys. If
+// verification is skipped, there are no verified chains and the certificates presented by the server are checked
+// instead.
+func chainPinned(rawCerts [][]byte, verifiedChains [][]*x509.Certificate, pins map[string]bool) bool {
+	if len(verifiedChains) == 0 {
+		var presented []*x509.Certificate
+		for _, raw := range rawCerts {
+			if cert, err := x509.ParseCertificate(raw); err == nil {
+				presented = append(presented, cert)
+			}
+		}
+		verifiedChains = [][]*x509.Certificate{presented}
+	}
+	for _, chain := range verifiedChains {
+		for _, cert := range chain {
+			if pins[SPKIHash(cert)] {
+				return true
+			}
+		}
+	}
+	return false
+}
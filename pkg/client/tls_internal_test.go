@@ -0,0 +1,64 @@
+package client
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTLSConfig(t *testing.T) {
+	ts := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+	pin := SPKIHash(ts.Certificate())
+	otherPin := "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="
+
+	assert.Nil(t, TransportOptions{}.tlsConfig())
+
+	var called bool
+	rejected := errors.New("rejected")
+	testCases := []struct {
+		name   string
+		opts   TransportOptions
+		expect error
+	}{
+		{"pinned", TransportOptions{PinnedSPKI: []string{otherPin, pin}}, nil},
+		{"pinned with prefix", TransportOptions{PinnedSPKI: []string{"sha256//" + pin}}, nil},
+		{"not pinned", TransportOptions{PinnedSPKI: []string{otherPin}}, ErrCertificateNotPinned},
+		{"invalid pin", TransportOptions{PinnedSPKI: []string{"not-a-pin"}}, ErrCertificateNotPinned},
+		{"callback", TransportOptions{VerifyPeerCertificate: func(_ [][]byte, chains [][]*x509.Certificate) error {
+			called = len(chains) > 0
+			return nil
+		}}, nil},
+		{"callback rejects", TransportOptions{PinnedSPKI: []string{pin}, VerifyPeerCertificate: func(_ [][]byte, _ [][]*x509.Certificate) error {
+			return rejected
+		}}, rejected},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			config := tc.opts.tlsConfig()
+			require.NotNil(t, config)
+			config.RootCAs = roots
+			conn, err := tls.Dial("tcp", ts.Listener.Addr().String(), config)
+			if tc.expect != nil {
+				assert.ErrorIs(t, err, tc.expect)
+				return
+			}
+			require.NoError(t, err)
+			conn.Close()
+		})
+	}
+	assert.True(t, called)
+
+	_, err := ParseSPKIPin("sha256/" + pin)
+	assert.NoError(t, err)
+	_, err = ParseSPKIPin("c2hvcnQ=")
+	assert.Error(t, err)
+}
@@ -0,0 +1,82 @@
+package client_test
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/pem"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/client"
+)
+
+func TestMutualTLS(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, r.TLS.PeerCertificates[0].Subject.Organization[0])
+	}))
+	ts.TLS = &tls.Config{ClientAuth: tls.RequireAnyClientCert}
+	ts.StartTLS()
+	defer ts.Close()
+
+	// write the server's certificate, which also serves as the client certificate, as PEM files
+	dir := t.TempDir()
+	serverCert := ts.TLS.Certificates[0]
+	key, err := x509.MarshalPKCS8PrivateKey(serverCert.PrivateKey)
+	require.NoError(t, err)
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: serverCert.Certificate[0]})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	caFile := filepath.Join(dir, "ca.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+	bundleFile := filepath.Join(dir, "bundle.pem")
+	require.NoError(t, os.WriteFile(caFile, certPEM, 0600))
+	require.NoError(t, os.WriteFile(keyFile, keyPEM, 0600))
+	require.NoError(t, os.WriteFile(bundleFile, append(certPEM, keyPEM...), 0600))
+
+	roots, err := client.LoadCertPool(caFile)
+	require.NoError(t, err)
+	cert, err := client.LoadClientCertificate(caFile, keyFile)
+	require.NoError(t, err)
+	_, err = client.LoadClientCertificate(bundleFile, "")
+	require.NoError(t, err)
+	_, err = client.LoadCertPool(keyFile)
+	assert.Error(t, err)
+
+	get := func(opts client.TransportOptions) (string, error) {
+		req, err := http.NewRequest(http.MethodGet, ts.URL, nil)
+		require.NoError(t, err)
+		resp, err := client.NewHTTPClient(client.Options{TransportOpts: opts}).Do(req)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	// the server's CA isn't trusted by the system
+	_, err = get(client.TransportOptions{Certificates: []tls.Certificate{cert}})
+	assert.Error(t, err)
+	// the server requires a client certificate
+	_, err = get(client.TransportOptions{RootCAs: roots})
+	assert.Error(t, err)
+
+	body, err := get(client.TransportOptions{RootCAs: roots, Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+	assert.Equal(t, "Acme Co", body)
+	body, err = get(client.TransportOptions{InsecureSkipVerify: true, Certificates: []tls.Certificate{cert}})
+	require.NoError(t, err)
+	assert.Equal(t, "Acme Co", body)
+	_, err = get(client.TransportOptions{
+		InsecureSkipVerify: true,
+		Certificates:       []tls.Certificate{cert},
+		PinnedSPKI:         []string{"47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+	})
+	assert.ErrorIs(t, err, client.ErrCertificateNotPinned)
+}
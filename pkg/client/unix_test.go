@@ -0,0 +1,44 @@
+package client_test
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/client"
+)
+
+func TestUnixSockets(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "cache.sock")
+	listener, err := net.Listen("unix", socket)
+	require.NoError(t, err)
+	cache := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "cache "+r.Host+r.URL.Path)
+	}))
+	cache.Listener = listener
+	cache.Start()
+	defer cache.Close()
+
+	// requests to the socket's host aren't proxied
+	proxyURL, err := client.ParseProxyURL("http://127.0.0.1:1")
+	require.NoError(t, err)
+	c := client.NewHTTPClient(client.Options{TransportOpts: client.TransportOptions{
+		Proxy:       proxyURL,
+		UnixSockets: map[string]string{"cache.test:80": socket},
+	}})
+
+	req, err := http.NewRequest(http.MethodGet, "http://cache.test/origin.test/file", nil)
+	require.NoError(t, err)
+	resp, err := c.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	assert.Equal(t, "cache cache.test/origin.test/file", string(body))
+}
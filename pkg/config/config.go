@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net"
 	"net/url"
+	"os"
 	"strings"
 
 	"github.com/rs/zerolog"
@@ -11,7 +12,10 @@ import (
 	"github.com/spf13/viper"
 
 	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/dirtree"
+	"github.com/emaballarin/rpget/pkg/extract"
 	"github.com/emaballarin/rpget/pkg/logging"
+	"github.com/emaballarin/rpget/pkg/scratch"
 )
 
 const viperEnvPrefix = "RPGET"
@@ -20,8 +24,13 @@ const (
 	ConsumerFile         = "file"
 	ConsumerTarExtractor = "tar-extractor"
 	ConsumerNull         = "null"
+	ConsumerTarStdout    = "tar-stdout"
+	ConsumerStdout       = "stdout"
 )
 
+// ServeCMDName is the name of the serve command, which runs without the PID lock.
+const ServeCMDName = "serve"
+
 var (
 	DefaultCacheURIPrefixes = []string{"https://weights.replicate.delivery"}
 )
@@ -140,17 +149,66 @@ func ResolveOverridesToMap(resolveOverrides []string) (map[string]string, error)
 	return resolveOverrideMap, nil
 }
 
+// HeadersToMap parses headers in the `Key: Value` format of --header, adding them to base (which may be nil). A
+// header given more than once takes its last value.
+func HeadersToMap(base map[string]string, headers []string) (map[string]string, error) {
+	if len(headers) == 0 {
+		return base, nil
+	}
+	headerMap := make(map[string]string, len(base)+len(headers))
+	for key, value := range base {
+		headerMap[key] = value
+	}
+	for _, header := range headers {
+		key, value, ok := strings.Cut(header, ":")
+		key = strings.TrimSpace(key)
+		if !ok || key == "" || strings.ContainsAny(key, " \t") {
+			return nil, fmt.Errorf("invalid header format, expected <key>: <value>, got: %s", header)
+		}
+		headerMap[key] = strings.TrimSpace(value)
+	}
+	return headerMap, nil
+}
+
 // GetConsumer returns the consumer specified by the user on the command line
 // or an error if the consumer is invalid. Note that this function explicitly
 // calls viper.GetString(OptExtract) internally.
 func GetConsumer() (consumer.Consumer, error) {
 	consumerName := viper.GetString(OptOutputConsumer)
+	if consumerName == "" {
+		// the default of --output, e.g. for commands without the flag
+		consumerName = ConsumerFile
+	}
+	return NewConsumer(consumerName)
+}
+
+// NewConsumer returns the consumer named consumerName, configured with the options given on the command line.
+func NewConsumer(consumerName string) (consumer.Consumer, error) {
 	enableOverwrite := viper.GetBool(OptForce)
 	switch consumerName {
 	case ConsumerFile:
-		return &consumer.FileWriter{Overwrite: enableOverwrite}, nil
+		return &consumer.FileWriter{
+			Overwrite:      enableOverwrite,
+			TempDir:        scratch.Dir(),
+			DirectIO:       viper.GetBool(OptDirectIO),
+			NoPreallocate:  viper.GetBool(OptNoPreallocate),
+			Dirs:           dirtree.New(),
+			BreakHardlinks: viper.GetString(OptCacheDir) != "",
+		}, nil
 	case ConsumerTarExtractor:
-		return &consumer.TarExtractor{Overwrite: enableOverwrite}, nil
+		opts, err := ExtractOptions()
+		if err != nil {
+			return nil, err
+		}
+		return &consumer.TarExtractor{Options: opts}, nil
+	case ConsumerTarStdout:
+		compression, err := extract.ParseCompression(viper.GetString(OptDecompress))
+		if err != nil {
+			return nil, err
+		}
+		return &consumer.TarStream{Writer: os.Stdout, Compression: compression}, nil
+	case ConsumerStdout:
+		return &consumer.Pipe{File: os.Stdout}, nil
 	case ConsumerNull:
 		return &consumer.NullWriter{}, nil
 	default:
@@ -158,6 +216,57 @@ func GetConsumer() (consumer.Consumer, error) {
 	}
 }
 
+// ExtractOptions returns the extraction options configured on the command line.
+func ExtractOptions() (extract.Options, error) {
+	compression, err := extract.ParseCompression(viper.GetString(OptDecompress))
+	if err != nil {
+		return extract.Options{}, err
+	}
+	stripComponents := viper.GetInt(OptStripComponents)
+	if stripComponents < 0 {
+		return extract.Options{}, fmt.Errorf("--%s must not be negative", OptStripComponents)
+	}
+	var transforms []extract.Transform
+	for _, expr := range viper.GetStringSlice(OptTransform) {
+		transform, err := extract.ParseTransform(expr)
+		if err != nil {
+			return extract.Options{}, err
+		}
+		transforms = append(transforms, transform)
+	}
+	duplicates, err := extract.ParseDuplicatePolicy(viper.GetString(OptExtractDuplicates))
+	if err != nil {
+		return extract.Options{}, err
+	}
+	caseCollisions, err := extract.ParseCaseCollisionPolicy(viper.GetString(OptExtractCaseCollisions))
+	if err != nil {
+		return extract.Options{}, err
+	}
+	preserve, err := extract.ParsePreserve(viper.GetString(OptExtractPreserve))
+	if err != nil {
+		return extract.Options{}, err
+	}
+	include := viper.GetStringSlice(OptExtractInclude)
+	exclude := viper.GetStringSlice(OptExtractExclude)
+	if err := extract.ValidatePatterns(append(append([]string{}, include...), exclude...)); err != nil {
+		return extract.Options{}, err
+	}
+	return extract.Options{
+		Overwrite:       viper.GetBool(OptForce),
+		Compression:     compression,
+		ChecksumsPath:   viper.GetString(OptExtractChecksums),
+		StripComponents: stripComponents,
+		Transforms:      transforms,
+		Duplicates:      duplicates,
+		CaseCollisions:  caseCollisions,
+		Include:         include,
+		Exclude:         exclude,
+		Preserve:        preserve,
+		Resume:          viper.GetBool(OptExtractResume),
+		TempDir:         scratch.Dir(),
+	}, nil
+}
+
 // GetCacheSRV returns the SRV name of the cache to use, if set.
 func GetCacheSRV() string {
 	if srv := viper.GetString(OptCacheNodesSRVName); srv != "" {
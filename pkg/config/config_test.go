@@ -57,6 +57,35 @@ func TestResolveOverrides(t *testing.T) {
 	}
 }
 
+func TestHeadersToMap(t *testing.T) {
+	testCases := []struct {
+		name     string
+		base     map[string]string
+		headers  []string
+		expected map[string]string
+		err      bool
+	}{
+		{"empty", nil, []string{}, nil, false},
+		{"base only", map[string]string{"X-Tenant": "a"}, nil, map[string]string{"X-Tenant": "a"}, false},
+		{"single", nil, []string{"Authorization: Bearer xyz"}, map[string]string{"Authorization": "Bearer xyz"}, false},
+		{"value with colons and commas", nil, []string{"X-Token:a:b, c"}, map[string]string{"X-Token": "a:b, c"}, false},
+		{"empty value", nil, []string{"X-Empty:"}, map[string]string{"X-Empty": ""}, false},
+		{"overrides base", map[string]string{"X-Tenant": "a", "X-Other": "b"}, []string{"X-Tenant: c"}, map[string]string{"X-Tenant": "c", "X-Other": "b"}, false},
+		{"last wins", nil, []string{"X-Tenant: a", "X-Tenant: b"}, map[string]string{"X-Tenant": "b"}, false},
+		{"missing colon", nil, []string{"X-Tenant"}, nil, true},
+		{"empty key", nil, []string{": value"}, nil, true},
+		{"space in key", nil, []string{"X Tenant: a"}, nil, true},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			headers, err := HeadersToMap(tc.base, tc.headers)
+			assert.Equal(t, tc.err, err != nil)
+			assert.Equal(t, tc.expected, headers)
+		})
+	}
+}
+
 func helperUrlParse(t *testing.T, uris ...string) []*url.URL {
 	t.Helper()
 	var urls []*url.URL
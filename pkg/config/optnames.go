@@ -3,6 +3,10 @@ package config
 const (
 	// these options are a massive hack. They're only availabe via
 	// envvar, not command line
+	OptCacheHealthCheckInterval    = "cache-health-check-interval"
+	OptCacheHealthCheckMode        = "cache-health-check-mode"
+	OptCacheHealthCheckThreshold   = "cache-health-check-threshold"
+	OptCacheHostsRefreshInterval   = "cache-hosts-refresh-interval"
 	OptCacheNodesSRVNameByHostCIDR = "cache-nodes-srv-name-by-host-cidr"
 	OptCacheNodesSRVName           = "cache-nodes-srv-name"
 	OptCacheServiceHostname        = "cache-service-hostname"
@@ -15,20 +19,120 @@ const (
 	OptProxyAuthHeader             = "proxy-auth-header"
 
 	// Normal options with CLI arguments
-	OptConcurrency        = "concurrency"
-	OptConnTimeout        = "connect-timeout"
-	OptChunkSize          = "chunk-size"
-	OptExtract            = "extract"
-	OptForce              = "force"
-	OptForceHTTP2         = "force-http2"
-	OptLoggingLevel       = "log-level"
-	OptMaxChunks          = "max-chunks"
-	OptMaxConnPerHost     = "max-conn-per-host"
-	OptMaxConcurrentFiles = "max-concurrent-files"
-	OptMinimumChunkSize   = "minimum-chunk-size"
-	OptOutputConsumer     = "output"
-	OptPIDFile            = "pid-file"
-	OptResolve            = "resolve"
-	OptRetries            = "retries"
-	OptVerbose            = "verbose"
+	OptAgent                     = "agent"
+	OptAgentIdleTimeout          = "agent-idle-timeout"
+	OptAllowHost                 = "allow-host"
+	OptAllowScheme               = "allow-scheme"
+	OptAPIToken                  = "api-token"
+	OptAWSSigV4                  = "aws-sigv4"
+	OptAuthBasic                 = "auth-basic"
+	OptAuthToken                 = "auth-token"
+	OptBackground                = "background"
+	OptBatch                     = "batch"
+	OptCacheDir                  = "cache-dir"
+	OptCacheSocket               = "cache-socket"
+	OptCHAlgorithm               = "ch-algorithm"
+	OptCHFallback                = "ch-fallback"
+	OptCHFallbackMirror          = "ch-fallback-mirror"
+	OptCoalesceSmallFiles        = "coalesce-small-files"
+	OptConcurrency               = "concurrency"
+	OptContinueOnError           = "continue-on-error"
+	OptConnTimeout               = "connect-timeout"
+	OptCookieFile                = "cookie-file"
+	OptCookies                   = "cookies"
+	OptChunkSize                 = "chunk-size"
+	OptDecompress                = "decompress"
+	OptDenyHost                  = "deny-host"
+	OptDestTemplate              = "dest-template"
+	OptDenyScheme                = "deny-scheme"
+	OptDirectIO                  = "direct-io"
+	OptDoHURL                    = "doh-url"
+	OptDuration                  = "duration"
+	OptEvictionPolicy            = "eviction-policy"
+	OptExtract                   = "extract"
+	OptExtractCaseCollisions     = "extract-case-collisions"
+	OptExtractChecksums          = "extract-checksums"
+	OptExtractDuplicates         = "extract-duplicates"
+	OptExtractExclude            = "extract-exclude"
+	OptExtractInclude            = "extract-include"
+	OptExtractPreserve           = "extract-preserve"
+	OptExtractResume             = "extract-resume"
+	OptExtractToStdout           = "extract-to-stdout"
+	OptFileSize                  = "file-size"
+	OptForce                     = "force"
+	OptExclude                   = "exclude"
+	OptForceHTTP2                = "force-http2"
+	OptFormat                    = "format"
+	OptGzipReadahead             = "gzip-readahead"
+	OptHeader                    = "header"
+	OptHedgeAfter                = "hedge-after"
+	OptHostMode                  = "host-mode"
+	OptHosts                     = "hosts"
+	OptIdempotent                = "idempotent"
+	OptIdleTimeout               = "idle-timeout"
+	OptInclude                   = "include"
+	OptInput                     = "input"
+	OptInsecureSkipVerify        = "insecure-skip-verify"
+	OptInterval                  = "interval"
+	OptIPVersion                 = "ip-version"
+	OptGRPCListen                = "grpc-listen"
+	OptListen                    = "listen"
+	OptLoggingLevel              = "log-level"
+	OptManifestFormat            = "manifest-format"
+	OptManifestStrict            = "manifest-strict"
+	OptManifestRetries           = "manifest-retries"
+	OptMaxAge                    = "max-age"
+	OptMaxBufferMemory           = "max-buffer-memory"
+	OptMaxChunks                 = "max-chunks"
+	OptMaxConnPerHost            = "max-conn-per-host"
+	OptMaxConnectionsPerHost     = "max-connections-per-host"
+	OptMaxConcurrentExtracts     = "max-concurrent-extracts"
+	OptMaxConcurrentFiles        = "max-concurrent-files"
+	OptMaxConcurrentFilesPerHost = "max-concurrent-files-per-host"
+	OptMaxErrorRate              = "max-error-rate"
+	OptMaxFiles                  = "max-files"
+	OptMaxSize                   = "max-size"
+	OptMaxTotalConnections       = "max-total-connections"
+	OptMinimumChunkSize          = "minimum-chunk-size"
+	OptNoPreallocate             = "no-preallocate"
+	OptOffsetWrites              = "offset-writes"
+	OptOnAllComplete             = "on-all-complete"
+	OptOnComplete                = "on-complete"
+	OptOnError                   = "on-error"
+	OptOpenFileLimit             = "open-file-limit"
+	OptOutputConsumer            = "output"
+	OptOutputDir                 = "output-dir"
+	OptOutputRoot                = "output-root"
+	OptPIDFile                   = "pid-file"
+	OptPreconnect                = "preconnect"
+	OptProxy                     = "proxy"
+	OptReportJSON                = "report-json"
+	OptResolve                   = "resolve"
+	OptResume                    = "resume"
+	OptRetries                   = "retries"
+	OptRoute                     = "route"
+	OptRunAs                     = "run-as"
+	OptSandbox                   = "sandbox"
+	OptSample                    = "sample"
+	OptSchedule                  = "schedule"
+	OptSimulateBandwidth         = "simulate-bandwidth"
+	OptSimulateLatency           = "simulate-latency"
+	OptSkipExisting              = "skip-existing"
+	OptSliceSize                 = "slice-size"
+	OptStripComponents           = "strip-components"
+	OptTLSCA                     = "tls-ca"
+	OptTLSCert                   = "tls-cert"
+	OptTLSKey                    = "tls-key"
+	OptTmpDir                    = "tmp-dir"
+	OptTransform                 = "transform"
+	OptURLPolicy                 = "url-policy"
+	OptVerbose                   = "verbose"
+	OptVersionMarker             = "version-marker"
+	OptVersionMarkerFile         = "version-marker-file"
+	OptWaitForURL                = "wait-for-url"
+	OptWaitTimeout               = "wait-timeout"
+	OptWALDir                    = "wal-dir"
+	OptWorkers                   = "workers"
+	OptZstdConcurrency           = "zstd-concurrency"
+	OptZstdMaxWindow             = "zstd-max-window"
 )
@@ -0,0 +1,82 @@
+package consistent
+
+import (
+	"fmt"
+	"slices"
+
+	"github.com/mitchellh/hashstructure/v2"
+)
+
+// Algorithm maps keys to buckets. Bucket returns a bucket from [0,buckets) other than previousBuckets, which
+// indicates buckets already attempted for key. Bucket may sort previousBuckets.
+type Algorithm interface {
+	Bucket(key any, buckets int, previousBuckets ...int) (int, error)
+}
+
+const (
+	AlgorithmJump       = "jump"
+	AlgorithmRendezvous = "rendezvous"
+)
+
+// ParseAlgorithm returns the Algorithm named name, Jump if name is empty.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch name {
+	case "", AlgorithmJump:
+		return Jump{}, nil
+	case AlgorithmRendezvous:
+		return Rendezvous{}, nil
+	default:
+		return nil, fmt.Errorf("invalid consistent hashing algorithm %s, expected %s or %s", name, AlgorithmJump, AlgorithmRendezvous)
+	}
+}
+
+// Jump is Google's Jump Consistent Hash (see HashBucket). Growing the ring from n to n+1 buckets only moves keys
+// to the new bucket, but removing a bucket other than the last remaps the keys of every later bucket: unavailable
+// buckets must be kept as empty entries.
+type Jump struct{}
+
+func (Jump) Bucket(key any, buckets int, previousBuckets ...int) (int, error) {
+	return HashBucket(key, buckets, previousBuckets...)
+}
+
+// Rendezvous is Highest Random Weight hashing: every bucket is scored against the key and the highest score
+// wins. Adding or removing any bucket only moves the keys of that bucket, and retries fall on the next highest
+// scores, so the keys of a failed bucket are spread over all others.
+type Rendezvous struct{}
+
+func (Rendezvous) Bucket(key any, buckets int, previousBuckets ...int) (int, error) {
+	if len(previousBuckets) >= buckets {
+		return -1, fmt.Errorf("No more buckets left: %d buckets available but %v already attempted", buckets, previousBuckets)
+	}
+	hashopts := &hashstructure.HashOptions{IgnoreZeroValue: true}
+	keyHash, err := hashstructure.Hash(key, hashstructure.FormatV2, hashopts)
+	if err != nil {
+		return -1, fmt.Errorf("error calculating hash of key: %w", err)
+	}
+	slices.Sort(previousBuckets)
+	best, bestScore := -1, uint64(0)
+	for bucket := 0; bucket < buckets; bucket++ {
+		if _, found := slices.BinarySearch(previousBuckets, bucket); found {
+			continue
+		}
+		if score := rendezvousScore(keyHash, bucket); best == -1 || score > bestScore {
+			best, bestScore = bucket, score
+		}
+	}
+	return best, nil
+}
+
+// rendezvousScore combines the hashes of the key and the bucket with MurmurHash3's 64-bit finalizer, so that scores
+// of neighbouring buckets are uncorrelated.
+func rendezvousScore(keyHash uint64, bucket int) uint64 {
+	return fmix64(keyHash ^ fmix64(uint64(bucket)+1))
+}
+
+func fmix64(h uint64) uint64 {
+	h ^= h >> 33
+	h *= 0xff51afd7ed558ccd
+	h ^= h >> 33
+	h *= 0xc4ceb9fe1a85ec53
+	h ^= h >> 33
+	return h
+}
@@ -20,7 +20,7 @@ type cacheKey struct {
 // sorting it.
 func HashBucket(key any, buckets int, previousBuckets ...int) (int, error) {
 	if len(previousBuckets) >= buckets {
-		return -1, fmt.Errorf("No more buckets left: %d buckets available but %d already attempted", buckets, previousBuckets)
+		return -1, fmt.Errorf("No more buckets left: %d buckets available but %v already attempted", buckets, previousBuckets)
 	}
 	// we set IgnoreZeroValue so that we can add fields to the hash key
 	// later without breaking things.
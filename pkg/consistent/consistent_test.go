@@ -1,6 +1,7 @@
 package consistent_test
 
 import (
+	"fmt"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -70,3 +71,68 @@ func FuzzRetriesMostNotRepeatIndices(f *testing.F) {
 		}
 	})
 }
+
+func TestRendezvousOnlyMovesKeysOfChangedBuckets(t *testing.T) {
+	rendezvous := consistent.Rendezvous{}
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		before, err := rendezvous.Bucket(key, 10)
+		require.NoError(t, err)
+		// growing the ring only moves keys to the new bucket
+		after, err := rendezvous.Bucket(key, 11)
+		require.NoError(t, err)
+		if after != before {
+			assert.Equal(t, 10, after)
+			moved++
+		}
+		// a failed bucket only moves its own keys
+		retry, err := rendezvous.Bucket(key, 10, 3)
+		require.NoError(t, err)
+		assert.NotEqual(t, 3, retry)
+		if before != 3 {
+			assert.Equal(t, before, retry)
+		}
+	}
+	// about 1/11th of the keys move to the new bucket
+	assert.InDelta(t, 1000/11, moved, 40)
+}
+
+func TestParseAlgorithm(t *testing.T) {
+	algorithm, err := consistent.ParseAlgorithm("")
+	require.NoError(t, err)
+	assert.Equal(t, consistent.Jump{}, algorithm)
+	algorithm, err = consistent.ParseAlgorithm("rendezvous")
+	require.NoError(t, err)
+	assert.Equal(t, consistent.Rendezvous{}, algorithm)
+	_, err = consistent.ParseAlgorithm("ketama")
+	assert.Error(t, err)
+}
+
+func TestNoMoreBuckets(t *testing.T) {
+	for _, algorithm := range []consistent.Algorithm{consistent.Jump{}, consistent.Rendezvous{}} {
+		_, err := algorithm.Bucket("key", 2, 1, 0)
+		assert.EqualError(t, err, "No more buckets left: 2 buckets available but [1 0] already attempted")
+	}
+}
+
+func FuzzRendezvousRetriesDoNotRepeatIndices(f *testing.F) {
+	f.Add("test.replicate.delivery", 5)
+	f.Fuzz(func(t *testing.T, key string, excessBuckets int) {
+		if excessBuckets < 0 || excessBuckets > 1000 {
+			t.Skip("invalid value")
+		}
+		buckets := 20 + excessBuckets
+		previous := []int{}
+		for i := 0; i < 20; i++ {
+			next, err := consistent.Rendezvous{}.Bucket(key, buckets, previous...)
+			require.NoError(t, err)
+			assert.Less(t, next, buckets)
+			assert.GreaterOrEqual(t, next, 0)
+			assert.NotContains(t, previous, next)
+			previous = append(previous, next)
+		}
+		_, err := consistent.Rendezvous{}.Bucket(key, len(previous), previous...)
+		assert.Error(t, err)
+	})
+}
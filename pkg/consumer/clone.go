@@ -0,0 +1,65 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+)
+
+// ErrCloneUnsupported is returned by Clone when src can't be cloned to dest, e.g. because they are on different
+// filesystems or their filesystem doesn't support reflinks.
+var ErrCloneUnsupported = errors.New("cloning is not supported")
+
+// cloneSupport memoises CanClone by pair of directories.
+var cloneSupport sync.Map
+
+type dirPair struct{ src, dest string }
+
+// CanClone reports whether files in srcDir can be cloned into destDir: whether both are on a filesystem supporting
+// copy-on-write clones (reflinks), such as btrfs, XFS or APFS. The first call for a pair of directories probes them
+// by cloning a file; the result is reused by later calls.
+func CanClone(srcDir, destDir string) bool {
+	key := dirPair{srcDir, destDir}
+	if supported, ok := cloneSupport.Load(key); ok {
+		return supported.(bool)
+	}
+	supported := probeClone(srcDir, destDir)
+	cloneSupport.Store(key, supported)
+	return supported
+}
+
+func probeClone(srcDir, destDir string) bool {
+	probe, err := os.CreateTemp(srcDir, ".rpget-clone-probe-*")
+	if err != nil {
+		return false
+	}
+	defer os.Remove(probe.Name())
+	_, err = probe.Write([]byte("rpget"))
+	if closeErr := probe.Close(); err != nil || closeErr != nil {
+		return false
+	}
+	clone, err := os.CreateTemp(destDir, ".rpget-clone-probe-*")
+	if err != nil {
+		return false
+	}
+	clone.Close()
+	os.Remove(clone.Name())
+	if err := cloneFile(probe.Name(), clone.Name()); err != nil {
+		return false
+	}
+	os.Remove(clone.Name())
+	return true
+}
+
+// Clone creates dest, which must not exist, as a copy-on-write clone of src: a copy sharing the data of src until
+// either of them is modified, made without copying any bytes. It returns an error wrapping ErrCloneUnsupported if
+// the filesystem can't clone src to dest.
+func Clone(src, dest string) error {
+	return cloneFile(src, dest)
+}
+
+// cloneUnsupported wraps err, returned when cloning a file, with ErrCloneUnsupported.
+func cloneUnsupported(err error) error {
+	return fmt.Errorf("%w: %w", ErrCloneUnsupported, err)
+}
@@ -0,0 +1,18 @@
+//go:build darwin
+
+package consumer
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile creates dest as a clone of src with clonefile(2), supported by APFS.
+func cloneFile(src, dest string) error {
+	err := unix.Clonefile(src, dest, unix.CLONE_NOFOLLOW)
+	if errors.Is(err, unix.EXDEV) || errors.Is(err, unix.ENOTSUP) {
+		return cloneUnsupported(err)
+	}
+	return err
+}
@@ -0,0 +1,33 @@
+//go:build linux
+
+package consumer
+
+import (
+	"errors"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// cloneFile creates dest as a clone of src with the FICLONE ioctl, supported by btrfs and XFS among others.
+func cloneFile(src, dest string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dest, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return err
+	}
+	if err := unix.IoctlFileClone(int(out.Fd()), int(in.Fd())); err != nil {
+		out.Close()
+		os.Remove(dest)
+		// EXDEV: different filesystems; EOPNOTSUPP, EINVAL and ENOTTY: a filesystem without reflinks
+		if errors.Is(err, unix.EXDEV) || errors.Is(err, unix.EOPNOTSUPP) || errors.Is(err, unix.EINVAL) || errors.Is(err, unix.ENOTTY) {
+			return cloneUnsupported(err)
+		}
+		return err
+	}
+	return out.Close()
+}
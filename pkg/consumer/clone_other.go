@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package consumer
+
+import "errors"
+
+func cloneFile(src, dest string) error {
+	return cloneUnsupported(errors.ErrUnsupported)
+}
@@ -0,0 +1,47 @@
+package consumer_test
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/consumer"
+)
+
+func TestClone(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src")
+	require.NoError(t, os.WriteFile(src, []byte("hello"), 0644))
+	dest := filepath.Join(dir, "dest")
+
+	// the temporary directory may or may not support clones, but the probe must agree with Clone
+	supported := consumer.CanClone(dir, dir)
+	assert.Equal(t, supported, consumer.CanClone(dir, dir))
+	err := consumer.Clone(src, dest)
+	if !supported {
+		assert.ErrorIs(t, err, consumer.ErrCloneUnsupported)
+		_, statErr := os.Stat(dest)
+		assert.True(t, os.IsNotExist(statErr))
+		return
+	}
+	require.NoError(t, err)
+	data, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	// the clone doesn't share the inode of its source
+	require.NoError(t, os.WriteFile(dest, []byte("world"), 0644))
+	data, err = os.ReadFile(src)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+}
+
+func TestCloneMissingSource(t *testing.T) {
+	dir := t.TempDir()
+	err := consumer.Clone(filepath.Join(dir, "missing"), filepath.Join(dir, "dest"))
+	assert.Error(t, err)
+	assert.NotErrorIs(t, err, consumer.ErrCloneUnsupported)
+}
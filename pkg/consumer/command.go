@@ -0,0 +1,46 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+)
+
+// Command pipes the downloaded file into the standard input of a shell command, e.g. to load it into another
+// process without writing it to disk. The command is run with sh for every file, with the destination path in the
+// RPGET_DEST environment variable and the standard output and error of rpget. Like Pipe, it is written to straight
+// from the chunk buffers of the download.
+type Command struct {
+	Command string
+}
+
+var _ Consumer = &Command{}
+
+func (c *Command) Consume(reader io.Reader, destPath string, expectedBytes int64) error {
+	cmd := exec.Command("/bin/sh", "-c", c.Command)
+	cmd.Env = append(os.Environ(), "RPGET_DEST="+destPath)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("error starting `%s`: %w", c.Command, err)
+	}
+	n, copyErr := io.Copy(stdin, reader)
+	closeErr := stdin.Close()
+	if err := cmd.Wait(); err != nil {
+		// a command exiting early fails the copy too, its own failure explains why
+		return fmt.Errorf("error running `%s`: %w", c.Command, err)
+	}
+	if err := errors.Join(copyErr, closeErr); err != nil {
+		return fmt.Errorf("error writing to `%s`: %w", c.Command, err)
+	}
+	if n != expectedBytes {
+		return fmt.Errorf("expected %d bytes, wrote %d", expectedBytes, n)
+	}
+	return nil
+}
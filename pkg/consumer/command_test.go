@@ -0,0 +1,35 @@
+package consumer_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/consumer"
+)
+
+func TestCommand_Consume(t *testing.T) {
+	buf := generateTestContent(kB)
+	out := filepath.Join(t.TempDir(), "out")
+	c := &consumer.Command{Command: `cat > "$RPGET_DEST"`}
+	require.NoError(t, c.Consume(bytes.NewReader(buf), out, kB))
+	written, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, buf, written)
+
+	failing := &consumer.Command{Command: "exit 3"}
+	assert.ErrorContains(t, failing.Consume(bytes.NewReader(buf), out, kB), "exit status 3")
+	assert.Error(t, c.Consume(bytes.NewReader(buf), out, kB-100))
+}
+
+func TestWritesDestination(t *testing.T) {
+	assert.True(t, consumer.WritesDestination(&consumer.FileWriter{}))
+	assert.True(t, consumer.WritesDestination(&consumer.TarExtractor{}))
+	assert.False(t, consumer.WritesDestination(&consumer.NullWriter{}))
+	assert.False(t, consumer.WritesDestination(&consumer.Pipe{File: os.Stdout}))
+	assert.False(t, consumer.WritesDestination(&consumer.Command{Command: "cat"}))
+}
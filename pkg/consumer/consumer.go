@@ -5,3 +5,37 @@ import "io"
 type Consumer interface {
 	Consume(reader io.Reader, destPath string, expectedBytes int64) error
 }
+
+// DecompressingConsumer is a Consumer which may decompress what it consumes. ConsumeDecompressed consumes like
+// Consume, also returning the size of the payload once decompressed, or 0 if it wasn't compressed.
+type DecompressingConsumer interface {
+	Consumer
+	ConsumeDecompressed(reader io.Reader, destPath string, expectedBytes int64) (int64, error)
+}
+
+// WriterAtConsumer is a Consumer which can also be given a file by offset, its chunks arriving in any order.
+// ConsumeAt opens destPath for a file of expectedBytes bytes, to be written with the returned OffsetFile.
+type WriterAtConsumer interface {
+	Consumer
+	ConsumeAt(destPath string, expectedBytes int64) (OffsetFile, error)
+}
+
+// OffsetFile is a file being written by offset by a WriterAtConsumer. It can be read back, e.g. to verify it, until
+// Commit completes it once every byte is written. Abort gives it up instead.
+type OffsetFile interface {
+	io.WriterAt
+	io.ReaderAt
+	Commit() error
+	Abort()
+}
+
+// WritesDestination reports whether c writes the destination path it is given, which must then be unique and not
+// already exist, rather than discarding the file or writing it elsewhere (e.g. to stdout or to a command).
+func WritesDestination(c Consumer) bool {
+	switch c.(type) {
+	case *NullWriter, NullWriter, *Pipe, *TarStream, *Command:
+		return false
+	default:
+		return true
+	}
+}
@@ -0,0 +1,39 @@
+package consumer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/emaballarin/rpget/pkg/extract"
+)
+
+// Decompressor decompresses the downloaded file to the destination file, without extracting it even if it is an
+// archive: see extract.Decompress.
+type Decompressor struct {
+	Options extract.Options
+}
+
+var _ DecompressingConsumer = &Decompressor{}
+
+func (d *Decompressor) Consume(reader io.Reader, destPath string, expectedBytes int64) error {
+	_, err := d.ConsumeDecompressed(reader, destPath, expectedBytes)
+	return err
+}
+
+// ConsumeDecompressed decompresses the file like Consume. If Options.Progress is set, the decompressed size is read
+// from it, so it accumulates over the calls sharing it.
+func (d *Decompressor) ConsumeDecompressed(reader io.Reader, destPath string, expectedBytes int64) (int64, error) {
+	opts := d.Options
+	if opts.Progress == nil {
+		opts.Progress = new(extract.Progress)
+	}
+	btReader := &byteTrackingReader{r: reader}
+	if err := extract.Decompress(bufio.NewReader(btReader), destPath, opts); err != nil {
+		return 0, fmt.Errorf("error decompressing file: %w", err)
+	}
+	if btReader.bytesRead != expectedBytes {
+		return 0, fmt.Errorf("expected %d bytes, read %d from compressed file", expectedBytes, btReader.bytesRead)
+	}
+	return opts.Progress.Decompressed(), nil
+}
@@ -0,0 +1,100 @@
+package consumer
+
+import (
+	"errors"
+	"io"
+	"os"
+	"unsafe"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+const (
+	// directIOAlignment is the alignment of the buffers, offsets and lengths of direct writes: the largest logical
+	// block size of common devices, so that it suits the smaller ones too.
+	directIOAlignment = 4096
+	// directIOBufferSize is the size of the writes of a directWriter.
+	directIOBufferSize = 1 << 20
+)
+
+// errDirectIOUnsupported is returned by openDirect when the filesystem or platform can't write without the page
+// cache.
+var errDirectIOUnsupported = errors.New("direct I/O is not supported")
+
+// openFile opens name like os.OpenFile, bypassing the page cache if direct is set and the filesystem supports it.
+// It returns a writer to write the file with, and a function to call once it is written, before closing it.
+func openFile(name string, flag int, perm os.FileMode, direct bool) (*os.File, io.Writer, func() error, error) {
+	if direct {
+		f, err := openDirect(name, flag, perm)
+		if err == nil {
+			w := &directWriter{f: f, buf: alignedBuffer(directIOBufferSize)}
+			return f, w, w.finish, nil
+		}
+		if !errors.Is(err, errDirectIOUnsupported) {
+			return nil, nil, nil, err
+		}
+		logger := logging.GetLogger()
+		logger.Debug().Err(err).Str("path", name).Msg("Writing through the page cache")
+	}
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return f, f, func() error { return nil }, nil
+}
+
+// directWriter writes a file opened for direct I/O in aligned blocks of its buffer.
+type directWriter struct {
+	f       *os.File
+	buf     []byte
+	n       int
+	written int64
+}
+
+func (w *directWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		n := copy(w.buf[w.n:], p)
+		w.n += n
+		total += n
+		p = p[n:]
+		if w.n == len(w.buf) {
+			if err := w.flush(w.n); err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (w *directWriter) flush(length int) error {
+	n, err := w.f.Write(w.buf[:length])
+	w.written += int64(n)
+	w.n = 0
+	return err
+}
+
+// finish writes what is left in the buffer. Direct writes must be a whole number of blocks long, so the last one is
+// padded with zeroes, which are then truncated away.
+func (w *directWriter) finish() error {
+	if w.n == 0 {
+		return nil
+	}
+	size := w.written + int64(w.n)
+	padded := (w.n + directIOAlignment - 1) &^ (directIOAlignment - 1)
+	clear(w.buf[w.n:padded])
+	if err := w.flush(padded); err != nil {
+		return err
+	}
+	return w.f.Truncate(size)
+}
+
+// alignedBuffer returns a buffer of size bytes whose address is aligned for direct I/O.
+func alignedBuffer(size int) []byte {
+	buf := make([]byte, size+directIOAlignment)
+	offset := 0
+	if misalignment := int(uintptr(unsafe.Pointer(&buf[0])) & (directIOAlignment - 1)); misalignment != 0 {
+		offset = directIOAlignment - misalignment
+	}
+	return buf[offset : offset+size : offset+size]
+}
@@ -0,0 +1,23 @@
+//go:build darwin
+
+package consumer
+
+import (
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openDirect opens name with F_NOCACHE set, macOS' equivalent of O_DIRECT.
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(name, flag, perm)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := unix.FcntlInt(f.Fd(), unix.F_NOCACHE, 1); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("%w: %w", errDirectIOUnsupported, err)
+	}
+	return f, nil
+}
@@ -0,0 +1,20 @@
+//go:build linux
+
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// openDirect opens name with O_DIRECT, which filesystems such as tmpfs reject.
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(name, flag|unix.O_DIRECT, perm)
+	if errors.Is(err, unix.EINVAL) {
+		return nil, fmt.Errorf("%w: %w", errDirectIOUnsupported, err)
+	}
+	return f, err
+}
@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package consumer
+
+import "os"
+
+func openDirect(name string, flag int, perm os.FileMode) (*os.File, error) {
+	return nil, errDirectIOUnsupported
+}
@@ -0,0 +1,30 @@
+package consumer
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// Pipe writes the downloaded file, as is, to File, e.g. stdout piped into another command. The destination path is
+// ignored.
+//
+// Chunks buffered by the download are written to File straight from their buffers, rather than being copied through
+// a buffer of their own first. Pipe doesn't splice(2): the response bodies of net/http aren't raw sockets, so there is
+// no file descriptor to splice downloads from.
+type Pipe struct {
+	File *os.File
+}
+
+var _ Consumer = &Pipe{}
+
+func (p *Pipe) Consume(reader io.Reader, destPath string, expectedBytes int64) error {
+	n, err := io.Copy(p.File, reader)
+	if err != nil {
+		return fmt.Errorf("error writing to %s: %w", p.File.Name(), err)
+	}
+	if n != expectedBytes {
+		return fmt.Errorf("expected %d bytes, wrote %d", expectedBytes, n)
+	}
+	return nil
+}
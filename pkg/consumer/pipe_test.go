@@ -0,0 +1,53 @@
+package consumer_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/consumer"
+)
+
+func TestPipe_Consume(t *testing.T) {
+	content := generateTestContent(3 * 1024 * kB)
+	src := filepath.Join(t.TempDir(), "src")
+	require.NoError(t, os.WriteFile(src, content, 0644))
+
+	for name, open := range map[string]func(t *testing.T) io.Reader{
+		"reader": func(t *testing.T) io.Reader { return bytes.NewReader(content) },
+		"file": func(t *testing.T) io.Reader {
+			f, err := os.Open(src)
+			require.NoError(t, err)
+			t.Cleanup(func() { f.Close() })
+			return f
+		},
+	} {
+		t.Run(name, func(t *testing.T) {
+			r, w, err := os.Pipe()
+			require.NoError(t, err)
+			defer r.Close()
+			received := make(chan []byte)
+			go func() {
+				buf, _ := io.ReadAll(r)
+				received <- buf
+			}()
+			err = (&consumer.Pipe{File: w}).Consume(open(t), "ignored", int64(len(content)))
+			w.Close()
+			require.NoError(t, err)
+			assert.Equal(t, content, <-received)
+		})
+	}
+
+	r, w, err := os.Pipe()
+	require.NoError(t, err)
+	defer r.Close()
+	go io.Copy(io.Discard, r)
+	err = (&consumer.Pipe{File: w}).Consume(bytes.NewReader(content), "ignored", int64(len(content))+1)
+	w.Close()
+	assert.ErrorContains(t, err, "expected")
+}
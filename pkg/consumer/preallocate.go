@@ -0,0 +1,29 @@
+package consumer
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// preallocate reserves size bytes of disk space for f, so that the filesystem can lay it out contiguously and a
+// full disk fails the download before it starts rather than midway. Filesystems which can't preallocate are
+// written to as usual.
+func preallocate(f *os.File, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+	err := allocate(f, size)
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EFBIG) {
+		return fmt.Errorf("error preallocating %d bytes: %w", size, err)
+	}
+	logger := logging.GetLogger()
+	logger.Debug().Err(err).Str("path", f.Name()).Msg("Error preallocating file")
+	return nil
+}
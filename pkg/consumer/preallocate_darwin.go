@@ -0,0 +1,19 @@
+//go:build darwin
+
+package consumer
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// allocate allocates size bytes for f with F_PREALLOCATE, keeping its size, preferably contiguously.
+func allocate(f *os.File, size int64) error {
+	store := &unix.Fstore_t{Flags: unix.F_ALLOCATECONTIG | unix.F_ALLOCATEALL, Posmode: unix.F_PEOFPOSMODE, Length: size}
+	if err := unix.FcntlFstore(f.Fd(), unix.F_PREALLOCATE, store); err == nil {
+		return nil
+	}
+	store.Flags = unix.F_ALLOCATEALL
+	return unix.FcntlFstore(f.Fd(), unix.F_PREALLOCATE, store)
+}
@@ -0,0 +1,15 @@
+//go:build linux
+
+package consumer
+
+import (
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// allocate allocates the blocks of the first size bytes of f with fallocate(2), keeping its size: the file only
+// grows as it is written, so a partial file can still be told from a complete one.
+func allocate(f *os.File, size int64) error {
+	return unix.Fallocate(int(f.Fd()), unix.FALLOC_FL_KEEP_SIZE, 0, size)
+}
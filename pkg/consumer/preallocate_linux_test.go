@@ -0,0 +1,54 @@
+package consumer_test
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/consumer"
+)
+
+// statReader records the size and allocated space of path when it is first read, then ends.
+type statReader struct {
+	path      string
+	size      int64
+	allocated int64
+}
+
+func (r *statReader) Read([]byte) (int, error) {
+	info, err := os.Stat(r.path)
+	if err != nil {
+		return 0, err
+	}
+	r.size = info.Size()
+	r.allocated = info.Sys().(*syscall.Stat_t).Blocks * 512
+	return 0, io.EOF
+}
+
+func TestFileWriter_Preallocate(t *testing.T) {
+	size := 256 * kB
+	buf := generateTestContent(size)
+	for _, noPreallocate := range []bool{false, true} {
+		dest := filepath.Join(t.TempDir(), "file")
+		stat := &statReader{path: dest}
+		writeFileConsumer := consumer.FileWriter{NoPreallocate: noPreallocate}
+		require.NoError(t, writeFileConsumer.Consume(io.MultiReader(stat, bytes.NewReader(buf)), dest, size))
+
+		// the space of the file is allocated before it is written, without changing its size
+		assert.Zero(t, stat.size)
+		if noPreallocate {
+			assert.Zero(t, stat.allocated)
+		} else {
+			assert.GreaterOrEqual(t, stat.allocated, size)
+		}
+		fileContent, err := os.ReadFile(dest)
+		require.NoError(t, err)
+		assert.Equal(t, buf, fileContent)
+	}
+}
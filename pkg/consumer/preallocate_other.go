@@ -0,0 +1,11 @@
+//go:build !linux && !darwin
+
+package consumer
+
+import "os"
+
+// allocate extends f to size bytes. Without a way to allocate blocks, this only reserves the size of the file,
+// which some filesystems use to lay it out.
+func allocate(f *os.File, size int64) error {
+	return f.Truncate(size)
+}
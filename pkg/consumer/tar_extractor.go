@@ -8,11 +8,13 @@ import (
 	"github.com/emaballarin/rpget/pkg/extract"
 )
 
+// TarExtractor extracts the downloaded archive into the destination directory. Despite its name, the archive
+// format is detected from the payload: see extract.Archive.
 type TarExtractor struct {
-	Overwrite bool
+	Options extract.Options
 }
 
-var _ Consumer = &TarExtractor{}
+var _ DecompressingConsumer = &TarExtractor{}
 
 var _ io.Reader = &byteTrackingReader{}
 
@@ -28,13 +30,24 @@ func (b *byteTrackingReader) Read(p []byte) (n int, err error) {
 }
 
 func (f *TarExtractor) Consume(reader io.Reader, destPath string, expectedBytes int64) error {
+	_, err := f.ConsumeDecompressed(reader, destPath, expectedBytes)
+	return err
+}
+
+// ConsumeDecompressed extracts the archive like Consume. If Options.Progress is set, the decompressed size is read
+// from it, so it accumulates over the calls sharing it.
+func (f *TarExtractor) ConsumeDecompressed(reader io.Reader, destPath string, expectedBytes int64) (int64, error) {
+	opts := f.Options
+	if opts.Progress == nil {
+		opts.Progress = new(extract.Progress)
+	}
 	btReader := &byteTrackingReader{r: reader}
-	err := extract.TarFile(bufio.NewReader(btReader), destPath, f.Overwrite)
+	err := extract.Archive(bufio.NewReader(btReader), destPath, opts)
 	if err != nil {
-		return fmt.Errorf("error extracting file: %w", err)
+		return 0, fmt.Errorf("error extracting file: %w", err)
 	}
 	if btReader.bytesRead != expectedBytes {
-		return fmt.Errorf("expected %d bytes, read %d from archive", expectedBytes, btReader.bytesRead)
+		return 0, fmt.Errorf("expected %d bytes, read %d from archive", expectedBytes, btReader.bytesRead)
 	}
-	return nil
+	return opts.Progress.Decompressed(), nil
 }
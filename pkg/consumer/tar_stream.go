@@ -0,0 +1,30 @@
+package consumer
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/emaballarin/rpget/pkg/extract"
+)
+
+// TarStream writes the downloaded tar archive, decompressed, to Writer instead of extracting it, e.g. to pipe it
+// into existing untar tooling. The destination path is ignored.
+type TarStream struct {
+	Writer io.Writer
+	// Compression, if set, decompresses the payload with this format instead of detecting it
+	Compression extract.Compression
+}
+
+var _ Consumer = &TarStream{}
+
+func (f *TarStream) Consume(reader io.Reader, destPath string, expectedBytes int64) error {
+	btReader := &byteTrackingReader{r: reader}
+	if err := extract.TarStream(bufio.NewReader(btReader), f.Writer, f.Compression); err != nil {
+		return fmt.Errorf("error streaming archive: %w", err)
+	}
+	if btReader.bytesRead != expectedBytes {
+		return fmt.Errorf("expected %d bytes, read %d from archive", expectedBytes, btReader.bytesRead)
+	}
+	return nil
+}
@@ -5,36 +5,277 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+
+	"github.com/emaballarin/rpget/pkg/dirtree"
+	"github.com/emaballarin/rpget/pkg/fsutil"
+	"github.com/emaballarin/rpget/pkg/wal"
 )
 
 type FileWriter struct {
 	Overwrite bool
+	// TempDir, if set, is where the file is written while it is downloaded. It is moved to its destination once
+	// complete, so that a failed download leaves no partial file behind.
+	TempDir string
+	// DirectIO writes the file bypassing the page cache (O_DIRECT on Linux, F_NOCACHE on macOS), so that writing
+	// large files doesn't evict memory other processes are using. Filesystems without direct I/O are written to
+	// through the page cache, as are files written by offset (see ConsumeAt), whose chunks can't be aligned.
+	DirectIO bool
+	// NoPreallocate disables reserving the disk space of files of known size before writing them (see
+	// preallocate).
+	NoPreallocate bool
+	// Dirs, if set, creates the directories of destinations, once each, and opens destinations relative to them, so
+	// that writing many small files into the same directories doesn't resolve their whole path every time. Files
+	// written with DirectIO are opened by path.
+	Dirs *dirtree.Tree
+	// BreakHardlinks removes destinations which other hardlinks point to before writing them in place, as those
+	// linked from a content cache share their inode with the cached object (see fsutil.BreakHardlink). Other
+	// hardlinks are written through otherwise.
+	BreakHardlinks bool
 }
 
-var _ Consumer = &FileWriter{}
+var _ WriterAtConsumer = &FileWriter{}
+
+func (f *FileWriter) breakHardlink(path string) error {
+	if !f.BreakHardlinks {
+		return nil
+	}
+	return fsutil.BreakHardlink(path)
+}
 
 func (f *FileWriter) Consume(reader io.Reader, destPath string, expectedBytes int64) error {
-	openFlags := os.O_WRONLY | os.O_CREATE
-	targetDir := filepath.Dir(destPath)
-	if err := os.MkdirAll(targetDir, 0755); err != nil {
+	if err := f.mkdirAll(filepath.Dir(destPath)); err != nil {
 		return fmt.Errorf("error creating directory: %w", err)
 	}
+	if f.TempDir != "" {
+		return f.consumeToTemp(reader, destPath, expectedBytes)
+	}
+	if err := f.breakHardlink(destPath); err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	openFlags := os.O_WRONLY | os.O_CREATE
 	if f.Overwrite {
 		openFlags |= os.O_TRUNC
 	}
-	out, err := os.OpenFile(destPath, openFlags, 0644)
+	out, w, finish, err := f.openDest(destPath, openFlags)
 	if err != nil {
 		return fmt.Errorf("error writing file: %w", err)
 	}
 	defer out.Close()
+	defer wal.Begin(wal.Op{Kind: wal.KindWrite, Dest: destPath}).Done()
+	if err := f.preallocate(out, expectedBytes); err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	if err := writeExpected(w, finish, reader, expectedBytes); err != nil {
+		return err
+	}
+	// a destination written in place without Overwrite may have been longer, e.g. the previous version of a file
+	// downloaded again because its version marker changed
+	if !f.Overwrite {
+		if err := out.Truncate(expectedBytes); err != nil {
+			return fmt.Errorf("error writing file: %w", err)
+		}
+	}
+	return nil
+}
 
+// consumeToTemp writes the file to TempDir, then moves it to destPath.
+func (f *FileWriter) consumeToTemp(reader io.Reader, destPath string, expectedBytes int64) error {
+	partial, err := os.CreateTemp(f.TempDir, filepath.Base(destPath)+".partial-*")
+	if err != nil {
+		return fmt.Errorf("error creating partial file: %w", err)
+	}
+	defer os.Remove(partial.Name())
+	w := io.Writer(partial)
+	finish := func() error { return nil }
+	if f.DirectIO {
+		partial.Close()
+		partial, w, finish, err = openFile(partial.Name(), os.O_WRONLY|os.O_TRUNC, 0600, true)
+		if err != nil {
+			return fmt.Errorf("error creating partial file: %w", err)
+		}
+	}
+	if err := f.preallocate(partial, expectedBytes); err != nil {
+		partial.Close()
+		return fmt.Errorf("error creating partial file: %w", err)
+	}
+	if err := writeExpected(w, finish, reader, expectedBytes); err != nil {
+		partial.Close()
+		return err
+	}
+	if err := partial.Chmod(0644); err != nil {
+		partial.Close()
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	if err := partial.Close(); err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	if err := os.Rename(partial.Name(), destPath); err == nil {
+		return nil
+	}
+	// the temporary directory may be on another filesystem
+	defer wal.Begin(wal.Op{Kind: wal.KindWrite, Dest: destPath}).Done()
+	return f.copyFile(partial.Name(), destPath, expectedBytes)
+}
+
+// ConsumeAt opens destPath, or a partial file in TempDir which Commit moves to destPath, to be written by offset.
+func (f *FileWriter) ConsumeAt(destPath string, expectedBytes int64) (OffsetFile, error) {
+	if err := f.mkdirAll(filepath.Dir(destPath)); err != nil {
+		return nil, fmt.Errorf("error creating directory: %w", err)
+	}
+	o := &offsetFile{writer: f, dest: destPath, size: expectedBytes}
+	var err error
+	if f.TempDir != "" {
+		if o.File, err = os.CreateTemp(f.TempDir, filepath.Base(destPath)+".partial-*"); err != nil {
+			return nil, fmt.Errorf("error creating partial file: %w", err)
+		}
+		o.partial = true
+	} else {
+		if err := f.breakHardlink(destPath); err != nil {
+			return nil, fmt.Errorf("error writing file: %w", err)
+		}
+		openFlags := os.O_RDWR | os.O_CREATE
+		if f.Overwrite {
+			openFlags |= os.O_TRUNC
+		}
+		open := os.OpenFile
+		if f.Dirs != nil {
+			open = f.Dirs.OpenFile
+		}
+		if o.File, err = open(destPath, openFlags, 0644); err != nil {
+			return nil, fmt.Errorf("error writing file: %w", err)
+		}
+		o.entry = wal.Begin(wal.Op{Kind: wal.KindWrite, Dest: destPath})
+	}
+	if err := f.preallocate(o.File, expectedBytes); err != nil {
+		o.Abort()
+		return nil, fmt.Errorf("error writing file: %w", err)
+	}
+	return o, nil
+}
+
+// offsetFile is a file a FileWriter writes by offset: its destination, or a partial file in TempDir.
+type offsetFile struct {
+	*os.File
+	writer  *FileWriter
+	dest    string
+	size    int64
+	partial bool
+	// entry records the write of the destination in place
+	entry *wal.Entry
+}
+
+func (o *offsetFile) Commit() error {
+	defer o.done()
+	// a destination written in place without Overwrite may have been longer
+	if err := o.Truncate(o.size); err != nil {
+		o.Abort()
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	if o.partial {
+		if err := o.Chmod(0644); err != nil {
+			o.Abort()
+			return fmt.Errorf("error writing file: %w", err)
+		}
+	}
+	if err := o.Close(); err != nil {
+		o.Abort()
+		return fmt.Errorf("error writing file: %w", err)
+	}
+	if !o.partial {
+		return nil
+	}
+	defer os.Remove(o.Name())
+	if err := os.Rename(o.Name(), o.dest); err == nil {
+		return nil
+	}
+	// the temporary directory may be on another filesystem
+	defer wal.Begin(wal.Op{Kind: wal.KindWrite, Dest: o.dest}).Done()
+	return o.writer.copyFile(o.Name(), o.dest, o.size)
+}
+
+func (o *offsetFile) Abort() {
+	o.Close()
+	o.done()
+	if o.partial {
+		os.Remove(o.Name())
+	}
+}
+
+// done ends the write of the destination in place, once.
+func (o *offsetFile) done() {
+	o.entry.Done()
+	o.entry = nil
+}
+
+func (f *FileWriter) mkdirAll(dir string) error {
+	if f.Dirs != nil {
+		return f.Dirs.MkdirAll(dir, 0755)
+	}
+	return os.MkdirAll(dir, 0755)
+}
+
+// openDest opens the destination destPath, like openFile.
+func (f *FileWriter) openDest(destPath string, flag int) (*os.File, io.Writer, func() error, error) {
+	if f.Dirs == nil || f.DirectIO {
+		return openFile(destPath, flag, 0644, f.DirectIO)
+	}
+	out, err := f.Dirs.OpenFile(destPath, flag, 0644)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	return out, out, func() error { return nil }, nil
+}
+
+func (f *FileWriter) preallocate(out *os.File, size int64) error {
+	if f.NoPreallocate {
+		return nil
+	}
+	return preallocate(out, size)
+}
+
+// writeExpected copies reader to out, then calls finish, and checks expectedBytes were written.
+func writeExpected(out io.Writer, finish func() error, reader io.Reader, expectedBytes int64) error {
 	written, err := io.Copy(out, reader)
 	if err != nil {
 		return fmt.Errorf("error writing file: %w", err)
 	}
+	if err := finish(); err != nil {
+		return fmt.Errorf("error writing file: %w", err)
+	}
 
 	if written != expectedBytes {
 		return fmt.Errorf("expected %d bytes, wrote %d", expectedBytes, written)
 	}
 	return nil
 }
+
+func (f *FileWriter) copyFile(src, dest string, size int64) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return fmt.Errorf("error moving file: %w", err)
+	}
+	defer in.Close()
+	if err := f.breakHardlink(dest); err != nil {
+		return fmt.Errorf("error moving file: %w", err)
+	}
+	out, w, finish, err := openFile(dest, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644, f.DirectIO)
+	if err != nil {
+		return fmt.Errorf("error moving file: %w", err)
+	}
+	if err := f.preallocate(out, size); err != nil {
+		out.Close()
+		return fmt.Errorf("error moving file: %w", err)
+	}
+	if _, err := io.Copy(w, in); err != nil {
+		out.Close()
+		return fmt.Errorf("error moving file: %w", err)
+	}
+	if err := finish(); err != nil {
+		out.Close()
+		return fmt.Errorf("error moving file: %w", err)
+	}
+	if err := out.Close(); err != nil {
+		return fmt.Errorf("error moving file: %w", err)
+	}
+	return nil
+}
@@ -2,12 +2,15 @@ package consumer_test
 
 import (
 	"bytes"
+	"fmt"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 
 	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/dirtree"
 )
 
 func TestFileWriter_Consume(t *testing.T) {
@@ -49,3 +52,146 @@ func TestFileWriter_Consume(t *testing.T) {
 	fileContent, _ = os.ReadFile(tmpFile.Name())
 	r.Equal(buf, fileContent)
 }
+
+func TestFileWriter_ConsumeHardlinked(t *testing.T) {
+	r := require.New(t)
+
+	for _, breakHardlinks := range []bool{false, true} {
+		dir := t.TempDir()
+		object := filepath.Join(dir, "object")
+		dest := filepath.Join(dir, "dest")
+		r.NoError(os.WriteFile(object, []byte("cached content"), 0644))
+		r.NoError(os.Link(object, dest))
+
+		// writing a destination hardlinked to e.g. a content cache object leaves the object as is if hardlinks are
+		// broken, and writes through it otherwise
+		buf := generateTestContent(kB)
+		writeFileConsumer := consumer.FileWriter{Overwrite: true, BreakHardlinks: breakHardlinks}
+		r.NoError(writeFileConsumer.Consume(bytes.NewReader(buf), dest, kB))
+		fileContent, err := os.ReadFile(dest)
+		r.NoError(err)
+		r.Equal(buf, fileContent)
+		objectContent, err := os.ReadFile(object)
+		r.NoError(err)
+		if breakHardlinks {
+			r.Equal("cached content", string(objectContent))
+		} else {
+			r.Equal(buf, objectContent)
+		}
+	}
+}
+
+func TestFileWriter_ConsumeTempDir(t *testing.T) {
+	r := require.New(t)
+
+	buf := generateTestContent(kB)
+	tempDir := t.TempDir()
+	dest := filepath.Join(t.TempDir(), "sub", "file")
+	writeFileConsumer := consumer.FileWriter{TempDir: tempDir}
+
+	r.NoError(writeFileConsumer.Consume(bytes.NewReader(buf), dest, kB))
+	fileContent, err := os.ReadFile(dest)
+	r.NoError(err)
+	r.Equal(buf, fileContent)
+
+	// a failed download leaves neither a partial file nor a destination behind
+	failed := filepath.Join(filepath.Dir(dest), "failed")
+	r.Error(writeFileConsumer.Consume(bytes.NewReader(buf), failed, kB+100))
+	r.NoFileExists(failed)
+	entries, err := os.ReadDir(tempDir)
+	r.NoError(err)
+	r.Empty(entries)
+}
+
+func TestFileWriter_ConsumeDirs(t *testing.T) {
+	r := require.New(t)
+
+	buf := generateTestContent(kB)
+	root := t.TempDir()
+	writeFileConsumer := consumer.FileWriter{Dirs: dirtree.New()}
+	for i := range 10 {
+		dest := filepath.Join(root, "a", "b", fmt.Sprintf("c%d", i%3), fmt.Sprintf("file%d", i))
+		r.NoError(writeFileConsumer.Consume(bytes.NewReader(buf), dest, kB))
+		fileContent, err := os.ReadFile(dest)
+		r.NoError(err)
+		r.Equal(buf, fileContent)
+	}
+
+	// files written by offset are opened the same way
+	dest := filepath.Join(root, "a", "b", "c0", "offset")
+	f, err := writeFileConsumer.ConsumeAt(dest, kB)
+	r.NoError(err)
+	_, err = f.WriteAt(buf, 0)
+	r.NoError(err)
+	r.NoError(f.Commit())
+	fileContent, err := os.ReadFile(dest)
+	r.NoError(err)
+	r.Equal(buf, fileContent)
+}
+
+func TestFileWriter_ConsumeDirectIO(t *testing.T) {
+	// sizes around the 4KiB alignment and the 1MiB buffer of direct writes
+	for _, size := range []int64{0, 100, 4 * kB, 4*kB + 1, kB * kB, 3*kB*kB + 12345} {
+		buf := generateTestContent(size)
+		for _, tempDir := range []string{"", t.TempDir()} {
+			dest := filepath.Join(t.TempDir(), "file")
+			writeFileConsumer := consumer.FileWriter{DirectIO: true, TempDir: tempDir}
+			require.NoError(t, writeFileConsumer.Consume(bytes.NewReader(buf), dest, size))
+			fileContent, err := os.ReadFile(dest)
+			require.NoError(t, err)
+			require.Equal(t, buf, fileContent, "size %d", size)
+		}
+	}
+
+	// overwriting a longer file leaves only the new content
+	dest := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(dest, generateTestContent(10*kB), 0644))
+	buf := generateTestContent(kB)
+	writeFileConsumer := consumer.FileWriter{DirectIO: true, Overwrite: true}
+	require.NoError(t, writeFileConsumer.Consume(bytes.NewReader(buf), dest, kB))
+	fileContent, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	require.Equal(t, buf, fileContent)
+}
+
+func TestFileWriter_ConsumeAt(t *testing.T) {
+	buf := generateTestContent(3 * kB)
+	for _, tempDir := range []string{"", t.TempDir()} {
+		dest := filepath.Join(t.TempDir(), "sub", "file")
+		require.NoError(t, os.MkdirAll(filepath.Dir(dest), 0755))
+		// a longer file written in place without Overwrite is truncated to the new content
+		require.NoError(t, os.WriteFile(dest, generateTestContent(10*kB), 0644))
+		writeFileConsumer := consumer.FileWriter{TempDir: tempDir}
+
+		f, err := writeFileConsumer.ConsumeAt(dest, 3*kB)
+		require.NoError(t, err)
+		// chunks arrive in any order
+		for _, start := range []int64{2 * kB, 0, kB} {
+			_, err := f.WriteAt(buf[start:start+kB], start)
+			require.NoError(t, err)
+		}
+		readBack := make([]byte, 3*kB)
+		_, err = f.ReadAt(readBack, 0)
+		require.NoError(t, err)
+		require.Equal(t, buf, readBack)
+		require.NoError(t, f.Commit())
+
+		fileContent, err := os.ReadFile(dest)
+		require.NoError(t, err)
+		require.Equal(t, buf, fileContent)
+	}
+
+	// an aborted file in TempDir leaves neither a partial file nor a destination behind
+	tempDir := t.TempDir()
+	dest := filepath.Join(t.TempDir(), "file")
+	writeFileConsumer := consumer.FileWriter{TempDir: tempDir}
+	f, err := writeFileConsumer.ConsumeAt(dest, kB)
+	require.NoError(t, err)
+	_, err = f.WriteAt(buf[:100], 0)
+	require.NoError(t, err)
+	f.Abort()
+	require.NoFileExists(t, dest)
+	entries, err := os.ReadDir(tempDir)
+	require.NoError(t, err)
+	require.Empty(t, entries)
+}
@@ -0,0 +1,138 @@
+package rpget
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/emaballarin/rpget/pkg/cas"
+	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/download"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// contentCacheFor returns the content cache of the entries consumed by c: Options.ContentCache if c writes files as
+// they are downloaded, otherwise nil.
+func (g *Getter) contentCacheFor(c consumer.Consumer) *cas.Store {
+	if _, isFile := c.(*consumer.FileWriter); !isFile {
+		return nil
+	}
+	return g.Options.ContentCache
+}
+
+// linkCached links the destination of entry to its content if it is in the content cache, reporting whether it
+// was. The entry is then finished (and recorded in the Report) as if it had been downloaded. Content which can't
+// be linked, or whose object was modified since it was added, is downloaded instead.
+func (g *Getter) linkCached(ctx context.Context, entry ManifestEntry, c consumer.Consumer, v *verifier) (int64, time.Duration, bool, error) {
+	logger := logging.GetLogger()
+	startTime := time.Now()
+	digest := g.cachedDigest(ctx, entry)
+	if digest == "" {
+		return 0, 0, false, nil
+	}
+	cache := g.Options.ContentCache
+	if size, err := cache.Size(digest); err != nil || (v != nil && v.size >= 0 && v.size != size) {
+		return 0, 0, false, nil
+	}
+	if err := cache.VerifyChanged(digest); err != nil {
+		logger.Warn().Err(err).Str("url", entry.URL).Str("dest", entry.Dest).Msg("Content cache")
+		return 0, 0, false, nil
+	}
+	link := cache.Link
+	if hasOwnMode(entry) {
+		link = cache.Copy
+	}
+	fileSize, err := link(digest, entry.Dest)
+	if err != nil {
+		logger.Warn().Err(err).Str("url", entry.URL).Str("dest", entry.Dest).Msg("Content cache")
+		return 0, 0, false, nil
+	}
+	logger.Info().Str("url", entry.URL).Str("dest", entry.Dest).Str("digest", digest).Msg("Linked from content cache")
+	err = g.finishEntry(entry, c, nil)
+	if err == nil {
+		err = g.runPostActions(ctx, entry)
+	}
+	elapsed := time.Since(startTime)
+	if g.Report != nil {
+		result := FileResult{
+			URL:             entry.URL,
+			Dest:            entry.Dest,
+			Size:            fileSize,
+			DurationSeconds: elapsed.Seconds(),
+			Cached:          true,
+		}
+		if err != nil {
+			result.Error = err.Error()
+		} else {
+			result.Checksum = digest
+		}
+		g.Report.add(result)
+	}
+	return fileSize, elapsed, true, err
+}
+
+// cachedDigest returns the digest of the content of entry if it is known without downloading it: its sha256
+// checksum, or the digest its URL was last downloaded as, provided the URL still serves the same ETag and size.
+// It returns "" otherwise. A digest found from the URL fills the Metadata of ctx, if any, as downloading it would.
+func (g *Getter) cachedDigest(ctx context.Context, entry ManifestEntry) string {
+	if strings.HasPrefix(entry.Checksum, checksumSHA256Prefix) {
+		return strings.ToLower(entry.Checksum)
+	}
+	record, err := g.Options.ContentCache.Lookup(entry.URL)
+	if err != nil {
+		if !errors.Is(err, cas.ErrNotFound) {
+			logger := logging.GetLogger()
+			logger.Warn().Err(err).Str("url", entry.URL).Msg("Content cache")
+		}
+		return ""
+	}
+	if record.ETag == "" {
+		return ""
+	}
+	info, err := download.Stat(ctx, g.Downloader, entry.URL)
+	if err != nil || info.ETag != record.ETag || info.Size != record.Size {
+		return ""
+	}
+	if md := download.MetadataFrom(ctx); md != nil {
+		md.ETag = info.ETag
+		md.LastModified = info.LastModified
+	}
+	return record.Digest
+}
+
+// addToCache adds the destination of entry, downloaded with digest, to the content cache. The cache is an
+// optimisation, so failing to add to it doesn't fail the download.
+func (g *Getter) addToCache(ctx context.Context, cache *cas.Store, entry ManifestEntry, digest string, size int64) {
+	logger := logging.GetLogger()
+	add := cache.Add
+	if hasOwnMode(entry) {
+		add = cache.AddCopy
+	}
+	if err := add(digest, entry.Dest); err != nil {
+		logger.Warn().Err(err).Str("url", entry.URL).Msg("Content cache")
+		return
+	}
+	record := cas.Record{URL: entry.URL, Digest: digest, Size: size}
+	if md := download.MetadataFrom(ctx); md != nil {
+		record.ETag = md.ETag
+	}
+	if err := cache.Record(record); err != nil {
+		logger.Warn().Err(err).Str("url", entry.URL).Msg("Content cache")
+	}
+}
+
+// hasOwnMode reports whether the destination of entry is given a mode of its own once written, by its Mode or a
+// ChmodAction: it mustn't be hardlinked to the content cache then, which would change the mode of the object and of
+// the other destinations linked to it.
+func hasOwnMode(entry ManifestEntry) bool {
+	if entry.Mode != 0 {
+		return true
+	}
+	for _, action := range entry.Post {
+		if _, ok := action.(*ChmodAction); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,101 @@
+package rpget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrDependencyFailed is returned for a manifest entry which was not downloaded because an entry it depends on
+// failed.
+var ErrDependencyFailed = errors.New("dependency failed")
+
+// entryState tracks the outcome of a manifest entry other entries depend on.
+type entryState struct {
+	done chan struct{}
+	err  error
+}
+
+// orderByDependencies returns entries ordered so that every entry comes after the entries named in its After
+// field, otherwise keeping the manifest order. It also returns the state of every entry depended on, keyed by
+// destination. Unknown destinations and dependency cycles are errors.
+func orderByDependencies(entries []ManifestEntry) ([]ManifestEntry, map[string]*entryState, error) {
+	index := make(map[string]int, len(entries))
+	for i, entry := range entries {
+		index[entry.Dest] = i
+	}
+	states := make(map[string]*entryState)
+	dependents := make([][]int, len(entries))
+	pending := make([]int, len(entries))
+	for i, entry := range entries {
+		for _, after := range entry.After {
+			j, ok := index[after]
+			if !ok {
+				return nil, nil, fmt.Errorf("%s depends on %s, which is not in the manifest", entry.Dest, after)
+			}
+			if _, ok := states[after]; !ok {
+				states[after] = &entryState{done: make(chan struct{})}
+			}
+			dependents[j] = append(dependents[j], i)
+			pending[i]++
+		}
+	}
+	if len(states) == 0 {
+		return entries, nil, nil
+	}
+
+	ordered := make([]ManifestEntry, 0, len(entries))
+	ready := make([]int, 0, len(entries))
+	for i := range entries {
+		if pending[i] == 0 {
+			ready = append(ready, i)
+		}
+	}
+	for len(ready) > 0 {
+		i := ready[0]
+		ready = ready[1:]
+		ordered = append(ordered, entries[i])
+		for _, dependent := range dependents[i] {
+			pending[dependent]--
+			if pending[dependent] == 0 {
+				ready = append(ready, dependent)
+			}
+		}
+	}
+	if len(ordered) != len(entries) {
+		cyclic := make([]string, 0)
+		for i, entry := range entries {
+			if pending[i] > 0 {
+				cyclic = append(cyclic, entry.Dest)
+			}
+		}
+		return nil, nil, fmt.Errorf("dependency cycle between %s", strings.Join(cyclic, ", "))
+	}
+	return ordered, states, nil
+}
+
+// waitForDependencies blocks until every entry named in entry.After has finished. It returns an error wrapping
+// ErrDependencyFailed if one of them failed, or the context's error if ctx is done first.
+func (r *multifileRun) waitForDependencies(ctx context.Context, entry ManifestEntry) error {
+	for _, after := range entry.After {
+		state := r.states[after]
+		select {
+		case <-state.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		if state.err != nil {
+			return fmt.Errorf("%w: %s depends on %s: %w", ErrDependencyFailed, entry.Dest, after, state.err)
+		}
+	}
+	return nil
+}
+
+// finish records the outcome of entry, releasing the entries depending on it.
+func (r *multifileRun) finish(entry ManifestEntry, err error) {
+	if state, ok := r.states[entry.Dest]; ok {
+		state.err = err
+		close(state.done)
+	}
+}
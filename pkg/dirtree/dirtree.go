@@ -0,0 +1,209 @@
+// Package dirtree writes many files into a directory tree quickly: every directory is created, or found to exist,
+// once, and files are opened relative to their parent directory, held open, so that writing tens of thousands of
+// small files into a deep tree doesn't resolve the whole path of every file again.
+package dirtree
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// maxOpenDirs is the number of directories a Tree holds open. Archives and manifests usually list the files of a
+// directory together, so only the most recent directories are worth keeping.
+const maxOpenDirs = 32
+
+// A Tree creates directories and opens files, remembering the directories known to exist. It must not be used
+// for paths which other processes, or other code of this process, remove or replace with something other than a
+// directory, unless they are forgotten first (see Forget). It is safe for concurrent use.
+type Tree struct {
+	mu sync.Mutex
+	// dirs are the directories known to exist
+	dirs map[string]bool
+	// open are the directories held open, least recently used first
+	open []*os.File
+}
+
+// New returns an empty Tree.
+func New() *Tree {
+	return &Tree{dirs: make(map[string]bool)}
+}
+
+// MkdirAll creates the directory dir and any missing parent, like os.MkdirAll. Directories are created relative to
+// their parent, and only the first call for a directory touches the filesystem.
+func (t *Tree) MkdirAll(dir string, perm os.FileMode) error {
+	dir = filepath.Clean(dir)
+	if t.known(dir) {
+		return nil
+	}
+	parent := filepath.Dir(dir)
+	if parent == dir {
+		// the root, or the current directory
+		if err := os.MkdirAll(dir, perm); err != nil {
+			return err
+		}
+		t.remember(dir)
+		return nil
+	}
+	if err := t.MkdirAll(parent, perm); err != nil {
+		return err
+	}
+	err := t.at(parent, func(d *os.File) error { return mkdirat(d, filepath.Base(dir), perm) })
+	if errors.Is(err, fs.ErrNotExist) && t.known(parent) {
+		// the parent was removed since it was found
+		t.Forget(parent)
+		return t.MkdirAll(dir, perm)
+	}
+	if errors.Is(err, fs.ErrExist) {
+		// a directory, or a symlink to one, like os.MkdirAll accepts
+		info, statErr := os.Stat(dir)
+		if statErr != nil {
+			return statErr
+		}
+		if !info.IsDir() {
+			return &os.PathError{Op: "mkdir", Path: dir, Err: syscall.ENOTDIR}
+		}
+	} else if err != nil {
+		return &os.PathError{Op: "mkdir", Path: dir, Err: err}
+	}
+	t.remember(dir)
+	return nil
+}
+
+// OpenFile opens the file name like os.OpenFile, relative to its parent directory. If flag has os.O_CREATE and the
+// parent directory was removed since MkdirAll found it, it is created again.
+func (t *Tree) OpenFile(name string, flag int, perm os.FileMode) (*os.File, error) {
+	name = filepath.Clean(name)
+	dir, base := filepath.Dir(name), filepath.Base(name)
+	var f *os.File
+	open := func(d *os.File) error {
+		var err error
+		f, err = openat(d, base, flag, perm)
+		return err
+	}
+	err := t.at(dir, open)
+	if errors.Is(err, fs.ErrNotExist) && flag&os.O_CREATE != 0 && t.known(dir) {
+		t.Forget(dir)
+		if mkdirErr := t.MkdirAll(dir, 0755); mkdirErr != nil {
+			return nil, mkdirErr
+		}
+		err = t.at(dir, open)
+	}
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: name, Err: err}
+	}
+	return f, nil
+}
+
+// Forget forgets path, and every directory beneath it, e.g. once it has been removed.
+func (t *Tree) Forget(path string) {
+	path = filepath.Clean(path)
+	prefix := path + string(filepath.Separator)
+	beneath := func(dir string) bool {
+		return dir == path || strings.HasPrefix(dir, prefix)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for dir := range t.dirs {
+		if beneath(dir) {
+			delete(t.dirs, dir)
+		}
+	}
+	open := t.open[:0]
+	for _, d := range t.open {
+		if beneath(d.Name()) {
+			d.Close()
+			continue
+		}
+		open = append(open, d)
+	}
+	clear(t.open[len(open):])
+	t.open = open
+}
+
+// Close closes the directories held open. The Tree may still be used afterwards.
+func (t *Tree) Close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var errs []error
+	for _, d := range t.open {
+		errs = append(errs, d.Close())
+	}
+	t.open = nil
+	return errors.Join(errs...)
+}
+
+func (t *Tree) known(dir string) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.dirs[dir]
+}
+
+func (t *Tree) remember(dir string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.dirs[dir] = true
+}
+
+// at calls fn with the directory dir, opened once and held open while it is among the most recently used. A
+// directory closed by another goroutine while fn runs is opened again.
+func (t *Tree) at(dir string, fn func(d *os.File) error) error {
+	for {
+		d, err := t.dir(dir)
+		if err != nil {
+			return err
+		}
+		if err := fn(d); !errors.Is(err, os.ErrClosed) {
+			return err
+		}
+	}
+}
+
+// dir returns the directory dir, opening it if it isn't held open.
+func (t *Tree) dir(dir string) (*os.File, error) {
+	t.mu.Lock()
+	for i, d := range t.open {
+		if d.Name() == dir {
+			copy(t.open[i:], t.open[i+1:])
+			t.open[len(t.open)-1] = d
+			t.mu.Unlock()
+			return d, nil
+		}
+	}
+	t.mu.Unlock()
+
+	d, err := os.Open(dir)
+	if err != nil {
+		return nil, unwrapPath(err)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, opened := range t.open {
+		if opened.Name() == dir {
+			// opened by another goroutine meanwhile
+			d.Close()
+			return opened, nil
+		}
+	}
+	if len(t.open) == maxOpenDirs {
+		// files being opened in it by other goroutines keep it open until they are done (see File.SyscallConn)
+		t.open[0].Close()
+		t.open = append(t.open[:0], t.open[1:]...)
+	}
+	t.open = append(t.open, d)
+	return d, nil
+}
+
+// unwrapPath returns the error of err if it is an *os.PathError, so that errors are reported with the path of the
+// file opened rather than of its directory.
+func unwrapPath(err error) error {
+	var pathErr *os.PathError
+	if errors.As(err, &pathErr) {
+		return pathErr.Err
+	}
+	return err
+}
@@ -0,0 +1,19 @@
+//go:build !unix
+
+package dirtree
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// mkdirat creates the directory name in the directory d; without openat, by its path.
+func mkdirat(d *os.File, name string, perm os.FileMode) error {
+	return unwrapPath(os.Mkdir(filepath.Join(d.Name(), name), perm))
+}
+
+// openat opens the file name in the directory d, like os.OpenFile; without openat, by its path.
+func openat(d *os.File, name string, flag int, perm os.FileMode) (*os.File, error) {
+	f, err := os.OpenFile(filepath.Join(d.Name(), name), flag, perm)
+	return f, unwrapPath(err)
+}
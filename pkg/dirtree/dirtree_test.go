@@ -0,0 +1,109 @@
+package dirtree_test
+
+import (
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/dirtree"
+)
+
+func writeFile(t *testing.T, tree *dirtree.Tree, name, content string) {
+	t.Helper()
+	require.NoError(t, tree.MkdirAll(filepath.Dir(name), 0755))
+	f, err := tree.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0640)
+	require.NoError(t, err)
+	assert.Equal(t, name, f.Name())
+	_, err = f.WriteString(content)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+func TestTree(t *testing.T) {
+	dir := t.TempDir()
+	tree := dirtree.New()
+	defer tree.Close()
+
+	// more directories than are held open
+	for i := range 100 {
+		name := filepath.Join(dir, "a", "b", fmt.Sprintf("c%d", i%40), "d", fmt.Sprintf("file%d", i))
+		writeFile(t, tree, name, name)
+	}
+	for i := range 100 {
+		name := filepath.Join(dir, "a", "b", fmt.Sprintf("c%d", i%40), "d", fmt.Sprintf("file%d", i))
+		content, err := os.ReadFile(name)
+		require.NoError(t, err)
+		assert.Equal(t, name, string(content))
+		info, err := os.Stat(name)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	}
+
+	// existing directories, and symlinks to them, are accepted
+	require.NoError(t, os.Symlink(filepath.Join(dir, "a"), filepath.Join(dir, "link")))
+	writeFile(t, dirtree.New(), filepath.Join(dir, "link", "b", "c0", "d", "other"), "other")
+	assert.FileExists(t, filepath.Join(dir, "a", "b", "c0", "d", "other"))
+
+	// files aren't
+	err := tree.MkdirAll(filepath.Join(dir, "a", "b", "c0", "d", "file0", "e"), 0755)
+	assert.ErrorIs(t, err, syscall.ENOTDIR)
+}
+
+func TestTreeRemovedDirectory(t *testing.T) {
+	dir := t.TempDir()
+	tree := dirtree.New()
+	defer tree.Close()
+
+	name := filepath.Join(dir, "a", "b", "file")
+	writeFile(t, tree, name, "first")
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "a")))
+
+	// files created in a directory removed meanwhile create it again
+	writeFile(t, tree, name, "second")
+	content, err := os.ReadFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "second", string(content))
+
+	// files which aren't created don't
+	require.NoError(t, os.RemoveAll(filepath.Join(dir, "a")))
+	_, err = tree.OpenFile(name, os.O_RDONLY, 0)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	var pathErr *os.PathError
+	require.ErrorAs(t, err, &pathErr)
+	assert.Equal(t, name, pathErr.Path)
+	assert.NoDirExists(t, filepath.Join(dir, "a"))
+
+	// forgotten directories are created again
+	tree.Forget(filepath.Join(dir, "a"))
+	require.NoError(t, tree.MkdirAll(filepath.Join(dir, "a", "b"), 0755))
+	assert.DirExists(t, filepath.Join(dir, "a", "b"))
+}
+
+func TestTreeConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	tree := dirtree.New()
+	defer tree.Close()
+
+	var wg sync.WaitGroup
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 50 {
+				name := filepath.Join(dir, fmt.Sprintf("d%d", j), fmt.Sprintf("file%d", i))
+				writeFile(t, tree, name, name)
+			}
+		}()
+	}
+	wg.Wait()
+	entries, err := os.ReadDir(filepath.Join(dir, "d49"))
+	require.NoError(t, err)
+	assert.Len(t, entries, 16)
+}
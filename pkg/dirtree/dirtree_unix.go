@@ -0,0 +1,74 @@
+//go:build unix
+
+package dirtree
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+
+	"golang.org/x/sys/unix"
+)
+
+// mkdirat creates the directory name in the directory d.
+func mkdirat(d *os.File, name string, perm os.FileMode) error {
+	return control(d, func(fd int) error {
+		return ignoringEINTR(func() error {
+			return unix.Mkdirat(fd, name, syscallMode(perm))
+		})
+	})
+}
+
+// openat opens the file name in the directory d, like os.OpenFile.
+func openat(d *os.File, name string, flag int, perm os.FileMode) (*os.File, error) {
+	var f *os.File
+	err := control(d, func(fd int) error {
+		return ignoringEINTR(func() error {
+			nfd, err := unix.Openat(fd, name, flag|unix.O_CLOEXEC, syscallMode(perm))
+			if err != nil {
+				return err
+			}
+			f = os.NewFile(uintptr(nfd), filepath.Join(d.Name(), name))
+			return nil
+		})
+	})
+	return f, err
+}
+
+// control calls fn with the file descriptor of d, which stays open until fn returns even if d is closed meanwhile.
+// It returns os.ErrClosed if d is already closed.
+func control(d *os.File, fn func(fd int) error) error {
+	conn, err := d.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var fnErr error
+	if err := conn.Control(func(fd uintptr) { fnErr = fn(int(fd)) }); err != nil {
+		// the only error is d being closed
+		return os.ErrClosed
+	}
+	return fnErr
+}
+
+func ignoringEINTR(fn func() error) error {
+	for {
+		if err := fn(); !errors.Is(err, unix.EINTR) {
+			return err
+		}
+	}
+}
+
+// syscallMode returns the mode bits of perm as the system expects them, as os.OpenFile does.
+func syscallMode(perm os.FileMode) uint32 {
+	mode := uint32(perm.Perm())
+	if perm&os.ModeSetuid != 0 {
+		mode |= unix.S_ISUID
+	}
+	if perm&os.ModeSetgid != 0 {
+		mode |= unix.S_ISGID
+	}
+	if perm&os.ModeSticky != 0 {
+		mode |= unix.S_ISVTX
+	}
+	return mode
+}
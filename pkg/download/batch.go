@@ -0,0 +1,152 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// BatchEndpointHeader is returned by origins supporting batch requests in response to an OPTIONS request. Its
+// value is the URL (absolute, or relative to the origin) of the batch endpoint, which must be on the same origin.
+const BatchEndpointHeader = "X-Batch-Endpoint"
+
+// BatchRequest is the body POSTed to a batch endpoint. Paths include the query of their URL, if any. The response is
+// a tar stream containing one regular file per requested path; the entry name is the path without its leading
+// slash. Paths the origin cannot serve are omitted from the stream.
+type BatchRequest struct {
+	Paths []string `json:"paths"`
+}
+
+// BatchMode fetches many small files from an origin with a single request, receiving them as one tar stream.
+// This removes the per-file request overhead for datasets of many small files, when the origin supports it.
+type BatchMode struct {
+	Client client.HTTPClient
+
+	mu        sync.Mutex
+	endpoints map[string]string
+}
+
+func GetBatchMode(opts Options) *BatchMode {
+	return &BatchMode{
+		Client:    client.NewHTTPClient(opts.Client),
+		endpoints: make(map[string]string),
+	}
+}
+
+// BatchPath returns the tar entry name under which the file at rawURL is delivered in a batch response.
+func BatchPath(rawURL string) (string, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimPrefix(batchRequestPath(parsed), "/"), nil
+}
+
+// batchRequestPath returns the path requested from a batch endpoint for the file at u: its path, followed by its
+// query if it has one, so that URLs differing only by their query are told apart.
+func batchRequestPath(u *url.URL) string {
+	if u.RawQuery == "" {
+		return u.Path
+	}
+	return u.Path + "?" + u.RawQuery
+}
+
+// Negotiate asks the origin of rawURL whether it supports batch requests and returns the batch endpoint. The
+// answer is cached per origin, so only the first call for each origin makes a request (or the first calls, if
+// they are concurrent). Endpoints on another origin are ignored, as batch requests carry the headers and
+// credentials of the origin.
+func (m *BatchMode) Negotiate(ctx context.Context, rawURL string) (string, bool) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return "", false
+	}
+	origin := parsed.Scheme + "://" + parsed.Host
+
+	m.mu.Lock()
+	endpoint, ok := m.endpoints[origin]
+	m.mu.Unlock()
+	if ok {
+		return endpoint, endpoint != ""
+	}
+
+	endpoint = m.negotiate(ctx, parsed, origin)
+	m.mu.Lock()
+	m.endpoints[origin] = endpoint
+	m.mu.Unlock()
+	return endpoint, endpoint != ""
+}
+
+// negotiate makes the OPTIONS request of Negotiate to origin, the origin of parsed, and returns the batch endpoint,
+// or "" if there is none.
+func (m *BatchMode) negotiate(ctx context.Context, parsed *url.URL, origin string) string {
+	logger := logging.GetLogger()
+	endpoint := ""
+	req, err := http.NewRequestWithContext(ctx, http.MethodOptions, origin+"/", nil)
+	if err == nil {
+		var resp *http.Response
+		resp, err = m.Client.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if value := resp.Header.Get(BatchEndpointHeader); value != "" {
+				if ref, parseErr := url.Parse(value); parseErr == nil {
+					resolved := parsed.ResolveReference(ref)
+					if resolved.Scheme+"://"+resolved.Host == origin {
+						endpoint = resolved.String()
+					} else {
+						logger.Warn().
+							Str("origin", origin).
+							Str("batch_endpoint", resolved.String()).
+							Msg("Ignoring batch endpoint on another origin")
+					}
+				}
+			}
+		}
+	}
+	logger.Debug().
+		Err(err).
+		Str("origin", origin).
+		Str("batch_endpoint", endpoint).
+		Bool("enabled", endpoint != "").
+		Msg("Batch Negotiation")
+	return endpoint
+}
+
+// FetchBatch requests the files at urls from endpoint. The caller must close the returned tar stream.
+func (m *BatchMode) FetchBatch(ctx context.Context, endpoint string, urls []string) (io.ReadCloser, error) {
+	batch := BatchRequest{Paths: make([]string, 0, len(urls))}
+	for _, u := range urls {
+		parsed, err := url.Parse(u)
+		if err != nil {
+			return nil, err
+		}
+		batch.Paths = append(batch.Paths, batchRequestPath(parsed))
+	}
+	body, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create batch request for %s: %w", endpoint, err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/x-tar")
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error executing batch request for %s: %w", endpoint, err)
+	}
+	if err := checkResponseStatus(req, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp.Body, nil
+}
@@ -0,0 +1,47 @@
+package download_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/download"
+)
+
+func TestBatchNegotiate(t *testing.T) {
+	originWithEndpoint := func(endpoint string) *httptest.Server {
+		return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(download.BatchEndpointHeader, endpoint)
+		}))
+	}
+	other := httptest.NewServer(http.NotFoundHandler())
+	defer other.Close()
+	same := originWithEndpoint("/_batch")
+	defer same.Close()
+	// batch requests carry the headers of the origin, so they aren't sent elsewhere
+	elsewhere := originWithEndpoint(other.URL + "/_batch")
+	defer elsewhere.Close()
+
+	batcher := download.GetBatchMode(defaultOpts)
+	endpoint, ok := batcher.Negotiate(context.Background(), same.URL+"/a.txt")
+	assert.True(t, ok)
+	assert.Equal(t, same.URL+"/_batch", endpoint)
+	_, ok = batcher.Negotiate(context.Background(), elsewhere.URL+"/a.txt")
+	assert.False(t, ok)
+}
+
+func TestBatchPath(t *testing.T) {
+	for rawURL, expected := range map[string]string{
+		"https://example.com/a/b.txt":         "a/b.txt",
+		"https://example.com/a/b.txt?v=1":     "a/b.txt?v=1",
+		"https://example.com/a/b.txt?v=2&x=y": "a/b.txt?v=2&x=y",
+	} {
+		path, err := download.BatchPath(rawURL)
+		require.NoError(t, err)
+		assert.Equal(t, expected, path, rawURL)
+	}
+}
@@ -6,14 +6,11 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"strconv"
 	"strings"
 
 	"github.com/rs/zerolog"
-	"github.com/spf13/viper"
 
 	"github.com/emaballarin/rpget/pkg/client"
-	"github.com/emaballarin/rpget/pkg/config"
 	"github.com/emaballarin/rpget/pkg/logging"
 )
 
@@ -23,6 +20,8 @@ type BufferMode struct {
 
 	queue      *priorityWorkQueue
 	redirected bool
+	preconnect preconnector
+	prefetched prefetchedChunks
 }
 
 func GetBufferMode(opts Options) *BufferMode {
@@ -32,11 +31,15 @@ func GetBufferMode(opts Options) *BufferMode {
 		Options:    opts,
 		redirected: false,
 	}
-	m.queue = newWorkQueue(opts.maxConcurrency(), m.chunkSize())
+	m.queue = newWorkQueue(opts.maxConcurrency(), opts.MaxConnectionsPerHost, m.chunkSize(), opts.MaxBufferMemory)
 	m.queue.start()
 	return m
 }
 
+func (m *BufferMode) workQueue() *priorityWorkQueue {
+	return m.queue
+}
+
 func (m *BufferMode) chunkSize() int64 {
 	minChunkSize := m.ChunkSize
 	if minChunkSize == 0 {
@@ -45,86 +48,74 @@ func (m *BufferMode) chunkSize() int64 {
 	return minChunkSize
 }
 
-func (m *BufferMode) getFileSizeFromResponse(resp *http.Response) (int64, error) {
-	// If the response is a 200 OK, we need to parse the file size assuming the whole
-	// file was returned. If it isn't, we will assume this was a 206 Partial Content
-	// and parse the file size from the content range header. We wouldn't be in this
-	// function if the response was not between 200 and 300, so this feels like a
-	// reasonable assumption. If we get a content range header though, we should
-	// always use that
-	if resp.StatusCode == http.StatusOK && resp.Header.Get("Content-Range") == "" {
-		return m.getFileSizeFromContentLength(resp.Header.Get("Content-Length"))
-	}
-	return m.getFileSizeFromContentRange(resp.Header.Get("Content-Range"))
-}
-
-func (m *BufferMode) getFileSizeFromContentLength(contentLength string) (int64, error) {
-	size, err := strconv.ParseInt(contentLength, 10, 64)
-	if err != nil {
-		return 0, err
-	}
-
-	return size, nil
-}
-
-func (m *BufferMode) getFileSizeFromContentRange(contentRange string) (int64, error) {
-	groups := contentRangeRegexp.FindStringSubmatch(contentRange)
-	if groups == nil {
-		return -1, fmt.Errorf("couldn't parse Content-Range: %s", contentRange)
-	}
-	return strconv.ParseInt(groups[1], 10, 64)
-}
-
 type firstReqResult struct {
-	fileSize int64
-	trueURL  string
-	err      error
+	fileSize   int64
+	trueURL    string
+	validators objectValidators
+	err        error
 }
 
 func (m *BufferMode) Fetch(ctx context.Context, url string) (io.Reader, int64, error) {
 	logger := logging.GetLogger()
 
-	firstChunk := newReaderPromise()
+	ctx, reader := newChunkedReader(ctx)
+	firstChunk := reader.newChunk()
 
+	// every request for the file counts towards the limit of its host, whether or not it is redirected
+	host := hostOf(url)
+	m.preconnect.warmUp(ctx, m.Client, m.Options, url)
 	firstReqResultCh := make(chan firstReqResult)
-	m.queue.submitLow(func(buf []byte) {
-		defer close(firstReqResultCh)
+	var err error
+	if chunk := m.prefetched.take(url); chunk != nil {
+		go chunk.deliver(ctx, firstReqResultCh, firstChunk)
+	} else {
+		err = m.queue.submitLow(ctx, host, func(buf []byte) {
+			defer close(firstReqResultCh)
 
-		if m.CacheHosts != nil {
-			url = m.rewriteUrlForCache(url)
-		}
+			if m.CacheHosts != nil {
+				url = m.rewriteUrlForCache(url)
+			}
 
-		firstChunkResp, err := m.DoRequest(ctx, 0, m.chunkSize()-1, url)
-		if err != nil {
-			firstReqResultCh <- firstReqResult{err: err}
-			return
-		}
+			firstChunkResp, err := m.DoRequest(ctx, 0, m.chunkSize()-1, url)
+			if err != nil {
+				firstReqResultCh <- firstReqResult{err: err}
+				return
+			}
 
-		defer firstChunkResp.Body.Close()
+			defer firstChunkResp.Body.Close()
 
-		trueURL := firstChunkResp.Request.URL.String()
-		if trueURL != url {
-			logger.Info().Str("url", url).Str("redirect_url", trueURL).Msg("Redirect")
-			m.redirected = true
-		}
+			trueURL := firstChunkResp.Request.URL.String()
+			if trueURL != url {
+				logger.Info().Str("url", url).Str("redirect_url", trueURL).Msg("Redirect")
+				m.redirected = true
+			}
 
-		fileSize, err := m.getFileSizeFromResponse(firstChunkResp)
-		if err != nil {
-			firstReqResultCh <- firstReqResult{err: err}
-			return
-		}
-		firstReqResultCh <- firstReqResult{fileSize: fileSize, trueURL: trueURL}
-
-		contentLength := firstChunkResp.ContentLength
-		n, err := io.ReadFull(firstChunkResp.Body, buf[0:contentLength])
-		if err == io.ErrUnexpectedEOF {
-			logger.Warn().
-				Int("connection_interrupted_at_byte", n).
-				Msg("Resuming Chunk Download")
-			n, err = resumeDownload(firstChunkResp.Request, buf[n:contentLength], m.Client, int64(n))
-		}
-		firstChunk.Deliver(buf[0:n], err)
-	})
+			fileSize, err := fileSizeFromResponse(firstChunkResp)
+			if err != nil {
+				firstReqResultCh <- firstReqResult{err: err}
+				return
+			}
+			recordMetadata(ctx, firstChunkResp)
+			firstReqResultCh <- firstReqResult{fileSize: fileSize, trueURL: trueURL, validators: validatorsFromResponse(firstChunkResp)}
+
+			contentLength := firstChunkResp.ContentLength
+			n, err := io.ReadFull(firstChunkResp.Body, buf[0:contentLength])
+			if err == io.ErrUnexpectedEOF {
+				logger.Warn().
+					Int("connection_interrupted_at_byte", n).
+					Msg("Resuming Chunk Download")
+				n, err = resumeDownload(firstChunkResp.Request, buf[n:contentLength], m.Client, int64(n))
+			}
+			if err == nil {
+				chunkReceived(ctx, 0, contentLength-1, fileSize)
+			}
+			firstChunk.Deliver(buf[0:n], err)
+		})
+	}
+	if err != nil {
+		reader.abandon()
+		return nil, -1, err
+	}
 
 	firstReqResult, ok := <-firstReqResultCh
 	if !ok {
@@ -132,15 +123,18 @@ func (m *BufferMode) Fetch(ctx context.Context, url string) (io.Reader, int64, e
 	}
 
 	if firstReqResult.err != nil {
+		reader.abandon()
 		return nil, -1, firstReqResult.err
 	}
 
 	fileSize := firstReqResult.fileSize
 	trueURL := firstReqResult.trueURL
+	chunkCtx := withValidators(ctx, firstReqResult.validators)
 
 	if fileSize <= m.chunkSize() {
 		// we only need a single chunk: just download it and finish
-		return firstChunk, fileSize, nil
+		reader.Reader = firstChunk
+		return reader, fileSize, nil
 	}
 
 	remainingBytes := fileSize - m.chunkSize()
@@ -159,13 +153,12 @@ func (m *BufferMode) Fetch(ctx context.Context, url string) (io.Reader, int64, e
 		Msg("Downloading")
 
 	for i := 0; i < numChunks; i++ {
-		chunk := newReaderPromise()
-		chunks[i+1] = chunk
+		chunks[i+1] = reader.newChunk()
 	}
 	go func(chunks []io.Reader) {
-		for i, reader := range chunks {
-			chunk := reader.(*readerPromise)
-			m.queue.submitHigh(func(buf []byte) {
+		for i, chunk := range chunks {
+			chunk := chunk.(*readerPromise)
+			err := m.queue.submitHigh(ctx, host, func(buf []byte) {
 				start := startOffset + m.chunkSize()*int64(i)
 				end := start + m.chunkSize() - 1
 
@@ -177,7 +170,9 @@ func (m *BufferMode) Fetch(ctx context.Context, url string) (io.Reader, int64, e
 					Int("chunk", i).
 					Msg("Downloading chunk")
 
-				resp, err := m.DoRequest(ctx, start, end, trueURL)
+				resp, err := hedge(chunkCtx, m.HedgeAfter, func(ctx context.Context, _ bool) (*http.Response, error) {
+					return m.DoRequest(ctx, start, end, trueURL)
+				})
 				if err != nil {
 					chunk.Deliver(nil, err)
 					return
@@ -192,12 +187,23 @@ func (m *BufferMode) Fetch(ctx context.Context, url string) (io.Reader, int64, e
 						Msg("Resuming Chunk Download")
 					n, err = resumeDownload(resp.Request, buf[n:contentLength], m.Client, int64(n))
 				}
+				if err == nil {
+					chunkReceived(chunkCtx, start, end, fileSize)
+				}
 				chunk.Deliver(buf[0:n], err)
 			})
+			if err != nil {
+				// the download was canceled or abandoned: the chunks left fail, unless they are abandoned first
+				for _, chunk := range chunks[i:] {
+					chunk.(*readerPromise).Deliver(nil, err)
+				}
+				return
+			}
 		}
 	}(chunks[1:])
 
-	return io.MultiReader(chunks...), fileSize, nil
+	reader.Reader = io.MultiReader(chunks...)
+	return reader, fileSize, nil
 }
 
 func (m *BufferMode) DoRequest(ctx context.Context, start, end int64, trueURL string) (*http.Response, error) {
@@ -206,16 +212,17 @@ func (m *BufferMode) DoRequest(ctx context.Context, start, end int64, trueURL st
 		return nil, fmt.Errorf("failed to download %s: %w", trueURL, err)
 	}
 	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
-	proxyAuthHeader := viper.GetString(config.OptProxyAuthHeader)
-	if proxyAuthHeader != "" && !m.redirected {
-		req.Header.Set("Authorization", proxyAuthHeader)
+	setConditionalHeaders(req)
+	if m.ProxyAuthHeader != "" && !m.redirected {
+		req.Header.Set("Authorization", m.ProxyAuthHeader)
 	}
 	resp, err := m.Client.Do(req)
 	if err != nil {
 		return nil, fmt.Errorf("error executing request for %s: %w", req.URL.String(), err)
 	}
-	if resp.StatusCode == 0 || resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("%w %s: %s", ErrUnexpectedHTTPStatus, req.URL.String(), resp.Status)
+	if err := checkResponseStatus(req, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
 	}
 
 	return resp, nil
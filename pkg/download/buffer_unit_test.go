@@ -1,6 +1,7 @@
 package download
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"io"
@@ -9,16 +10,20 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"strings"
+	"sync/atomic"
 	"testing"
 	"testing/fstest"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/jarcoal/httpmock"
 	"github.com/rs/zerolog"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/sync/errgroup"
 
 	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/testserver"
 )
 
 func init() {
@@ -194,3 +199,112 @@ func TestReaderHandlesFullFile(t *testing.T) {
 	assert.Equal(t, "hello ", string(out))
 	assert.NoError(t, err)
 }
+
+func TestChunksPinnedToFirstResponseETag(t *testing.T) {
+	content := generateTestContent(humanize.KiByte)
+	var requests atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// the object is replaced after the first chunk has been served
+		if requests.Add(1) == 1 {
+			w.Header().Set("ETag", `"v1"`)
+		} else {
+			w.Header().Set("ETag", `"v2"`)
+		}
+		http.ServeContent(w, r, testFilePath, time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	bufferMode := GetBufferMode(Options{Client: client.Options{}, ChunkSize: 256, MaxConcurrency: 2})
+	download, _, err := bufferMode.Fetch(context.Background(), server.URL+"/"+testFilePath)
+	require.NoError(t, err)
+	_, err = io.ReadAll(download)
+	assert.ErrorIs(t, err, ErrObjectChanged)
+}
+
+func TestErrorResponsesReleaseConnections(t *testing.T) {
+	server := httptest.NewServer(http.NotFoundHandler())
+	defer server.Close()
+
+	// with a single connection, a failed request holding on to it would block the next ones forever
+	bufferMode := GetBufferMode(Options{Client: client.Options{TransportOpts: client.TransportOptions{MaxConnPerHost: 1}}})
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for range 3 {
+		_, _, err := bufferMode.Fetch(ctx, server.URL+"/missing.txt")
+		require.ErrorIs(t, err, ErrUnexpectedHTTPStatus)
+	}
+}
+
+func TestMaxBufferMemory(t *testing.T) {
+	files := map[string][]byte{}
+	for i := range 4 {
+		files[fmt.Sprintf("/%d.bin", i)] = generateTestContent(10000)
+	}
+	server := testserver.New(files)
+	defer server.Close()
+
+	// budgets of two chunks, and of less than one
+	for _, budget := range []int64{2500, 100} {
+		bufferMode := GetBufferMode(Options{ChunkSize: 1000, MaxConcurrency: 8, MaxBufferMemory: budget})
+		var eg errgroup.Group
+		for path, content := range files {
+			eg.Go(func() error {
+				reader, _, err := bufferMode.Fetch(context.Background(), server.URL+path)
+				if err != nil {
+					return err
+				}
+				data, err := io.ReadAll(reader)
+				if err != nil {
+					return err
+				}
+				if !bytes.Equal(content, data) {
+					return fmt.Errorf("content of %s differs", path)
+				}
+				return nil
+			})
+		}
+		require.NoError(t, eg.Wait())
+		pool := bufferMode.queue.buffers
+		pool.mu.Lock()
+		assert.LessOrEqual(t, pool.allocated, max(int(budget/1000), 1))
+		pool.mu.Unlock()
+	}
+}
+
+func TestMaxConnectionsPerHost(t *testing.T) {
+	content := generateTestContent(1000)
+	files := map[string][]byte{"/file.bin": content}
+
+	// the slow host answers once released
+	release := make(chan struct{})
+	var slowRequests atomic.Int64
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		slowRequests.Add(1)
+		<-release
+		testserver.Handler(files).ServeHTTP(w, r)
+	}))
+	defer slow.Close()
+	defer close(release)
+	fast := testserver.New(files)
+	defer fast.Close()
+
+	bufferMode := GetBufferMode(Options{ChunkSize: 100, MaxConcurrency: 4, MaxConnectionsPerHost: 2})
+	var slowFetches errgroup.Group
+	for range 4 {
+		slowFetches.Go(func() error {
+			_, _, err := bufferMode.Fetch(context.Background(), slow.URL+"/file.bin")
+			return err
+		})
+	}
+	require.Eventually(t, func() bool { return slowRequests.Load() == 2 }, 5*time.Second, 10*time.Millisecond)
+
+	// files of other hosts don't wait for the slow one, which has all the connections it is allowed
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	reader, _, err := bufferMode.Fetch(ctx, fast.URL+"/file.bin")
+	require.NoError(t, err)
+	data, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, int64(2), slowRequests.Load())
+}
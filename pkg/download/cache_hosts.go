@@ -0,0 +1,98 @@
+package download
+
+import (
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// minCacheHostsRefreshInterval rate limits the refreshes triggered by failed requests
+const minCacheHostsRefreshInterval = 5 * time.Second
+
+// cacheHosts is the ring of cache hosts of a ConsistentHashingMode. If it has a refresh func, the ring is replaced
+// periodically and after failed requests, so that slices not fetched yet are mapped to the current fleet.
+type cacheHosts struct {
+	refresh func() ([]string, error)
+
+	mu          sync.RWMutex
+	hosts       []string
+	lastRefresh time.Time
+	refreshing  bool
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newCacheHosts(hosts []string, refresh func() ([]string, error)) *cacheHosts {
+	return &cacheHosts{hosts: hosts, refresh: refresh, lastRefresh: time.Now()}
+}
+
+// get returns the current ring, which must not be modified.
+func (c *cacheHosts) get() []string {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.hosts
+}
+
+// start refreshes the ring every interval until close is called.
+func (c *cacheHosts) start(interval time.Duration) {
+	c.stop = make(chan struct{})
+	c.done = make(chan struct{})
+	go func() {
+		defer close(c.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-c.stop:
+				return
+			case <-ticker.C:
+				c.refreshNow()
+			}
+		}
+	}()
+}
+
+func (c *cacheHosts) close() {
+	if c.stop != nil {
+		close(c.stop)
+		<-c.done
+	}
+}
+
+// refreshAfterFailure refreshes the ring in the background, unless it was refreshed recently or is being refreshed.
+func (c *cacheHosts) refreshAfterFailure() {
+	if c.refresh == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.refreshing || time.Since(c.lastRefresh) < minCacheHostsRefreshInterval {
+		return
+	}
+	c.refreshing = true
+	go c.refreshNow()
+}
+
+func (c *cacheHosts) refreshNow() {
+	logger := logging.GetLogger()
+	hosts, err := c.refresh()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.refreshing = false
+	c.lastRefresh = time.Now()
+	if err != nil {
+		// keep using the previous ring
+		logger.Warn().Err(err).Msg("Error refreshing cache hosts")
+		return
+	}
+	if !slices.Equal(hosts, c.hosts) {
+		logger.Info().
+			Strs("previous", c.hosts).
+			Strs("hosts", hosts).
+			Msg("Cache hosts changed")
+	}
+	c.hosts = hosts
+}
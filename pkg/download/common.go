@@ -1,6 +1,7 @@
 package download
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -20,11 +21,95 @@ const defaultChunkSize = 125 * humanize.MiByte
 var (
 	contentRangeRegexp = regexp.MustCompile(`^bytes .*/([0-9]+)$`)
 
+	// ErrObjectChanged is returned when the remote object no longer matches the version returned by the first
+	// chunk request, i.e. it was replaced mid-download.
+	ErrObjectChanged = errors.New("remote object changed during download")
+
 	errMalformedRangeHeader = errors.New("malformed range header")
 	errMissingRangeHeader   = errors.New("missing range header")
 	errInvalidContentRange  = errors.New("invalid content range")
 )
 
+type validatorsKey struct{}
+
+// objectValidators identify the version of the remote object returned by the first chunk request.
+type objectValidators struct {
+	etag         string
+	lastModified string
+}
+
+func validatorsFromResponse(resp *http.Response) objectValidators {
+	v := objectValidators{lastModified: resp.Header.Get("Last-Modified")}
+	// If-Match requires strong comparison, weak ETags can never match
+	if etag := resp.Header.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+		v.etag = etag
+	}
+	return v
+}
+
+// withValidators returns a context which pins all requests made with it to the object version described by v.
+func withValidators(ctx context.Context, v objectValidators) context.Context {
+	return context.WithValue(ctx, validatorsKey{}, v)
+}
+
+// setConditionalHeaders adds If-Match (or, lacking a strong ETag, If-Unmodified-Since) to req if its context
+// carries validators from a previous response. This guarantees all chunks come from the same object version.
+func setConditionalHeaders(req *http.Request) {
+	v, ok := req.Context().Value(validatorsKey{}).(objectValidators)
+	if !ok {
+		return
+	}
+	if v.etag != "" {
+		req.Header.Set("If-Match", v.etag)
+	} else if v.lastModified != "" {
+		req.Header.Set("If-Unmodified-Since", v.lastModified)
+	}
+}
+
+// checkResponseStatus returns an error if resp does not have a 2xx status.
+func checkResponseStatus(req *http.Request, resp *http.Response) error {
+	if resp.StatusCode == http.StatusPreconditionFailed {
+		return fmt.Errorf("%w %s: %s", ErrObjectChanged, req.URL.String(), resp.Status)
+	}
+	if resp.StatusCode == http.StatusNotModified {
+		return fmt.Errorf("%w: %s", ErrNotModified, req.URL.String())
+	}
+	if resp.StatusCode == 0 || resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%w %s: %s", ErrUnexpectedHTTPStatus, req.URL.String(), resp.Status)
+	}
+	return nil
+}
+
+func fileSizeFromResponse(resp *http.Response) (int64, error) {
+	// If the response is a 200 OK, we need to parse the file size assuming the whole
+	// file was returned. If it isn't, we will assume this was a 206 Partial Content
+	// and parse the file size from the content range header. We wouldn't be in this
+	// function if the response was not between 200 and 300, so this feels like a
+	// reasonable assumption. If we get a content range header though, we should
+	// always use that
+	if resp.StatusCode == http.StatusOK && resp.Header.Get("Content-Range") == "" {
+		return fileSizeFromContentLength(resp.Header.Get("Content-Length"))
+	}
+	return fileSizeFromContentRange(resp.Header.Get("Content-Range"))
+}
+
+func fileSizeFromContentLength(contentLength string) (int64, error) {
+	size, err := strconv.ParseInt(contentLength, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+func fileSizeFromContentRange(contentRange string) (int64, error) {
+	groups := contentRangeRegexp.FindStringSubmatch(contentRange)
+	if groups == nil {
+		return -1, fmt.Errorf("couldn't parse Content-Range: %s", contentRange)
+	}
+	return strconv.ParseInt(groups[1], 10, 64)
+}
+
 func resumeDownload(req *http.Request, buffer []byte, client client.HTTPClient, bytesReceived int64) (int, error) {
 	var startByte int
 	logger := logging.GetLogger()
@@ -2,6 +2,7 @@ package download
 
 import (
 	"bytes"
+	"context"
 	"errors"
 	"io"
 	"net/http"
@@ -188,3 +189,48 @@ func TestUpdateRangeRequestHeader(t *testing.T) {
 		})
 	}
 }
+
+func TestSetConditionalHeaders(t *testing.T) {
+	tests := []struct {
+		name                      string
+		etag                      string
+		lastModified              string
+		expectedIfMatch           string
+		expectedIfUnmodifiedSince string
+	}{
+		{
+			name:            "strong etag",
+			etag:            `"abc"`,
+			lastModified:    "Wed, 21 Oct 2015 07:28:00 GMT",
+			expectedIfMatch: `"abc"`,
+		},
+		{
+			name:                      "weak etag uses last-modified",
+			etag:                      `W/"abc"`,
+			lastModified:              "Wed, 21 Oct 2015 07:28:00 GMT",
+			expectedIfUnmodifiedSince: "Wed, 21 Oct 2015 07:28:00 GMT",
+		},
+		{
+			name: "no validators",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp := &http.Response{Header: http.Header{}}
+			if tt.etag != "" {
+				resp.Header.Set("ETag", tt.etag)
+			}
+			if tt.lastModified != "" {
+				resp.Header.Set("Last-Modified", tt.lastModified)
+			}
+			ctx := withValidators(context.Background(), validatorsFromResponse(resp))
+			req, err := http.NewRequestWithContext(ctx, "GET", "http://example.com", nil)
+			require.NoError(t, err)
+
+			setConditionalHeaders(req)
+			assert.Equal(t, tt.expectedIfMatch, req.Header.Get("If-Match"))
+			assert.Equal(t, tt.expectedIfUnmodifiedSince, req.Header.Get("If-Unmodified-Since"))
+		})
+	}
+}
@@ -7,22 +7,28 @@ import (
 	"io"
 	"net/http"
 	"net/url"
+	"slices"
 	"strconv"
 	"strings"
 
 	"github.com/emaballarin/rpget/pkg/client"
 	"github.com/emaballarin/rpget/pkg/config"
-	"github.com/emaballarin/rpget/pkg/consistent"
 	"github.com/emaballarin/rpget/pkg/logging"
 )
 
 type ConsistentHashingMode struct {
 	Client client.HTTPClient
 	Options
-	// TODO: allow this to be configured and not just "BufferMode"
+	// FallbackStrategy fetches files and chunks the cache hosts can't serve, see Options.Fallback.
 	FallbackStrategy Strategy
 
-	queue *priorityWorkQueue
+	// origin fetches the files of hosts which aren't cached
+	origin *BufferMode
+	queue  *priorityWorkQueue
+	hosts  *cacheHosts
+	health *healthChecker
+
+	preconnect preconnector
 }
 
 type CacheKey struct {
@@ -36,27 +42,48 @@ func GetConsistentHashingMode(opts Options) (*ConsistentHashingMode, error) {
 	}
 	client := client.NewHTTPClient(opts.Client)
 
-	fallbackStrategy := &BufferMode{
+	m := &ConsistentHashingMode{
+		Client:  client,
+		Options: opts,
+	}
+	// Do not pass cache-related options to the origin strategy. It shares the queue, so it downloads files that
+	// fall back to origin with as many chunks in flight as the cache hosts would, in chunks that fit its buffers.
+	m.origin = &BufferMode{
 		Client: client,
-		// Do not pass cache-related options to the fallback strategy
 		Options: Options{
 			Client:         opts.Client,
-			ChunkSize:      opts.ChunkSize,
+			ChunkSize:      m.chunkSize(),
 			MaxConcurrency: opts.MaxConcurrency,
+			HedgeAfter:     opts.HedgeAfter,
 		},
 	}
-
-	m := &ConsistentHashingMode{
-		Client:           client,
-		Options:          opts,
-		FallbackStrategy: fallbackStrategy,
+	fallbackStrategy, err := newFallbackStrategy(opts, m.origin)
+	if err != nil {
+		return nil, err
 	}
-	m.queue = newWorkQueue(opts.maxConcurrency(), m.chunkSize())
+	m.FallbackStrategy = fallbackStrategy
+	m.queue = newWorkQueue(opts.maxConcurrency(), opts.MaxConnectionsPerHost, m.chunkSize(), opts.MaxBufferMemory)
 	m.queue.start()
-	fallbackStrategy.queue = m.queue
+	m.origin.queue = m.queue
+	m.hosts = newCacheHosts(opts.CacheHosts, opts.CacheHostsRefresh)
+	if opts.CacheHostsRefresh != nil && opts.CacheHostsRefreshInterval > 0 {
+		m.hosts.start(opts.CacheHostsRefreshInterval)
+	}
+	if opts.HealthCheck.Interval > 0 && len(opts.CacheHosts) > 0 {
+		m.health = newHealthChecker(m.hosts.get, opts.HealthCheck, opts.Client)
+		m.health.start()
+	}
 	return m, nil
 }
 
+// Close stops refreshing and health checking the cache hosts.
+func (m *ConsistentHashingMode) Close() {
+	m.hosts.close()
+	if m.health != nil {
+		m.health.close()
+	}
+}
+
 func (m *ConsistentHashingMode) chunkSize() int64 {
 	chunkSize := m.ChunkSize
 	if chunkSize == 0 {
@@ -97,6 +124,18 @@ func (m *ConsistentHashingMode) getFileSizeFromContentRange(contentRange string)
 	return strconv.ParseInt(groups[1], 10, 64)
 }
 
+// warmUpCacheHosts warms up the connections to the cache hosts, see preconnector.
+func (m *ConsistentHashingMode) warmUpCacheHosts(ctx context.Context) {
+	var cacheHosts []string
+	for _, host := range m.hosts.get() {
+		// hosts of not-ready pods are empty
+		if host != "" {
+			cacheHosts = append(cacheHosts, "http://"+host)
+		}
+	}
+	m.preconnect.warmUp(ctx, m.Client, m.Options, cacheHosts...)
+}
+
 func (m *ConsistentHashingMode) Fetch(ctx context.Context, urlString string) (io.Reader, int64, error) {
 	logger := logging.GetLogger()
 
@@ -104,29 +143,29 @@ func (m *ConsistentHashingMode) Fetch(ctx context.Context, urlString string) (io
 	if err != nil {
 		return nil, -1, err
 	}
-	shouldContinue := false
-	if prefixes, ok := m.CacheableURIPrefixes[parsed.Host]; ok {
-		for _, pfx := range prefixes {
-			if pfx.Path == "/" || strings.HasPrefix(parsed.Path, pfx.Path) {
-				shouldContinue = true
-				break
-			}
+	// Fetch from origin if we're not downloading from a consistent-hashing enabled domain: the fallback strategy
+	// only applies to the origins of the cache
+	if !m.cacheable(ctx, parsed) {
+		reason := fmt.Sprintf("consistent hashing not enabled for %s", parsed.Host)
+		if m.modeFor(ctx, parsed) == ModeBuffer {
+			reason = fmt.Sprintf("%s mode forced for %s", ModeBuffer, parsed.Host)
 		}
-	}
-	// Use our fallback mode if we're not downloading from a consistent-hashing enabled domain
-	if !shouldContinue {
 		logger.Debug().
 			Str("url", urlString).
-			Str("reason", fmt.Sprintf("consistent hashing not enabled for %s", parsed.Host)).
+			Str("reason", reason).
 			Msg("fallback strategy")
-		return m.FallbackStrategy.Fetch(ctx, urlString)
+		recordFallbackReason(ctx, reason)
+		return m.origin.Fetch(ctx, urlString)
 	}
 
-	firstChunk := newReaderPromise()
+	m.warmUpCacheHosts(ctx)
+
+	chunkCtx, reader := newChunkedReader(ctx)
+	firstChunk := reader.newChunk()
 	firstReqResultCh := make(chan firstReqResult)
-	m.queue.submitLow(func(buf []byte) {
+	err = m.queue.submitLow(chunkCtx, m.cacheHostOf(parsed, 0), func(buf []byte) {
 		defer close(firstReqResultCh)
-		firstChunkResp, err := m.DoRequest(ctx, 0, m.chunkSize()-1, urlString)
+		firstChunkResp, err := m.DoRequest(chunkCtx, 0, m.chunkSize()-1, urlString)
 		if err != nil {
 			firstReqResultCh <- firstReqResult{err: err}
 			return
@@ -138,7 +177,8 @@ func (m *ConsistentHashingMode) Fetch(ctx context.Context, urlString string) (io
 			firstReqResultCh <- firstReqResult{err: err}
 			return
 		}
-		firstReqResultCh <- firstReqResult{fileSize: fileSize}
+		recordMetadata(chunkCtx, firstChunkResp)
+		firstReqResultCh <- firstReqResult{fileSize: fileSize, validators: validatorsFromResponse(firstChunkResp)}
 
 		contentLength := firstChunkResp.ContentLength
 		n, err := io.ReadFull(firstChunkResp.Body, buf[0:contentLength])
@@ -148,13 +188,21 @@ func (m *ConsistentHashingMode) Fetch(ctx context.Context, urlString string) (io
 				Msg("Resuming Chunk Download")
 			n, err = resumeDownload(firstChunkResp.Request, buf[n:contentLength], m.Client, int64(n))
 		}
+		if err == nil {
+			chunkReceived(chunkCtx, 0, contentLength-1, fileSize)
+		}
 		firstChunk.Deliver(buf[0:n], err)
 	})
+	if err != nil {
+		reader.abandon()
+		return nil, -1, err
+	}
 	firstReqResult, ok := <-firstReqResultCh
 	if !ok {
 		panic("logic error in ConsistentHashingMode: first request didn't return any output")
 	}
 	if firstReqResult.err != nil {
+		reader.abandon()
 		// In the case that an error indicating an issue with the cache server, networking, etc is returned,
 		// this will use the fallback strategy. This is a case where the whole file will use the fallback
 		// strategy.
@@ -163,8 +211,9 @@ func (m *ConsistentHashingMode) Fetch(ctx context.Context, urlString string) (io
 			logger.Info().
 				Str("url", urlString).
 				Str("type", "file").
-				Err(err).
+				Err(firstReqResult.err).
 				Msg("consistent hash fallback")
+			recordFallbackReason(ctx, firstReqResult.err.Error())
 			return m.FallbackStrategy.Fetch(ctx, urlString)
 		}
 		return nil, -1, firstReqResult.err
@@ -173,7 +222,8 @@ func (m *ConsistentHashingMode) Fetch(ctx context.Context, urlString string) (io
 
 	if fileSize <= m.chunkSize() {
 		// we only need a single chunk: just download it and finish
-		return firstChunk, fileSize, nil
+		reader.Reader = firstChunk
+		return reader, fileSize, nil
 	}
 
 	totalSlices := fileSize / m.SliceSize
@@ -201,28 +251,30 @@ func (m *ConsistentHashingMode) Fetch(ctx context.Context, urlString string) (io
 			if slice == 0 && i == 0 {
 				chunk = firstChunk
 			} else {
-				chunk = newReaderPromise()
+				chunk = reader.newChunk()
 			}
 			chunks[i] = chunk
 			readers = append(readers, chunk)
 		}
 		slices[slice] = chunks
 	}
-	go m.downloadRemainingChunks(ctx, urlString, slices)
-	return io.MultiReader(readers...), fileSize, nil
+	go m.downloadRemainingChunks(withValidators(chunkCtx, firstReqResult.validators), parsed, urlString, fileSize, slices)
+	reader.Reader = io.MultiReader(readers...)
+	return reader, fileSize, nil
 }
 
-func (m *ConsistentHashingMode) downloadRemainingChunks(ctx context.Context, urlString string, slices [][]*readerPromise) {
+func (m *ConsistentHashingMode) downloadRemainingChunks(ctx context.Context, parsed *url.URL, urlString string, fileSize int64, slices [][]*readerPromise) {
 	logger := logging.GetLogger()
 	for slice, sliceChunks := range slices {
 		sliceStart := m.SliceSize * int64(slice)
 		sliceEnd := m.SliceSize*int64(slice+1) - 1
+		host := m.cacheHostOf(parsed, int64(slice))
 		for i, chunk := range sliceChunks {
 			if slice == 0 && i == 0 {
 				// this is the first chunk, already handled above
 				continue
 			}
-			m.queue.submitHigh(func(buf []byte) {
+			err := m.queue.submitHigh(ctx, host, func(buf []byte) {
 				chunkStart := sliceStart + int64(i)*m.chunkSize()
 				chunkEnd := chunkStart + m.chunkSize() - 1
 				if chunkEnd > sliceEnd {
@@ -230,24 +282,15 @@ func (m *ConsistentHashingMode) downloadRemainingChunks(ctx context.Context, url
 				}
 
 				logger.Debug().Int64("start", chunkStart).Int64("end", chunkEnd).Msg("starting request")
-				resp, err := m.DoRequest(ctx, chunkStart, chunkEnd, urlString)
-				if err != nil {
-					// in the case that an error indicating an issue with the cache server, networking, etc is returned,
-					// this will use the fallback strategy. This is a case where the whole file will perform the fall-back
-					// for the specified chunk instead of the whole file.
-					if errors.Is(err, client.ErrStrategyFallback) {
-						// TODO(morgan): we should indicate the fallback strategy we're using in the logs
-						logger.Info().
-							Str("url", urlString).
-							Str("type", "chunk").
-							Err(err).
-							Msg("consistent hash fallback")
-						resp, err = m.FallbackStrategy.DoRequest(ctx, chunkStart, chunkEnd, urlString)
-					}
-					if err != nil {
-						chunk.Deliver(nil, err)
-						return
+				resp, err := hedge(ctx, m.HedgeAfter, func(ctx context.Context, hedged bool) (*http.Response, error) {
+					if hedged {
+						return m.doHedgedChunkRequest(ctx, chunkStart, chunkEnd, urlString)
 					}
+					return m.doChunkRequest(ctx, chunkStart, chunkEnd, urlString)
+				})
+				if err != nil {
+					chunk.Deliver(nil, err)
+					return
 				}
 				defer resp.Body.Close()
 				contentLength := resp.ContentLength
@@ -258,27 +301,101 @@ func (m *ConsistentHashingMode) downloadRemainingChunks(ctx context.Context, url
 						Msg("Resuming Chunk Download")
 					n, err = resumeDownload(resp.Request, buf[n:contentLength], m.Client, int64(n))
 				}
+				if err == nil {
+					chunkReceived(ctx, chunkStart, chunkEnd, fileSize)
+				}
 				chunk.Deliver(buf[0:n], err)
 			})
+			if err != nil {
+				// the download was canceled or abandoned: the chunks left fail, unless they are abandoned first
+				for _, chunk := range sliceChunks[i:] {
+					chunk.Deliver(nil, err)
+				}
+				for _, sliceChunks := range slices[slice+1:] {
+					for _, chunk := range sliceChunks {
+						chunk.Deliver(nil, err)
+					}
+				}
+				return
+			}
 		}
 	}
 }
 
+// cacheHostOf returns the host the items fetching slice of parsed are limited by: the cache host the slice maps to,
+// so that a slow cache host only holds slots of its own, or the host of parsed if the slice maps to none.
+func (m *ConsistentHashingMode) cacheHostOf(parsed *url.URL, slice int64) string {
+	cacheHosts := m.hosts.get()
+	index, err := m.ringAlgorithm().Bucket(CacheKey{URL: parsed, Slice: slice}, len(cacheHosts))
+	if err != nil || index < 0 || index >= len(cacheHosts) || cacheHosts[index] == "" {
+		return parsed.Host
+	}
+	return cacheHosts[index]
+}
+
+// doChunkRequest requests a chunk from its cache host, falling back to the fallback strategy for this chunk if the
+// cache host is unavailable.
+func (m *ConsistentHashingMode) doChunkRequest(ctx context.Context, start, end int64, urlString string, previousPodIndexes ...int) (*http.Response, error) {
+	logger := logging.GetLogger()
+	resp, err := m.doRequest(ctx, start, end, urlString, previousPodIndexes...)
+	// in the case that an error indicating an issue with the cache server, networking, etc is returned,
+	// this will use the fallback strategy. This is a case where the whole file will perform the fall-back
+	// for the specified chunk instead of the whole file.
+	if errors.Is(err, client.ErrStrategyFallback) {
+		// TODO(morgan): we should indicate the fallback strategy we're using in the logs
+		logger.Info().
+			Str("url", urlString).
+			Str("type", "chunk").
+			Err(err).
+			Msg("consistent hash fallback")
+		return m.FallbackStrategy.DoRequest(ctx, start, end, urlString)
+	}
+	return resp, err
+}
+
+// doHedgedChunkRequest duplicates the request for a straggling chunk to the next cache host of the ring, or to the
+// fallback strategy if there is none.
+func (m *ConsistentHashingMode) doHedgedChunkRequest(ctx context.Context, start, end int64, urlString string) (*http.Response, error) {
+	parsed, err := url.Parse(urlString)
+	if err != nil {
+		return nil, err
+	}
+	buckets := len(m.hosts.get())
+	primary, err := m.ringAlgorithm().Bucket(CacheKey{URL: parsed, Slice: start / m.SliceSize}, buckets)
+	if err != nil || buckets < 2 {
+		return m.FallbackStrategy.DoRequest(ctx, start, end, urlString)
+	}
+	return m.doChunkRequest(ctx, start, end, urlString, primary)
+}
+
 func (m *ConsistentHashingMode) DoRequest(ctx context.Context, start, end int64, urlString string) (*http.Response, error) {
+	if parsed, err := url.Parse(urlString); err == nil && !m.cacheable(ctx, parsed) {
+		return m.origin.DoRequest(ctx, start, end, urlString)
+	}
+	return m.doRequest(ctx, start, end, urlString)
+}
+
+// doRequest requests a range from its cache host, skipping previousPodIndexes, then from the next cache host if it
+// is unavailable.
+func (m *ConsistentHashingMode) doRequest(ctx context.Context, start, end int64, urlString string, previousPodIndexes ...int) (*http.Response, error) {
 	chContext := context.WithValue(ctx, config.ConsistentHashingStrategyKey, true)
 	req, err := http.NewRequestWithContext(chContext, "GET", urlString, nil)
 	if err != nil {
 		return nil, fmt.Errorf("failed to download %s: %w", req.URL.String(), err)
 	}
-	resp, cachePodIndex, err := m.doRequestToCacheHost(req, urlString, start, end)
+	setConditionalHeaders(req)
+	resp, cachePodIndex, err := m.doRequestToCacheHost(req, urlString, start, end, previousPodIndexes...)
 	if err != nil {
 		if errors.Is(err, client.ErrStrategyFallback) {
+			// the fleet may have been scaled: map the next slices to the current one
+			m.hosts.refreshAfterFailure()
 			origErr := err
 			req, err := http.NewRequestWithContext(chContext, "GET", urlString, nil)
 			if err != nil {
 				return nil, fmt.Errorf("failed to download %s: %w", req.URL.String(), err)
 			}
-			resp, _, err = m.doRequestToCacheHost(req, urlString, start, end, cachePodIndex)
+			setConditionalHeaders(req)
+			resp, _, err = m.doRequestToCacheHost(req, urlString, start, end, append(slices.Clone(previousPodIndexes), cachePodIndex)...)
 			if err != nil {
 				// return origErr so that we can use our regular fallback strategy
 				return nil, origErr
@@ -287,8 +404,9 @@ func (m *ConsistentHashingMode) DoRequest(ctx context.Context, start, end int64,
 			return nil, fmt.Errorf("error executing request for %s: %w", req.URL.String(), err)
 		}
 	}
-	if resp.StatusCode == 0 || resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("%w %s: %s", ErrUnexpectedHTTPStatus, req.URL.String(), resp.Status)
+	if err := checkResponseStatus(req, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
 	}
 
 	return resp, nil
@@ -317,7 +435,10 @@ func (m *ConsistentHashingMode) rewriteRequestToCacheHost(req *http.Request, sta
 
 	key := CacheKey{URL: req.URL, Slice: slice}
 
-	cachePodIndex, err := consistent.HashBucket(key, len(m.CacheHosts), previousPodIndexes...)
+	cacheHosts := m.hosts.get()
+	// the ring may have shrunk since the previous attempts
+	previousPodIndexes = slices.DeleteFunc(slices.Clone(previousPodIndexes), func(i int) bool { return i >= len(cacheHosts) })
+	cachePodIndex, err := m.ringAlgorithm().Bucket(key, len(cacheHosts), previousPodIndexes...)
 	if err != nil {
 		return -1, err
 	}
@@ -330,7 +451,7 @@ func (m *ConsistentHashingMode) rewriteRequestToCacheHost(req *http.Request, sta
 		// Ensure wr have a leading slash, things get weird (especially in testing) if we do not.
 		req.URL.Path = fmt.Sprintf("/%s", newPath)
 	}
-	cacheHost := m.CacheHosts[cachePodIndex]
+	cacheHost := cacheHosts[cachePodIndex]
 	if cacheHost == "" {
 		// this can happen if an SRV record is missing due to a not-ready pod
 		logger.Debug().
@@ -343,6 +464,16 @@ func (m *ConsistentHashingMode) rewriteRequestToCacheHost(req *http.Request, sta
 			Msg("cache host for bucket not ready, falling back")
 		return cachePodIndex, client.ErrStrategyFallback
 	}
+	if m.health != nil && !m.health.healthy(cacheHost) {
+		// the host failed its health checks, skip it like a missing one rather than wait for a failed request
+		logger.Debug().
+			Str("cache_key", fmt.Sprintf("%+v", key)).
+			Str("host", cacheHost).
+			Int("bucket", cachePodIndex).
+			Ints("previous_pod_indexes", previousPodIndexes).
+			Msg("cache host for bucket ejected, falling back")
+		return cachePodIndex, client.ErrStrategyFallback
+	}
 	logger.Debug().
 		Str("cache_key", fmt.Sprintf("%+v", key)).
 		Int64("start", start).
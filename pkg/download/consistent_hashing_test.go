@@ -8,17 +8,21 @@ import (
 	"net/http/httptest"
 	"net/url"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/fstest"
+	"time"
 
 	"github.com/jarcoal/httpmock"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 
 	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/consistent"
 	"github.com/emaballarin/rpget/pkg/download"
 )
 
@@ -452,6 +456,65 @@ func TestConsistentHashingHasFallback(t *testing.T) {
 	assert.Equal(t, "0000000000000000", string(bytes))
 }
 
+func TestConsistentHashingFileFallbackKeepsChunkParallelism(t *testing.T) {
+	mockTransport := httpmock.NewMockTransport()
+	mockTransport.RegisterResponder("GET", "http://fake.replicate.delivery/hello.txt", rangeResponder(200, "0123456789abcdef"))
+
+	opts := download.Options{
+		Client:               client.Options{Transport: mockTransport},
+		MaxConcurrency:       8,
+		ChunkSize:            10, // larger than a slice
+		CacheHosts:           []string{""},
+		CacheableURIPrefixes: makeCacheableURIPrefixes("http://fake.replicate.delivery"),
+		SliceSize:            3,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	strategy, err := download.GetConsistentHashingMode(opts)
+	require.NoError(t, err)
+
+	var reason string
+	reader, _, err := strategy.Fetch(download.WithFallbackReason(ctx, &reason), "http://fake.replicate.delivery/hello.txt")
+	require.NoError(t, err)
+	bytes, err := io.ReadAll(reader)
+	require.NoError(t, err)
+
+	assert.Equal(t, "0123456789abcdef", string(bytes))
+	assert.NotEmpty(t, reason)
+	// the whole file was fetched from origin in chunks of the slice size, as it would have been from the cache hosts
+	assert.Equal(t, 6, mockTransport.GetTotalCallCount())
+}
+
+func TestConsistentHashingFallbackReasonForUncacheableHost(t *testing.T) {
+	mockTransport := httpmock.NewMockTransport()
+	mockTransport.RegisterResponder("GET", "http://example.com/hello.txt", rangeResponder(200, "0000"))
+
+	opts := download.Options{
+		Client:               client.Options{Transport: mockTransport},
+		MaxConcurrency:       8,
+		ChunkSize:            2,
+		CacheHosts:           []string{"cache-host-0"},
+		CacheableURIPrefixes: makeCacheableURIPrefixes("http://fake.replicate.delivery"),
+		SliceSize:            3,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	strategy, err := download.GetConsistentHashingMode(opts)
+	require.NoError(t, err)
+
+	var reason string
+	reader, _, err := strategy.Fetch(download.WithFallbackReason(ctx, &reason), "http://example.com/hello.txt")
+	require.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	require.NoError(t, err)
+
+	assert.Equal(t, "consistent hashing not enabled for example.com", reason)
+}
+
 func TestConsistentHashingHandlesFullFile(t *testing.T) {
 	mockTransport := httpmock.NewMockTransport()
 	mockTransport.RegisterResponder("GET", "http://fake.replicate.delivery/hello.txt", func(req *http.Request) (*http.Response, error) {
@@ -646,3 +709,482 @@ func TestConsistentHashingChunkFallback(t *testing.T) {
 		})
 	}
 }
+
+func TestConsistentHashingHealthCheckEjectsHost(t *testing.T) {
+	hostnames, mockTransport := fakeCacheHosts(8, 16)
+	var unhealthy atomic.Bool
+	unhealthy.Store(true)
+	for i, hostname := range hostnames {
+		mockTransport.RegisterResponder("HEAD", fmt.Sprintf("http://%s/", hostname), func(req *http.Request) (*http.Response, error) {
+			if i == 0 && unhealthy.Load() {
+				return nil, fmt.Errorf("connection refused")
+			}
+			return httpmock.NewStringResponse(http.StatusOK, ""), nil
+		})
+	}
+
+	opts := download.Options{
+		Client:               client.Options{Transport: mockTransport},
+		MaxConcurrency:       8,
+		ChunkSize:            1,
+		CacheHosts:           hostnames,
+		CacheableURIPrefixes: makeCacheableURIPrefixes("http://fake.replicate.delivery"),
+		SliceSize:            1,
+		HealthCheck:          download.HealthCheckOptions{Interval: 10 * time.Millisecond},
+	}
+	strategy, err := download.GetConsistentHashingMode(opts)
+	require.NoError(t, err)
+	defer strategy.Close()
+
+	fetch := func() string {
+		reader, _, err := strategy.Fetch(context.Background(), "http://fake.replicate.delivery/hello.txt")
+		require.NoError(t, err)
+		bytes, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		return string(bytes)
+	}
+	// once cache-host-0 is ejected, its slices are routed as if its SRV record was missing, see
+	// TestConsistentHashRetriesMissingHostname
+	require.Eventually(t, func() bool { return fetch() == "3344761726165516" }, 5*time.Second, 10*time.Millisecond)
+
+	unhealthy.Store(false)
+	require.Eventually(t, func() bool { return fetch() == "0344760706165500" }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConsistentHashingRefreshesCacheHosts(t *testing.T) {
+	hostnames, mockTransport := fakeCacheHosts(8, 16)
+	var missing atomic.Bool
+
+	opts := download.Options{
+		Client:               client.Options{Transport: mockTransport},
+		MaxConcurrency:       8,
+		ChunkSize:            1,
+		CacheHosts:           hostnames,
+		CacheableURIPrefixes: makeCacheableURIPrefixes("http://fake.replicate.delivery"),
+		SliceSize:            1,
+		CacheHostsRefresh: func() ([]string, error) {
+			hosts := slices.Clone(hostnames)
+			if missing.Load() {
+				hosts[0] = ""
+			}
+			return hosts, nil
+		},
+		CacheHostsRefreshInterval: 10 * time.Millisecond,
+	}
+	strategy, err := download.GetConsistentHashingMode(opts)
+	require.NoError(t, err)
+	defer strategy.Close()
+
+	fetch := func() string {
+		reader, _, err := strategy.Fetch(context.Background(), "http://fake.replicate.delivery/hello.txt")
+		require.NoError(t, err)
+		bytes, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		return string(bytes)
+	}
+	assert.Equal(t, "0344760706165500", fetch())
+
+	// cache-host-0's SRV record disappears: see TestConsistentHashRetriesMissingHostname
+	missing.Store(true)
+	require.Eventually(t, func() bool { return fetch() == "3344761726165516" }, 5*time.Second, 10*time.Millisecond)
+
+	missing.Store(false)
+	require.Eventually(t, func() bool { return fetch() == "0344760706165500" }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConsistentHashingHedgesStragglingChunks(t *testing.T) {
+	hostnames, mockTransport := fakeCacheHosts(3, 16)
+	var cancelled atomic.Int32
+	// cache-host-1 never answers
+	mockTransport.RegisterResponder("GET", "http://cache-host-1/hello.txt", func(req *http.Request) (*http.Response, error) {
+		select {
+		case <-req.Context().Done():
+			cancelled.Add(1)
+			return nil, req.Context().Err()
+		case <-time.After(10 * time.Second):
+			return nil, fmt.Errorf("chunk request was not cancelled")
+		}
+	})
+
+	opts := download.Options{
+		Client:               client.Options{Transport: mockTransport},
+		MaxConcurrency:       8,
+		ChunkSize:            1,
+		CacheHosts:           hostnames,
+		CacheableURIPrefixes: makeCacheableURIPrefixes("http://test.replicate.com"),
+		SliceSize:            3,
+		HedgeAfter:           10 * time.Millisecond,
+	}
+	strategy, err := download.GetConsistentHashingMode(opts)
+	require.NoError(t, err)
+
+	reader, _, err := strategy.Fetch(context.Background(), "http://test.replicate.com/hello.txt")
+	require.NoError(t, err)
+	bytes, err := io.ReadAll(reader)
+	require.NoError(t, err)
+
+	// without hedging, we'd see 2221110000002222: the chunks of cache-host-1 are hedged to other hosts
+	assert.Len(t, bytes, 16)
+	assert.NotContains(t, string(bytes), "1")
+	assert.Equal(t, "222", string(bytes[:3]))
+	assert.Equal(t, "0000002222", string(bytes[6:]))
+	require.Eventually(t, func() bool { return cancelled.Load() == 3 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestConsistentHashingMaxConnectionsPerCacheHost(t *testing.T) {
+	hostnames, mockTransport := fakeCacheHosts(3, 16)
+	// cache-host-1 answers once released
+	release := make(chan struct{})
+	var slowRequests atomic.Int32
+	slowResponder := rangeResponder(200, strings.Repeat("1", 16))
+	mockTransport.RegisterResponder("GET", "http://cache-host-1/hello.txt", func(req *http.Request) (*http.Response, error) {
+		slowRequests.Add(1)
+		select {
+		case <-release:
+			return slowResponder(req)
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	})
+	// a file of the same origin whose only slice maps to another cache host
+	var other string
+	for i := 0; other == ""; i++ {
+		candidate, err := url.Parse(fmt.Sprintf("http://test.replicate.com/other-%d.txt", i))
+		require.NoError(t, err)
+		if bucket, err := (consistent.Jump{}).Bucket(download.CacheKey{URL: candidate, Slice: 0}, len(hostnames)); err == nil && bucket != 1 {
+			other = candidate.Path
+		}
+	}
+	for _, host := range []string{"cache-host-0", "cache-host-2"} {
+		mockTransport.RegisterResponder("GET", "http://"+host+other, rangeResponder(200, "x"))
+	}
+
+	opts := download.Options{
+		Client:                client.Options{Transport: mockTransport},
+		MaxConcurrency:        8,
+		MaxConnectionsPerHost: 1,
+		ChunkSize:             1,
+		CacheHosts:            hostnames,
+		CacheableURIPrefixes:  makeCacheableURIPrefixes("http://test.replicate.com"),
+		SliceSize:             3,
+	}
+	strategy, err := download.GetConsistentHashingMode(opts)
+	require.NoError(t, err)
+
+	reader, _, err := strategy.Fetch(context.Background(), "http://test.replicate.com/hello.txt")
+	require.NoError(t, err)
+	// chunks hold their slot until they are read
+	read := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(reader)
+		read <- data
+	}()
+	require.Eventually(t, func() bool { return slowRequests.Load() == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// the slots are those of the cache hosts, not of the origin: the slow one doesn't hold up the others
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	otherReader, _, err := strategy.Fetch(ctx, "http://test.replicate.com"+other)
+	require.NoError(t, err)
+	data, err := io.ReadAll(otherReader)
+	require.NoError(t, err)
+	assert.Equal(t, "x", string(data))
+	assert.Equal(t, int32(1), slowRequests.Load())
+
+	close(release)
+	assert.Equal(t, "2221110000002222", string(<-read))
+}
+
+func TestParseHealthCheckMode(t *testing.T) {
+	mode, err := download.ParseHealthCheckMode("")
+	require.NoError(t, err)
+	assert.Equal(t, download.HealthCheckHEAD, mode)
+	mode, err = download.ParseHealthCheckMode("tcp")
+	require.NoError(t, err)
+	assert.Equal(t, download.HealthCheckTCP, mode)
+	_, err = download.ParseHealthCheckMode("icmp")
+	assert.Error(t, err)
+}
+
+func TestConsistentHashingFallbackModes(t *testing.T) {
+	const content = "0123456789abcdef"
+	tc := []struct {
+		name     string
+		fallback download.FallbackMode
+		mirror   string
+		// requests is the number of requests expected to each host
+		requests map[string]int
+		err      error
+	}{
+		{
+			name:     "origin",
+			fallback: download.FallbackOrigin,
+			requests: map[string]int{"fake.replicate.delivery": 6},
+		},
+		{
+			name:     "single",
+			fallback: download.FallbackSingle,
+			requests: map[string]int{"fake.replicate.delivery": 1},
+		},
+		{
+			name:     "mirror",
+			fallback: download.FallbackMirror,
+			mirror:   "http://mirror.example.com/pub/",
+			requests: map[string]int{"mirror.example.com": 6},
+		},
+		{
+			name:     "fail",
+			fallback: download.FallbackFail,
+			requests: map[string]int{},
+			err:      download.ErrFallbackDisabled,
+		},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			mockTransport := httpmock.NewMockTransport()
+			mockTransport.RegisterResponder("GET", "http://fake.replicate.delivery/hello.txt", rangeResponder(200, content))
+			mockTransport.RegisterResponder("GET", "http://mirror.example.com/pub/hello.txt", rangeResponder(200, content))
+
+			opts := download.Options{
+				Client:               client.Options{Transport: mockTransport},
+				MaxConcurrency:       8,
+				ChunkSize:            3,
+				CacheHosts:           []string{""}, // simulate a single unavailable cache host
+				CacheableURIPrefixes: makeCacheableURIPrefixes("http://fake.replicate.delivery"),
+				SliceSize:            3,
+				Fallback:             tc.fallback,
+				FallbackMirrorURL:    tc.mirror,
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			strategy, err := download.GetConsistentHashingMode(opts)
+			require.NoError(t, err)
+
+			reader, _, err := strategy.Fetch(ctx, "http://fake.replicate.delivery/hello.txt")
+			if tc.err != nil {
+				assert.ErrorIs(t, err, tc.err)
+			} else {
+				require.NoError(t, err)
+				bytes, err := io.ReadAll(reader)
+				require.NoError(t, err)
+				assert.Equal(t, content, string(bytes))
+			}
+			requests := make(map[string]int)
+			for call, count := range mockTransport.GetCallCountInfo() {
+				if count > 0 {
+					parsed, err := url.Parse(strings.TrimPrefix(call, "GET "))
+					require.NoError(t, err)
+					requests[parsed.Host] += count
+				}
+			}
+			assert.Equal(t, tc.requests, requests)
+		})
+	}
+}
+
+func TestConsistentHashingFailFallbackStillFetchesUncachedHosts(t *testing.T) {
+	mockTransport := httpmock.NewMockTransport()
+	mockTransport.RegisterResponder("GET", "http://example.com/hello.txt", rangeResponder(200, "0000"))
+
+	opts := download.Options{
+		Client:               client.Options{Transport: mockTransport},
+		MaxConcurrency:       8,
+		ChunkSize:            2,
+		CacheHosts:           []string{"cache-host-0"},
+		CacheableURIPrefixes: makeCacheableURIPrefixes("http://fake.replicate.delivery"),
+		SliceSize:            3,
+		Fallback:             download.FallbackFail,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	strategy, err := download.GetConsistentHashingMode(opts)
+	require.NoError(t, err)
+
+	reader, _, err := strategy.Fetch(ctx, "http://example.com/hello.txt")
+	require.NoError(t, err)
+	bytes, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, "0000", string(bytes))
+}
+
+func TestParseFallbackMode(t *testing.T) {
+	mode, err := download.ParseFallbackMode("")
+	require.NoError(t, err)
+	assert.Equal(t, download.FallbackOrigin, mode)
+	mode, err = download.ParseFallbackMode("single")
+	require.NoError(t, err)
+	assert.Equal(t, download.FallbackSingle, mode)
+	_, err = download.ParseFallbackMode("nearest")
+	assert.Error(t, err)
+
+	_, err = download.GetConsistentHashingMode(download.Options{SliceSize: 3, Fallback: download.FallbackMirror})
+	assert.ErrorContains(t, err, "invalid fallback mirror")
+	_, err = download.GetConsistentHashingMode(download.Options{SliceSize: 3, FallbackMirrorURL: "http://mirror.example.com"})
+	assert.ErrorContains(t, err, "requires the mirror fallback mode")
+}
+
+func TestConsistentHashingForcedModes(t *testing.T) {
+	content := "0123456789"
+	testCases := []struct {
+		name      string
+		url       string
+		hostModes map[string]download.Mode
+		ctxMode   download.Mode
+		requests  map[string]int
+	}{
+		{
+			name:     "cacheable prefix",
+			url:      "http://fake.replicate.delivery/hello.txt",
+			requests: map[string]int{"cache-host-0": 4},
+		},
+		{
+			name:      "host forced to buffer",
+			url:       "http://fake.replicate.delivery/hello.txt",
+			hostModes: map[string]download.Mode{"fake.replicate.delivery": download.ModeBuffer},
+			requests:  map[string]int{"fake.replicate.delivery": 4},
+		},
+		{
+			name:      "host forced to consistent hashing",
+			url:       "http://example.com/hello.txt",
+			hostModes: map[string]download.Mode{"example.com": download.ModeConsistentHashing},
+			requests:  map[string]int{"cache-host-0": 4},
+		},
+		{
+			name:      "context takes precedence over host",
+			url:       "http://example.com/hello.txt",
+			hostModes: map[string]download.Mode{"example.com": download.ModeConsistentHashing},
+			ctxMode:   download.ModeBuffer,
+			requests:  map[string]int{"example.com": 4},
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			mockTransport := httpmock.NewMockTransport()
+			mockTransport.RegisterResponder("GET", "http://cache-host-0/hello.txt", rangeResponder(200, content))
+			mockTransport.RegisterResponder("GET", "http://fake.replicate.delivery/hello.txt", rangeResponder(200, content))
+			mockTransport.RegisterResponder("GET", "http://example.com/hello.txt", rangeResponder(200, content))
+
+			opts := download.Options{
+				Client:               client.Options{Transport: mockTransport},
+				MaxConcurrency:       8,
+				ChunkSize:            3,
+				CacheHosts:           []string{"cache-host-0"},
+				CacheableURIPrefixes: makeCacheableURIPrefixes("http://fake.replicate.delivery"),
+				SliceSize:            3,
+				HostModes:            tc.hostModes,
+			}
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			strategy, err := download.NewStrategy(opts)
+			require.NoError(t, err)
+
+			reader, _, err := strategy.Fetch(download.WithMode(ctx, tc.ctxMode), tc.url)
+			require.NoError(t, err)
+			bytes, err := io.ReadAll(reader)
+			require.NoError(t, err)
+			assert.Equal(t, content, string(bytes))
+
+			requests := make(map[string]int)
+			for call, count := range mockTransport.GetCallCountInfo() {
+				if count > 0 {
+					parsed, err := url.Parse(strings.TrimPrefix(call, "GET "))
+					require.NoError(t, err)
+					requests[parsed.Host] += count
+				}
+			}
+			assert.Equal(t, tc.requests, requests)
+		})
+	}
+}
+
+func TestParseMode(t *testing.T) {
+	mode, err := download.ParseMode("consistent-hashing")
+	require.NoError(t, err)
+	assert.Equal(t, download.ModeConsistentHashing, mode)
+	_, err = download.ParseMode("cache")
+	assert.Error(t, err)
+
+	_, err = download.NewStrategy(download.Options{HostModes: map[string]download.Mode{"example.com": download.ModeConsistentHashing}})
+	assert.ErrorContains(t, err, "requires cache hosts")
+	_, err = download.NewStrategy(download.Options{HostModes: map[string]download.Mode{"example.com": "cache"}})
+	assert.ErrorContains(t, err, "invalid download mode")
+}
+
+func TestConsistentHashingStatCacheHost(t *testing.T) {
+	content := strings.Repeat("0123456789", 5)
+	mockTransport := httpmock.NewMockTransport()
+	mockTransport.RegisterResponder("GET", "http://cache-host-0/hello.txt", rangeResponder(200, content))
+	mockTransport.RegisterResponder("GET", "http://cache-host-1/hello.txt", rangeResponder(200, content))
+	mockTransport.RegisterResponder("GET", "http://example.com/hello.txt", rangeResponder(200, content))
+
+	opts := download.Options{
+		Client:               client.Options{Transport: mockTransport},
+		CacheHosts:           []string{"cache-host-0", "cache-host-1"},
+		CacheableURIPrefixes: makeCacheableURIPrefixes("http://fake.replicate.delivery"),
+		SliceSize:            3,
+	}
+	strategy, err := download.GetConsistentHashingMode(opts)
+	require.NoError(t, err)
+	defer strategy.Close()
+	owners, err := download.RingOwners(opts, "http://fake.replicate.delivery/hello.txt", int64(len(content)))
+	require.NoError(t, err)
+
+	info, err := download.Stat(context.Background(), strategy, "http://fake.replicate.delivery/hello.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+	// the host of the first slice
+	assert.Equal(t, owners[0].Host, info.CacheHost)
+
+	// uncacheable URLs are requested from their own host
+	info, err = download.Stat(context.Background(), strategy, "http://example.com/hello.txt")
+	require.NoError(t, err)
+	assert.Empty(t, info.CacheHost)
+}
+
+func TestRingOwnersMatchDownload(t *testing.T) {
+	content := strings.Repeat("0123456789", 5)
+	for _, algorithm := range []consistent.Algorithm{consistent.Jump{}, consistent.Rendezvous{}} {
+		mockTransport := httpmock.NewMockTransport()
+		mockTransport.RegisterResponder("GET", "http://cache-host-0/hello.txt", rangeResponder(200, content))
+		mockTransport.RegisterResponder("GET", "http://cache-host-2/hello.txt", rangeResponder(200, content))
+
+		opts := download.Options{
+			Client:               client.Options{Transport: mockTransport},
+			MaxConcurrency:       8,
+			ChunkSize:            3,
+			CacheHosts:           []string{"cache-host-0", "", "cache-host-2"},
+			CacheableURIPrefixes: makeCacheableURIPrefixes("http://fake.replicate.delivery"),
+			SliceSize:            3,
+			RingAlgorithm:        algorithm,
+		}
+		owners, err := download.RingOwners(opts, "http://fake.replicate.delivery/hello.txt", int64(len(content)))
+		require.NoError(t, err)
+		require.Len(t, owners, 17)
+		assert.Equal(t, download.SliceOwner{Slice: 16, Start: 48, End: 49, Bucket: owners[16].Bucket, Host: owners[16].Host}, owners[16])
+		expected := make(map[string]int)
+		for _, owner := range owners {
+			assert.NotEmpty(t, owner.Host)
+			expected["GET http://"+owner.Host+"/hello.txt"]++
+		}
+
+		strategy, err := download.GetConsistentHashingMode(opts)
+		require.NoError(t, err)
+		reader, _, err := strategy.Fetch(context.Background(), "http://fake.replicate.delivery/hello.txt")
+		require.NoError(t, err)
+		bytes, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, content, string(bytes))
+		assert.Equal(t, expected, mockTransport.GetCallCountInfo())
+		strategy.Close()
+	}
+
+	_, err := download.RingOwners(download.Options{SliceSize: 3}, "http://example.com/hello.txt", 10)
+	assert.ErrorContains(t, err, "no cache hosts")
+}
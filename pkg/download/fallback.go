@@ -0,0 +1,136 @@
+package download
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// FallbackMode selects how files are fetched in consistent hashing mode when the cache hosts can't serve them.
+type FallbackMode string
+
+const (
+	// FallbackOrigin fetches them from origin in buffer mode, with as many chunks in flight as from the cache hosts.
+	FallbackOrigin FallbackMode = "origin"
+	// FallbackSingle fetches files from origin with a single streamed request each, to spare it from parallel
+	// chunk requests. Chunks of files the cache hosts served in part are still requested from origin one by one.
+	FallbackSingle FallbackMode = "single"
+	// FallbackMirror fetches them in buffer mode from Options.FallbackMirrorURL instead of origin.
+	FallbackMirror FallbackMode = "mirror"
+	// FallbackFail fails the download, for origins which must never receive direct traffic.
+	FallbackFail FallbackMode = "fail"
+)
+
+// ErrFallbackDisabled is returned in consistent hashing mode when the cache hosts can't serve a file and
+// Options.Fallback is FallbackFail.
+var ErrFallbackDisabled = errors.New("fallback from the cache hosts is disabled")
+
+// ParseFallbackMode returns the FallbackMode named name, FallbackOrigin if name is empty.
+func ParseFallbackMode(name string) (FallbackMode, error) {
+	switch mode := FallbackMode(name); mode {
+	case "":
+		return FallbackOrigin, nil
+	case FallbackOrigin, FallbackSingle, FallbackMirror, FallbackFail:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid fallback mode %s, expected one of %s, %s, %s, %s", name, FallbackOrigin, FallbackSingle, FallbackMirror, FallbackFail)
+	}
+}
+
+// newFallbackStrategy returns the fallback strategy of consistent hashing mode selected by opts.Fallback. origin is
+// the buffer mode strategy fetching from origin, which the others are derived from.
+func newFallbackStrategy(opts Options, origin *BufferMode) (Strategy, error) {
+	mode, err := ParseFallbackMode(string(opts.Fallback))
+	if err != nil {
+		return nil, err
+	}
+	if mode != FallbackMirror && opts.FallbackMirrorURL != "" {
+		return nil, fmt.Errorf("a fallback mirror requires the %s fallback mode", FallbackMirror)
+	}
+	switch mode {
+	case FallbackSingle:
+		// a file no larger than the threshold is fetched with a single request
+		return &SmallFileMode{Client: origin.Client, Threshold: math.MaxInt64, ProxyAuthHeader: origin.ProxyAuthHeader}, nil
+	case FallbackMirror:
+		mirror, err := url.Parse(opts.FallbackMirrorURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fallback mirror: %w", err)
+		}
+		if mirror.Scheme == "" || mirror.Host == "" {
+			return nil, fmt.Errorf("invalid fallback mirror %q: expected an absolute URL", opts.FallbackMirrorURL)
+		}
+		return &mirrorMode{Strategy: origin, mirror: mirror}, nil
+	case FallbackFail:
+		return failMode{}, nil
+	default:
+		return origin, nil
+	}
+}
+
+// mirrorMode fetches files from a mirror of their origin with the Strategy it wraps: the scheme and host of their
+// URL are replaced with those of mirror, and its path is prepended to theirs.
+type mirrorMode struct {
+	Strategy
+	mirror *url.URL
+}
+
+func (m *mirrorMode) Fetch(ctx context.Context, urlString string) (io.Reader, int64, error) {
+	mirrored, err := m.rewrite(urlString)
+	if err != nil {
+		return nil, -1, err
+	}
+	return m.Strategy.Fetch(ctx, mirrored)
+}
+
+func (m *mirrorMode) DoRequest(ctx context.Context, start, end int64, urlString string) (*http.Response, error) {
+	mirrored, err := m.rewrite(urlString)
+	if err != nil {
+		return nil, err
+	}
+	return m.Strategy.DoRequest(ctx, start, end, mirrored)
+}
+
+func (m *mirrorMode) rewrite(urlString string) (string, error) {
+	parsed, err := url.Parse(urlString)
+	if err != nil {
+		return "", err
+	}
+	parsed.Scheme = m.mirror.Scheme
+	parsed.Host = m.mirror.Host
+	parsed.User = m.mirror.User
+	parsed.Path = strings.TrimSuffix(m.mirror.Path, "/") + parsed.Path
+	parsed.RawPath = ""
+	return parsed.String(), nil
+}
+
+// failMode fails every request, see FallbackFail.
+type failMode struct{}
+
+func (failMode) Fetch(_ context.Context, url string) (io.Reader, int64, error) {
+	return nil, -1, fmt.Errorf("%w: can't fetch %s from the cache hosts", ErrFallbackDisabled, url)
+}
+
+func (failMode) DoRequest(_ context.Context, _, _ int64, url string) (*http.Response, error) {
+	return nil, fmt.Errorf("%w: can't fetch %s from the cache hosts", ErrFallbackDisabled, url)
+}
+
+type fallbackReasonKey struct{}
+
+// WithFallbackReason returns a context that causes Fetch in consistent hashing mode to set *reason to why the whole
+// file was fetched from origin or with its fallback strategy rather than from the cache hosts. *reason is left as
+// it is if the file wasn't.
+func WithFallbackReason(ctx context.Context, reason *string) context.Context {
+	return context.WithValue(ctx, fallbackReasonKey{}, reason)
+}
+
+// recordFallbackReason sets the reason requested with WithFallbackReason, if any.
+func recordFallbackReason(ctx context.Context, reason string) {
+	if r, ok := ctx.Value(fallbackReasonKey{}).(*string); ok && r != nil {
+		*r = reason
+	}
+}
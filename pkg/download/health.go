@@ -0,0 +1,222 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// HealthCheckMode selects how cache hosts are probed.
+type HealthCheckMode string
+
+const (
+	// HealthCheckHEAD probes a cache host with a HEAD request to its root, which is healthy unless it fails or
+	// answers with a server error
+	HealthCheckHEAD HealthCheckMode = "head"
+	// HealthCheckTCP probes a cache host by opening a TCP connection to it
+	HealthCheckTCP HealthCheckMode = "tcp"
+)
+
+// ParseHealthCheckMode parses a health check mode, defaulting to HealthCheckHEAD if s is empty.
+func ParseHealthCheckMode(s string) (HealthCheckMode, error) {
+	switch mode := HealthCheckMode(s); mode {
+	case "":
+		return HealthCheckHEAD, nil
+	case HealthCheckHEAD, HealthCheckTCP:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid health check mode %s, expected head or tcp", s)
+	}
+}
+
+type HealthCheckOptions struct {
+	// Interval between two probes of every cache host. Health checking is disabled if zero.
+	Interval time.Duration
+
+	// Mode is how cache hosts are probed, HealthCheckHEAD if empty.
+	Mode HealthCheckMode
+
+	// Timeout of a probe. If set to zero, Interval will be used.
+	Timeout time.Duration
+
+	// Threshold is the number of consecutive failed probes ejecting a host from the ring, and of consecutive
+	// successful probes adding it back. If set to zero, 1 will be used.
+	Threshold int
+}
+
+func (o HealthCheckOptions) timeout() time.Duration {
+	if o.Timeout == 0 {
+		return o.Interval
+	}
+	return o.Timeout
+}
+
+func (o HealthCheckOptions) threshold() int {
+	if o.Threshold <= 0 {
+		return 1
+	}
+	return o.Threshold
+}
+
+// hostHealth is the health of a cache host: ejected hosts are skipped as if their ring entry was empty.
+type hostHealth struct {
+	ejected bool
+	// streak counts the consecutive probes disagreeing with ejected
+	streak int
+}
+
+// healthChecker probes the cache hosts in the background and tracks which are ejected from the ring. Every host
+// starts healthy.
+type healthChecker struct {
+	// hosts returns the current ring
+	hosts  func() []string
+	opts   HealthCheckOptions
+	client client.HTTPClient
+	dialer *net.Dialer
+
+	mu     sync.RWMutex
+	health map[string]*hostHealth
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newHealthChecker(hosts func() []string, opts HealthCheckOptions, clientOpts client.Options) *healthChecker {
+	// probes aren't retried: a failed probe is a failure
+	clientOpts.MaxRetries = 0
+	return &healthChecker{
+		hosts:  hosts,
+		opts:   opts,
+		client: client.NewHTTPClient(clientOpts),
+		dialer: &net.Dialer{Timeout: opts.timeout()},
+		health: make(map[string]*hostHealth),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+}
+
+func (h *healthChecker) start() {
+	go func() {
+		defer close(h.done)
+		ticker := time.NewTicker(h.opts.Interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-h.stop:
+				return
+			case <-ticker.C:
+				h.probeAll()
+			}
+		}
+	}()
+}
+
+// close stops probing and waits for the running probes to complete.
+func (h *healthChecker) close() {
+	close(h.stop)
+	<-h.done
+}
+
+// healthy reports whether the cache host hasn't been ejected.
+func (h *healthChecker) healthy(host string) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	health, ok := h.health[host]
+	return !ok || !health.ejected
+}
+
+func (h *healthChecker) probeAll() {
+	hosts := h.hosts()
+	h.forget(hosts)
+	var wg sync.WaitGroup
+	for _, host := range hosts {
+		if host == "" {
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.record(host, h.probe(host))
+		}()
+	}
+	wg.Wait()
+}
+
+// forget drops the health of the hosts which left the ring.
+func (h *healthChecker) forget(hosts []string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for host := range h.health {
+		if !slices.Contains(hosts, host) {
+			delete(h.health, host)
+		}
+	}
+}
+
+func (h *healthChecker) probe(host string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), h.opts.timeout())
+	defer cancel()
+	if h.opts.Mode == HealthCheckTCP {
+		addr := host
+		if _, _, err := net.SplitHostPort(host); err != nil {
+			addr = net.JoinHostPort(host, "80")
+		}
+		conn, err := h.dialer.DialContext(ctx, "tcp", addr)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodHead, "http://"+host+"/", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+// record updates the health of the cache host with the outcome of a probe.
+func (h *healthChecker) record(host string, err error) {
+	logger := logging.GetLogger()
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	health, ok := h.health[host]
+	if !ok {
+		health = &hostHealth{}
+		h.health[host] = health
+	}
+	if (err != nil) != health.ejected {
+		health.streak++
+	} else {
+		health.streak = 0
+	}
+	if health.streak < h.opts.threshold() {
+		return
+	}
+	health.ejected = !health.ejected
+	health.streak = 0
+	if health.ejected {
+		logger.Warn().
+			Str("host", host).
+			Err(err).
+			Msg("Cache host unhealthy, ejecting from ring")
+	} else {
+		logger.Info().
+			Str("host", host).
+			Msg("Cache host recovered, adding back to ring")
+	}
+}
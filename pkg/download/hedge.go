@@ -0,0 +1,94 @@
+package download
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// hedgedAttempt sends a request for a chunk with ctx. hedged is false for the first request and true for the
+// duplicate one, which should be sent to another host if there is one.
+type hedgedAttempt func(ctx context.Context, hedged bool) (*http.Response, error)
+
+type hedgeResult struct {
+	resp   *http.Response
+	err    error
+	hedged bool
+}
+
+// hedge sends a request with do and, if it hasn't returned a response after the given delay, a duplicate request,
+// returning whichever response arrives first and cancelling the other request. If the first request fails before
+// the delay, its error is returned as is; if both fail, the error of the first request is returned. Requests are
+// not hedged if after is zero.
+func hedge(ctx context.Context, after time.Duration, do hedgedAttempt) (*http.Response, error) {
+	if after <= 0 {
+		return do(ctx, false)
+	}
+	logger := logging.GetLogger()
+	results := make(chan hedgeResult, 2)
+	attempt := func(hedged bool) context.CancelFunc {
+		attemptCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			resp, err := do(attemptCtx, hedged)
+			results <- hedgeResult{resp: resp, err: err, hedged: hedged}
+		}()
+		return cancel
+	}
+	cancels := map[bool]context.CancelFunc{false: attempt(false)}
+	timer := time.NewTimer(after)
+	defer timer.Stop()
+
+	var firstErr error
+	for pending := 1; pending > 0; {
+		select {
+		case <-timer.C:
+			logger.Debug().
+				Dur("hedge_after", after).
+				Msg("Hedging straggling chunk request")
+			cancels[true] = attempt(true)
+			pending++
+		case result := <-results:
+			pending--
+			if result.err == nil {
+				if pending > 0 {
+					// the loser's response, if any, is discarded
+					cancels[!result.hedged]()
+					go func() {
+						if loser := <-results; loser.resp != nil {
+							loser.resp.Body.Close()
+						}
+					}()
+				}
+				if result.hedged {
+					logger.Debug().Msg("Hedged chunk request won")
+				}
+				result.resp.Body = cancelOnClose{ReadCloser: result.resp.Body, cancel: cancels[result.hedged]}
+				return result.resp, nil
+			}
+			cancels[result.hedged]()
+			if !result.hedged || firstErr == nil {
+				firstErr = result.err
+			}
+			if _, hedged := cancels[true]; !hedged {
+				// the first request failed before being hedged, it's up to the caller to retry it
+				return nil, result.err
+			}
+		}
+	}
+	return nil, firstErr
+}
+
+// cancelOnClose cancels the context of a response once its body is closed.
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (c cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
@@ -0,0 +1,55 @@
+package download
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Metadata holds the response headers of a fetched file which are of interest to callers.
+type Metadata struct {
+	ContentType string
+	ETag        string
+	// LastModified is zero if the response had no (valid) Last-Modified header.
+	LastModified time.Time
+	// Custom holds the X- headers of the response, such as the x-amz-meta-* user metadata of S3 objects.
+	Custom http.Header
+}
+
+type metadataKey struct{}
+
+// WithMetadata returns a context that causes Fetch to fill md with the metadata of the file fetched with it, as
+// returned by the response to its first request.
+func WithMetadata(ctx context.Context, md *Metadata) context.Context {
+	return context.WithValue(ctx, metadataKey{}, md)
+}
+
+// MetadataFrom returns the metadata requested with WithMetadata, or nil if there is none.
+func MetadataFrom(ctx context.Context) *Metadata {
+	md, _ := ctx.Value(metadataKey{}).(*Metadata)
+	return md
+}
+
+// recordMetadata fills the metadata requested with WithMetadata, if any, from resp.
+func recordMetadata(ctx context.Context, resp *http.Response) {
+	md := MetadataFrom(ctx)
+	if md == nil {
+		return
+	}
+	*md = Metadata{
+		ContentType: resp.Header.Get("Content-Type"),
+		ETag:        resp.Header.Get("ETag"),
+	}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		md.LastModified = lastModified
+	}
+	for key, values := range resp.Header {
+		if strings.HasPrefix(strings.ToLower(key), "x-") {
+			if md.Custom == nil {
+				md.Custom = make(http.Header)
+			}
+			md.Custom[key] = values
+		}
+	}
+}
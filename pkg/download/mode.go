@@ -0,0 +1,79 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+)
+
+// Mode forces how a file is fetched in consistent hashing mode, whatever Options.CacheableURIPrefixes says of it.
+type Mode string
+
+const (
+	// ModeBuffer fetches the file from origin in buffer mode, bypassing the cache hosts.
+	ModeBuffer Mode = "buffer"
+	// ModeConsistentHashing fetches the file from the cache hosts, as if its URL matched a cacheable prefix.
+	ModeConsistentHashing Mode = "consistent-hashing"
+)
+
+// ParseMode returns the Mode named name. It is empty if name is.
+func ParseMode(name string) (Mode, error) {
+	switch mode := Mode(name); mode {
+	case "", ModeBuffer, ModeConsistentHashing:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("invalid download mode %s, expected %s or %s", name, ModeBuffer, ModeConsistentHashing)
+	}
+}
+
+// checkHostModes returns an error if Options.HostModes forces an unknown mode, or consistent hashing mode without
+// a sliced cache to fetch files from.
+func (o *Options) checkHostModes() error {
+	for host, mode := range o.HostModes {
+		if _, err := ParseMode(string(mode)); err != nil || mode == "" {
+			return fmt.Errorf("invalid download mode %q for %s", mode, host)
+		}
+		if mode == ModeConsistentHashing && o.SliceSize == 0 {
+			return fmt.Errorf("%s mode for %s requires cache hosts in consistent hashing mode", mode, host)
+		}
+	}
+	return nil
+}
+
+type modeKey struct{}
+
+// WithMode returns a context that forces the files fetched with it in consistent hashing mode to be fetched in
+// mode, taking precedence over Options.HostModes. ctx is returned as it is if mode is empty. Other strategies
+// ignore it.
+func WithMode(ctx context.Context, mode Mode) context.Context {
+	if mode == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, modeKey{}, mode)
+}
+
+// modeFor returns the mode forced for u by the context or by Options.HostModes, or "" if there is none.
+func (o *Options) modeFor(ctx context.Context, u *url.URL) Mode {
+	if mode, ok := ctx.Value(modeKey{}).(Mode); ok {
+		return mode
+	}
+	return o.HostModes[u.Host]
+}
+
+// cacheable reports whether u is fetched from the cache hosts in consistent hashing mode: either its mode is
+// forced, or it matches one of Options.CacheableURIPrefixes.
+func (o *Options) cacheable(ctx context.Context, u *url.URL) bool {
+	switch o.modeFor(ctx, u) {
+	case ModeBuffer:
+		return false
+	case ModeConsistentHashing:
+		return true
+	}
+	for _, pfx := range o.CacheableURIPrefixes[u.Host] {
+		if pfx.Path == "/" || strings.HasPrefix(u.Path, pfx.Path) {
+			return true
+		}
+	}
+	return false
+}
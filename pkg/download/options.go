@@ -3,15 +3,23 @@ package download
 import (
 	"net/url"
 	"runtime"
+	"time"
 
 	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/consistent"
 )
 
 type Options struct {
-	// Maximum number of chunks to download. If set to zero, GOMAXPROCS*4
-	// will be used.
+	// Maximum number of chunks to download at once, of all files and hosts
+	// together. If set to zero, GOMAXPROCS*4 will be used.
 	MaxConcurrency int
 
+	// MaxConnectionsPerHost, if non-zero, is the maximum number of chunks
+	// of files of the same host (the host of their URL, before any
+	// redirect) to download at once, so that a slow host doesn't take all
+	// of MaxConcurrency while the files of other hosts wait.
+	MaxConnectionsPerHost int
+
 	// SliceSize is the number of bytes per slice in nginx.
 	// See https://nginx.org/en/docs/http/ngx_http_slice_module.html
 	SliceSize int64
@@ -19,6 +27,12 @@ type Options struct {
 	// Number of bytes per chunk. If set to zero, 125 MiB will be used.
 	ChunkSize int64
 
+	// MaxBufferMemory, if non-zero, is the most memory the chunk buffers of
+	// all the files being downloaded may use at once. Chunk requests wait for
+	// a buffer to be freed once it is reached, rather than exhausting memory.
+	// At least one chunk is downloaded at a time, whatever the budget.
+	MaxBufferMemory int64
+
 	Client client.Options
 
 	// CacheableURIPrefixes is an allowlist of domains+path-prefixes which may
@@ -37,10 +51,59 @@ type Options struct {
 	// correspond to a cache host which is currently unavailable.
 	CacheHosts []string
 
+	// CacheHostsRefresh, if set, returns the current CacheHosts. It is
+	// called every CacheHostsRefreshInterval (if non-zero) and when a
+	// request to a cache host fails, so that slices not fetched yet are
+	// mapped to the current cache fleet.
+	CacheHostsRefresh         func() ([]string, error)
+	CacheHostsRefreshInterval time.Duration
+
 	// ForceCachePrefixRewrite will forcefully rewrite the prefix for all
 	// rpget requests to the first item in the CacheHosts list. This ignores
 	// anything in the CacheableURIPrefixes and rewrites all requests.
 	ForceCachePrefixRewrite bool
+
+	// HealthCheck configures the active health checking of CacheHosts in
+	// consistent hashing mode: unhealthy hosts are ejected from the ring
+	// until they recover.
+	HealthCheck HealthCheckOptions
+
+	// HedgeAfter, if non-zero, is how long to wait for the response to a
+	// chunk request before sending a duplicate request, to another cache
+	// host in consistent hashing mode. Whichever response arrives first is
+	// used and the other request is cancelled.
+	HedgeAfter time.Duration
+
+	// ProxyAuthHeader, if set, is sent as the Authorization header of
+	// requests in buffer mode, unless the request was redirected.
+	ProxyAuthHeader string
+
+	// Fallback selects how files and chunks are fetched in consistent
+	// hashing mode when the cache hosts can't serve them. If empty,
+	// FallbackOrigin will be used. Files of hosts which aren't in
+	// CacheableURIPrefixes (or forced to ModeBuffer) are always fetched
+	// from origin.
+	Fallback FallbackMode
+
+	// FallbackMirrorURL is the base URL of the mirror files are fetched from
+	// with FallbackMirror.
+	FallbackMirrorURL string
+
+	// HostModes forces the mode files of these hosts (keyed by host, as in
+	// CacheableURIPrefixes) are fetched in, in consistent hashing mode. A
+	// context returned by WithMode takes precedence.
+	HostModes map[string]Mode
+
+	// RingAlgorithm maps slices to CacheHosts in consistent hashing mode.
+	// If nil, consistent.Jump will be used.
+	RingAlgorithm consistent.Algorithm
+}
+
+func (o *Options) ringAlgorithm() consistent.Algorithm {
+	if o.RingAlgorithm == nil {
+		return consistent.Jump{}
+	}
+	return o.RingAlgorithm
 }
 
 func (o *Options) maxConcurrency() int {
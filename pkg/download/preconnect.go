@@ -0,0 +1,51 @@
+package download
+
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// warmUpper is implemented by the clients which can establish connections ahead of requests (see
+// client.RPGetHTTPClient.WarmUp).
+type warmUpper interface {
+	WarmUp(ctx context.Context, hosts []string) error
+}
+
+// preconnector warms up the connections of a strategy to the hosts it downloads from, the first time each is
+// requested, if client.TransportOptions.Preconnect is set.
+type preconnector struct {
+	warmed sync.Map
+}
+
+// warmUp establishes connections to the hosts of urls not warmed up yet in the background, alongside the first
+// request, so that the chunk requests which follow it don't wait for handshakes.
+func (p *preconnector) warmUp(ctx context.Context, c client.HTTPClient, opts Options, urls ...string) {
+	w, ok := c.(warmUpper)
+	if !ok || opts.Client.Transport != nil || opts.Client.TransportOpts.Preconnect <= 0 {
+		return
+	}
+	var hosts []string
+	for _, rawURL := range urls {
+		u, err := url.Parse(rawURL)
+		if err != nil {
+			continue
+		}
+		host := u.Scheme + "://" + u.Host
+		if _, warmed := p.warmed.LoadOrStore(host, true); !warmed {
+			hosts = append(hosts, host)
+		}
+	}
+	if len(hosts) == 0 {
+		return
+	}
+	go func() {
+		if err := w.WarmUp(ctx, hosts); err != nil {
+			logger := logging.GetLogger()
+			logger.Debug().Err(err).Strs("hosts", hosts).Msg("Preconnect failed")
+		}
+	}()
+}
@@ -0,0 +1,182 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// prefetchTTL is how long the first chunk of a file fetched by Prefetch is kept for Fetch, so that files prefetched
+// but never fetched don't hold their memory for good, and those which are fetched aren't stale.
+const prefetchTTL = time.Minute
+
+// Prefetcher is implemented by the strategies which can fetch the first chunk of a file ahead of Fetch.
+type Prefetcher interface {
+	// Prefetch requests the first chunk of url and keeps it in memory for the next Fetch of url, which then returns
+	// at once and requests the remaining chunks straight away, unless it comes more than a minute later.
+	Prefetch(ctx context.Context, url string) error
+}
+
+// firstChunkTaker is implemented by the strategies which can take the response to the first request of a file, made
+// by another strategy, rather than requesting it again.
+type firstChunkTaker interface {
+	// takeFirstChunk reads resp, the response to a request for the first chunkSize bytes of url, of fileSize
+	// bytes, and keeps it for the next Fetch of url, as Prefetch would. resp is left unread if it doesn't have the
+	// first chunk of the strategy. If reading it fails, the next Fetch requests it again.
+	takeFirstChunk(url string, resp *http.Response, fileSize, chunkSize int64) error
+}
+
+// firstChunkHolder is implemented by the strategies which can hold the first chunk of a file, prefetched or taken.
+type firstChunkHolder interface {
+	// holdsFirstChunk reports whether the next Fetch of url starts with a first chunk held already.
+	holdsFirstChunk(url string) bool
+}
+
+// prefetchedChunk is the response to the first request of a file, made by Prefetch or by another strategy.
+type prefetchedChunk struct {
+	result firstReqResult
+	// resp has the headers of the response, for its metadata, and data its body
+	resp *http.Response
+	data []byte
+}
+
+// prefetchedChunks holds the first chunks fetched by Prefetch, by URL, until they are fetched or expire.
+type prefetchedChunks struct {
+	chunks sync.Map
+}
+
+func (p *prefetchedChunks) put(url string, chunk *prefetchedChunk) {
+	p.chunks.Store(url, chunk)
+	time.AfterFunc(prefetchTTL, func() {
+		p.chunks.CompareAndDelete(url, chunk)
+	})
+}
+
+func (p *prefetchedChunks) has(url string) bool {
+	_, ok := p.chunks.Load(url)
+	return ok
+}
+
+// take returns the first chunk of url, which is then no longer held, or nil if it wasn't prefetched.
+func (p *prefetchedChunks) take(url string) *prefetchedChunk {
+	if chunk, ok := p.chunks.LoadAndDelete(url); ok {
+		return chunk.(*prefetchedChunk)
+	}
+	return nil
+}
+
+// deliver hands chunk to Fetch as the first request would (see BufferMode.Fetch).
+func (chunk *prefetchedChunk) deliver(ctx context.Context, results chan<- firstReqResult, firstChunk *readerPromise) {
+	defer close(results)
+	recordMetadata(ctx, chunk.resp)
+	results <- chunk.result
+	chunkReceived(ctx, 0, int64(len(chunk.data))-1, chunk.result.fileSize)
+	firstChunk.Deliver(chunk.data, nil)
+}
+
+// Prefetch requests the first chunk of url, as Fetch would, and keeps it for Fetch (see Prefetcher). The request
+// waits for a slot of its host like the others.
+func (m *BufferMode) Prefetch(ctx context.Context, url string) error {
+	m.preconnect.warmUp(ctx, m.Client, m.Options, url)
+	var err error
+	done := make(chan struct{})
+	if submitErr := m.queue.submitLowUnbuffered(ctx, hostOf(url), func() {
+		defer close(done)
+		err = m.prefetch(ctx, url)
+	}); submitErr != nil {
+		return submitErr
+	}
+	<-done
+	return err
+}
+
+func (m *BufferMode) prefetch(ctx context.Context, url string) error {
+	logger := logging.GetLogger()
+
+	requestURL := url
+	if m.CacheHosts != nil {
+		requestURL = m.rewriteUrlForCache(url)
+	}
+	resp, err := m.DoRequest(ctx, 0, m.chunkSize()-1, requestURL)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	trueURL := resp.Request.URL.String()
+	if trueURL != requestURL {
+		logger.Info().Str("url", requestURL).Str("redirect_url", trueURL).Msg("Redirect")
+		m.redirected = true
+	}
+	fileSize, err := fileSizeFromResponse(resp)
+	if err != nil {
+		return err
+	}
+	contentLength := resp.ContentLength
+	if contentLength < 0 || contentLength > m.chunkSize() {
+		// e.g. a server ignoring the range, sending the whole file
+		return fmt.Errorf("can't prefetch %s: expected at most %d bytes, got %d", url, m.chunkSize(), contentLength)
+	}
+	return m.keepFirstChunk(url, resp, fileSize)
+}
+
+// keepFirstChunk reads resp, the response to the first request of url, of fileSize bytes, whose length is known,
+// and keeps it for the next Fetch of url.
+func (m *BufferMode) keepFirstChunk(url string, resp *http.Response, fileSize int64) error {
+	logger := logging.GetLogger()
+	data := make([]byte, resp.ContentLength)
+	n, err := io.ReadFull(resp.Body, data)
+	if err == io.ErrUnexpectedEOF {
+		logger.Warn().
+			Int("connection_interrupted_at_byte", n).
+			Msg("Resuming Chunk Download")
+		n, err = resumeDownload(resp.Request, data[n:], m.Client, int64(n))
+	}
+	if err != nil {
+		return err
+	}
+	m.prefetched.put(url, &prefetchedChunk{
+		result: firstReqResult{fileSize: fileSize, trueURL: resp.Request.URL.String(), validators: validatorsFromResponse(resp)},
+		resp:   &http.Response{Header: resp.Header},
+		data:   data[:n],
+	})
+	return nil
+}
+
+func (m *BufferMode) holdsFirstChunk(url string) bool {
+	return m.prefetched.has(url)
+}
+
+// takeFirstChunk keeps resp for the next Fetch of url if it has the first chunk of the file, see firstChunkTaker.
+// Files fetched through the cache hosts aren't taken, as their first request must be to a cache host.
+func (m *BufferMode) takeFirstChunk(url string, resp *http.Response, fileSize, chunkSize int64) error {
+	if m.CacheHosts != nil || chunkSize != m.chunkSize() || resp.ContentLength != chunkSize {
+		return nil
+	}
+	if resp.Request.URL.String() != url {
+		m.redirected = true
+	}
+	return m.keepFirstChunk(url, resp, fileSize)
+}
+
+// Prefetch prefetches the first chunk of the files of hosts which aren't cached, see BufferMode.Prefetch. For the
+// files of the cache hosts, it only requests their first byte, which leaves a connection open to the cache host of
+// their first slice.
+func (m *ConsistentHashingMode) Prefetch(ctx context.Context, urlString string) error {
+	parsed, err := url.Parse(urlString)
+	if err != nil {
+		return err
+	}
+	if !m.cacheable(ctx, parsed) {
+		return m.origin.Prefetch(ctx, urlString)
+	}
+	m.warmUpCacheHosts(ctx)
+	_, err = Stat(ctx, m, urlString)
+	return err
+}
@@ -0,0 +1,25 @@
+package download
+
+import "context"
+
+// Chunk is the byte range of a file fetched by a single request, End included.
+type Chunk struct {
+	Start int64
+	End   int64
+}
+
+type chunkCallbackKey struct{}
+
+// WithChunkCallback returns a context that causes BufferMode and ConsistentHashingMode to call fn with every chunk
+// of a file fetched with it, and the size of the file, once the chunk has been received. fn is called from the
+// goroutines downloading the chunks, so it must be safe for concurrent use and should return quickly.
+func WithChunkCallback(ctx context.Context, fn func(chunk Chunk, fileSize int64)) context.Context {
+	return context.WithValue(ctx, chunkCallbackKey{}, fn)
+}
+
+// chunkReceived calls the chunk callback of ctx, if any, for the chunk from start to end.
+func chunkReceived(ctx context.Context, start, end, fileSize int64) {
+	if fn, ok := ctx.Value(chunkCallbackKey{}).(func(Chunk, int64)); ok {
+		fn(Chunk{Start: start, End: end}, fileSize)
+	}
+}
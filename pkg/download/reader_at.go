@@ -0,0 +1,265 @@
+package download
+
+import (
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+const (
+	defaultBlockSize      = humanize.MiByte
+	defaultBlockCacheSize = 64 * humanize.MiByte
+)
+
+// ErrRangeNotSupported is returned by a ReaderAt when the server ignores range requests.
+var ErrRangeNotSupported = errors.New("server does not support range requests")
+
+type ReaderAtOptions struct {
+	Client client.Options
+
+	// BlockSize is the number of bytes fetched by a range request. If set
+	// to zero, 1 MiB will be used.
+	BlockSize int64
+
+	// CacheSize is the number of bytes of the most recently read blocks
+	// kept in memory. If set to zero, 64 MiB will be used; at least one
+	// block is cached.
+	CacheSize int64
+}
+
+// ReaderAt reads a remote file on demand: every read fetches the blocks it spans with range requests, unless they
+// are in its LRU cache. It is safe for concurrent use. All blocks come from the version of the file found by
+// NewReaderAt, reads fail with ErrObjectChanged if it is replaced.
+type ReaderAt struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	client    client.HTTPClient
+	url       string
+	size      int64
+	blockSize int64
+	maxBlocks int
+
+	mu     sync.Mutex
+	closed bool
+	// lru holds the cached blocks, most recently used first
+	lru      *list.List
+	blocks   map[int64]*list.Element
+	fetching map[int64]*blockFetch
+}
+
+type cachedBlock struct {
+	index int64
+	data  []byte
+}
+
+// blockFetch is a block being fetched, which concurrent reads of the same block wait for.
+type blockFetch struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+var _ io.ReaderAt = &ReaderAt{}
+var _ io.Closer = &ReaderAt{}
+
+// NewReaderAt returns a ReaderAt for the file at url, fetching its first block to find its size. The requests of
+// the ReaderAt are cancelled once ctx is done or the ReaderAt is closed.
+func NewReaderAt(ctx context.Context, url string, opts ReaderAtOptions) (*ReaderAt, error) {
+	blockSize := opts.BlockSize
+	if blockSize <= 0 {
+		blockSize = defaultBlockSize
+	}
+	cacheSize := opts.CacheSize
+	if cacheSize <= 0 {
+		cacheSize = defaultBlockCacheSize
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	r := &ReaderAt{
+		cancel:    cancel,
+		client:    client.NewHTTPClient(opts.Client),
+		url:       url,
+		blockSize: blockSize,
+		maxBlocks: int(max(cacheSize/blockSize, 1)),
+		lru:       list.New(),
+		blocks:    make(map[int64]*list.Element),
+		fetching:  make(map[int64]*blockFetch),
+	}
+
+	resp, err := r.request(ctx, 0, blockSize-1)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if r.size, err = fileSizeFromResponse(resp); err != nil {
+		cancel()
+		return nil, err
+	}
+	// later requests go to the redirect target, and are pinned to this version of the file
+	r.url = resp.Request.URL.String()
+	r.ctx = withValidators(ctx, validatorsFromResponse(resp))
+	data, err := r.readBlock(resp, 0, min(blockSize, r.size))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	r.mu.Lock()
+	r.cache(0, data)
+	r.mu.Unlock()
+	return r, nil
+}
+
+// Size returns the size of the remote file.
+func (r *ReaderAt) Size() int64 {
+	return r.size
+}
+
+// ReadAt implements io.ReaderAt.
+func (r *ReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, fmt.Errorf("negative offset %d", off)
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	n := 0
+	for n < len(p) && off < r.size {
+		index := off / r.blockSize
+		block, err := r.block(index)
+		if err != nil {
+			return n, err
+		}
+		copied := copy(p[n:], block[off-index*r.blockSize:])
+		n += copied
+		off += int64(copied)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// Close cancels the pending requests and drops the cached blocks. Reads fail with os.ErrClosed once closed.
+func (r *ReaderAt) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	r.cancel()
+	r.lru.Init()
+	clear(r.blocks)
+	return nil
+}
+
+// block returns the block at index from the cache, or fetches it.
+func (r *ReaderAt) block(index int64) ([]byte, error) {
+	r.mu.Lock()
+	if r.closed {
+		r.mu.Unlock()
+		return nil, os.ErrClosed
+	}
+	if elem, ok := r.blocks[index]; ok {
+		r.lru.MoveToFront(elem)
+		r.mu.Unlock()
+		return elem.Value.(*cachedBlock).data, nil
+	}
+	if fetch, ok := r.fetching[index]; ok {
+		r.mu.Unlock()
+		<-fetch.done
+		return fetch.data, fetch.err
+	}
+	fetch := &blockFetch{done: make(chan struct{})}
+	r.fetching[index] = fetch
+	r.mu.Unlock()
+
+	fetch.data, fetch.err = r.fetchBlock(index)
+	r.mu.Lock()
+	delete(r.fetching, index)
+	if fetch.err == nil {
+		r.cache(index, fetch.data)
+	}
+	r.mu.Unlock()
+	close(fetch.done)
+	return fetch.data, fetch.err
+}
+
+// cache adds a block to the cache, evicting the least recently used blocks beyond its capacity. r.mu must be held.
+func (r *ReaderAt) cache(index int64, data []byte) {
+	if r.closed {
+		return
+	}
+	r.blocks[index] = r.lru.PushFront(&cachedBlock{index: index, data: data})
+	for r.lru.Len() > r.maxBlocks {
+		oldest := r.lru.Back()
+		r.lru.Remove(oldest)
+		delete(r.blocks, oldest.Value.(*cachedBlock).index)
+	}
+}
+
+func (r *ReaderAt) fetchBlock(index int64) ([]byte, error) {
+	logger := logging.GetLogger()
+	start := index * r.blockSize
+	end := min(start+r.blockSize, r.size) - 1
+	logger.Debug().
+		Str("url", r.url).
+		Int64("start", start).
+		Int64("end", end).
+		Msg("Fetching block")
+	resp, err := r.request(r.ctx, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return r.readBlock(resp, start, end-start+1)
+}
+
+func (r *ReaderAt) request(ctx context.Context, start, end int64) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, r.url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", r.url, err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	setConditionalHeaders(req)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error executing request for %s: %w", req.URL.String(), err)
+	}
+	if err := checkResponseStatus(req, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// readBlock reads the block of length bytes starting at start from resp. A server ignoring the range answers with
+// the whole file, which is only a block if the file fits in one.
+func (r *ReaderAt) readBlock(resp *http.Response, start, length int64) ([]byte, error) {
+	logger := logging.GetLogger()
+	if resp.StatusCode != http.StatusPartialContent && (start != 0 || resp.ContentLength > r.blockSize) {
+		return nil, fmt.Errorf("%w: %s returned %s", ErrRangeNotSupported, r.url, resp.Status)
+	}
+	if resp.ContentLength != length {
+		return nil, fmt.Errorf("%w: expected %d bytes from %s at offset %d, got %d", errInvalidContentRange, length, r.url, start, resp.ContentLength)
+	}
+	buf := make([]byte, length)
+	n, err := io.ReadFull(resp.Body, buf)
+	if err == io.ErrUnexpectedEOF {
+		logger.Warn().
+			Int("connection_interrupted_at_byte", n).
+			Msg("Resuming Chunk Download")
+		_, err = resumeDownload(resp.Request, buf[n:], r.client, int64(n))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
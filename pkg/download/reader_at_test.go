@@ -0,0 +1,102 @@
+package download_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"math/rand"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/download"
+	"github.com/emaballarin/rpget/pkg/testserver"
+)
+
+func TestReaderAt(t *testing.T) {
+	content := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(content)
+	server := testserver.New(map[string][]byte{"/file.bin": content})
+	defer server.Close()
+	requests := server.Requests
+
+	r, err := download.NewReaderAt(context.Background(), server.URL+"/file.bin", download.ReaderAtOptions{BlockSize: 1000, CacheSize: 3000})
+	require.NoError(t, err)
+	defer r.Close()
+	assert.Equal(t, int64(len(content)), r.Size())
+	assert.Equal(t, int64(1), requests())
+
+	// the first block is cached by NewReaderAt
+	buf := make([]byte, 100)
+	n, err := r.ReadAt(buf, 10)
+	require.NoError(t, err)
+	assert.Equal(t, 100, n)
+	assert.Equal(t, content[10:110], buf)
+	assert.Equal(t, int64(1), requests())
+
+	// a read spanning blocks fetches each of them
+	buf = make([]byte, 1500)
+	_, err = r.ReadAt(buf, 1900)
+	require.NoError(t, err)
+	assert.Equal(t, content[1900:3400], buf)
+	assert.Equal(t, int64(4), requests())
+
+	// the cache holds 3 blocks: block 0 was evicted
+	_, err = r.ReadAt(buf[:10], 0)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5), requests())
+
+	// reading past the end returns what's left
+	n, err = r.ReadAt(buf, 9500)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, 500, n)
+	assert.Equal(t, content[9500:], buf[:n])
+	_, err = r.ReadAt(buf, 10000)
+	assert.Equal(t, io.EOF, err)
+
+	// concurrent reads of a block fetch it once
+	before := requests()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			buf := make([]byte, 10)
+			_, err := r.ReadAt(buf, 5000+int64(i))
+			assert.NoError(t, err)
+			assert.Equal(t, content[5000+i:5010+i], buf)
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, before+1, requests())
+
+	// io.SectionReader turns it into a regular reader
+	data, err := io.ReadAll(io.NewSectionReader(r, 0, r.Size()))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	require.NoError(t, r.Close())
+	_, err = r.ReadAt(buf, 0)
+	assert.ErrorIs(t, err, os.ErrClosed)
+}
+
+func TestReaderAtRangeNotSupported(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 2000)
+	server := testserver.New(map[string][]byte{"/file.bin": content}, testserver.IgnoreRange())
+	defer server.Close()
+
+	_, err := download.NewReaderAt(context.Background(), server.URL+"/file.bin", download.ReaderAtOptions{BlockSize: 1000})
+	assert.ErrorIs(t, err, download.ErrRangeNotSupported)
+
+	// a file fitting in a block is read whole
+	r, err := download.NewReaderAt(context.Background(), server.URL+"/file.bin", download.ReaderAtOptions{BlockSize: 4000})
+	require.NoError(t, err)
+	defer r.Close()
+	buf := make([]byte, 2000)
+	_, err = r.ReadAt(buf, 0)
+	require.NoError(t, err)
+	assert.Equal(t, content, buf)
+}
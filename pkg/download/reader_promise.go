@@ -2,7 +2,9 @@ package download
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"sync"
 )
 
 // A readerPromise represents an io.Reader whose implementation is not yet
@@ -11,19 +13,25 @@ import (
 //
 // The intended use is: a consumer goroutine calls Read(), which blocks until
 // data is ready.  A producer calls Deliver().  These block
-// until the consumer has read the provided data or error.
+// until the consumer has read the provided data or error, or has abandoned it.
 type readerPromise struct {
 	// ready channel is closed when we're ready to read
 	ready chan struct{}
 	// finished channel is closed when we're done reading
 	finished chan struct{}
-	buf      []byte
+	// abandoned channel is closed when the consumer won't read; it is nil if
+	// the promise can't be abandoned
+	abandoned <-chan struct{}
+	buf       []byte
 	// if reader is non-nil, buf is always the underlying buffer for the reader
 	reader *bytes.Reader
 	err    error
 }
 
-var _ io.Reader = &readerPromise{}
+var (
+	_ io.Reader   = &readerPromise{}
+	_ io.WriterTo = &readerPromise{}
+)
 
 func newReaderPromise() *readerPromise {
 	return &readerPromise{
@@ -51,6 +59,26 @@ func (b *readerPromise) Read(buf []byte) (int, error) {
 	return n, err
 }
 
+// WriteTo implements io.WriterTo, writing the body to w straight from its buffer, so that io.Copy doesn't copy it
+// through a buffer of its own first. Like Read, it blocks until the body is available.
+func (b *readerPromise) WriteTo(w io.Writer) (int64, error) {
+	<-b.ready
+	if b.err == io.EOF {
+		return 0, nil
+	}
+	if b.err != nil {
+		return 0, b.err
+	}
+	n, err := b.reader.WriteTo(w)
+	if err != nil {
+		return n, err
+	}
+	close(b.finished)
+	b.buf = nil
+	b.err = io.EOF
+	return n, nil
+}
+
 func (b *readerPromise) Deliver(buf []byte, err error) {
 	if buf == nil {
 		buf = []byte{}
@@ -59,5 +87,64 @@ func (b *readerPromise) Deliver(buf []byte, err error) {
 	b.err = err
 	b.reader = bytes.NewReader(buf)
 	close(b.ready)
-	<-b.finished
+	select {
+	case <-b.finished:
+	case <-b.abandoned:
+	}
+}
+
+// chunkedReader reads the chunks of a file in order, as they are delivered. Once it is read to the end, fails or is
+// closed, the chunks not read are abandoned: their producers stop waiting for them to be read, releasing their
+// workers and buffers, and the requests of those not delivered yet are canceled, so that a consumer failing
+// part-way through a file doesn't leave workers waiting for it for good.
+type chunkedReader struct {
+	io.Reader
+	abandoned chan struct{}
+	cancel    context.CancelFunc
+	once      sync.Once
+}
+
+var (
+	_ io.ReadCloser = &chunkedReader{}
+	_ io.WriterTo   = &chunkedReader{}
+)
+
+// newChunkedReader returns a reader for chunks made with newChunk, and the context of their requests, canceled once
+// they are abandoned. Its Reader is set once the chunks are known.
+func newChunkedReader(ctx context.Context) (context.Context, *chunkedReader) {
+	ctx, cancel := context.WithCancel(ctx)
+	return ctx, &chunkedReader{abandoned: make(chan struct{}), cancel: cancel}
+}
+
+// newChunk returns a promise of a chunk of r, abandoned along with it.
+func (r *chunkedReader) newChunk() *readerPromise {
+	chunk := newReaderPromise()
+	chunk.abandoned = r.abandoned
+	return chunk
+}
+
+func (r *chunkedReader) Read(buf []byte) (int, error) {
+	n, err := r.Reader.Read(buf)
+	if err != nil {
+		r.abandon()
+	}
+	return n, err
+}
+
+func (r *chunkedReader) WriteTo(w io.Writer) (int64, error) {
+	defer r.abandon()
+	return io.Copy(w, r.Reader)
+}
+
+// Close abandons the chunks not read yet.
+func (r *chunkedReader) Close() error {
+	r.abandon()
+	return nil
+}
+
+func (r *chunkedReader) abandon() {
+	r.once.Do(func() {
+		close(r.abandoned)
+		r.cancel()
+	})
 }
@@ -2,12 +2,15 @@ package download
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestReaderPromiseParallel(t *testing.T) {
@@ -61,3 +64,69 @@ func TestReaderPromiseSubsequentReadsReturnEOF(t *testing.T) {
 	assert.Equal(t, 0, n)
 	assert.ErrorIs(t, err, io.EOF)
 }
+
+func TestReaderPromiseWriteTo(t *testing.T) {
+	p := newReaderPromise()
+	delivered := make(chan struct{})
+	go func() {
+		p.Deliver([]byte("foobar"), nil)
+		close(delivered)
+	}()
+	first := make([]byte, 3)
+	_, err := p.Read(first)
+	assert.NoError(t, err)
+	var buf bytes.Buffer
+	n, err := io.Copy(&buf, p)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), n)
+	assert.Equal(t, "bar", buf.String())
+	// the producer is unblocked once the body is written
+	<-delivered
+	n, err = p.WriteTo(&buf)
+	assert.NoError(t, err)
+	assert.Zero(t, n)
+}
+
+func TestChunkedReaderAbandon(t *testing.T) {
+	ctx, reader := newChunkedReader(context.Background())
+	first, second := reader.newChunk(), reader.newChunk()
+	reader.Reader = io.MultiReader(first, second)
+	delivered := make(chan struct{}, 2)
+	go func() {
+		first.Deliver(nil, fmt.Errorf("oh no"))
+		delivered <- struct{}{}
+	}()
+	go func() {
+		second.Deliver([]byte("foobar"), nil)
+		delivered <- struct{}{}
+	}()
+
+	// the first chunk fails, so the second is never read: its producer is unblocked all the same
+	_, err := io.ReadAll(reader)
+	assert.ErrorContains(t, err, "oh no")
+	for range 2 {
+		select {
+		case <-delivered:
+		case <-time.After(5 * time.Second):
+			t.Fatal("a producer is still waiting for its chunk to be read")
+		}
+	}
+	assert.ErrorIs(t, ctx.Err(), context.Canceled)
+}
+
+func TestChunkedReaderClose(t *testing.T) {
+	_, reader := newChunkedReader(context.Background())
+	chunk := reader.newChunk()
+	reader.Reader = chunk
+	delivered := make(chan struct{})
+	go func() {
+		chunk.Deliver([]byte("foobar"), nil)
+		close(delivered)
+	}()
+	require.NoError(t, reader.Close())
+	select {
+	case <-delivered:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the producer is still waiting for its chunk to be read")
+	}
+}
@@ -0,0 +1,55 @@
+package download
+
+import (
+	"fmt"
+	"net/url"
+)
+
+// A SliceOwner is the cache host a slice of a file is fetched from in consistent hashing mode.
+type SliceOwner struct {
+	Slice int64 `json:"slice"`
+	// Start and End are the first and last byte of the slice.
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+	// Bucket is the index of Host in Options.CacheHosts, -1 if the slice is fetched with the fallback strategy
+	// because neither its cache host nor the next one is available.
+	Bucket int    `json:"bucket"`
+	Host   string `json:"host,omitempty"`
+}
+
+// RingOwners returns the owner of every slice of the file of size bytes at urlString, as consistent hashing mode
+// with opts maps them to opts.CacheHosts. Like a download, a slice whose cache host is unavailable (an empty entry
+// of CacheHosts) is fetched from the next one of the ring, if it is available. Health checks and refreshes of the
+// cache hosts are not taken into account.
+func RingOwners(opts Options, urlString string, size int64) ([]SliceOwner, error) {
+	if opts.SliceSize <= 0 {
+		return nil, fmt.Errorf("must specify slice size in consistent hashing mode")
+	}
+	if len(opts.CacheHosts) == 0 {
+		return nil, fmt.Errorf("no cache hosts")
+	}
+	parsed, err := url.Parse(urlString)
+	if err != nil {
+		return nil, err
+	}
+	algorithm := opts.ringAlgorithm()
+	owners := make([]SliceOwner, 0, (size+opts.SliceSize-1)/opts.SliceSize)
+	for start := int64(0); start < size; start += opts.SliceSize {
+		key := CacheKey{URL: parsed, Slice: start / opts.SliceSize}
+		bucket, err := algorithm.Bucket(key, len(opts.CacheHosts))
+		if err != nil {
+			return nil, err
+		}
+		if opts.CacheHosts[bucket] == "" && len(opts.CacheHosts) > 1 {
+			if bucket, err = algorithm.Bucket(key, len(opts.CacheHosts), bucket); err != nil {
+				return nil, err
+			}
+		}
+		owner := SliceOwner{Slice: key.Slice, Start: start, End: min(start+opts.SliceSize, size) - 1, Bucket: bucket}
+		if owner.Host = opts.CacheHosts[bucket]; owner.Host == "" {
+			owner.Bucket = -1
+		}
+		owners = append(owners, owner)
+	}
+	return owners, nil
+}
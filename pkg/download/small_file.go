@@ -0,0 +1,271 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sync"
+
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// SmallFileMode is a Strategy for datasets made of many small files. Each file is fetched with a single
+// request whose body is streamed straight to the caller, skipping the chunk buffers entirely. All requests share one
+// client, and therefore one pool of keep-alive (or HTTP/2) connections. Requests wait for a slot of their host in the
+// work queue of Next, if it has one, holding it until their body is read, so that they count towards the same
+// connection limits as the chunks of Next.
+//
+// Files larger than Threshold are handed off to Next, along with the response to their first request if Next can
+// use it as their first chunk (see BufferMode): the threshold should be the chunk size of Next.
+//
+// The reader returned by Fetch is an io.ReadCloser, which must be closed if it isn't read to the end.
+type SmallFileMode struct {
+	Client    client.HTTPClient
+	Threshold int64
+	Next      Strategy
+	// ProxyAuthHeader, if set, is sent as the Authorization header of requests, as in BufferMode.
+	ProxyAuthHeader string
+
+	// queue is nil if requests aren't limited, e.g. because they are made by a work item already
+	queue *priorityWorkQueue
+}
+
+var (
+	_ WriterAtStrategy = &SmallFileMode{}
+	_ Prefetcher       = &SmallFileMode{}
+)
+
+// queuedStrategy is implemented by the strategies submitting their requests to a work queue.
+type queuedStrategy interface {
+	workQueue() *priorityWorkQueue
+}
+
+func GetSmallFileMode(opts Options, threshold int64, next Strategy) *SmallFileMode {
+	m := &SmallFileMode{
+		Client:          client.NewHTTPClient(opts.Client),
+		Threshold:       threshold,
+		Next:            next,
+		ProxyAuthHeader: opts.ProxyAuthHeader,
+	}
+	if queued, ok := next.(queuedStrategy); ok {
+		m.queue = queued.workQueue()
+	} else {
+		m.queue = newWorkQueue(opts.maxConcurrency(), opts.MaxConnectionsPerHost, 0, 0)
+		m.queue.start()
+	}
+	return m
+}
+
+func (m *SmallFileMode) Fetch(ctx context.Context, url string) (io.Reader, int64, error) {
+	if m.nextHoldsFirstChunk(url) {
+		return m.Next.Fetch(ctx, url)
+	}
+	resp, release, err := m.request(ctx, url)
+	if err != nil {
+		return nil, -1, err
+	}
+	fileSize, err := fileSizeFromResponse(resp)
+	if err != nil {
+		resp.Body.Close()
+		release()
+		return nil, -1, err
+	}
+	if fileSize > m.Threshold {
+		m.handOff(url, resp, fileSize)
+		release()
+		return m.Next.Fetch(ctx, url)
+	}
+	recordMetadata(ctx, resp)
+	return &closeOnEOFReader{body: resp.Body, release: release}, fileSize, nil
+}
+
+// FetchAt writes the file at url to the io.WriterAt open returns, see WriterAtStrategy. Files handed off are
+// written by Next, straight to their offsets if it is a WriterAtStrategy.
+func (m *SmallFileMode) FetchAt(ctx context.Context, url string, open func(fileSize int64) (io.WriterAt, error)) (int64, error) {
+	if m.nextHoldsFirstChunk(url) {
+		return m.fetchAtNext(ctx, url, open)
+	}
+	resp, release, err := m.request(ctx, url)
+	if err != nil {
+		return -1, err
+	}
+	fileSize, err := fileSizeFromResponse(resp)
+	if err != nil {
+		resp.Body.Close()
+		release()
+		return -1, err
+	}
+	if fileSize > m.Threshold {
+		m.handOff(url, resp, fileSize)
+		release()
+		return m.fetchAtNext(ctx, url, open)
+	}
+	defer release()
+	defer resp.Body.Close()
+	recordMetadata(ctx, resp)
+	w, err := open(fileSize)
+	if err != nil {
+		return fileSize, err
+	}
+	if err := copyAt(w, resp.Body, fileSize); err != nil {
+		return fileSize, err
+	}
+	chunkReceived(ctx, 0, fileSize-1, fileSize)
+	return fileSize, nil
+}
+
+// fetchAtNext writes the file at url with Next to the io.WriterAt open returns, straight to its offsets if Next is a
+// WriterAtStrategy, in order otherwise.
+func (m *SmallFileMode) fetchAtNext(ctx context.Context, url string, open func(fileSize int64) (io.WriterAt, error)) (int64, error) {
+	if next, ok := m.Next.(WriterAtStrategy); ok {
+		return next.FetchAt(ctx, url, open)
+	}
+	reader, fileSize, err := m.Next.Fetch(ctx, url)
+	if err != nil {
+		return fileSize, err
+	}
+	if closer, ok := reader.(io.Closer); ok {
+		defer closer.Close()
+	}
+	w, err := open(fileSize)
+	if err != nil {
+		return fileSize, err
+	}
+	return fileSize, copyAt(w, reader, fileSize)
+}
+
+// copyAt copies the fileSize bytes of r to w, from its start.
+func copyAt(w io.WriterAt, r io.Reader, fileSize int64) error {
+	n, err := io.Copy(io.NewOffsetWriter(w, 0), r)
+	if err != nil {
+		return err
+	}
+	if n != fileSize {
+		return fmt.Errorf("expected %d bytes, got %d", fileSize, n)
+	}
+	return nil
+}
+
+// Prefetch prefetches the first chunk of url with Next, see Prefetcher. The first chunk of a small file is the whole
+// file, which Fetch then takes from Next rather than requesting it again. If Next can't prefetch, only the first
+// byte of url is requested.
+func (m *SmallFileMode) Prefetch(ctx context.Context, url string) error {
+	if prefetcher, ok := m.Next.(Prefetcher); ok {
+		return prefetcher.Prefetch(ctx, url)
+	}
+	_, err := Stat(ctx, m, url)
+	return err
+}
+
+// nextHoldsFirstChunk reports whether Next holds the first chunk of url, prefetched or handed off to it.
+func (m *SmallFileMode) nextHoldsFirstChunk(url string) bool {
+	holder, ok := m.Next.(firstChunkHolder)
+	return ok && holder.holdsFirstChunk(url)
+}
+
+// request requests the first Threshold bytes of url, once it holds a slot of its host in the queue. The slot is
+// held until release is called, once the body of resp is read or closed.
+func (m *SmallFileMode) request(ctx context.Context, url string) (resp *http.Response, release func(), err error) {
+	if m.queue == nil {
+		resp, err := m.DoRequest(ctx, 0, m.Threshold-1, url)
+		return resp, func() {}, err
+	}
+	type result struct {
+		resp *http.Response
+		err  error
+	}
+	results := make(chan result, 1)
+	released := make(chan struct{})
+	if err := m.queue.submitLowUnbuffered(ctx, hostOf(url), func() {
+		resp, err := m.DoRequest(ctx, 0, m.Threshold-1, url)
+		results <- result{resp: resp, err: err}
+		if err == nil {
+			select {
+			case <-released:
+			case <-ctx.Done():
+			}
+		}
+	}); err != nil {
+		return nil, nil, err
+	}
+	r := <-results
+	if r.err != nil {
+		return nil, nil, r.err
+	}
+	var once sync.Once
+	return r.resp, func() { once.Do(func() { close(released) }) }, nil
+}
+
+// handOff hands resp, the response to the first request of url, of fileSize bytes, to Next, if it can take it as its
+// first chunk rather than requesting it again, and closes it.
+func (m *SmallFileMode) handOff(url string, resp *http.Response, fileSize int64) {
+	logger := logging.GetLogger()
+	logger.Debug().
+		Str("url", url).
+		Int64("size", fileSize).
+		Int64("threshold", m.Threshold).
+		Msg("Small file fetch: file too large, handing off")
+	defer resp.Body.Close()
+	if taker, ok := m.Next.(firstChunkTaker); ok {
+		if err := taker.takeFirstChunk(url, resp, fileSize, m.Threshold); err != nil {
+			logger.Debug().Err(err).Str("url", url).Msg("Small file fetch: first chunk not handed off")
+		}
+	}
+}
+
+func (m *SmallFileMode) DoRequest(ctx context.Context, start, end int64, url string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to download %s: %w", url, err)
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	if m.ProxyAuthHeader != "" {
+		req.Header.Set("Authorization", m.ProxyAuthHeader)
+	}
+	setConditionalHeaders(req)
+	resp, err := m.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error executing request for %s: %w", req.URL.String(), err)
+	}
+	if err := checkResponseStatus(req, resp); err != nil {
+		resp.Body.Close()
+		return nil, err
+	}
+	return resp, nil
+}
+
+// closeOnEOFReader closes the underlying response body once it has been fully read (or failed), returning
+// the connection to the pool without requiring the consumer to know it is reading from the network, and calls
+// release. Consumers stopping before the end close it.
+type closeOnEOFReader struct {
+	body    io.ReadCloser
+	release func()
+	closed  bool
+}
+
+var _ io.ReadCloser = &closeOnEOFReader{}
+
+func (r *closeOnEOFReader) Read(p []byte) (int, error) {
+	if r.closed {
+		return 0, io.EOF
+	}
+	n, err := r.body.Read(p)
+	if err != nil {
+		r.Close()
+	}
+	return n, err
+}
+
+func (r *closeOnEOFReader) Close() error {
+	if r.closed {
+		return nil
+	}
+	r.closed = true
+	err := r.body.Close()
+	if r.release != nil {
+		r.release()
+	}
+	return err
+}
@@ -0,0 +1,183 @@
+package download
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/client"
+)
+
+type countingStrategy struct {
+	Strategy
+	fetches atomic.Int32
+}
+
+func (s *countingStrategy) Fetch(ctx context.Context, url string) (io.Reader, int64, error) {
+	s.fetches.Add(1)
+	return s.Strategy.Fetch(ctx, url)
+}
+
+func TestSmallFileMode(t *testing.T) {
+	content := generateTestContent(humanize.KiByte)
+	server := newTestServer(t, content)
+	defer server.Close()
+	path, _ := url.JoinPath(server.URL, testFilePath)
+
+	tc := []struct {
+		name            string
+		threshold       int64
+		expectedHandoff int32
+	}{
+		{name: "small file fetched directly", threshold: 2 * humanize.KiByte},
+		{name: "exactly threshold fetched directly", threshold: humanize.KiByte},
+		{name: "large file handed off", threshold: 100, expectedHandoff: 1},
+	}
+
+	for _, tc := range tc {
+		t.Run(tc.name, func(t *testing.T) {
+			next := &countingStrategy{Strategy: GetBufferMode(Options{Client: client.Options{}, ChunkSize: 100})}
+			smallFileMode := GetSmallFileMode(Options{Client: client.Options{}}, tc.threshold, next)
+
+			download, size, err := smallFileMode.Fetch(context.Background(), path)
+			require.NoError(t, err)
+			data, err := io.ReadAll(download)
+			assert.NoError(t, err)
+			assert.Equal(t, int64(len(content)), size)
+			assert.Equal(t, content, data)
+			assert.Equal(t, tc.expectedHandoff, next.fetches.Load())
+		})
+	}
+}
+
+// chunks fetched with DoRequest, e.g. by consistent hashing mode falling back to it, are pinned to the object version
+// of the first chunk like in buffer mode
+func TestSmallFileModeDoRequestConditional(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-Match") != `"v1"` {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.WriteHeader(http.StatusPartialContent)
+	}))
+	defer server.Close()
+	smallFileMode := GetSmallFileMode(Options{Client: client.Options{}}, humanize.KiByte, nil)
+
+	resp := &http.Response{Header: http.Header{"Etag": []string{`"v1"`}}}
+	ctx := withValidators(context.Background(), validatorsFromResponse(resp))
+	resp, err := smallFileMode.DoRequest(ctx, 0, 99, server.URL)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	resp = &http.Response{Header: http.Header{"Etag": []string{`"v2"`}}}
+	ctx = withValidators(context.Background(), validatorsFromResponse(resp))
+	_, err = smallFileMode.DoRequest(ctx, 0, 99, server.URL)
+	assert.ErrorIs(t, err, ErrObjectChanged)
+}
+
+func TestSmallFileModeHandOff(t *testing.T) {
+	content := generateTestContent(humanize.KiByte)
+	var requests atomic.Int32
+	var authorization atomic.Value
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		authorization.Store(r.Header.Get("Authorization"))
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	// the first chunk of a file too large is the response to the first request, which isn't made again
+	opts := Options{Client: client.Options{}, ChunkSize: 100, ProxyAuthHeader: "Bearer proxy"}
+	smallFileMode := GetSmallFileMode(opts, 100, GetBufferMode(opts))
+	download, size, err := smallFileMode.Fetch(context.Background(), server.URL)
+	require.NoError(t, err)
+	data, err := io.ReadAll(download)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	assert.Equal(t, content, data)
+	assert.Equal(t, int32(11), requests.Load())
+	assert.Equal(t, "Bearer proxy", authorization.Load())
+
+	// a small file closed before it is read to the end releases its response
+	smallFileMode = GetSmallFileMode(opts, 2*humanize.KiByte, GetBufferMode(opts))
+	download, _, err = smallFileMode.Fetch(context.Background(), server.URL)
+	require.NoError(t, err)
+	closer, ok := download.(io.ReadCloser)
+	require.True(t, ok)
+	require.NoError(t, closer.Close())
+	n, err := download.Read(make([]byte, 10))
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, io.EOF)
+}
+
+func TestSmallFileModeHostLimit(t *testing.T) {
+	content := generateTestContent(100)
+	var inFlight, maxInFlight atomic.Int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		n := inFlight.Add(1)
+		defer inFlight.Add(-1)
+		for {
+			current := maxInFlight.Load()
+			if n <= current || maxInFlight.CompareAndSwap(current, n) {
+				break
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	// the requests of small files wait for a slot of their host in the queue of Next, until their body is read
+	opts := Options{Client: client.Options{}, ChunkSize: 1000, MaxConcurrency: 4, MaxConnectionsPerHost: 1}
+	smallFileMode := GetSmallFileMode(opts, 1000, GetBufferMode(opts))
+	done := make(chan error)
+	for range 4 {
+		go func() {
+			download, _, err := smallFileMode.Fetch(context.Background(), server.URL)
+			if err == nil {
+				time.Sleep(10 * time.Millisecond)
+				_, err = io.ReadAll(download)
+			}
+			done <- err
+		}()
+	}
+	for range 4 {
+		require.NoError(t, <-done)
+	}
+	assert.Equal(t, int32(1), maxInFlight.Load())
+}
+
+func TestSmallFileModeFetchAt(t *testing.T) {
+	content := generateTestContent(humanize.KiByte)
+	server := newTestServer(t, content)
+	defer server.Close()
+	path, _ := url.JoinPath(server.URL, testFilePath)
+
+	for _, threshold := range []int64{2 * humanize.KiByte, 100} {
+		opts := Options{Client: client.Options{}, ChunkSize: 100}
+		smallFileMode := GetSmallFileMode(opts, threshold, GetBufferMode(opts))
+		dest, err := os.Create(filepath.Join(t.TempDir(), "file.bin"))
+		require.NoError(t, err)
+		size, err := smallFileMode.FetchAt(context.Background(), path, func(fileSize int64) (io.WriterAt, error) {
+			return dest, nil
+		})
+		require.NoError(t, err)
+		require.NoError(t, dest.Close())
+		assert.Equal(t, int64(len(content)), size)
+		written, err := os.ReadFile(dest.Name())
+		require.NoError(t, err)
+		assert.Equal(t, content, written, threshold)
+	}
+}
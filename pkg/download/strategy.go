@@ -5,14 +5,21 @@ import (
 	"errors"
 	"io"
 	"net/http"
+	"net/url"
+	"time"
 )
 
 var ErrUnexpectedHTTPStatus = errors.New("unexpected http status")
 
+// ErrNotModified is returned when a conditional request, e.g. with an If-None-Match header set with
+// client.WithHeaders, finds the remote file unchanged: the server answered 304 Not Modified.
+var ErrNotModified = errors.New("remote file not modified")
+
 type Strategy interface {
 	// Fetch retrieves the content from a given URL and returns it as an io.Reader along with the file size.
 	// If an error occurs during the process, it returns nil for the reader, 0 for the fileSize, and the error itself.
-	// This is the primary method that should be called to initiate a download of a file.
+	// This is the primary method that should be called to initiate a download of a file. If the reader is an
+	// io.Closer, the caller closes it once done with it, whether or not it read it to the end.
 	Fetch(ctx context.Context, url string) (result io.Reader, fileSize int64, err error)
 
 	// DoRequest sends an HTTP GET request with a specified range of bytes to the given URL using the provided context.
@@ -26,3 +33,70 @@ type Strategy interface {
 	// The trueURL parameter is the actual URL after any redirects.
 	DoRequest(ctx context.Context, start, end int64, url string) (*http.Response, error)
 }
+
+// NewStrategy returns the download strategy for opts: consistent hashing when a sliced cache is configured,
+// otherwise buffer mode. Options.HostModes can only force consistent hashing mode in the former.
+func NewStrategy(opts Options) (Strategy, error) {
+	if err := opts.checkHostModes(); err != nil {
+		return nil, err
+	}
+	if opts.SliceSize != 0 {
+		return GetConsistentHashingMode(opts)
+	}
+	return GetBufferMode(opts), nil
+}
+
+// FileInfo describes a remote file, as returned by Stat.
+type FileInfo struct {
+	// URL is the URL the file is served from, after following redirects.
+	URL          string
+	Size         int64
+	ETag         string
+	AcceptRanges bool
+	// LastModified is zero if the response had no (valid) Last-Modified header.
+	LastModified time.Time
+	// CacheHost is the host of the cache the file was requested from, if the request was routed to one rather
+	// than to the host of its URL, e.g. the cache host of its first slice in consistent hashing mode.
+	CacheHost string
+}
+
+// Stat describes the file at urlString without downloading it, requesting its first byte with s so the request takes
+// the same route (cache hosts, redirects) as the download would.
+func Stat(ctx context.Context, s Strategy, urlString string) (FileInfo, error) {
+	resp, err := s.DoRequest(ctx, 0, 0, urlString)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	defer resp.Body.Close()
+	size, err := fileSizeFromResponse(resp)
+	if err != nil {
+		return FileInfo{}, err
+	}
+	info := FileInfo{
+		URL:          resp.Request.URL.String(),
+		Size:         size,
+		ETag:         resp.Header.Get("ETag"),
+		AcceptRanges: resp.StatusCode == http.StatusPartialContent,
+	}
+	if lastModified, err := http.ParseTime(resp.Header.Get("Last-Modified")); err == nil {
+		info.LastModified = lastModified
+	}
+	// the first request, before redirects, tells where the strategy sent it
+	first := resp.Request
+	for first.Response != nil && first.Response.Request != nil {
+		first = first.Response.Request
+	}
+	if parsed, err := url.Parse(urlString); err == nil && first.URL.Host != parsed.Host {
+		info.CacheHost = first.URL.Host
+	}
+	return info, nil
+}
+
+// RemoteSize returns the size of the file at url, requesting its first byte with s.
+func RemoteSize(ctx context.Context, s Strategy, url string) (int64, error) {
+	info, err := Stat(ctx, s, url)
+	if err != nil {
+		return -1, err
+	}
+	return info.Size, nil
+}
@@ -1,55 +1,263 @@
 package download
 
+import (
+	"context"
+	"net/url"
+	"sync"
+
+	"github.com/dustin/go-humanize"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
 // priorityWorkQueue takes work items and executes them, with n parallel
 // workers.  It allows for a simple high/low priority split between work.  We
 // use this to prefer finishing existing downloads over starting new downloads.
 //
-// work items are provided with a fixed-size buffer.
+// work items are provided with a fixed-size buffer from the queue's
+// bufferPool.
+//
+// Every item is submitted for a host, and at most a given number of the items
+// of a host run at once, so that a slow host doesn't take every worker while
+// the items of other hosts wait.
 type priorityWorkQueue struct {
 	concurrency  int
-	lowPriority  chan work
-	highPriority chan work
-	bufSize      int64
+	lowPriority  chan func()
+	highPriority chan func()
+	buffers      *bufferPool
+	hosts        *hostSlots
 }
 
 type work func([]byte)
 
-func newWorkQueue(concurrency int, bufSize int64) *priorityWorkQueue {
+// newWorkQueue returns a queue running concurrency items at once, at most maxPerHost of them for the same host if
+// it is non-zero, whose buffers of bufSize bytes use at most maxBufferMemory bytes altogether, or as many as there
+// are workers if it is zero.
+func newWorkQueue(concurrency, maxPerHost int, bufSize int64, maxBufferMemory int64) *priorityWorkQueue {
 	return &priorityWorkQueue{
 		concurrency:  concurrency,
-		lowPriority:  make(chan work),
-		highPriority: make(chan work),
-		bufSize:      bufSize,
+		lowPriority:  make(chan func()),
+		highPriority: make(chan func()),
+		buffers:      newBufferPool(bufSize, maxBufferMemory),
+		hosts:        newHostSlots(maxPerHost),
+	}
+}
+
+// submitLow and submitHigh wait for a slot of host and then for a buffer to be available within the memory budget of
+// the queue before submitting w, so that a chunk isn't requested until there is memory to hold it. They return the
+// error of ctx, without submitting w, if it is done first.
+func (q *priorityWorkQueue) submitLow(ctx context.Context, host string, w work) error {
+	return q.submit(ctx, q.lowPriority, host, w)
+}
+
+func (q *priorityWorkQueue) submitHigh(ctx context.Context, host string, w work) error {
+	return q.submit(ctx, q.highPriority, host, w)
+}
+
+// submitLowUnbuffered and submitHighUnbuffered submit work which doesn't need a buffer, e.g. because it writes what
+// it downloads straight to its destination.
+func (q *priorityWorkQueue) submitLowUnbuffered(ctx context.Context, host string, fn func()) error {
+	return q.submitUnbuffered(ctx, q.lowPriority, host, fn)
+}
+
+func (q *priorityWorkQueue) submitHighUnbuffered(ctx context.Context, host string, fn func()) error {
+	return q.submitUnbuffered(ctx, q.highPriority, host, fn)
+}
+
+// submit reserves a buffer for w once it holds a slot of its host, and sends it to queue with both. Items waiting
+// for a busy host hold no buffer, so they don't keep the items of other hosts waiting for one. Buffers are reserved
+// in the order items are submitted, so the chunks of a file get them in order: a chunk the ones after it are
+// waiting for is never left waiting for a buffer they hold.
+func (q *priorityWorkQueue) submit(ctx context.Context, queue chan func(), host string, w work) error {
+	slot, err := q.hosts.acquire(ctx, host)
+	if err != nil {
+		return err
+	}
+	if err := q.buffers.reserve(ctx); err != nil {
+		q.hosts.release(slot)
+		return err
+	}
+	item := q.forHost(slot, func() {
+		buf := q.buffers.get()
+		defer q.buffers.put(buf)
+		w(buf)
+	})
+	select {
+	case queue <- item:
+		return nil
+	case <-ctx.Done():
+		q.buffers.unreserve()
+		q.hosts.release(slot)
+		return ctx.Err()
 	}
 }
 
-func (q *priorityWorkQueue) submitLow(w work) {
-	q.lowPriority <- w
+func (q *priorityWorkQueue) submitUnbuffered(ctx context.Context, queue chan func(), host string, fn func()) error {
+	slot, err := q.hosts.acquire(ctx, host)
+	if err != nil {
+		return err
+	}
+	select {
+	case queue <- q.forHost(slot, fn):
+		return nil
+	case <-ctx.Done():
+		q.hosts.release(slot)
+		return ctx.Err()
+	}
 }
 
-func (q *priorityWorkQueue) submitHigh(w work) {
-	q.highPriority <- w
+// forHost returns a function running fn and releasing slot, a slot of its host. Items wait for a slot before they
+// are submitted, blocking their submitter rather than a worker.
+func (q *priorityWorkQueue) forHost(slot chan struct{}, fn func()) func() {
+	return func() {
+		defer q.hosts.release(slot)
+		fn()
+	}
 }
 
 func (q *priorityWorkQueue) start() {
 	for i := 0; i < q.concurrency; i++ {
-		go q.run(make([]byte, q.bufSize))
+		go q.run()
 	}
 }
 
-func (q *priorityWorkQueue) run(buf []byte) {
+func (q *priorityWorkQueue) run() {
 	for {
 		// read items off the high priority queue until it's empty
 		select {
 		case item := <-q.highPriority:
-			item(buf)
+			item()
 		default:
 			select { // read one item from either queue, then go round the loop again
 			case item := <-q.highPriority:
-				item(buf)
+				item()
 			case item := <-q.lowPriority:
-				item(buf)
+				item()
 			}
 		}
 	}
 }
+
+// hostSlots limits the number of work items of each host running at once. Its zero value, or one with a limit of
+// zero, doesn't limit them.
+type hostSlots struct {
+	limit int
+
+	mu sync.Mutex
+	// slots holds a token per item of a host running, by host
+	slots map[string]chan struct{}
+}
+
+func newHostSlots(limit int) *hostSlots {
+	return &hostSlots{limit: limit, slots: make(map[string]chan struct{})}
+}
+
+// acquire waits for a slot of host to be free, and returns it to be released once the item is done, or the error
+// of ctx if it is done first. Slots are handed out in the order they are asked for, so the chunks of a file get them
+// in order.
+func (s *hostSlots) acquire(ctx context.Context, host string) (chan struct{}, error) {
+	if s.limit <= 0 {
+		return nil, nil
+	}
+	s.mu.Lock()
+	slot, ok := s.slots[host]
+	if !ok {
+		slot = make(chan struct{}, s.limit)
+		s.slots[host] = slot
+	}
+	s.mu.Unlock()
+	select {
+	case slot <- struct{}{}:
+		return slot, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (s *hostSlots) release(slot chan struct{}) {
+	if slot != nil {
+		<-slot
+	}
+}
+
+// hostOf returns the host items downloading rawURL are limited by: the host of the URL, including its port.
+func hostOf(rawURL string) string {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return rawURL
+	}
+	return parsed.Host
+}
+
+// bufferPool hands out the buffers of work items, allocating them as they are first needed and reusing them after.
+// If it has a budget, at most budget/size buffers are reserved at once, and reserve blocks until one is put back.
+type bufferPool struct {
+	size int64
+	// budget holds a token per reserved buffer; it is nil if the pool has no budget
+	budget chan struct{}
+
+	mu   sync.Mutex
+	free [][]byte
+	// allocated counts the buffers made so far
+	allocated int
+}
+
+func newBufferPool(size, maxMemory int64) *bufferPool {
+	p := &bufferPool{size: size}
+	if maxMemory > 0 {
+		n := maxMemory / size
+		if n < 1 {
+			logger := logging.GetLogger()
+			logger.Warn().
+				Str("max_buffer_memory", humanize.IBytes(uint64(maxMemory))).
+				Str("chunk_size", humanize.IBytes(uint64(size))).
+				Msg("Buffer memory budget is smaller than a chunk, allowing one chunk at a time")
+			n = 1
+		}
+		p.budget = make(chan struct{}, n)
+	}
+	return p
+}
+
+// reserve waits for a buffer to be available within the budget, or returns the error of ctx if it is done first.
+// Every reserve must be followed by get and put, or by unreserve.
+func (p *bufferPool) reserve(ctx context.Context) error {
+	if p.budget == nil {
+		return nil
+	}
+	select {
+	case p.budget <- struct{}{}:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// unreserve releases a reservation whose buffer isn't needed after all.
+func (p *bufferPool) unreserve() {
+	if p.budget != nil {
+		<-p.budget
+	}
+}
+
+func (p *bufferPool) get() []byte {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if n := len(p.free); n > 0 {
+		buf := p.free[n-1]
+		p.free = p.free[:n-1]
+		return buf
+	}
+	p.allocated++
+	return make([]byte, p.size)
+}
+
+// put returns buf to the pool and releases its reservation.
+func (p *bufferPool) put(buf []byte) {
+	p.mu.Lock()
+	p.free = append(p.free, buf)
+	p.mu.Unlock()
+	if p.budget != nil {
+		<-p.budget
+	}
+}
@@ -0,0 +1,51 @@
+package download
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkQueueBufferNotHeldWaitingForHost(t *testing.T) {
+	ctx := context.Background()
+	q := newWorkQueue(4, 1, 1, 1)
+	q.start()
+
+	// the only slot of the blocked host is taken, and another of its items waits for it
+	blocked := make(chan struct{})
+	defer close(blocked)
+	q.submitHighUnbuffered(ctx, "blocked.example.com", func() { <-blocked })
+	go q.submitLow(ctx, "blocked.example.com", func([]byte) {})
+	time.Sleep(50 * time.Millisecond)
+
+	// which leaves the only buffer of the budget to the free host
+	done := make(chan struct{})
+	go q.submitLow(ctx, "free.example.com", func([]byte) { close(done) })
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the item of the free host is waiting for the buffer held by the blocked host")
+	}
+}
+
+func TestWorkQueueSubmitCanceled(t *testing.T) {
+	q := newWorkQueue(1, 1, 1, 1)
+	q.start()
+
+	// the only worker is busy, and so is the only slot of the host
+	blocked := make(chan struct{})
+	defer close(blocked)
+	require.NoError(t, q.submitHighUnbuffered(context.Background(), "example.com", func() { <-blocked }))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	ran := false
+	err := q.submitLow(ctx, "example.com", func([]byte) { ran = true })
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	err = q.submitLowUnbuffered(ctx, "other.example.com", func() { ran = true })
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+	assert.False(t, ran)
+}
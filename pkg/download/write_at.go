@@ -0,0 +1,195 @@
+package download
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// A WriterAtStrategy is a Strategy which can also write the chunks of a file straight to their offsets in a
+// destination as each completes, rather than returning them in order through a reader. No chunk waits in memory for
+// the ones before it, so memory use doesn't grow with the bandwidth-delay product.
+type WriterAtStrategy interface {
+	Strategy
+	// FetchAt retrieves the content from url, calls open with its size, and writes every chunk to the io.WriterAt
+	// open returns, at the chunk's offset. It returns once all chunks are written, or once the chunks in flight have
+	// stopped after the first error, so w is no longer written to when it returns.
+	FetchAt(ctx context.Context, url string, open func(fileSize int64) (io.WriterAt, error)) (fileSize int64, err error)
+}
+
+var _ WriterAtStrategy = &BufferMode{}
+
+func (m *BufferMode) FetchAt(ctx context.Context, url string, open func(fileSize int64) (io.WriterAt, error)) (int64, error) {
+	logger := logging.GetLogger()
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type firstResult struct {
+		firstReqResult
+		w io.WriterAt
+		// whole is set if the server ignored the range of the first request and is sending the whole file
+		whole bool
+	}
+	firstResultCh := make(chan firstResult, 1)
+	firstChunkErr := make(chan error, 1)
+	host := hostOf(url)
+	err := m.queue.submitLowUnbuffered(ctx, host, func() {
+		if m.CacheHosts != nil {
+			url = m.rewriteUrlForCache(url)
+		}
+
+		firstChunkResp, err := m.DoRequest(ctx, 0, m.chunkSize()-1, url)
+		if err != nil {
+			firstResultCh <- firstResult{firstReqResult: firstReqResult{err: err}}
+			return
+		}
+		defer firstChunkResp.Body.Close()
+
+		trueURL := firstChunkResp.Request.URL.String()
+		if trueURL != url {
+			logger.Info().Str("url", url).Str("redirect_url", trueURL).Msg("Redirect")
+			m.redirected = true
+		}
+
+		fileSize, err := fileSizeFromResponse(firstChunkResp)
+		if err != nil {
+			firstResultCh <- firstResult{firstReqResult: firstReqResult{err: err}}
+			return
+		}
+		recordMetadata(ctx, firstChunkResp)
+		w, err := open(fileSize)
+		if err != nil {
+			firstResultCh <- firstResult{firstReqResult: firstReqResult{err: err}}
+			return
+		}
+		firstResultCh <- firstResult{
+			firstReqResult: firstReqResult{fileSize: fileSize, trueURL: trueURL, validators: validatorsFromResponse(firstChunkResp)},
+			w:              w,
+			whole:          firstChunkResp.StatusCode == http.StatusOK,
+		}
+
+		end := firstChunkResp.ContentLength - 1
+		err = m.writeChunk(firstChunkResp, w, 0, end)
+		if err == nil {
+			chunkReceived(ctx, 0, end, fileSize)
+		}
+		firstChunkErr <- err
+	})
+	if err != nil {
+		return -1, err
+	}
+
+	first := <-firstResultCh
+	if first.err != nil {
+		return -1, first.err
+	}
+	fileSize := first.fileSize
+	trueURL := first.trueURL
+	chunkCtx := withValidators(ctx, first.validators)
+
+	numChunks := 0
+	if !first.whole && fileSize > m.chunkSize() {
+		// integer divide rounding up
+		numChunks = int((fileSize-m.chunkSize()-1)/m.chunkSize() + 1)
+	}
+	logger.Debug().Str("url", url).
+		Int64("size", fileSize).
+		Int("connections", numChunks).
+		Int64("chunkSize", m.chunkSize()).
+		Msg("Downloading")
+
+	// every chunk submitted sends exactly one result, so that they can all be waited for
+	chunkErrs := make(chan error, numChunks)
+	go func() {
+		for i := 0; i < numChunks; i++ {
+			err := m.queue.submitHighUnbuffered(ctx, host, func() {
+				if err := ctx.Err(); err != nil {
+					chunkErrs <- err
+					return
+				}
+				start := m.chunkSize() * int64(i+1)
+				end := min(start+m.chunkSize(), fileSize) - 1
+				logger.Debug().Str("url", url).
+					Int64("size", fileSize).
+					Int("chunk", i).
+					Msg("Downloading chunk")
+
+				resp, err := hedge(chunkCtx, m.HedgeAfter, func(ctx context.Context, _ bool) (*http.Response, error) {
+					return m.DoRequest(ctx, start, end, trueURL)
+				})
+				if err != nil {
+					chunkErrs <- err
+					return
+				}
+				defer resp.Body.Close()
+				err = m.writeChunk(resp, first.w, start, end)
+				if err == nil {
+					chunkReceived(chunkCtx, start, end, fileSize)
+				}
+				chunkErrs <- err
+			})
+			if err != nil {
+				// the chunks left aren't requested, but send their result all the same
+				for ; i < numChunks; i++ {
+					chunkErrs <- err
+				}
+				return
+			}
+		}
+	}()
+
+	var firstErr error
+	for i := 0; i <= numChunks; i++ {
+		var err error
+		if i == 0 {
+			err = <-firstChunkErr
+		} else {
+			err = <-chunkErrs
+		}
+		if err != nil && firstErr == nil {
+			firstErr = err
+			// fail the remaining chunks fast
+			cancel()
+		}
+	}
+	return fileSize, firstErr
+}
+
+// writeChunk copies the body of resp, the chunk of the file from start to end, to w at start. A connection
+// interrupted mid-chunk is resumed from the last byte received, as resumeDownload does for buffered chunks.
+func (m *BufferMode) writeChunk(resp *http.Response, w io.WriterAt, start, end int64) error {
+	logger := logging.GetLogger()
+	out := io.NewOffsetWriter(w, start)
+	length := end - start + 1
+	n, err := io.CopyN(out, resp.Body, length)
+	written := n
+	req := resp.Request
+	for resumeCount := 1; err == io.ErrUnexpectedEOF; resumeCount++ {
+		logger.Warn().
+			Int64("connection_interrupted_at_byte", written).
+			Int("resume_count", resumeCount).
+			Msg("Resuming Chunk Download")
+		// the Range header of req starts where the previous attempt did
+		if err = updateRangeRequestHeader(req, n); err != nil {
+			return err
+		}
+		var resp *http.Response
+		if resp, err = m.Client.Do(req); err != nil {
+			return err
+		}
+		if resp.StatusCode != http.StatusPartialContent {
+			resp.Body.Close()
+			return fmt.Errorf("expected status code %d, got %d", http.StatusPartialContent, resp.StatusCode)
+		}
+		n, err = io.CopyN(out, resp.Body, length-written)
+		resp.Body.Close()
+		written += n
+	}
+	if err != nil {
+		return fmt.Errorf("error writing chunk %d-%d: %w", start, end, err)
+	}
+	return nil
+}
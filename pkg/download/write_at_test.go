@@ -0,0 +1,102 @@
+package download_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/download"
+	"github.com/emaballarin/rpget/pkg/testserver"
+)
+
+func TestFetchAt(t *testing.T) {
+	content := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(content)
+	server := testserver.New(map[string][]byte{"/file.bin": content},
+		testserver.OnRange(3000, testserver.Times(1, testserver.CloseAfter(500))),
+		testserver.OnRange(0, testserver.SlowBody(100, 20*time.Millisecond)),
+	)
+	defer server.Close()
+
+	var mu sync.Mutex
+	var chunks []download.Chunk
+	ctx := download.WithChunkCallback(context.Background(), func(chunk download.Chunk, fileSize int64) {
+		mu.Lock()
+		defer mu.Unlock()
+		chunks = append(chunks, chunk)
+	})
+	dest, err := os.Create(filepath.Join(t.TempDir(), "file.bin"))
+	require.NoError(t, err)
+	defer dest.Close()
+
+	m := download.GetBufferMode(download.Options{ChunkSize: 1000, MaxConcurrency: 4})
+	fileSize, err := m.FetchAt(ctx, server.URL+"/file.bin", func(fileSize int64) (io.WriterAt, error) {
+		assert.Equal(t, int64(len(content)), fileSize)
+		return dest, nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), fileSize)
+
+	written, err := os.ReadFile(dest.Name())
+	require.NoError(t, err)
+	assert.Equal(t, content, written)
+	// the first chunk was the slowest, the others didn't wait for it
+	assert.Len(t, chunks, 10)
+	assert.Equal(t, download.Chunk{Start: 0, End: 999}, chunks[len(chunks)-1])
+}
+
+func TestFetchAtChunkFails(t *testing.T) {
+	content := make([]byte, 10000)
+	server := testserver.New(map[string][]byte{"/file.bin": content},
+		testserver.OnRange(5000, testserver.Status(http.StatusNotFound)),
+	)
+	defer server.Close()
+
+	dest, err := os.Create(filepath.Join(t.TempDir(), "file.bin"))
+	require.NoError(t, err)
+	defer dest.Close()
+
+	m := download.GetBufferMode(download.Options{ChunkSize: 1000, MaxConcurrency: 4})
+	_, err = m.FetchAt(context.Background(), server.URL+"/file.bin", func(int64) (io.WriterAt, error) {
+		return dest, nil
+	})
+	assert.ErrorIs(t, err, download.ErrUnexpectedHTTPStatus)
+
+	errOpen := errors.New("open failed")
+	_, err = m.FetchAt(context.Background(), server.URL+"/file.bin", func(int64) (io.WriterAt, error) {
+		return nil, errOpen
+	})
+	assert.ErrorIs(t, err, errOpen)
+}
+
+func TestFetchAtRangeNotSupported(t *testing.T) {
+	content := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(content)
+	server := testserver.New(map[string][]byte{"/file.bin": content}, testserver.IgnoreRange())
+	defer server.Close()
+
+	dest, err := os.Create(filepath.Join(t.TempDir(), "file.bin"))
+	require.NoError(t, err)
+	defer dest.Close()
+
+	m := download.GetBufferMode(download.Options{ChunkSize: 1000, MaxConcurrency: 4})
+	_, err = m.FetchAt(context.Background(), server.URL+"/file.bin", func(int64) (io.WriterAt, error) {
+		return dest, nil
+	})
+	require.NoError(t, err)
+	written, err := os.ReadFile(dest.Name())
+	require.NoError(t, err)
+	assert.Equal(t, content, written)
+	// the whole file came with the first response
+	assert.Equal(t, int64(1), server.Requests())
+}
@@ -0,0 +1,73 @@
+package rpget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/download"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// ErrDestinationMismatch is returned when Options.Idempotent is set and the destination of a file already exists
+// but does not match the file.
+var ErrDestinationMismatch = errors.New("destination already exists and does not match")
+
+// skipExisting reports whether entry can be skipped because its destination already exists and matches it. The
+// destination matches if it passes the entry's checksum or, if the entry has none, if it has the size of the remote
+// file. Only files written by a FileWriter can be compared: any other existing destination is an error. A
+// destination which doesn't match is an error too, unless the FileWriter overwrites it.
+func (g *Getter) skipExisting(ctx context.Context, entry ManifestEntry, c consumer.Consumer) (bool, error) {
+	logger := logging.GetLogger()
+	info, err := os.Stat(entry.Dest)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	fileWriter, isFile := c.(*consumer.FileWriter)
+	if !isFile || !info.Mode().IsRegular() {
+		return false, fmt.Errorf("destination %s already exists", entry.Dest)
+	}
+	matches, err := g.matches(ctx, entry, info.Size())
+	if err != nil {
+		return false, fmt.Errorf("error comparing %s with %s: %w", entry.Dest, entry.URL, err)
+	}
+	if matches {
+		logger.Info().Str("url", entry.URL).Str("dest", entry.Dest).Msg("Already exists, skipping")
+		return true, nil
+	}
+	if fileWriter.Overwrite {
+		return false, nil
+	}
+	return false, fmt.Errorf("%w: %s", ErrDestinationMismatch, entry.Dest)
+}
+
+// matches reports whether the file of size bytes at the destination of entry matches it.
+func (g *Getter) matches(ctx context.Context, entry ManifestEntry, size int64) (bool, error) {
+	if entry.Checksum == "" {
+		remoteSize, err := download.RemoteSize(ctx, g.Downloader, entry.URL)
+		if err != nil {
+			return false, err
+		}
+		return remoteSize == size, nil
+	}
+	v, err := newVerifier(entry.Checksum)
+	if err != nil {
+		return false, err
+	}
+	f, err := os.Open(entry.Dest)
+	if err != nil {
+		return false, err
+	}
+	defer f.Close()
+	if _, err := io.Copy(v, f); err != nil {
+		return false, err
+	}
+	return v.verify() == nil, nil
+}
@@ -0,0 +1,346 @@
+package extract
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+const tarBlockSize = 512
+
+var ErrUnknownFormat = errors.New("unrecognized archive format")
+
+var (
+	zipMagic      = []byte{'P', 'K', 0x03, 0x04}
+	emptyZipMagic = []byte{'P', 'K', 0x05, 0x06}
+)
+
+// Archive extracts the payload read from r according to its format, sniffed from its first bytes:
+//   - a tar archive, optionally compressed, is extracted into the directory dest
+//   - a zip archive is extracted into the directory dest
+//   - any other compressed payload is decompressed to the file dest
+//
+// Anything else is rejected with ErrUnknownFormat. If opts.Compression is set, the payload is decompressed with it
+// instead of sniffing its format.
+func Archive(r *bufio.Reader, dest string, opts Options) error {
+	logger := logging.GetLogger()
+	startTime := time.Now()
+	if opts.Progress == nil {
+		// counted for the logs
+		opts.Progress = new(Progress)
+	}
+
+	peekData, err := r.Peek(detectionPeekSize())
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("error reading peek data: %w", err)
+	}
+	format := "tar"
+	switch {
+	case opts.Compression != "":
+		format, err = decompressArchive(r, opts.Compression.decompressor(), dest, opts)
+	case bytes.HasPrefix(peekData, zipMagic), bytes.HasPrefix(peekData, emptyZipMagic):
+		format = "zip"
+		err = newExtraction(dest, opts).unzip(r)
+	// tar is checked before compression, as short magic numbers (e.g. bzip2's "BZ") may start a tar entry name
+	case isTar(r):
+		err = newExtraction(dest, opts).untar(r)
+	case detectFormat(peekData) != nil:
+		format, err = decompressArchive(r, detectFormat(peekData), dest, opts)
+	default:
+		return ErrUnknownFormat
+	}
+	if err != nil {
+		return err
+	}
+
+	event := logger.Debug().
+		Str("extractor", format).
+		Int64("entries", opts.Progress.Entries()).
+		Int64("bytes", opts.Progress.Bytes())
+	if decompressed := opts.Progress.Decompressed(); decompressed > 0 {
+		event = event.Int64("decompressed_bytes", decompressed)
+	}
+	event.Float64("elapsed_time", time.Since(startTime).Seconds()).
+		Str("status", "complete").
+		Msg("Extract")
+	return nil
+}
+
+// decompressArchive extracts the compressed payload read from r, returning "tar" if it is a compressed tar archive
+// or "file" if it is a single compressed file.
+func decompressArchive(r io.Reader, decompressor decompressor, dest string, opts Options) (string, error) {
+	logger := logging.GetLogger()
+	stream, err := decompressor.decompress(r)
+	if err != nil {
+		return "", fmt.Errorf("error creating decompressed stream: %w", err)
+	}
+	if closer, ok := stream.(io.Closer); ok {
+		defer closer.Close()
+	}
+	logger.Info().
+		Str("decompressor", fmt.Sprintf("%T", decompressor)).
+		Msg("Compression Detected: Compression can significantly slowdown rpget (e.g. for model weights)")
+	decompressed := bufio.NewReaderSize(opts.Progress.decompressedReader(stream), 2*tarBlockSize)
+	if isTar(decompressed) {
+		return "tar", newExtraction(dest, opts).untar(decompressed)
+	}
+	// a single file is extracted next to its siblings, so relative paths are relative to its directory
+	return "file", newExtraction(filepath.Dir(dest), opts).decompressFile(decompressed, dest)
+}
+
+// isTar reports whether r starts with a tar header, validated by its checksum, or with the zero block ending an
+// empty archive.
+func isTar(r *bufio.Reader) bool {
+	block, err := r.Peek(tarBlockSize)
+	if err != nil {
+		return false
+	}
+	if bytes.Equal(block, make([]byte, tarBlockSize)) {
+		return true
+	}
+	// the checksum is an octal number, terminated by a NUL and/or space, over the header with the checksum field
+	// itself read as spaces
+	field := strings.Trim(string(block[148:156]), " \x00")
+	expected, err := strconv.ParseUint(field, 8, 64)
+	if err != nil {
+		return false
+	}
+	var sum uint64
+	for i, b := range block {
+		if i >= 148 && i < 156 {
+			b = ' '
+		}
+		sum += uint64(b)
+	}
+	return sum == expected
+}
+
+// decompressFile writes the decompressed payload read from r to the file dest.
+func (x *extraction) decompressFile(r io.Reader, dest string) error {
+	defer x.tree.Close()
+	if err := x.tree.MkdirAll(filepath.Dir(dest), 0755); err != nil {
+		return err
+	}
+	if err := x.writeFile(r, dest, 0644); err != nil {
+		return fmt.Errorf("error decompressing to %s: %w", dest, err)
+	}
+	if err := x.addEntry(); err != nil {
+		return err
+	}
+	return x.finish()
+}
+
+// unzip extracts the zip archive read from r into the destination directory. The central directory of a zip
+// archive is at its end, so the archive is first spooled to a temporary file in opts.TempDir, or next to the
+// destination.
+func (x *extraction) unzip(r io.Reader) error {
+	logger := logging.GetLogger()
+	destDir := x.destDir
+	defer x.tree.Close()
+	if err := x.tree.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	spoolDir := x.opts.TempDir
+	if spoolDir == "" {
+		spoolDir = filepath.Dir(filepath.Clean(destDir))
+	}
+	spool, err := os.CreateTemp(spoolDir, ".rpget-zip-*")
+	if err != nil {
+		return fmt.Errorf("error creating temporary file for zip archive: %w", err)
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	size, err := io.Copy(spool, r)
+	if err != nil {
+		return fmt.Errorf("error spooling zip archive: %w", err)
+	}
+	archive, err := zip.NewReader(spool, size)
+	if err != nil {
+		return fmt.Errorf("error reading zip archive: %w", err)
+	}
+	if err := x.startJournal(); err != nil {
+		return err
+	}
+	defer x.closeJournal()
+
+	for _, file := range archive.File {
+		if file.Name == "" {
+			return ErrEmptyHeaderName
+		}
+		name, ok := x.mapName(file.Name)
+		if !ok || !x.included(file.Name) {
+			logger.Debug().
+				Str("name", file.Name).
+				Msg("Zip: Skip")
+			continue
+		}
+		if err := guardPath(name, destDir); err != nil {
+			return err
+		}
+		target := filepath.Join(destDir, name)
+		mode := file.Mode()
+		kind := kindFile
+		if mode.IsDir() {
+			kind = kindDir
+		} else if mode&os.ModeSymlink != 0 {
+			kind = kindLink
+		}
+		claimed, err := x.claim(target, kind)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+		switch {
+		case mode.IsDir():
+			logger.Debug().
+				Str("target", target).
+				Str("perms", fmt.Sprintf("%o", mode.Perm())).
+				Msg("Zip: Directory")
+			if err := x.tree.MkdirAll(target, cleanFileMode(mode.Perm())|0700); err != nil {
+				return err
+			}
+			if err := x.preserve(zipMetadata(file, target), true); err != nil {
+				return err
+			}
+		case mode&os.ModeSymlink != 0:
+			linkName, err := readZipEntry(file)
+			if err != nil {
+				return err
+			}
+			logger.Debug().
+				Str("old_name", linkName).
+				Str("new_name", target).
+				Msg("Zip: (Defer) Link")
+			x.links = append(x.links, &link{linkType: tar.TypeSymlink, oldName: linkName, newName: target})
+		case mode.IsRegular():
+			resumed, err := x.resume(target, int64(file.UncompressedSize64))
+			if err != nil {
+				return err
+			}
+			if resumed {
+				logger.Debug().
+					Str("target", target).
+					Msg("Zip: Skip (already extracted)")
+				break
+			}
+			logger.Debug().
+				Str("target", target).
+				Str("perms", fmt.Sprintf("%o", mode.Perm())).
+				Msg("Zip: File")
+			if err := x.tree.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := x.extractZipEntry(file, target); err != nil {
+				return err
+			}
+			if err := x.preserve(zipMetadata(file, target), false); err != nil {
+				return err
+			}
+			if err := x.journalFile(target); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unsupported file type for %s, mode %s", file.Name, mode)
+		}
+		if err := x.addEntry(); err != nil {
+			return err
+		}
+	}
+	if err := createLinks(x.links, destDir, x.opts.Overwrite); err != nil {
+		return fmt.Errorf("error creating links: %w", err)
+	}
+	if err := x.finishMetadata(); err != nil {
+		return err
+	}
+	return x.finish()
+}
+
+// zipMetadata returns the metadata of a zip entry; zip archives don't record owners.
+func zipMetadata(file *zip.File, target string) entryMetadata {
+	return entryMetadata{target: target, mode: file.Mode(), modTime: file.Modified}
+}
+
+func (x *extraction) extractZipEntry(file *zip.File, target string) error {
+	rc, err := file.Open()
+	if err != nil {
+		return fmt.Errorf("error opening %s in zip archive: %w", file.Name, err)
+	}
+	defer rc.Close()
+	mode := file.Mode().Perm()
+	if mode == 0 {
+		mode = 0644
+	}
+	return x.writeFile(rc, target, cleanFileMode(mode))
+}
+
+func readZipEntry(file *zip.File) (string, error) {
+	rc, err := file.Open()
+	if err != nil {
+		return "", fmt.Errorf("error opening %s in zip archive: %w", file.Name, err)
+	}
+	defer rc.Close()
+	data, err := io.ReadAll(io.LimitReader(rc, 4096))
+	if err != nil {
+		return "", fmt.Errorf("error reading %s in zip archive: %w", file.Name, err)
+	}
+	return string(data), nil
+}
+
+// Sniff returns the format of the payload read from r as Archive detects it, without consuming it: "zip", "tar",
+// the name of its compression (e.g. "gzip", "zstd" or a format added with RegisterFormat), or "" if it isn't
+// recognized. A compressed tar archive is reported by its compression.
+func Sniff(r *bufio.Reader) string {
+	peekData, err := r.Peek(detectionPeekSize())
+	if err != nil && !errors.Is(err, io.EOF) {
+		return ""
+	}
+	switch {
+	case bytes.HasPrefix(peekData, zipMagic), bytes.HasPrefix(peekData, emptyZipMagic):
+		return "zip"
+	case isTar(r):
+		return "tar"
+	default:
+		return decompressorName(detectFormat(peekData))
+	}
+}
+
+// Decompress writes the decompressed payload read from r to the file dest. Its compression is detected from its
+// first bytes unless opts.Compression is set; a payload which isn't compressed is rejected with ErrUnknownFormat.
+// Unlike Archive, a compressed tar archive is decompressed to dest rather than extracted.
+func Decompress(r *bufio.Reader, dest string, opts Options) error {
+	if opts.Progress == nil {
+		opts.Progress = new(Progress)
+	}
+	d := opts.Compression.decompressor()
+	if opts.Compression == "" {
+		peekData, err := r.Peek(detectionPeekSize())
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("error reading peek data: %w", err)
+		}
+		d = detectFormat(peekData)
+	}
+	if d == nil {
+		return ErrUnknownFormat
+	}
+	stream, err := d.decompress(r)
+	if err != nil {
+		return fmt.Errorf("error creating decompressed stream: %w", err)
+	}
+	if closer, ok := stream.(io.Closer); ok {
+		defer closer.Close()
+	}
+	return newExtraction(filepath.Dir(dest), opts).decompressFile(opts.Progress.decompressedReader(stream), dest)
+}
@@ -0,0 +1,397 @@
+package extract
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/pierrec/lz4"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"github.com/ulikunitz/xz"
+)
+
+func tarBytes(t testing.TB, files map[string]string) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func gzipBytes(t testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	_, err := zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func xzBytes(t testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	w, err := xz.NewWriter(&buf)
+	require.NoError(t, err)
+	_, err = w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func lz4Bytes(t testing.TB, data []byte) []byte {
+	var buf bytes.Buffer
+	w := lz4.NewWriter(&buf)
+	_, err := w.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func zipBytes(t testing.TB, files map[string]string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for name, content := range files {
+		w, err := zw.Create(name)
+		require.NoError(t, err)
+		_, err = w.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+func assertContent(t *testing.T, expected, path string) {
+	data, err := os.ReadFile(path)
+	require.NoError(t, err)
+	assert.Equal(t, expected, string(data))
+}
+
+func TestArchive(t *testing.T) {
+	files := map[string]string{"a.txt": "a", "sub/b.txt": "b"}
+	tests := []struct {
+		name    string
+		payload []byte
+	}{
+		{name: "tar", payload: tarBytes(t, files)},
+		{name: "tar.gz", payload: gzipBytes(t, tarBytes(t, files))},
+		{name: "tar.xz", payload: xzBytes(t, tarBytes(t, files))},
+		{name: "tar.lz4", payload: lz4Bytes(t, tarBytes(t, files))},
+		{name: "zip", payload: zipBytes(t, files)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dest := filepath.Join(t.TempDir(), "out")
+			progress := new(Progress)
+			require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(tt.payload)), dest, Options{Progress: progress}))
+			assertContent(t, "a", filepath.Join(dest, "a.txt"))
+			assertContent(t, "b", filepath.Join(dest, "sub", "b.txt"))
+			assert.Equal(t, int64(2), progress.Entries())
+			assert.Equal(t, int64(2), progress.Bytes())
+		})
+	}
+}
+
+func TestArchiveChecksums(t *testing.T) {
+	files := map[string]string{"a.txt": "a", "sub/b.txt": "b"}
+	expected := map[string]string{
+		"a.txt":     "sha256:ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb",
+		"sub/b.txt": "sha256:3e23e8160039594a33894f6564e1b1348bbd7a0088d42c4acb73eeaed59c009d",
+	}
+	for name, payload := range map[string][]byte{"tar": tarBytes(t, files), "zip": zipBytes(t, files)} {
+		dest := filepath.Join(t.TempDir(), "out")
+		require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(payload)), dest, Options{ChecksumsPath: ChecksumsFileName}), name)
+		data, err := os.ReadFile(filepath.Join(dest, ChecksumsFileName))
+		require.NoError(t, err, name)
+		var checksums map[string]string
+		require.NoError(t, json.Unmarshal(data, &checksums), name)
+		assert.Equal(t, expected, checksums, name)
+	}
+
+	// an absolute path is used as is
+	checksumsPath := filepath.Join(t.TempDir(), "sums.json")
+	payload := tarBytes(t, files)
+	require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(payload)), t.TempDir(), Options{ChecksumsPath: checksumsPath}))
+	assert.FileExists(t, checksumsPath)
+}
+
+func TestArchiveStripAndTransform(t *testing.T) {
+	files := map[string]string{
+		"model-v1/config.json":         "config",
+		"model-v1/weights/a.bin":       "a",
+		"model-v1/tokenizer/vocab.txt": "vocab",
+		"README":                       "skipped",
+	}
+	opts := Options{
+		StripComponents: 1,
+		Transforms:      []Transform{{Old: "weights", New: "shards"}, {Old: "tokenizer", New: ""}},
+	}
+	for name, payload := range map[string][]byte{"tar": tarBytes(t, files), "zip": zipBytes(t, files)} {
+		dest := t.TempDir()
+		require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(payload)), dest, opts), name)
+		assertContent(t, "config", filepath.Join(dest, "config.json"))
+		assertContent(t, "a", filepath.Join(dest, "shards", "a.bin"))
+		assertContent(t, "vocab", filepath.Join(dest, "vocab.txt"))
+		assert.NoFileExists(t, filepath.Join(dest, "README"), name)
+	}
+
+	// a transform can't move entries outside of the destination
+	dest := t.TempDir()
+	payload := tarBytes(t, map[string]string{"a/b.txt": "b"})
+	err := Archive(bufio.NewReader(bytes.NewReader(payload)), dest, Options{Transforms: []Transform{{Old: "a", New: ".."}}})
+	assert.ErrorIs(t, err, ErrZipSlip)
+}
+
+func TestParseTransform(t *testing.T) {
+	transform, err := ParseTransform("model/=weights")
+	require.NoError(t, err)
+	assert.Equal(t, Transform{Old: "model", New: "weights"}, transform)
+	transform, err = ParseTransform("model=")
+	require.NoError(t, err)
+	assert.Equal(t, Transform{Old: "model"}, transform)
+
+	for _, expr := range []string{"model", "=weights", ""} {
+		_, err := ParseTransform(expr)
+		assert.Error(t, err, expr)
+	}
+}
+
+func TestArchiveCompressedFile(t *testing.T) {
+	dest := filepath.Join(t.TempDir(), "weights.bin")
+	payload := gzipBytes(t, []byte("not an archive"))
+	require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(payload)), dest, Options{}))
+	assertContent(t, "not an archive", dest)
+}
+
+func TestSniff(t *testing.T) {
+	tarball := tarBytes(t, map[string]string{"a.txt": "a"})
+	for expected, payload := range map[string][]byte{
+		"tar":  tarball,
+		"zip":  zipBytes(t, map[string]string{"a.txt": "a"}),
+		"gzip": gzipBytes(t, tarball),
+		"xz":   xzBytes(t, []byte("not an archive")),
+		"lz4":  lz4Bytes(t, []byte("not an archive")),
+		"":     []byte("not an archive"),
+	} {
+		r := bufio.NewReader(bytes.NewReader(payload))
+		assert.Equal(t, expected, Sniff(r), expected)
+		// the payload isn't consumed
+		buffered, err := r.Peek(len(payload))
+		require.NoError(t, err)
+		assert.Equal(t, payload, buffered)
+	}
+}
+
+func TestDecompress(t *testing.T) {
+	tarball := tarBytes(t, map[string]string{"a.txt": "a"})
+	// a compressed tar archive is decompressed, not extracted
+	dest := filepath.Join(t.TempDir(), "model.tar")
+	require.NoError(t, Decompress(bufio.NewReader(bytes.NewReader(gzipBytes(t, tarball))), dest, Options{}))
+	assertContent(t, string(tarball), dest)
+
+	err := Decompress(bufio.NewReader(bytes.NewReader(tarball)), filepath.Join(t.TempDir(), "model.tar"), Options{})
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+}
+
+func TestArchiveExplicitCompression(t *testing.T) {
+	payload := xzBytes(t, tarBytes(t, map[string]string{"a.txt": "a"}))
+	// a proxy mangling the first bytes defeats sniffing, but not an explicit compression
+	mangled := append([]byte{}, payload...)
+	mangled[0] = 0x00
+	err := Archive(bufio.NewReader(bytes.NewReader(mangled)), t.TempDir(), Options{})
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+
+	dest := t.TempDir()
+	require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(payload)), dest, Options{Compression: CompressionXZ}))
+	assertContent(t, "a", filepath.Join(dest, "a.txt"))
+
+	err = Archive(bufio.NewReader(bytes.NewReader(payload)), t.TempDir(), Options{Compression: CompressionLZ4})
+	assert.Error(t, err)
+
+	_, err = ParseCompression("rar")
+	assert.Error(t, err)
+	compression, err := ParseCompression("lz4")
+	require.NoError(t, err)
+	assert.Equal(t, CompressionLZ4, compression)
+}
+
+func TestArchiveTarNameLikeMagic(t *testing.T) {
+	// "BZ" is the bzip2 magic number, but a valid tar header takes precedence
+	dest := t.TempDir()
+	payload := tarBytes(t, map[string]string{"BZh9.txt": "tar"})
+	require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(payload)), dest, Options{}))
+	assertContent(t, "tar", filepath.Join(dest, "BZh9.txt"))
+}
+
+func TestArchiveErrors(t *testing.T) {
+	dest := t.TempDir()
+	err := Archive(bufio.NewReader(bytes.NewReader([]byte("plain text"))), dest, Options{})
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+
+	payload := zipBytes(t, map[string]string{"../escape.txt": "x"})
+	err = Archive(bufio.NewReader(bytes.NewReader(payload)), filepath.Join(dest, "out"), Options{})
+	assert.ErrorIs(t, err, ErrZipSlip)
+}
+
+func TestTarStream(t *testing.T) {
+	archive := tarBytes(t, map[string]string{"a.txt": "a"})
+	for name, payload := range map[string][]byte{"tar": archive, "tar.gz": gzipBytes(t, archive), "tar.xz": xzBytes(t, archive)} {
+		var out bytes.Buffer
+		require.NoError(t, TarStream(bufio.NewReader(bytes.NewReader(payload)), &out, ""), name)
+		assert.Equal(t, archive, out.Bytes(), name)
+	}
+
+	var out bytes.Buffer
+	err := TarStream(bufio.NewReader(bytes.NewReader(gzipBytes(t, []byte("not a tar")))), &out, "")
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+	assert.Zero(t, out.Len())
+}
+
+func TestArchiveDuplicates(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, content := range []string{"first", "second"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: "a.txt", Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(content))
+		require.NoError(t, err)
+	}
+	// a file later replaced by a symlink
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "b.txt", Mode: 0644, Size: 1, Typeflag: tar.TypeReg}))
+	_, err := tw.Write([]byte("b"))
+	require.NoError(t, err)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "b.txt", Linkname: "a.txt", Typeflag: tar.TypeSymlink}))
+	require.NoError(t, tw.Close())
+	payload := buf.Bytes()
+
+	dest := t.TempDir()
+	require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(payload)), dest, Options{}))
+	assertContent(t, "second", filepath.Join(dest, "a.txt"))
+	linkTarget, err := os.Readlink(filepath.Join(dest, "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "a.txt", linkTarget)
+
+	dest = t.TempDir()
+	require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(payload)), dest, Options{Duplicates: DuplicatesFirstWins}))
+	assertContent(t, "first", filepath.Join(dest, "a.txt"))
+	assertContent(t, "b", filepath.Join(dest, "b.txt"))
+
+	err = Archive(bufio.NewReader(bytes.NewReader(payload)), t.TempDir(), Options{Duplicates: DuplicatesFail})
+	assert.ErrorIs(t, err, ErrDuplicateEntry)
+
+	_, err = ParseDuplicatePolicy("newest")
+	assert.Error(t, err)
+}
+
+func TestArchiveFilters(t *testing.T) {
+	files := map[string]string{
+		"model/tokenizer.json":        "tokenizer",
+		"model/tokenizer_config.json": "config",
+		"model/weights/a.bin":         "a",
+		"model/tmp/tokenizer.json":    "tmp",
+	}
+	opts := Options{Include: []string{"tokenizer*"}, Exclude: []string{"model/tmp/*"}}
+	for name, payload := range map[string][]byte{"tar": tarBytes(t, files), "zip": zipBytes(t, files)} {
+		dest := t.TempDir()
+		require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(payload)), dest, opts), name)
+		assertContent(t, "tokenizer", filepath.Join(dest, "model", "tokenizer.json"))
+		assertContent(t, "config", filepath.Join(dest, "model", "tokenizer_config.json"))
+		assert.NoDirExists(t, filepath.Join(dest, "model", "weights"), name)
+		assert.NoDirExists(t, filepath.Join(dest, "model", "tmp"), name)
+	}
+
+	assert.Error(t, ValidatePatterns([]string{"*.json", "["}))
+}
+
+func TestArchiveCaseCollisions(t *testing.T) {
+	defer func(v bool) { caseInsensitiveFS = v }(caseInsensitiveFS)
+	payload := tarBytes(t, map[string]string{"README": "upper", "readme": "lower"})
+
+	caseInsensitiveFS = false
+	require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(payload)), t.TempDir(), Options{CaseCollisions: CaseCollisionsFail}))
+
+	caseInsensitiveFS = true
+	require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(payload)), t.TempDir(), Options{}))
+	err := Archive(bufio.NewReader(bytes.NewReader(payload)), t.TempDir(), Options{CaseCollisions: CaseCollisionsFail})
+	assert.ErrorIs(t, err, ErrCaseCollision)
+
+	_, err = ParseCaseCollisionPolicy("ignore")
+	assert.Error(t, err)
+}
+
+func TestArchivePreserveTimes(t *testing.T) {
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "d/", Mode: 0755, Typeflag: tar.TypeDir, ModTime: modTime}))
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "d/a.txt", Mode: 0644, Size: 1, Typeflag: tar.TypeReg, ModTime: modTime}))
+	_, err := tw.Write([]byte("a"))
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+
+	dest := t.TempDir()
+	require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(buf.Bytes())), dest, Options{Preserve: PreserveTimes}))
+	for _, name := range []string{"d", "d/a.txt"} {
+		info, err := os.Stat(filepath.Join(dest, name))
+		require.NoError(t, err)
+		assert.True(t, modTime.Equal(info.ModTime()), name)
+	}
+
+	preserve, err := ParsePreserve("owner, times,xattrs")
+	require.NoError(t, err)
+	assert.Equal(t, PreserveOwner|PreserveTimes|PreserveXattrs, preserve)
+	_, err = ParsePreserve("mode")
+	assert.Error(t, err)
+}
+
+func TestArchiveResume(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 1, Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte(name[:1]))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	payload := buf.Bytes()
+
+	// the download fails in the middle of the header of b.txt
+	dest := t.TempDir()
+	opts := Options{Resume: true, ChecksumsPath: ChecksumsFileName}
+	err := Archive(bufio.NewReader(bytes.NewReader(payload[:2*tarBlockSize+100])), dest, opts)
+	require.Error(t, err)
+	assert.FileExists(t, filepath.Join(dest, JournalFileName))
+
+	// a.txt is skipped as long as it is unchanged since it was journaled
+	aPath := filepath.Join(dest, "a.txt")
+	info, err := os.Stat(aPath)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(aPath, []byte("x"), 0644))
+	require.NoError(t, os.Chtimes(aPath, info.ModTime(), info.ModTime()))
+
+	progress := new(Progress)
+	opts.Progress = progress
+	require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(payload)), dest, opts))
+	assertContent(t, "x", aPath)
+	assertContent(t, "b", filepath.Join(dest, "b.txt"))
+	assert.Equal(t, int64(2), progress.Entries())
+	assert.Equal(t, int64(1), progress.Bytes())
+	assert.NoFileExists(t, filepath.Join(dest, JournalFileName))
+	// the checksum of a.txt is the journaled one
+	data, err := os.ReadFile(filepath.Join(dest, ChecksumsFileName))
+	require.NoError(t, err)
+	assert.Contains(t, string(data), "sha256:ca978112ca1bbdcafac231b39a23dc4da786eff8147c4e72b9807785afee48bb")
+
+	// without the journal, every file is extracted again
+	require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(payload)), dest, Options{Resume: true, Overwrite: true}))
+	assertContent(t, "a", aPath)
+}
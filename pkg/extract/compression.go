@@ -3,10 +3,12 @@ package extract
 import (
 	"bytes"
 	"compress/bzip2"
-	"compress/gzip"
 	"compress/lzw"
+	"fmt"
 	"io"
 
+	"github.com/klauspost/compress/zstd"
+	"github.com/klauspost/pgzip"
 	"github.com/pierrec/lz4"
 	"github.com/ulikunitz/xz"
 
@@ -22,23 +24,110 @@ var (
 	bzipMagic = []byte{0x42, 0x5A}
 	xzMagic   = []byte{0xFD, 0x37, 0x7A, 0x58, 0x5A, 0x00}
 	lzwMagic  = []byte{0x1F, 0x9D}
-	lz4Magic  = []byte{0x18, 0x4D, 0x22, 0x04}
+	// the lz4 frame magic number 0x184D2204, stored little-endian
+	lz4Magic  = []byte{0x04, 0x22, 0x4D, 0x18}
+	zstdMagic = []byte{0x28, 0xB5, 0x2F, 0xFD}
 )
 
+// Compression names a compression format, to decompress streams whose format can't be detected from their magic
+// number (e.g. when a proxy has re-encoded their first bytes). The zero value means the format is detected.
+type Compression string
+
+const (
+	CompressionGzip  Compression = "gzip"
+	CompressionBzip2 Compression = "bzip2"
+	CompressionXZ    Compression = "xz"
+	CompressionLZ4   Compression = "lz4"
+	CompressionZstd  Compression = "zstd"
+)
+
+// ParseCompression returns the Compression named name, which may be a format added with RegisterFormat, or the
+// zero value (detection) if name is empty.
+func ParseCompression(name string) (Compression, error) {
+	switch c := Compression(name); c {
+	case "", CompressionGzip, CompressionBzip2, CompressionXZ, CompressionLZ4, CompressionZstd:
+		return c, nil
+	default:
+		if registeredFormat(name) != nil {
+			return c, nil
+		}
+		return "", fmt.Errorf("invalid compression %s, expected one of gzip, bzip2, xz, lz4, zstd", name)
+	}
+}
+
+func (c Compression) decompressor() decompressor {
+	if d := c.builtinDecompressor(); d != nil {
+		return d
+	}
+	return registeredFormat(string(c))
+}
+
+func (c Compression) builtinDecompressor() decompressor {
+	switch c {
+	case CompressionGzip:
+		return gzipDecompressor{options: Gzip}
+	case CompressionBzip2:
+		return bzip2Decompressor{}
+	case CompressionXZ:
+		return xzDecompressor{}
+	case CompressionLZ4:
+		return lz4Decompressor{}
+	case CompressionZstd:
+		return zstdDecompressor{options: Zstd}
+	default:
+		return nil
+	}
+}
+
+// ZstdOptions configures the zstd decoder.
+type ZstdOptions struct {
+	// MaxWindow is the largest window size (in bytes) a stream may use, 0 for the decoder default
+	MaxWindow uint64
+	// Concurrency is the number of goroutines decoding blocks, 0 for GOMAXPROCS
+	Concurrency int
+}
+
+// Zstd configures the decoding of every zstd stream extracted by this package.
+var Zstd ZstdOptions
+
+// gzipBlockSize is the size of the blocks decoded ahead of the reader of a gzip stream
+const gzipBlockSize = 1 << 20
+
+// GzipOptions configures the gzip decoder. Deflate streams can't be decoded in parallel, so the decoder runs in
+// its own goroutine, ahead of the extraction, and verifies checksums in another.
+type GzipOptions struct {
+	// Readahead is how many bytes (rounded up to 1 MiB blocks) are decoded ahead of the extraction, 0 for the
+	// decoder default (4 MB)
+	Readahead uint64
+}
+
+func (o GzipOptions) blocks() int {
+	return int((o.Readahead + gzipBlockSize - 1) / gzipBlockSize)
+}
+
+// Gzip configures the decoding of every gzip stream extracted by this package.
+var Gzip GzipOptions
+
 var _ decompressor = gzipDecompressor{}
 var _ decompressor = bzip2Decompressor{}
 var _ decompressor = xzDecompressor{}
 var _ decompressor = lzwDecompressor{}
 var _ decompressor = lz4Decompressor{}
+var _ decompressor = zstdDecompressor{}
 
-// decompressor represents different compression formats.
+// decompressor represents different compression formats. If the returned reader is an io.Closer, it must be closed
+// once the stream has been consumed.
 type decompressor interface {
 	decompress(r io.Reader) (io.Reader, error)
 }
 
-// detectFormat returns the appropriate extractor according to the magic number.
+// detectFormat returns the appropriate extractor according to the magic number, trying the registered formats
+// first.
 func detectFormat(input []byte) decompressor {
 	log := logging.GetLogger()
+	if d := detectRegisteredFormat(input); d != nil {
+		return d
+	}
 	inputSize := len(input)
 
 	if inputSize < 2 {
@@ -54,7 +143,7 @@ func detectFormat(input []byte) decompressor {
 		log.Debug().
 			Str("type", "gzip").
 			Msg("Compression Format")
-		return gzipDecompressor{}
+		return gzipDecompressor{options: Gzip}
 	case bytes.HasPrefix(input, bzipMagic):
 		log.Debug().
 			Str("type", "bzip2").
@@ -83,6 +172,13 @@ func detectFormat(input []byte) decompressor {
 			Str("type", "xz").
 			Msg("Compression Format")
 		return xzDecompressor{}
+	case bytes.HasPrefix(input, zstdMagic):
+		log.Debug().
+			Str("type", "zstd").
+			Uint64("max_window", Zstd.MaxWindow).
+			Int("concurrency", Zstd.Concurrency).
+			Msg("Compression Format")
+		return zstdDecompressor{options: Zstd}
 	default:
 		log.Debug().
 			Str("type", "none").
@@ -92,10 +188,48 @@ func detectFormat(input []byte) decompressor {
 
 }
 
-type gzipDecompressor struct{}
+// decompressorName returns the name of the format d decompresses, or "" if d is nil.
+func decompressorName(d decompressor) string {
+	switch d := d.(type) {
+	case gzipDecompressor:
+		return string(CompressionGzip)
+	case bzip2Decompressor:
+		return string(CompressionBzip2)
+	case xzDecompressor:
+		return string(CompressionXZ)
+	case lzwDecompressor:
+		return "lzw"
+	case lz4Decompressor:
+		return string(CompressionLZ4)
+	case zstdDecompressor:
+		return string(CompressionZstd)
+	case formatDecompressor:
+		return d.format.Name
+	default:
+		return ""
+	}
+}
+
+type gzipDecompressor struct {
+	options GzipOptions
+}
 
 func (d gzipDecompressor) decompress(r io.Reader) (io.Reader, error) {
-	return gzip.NewReader(r)
+	var z *pgzip.Reader
+	var err error
+	if d.options.Readahead == 0 {
+		z, err = pgzip.NewReader(r)
+	} else {
+		z, err = pgzip.NewReaderN(r, gzipBlockSize, d.options.blocks())
+	}
+	if err != nil {
+		return nil, err
+	}
+	// hide pgzip's WriteTo, which fails with io.EOF once the stream has been read (e.g. peeked) to its end
+	return struct {
+		io.Reader
+		io.Closer
+	}{z, z}, nil
 }
 
 type bzip2Decompressor struct{}
@@ -124,3 +258,20 @@ type lz4Decompressor struct{}
 func (d lz4Decompressor) decompress(r io.Reader) (io.Reader, error) {
 	return lz4.NewReader(r), nil
 }
+
+type zstdDecompressor struct {
+	options ZstdOptions
+}
+
+func (d zstdDecompressor) decompress(r io.Reader) (io.Reader, error) {
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(d.options.Concurrency)}
+	if d.options.MaxWindow > 0 {
+		opts = append(opts, zstd.WithDecoderMaxWindow(d.options.MaxWindow))
+	}
+	decoder, err := zstd.NewReader(r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	// closing the decoder stops its goroutines
+	return decoder.IOReadCloser(), nil
+}
@@ -1,10 +1,17 @@
 package extract
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
 	"fmt"
+	"io"
+	"path/filepath"
 	"testing"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestDetectFormat(t *testing.T) {
@@ -28,6 +35,16 @@ func TestDetectFormat(t *testing.T) {
 			input:      []byte{0xfd, 0x37, 0x7a, 0x58, 0x5a, 0x00},
 			expectType: "extract.xzDecompressor",
 		},
+		{
+			name:       "LZ4",
+			input:      []byte{0x04, 0x22, 0x4d, 0x18},
+			expectType: "extract.lz4Decompressor",
+		},
+		{
+			name:       "ZSTD",
+			input:      []byte{0x28, 0xb5, 0x2f, 0xfd},
+			expectType: "extract.zstdDecompressor",
+		},
 		{
 			name:       "Less than 2 bytes",
 			input:      []byte{0x1f},
@@ -48,6 +65,103 @@ func TestDetectFormat(t *testing.T) {
 	}
 }
 
+func TestZstdDecompressor(t *testing.T) {
+	data := bytes.Repeat([]byte("rpget zstd "), 64*1024)
+	encoder, err := zstd.NewWriter(nil, zstd.WithWindowSize(1<<20))
+	require.NoError(t, err)
+	compressed := encoder.EncodeAll(data, nil)
+
+	d := zstdDecompressor{options: ZstdOptions{Concurrency: 2}}
+	reader, err := d.decompress(bytes.NewReader(compressed))
+	require.NoError(t, err)
+	decompressed, err := io.ReadAll(reader)
+	require.NoError(t, err)
+	assert.Equal(t, data, decompressed)
+	require.NoError(t, reader.(io.Closer).Close())
+
+	// a window larger than allowed is refused
+	d = zstdDecompressor{options: ZstdOptions{MaxWindow: zstd.MinWindowSize}}
+	reader, err = d.decompress(bytes.NewReader(compressed))
+	require.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	assert.Error(t, err)
+}
+
+func TestGzipDecompressor(t *testing.T) {
+	// larger than the read-ahead, and split over two members as written by parallel compressors
+	data := bytes.Repeat([]byte("rpget gzip "), 512*1024)
+	var compressed bytes.Buffer
+	for _, part := range [][]byte{data[:len(data)/2], data[len(data)/2:]} {
+		w := gzip.NewWriter(&compressed)
+		_, err := w.Write(part)
+		require.NoError(t, err)
+		require.NoError(t, w.Close())
+	}
+
+	for _, options := range []GzipOptions{{}, {Readahead: 3 << 20}} {
+		reader, err := gzipDecompressor{options: options}.decompress(bytes.NewReader(compressed.Bytes()))
+		require.NoError(t, err)
+		decompressed, err := io.ReadAll(reader)
+		require.NoError(t, err)
+		assert.Equal(t, data, decompressed)
+		require.NoError(t, reader.(io.Closer).Close())
+	}
+	assert.Equal(t, 3, GzipOptions{Readahead: 3 << 20}.blocks())
+	assert.Equal(t, 1, GzipOptions{Readahead: 1}.blocks())
+
+	// a corrupted checksum is an error
+	corrupted := bytes.Clone(compressed.Bytes())
+	corrupted[len(corrupted)-5] ^= 0xFF
+	reader, err := gzipDecompressor{}.decompress(bytes.NewReader(corrupted))
+	require.NoError(t, err)
+	_, err = io.ReadAll(reader)
+	assert.Error(t, err)
+}
+
+func TestRegisterFormat(t *testing.T) {
+	saved := formats.list
+	savedPeekSize := formats.peekSize
+	t.Cleanup(func() {
+		formats.list = saved
+		formats.peekSize = savedPeekSize
+	})
+
+	// a container prefixing a tar archive with a 16 bytes header, detected from its first 12 bytes
+	header := []byte("RPWEIGHTS001\x00\x00\x00\x00")
+	RegisterFormat(Format{
+		Name:     "rpweights",
+		PeekSize: 12,
+		Detect: func(peek []byte) bool {
+			return bytes.Equal(peek, header[:12])
+		},
+		Decode: func(r io.Reader) (io.Reader, error) {
+			if _, err := io.CopyN(io.Discard, r, int64(len(header))); err != nil {
+				return nil, err
+			}
+			return r, nil
+		},
+	})
+	assert.Equal(t, 12, detectionPeekSize())
+	detectNothing := func([]byte) bool { return false }
+	identity := func(r io.Reader) (io.Reader, error) { return r, nil }
+	assert.Panics(t, func() { RegisterFormat(Format{Name: "rpweights", Detect: detectNothing, Decode: identity}) })
+	assert.Panics(t, func() { RegisterFormat(Format{Name: "gzip", Detect: detectNothing, Decode: identity}) })
+	assert.Panics(t, func() { RegisterFormat(Format{Name: "nodecode", Detect: detectNothing}) })
+
+	payload := append(bytes.Clone(header), tarBytes(t, map[string]string{"a.txt": "a"})...)
+	assert.Equal(t, "extract.formatDecompressor", stringFromInterface(detectFormat(payload[:12])))
+
+	dest := t.TempDir()
+	require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(payload)), dest, Options{}))
+	assertContent(t, "a", filepath.Join(dest, "a.txt"))
+
+	compression, err := ParseCompression("rpweights")
+	require.NoError(t, err)
+	dest = t.TempDir()
+	require.NoError(t, Archive(bufio.NewReader(bytes.NewReader(payload)), dest, Options{Compression: compression}))
+	assertContent(t, "a", filepath.Join(dest, "a.txt"))
+}
+
 func stringFromInterface(i interface{}) string {
 	if i == nil {
 		return ""
@@ -0,0 +1,178 @@
+package extract
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// ErrDuplicateEntry is returned by an extraction with the DuplicatesFail policy when an archive contains the same
+// path more than once.
+var ErrDuplicateEntry = errors.New("archive contains the same path more than once")
+
+// DuplicatePolicy decides what happens when an archive contains the same path more than once, e.g. a file
+// appended twice or a file later replaced by a symlink or directory, a known pattern to smuggle content past
+// reviews of an archive listing. Directories repeated as directories are not duplicates.
+type DuplicatePolicy string
+
+const (
+	// DuplicatesLastWins replaces the earlier entry, as tar(1) does
+	DuplicatesLastWins DuplicatePolicy = "last-wins"
+	// DuplicatesFirstWins skips the later entry
+	DuplicatesFirstWins DuplicatePolicy = "first-wins"
+	// DuplicatesFail fails the extraction with ErrDuplicateEntry
+	DuplicatesFail DuplicatePolicy = "fail"
+)
+
+// ParseDuplicatePolicy returns the DuplicatePolicy named name, defaulting to DuplicatesLastWins if name is empty.
+func ParseDuplicatePolicy(name string) (DuplicatePolicy, error) {
+	switch p := DuplicatePolicy(name); p {
+	case "":
+		return DuplicatesLastWins, nil
+	case DuplicatesLastWins, DuplicatesFirstWins, DuplicatesFail:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid duplicate policy %s, expected one of last-wins, first-wins, fail", name)
+	}
+}
+
+// ErrCaseCollision is returned by an extraction with the CaseCollisionsFail policy when two archive paths differ
+// only by case on a case-insensitive filesystem.
+var ErrCaseCollision = errors.New("archive paths collide on a case-insensitive filesystem")
+
+// CaseCollisionPolicy decides what happens when two archive paths differ only by case, e.g. "README" and "readme",
+// and so are the same path on the case-insensitive filesystems macOS and Windows use by default: the later entry
+// silently overwrites or merges into the earlier one.
+type CaseCollisionPolicy string
+
+const (
+	// CaseCollisionsWarn logs the collision and extracts the entry anyway
+	CaseCollisionsWarn CaseCollisionPolicy = "warn"
+	// CaseCollisionsFail fails the extraction with ErrCaseCollision
+	CaseCollisionsFail CaseCollisionPolicy = "fail"
+)
+
+// caseInsensitiveFS is whether paths differing only by case are checked for, as they collide on the default
+// filesystems of these platforms.
+var caseInsensitiveFS = runtime.GOOS == "darwin" || runtime.GOOS == "windows"
+
+// ParseCaseCollisionPolicy returns the CaseCollisionPolicy named name, defaulting to CaseCollisionsWarn if name is
+// empty.
+func ParseCaseCollisionPolicy(name string) (CaseCollisionPolicy, error) {
+	switch p := CaseCollisionPolicy(name); p {
+	case "":
+		return CaseCollisionsWarn, nil
+	case CaseCollisionsWarn, CaseCollisionsFail:
+		return p, nil
+	default:
+		return "", fmt.Errorf("invalid case collision policy %s, expected one of warn, fail", name)
+	}
+}
+
+type entryKind int
+
+const (
+	kindFile entryKind = iota
+	kindDir
+	kindLink
+)
+
+func (k entryKind) String() string {
+	switch k {
+	case kindDir:
+		return "directory"
+	case kindLink:
+		return "link"
+	default:
+		return "file"
+	}
+}
+
+// claim records that target is extracted as kind, applying the duplicate policy if an earlier entry of the
+// archive was extracted at the same path. It returns false if the entry must be skipped.
+func (x *extraction) claim(target string, kind entryKind) (bool, error) {
+	logger := logging.GetLogger()
+	key := filepath.Clean(target)
+	previous, seen := x.seen[key]
+	if !seen || (previous == kindDir && kind == kindDir) {
+		if err := x.checkCase(key); err != nil {
+			return false, err
+		}
+		x.seen[key] = kind
+		return true, nil
+	}
+
+	policy := x.opts.Duplicates
+	if policy == "" {
+		policy = DuplicatesLastWins
+	}
+	logger.Warn().
+		Str("target", target).
+		Str("previous", previous.String()).
+		Str("current", kind.String()).
+		Str("policy", string(policy)).
+		Msg("Extract: Duplicate Entry")
+	switch policy {
+	case DuplicatesFail:
+		return false, fmt.Errorf("%w: %s (%s, then %s)", ErrDuplicateEntry, target, previous, kind)
+	case DuplicatesFirstWins:
+		return false, nil
+	}
+
+	// last wins: undo the earlier entry
+	if previous == kindLink {
+		links := x.links[:0]
+		for _, l := range x.links {
+			if filepath.Clean(l.newName) != key {
+				links = append(links, l)
+			}
+		}
+		x.links = links
+	} else {
+		if err := os.RemoveAll(target); err != nil {
+			return false, fmt.Errorf("error replacing duplicate entry %s: %w", target, err)
+		}
+		x.tree.Forget(target)
+	}
+	for name := range x.checksums {
+		if filepath.Join(x.destDir, name) == key {
+			delete(x.checksums, name)
+		}
+	}
+	x.seen[key] = kind
+	return true, nil
+}
+
+// checkCase applies the case collision policy if key differs only by case from a path extracted earlier.
+func (x *extraction) checkCase(key string) error {
+	if !caseInsensitiveFS {
+		return nil
+	}
+	folded := strings.ToLower(key)
+	other, seen := x.folded[folded]
+	if !seen {
+		x.folded[folded] = key
+		return nil
+	}
+	if other == key {
+		return nil
+	}
+	policy := x.opts.CaseCollisions
+	if policy == "" {
+		policy = CaseCollisionsWarn
+	}
+	if policy == CaseCollisionsFail {
+		return fmt.Errorf("%w: %s and %s", ErrCaseCollision, other, key)
+	}
+	logger := logging.GetLogger()
+	logger.Warn().
+		Str("target", key).
+		Str("collides_with", other).
+		Msg("Extract: Case-Insensitive Collision")
+	return nil
+}
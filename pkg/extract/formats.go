@@ -0,0 +1,115 @@
+package extract
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// MaxPeekSize is the largest Format.PeekSize: the first bytes of a payload are peeked from a bufio.Reader, whose
+// default buffer holds 4096 bytes.
+const MaxPeekSize = 4096
+
+// Format is a custom compression or container format, detected from the first bytes of a payload like the built-in
+// compression formats. Its decoded stream is extracted like a decompressed one: as a tar archive if it is one,
+// otherwise as a single file.
+type Format struct {
+	// Name identifies the format in logs, and selects it as a Compression
+	Name string
+	// PeekSize is the number of bytes Detect needs, at most MaxPeekSize. If zero, 8 bytes are peeked.
+	PeekSize int
+	// Detect reports whether the payload starting with peek is in this format. peek is shorter than PeekSize if the
+	// payload is.
+	Detect func(peek []byte) bool
+	// Decode returns the decoded stream of the payload read from r. If it is an io.Closer, it is closed once it has
+	// been consumed.
+	Decode func(r io.Reader) (io.Reader, error)
+}
+
+var formats struct {
+	mu       sync.RWMutex
+	list     []Format
+	peekSize int
+}
+
+// RegisterFormat registers a custom format, which is detected before the built-in formats and in registration order.
+// It panics if f is invalid or if a format with the same name is already registered.
+func RegisterFormat(f Format) {
+	if f.Name == "" || f.Detect == nil || f.Decode == nil {
+		panic("extract: RegisterFormat requires a name, Detect and Decode")
+	}
+	if f.PeekSize < 0 || f.PeekSize > MaxPeekSize {
+		panic(fmt.Sprintf("extract: peek size %d of format %s is not between 0 and %d", f.PeekSize, f.Name, MaxPeekSize))
+	}
+	formats.mu.Lock()
+	defer formats.mu.Unlock()
+	if Compression(f.Name).builtinDecompressor() != nil || lookupFormat(f.Name) != nil {
+		panic(fmt.Sprintf("extract: format %s is already registered", f.Name))
+	}
+	formats.list = append(formats.list, f)
+	formats.peekSize = max(formats.peekSize, f.PeekSize)
+}
+
+func (f Format) peekSize() int {
+	if f.PeekSize == 0 {
+		return peekSize
+	}
+	return f.PeekSize
+}
+
+// lookupFormat returns the registered format named name, if any. formats.mu must be held.
+func lookupFormat(name string) *Format {
+	for i := range formats.list {
+		if formats.list[i].Name == name {
+			return &formats.list[i]
+		}
+	}
+	return nil
+}
+
+// registeredFormat returns the decompressor of the registered format named name, or nil.
+func registeredFormat(name string) decompressor {
+	formats.mu.RLock()
+	defer formats.mu.RUnlock()
+	if f := lookupFormat(name); f != nil {
+		return formatDecompressor{*f}
+	}
+	return nil
+}
+
+// detectRegisteredFormat returns the decompressor of the first registered format detecting input, or nil.
+func detectRegisteredFormat(input []byte) decompressor {
+	formats.mu.RLock()
+	defer formats.mu.RUnlock()
+	for _, f := range formats.list {
+		peek := input
+		if n := f.peekSize(); len(peek) > n {
+			peek = peek[:n]
+		}
+		if f.Detect(peek) {
+			logger := logging.GetLogger()
+			logger.Debug().
+				Str("type", f.Name).
+				Msg("Compression Format")
+			return formatDecompressor{f}
+		}
+	}
+	return nil
+}
+
+// detectionPeekSize is the number of bytes peeked to detect the format of a payload.
+func detectionPeekSize() int {
+	formats.mu.RLock()
+	defer formats.mu.RUnlock()
+	return max(peekSize, formats.peekSize)
+}
+
+type formatDecompressor struct {
+	format Format
+}
+
+func (d formatDecompressor) decompress(r io.Reader) (io.Reader, error) {
+	return d.format.Decode(r)
+}
@@ -0,0 +1,47 @@
+package extract
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// FuzzArchive feeds arbitrary payloads through format detection, the decompressors and the tar and zip
+// extractors, which all consume untrusted input: they must fail cleanly rather than panic, and never write outside
+// the destination.
+func FuzzArchive(f *testing.F) {
+	files := map[string]string{"a.txt": "hello", "dir/b.txt": "world"}
+	archive := tarBytes(f, files)
+	f.Add(archive)
+	f.Add(gzipBytes(f, archive))
+	f.Add(xzBytes(f, archive))
+	f.Add(lz4Bytes(f, archive))
+	f.Add(zipBytes(f, files))
+	f.Add(gzipBytes(f, []byte("not an archive")))
+	f.Add(zipBytes(f, map[string]string{"../escape.txt": "x"}))
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	require.NoError(f, tw.WriteHeader(&tar.Header{Name: "link", Linkname: "../../outside", Typeflag: tar.TypeSymlink}))
+	require.NoError(f, tw.WriteHeader(&tar.Header{Name: "link/escape.txt", Mode: 0644, Typeflag: tar.TypeReg}))
+	require.NoError(f, tw.WriteHeader(&tar.Header{Name: "/abs/../../escape.txt", Mode: 0644, Typeflag: tar.TypeReg}))
+	require.NoError(f, tw.Close())
+	f.Add(buf.Bytes())
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		root := t.TempDir()
+		dest := filepath.Join(root, "dest")
+		_ = Archive(bufio.NewReader(bytes.NewReader(data)), dest, Options{})
+
+		entries, err := os.ReadDir(root)
+		require.NoError(t, err)
+		for _, entry := range entries {
+			require.Equal(t, "dest", entry.Name(), "extraction wrote outside its destination")
+		}
+	})
+}
@@ -0,0 +1,113 @@
+package extract
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// JournalFileName is the name of the journal written to the destination directory of a resumable extraction.
+const JournalFileName = ".rpget-extract-journal"
+
+// journalRecord is a line of the journal: a regular file completely written by an earlier run of the extraction,
+// with its size and modification time once written.
+type journalRecord struct {
+	Path    string `json:"path"`
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"mtime"`
+	// Checksum is only recorded if checksums were requested
+	Checksum string `json:"sha256,omitempty"`
+}
+
+// journal records the regular files extracted into a directory, so that extracting the same archive again after a
+// failure skips the files which are still as they were written. It is removed once the extraction completes.
+type journal struct {
+	path string
+	file *os.File
+	// previous maps the paths recorded by earlier runs to their latest record
+	previous map[string]journalRecord
+}
+
+// openJournal reads the journal left in destDir by an earlier run, then opens it for appending.
+func openJournal(destDir string) (*journal, error) {
+	logger := logging.GetLogger()
+	if err := os.MkdirAll(destDir, 0755); err != nil {
+		return nil, err
+	}
+	j := &journal{path: filepath.Join(destDir, JournalFileName), previous: make(map[string]journalRecord)}
+	f, err := os.Open(j.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("error opening extraction journal: %w", err)
+	}
+	if f != nil {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var record journalRecord
+			// the last line may be truncated if the earlier run was killed while writing it
+			if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+				continue
+			}
+			j.previous[record.Path] = record
+		}
+		err := scanner.Err()
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("error reading extraction journal: %w", err)
+		}
+		logger.Info().
+			Str("journal", j.path).
+			Int("files", len(j.previous)).
+			Msg("Extract: Resuming")
+	}
+	if j.file, err = os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, fmt.Errorf("error opening extraction journal: %w", err)
+	}
+	return j, nil
+}
+
+// lookup returns the record of the file at rel if it was extracted by an earlier run with this size and is
+// unchanged since.
+func (j *journal) lookup(rel string, size int64) (journalRecord, bool) {
+	record, ok := j.previous[rel]
+	if !ok || record.Size != size {
+		return journalRecord{}, false
+	}
+	info, err := os.Lstat(filepath.Join(filepath.Dir(j.path), rel))
+	if err != nil || !info.Mode().IsRegular() || info.Size() != record.Size || info.ModTime().UnixNano() != record.ModTime {
+		return journalRecord{}, false
+	}
+	return record, true
+}
+
+// record appends the file at rel, as it is on disk now, to the journal.
+func (j *journal) record(rel, checksum string) error {
+	info, err := os.Stat(filepath.Join(filepath.Dir(j.path), rel))
+	if err != nil {
+		return err
+	}
+	line, err := json.Marshal(journalRecord{Path: rel, Size: info.Size(), ModTime: info.ModTime().UnixNano(), Checksum: checksum})
+	if err != nil {
+		return err
+	}
+	if _, err := j.file.Write(append(line, '\n')); err != nil {
+		return fmt.Errorf("error writing extraction journal: %w", err)
+	}
+	return nil
+}
+
+func (j *journal) close() error {
+	return j.file.Close()
+}
+
+// remove closes and deletes the journal of a completed extraction.
+func (j *journal) remove() error {
+	if err := j.close(); err != nil {
+		return err
+	}
+	return os.Remove(j.path)
+}
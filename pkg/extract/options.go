@@ -0,0 +1,332 @@
+package extract
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/emaballarin/rpget/pkg/dirtree"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// ChecksumsFileName is the conventional name of the checksums file written by an extraction.
+const ChecksumsFileName = "CHECKSUMS.json"
+
+// ErrLimitExceeded is returned when an archive has more entries, or expands to more bytes, than the limits of an
+// extraction allow.
+var ErrLimitExceeded = errors.New("archive exceeds extraction limits")
+
+// Options configures an extraction.
+type Options struct {
+	// Overwrite existing files
+	Overwrite bool
+	// Compression, if set, decompresses the payload with this format instead of detecting it
+	Compression Compression
+	// ChecksumsPath, if set, is where a JSON object mapping the path of every extracted regular file, relative to
+	// the destination, to its "sha256:<hex>" checksum is written. A relative path is relative to the destination
+	// directory.
+	ChecksumsPath string
+	// StripComponents leading path components are removed from the name of every archive entry; entries with no
+	// more components are skipped
+	StripComponents int
+	// Transforms are applied in order to entry names once stripped; the first matching transform is used
+	Transforms []Transform
+	// Duplicates is the policy for paths found more than once in an archive, DuplicatesLastWins if unset
+	Duplicates DuplicatePolicy
+	// CaseCollisions is the policy for paths differing only by case on macOS and Windows, CaseCollisionsWarn if
+	// unset
+	CaseCollisions CaseCollisionPolicy
+	// Preserve selects the metadata of archive entries applied to extracted files
+	Preserve Preserve
+	// Resume journals the regular files extracted from an archive in JournalFileName in the destination
+	// directory, until the extraction completes. Extracting the same archive again after a failure skips the files
+	// recorded by the journal whose size and modification time haven't changed.
+	Resume bool
+	// MaxEntries, if positive, fails the extraction with ErrLimitExceeded once more entries have been extracted
+	MaxEntries int64
+	// MaxBytes, if positive, fails the extraction with ErrLimitExceeded once more bytes have been written to
+	// extracted files, guarding against archives expanding to far more than expected
+	MaxBytes int64
+	// TempDir, if set, holds the temporary files of the extraction, e.g. zip archives spooled before being
+	// extracted. Otherwise they are created next to the destination.
+	TempDir string
+	// Progress, if set, is updated as entries are extracted
+	Progress *Progress
+	// Include, if not empty, restricts extraction to the entries matching one of these patterns
+	Include []string
+	// Exclude skips the entries matching one of these patterns. Patterns use path.Match syntax and are matched
+	// against entry paths in the archive: a pattern without a slash is matched against the base name, any other
+	// pattern against the whole path.
+	Exclude []string
+}
+
+// ValidatePatterns returns an error if one of patterns is not a valid path.Match pattern.
+func ValidatePatterns(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	return nil
+}
+
+// Transform replaces the leading path prefix Old of archive entry names with New. The prefix matches whole path
+// components: "model=weights" maps "model/a.bin" to "weights/a.bin" but leaves "models/a.bin" unchanged.
+type Transform struct {
+	Old string
+	New string
+}
+
+// ParseTransform parses a transform of the form "old=new". new may be empty to move entries under old to the
+// destination root.
+func ParseTransform(expr string) (Transform, error) {
+	old, replacement, ok := strings.Cut(expr, "=")
+	old = strings.Trim(old, "/")
+	if !ok || old == "" {
+		return Transform{}, fmt.Errorf("invalid transform `%s`, expected <old>=<new>", expr)
+	}
+	return Transform{Old: old, New: strings.Trim(replacement, "/")}, nil
+}
+
+func (t Transform) apply(name string) (string, bool) {
+	if name == t.Old {
+		return t.New, true
+	}
+	if rest, ok := strings.CutPrefix(name, t.Old+"/"); ok {
+		return path.Join(t.New, rest), true
+	}
+	return name, false
+}
+
+// extraction holds the state of a single extraction into destDir.
+type extraction struct {
+	destDir string
+	opts    Options
+	// checksums is nil unless opts.ChecksumsPath is set
+	checksums map[string]string
+	// seen is the kind of every path extracted so far
+	seen map[string]entryKind
+	// folded maps the lower case form of every path extracted so far to the path
+	folded map[string]string
+	// links are created once every file has been extracted
+	links []*link
+	// deferred is the metadata applied once the extraction is complete
+	deferred    []entryMetadata
+	ownerWarned bool
+	// journal is nil unless opts.Resume is set
+	journal *journal
+	resumed int
+	// entries and written are counted against opts.MaxEntries and opts.MaxBytes
+	entries int64
+	written int64
+	// tree creates the directories of the extraction and opens its files
+	tree *dirtree.Tree
+}
+
+func newExtraction(destDir string, opts Options) *extraction {
+	x := &extraction{
+		destDir: destDir,
+		opts:    opts,
+		seen:    make(map[string]entryKind),
+		folded:  make(map[string]string),
+		tree:    dirtree.New(),
+	}
+	if opts.ChecksumsPath != "" {
+		x.checksums = make(map[string]string)
+	}
+	return x
+}
+
+// included reports whether the archive entry name passes the Include and Exclude filters.
+func (x *extraction) included(name string) bool {
+	name = strings.Trim(strings.TrimPrefix(name, "./"), "/")
+	if len(x.opts.Include) > 0 && !matchAny(x.opts.Include, name) {
+		return false
+	}
+	return !matchAny(x.opts.Exclude, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		target := name
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(name)
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// mapName returns the name archive entry name is extracted as, after StripComponents and Transforms, or false if
+// the entry is to be skipped.
+func (x *extraction) mapName(name string) (string, bool) {
+	name = strings.TrimPrefix(name, "./")
+	if x.opts.StripComponents > 0 {
+		parts := strings.Split(name, "/")
+		if len(parts) <= x.opts.StripComponents {
+			return "", false
+		}
+		name = strings.Join(parts[x.opts.StripComponents:], "/")
+	}
+	for _, t := range x.opts.Transforms {
+		var ok bool
+		if name, ok = t.apply(strings.TrimSuffix(name, "/")); ok {
+			break
+		}
+	}
+	if strings.Trim(name, "/") == "" {
+		return "", false
+	}
+	return name, true
+}
+
+// writeFile writes the contents of r to the file target, truncating an existing file if opts.Overwrite is set.
+func (x *extraction) writeFile(r io.Reader, target string, mode os.FileMode) error {
+	var h hash.Hash
+	if x.checksums != nil {
+		h = sha256.New()
+		r = io.TeeReader(r, h)
+	}
+	if x.opts.MaxBytes > 0 {
+		// one more byte than allowed tells a file at the limit from a file over it
+		r = io.LimitReader(r, x.opts.MaxBytes-x.written+1)
+	}
+	openFlags := os.O_CREATE | os.O_WRONLY
+	if x.opts.Overwrite {
+		openFlags |= os.O_TRUNC
+	}
+	targetFile, err := x.tree.OpenFile(target, openFlags, mode)
+	if err != nil {
+		return err
+	}
+	n, err := io.Copy(x.opts.Progress.writer(targetFile), r)
+	if err != nil {
+		targetFile.Close()
+		return err
+	}
+	if err := targetFile.Close(); err != nil {
+		return fmt.Errorf("error closing file %s: %w", target, err)
+	}
+	x.written += n
+	if x.opts.MaxBytes > 0 && x.written > x.opts.MaxBytes {
+		return fmt.Errorf("%w: more than %d bytes extracted", ErrLimitExceeded, x.opts.MaxBytes)
+	}
+	if h != nil {
+		rel, err := filepath.Rel(x.destDir, target)
+		if err != nil {
+			return err
+		}
+		x.checksums[filepath.ToSlash(rel)] = "sha256:" + hex.EncodeToString(h.Sum(nil))
+	}
+	return nil
+}
+
+// addEntry counts an extracted entry.
+func (x *extraction) addEntry() error {
+	x.opts.Progress.addEntry()
+	x.entries++
+	if x.opts.MaxEntries > 0 && x.entries > x.opts.MaxEntries {
+		return fmt.Errorf("%w: more than %d entries", ErrLimitExceeded, x.opts.MaxEntries)
+	}
+	return nil
+}
+
+// startJournal opens the journal of the extraction, if it is resumable.
+func (x *extraction) startJournal() error {
+	if !x.opts.Resume {
+		return nil
+	}
+	var err error
+	x.journal, err = openJournal(x.destDir)
+	return err
+}
+
+// closeJournal closes the journal, leaving it for the next run if the extraction failed.
+func (x *extraction) closeJournal() {
+	if x.journal != nil {
+		x.journal.close()
+	}
+}
+
+// resume reports whether the regular file target, of the given size, was extracted by an earlier run and can be
+// skipped.
+func (x *extraction) resume(target string, size int64) (bool, error) {
+	if x.journal == nil {
+		return false, nil
+	}
+	rel, err := filepath.Rel(x.destDir, target)
+	if err != nil {
+		return false, err
+	}
+	rel = filepath.ToSlash(rel)
+	record, ok := x.journal.lookup(rel, size)
+	if !ok {
+		return false, nil
+	}
+	if x.checksums != nil {
+		if record.Checksum == "" {
+			// checksums weren't requested by the earlier run
+			return false, nil
+		}
+		x.checksums[rel] = record.Checksum
+	}
+	x.resumed++
+	return true, nil
+}
+
+// journalFile records the regular file target once it is completely written.
+func (x *extraction) journalFile(target string) error {
+	if x.journal == nil {
+		return nil
+	}
+	rel, err := filepath.Rel(x.destDir, target)
+	if err != nil {
+		return err
+	}
+	rel = filepath.ToSlash(rel)
+	return x.journal.record(rel, x.checksums[rel])
+}
+
+// finish writes the checksums file, if requested, and removes the journal.
+func (x *extraction) finish() error {
+	if x.journal != nil {
+		if x.resumed > 0 {
+			logger := logging.GetLogger()
+			logger.Info().
+				Int("resumed_files", x.resumed).
+				Msg("Extract: Resumed")
+		}
+		if err := x.journal.remove(); err != nil {
+			return fmt.Errorf("error removing extraction journal: %w", err)
+		}
+		x.journal = nil
+	}
+	if x.checksums == nil {
+		return nil
+	}
+	path := x.opts.ChecksumsPath
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(x.destDir, path)
+	}
+	data, err := json.MarshalIndent(x.checksums, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		return fmt.Errorf("error writing checksums to %s: %w", path, err)
+	}
+	return nil
+}
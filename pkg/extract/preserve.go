@@ -0,0 +1,146 @@
+package extract
+
+import (
+	"archive/tar"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// Preserve selects the metadata of archive entries applied to the extracted files, which is otherwise dropped.
+type Preserve uint8
+
+const (
+	// PreserveOwner sets the owner and group of extracted files, and keeps their setuid, setgid and sticky bits.
+	// It requires running as root and is skipped with a warning otherwise.
+	PreserveOwner Preserve = 1 << iota
+	// PreserveTimes sets the access and modification times of extracted files and directories
+	PreserveTimes
+	// PreserveXattrs sets the extended attributes of extracted files (Linux and macOS only)
+	PreserveXattrs
+)
+
+// paxXattrPrefix prefixes the PAX records holding extended attributes
+const paxXattrPrefix = "SCHILY.xattr."
+
+// ParsePreserve parses a comma separated list of the metadata to preserve: owner, times and xattrs.
+func ParsePreserve(list string) (Preserve, error) {
+	var p Preserve
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(name) {
+		case "":
+		case "owner":
+			p |= PreserveOwner
+		case "times":
+			p |= PreserveTimes
+		case "xattrs":
+			p |= PreserveXattrs
+		default:
+			return 0, fmt.Errorf("invalid metadata %s to preserve, expected owner, times or xattrs", name)
+		}
+	}
+	return p, nil
+}
+
+// entryMetadata is the metadata of an archive entry which may be preserved.
+type entryMetadata struct {
+	target string
+	// mode includes the setuid, setgid and sticky bits
+	mode os.FileMode
+	// owner is set if uid and gid are known
+	owner      bool
+	uid, gid   int
+	accessTime time.Time
+	modTime    time.Time
+	xattrs     map[string]string
+	// link is set for symlinks, whose times and mode can't be set portably
+	link bool
+}
+
+func tarMetadata(header *tar.Header, target string) entryMetadata {
+	m := entryMetadata{
+		target:     target,
+		mode:       header.FileInfo().Mode(),
+		owner:      true,
+		uid:        header.Uid,
+		gid:        header.Gid,
+		accessTime: header.AccessTime,
+		modTime:    header.ModTime,
+		link:       header.Typeflag == tar.TypeSymlink,
+	}
+	for key, value := range header.PAXRecords {
+		if name, ok := strings.CutPrefix(key, paxXattrPrefix); ok {
+			if m.xattrs == nil {
+				m.xattrs = make(map[string]string)
+			}
+			m.xattrs[name] = value
+		}
+	}
+	return m
+}
+
+// preserve applies the metadata of an extracted entry. Directories' metadata is applied once the extraction
+// is complete, as extracting their children would change their times.
+func (x *extraction) preserve(m entryMetadata, deferred bool) error {
+	if x.opts.Preserve == 0 {
+		return nil
+	}
+	if deferred {
+		x.deferred = append(x.deferred, m)
+		return nil
+	}
+	return x.applyMetadata(m)
+}
+
+// finishMetadata applies the deferred metadata, children before their parents.
+func (x *extraction) finishMetadata() error {
+	for i := len(x.deferred) - 1; i >= 0; i-- {
+		if err := x.applyMetadata(x.deferred[i]); err != nil {
+			return err
+		}
+	}
+	x.deferred = nil
+	return nil
+}
+
+func (x *extraction) applyMetadata(m entryMetadata) error {
+	logger := logging.GetLogger()
+	if x.opts.Preserve&PreserveOwner != 0 && m.owner {
+		if os.Geteuid() != 0 {
+			if !x.ownerWarned {
+				logger.Warn().Msg("Extract: not running as root, ownership is not preserved")
+				x.ownerWarned = true
+			}
+		} else {
+			if err := os.Lchown(m.target, m.uid, m.gid); err != nil {
+				return fmt.Errorf("error preserving owner of %s: %w", m.target, err)
+			}
+			// chown clears the setuid and setgid bits
+			if !m.link && m.mode&(os.ModeSetuid|os.ModeSetgid|os.ModeSticky) != 0 {
+				if err := os.Chmod(m.target, m.mode&(os.ModePerm|os.ModeSetuid|os.ModeSetgid|os.ModeSticky)); err != nil {
+					return fmt.Errorf("error preserving mode of %s: %w", m.target, err)
+				}
+			}
+		}
+	}
+	if x.opts.Preserve&PreserveXattrs != 0 {
+		for name, value := range m.xattrs {
+			if err := setXattr(m.target, name, []byte(value)); err != nil {
+				return fmt.Errorf("error preserving extended attribute %s of %s: %w", name, m.target, err)
+			}
+		}
+	}
+	if x.opts.Preserve&PreserveTimes != 0 && !m.link && !m.modTime.IsZero() {
+		accessTime := m.accessTime
+		if accessTime.IsZero() {
+			accessTime = m.modTime
+		}
+		if err := os.Chtimes(m.target, accessTime, m.modTime); err != nil {
+			return fmt.Errorf("error preserving times of %s: %w", m.target, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,83 @@
+package extract
+
+import (
+	"io"
+	"sync/atomic"
+)
+
+// Progress counts the entries and bytes written by an extraction. It may be read while the extraction runs, and
+// its methods are safe to call on a nil Progress.
+type Progress struct {
+	entries      atomic.Int64
+	bytes        atomic.Int64
+	decompressed atomic.Int64
+}
+
+// Entries returns the number of archive entries extracted so far.
+func (p *Progress) Entries() int64 {
+	if p == nil {
+		return 0
+	}
+	return p.entries.Load()
+}
+
+// Bytes returns the number of bytes written to extracted files so far.
+func (p *Progress) Bytes() int64 {
+	if p == nil {
+		return 0
+	}
+	return p.bytes.Load()
+}
+
+// Decompressed returns the number of bytes decompressed so far, 0 if the payload isn't compressed. Unlike Bytes,
+// it includes the archive headers and padding.
+func (p *Progress) Decompressed() int64 {
+	if p == nil {
+		return 0
+	}
+	return p.decompressed.Load()
+}
+
+func (p *Progress) addEntry() {
+	if p != nil {
+		p.entries.Add(1)
+	}
+}
+
+// writer returns w, counting the bytes written to it.
+func (p *Progress) writer(w io.Writer) io.Writer {
+	if p == nil {
+		return w
+	}
+	return &progressWriter{w: w, p: p}
+}
+
+type progressWriter struct {
+	w io.Writer
+	p *Progress
+}
+
+func (w *progressWriter) Write(b []byte) (int, error) {
+	n, err := w.w.Write(b)
+	w.p.bytes.Add(int64(n))
+	return n, err
+}
+
+// decompressedReader returns r, counting the bytes read from it as decompressed.
+func (p *Progress) decompressedReader(r io.Reader) io.Reader {
+	if p == nil {
+		return r
+	}
+	return &progressReader{r: r, n: &p.decompressed}
+}
+
+type progressReader struct {
+	r io.Reader
+	n *atomic.Int64
+}
+
+func (r *progressReader) Read(b []byte) (int, error) {
+	n, err := r.r.Read(b)
+	r.n.Add(int64(n))
+	return n, err
+}
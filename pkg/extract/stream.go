@@ -0,0 +1,43 @@
+package extract
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// TarStream writes the tar archive read from r to w instead of extracting it, decompressing it with compression,
+// or with the format detected from its first bytes if compression is unset. The (decompressed) stream must be a
+// tar archive, otherwise ErrUnknownFormat is returned before anything is written.
+func TarStream(r *bufio.Reader, w io.Writer, compression Compression) error {
+	var reader io.Reader = r
+	d := compression.decompressor()
+	if d == nil && !isTar(r) {
+		peekData, err := r.Peek(detectionPeekSize())
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("error reading peek data: %w", err)
+		}
+		if d = detectFormat(peekData); d == nil {
+			return ErrUnknownFormat
+		}
+	}
+	if d != nil {
+		stream, err := d.decompress(r)
+		if err != nil {
+			return fmt.Errorf("error creating decompressed stream: %w", err)
+		}
+		if closer, ok := stream.(io.Closer); ok {
+			defer closer.Close()
+		}
+		decompressed := bufio.NewReaderSize(stream, 2*tarBlockSize)
+		if !isTar(decompressed) {
+			return ErrUnknownFormat
+		}
+		reader = decompressed
+	}
+	if _, err := io.Copy(w, reader); err != nil {
+		return fmt.Errorf("error writing tar stream: %w", err)
+	}
+	return nil
+}
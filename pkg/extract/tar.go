@@ -3,6 +3,7 @@ package extract
 import (
 	"archive/tar"
 	"bufio"
+	"context"
 	"errors"
 	"fmt"
 	"io"
@@ -23,33 +24,88 @@ type link struct {
 	newName  string
 }
 
-func TarFile(r *bufio.Reader, destDir string, overwrite bool) error {
-	var links []*link
-	var reader io.Reader = r
-
+// Tar extracts the tar archive read from r into the directory dest, applying opts. The archive is decompressed
+// with opts.Compression, or with the format detected from its first bytes if unset; a payload which is neither a
+// tar archive nor a compressed one is rejected with ErrUnknownFormat. The extraction stops with the error of ctx
+// once it is done.
+func Tar(ctx context.Context, r io.Reader, dest string, opts Options) error {
 	log := logging.GetLogger()
 
 	startTime := time.Now()
-	peekData, err := r.Peek(peekSize)
-	if err != nil {
-		return fmt.Errorf("error reading peek data: %w", err)
+	br := bufio.NewReader(contextReader{ctx: ctx, r: r})
+	d := opts.Compression.decompressor()
+	if d == nil && !isTar(br) {
+		peekData, err := br.Peek(detectionPeekSize())
+		if err != nil && !errors.Is(err, io.EOF) {
+			return fmt.Errorf("error reading peek data: %w", err)
+		}
+		if d = detectFormat(peekData); d == nil {
+			return ErrUnknownFormat
+		}
 	}
-	if decompressor := detectFormat(peekData); decompressor != nil {
-		reader, err = decompressor.decompress(reader)
+	var reader io.Reader = br
+	if d != nil {
+		stream, err := d.decompress(br)
 		if err != nil {
 			return fmt.Errorf("error creating decompressed stream: %w", err)
 		}
+		if closer, ok := stream.(io.Closer); ok {
+			defer closer.Close()
+		}
 		log.Info().
-			Str("decompressor", fmt.Sprintf("%T", decompressor)).
+			Str("decompressor", fmt.Sprintf("%T", d)).
 			Msg("Tar Compression Detected: Compression can significantly slowdown rpget (e.g. for model weights)")
+		reader = opts.Progress.decompressedReader(stream)
+	}
+	if err := newExtraction(dest, opts).untar(reader); err != nil {
+		return err
+	}
+
+	elapsed := time.Since(startTime).Seconds()
+	log.Debug().
+		Str("extractor", "tar").
+		Float64("elapsed_time", elapsed).
+		Str("status", "complete").
+		Msg("Extract")
+	return nil
+}
+
+// TarFile extracts the tar archive read from r, optionally compressed, into destDir.
+//
+// Deprecated: use Tar, which takes Options.
+func TarFile(r *bufio.Reader, destDir string, overwrite bool) error {
+	return Tar(context.Background(), r, destDir, Options{Overwrite: overwrite})
+}
+
+// contextReader fails reads with the error of ctx once it is done.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
 	}
-	tarReader := tar.NewReader(reader)
+	return c.r.Read(p)
+}
+
+// untar extracts the uncompressed tar stream read from r into the destination directory, then consumes the rest
+// of r.
+func (x *extraction) untar(r io.Reader) error {
+	destDir := x.destDir
+	tarReader := tar.NewReader(r)
 	logger := logging.GetLogger()
+	defer x.tree.Close()
 
 	logger.Debug().
 		Str("extractor", "tar").
 		Str("status", "starting").
 		Msg("Extract")
+	if err := x.startJournal(); err != nil {
+		return err
+	}
+	defer x.closeJournal()
 	for {
 		header, err := tarReader.Next()
 		if err == io.EOF {
@@ -59,14 +115,35 @@ func TarFile(r *bufio.Reader, destDir string, overwrite bool) error {
 			return err
 		}
 
+		if header.Name == "" {
+			return ErrEmptyHeaderName
+		}
+		name, ok := x.mapName(header.Name)
+		if !ok || !x.included(header.Name) {
+			logger.Debug().
+				Str("name", header.Name).
+				Msg("Tar: Skip")
+			continue
+		}
+		header.Name = name
+		if err := guardAgainstZipSlip(header, destDir); err != nil {
+			return err
+		}
+
 		target := filepath.Join(destDir, header.Name)
 		targetDir := filepath.Dir(target)
-		if err := os.MkdirAll(targetDir, 0755); err != nil {
+		if err := x.tree.MkdirAll(targetDir, 0755); err != nil {
 			return err
 		}
 
-		if err := guardAgainstZipSlip(header, destDir); err != nil {
-			return err
+		if kind, ok := tarEntryKind(header.Typeflag); ok {
+			claimed, err := x.claim(target, kind)
+			if err != nil {
+				return err
+			}
+			if !claimed {
+				continue
+			}
 		}
 
 		switch header.Typeflag {
@@ -80,28 +157,35 @@ func TarFile(r *bufio.Reader, destDir string, overwrite bool) error {
 				Str("target", target).
 				Str("perms", fmt.Sprintf("%o", header.Mode)).
 				Msg("Tar: Directory")
-			if err := os.MkdirAll(target, cleanFileMode(os.FileMode(header.Mode))); err != nil {
+			if err := x.tree.MkdirAll(target, cleanFileMode(os.FileMode(header.Mode))); err != nil {
+				return err
+			}
+			if err := x.preserve(tarMetadata(header, target), true); err != nil {
 				return err
 			}
 		case tar.TypeReg:
-			openFlags := os.O_CREATE | os.O_WRONLY
-			if overwrite {
-				openFlags |= os.O_TRUNC
+			resumed, err := x.resume(target, header.Size)
+			if err != nil {
+				return err
+			}
+			if resumed {
+				logger.Debug().
+					Str("target", target).
+					Msg("Tar: Skip (already extracted)")
+				break
 			}
 			logger.Debug().
 				Str("target", target).
 				Str("perms", fmt.Sprintf("%o", header.Mode)).
 				Msg("Tar: File")
-			targetFile, err := os.OpenFile(target, openFlags, cleanFileMode(os.FileMode(header.Mode)))
-			if err != nil {
+			if err := x.writeFile(tarReader, target, cleanFileMode(os.FileMode(header.Mode))); err != nil {
 				return err
 			}
-			if _, err := io.Copy(targetFile, tarReader); err != nil {
-				targetFile.Close()
+			if err := x.preserve(tarMetadata(header, target), false); err != nil {
 				return err
 			}
-			if err := targetFile.Close(); err != nil {
-				return fmt.Errorf("error closing file %s: %w", target, err)
+			if err := x.journalFile(target); err != nil {
+				return err
 			}
 		case tar.TypeSymlink, tar.TypeLink:
 			// Defer creation of
@@ -109,18 +193,45 @@ func TarFile(r *bufio.Reader, destDir string, overwrite bool) error {
 				Str("old_name", header.Linkname).
 				Str("new_name", target).
 				Msg("Tar: (Defer) Link")
-			links = append(links, &link{linkType: header.Typeflag, oldName: header.Linkname, newName: target})
+			linkName := header.Linkname
+			if header.Typeflag == tar.TypeLink {
+				if !x.included(linkName) {
+					logger.Warn().
+						Str("name", header.Name).
+						Str("link_name", linkName).
+						Msg("Tar: Skip hard link to filtered out entry")
+					continue
+				}
+				// hard links name another archive entry, which was renamed the same way
+				if linkName, ok = x.mapName(linkName); !ok {
+					return fmt.Errorf("hard link %s targets %s, which is not extracted", header.Name, header.Linkname)
+				}
+			}
+			x.links = append(x.links, &link{linkType: header.Typeflag, oldName: linkName, newName: target})
+			// hard links share the metadata of their target
+			if header.Typeflag == tar.TypeSymlink {
+				if err := x.preserve(tarMetadata(header, target), true); err != nil {
+					return err
+				}
+			}
 		default:
 			return fmt.Errorf("unsupported file type for %s, typeflag %s", header.Name, string(header.Typeflag))
 		}
+		if err := x.addEntry(); err != nil {
+			return err
+		}
 	}
 
-	if err := createLinks(links, destDir, overwrite); err != nil {
+	if err := createLinks(x.links, destDir, x.opts.Overwrite); err != nil {
 		return fmt.Errorf("error creating links: %w", err)
 	}
+	if err := x.finishMetadata(); err != nil {
+		return err
+	}
 
 	// Read the rest of the bytes from the archive and verify they are all null bytes
-	// This is for validation that the byte count is correct
+	// This is for validation that the byte count is correct, and for compressed archives it drains the
+	// decompressor so that its trailer is verified
 	padding, err := io.ReadAll(r)
 	if err != nil {
 		return fmt.Errorf("error reading padding bytes: %w", err)
@@ -130,14 +241,21 @@ func TarFile(r *bufio.Reader, destDir string, overwrite bool) error {
 			return fmt.Errorf("unexpected non-null byte in padding: %x", b)
 		}
 	}
+	return x.finish()
+}
 
-	elapsed := time.Since(startTime).Seconds()
-	logger.Debug().
-		Str("extractor", "tar").
-		Float64("elapsed_time", elapsed).
-		Str("status", "complete").
-		Msg("Extract")
-	return nil
+// tarEntryKind returns the kind of path created by a tar entry of type typeflag, or false if it creates none.
+func tarEntryKind(typeflag byte) (entryKind, bool) {
+	switch typeflag {
+	case tar.TypeReg:
+		return kindFile, true
+	case tar.TypeDir:
+		return kindDir, true
+	case tar.TypeSymlink, tar.TypeLink:
+		return kindLink, true
+	default:
+		return 0, false
+	}
 }
 
 func createLinks(links []*link, destDir string, overwrite bool) error {
@@ -196,9 +314,14 @@ func guardAgainstZipSlip(header *tar.Header, destDir string) error {
 	if header.Name == "" {
 		return ErrEmptyHeaderName
 	}
-	target, err := filepath.Abs(filepath.Join(destDir, header.Name))
+	return guardPath(header.Name, destDir)
+}
+
+// guardPath returns ErrZipSlip if the archive entry name resolves to a path outside of destDir.
+func guardPath(name, destDir string) error {
+	target, err := filepath.Abs(filepath.Join(destDir, name))
 	if err != nil {
-		return fmt.Errorf("error getting absolute path of destDir %s: %w", header.Name, err)
+		return fmt.Errorf("error getting absolute path of destDir %s: %w", name, err)
 	}
 	destAbs, err := filepath.Abs(destDir)
 	if err != nil {
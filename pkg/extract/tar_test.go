@@ -2,12 +2,15 @@ package extract
 
 import (
 	"archive/tar"
+	"bytes"
+	"context"
 	"os"
 	"path/filepath"
 	"syscall"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestCreateLinks(t *testing.T) {
@@ -280,3 +283,32 @@ func TestCleanFileMode(t *testing.T) {
 		})
 	}
 }
+
+func TestTar(t *testing.T) {
+	files := map[string]string{"a.txt": "a", "sub/b.txt": "bb", "sub/c.bin": "ccc"}
+	payload := gzipBytes(t, tarBytes(t, files))
+
+	dest := t.TempDir()
+	progress := new(Progress)
+	opts := Options{Exclude: []string{"*.bin"}, Progress: progress}
+	require.NoError(t, Tar(context.Background(), bytes.NewReader(payload), dest, opts))
+	assertContent(t, "a", filepath.Join(dest, "a.txt"))
+	assertContent(t, "bb", filepath.Join(dest, "sub/b.txt"))
+	assert.NoFileExists(t, filepath.Join(dest, "sub/c.bin"))
+	assert.Equal(t, int64(2), progress.Entries())
+	assert.Greater(t, progress.Decompressed(), int64(0))
+
+	err := Tar(context.Background(), bytes.NewReader(payload), t.TempDir(), Options{MaxEntries: 2})
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	err = Tar(context.Background(), bytes.NewReader(payload), t.TempDir(), Options{MaxBytes: 5})
+	assert.ErrorIs(t, err, ErrLimitExceeded)
+	assert.NoError(t, Tar(context.Background(), bytes.NewReader(payload), t.TempDir(), Options{MaxEntries: 3, MaxBytes: 6}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err = Tar(ctx, bytes.NewReader(payload), t.TempDir(), Options{})
+	assert.ErrorIs(t, err, context.Canceled)
+
+	err = Tar(context.Background(), bytes.NewReader([]byte("not an archive")), t.TempDir(), Options{})
+	assert.ErrorIs(t, err, ErrUnknownFormat)
+}
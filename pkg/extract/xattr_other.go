@@ -0,0 +1,9 @@
+//go:build !linux && !darwin
+
+package extract
+
+import "errors"
+
+func setXattr(path, name string, value []byte) error {
+	return errors.ErrUnsupported
+}
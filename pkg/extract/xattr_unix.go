@@ -0,0 +1,9 @@
+//go:build linux || darwin
+
+package extract
+
+import "golang.org/x/sys/unix"
+
+func setXattr(path, name string, value []byte) error {
+	return unix.Lsetxattr(path, name, value, 0)
+}
@@ -0,0 +1,47 @@
+package rpget
+
+import (
+	"context"
+	"runtime"
+
+	"github.com/emaballarin/rpget/pkg/consumer"
+)
+
+// extractWorkers bounds the number of extractions running at once across the entries of a DownloadFiles call, so
+// that CPU-bound decompression is shared between archives instead of oversubscribing the CPUs.
+type extractWorkers chan struct{}
+
+type extractWorkersKey struct{}
+
+func newExtractWorkers(n int) extractWorkers {
+	if n <= 0 {
+		n = runtime.NumCPU()
+	}
+	return make(extractWorkers, n)
+}
+
+func withExtractWorkers(ctx context.Context, workers extractWorkers) context.Context {
+	return context.WithValue(ctx, extractWorkersKey{}, workers)
+}
+
+// acquireExtractWorker waits for an extraction worker of the DownloadFiles call ctx belongs to, returning a func
+// releasing it. Outside of DownloadFiles, or once the entry holds a worker, extractions are not bounded.
+func acquireExtractWorker(ctx context.Context) (func(), error) {
+	workers, _ := ctx.Value(extractWorkersKey{}).(extractWorkers)
+	if workers == nil {
+		return func() {}, nil
+	}
+	select {
+	case workers <- struct{}{}:
+		return func() { <-workers }, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// extractsWhileDownloading reports whether entry is extracted as it is downloaded, which takes an extraction
+// worker for the whole download.
+func (g *Getter) extractsWhileDownloading(entry ManifestEntry) bool {
+	_, ok := g.consumerFor(entry).(*consumer.TarExtractor)
+	return ok
+}
@@ -0,0 +1,25 @@
+// Package fsutil has the filesystem helpers shared by the packages which write files and those which store them.
+package fsutil
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+)
+
+// BreakHardlink removes the file at path if other hardlinks to it exist, so that writing path in place doesn't
+// write the files it is linked to, e.g. the objects of a content cache (see pkg/cas). The file is then created
+// again. A missing file is left as is.
+func BreakHardlink(path string) error {
+	info, err := os.Lstat(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() || LinkCount(info) < 2 {
+		return nil
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,16 @@
+//go:build !windows
+
+package fsutil
+
+import (
+	"io/fs"
+	"syscall"
+)
+
+// LinkCount returns the number of hardlinks to the file of info, as returned by os.Stat or os.Lstat.
+func LinkCount(info fs.FileInfo) uint64 {
+	if st, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(st.Nlink)
+	}
+	return 1
+}
@@ -0,0 +1,11 @@
+//go:build windows
+
+package fsutil
+
+import "io/fs"
+
+// LinkCount returns the number of hardlinks to the file of info. os.Stat doesn't report it on Windows, so every
+// file is taken to have one.
+func LinkCount(info fs.FileInfo) uint64 {
+	return 1
+}
@@ -0,0 +1,75 @@
+package fsutil
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// Confine returns dest, a destination relative to root, joined to root, or an error if it escapes it (see
+// InsideRoot).
+func Confine(root, dest string) (string, error) {
+	resolvedRoot, err := ResolveExisting(root)
+	if err != nil {
+		return "", fmt.Errorf("error resolving output root %s: %w", root, err)
+	}
+	return InsideRoot(root, resolvedRoot, dest)
+}
+
+// InsideRoot returns dest, a destination relative to root, joined to root. Absolute destinations, and those escaping
+// root with `..` or through a symlink, are an error. resolvedRoot is root as returned by ResolveExisting.
+func InsideRoot(root, resolvedRoot, dest string) (string, error) {
+	if filepath.IsAbs(dest) {
+		return "", fmt.Errorf("absolute destination %s not allowed with an output root", dest)
+	}
+	if !filepath.IsLocal(dest) {
+		return "", fmt.Errorf("destination %s escapes the output root", dest)
+	}
+	path := filepath.Join(root, dest)
+	if err := CheckInside(path, resolvedRoot); err != nil {
+		return "", fmt.Errorf("destination %s: %w", dest, err)
+	}
+	return path, nil
+}
+
+// CheckInside returns an error unless path, once its existing symlinks are resolved, is inside resolvedRoot.
+func CheckInside(path, resolvedRoot string) error {
+	resolved, err := ResolveExisting(path)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(resolvedRoot, resolved); err != nil || !filepath.IsLocal(rel) {
+		return fmt.Errorf("resolves to %s, outside the output root", resolved)
+	}
+	return nil
+}
+
+// ResolveExisting returns the absolute path of path, with the symlinks of the part of it which exists resolved.
+// A dangling symlink is an error, as writing through it would create its target wherever it points.
+func ResolveExisting(path string) (string, error) {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return "", err
+	}
+	rest := ""
+	for {
+		resolved, err := filepath.EvalSymlinks(path)
+		if err == nil {
+			return filepath.Join(resolved, rest), nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return "", err
+		}
+		if info, err := os.Lstat(path); err == nil && info.Mode()&fs.ModeSymlink != 0 {
+			return "", fmt.Errorf("%s is a dangling symlink", path)
+		}
+		parent := filepath.Dir(path)
+		if parent == path {
+			return filepath.Join(path, rest), nil
+		}
+		rest = filepath.Join(filepath.Base(path), rest)
+		path = parent
+	}
+}
@@ -0,0 +1,90 @@
+package rpget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+)
+
+// ErrorPolicy controls how a DownloadGroup handles failed downloads.
+type ErrorPolicy int
+
+const (
+	// FailFast cancels the remaining downloads of the group on the first failure, and Wait returns that error.
+	FailFast ErrorPolicy = iota
+	// CollectErrors lets every download of the group run to completion, and Wait returns all failures joined.
+	CollectErrors
+)
+
+// DownloadGroup is a set of downloads sharing a context, an error policy and a completion barrier. Downloads
+// run concurrently, at most Options.MaxConcurrentFiles at a time if set.
+type DownloadGroup struct {
+	getter    *Getter
+	policy    ErrorPolicy
+	ctx       context.Context
+	group     *errgroup.Group
+	start     time.Time
+	totalSize atomic.Int64
+
+	mu   sync.Mutex
+	errs []error
+}
+
+// DownloadGroup returns an empty DownloadGroup whose downloads are bound to ctx.
+func (g *Getter) DownloadGroup(ctx context.Context, policy ErrorPolicy) *DownloadGroup {
+	if g.Consumer == nil {
+		g.Consumer = defaultConsumer(g.Options)
+	}
+	dg := &DownloadGroup{getter: g, policy: policy, ctx: ctx, group: new(errgroup.Group), start: time.Now()}
+	if policy == FailFast {
+		dg.group, dg.ctx = errgroup.WithContext(ctx)
+	}
+	if g.Options.MaxConcurrentFiles != 0 {
+		dg.group.SetLimit(g.Options.MaxConcurrentFiles)
+	}
+	return dg
+}
+
+// Go starts downloading url to dest. It blocks while the group is at its concurrency limit.
+func (dg *DownloadGroup) Go(url, dest string) {
+	dg.GoEntry(ManifestEntry{URL: url, Dest: dest})
+}
+
+// GoEntry starts downloading entry, verifying its checksum if set. It blocks while the group is at its
+// concurrency limit.
+func (dg *DownloadGroup) GoEntry(entry ManifestEntry) {
+	dg.group.Go(func() error {
+		size, _, err := dg.getter.DownloadEntry(dg.ctx, entry)
+		if err != nil {
+			err = fmt.Errorf("error downloading %s: %w", entry.URL, err)
+			if dg.policy == FailFast {
+				return err
+			}
+			dg.mu.Lock()
+			dg.errs = append(dg.errs, err)
+			dg.mu.Unlock()
+			return nil
+		}
+		dg.totalSize.Add(size)
+		return nil
+	})
+}
+
+// Wait blocks until every download started on the group has finished. It returns the number of bytes
+// downloaded successfully, the time since the group was created, and the group's error according to its policy.
+// No downloads may be started once Wait has been called.
+func (dg *DownloadGroup) Wait() (int64, time.Duration, error) {
+	err := dg.group.Wait()
+	elapsed := time.Since(dg.start)
+	if dg.policy == CollectErrors {
+		dg.mu.Lock()
+		err = errors.Join(dg.errs...)
+		dg.mu.Unlock()
+	}
+	return dg.totalSize.Load(), elapsed, err
+}
@@ -0,0 +1,31 @@
+package rpget
+
+import (
+	"context"
+)
+
+// Hooks are called as the files downloaded by a Getter complete or fail, e.g. to send notifications or signal
+// caches. They are called from the goroutine downloading the file, which they hold up until they return.
+type Hooks struct {
+	// OnComplete is called once a file has been downloaded, verified and post-processed, or skipped because its
+	// destination is up to date (see Options.Idempotent, Options.SkipExisting and ManifestEntry.VersionMarker).
+	OnComplete func(ctx context.Context, entry ManifestEntry)
+	// OnError is called when a file fails for good: in DownloadFiles, once no further pass retries it (see
+	// Options.ManifestRetries). It isn't called for the files cancelled because another one failed, or with ctx.
+	OnError func(ctx context.Context, entry ManifestEntry, err error)
+}
+
+// fileDone calls the hook of Options.Hooks for entry, which completed or failed with err.
+func (g *Getter) fileDone(ctx context.Context, entry ManifestEntry, err error) {
+	hooks := g.Options.Hooks
+	switch {
+	case err == nil:
+		if hooks.OnComplete != nil {
+			hooks.OnComplete(ctx, entry)
+		}
+	case ctx.Err() != nil:
+		// the file was cancelled
+	case hooks.OnError != nil:
+		hooks.OnError(ctx, entry, err)
+	}
+}
@@ -0,0 +1,94 @@
+package rpget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// maxVersionMarkerSize is the size of the largest version marker read: markers are meant to hold a version, a
+// digest or a timestamp.
+const maxVersionMarkerSize = 64 * 1024
+
+// VersionMarkerFile returns the path the version marker of entry is stored at locally, see
+// ManifestEntry.VersionMarkerFile.
+func VersionMarkerFile(entry ManifestEntry) string {
+	if entry.VersionMarkerFile != "" {
+		return entry.VersionMarkerFile
+	}
+	return entry.Dest + ".marker"
+}
+
+// checkVersionMarker fetches the version marker of entry, and reports whether it is unchanged: whether it matches
+// the value stored when the entry was last downloaded and the destination still exists. It returns the remote
+// value, to be stored once the entry has been downloaded.
+func (g *Getter) checkVersionMarker(ctx context.Context, entry ManifestEntry) (string, bool, error) {
+	logger := logging.GetLogger()
+	remote, err := g.fetchVersionMarker(ctx, entry.VersionMarker)
+	if err != nil {
+		return "", false, fmt.Errorf("error fetching version marker %s: %w", entry.VersionMarker, err)
+	}
+	stored, err := os.ReadFile(VersionMarkerFile(entry))
+	if errors.Is(err, fs.ErrNotExist) {
+		return remote, false, nil
+	}
+	if err != nil {
+		return "", false, fmt.Errorf("error reading version marker: %w", err)
+	}
+	if strings.TrimSpace(string(stored)) != remote {
+		logger.Info().Str("url", entry.URL).Str("marker", entry.VersionMarker).Msg("Version marker changed")
+		return remote, false, nil
+	}
+	if _, err := os.Stat(entry.Dest); err != nil {
+		// the destination was removed since
+		return remote, false, nil
+	}
+	logger.Info().Str("url", entry.URL).Str("dest", entry.Dest).Msg("Version marker unchanged, skipping")
+	return remote, true, nil
+}
+
+// fetchVersionMarker returns the content of the marker at url, without leading and trailing white space.
+func (g *Getter) fetchVersionMarker(ctx context.Context, url string) (string, error) {
+	resp, err := g.Downloader.DoRequest(ctx, 0, maxVersionMarkerSize-1, url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	// a server ignoring the range sends the whole marker
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxVersionMarkerSize+1))
+	if err != nil {
+		return "", err
+	}
+	if len(data) > maxVersionMarkerSize {
+		return "", fmt.Errorf("version marker is larger than %d bytes", maxVersionMarkerSize)
+	}
+	return strings.TrimSpace(string(data)), nil
+}
+
+// storeVersionMarker records value as the version marker of entry, replacing the previous one atomically.
+func storeVersionMarker(entry ManifestEntry, value string) error {
+	path := VersionMarkerFile(entry)
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("error storing version marker: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(value + "\n"); err != nil {
+		tmp.Close()
+		return fmt.Errorf("error storing version marker: %w", err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("error storing version marker: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("error storing version marker: %w", err)
+	}
+	return nil
+}
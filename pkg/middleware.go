@@ -0,0 +1,41 @@
+package rpget
+
+import (
+	"context"
+	"fmt"
+	"io"
+)
+
+// ResponseBody is the body of a file downloaded by a Getter, as passed through its ResponseMiddleware.
+type ResponseBody struct {
+	URL  string
+	Dest string
+	// Size is the number of bytes Reader yields, which the consumer expects. A middleware changing the length of
+	// the body must update it.
+	Size   int64
+	Reader io.Reader
+}
+
+// A ResponseMiddleware transforms the body of a downloaded file before it is verified and consumed, e.g. to
+// de-obfuscate it, or wraps it to observe it, e.g. to audit the bytes received. It is called once per file, before
+// the body is read, whatever strategy the file is downloaded with, including batch requests. Files are downloaded
+// concurrently, so a middleware must be safe for concurrent use.
+type ResponseMiddleware func(ctx context.Context, body ResponseBody) (ResponseBody, error)
+
+// Use appends mw to the middleware the bodies of the files downloaded by g are passed through, in order: the first
+// middleware is given the body as received, and each following one the body returned by the previous one.
+// Checksums are verified against the body returned by the last one.
+func (g *Getter) Use(mw ...ResponseMiddleware) {
+	g.middleware = append(g.middleware, mw...)
+}
+
+// transformBody passes body through the middleware of g.
+func (g *Getter) transformBody(ctx context.Context, body ResponseBody) (ResponseBody, error) {
+	for _, mw := range g.middleware {
+		var err error
+		if body, err = mw(ctx, body); err != nil {
+			return body, fmt.Errorf("response middleware: %w", err)
+		}
+	}
+	return body, nil
+}
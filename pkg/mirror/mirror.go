@@ -0,0 +1,337 @@
+// Package mirror lists the files under a remote directory, so that the whole directory can be downloaded while
+// preserving relative paths. Supported listings are HTML directory indexes, S3 buckets (ListObjectsV2) and GCS
+// buckets (JSON API).
+package mirror
+
+import (
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+
+	"golang.org/x/net/html"
+
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/download"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+const (
+	defaultGCSEndpoint = "https://storage.googleapis.com"
+	// maxListingBytes bounds the size of a single listing page or HTML index
+	maxListingBytes = 64 << 20
+)
+
+// Object is a file found in a listing.
+type Object struct {
+	// URL the file can be downloaded from
+	URL string
+	// Path of the file relative to the listed directory, using forward slashes
+	Path string
+}
+
+// Lister lists remote directories.
+type Lister struct {
+	Client client.HTTPClient
+	// S3Endpoint, if set, is used with path-style addressing instead of https://<bucket>.s3.amazonaws.com
+	S3Endpoint string
+	// GCSEndpoint, if set, replaces https://storage.googleapis.com
+	GCSEndpoint string
+}
+
+func NewLister(opts client.Options) *Lister {
+	return &Lister{Client: client.NewHTTPClient(opts)}
+}
+
+// List returns every file under rawURL, which is either s3://bucket/prefix, gs://bucket/prefix or the http(s) URL
+// of an HTML directory index. Subdirectories of an HTML index are listed recursively.
+func (l *Lister) List(ctx context.Context, rawURL string) ([]Object, error) {
+	parsed, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	var objects []Object
+	switch parsed.Scheme {
+	case "s3":
+		objects, err = l.listS3(ctx, parsed.Host, prefix(parsed.Path))
+	case "gs":
+		objects, err = l.listGCS(ctx, parsed.Host, prefix(parsed.Path))
+	case "http", "https":
+		objects, err = l.listHTML(ctx, parsed)
+	default:
+		return nil, fmt.Errorf("unsupported listing URL scheme %s", parsed.Scheme)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, object := range objects {
+		if err := checkRelativePath(object.Path); err != nil {
+			return nil, err
+		}
+	}
+	return objects, nil
+}
+
+// prefix turns a URL path into a bucket listing prefix: no leading slash and, unless empty, a trailing slash so
+// that only the contents of that directory are listed.
+func prefix(urlPath string) string {
+	p := strings.TrimPrefix(urlPath, "/")
+	if p != "" && !strings.HasSuffix(p, "/") {
+		p += "/"
+	}
+	return p
+}
+
+// checkRelativePath rejects listing entries which would escape the destination directory.
+func checkRelativePath(p string) error {
+	if p == "" || path.IsAbs(p) || strings.Contains(p, "\\") {
+		return fmt.Errorf("invalid path %q in listing", p)
+	}
+	for _, segment := range strings.Split(p, "/") {
+		if segment == ".." || segment == "." || segment == "" {
+			return fmt.Errorf("invalid path %q in listing", p)
+		}
+	}
+	return nil
+}
+
+func (l *Lister) get(ctx context.Context, rawURL string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := l.Client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("error listing %s: %w", rawURL, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%w %s: %s", download.ErrUnexpectedHTTPStatus, rawURL, resp.Status)
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxListingBytes+1))
+	if err != nil {
+		return nil, fmt.Errorf("error reading listing %s: %w", rawURL, err)
+	}
+	if len(body) > maxListingBytes {
+		return nil, fmt.Errorf("listing %s is larger than %d bytes", rawURL, maxListingBytes)
+	}
+	return body, nil
+}
+
+// s3ListBucketResult is the subset of an S3 ListObjectsV2 response used here.
+type s3ListBucketResult struct {
+	Contents []struct {
+		Key string `xml:"Key"`
+	} `xml:"Contents"`
+	IsTruncated           bool   `xml:"IsTruncated"`
+	NextContinuationToken string `xml:"NextContinuationToken"`
+}
+
+func (l *Lister) listS3(ctx context.Context, bucket, keyPrefix string) ([]Object, error) {
+	base := "https://" + bucket + ".s3.amazonaws.com"
+	if l.S3Endpoint != "" {
+		base = strings.TrimSuffix(l.S3Endpoint, "/") + "/" + bucket
+	}
+	var objects []Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {keyPrefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		body, err := l.get(ctx, base+"/?"+query.Encode())
+		if err != nil {
+			return nil, err
+		}
+		var result s3ListBucketResult
+		if err := xml.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("error parsing S3 listing: %w", err)
+		}
+		for _, content := range result.Contents {
+			// zero-byte "directory" markers
+			if strings.HasSuffix(content.Key, "/") {
+				continue
+			}
+			objects = append(objects, Object{
+				URL:  base + "/" + escapeKey(content.Key),
+				Path: strings.TrimPrefix(content.Key, keyPrefix),
+			})
+		}
+		if !result.IsTruncated || result.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = result.NextContinuationToken
+	}
+}
+
+// gcsObjectList is the subset of a GCS objects.list response used here.
+type gcsObjectList struct {
+	Items []struct {
+		Name string `json:"name"`
+	} `json:"items"`
+	NextPageToken string `json:"nextPageToken"`
+}
+
+func (l *Lister) listGCS(ctx context.Context, bucket, objectPrefix string) ([]Object, error) {
+	endpoint := defaultGCSEndpoint
+	if l.GCSEndpoint != "" {
+		endpoint = strings.TrimSuffix(l.GCSEndpoint, "/")
+	}
+	var objects []Object
+	token := ""
+	for {
+		query := url.Values{"prefix": {objectPrefix}, "fields": {"items(name),nextPageToken"}}
+		if token != "" {
+			query.Set("pageToken", token)
+		}
+		body, err := l.get(ctx, endpoint+"/storage/v1/b/"+url.PathEscape(bucket)+"/o?"+query.Encode())
+		if err != nil {
+			return nil, err
+		}
+		var result gcsObjectList
+		if err := json.Unmarshal(body, &result); err != nil {
+			return nil, fmt.Errorf("error parsing GCS listing: %w", err)
+		}
+		for _, item := range result.Items {
+			if strings.HasSuffix(item.Name, "/") {
+				continue
+			}
+			objects = append(objects, Object{
+				URL:  endpoint + "/" + url.PathEscape(bucket) + "/" + escapeKey(item.Name),
+				Path: strings.TrimPrefix(item.Name, objectPrefix),
+			})
+		}
+		if result.NextPageToken == "" {
+			return objects, nil
+		}
+		token = result.NextPageToken
+	}
+}
+
+// escapeKey escapes every segment of an object key, keeping the slashes between them.
+func escapeKey(key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return strings.Join(segments, "/")
+}
+
+// listHTML follows the links of an HTML directory index. Links to files below the index are returned, links to
+// directories below it are followed; everything else (parent directories, sorting links, other hosts) is ignored.
+func (l *Lister) listHTML(ctx context.Context, base *url.URL) ([]Object, error) {
+	logger := logging.GetLogger()
+	root := *base
+	if !strings.HasSuffix(root.Path, "/") {
+		root.Path += "/"
+	}
+	root.RawQuery, root.Fragment, root.RawPath = "", "", ""
+
+	var objects []Object
+	seen := map[string]bool{root.String(): true}
+	queue := []*url.URL{&root}
+	for len(queue) > 0 {
+		page := queue[0]
+		queue = queue[1:]
+		body, err := l.get(ctx, page.String())
+		if err != nil {
+			return nil, err
+		}
+		links, err := parseLinks(body)
+		if err != nil {
+			return nil, fmt.Errorf("error parsing HTML index %s: %w", page, err)
+		}
+		for _, href := range links {
+			ref, err := url.Parse(href)
+			if err != nil {
+				logger.Debug().Err(err).Str("href", href).Msg("Mirror: skip invalid link")
+				continue
+			}
+			target := page.ResolveReference(ref)
+			target.Fragment = ""
+			if target.RawQuery != "" || target.Scheme != root.Scheme || target.Host != root.Host {
+				continue
+			}
+			if !strings.HasPrefix(target.Path, root.Path) || target.Path == root.Path {
+				continue
+			}
+			if seen[target.String()] {
+				continue
+			}
+			seen[target.String()] = true
+			if strings.HasSuffix(target.Path, "/") {
+				queue = append(queue, target)
+				continue
+			}
+			objects = append(objects, Object{URL: target.String(), Path: strings.TrimPrefix(target.Path, root.Path)})
+		}
+	}
+	return objects, nil
+}
+
+func parseLinks(body []byte) ([]string, error) {
+	var links []string
+	tokenizer := html.NewTokenizer(strings.NewReader(string(body)))
+	for {
+		switch tokenizer.Next() {
+		case html.ErrorToken:
+			if errors.Is(tokenizer.Err(), io.EOF) {
+				return links, nil
+			}
+			return nil, tokenizer.Err()
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := tokenizer.TagName()
+			if string(name) != "a" {
+				continue
+			}
+			for hasAttr {
+				var key, value []byte
+				key, value, hasAttr = tokenizer.TagAttr()
+				if string(key) == "href" {
+					links = append(links, string(value))
+				}
+			}
+		}
+	}
+}
+
+// Filter returns the objects matching at least one include pattern (or all objects, if there are none) and no
+// exclude pattern. Patterns use path.Match syntax; a pattern without a slash is matched against the base name,
+// any other pattern against the whole relative path.
+func Filter(objects []Object, include, exclude []string) ([]Object, error) {
+	for _, pattern := range append(append([]string{}, include...), exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("invalid pattern %q: %w", pattern, err)
+		}
+	}
+	filtered := make([]Object, 0, len(objects))
+	for _, object := range objects {
+		if len(include) > 0 && !matchAny(include, object.Path) {
+			continue
+		}
+		if matchAny(exclude, object.Path) {
+			continue
+		}
+		filtered = append(filtered, object)
+	}
+	return filtered, nil
+}
+
+func matchAny(patterns []string, p string) bool {
+	for _, pattern := range patterns {
+		target := p
+		if !strings.Contains(pattern, "/") {
+			target = path.Base(p)
+		}
+		if ok, _ := path.Match(pattern, target); ok {
+			return true
+		}
+	}
+	return false
+}
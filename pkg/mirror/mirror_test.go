@@ -0,0 +1,140 @@
+package mirror_test
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"testing"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/mirror"
+)
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+func paths(objects []mirror.Object) []string {
+	result := make([]string, 0, len(objects))
+	for _, object := range objects {
+		result = append(result, object.Path)
+	}
+	sort.Strings(result)
+	return result
+}
+
+func TestListHTML(t *testing.T) {
+	pages := map[string]string{
+		"/data/": `<html><body>
+			<a href="../">Parent Directory</a>
+			<a href="?C=N;O=D">Name</a>
+			<a href="a.txt">a.txt</a>
+			<a href="/data/sub/">sub/</a>
+			<a href="https://elsewhere.example.com/x.txt">x.txt</a>
+			<a href="/other/y.txt">y.txt</a>
+			</body></html>`,
+		"/data/sub/": `<a href="b%20c.txt">b c.txt</a><a href="../a.txt">a.txt</a>`,
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		page, ok := pages[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		fmt.Fprint(w, page)
+	}))
+	defer ts.Close()
+
+	lister := mirror.NewLister(client.Options{})
+	objects, err := lister.List(context.Background(), ts.URL+"/data")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "sub/b c.txt"}, paths(objects))
+	for _, object := range objects {
+		if object.Path == "sub/b c.txt" {
+			assert.Equal(t, ts.URL+"/data/sub/b%20c.txt", object.URL)
+		}
+	}
+}
+
+func TestListS3(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/bucket/", r.URL.Path)
+		require.Equal(t, "2", r.URL.Query().Get("list-type"))
+		require.Equal(t, "models/", r.URL.Query().Get("prefix"))
+		if r.URL.Query().Get("continuation-token") == "" {
+			fmt.Fprint(w, `<ListBucketResult><Contents><Key>models/</Key></Contents><Contents><Key>models/a.bin</Key></Contents>
+				<IsTruncated>true</IsTruncated><NextContinuationToken>next</NextContinuationToken></ListBucketResult>`)
+			return
+		}
+		fmt.Fprint(w, `<ListBucketResult><Contents><Key>models/sub/b c.bin</Key></Contents><IsTruncated>false</IsTruncated></ListBucketResult>`)
+	}))
+	defer ts.Close()
+
+	lister := mirror.NewLister(client.Options{})
+	lister.S3Endpoint = ts.URL
+	objects, err := lister.List(context.Background(), "s3://bucket/models")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.bin", "sub/b c.bin"}, paths(objects))
+	assert.Equal(t, ts.URL+"/bucket/models/sub/b%20c.bin", objects[1].URL)
+}
+
+func TestListGCS(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "/storage/v1/b/bucket/o", r.URL.Path)
+		require.Equal(t, "models/", r.URL.Query().Get("prefix"))
+		if r.URL.Query().Get("pageToken") == "" {
+			fmt.Fprint(w, `{"items": [{"name": "models/a.bin"}], "nextPageToken": "next"}`)
+			return
+		}
+		fmt.Fprint(w, `{"items": [{"name": "models/sub/"}, {"name": "models/sub/b.bin"}]}`)
+	}))
+	defer ts.Close()
+
+	lister := mirror.NewLister(client.Options{})
+	lister.GCSEndpoint = ts.URL
+	objects, err := lister.List(context.Background(), "gs://bucket/models/")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.bin", "sub/b.bin"}, paths(objects))
+	assert.Equal(t, ts.URL+"/bucket/models/a.bin", objects[0].URL)
+}
+
+func TestListRejectsEscapingPaths(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, `{"items": [{"name": "models/../../etc/passwd"}]}`)
+	}))
+	defer ts.Close()
+
+	lister := mirror.NewLister(client.Options{})
+	lister.GCSEndpoint = ts.URL
+	_, err := lister.List(context.Background(), "gs://bucket/models/")
+	assert.Error(t, err)
+
+	_, err = lister.List(context.Background(), "ftp://example.com/")
+	assert.Error(t, err)
+}
+
+func TestFilter(t *testing.T) {
+	objects := []mirror.Object{
+		{Path: "a.txt"},
+		{Path: "b.bin"},
+		{Path: "tmp/c.txt"},
+		{Path: "sub/d.txt"},
+	}
+
+	filtered, err := mirror.Filter(objects, nil, nil)
+	require.NoError(t, err)
+	assert.Len(t, filtered, 4)
+
+	filtered, err = mirror.Filter(objects, []string{"*.txt"}, []string{"tmp/*"})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "sub/d.txt"}, paths(filtered))
+
+	_, err = mirror.Filter(objects, []string{"["}, nil)
+	assert.Error(t, err)
+}
@@ -0,0 +1,431 @@
+package rpget
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/emaballarin/rpget/pkg/cas"
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/download"
+)
+
+// defaultRetries matches the default of the --retries flag.
+const defaultRetries = 5
+
+// An Option configures a Getter created by New.
+type Option func(*settings) error
+
+type settings struct {
+	download   download.Options
+	downloader download.Strategy
+	consumer   consumer.Consumer
+	options    Options
+	report     *Report
+	onProgress func(ProgressEvent)
+	middleware []ResponseMiddleware
+}
+
+// New returns a Getter configured by opts, which are applied in order. Unless an option says otherwise, files are
+// downloaded with the defaults of the rpget command: the Getter does not read the command line configuration, so
+// it can be used by programs importing rpget as a library.
+//
+//	getter, err := rpget.New(
+//		rpget.WithConcurrency(16),
+//		rpget.WithChunkSize(64*humanize.MiByte),
+//		rpget.WithHeaders(map[string]string{"Authorization": "Bearer " + token}),
+//	)
+//	if err != nil {
+//		return err
+//	}
+//	_, _, err = getter.DownloadFile(ctx, "https://example.com/model.tar", "/srv/model")
+func New(opts ...Option) (*Getter, error) {
+	var s settings
+	s.download.Client.MaxRetries = defaultRetries
+	for _, opt := range opts {
+		if err := opt(&s); err != nil {
+			return nil, err
+		}
+	}
+	if s.consumer == nil {
+		s.consumer = defaultConsumer(s.options)
+	}
+	downloader := s.downloader
+	if downloader == nil {
+		var err error
+		if downloader, err = download.NewStrategy(s.download); err != nil {
+			return nil, err
+		}
+	}
+	return &Getter{
+		Downloader: downloader,
+		Consumer:   s.consumer,
+		Options:    s.options,
+		Report:     s.report,
+		onProgress: s.onProgress,
+		middleware: s.middleware,
+	}, nil
+}
+
+// WithConcurrency sets the maximum number of chunks of a file downloaded in parallel. If n is zero, 4 chunks per
+// CPU are downloaded in parallel.
+func WithConcurrency(n int) Option {
+	return func(s *settings) error {
+		if n < 0 {
+			return fmt.Errorf("invalid concurrency %d", n)
+		}
+		s.download.MaxConcurrency = n
+		return nil
+	}
+}
+
+// WithMaxConnectionsPerHost sets the maximum number of chunks of files of the same host downloaded in parallel, so
+// that a slow host doesn't take all of the concurrency while the files of other hosts wait. If n is zero, the chunks
+// of a host are only limited by the concurrency.
+func WithMaxConnectionsPerHost(n int) Option {
+	return func(s *settings) error {
+		if n < 0 {
+			return fmt.Errorf("invalid maximum connections per host %d", n)
+		}
+		s.download.MaxConnectionsPerHost = n
+		return nil
+	}
+}
+
+// WithChunkSize sets the number of bytes per chunk. If size is zero, 125 MiB chunks are used.
+func WithChunkSize(size int64) Option {
+	return func(s *settings) error {
+		if size < 0 {
+			return fmt.Errorf("invalid chunk size %d", size)
+		}
+		s.download.ChunkSize = size
+		return nil
+	}
+}
+
+// WithHeaders sets headers sent with every request, on top of the headers of a ManifestEntry.
+func WithHeaders(headers map[string]string) Option {
+	return func(s *settings) error {
+		s.download.Client.Headers = headers
+		return nil
+	}
+}
+
+// WithRetries sets the number of times a failed request is retried. Defaults to 5.
+func WithRetries(n int) Option {
+	return func(s *settings) error {
+		if n < 0 {
+			return fmt.Errorf("invalid number of retries %d", n)
+		}
+		s.download.Client.MaxRetries = n
+		return nil
+	}
+}
+
+// WithConnectTimeout sets the timeout for establishing a connection. If d is zero, there is no timeout.
+func WithConnectTimeout(d time.Duration) Option {
+	return func(s *settings) error {
+		s.download.Client.TransportOpts.ConnectTimeout = d
+		return nil
+	}
+}
+
+// WithIPVersion restricts connections to IPv4 or IPv6, or with client.IPVersionAuto races the addresses of both
+// (Happy Eyeballs), which is the default.
+func WithIPVersion(version client.IPVersion) Option {
+	return func(s *settings) error {
+		version, err := client.ParseIPVersion(string(version))
+		if err != nil {
+			return err
+		}
+		s.download.Client.TransportOpts.IPVersion = version
+		return nil
+	}
+}
+
+// WithPreconnect establishes n connections to the host of a URL, or to each cache host, alongside the first request
+// for it, so that the chunk requests which follow don't wait for TCP and TLS handshakes (see client.RPGetHTTPClient.WarmUp).
+func WithPreconnect(n int) Option {
+	return func(s *settings) error {
+		if n < 0 {
+			return fmt.Errorf("invalid number of connections %d", n)
+		}
+		s.download.Client.TransportOpts.Preconnect = n
+		return nil
+	}
+}
+
+// WithCookieJar keeps the cookies set by responses in jar, redirects included, and sends them with the requests which
+// follow, as --cookies does. jar may be preloaded, e.g. with client.LoadCookieFile.
+func WithCookieJar(jar http.CookieJar) Option {
+	return func(s *settings) error {
+		s.download.Client.Jar = jar
+		return nil
+	}
+}
+
+// WithRequestSigner sets a signer called just before every request is sent, including chunk requests and retries.
+func WithRequestSigner(signer client.RequestSigner) Option {
+	return func(s *settings) error {
+		s.download.Client.Signer = signer
+		return nil
+	}
+}
+
+// WithPinnedSPKI only allows connecting to servers whose certificate chain includes a public key with one of pins,
+// the base64 SHA-256 of its SubjectPublicKeyInfo (see client.SPKIHash). The chain must still be valid.
+func WithPinnedSPKI(pins ...string) Option {
+	return func(s *settings) error {
+		for _, pin := range pins {
+			if _, err := client.ParseSPKIPin(pin); err != nil {
+				return err
+			}
+		}
+		s.download.Client.TransportOpts.PinnedSPKI = pins
+		return nil
+	}
+}
+
+// WithVerifyPeerCertificate sets a callback run once the certificate chain of a server has been verified, which
+// can reject the connection by returning an error.
+func WithVerifyPeerCertificate(fn func(rawCerts [][]byte, verifiedChains [][]*x509.Certificate) error) Option {
+	return func(s *settings) error {
+		s.download.Client.TransportOpts.VerifyPeerCertificate = fn
+		return nil
+	}
+}
+
+// WithTransport sets the transport of the HTTP client, replacing the transport configured by the other options.
+func WithTransport(transport http.RoundTripper) Option {
+	return func(s *settings) error {
+		s.download.Client.Transport = transport
+		return nil
+	}
+}
+
+// WithConsumer sets what is done with downloaded files. Defaults to writing them to their destination with a
+// consumer.FileWriter.
+func WithConsumer(c consumer.Consumer) Option {
+	return func(s *settings) error {
+		if c == nil {
+			return errors.New("consumer is nil")
+		}
+		s.consumer = c
+		return nil
+	}
+}
+
+// WithMaxConcurrentFiles sets the maximum number of files DownloadFiles downloads at once. If n is zero, there is
+// no limit.
+func WithMaxConcurrentFiles(n int) Option {
+	return func(s *settings) error {
+		if n < 0 {
+			return fmt.Errorf("invalid maximum number of concurrent files %d", n)
+		}
+		s.options.MaxConcurrentFiles = n
+		return nil
+	}
+}
+
+// WithMaxConcurrentFilesPerHost sets the maximum number of files DownloadFiles downloads at once from each host,
+// see Options.MaxConcurrentFilesPerHost. If n is zero, there is no limit.
+func WithMaxConcurrentFilesPerHost(n int) Option {
+	return func(s *settings) error {
+		if n < 0 {
+			return fmt.Errorf("invalid maximum number of concurrent files per host %d", n)
+		}
+		s.options.MaxConcurrentFilesPerHost = n
+		return nil
+	}
+}
+
+// WithSchedule sets the order in which DownloadFiles starts the entries of a manifest, see Options.Schedule.
+func WithSchedule(schedule Schedule) Option {
+	return func(s *settings) error {
+		if _, err := ParseSchedule(string(schedule)); err != nil {
+			return err
+		}
+		s.options.Schedule = schedule
+		return nil
+	}
+}
+
+// WithMaxConcurrentExtracts sets the maximum number of entries DownloadFiles extracts at once. If n is zero, one
+// entry per CPU is extracted at once.
+func WithMaxConcurrentExtracts(n int) Option {
+	return func(s *settings) error {
+		if n < 0 {
+			return fmt.Errorf("invalid maximum number of concurrent extracts %d", n)
+		}
+		s.options.MaxConcurrentExtracts = n
+		return nil
+	}
+}
+
+// WithIdempotent sets whether files whose destination already exists and matches are skipped, see
+// Options.Idempotent.
+func WithIdempotent(enabled bool) Option {
+	return func(s *settings) error {
+		s.options.Idempotent = enabled
+		return nil
+	}
+}
+
+// WithSkipExisting sets how files whose destination already exists are found up to date and skipped, see
+// Options.SkipExisting. An empty mode disables it.
+func WithSkipExisting(mode SkipExisting) Option {
+	return func(s *settings) error {
+		if _, err := ParseSkipExisting(string(mode)); err != nil {
+			return err
+		}
+		s.options.SkipExisting = mode
+		return nil
+	}
+}
+
+// WithHooks sets the hooks called as files complete or fail, see Hooks.
+func WithHooks(hooks Hooks) Option {
+	return func(s *settings) error {
+		s.options.Hooks = hooks
+		return nil
+	}
+}
+
+// WithConsumerRoutes sets the routes handing files to consumers by their Content-Type or format, see
+// Options.ConsumerRoutes.
+func WithConsumerRoutes(routes ...ConsumerRoute) Option {
+	return func(s *settings) error {
+		s.options.ConsumerRoutes = routes
+		return nil
+	}
+}
+
+// WithContinueOnError sets whether DownloadFiles carries on with the other entries of a manifest when one fails,
+// see Options.ContinueOnError.
+func WithContinueOnError(enabled bool) Option {
+	return func(s *settings) error {
+		s.options.ContinueOnError = enabled
+		return nil
+	}
+}
+
+// WithManifestRetries sets the number of additional passes DownloadFiles makes over the entries which failed, see
+// Options.ManifestRetries.
+func WithManifestRetries(n int) Option {
+	return func(s *settings) error {
+		if n < 0 {
+			return fmt.Errorf("invalid number of manifest retries %d", n)
+		}
+		s.options.ManifestRetries = n
+		return nil
+	}
+}
+
+// WithWaitInterval sets the interval WaitForFile first polls a file which doesn't exist yet at, and DownloadFiles
+// first waits before retrying failed entries. If d is zero, it is 1s.
+func WithWaitInterval(d time.Duration) Option {
+	return func(s *settings) error {
+		if d < 0 {
+			return fmt.Errorf("invalid wait interval %s", d)
+		}
+		s.options.WaitInterval = d
+		return nil
+	}
+}
+
+// WithPrefetchFirstChunks sets whether Getter.Prefetch fetches the first chunk of files ahead of their download, see
+// Options.PrefetchFirstChunks.
+func WithPrefetchFirstChunks(enabled bool) Option {
+	return func(s *settings) error {
+		s.options.PrefetchFirstChunks = enabled
+		return nil
+	}
+}
+
+// WithOffsetWrites sets whether chunks are written straight to their offsets in destination files, see
+// Options.OffsetWrites.
+func WithOffsetWrites(enabled bool) Option {
+	return func(s *settings) error {
+		s.options.OffsetWrites = enabled
+		return nil
+	}
+}
+
+// WithContentCache stores downloaded files by digest in the content cache in dir, creating it if needed, and links
+// the destinations of content it already holds instead of downloading them again (see Options.ContentCache). If dir
+// is empty, there is no content cache.
+func WithContentCache(dir string) Option {
+	return func(s *settings) error {
+		if dir == "" {
+			s.options.ContentCache = nil
+			return nil
+		}
+		store, err := cas.Open(dir)
+		if err != nil {
+			return err
+		}
+		s.options.ContentCache = store
+		return nil
+	}
+}
+
+// WithMetricsEndpoint sets the URL a metrics payload is posted to after every download.
+func WithMetricsEndpoint(endpoint string) Option {
+	return func(s *settings) error {
+		s.options.MetricsEndpoint = endpoint
+		return nil
+	}
+}
+
+// WithReport records a FileResult for every downloaded file in report.
+func WithReport(report *Report) Option {
+	return func(s *settings) error {
+		s.report = report
+		return nil
+	}
+}
+
+// WithProgress sets a progress callback, see Getter.OnProgress.
+func WithProgress(fn func(ProgressEvent)) Option {
+	return func(s *settings) error {
+		s.onProgress = fn
+		return nil
+	}
+}
+
+// WithResponseMiddleware appends mw to the middleware the bodies of downloaded files are passed through, see
+// Getter.Use.
+func WithResponseMiddleware(mw ...ResponseMiddleware) Option {
+	return func(s *settings) error {
+		for _, m := range mw {
+			if m == nil {
+				return errors.New("response middleware is nil")
+			}
+		}
+		s.middleware = append(s.middleware, mw...)
+		return nil
+	}
+}
+
+// WithDownloadOptions replaces the download options built by the preceding options with opts, giving access to
+// the settings without an Option of their own, such as the cache hosts.
+func WithDownloadOptions(opts download.Options) Option {
+	return func(s *settings) error {
+		s.download = opts
+		return nil
+	}
+}
+
+// WithDownloader sets the download strategy, which is used as is: the download options are ignored.
+func WithDownloader(downloader download.Strategy) Option {
+	return func(s *settings) error {
+		if downloader == nil {
+			return errors.New("downloader is nil")
+		}
+		s.downloader = downloader
+		return nil
+	}
+}
@@ -0,0 +1,162 @@
+package rpget
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/emaballarin/rpget/pkg/extract"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// PostAction is run on a manifest entry once it has been downloaded and verified. Post actions run in order,
+// and the first failing action fails the entry.
+type PostAction interface {
+	Run(ctx context.Context, entry ManifestEntry) error
+}
+
+// postActionData is the data available to post action templates, e.g. `{{.Dest}}`.
+type postActionData struct {
+	URL  string
+	Dest string
+	// Dir is the directory containing Dest
+	Dir string
+	// Name is the base name of Dest
+	Name string
+}
+
+func parseTemplate(text string) (*template.Template, error) {
+	t, err := template.New("post").Option("missingkey=error").Parse(text)
+	if err != nil {
+		return nil, fmt.Errorf("invalid template `%s`: %w", text, err)
+	}
+	return t, nil
+}
+
+func render(t *template.Template, entry ManifestEntry) (string, error) {
+	var buf bytes.Buffer
+	data := postActionData{
+		URL:  entry.URL,
+		Dest: entry.Dest,
+		Dir:  filepath.Dir(entry.Dest),
+		Name: filepath.Base(entry.Dest),
+	}
+	if err := t.Execute(&buf, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// ExtractAction extracts the downloaded archive into a directory, detecting its format as --extract does.
+type ExtractAction struct {
+	dir       *template.Template
+	Overwrite bool
+}
+
+// NewExtractAction returns an ExtractAction extracting into the directory given by the dir template, or next to
+// the downloaded file if dir is empty.
+func NewExtractAction(dir string, overwrite bool) (*ExtractAction, error) {
+	if dir == "" {
+		dir = "{{.Dir}}"
+	}
+	t, err := parseTemplate(dir)
+	if err != nil {
+		return nil, err
+	}
+	return &ExtractAction{dir: t, Overwrite: overwrite}, nil
+}
+
+// Dir returns the directory the archive downloaded for entry is extracted into.
+func (a *ExtractAction) Dir(entry ManifestEntry) (string, error) {
+	return render(a.dir, entry)
+}
+
+func (a *ExtractAction) Run(ctx context.Context, entry ManifestEntry) error {
+	dir, err := a.Dir(entry)
+	if err != nil {
+		return err
+	}
+	release, err := acquireExtractWorker(ctx)
+	if err != nil {
+		return err
+	}
+	defer release()
+	file, err := os.Open(entry.Dest)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if err := extract.Archive(bufio.NewReader(file), dir, extract.Options{Overwrite: a.Overwrite}); err != nil {
+		return fmt.Errorf("error extracting %s to %s: %w", entry.Dest, dir, err)
+	}
+	return nil
+}
+
+// ChmodAction sets the mode of the downloaded file.
+type ChmodAction struct {
+	Mode os.FileMode
+}
+
+func (a *ChmodAction) Run(_ context.Context, entry ManifestEntry) error {
+	return os.Chmod(entry.Dest, a.Mode)
+}
+
+// RunAction runs a command. Every argument is a template; the command also receives RPGET_URL and RPGET_DEST in
+// its environment.
+type RunAction struct {
+	args []*template.Template
+}
+
+func NewRunAction(args []string) (*RunAction, error) {
+	if len(args) == 0 {
+		return nil, fmt.Errorf("run action requires a command")
+	}
+	action := &RunAction{args: make([]*template.Template, 0, len(args))}
+	for _, arg := range args {
+		t, err := parseTemplate(arg)
+		if err != nil {
+			return nil, err
+		}
+		action.args = append(action.args, t)
+	}
+	return action, nil
+}
+
+func (a *RunAction) Run(ctx context.Context, entry ManifestEntry) error {
+	logger := logging.GetLogger()
+	args := make([]string, 0, len(a.args))
+	for _, t := range a.args {
+		arg, err := render(t, entry)
+		if err != nil {
+			return err
+		}
+		args = append(args, arg)
+	}
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Env = append(os.Environ(), "RPGET_URL="+entry.URL, "RPGET_DEST="+entry.Dest)
+	output, err := cmd.CombinedOutput()
+	logger.Debug().
+		Str("dest", entry.Dest).
+		Strs("command", args).
+		Str("output", string(output)).
+		Msg("Post Action")
+	if err != nil {
+		return fmt.Errorf("error running `%s`: %w: %s", strings.Join(args, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+func (g *Getter) runPostActions(ctx context.Context, entry ManifestEntry) error {
+	for _, action := range entry.Post {
+		if err := action.Run(ctx, entry); err != nil {
+			return fmt.Errorf("post action for %s failed: %w", entry.Dest, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package rpget
+
+import (
+	"context"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/emaballarin/rpget/pkg/download"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// Prefetch prepares the downloads of urls in the background, so that downloading them later starts with little
+// latency: the first byte of each file is requested, which resolves its host, follows its redirects and leaves a
+// connection open to it (more with client.TransportOptions.Preconnect). With Options.PrefetchFirstChunks, and a
+// Downloader which supports it (see download.Prefetcher), the whole first chunk of each file is requested instead
+// and kept in memory for a minute, so that downloading it starts with its first chunk and requests the others at
+// once.
+//
+// Files are prefetched Options.MaxConcurrentFiles at a time, if set. Prefetch returns at once, and failures are only
+// logged: downloading the files reports them.
+func (g *Getter) Prefetch(ctx context.Context, urls ...string) {
+	prefetcher, prefetchFirstChunks := g.Downloader.(download.Prefetcher)
+	prefetchFirstChunks = prefetchFirstChunks && g.Options.PrefetchFirstChunks
+	go func() {
+		var group errgroup.Group
+		if g.Options.MaxConcurrentFiles != 0 {
+			group.SetLimit(g.Options.MaxConcurrentFiles)
+		}
+		for _, url := range urls {
+			group.Go(func() error {
+				var err error
+				if prefetchFirstChunks {
+					err = prefetcher.Prefetch(ctx, url)
+				} else {
+					_, err = g.Stat(ctx, url)
+				}
+				if err != nil {
+					logger := logging.GetLogger()
+					logger.Debug().Err(err).Str("url", url).Msg("Prefetch failed")
+				}
+				return nil
+			})
+		}
+		_ = group.Wait()
+	}()
+}
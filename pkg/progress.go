@@ -0,0 +1,133 @@
+package rpget
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+
+	"github.com/emaballarin/rpget/pkg/download"
+)
+
+// ProgressEvent reports the progress of a file downloaded by a Getter.
+type ProgressEvent struct {
+	URL  string
+	Dest string
+	// BytesDone is the number of bytes of the file consumed so far, or written with Options.OffsetWrites.
+	BytesDone int64
+	// TotalBytes is the size of the file.
+	TotalBytes int64
+	// Chunk, if set, is the chunk of the file whose download just completed, ahead of it being consumed. Events
+	// without a Chunk are sent as the file is consumed.
+	Chunk *download.Chunk
+}
+
+// OnProgress sets fn to be called as the files of g are downloaded and consumed. Files and chunks are downloaded
+// concurrently, so fn must be safe for concurrent use; it is called for every read of the consumer, or every write
+// with Options.OffsetWrites, so it should return quickly.
+func (g *Getter) OnProgress(fn func(ProgressEvent)) {
+	g.onProgress = fn
+}
+
+// progressTracker sends the progress events of a single file.
+type progressTracker struct {
+	fn    func(ProgressEvent)
+	url   string
+	dest  string
+	done  atomic.Int64
+	total atomic.Int64
+}
+
+// track returns a context reporting the chunks of the file downloaded with it, and a tracker of the bytes of the
+// file consumed. If g has no progress callback, ctx is returned unchanged along with a nil tracker, which tracks
+// nothing.
+func (g *Getter) track(ctx context.Context, url, dest string) (context.Context, *progressTracker) {
+	if g.onProgress == nil {
+		return ctx, nil
+	}
+	t := &progressTracker{fn: g.onProgress, url: url, dest: dest}
+	ctx = download.WithChunkCallback(ctx, func(chunk download.Chunk, fileSize int64) {
+		t.total.Store(fileSize)
+		t.send(&chunk)
+	})
+	return ctx, t
+}
+
+// reader wraps r, the reader of a file of fileSize bytes, to report the bytes read from it.
+func (t *progressTracker) reader(r io.Reader, fileSize int64) io.Reader {
+	if t == nil {
+		return r
+	}
+	t.total.Store(fileSize)
+	return &progressReader{r: r, tracker: t}
+}
+
+// writerAt wraps w, the destination of a file of fileSize bytes written by offset, to report the bytes written to
+// it.
+func (t *progressTracker) writerAt(w io.WriterAt, fileSize int64) io.WriterAt {
+	if t == nil {
+		return w
+	}
+	t.total.Store(fileSize)
+	return &progressWriterAt{w: w, tracker: t}
+}
+
+func (t *progressTracker) send(chunk *download.Chunk) {
+	t.fn(ProgressEvent{
+		URL:        t.url,
+		Dest:       t.dest,
+		BytesDone:  t.done.Load(),
+		TotalBytes: t.total.Load(),
+		Chunk:      chunk,
+	})
+}
+
+type progressReader struct {
+	r       io.Reader
+	tracker *progressTracker
+}
+
+func (p *progressReader) Read(buf []byte) (int, error) {
+	n, err := p.r.Read(buf)
+	if n > 0 {
+		p.tracker.done.Add(int64(n))
+		p.tracker.send(nil)
+	}
+	return n, err
+}
+
+// WriteTo implements io.WriterTo, so that a reader writing itself straight from its buffers, as downloads do, still
+// does through the tracker.
+func (p *progressReader) WriteTo(w io.Writer) (int64, error) {
+	if wt, ok := p.r.(io.WriterTo); ok {
+		return wt.WriteTo(&progressWriter{w: w, tracker: p.tracker})
+	}
+	return io.Copy(w, struct{ io.Reader }{p})
+}
+
+type progressWriter struct {
+	w       io.Writer
+	tracker *progressTracker
+}
+
+func (p *progressWriter) Write(buf []byte) (int, error) {
+	n, err := p.w.Write(buf)
+	if n > 0 {
+		p.tracker.done.Add(int64(n))
+		p.tracker.send(nil)
+	}
+	return n, err
+}
+
+type progressWriterAt struct {
+	w       io.WriterAt
+	tracker *progressTracker
+}
+
+func (p *progressWriterAt) WriteAt(buf []byte, off int64) (int, error) {
+	n, err := p.w.WriteAt(buf, off)
+	if n > 0 {
+		p.tracker.done.Add(int64(n))
+		p.tracker.send(nil)
+	}
+	return n, err
+}
@@ -0,0 +1,175 @@
+package rpget
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// FileResult is the outcome of downloading a single file, as recorded in a Report.
+type FileResult struct {
+	URL             string  `json:"url"`
+	Dest            string  `json:"dest"`
+	Size            int64   `json:"size"`
+	DurationSeconds float64 `json:"duration_seconds"`
+	BytesPerSecond  float64 `json:"bytes_per_second"`
+	Retries         int64   `json:"retries"`
+	Checksum        string  `json:"checksum,omitempty"`
+	Error           string  `json:"error,omitempty"`
+	// DecompressedSize is the size of the file once decompressed when it was extracted from a compressed
+	// archive. Size and BytesPerSecond are always measured on the wire.
+	DecompressedSize           int64   `json:"decompressed_size,omitempty"`
+	DecompressedBytesPerSecond float64 `json:"decompressed_bytes_per_second,omitempty"`
+	CompressionRatio           float64 `json:"compression_ratio,omitempty"`
+	// Cached is set when the file was linked from the content cache rather than downloaded.
+	Cached bool `json:"cached,omitempty"`
+	// Fallback is why the file was fetched from origin rather than through the consistent hashing cache, if it was.
+	Fallback string `json:"fallback,omitempty"`
+}
+
+// ResourceUsage is the resources rpget used over a run, as reported by getrusage(2), to compare the cost of modes
+// and options. Only PeakRSSBytes covers the whole life of the process rather than the run.
+type ResourceUsage struct {
+	UserCPUSeconds   float64 `json:"user_cpu_seconds"`
+	SystemCPUSeconds float64 `json:"system_cpu_seconds"`
+	PeakRSSBytes     int64   `json:"peak_rss_bytes"`
+	// MajorPageFaults required reading from disk, MinorPageFaults didn't.
+	MinorPageFaults int64 `json:"minor_page_faults"`
+	MajorPageFaults int64 `json:"major_page_faults"`
+	// BlockInputs and BlockOutputs count the reads and writes of the filesystem which went to disk, in 512-byte
+	// blocks on Linux and operations on macOS; writes to the page cache flushed later by the kernel may be missed.
+	BlockInputs  int64 `json:"block_inputs"`
+	BlockOutputs int64 `json:"block_outputs"`
+	// VoluntaryContextSwitches are mostly waits for the network or the disk, InvoluntaryContextSwitches preemptions
+	// by the scheduler, e.g. for lack of CPU.
+	VoluntaryContextSwitches   int64 `json:"voluntary_context_switches"`
+	InvoluntaryContextSwitches int64 `json:"involuntary_context_switches"`
+}
+
+// since returns the resources used since start.
+func (u ResourceUsage) since(start ResourceUsage) ResourceUsage {
+	return ResourceUsage{
+		UserCPUSeconds:             u.UserCPUSeconds - start.UserCPUSeconds,
+		SystemCPUSeconds:           u.SystemCPUSeconds - start.SystemCPUSeconds,
+		PeakRSSBytes:               u.PeakRSSBytes,
+		MinorPageFaults:            u.MinorPageFaults - start.MinorPageFaults,
+		MajorPageFaults:            u.MajorPageFaults - start.MajorPageFaults,
+		BlockInputs:                u.BlockInputs - start.BlockInputs,
+		BlockOutputs:               u.BlockOutputs - start.BlockOutputs,
+		VoluntaryContextSwitches:   u.VoluntaryContextSwitches - start.VoluntaryContextSwitches,
+		InvoluntaryContextSwitches: u.InvoluntaryContextSwitches - start.InvoluntaryContextSwitches,
+	}
+}
+
+// Report is a structured, machine-readable summary of a Getter run. When a Getter has a non-nil
+// Report, every call to DownloadFile (including those made by DownloadFiles) records a FileResult.
+// A file downloaded again after failing, e.g. by a retry pass of DownloadFiles, replaces its failed result.
+// Report is safe for concurrent use.
+type Report struct {
+	mu      sync.Mutex
+	started time.Time
+	// startUsage is the resources used by the process when the report was created, if known
+	startUsage *ResourceUsage
+	files      []FileResult
+	// failed indexes the failed results of files by destination
+	failed map[string]int
+}
+
+type reportPayload struct {
+	Files       []FileResult `json:"files"`
+	FileCount   int          `json:"file_count"`
+	FailedCount int          `json:"failed_count"`
+	TotalBytes  int64        `json:"total_bytes"`
+	// TotalDecompressedBytes counts compressed files once decompressed, other files as they are
+	TotalDecompressedBytes int64   `json:"total_decompressed_bytes"`
+	ElapsedSeconds         float64 `json:"elapsed_seconds"`
+	// Resources is left out where getrusage(2) isn't supported
+	Resources *ResourceUsage `json:"resources,omitempty"`
+}
+
+func NewReport() *Report {
+	r := &Report{started: time.Now(), files: make([]FileResult, 0)}
+	if usage, ok := resourceUsage(); ok {
+		r.startUsage = &usage
+	}
+	return r
+}
+
+func (r *Report) add(result FileResult) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	i, ok := r.failed[result.Dest]
+	if ok {
+		r.files[i] = result
+		delete(r.failed, result.Dest)
+	} else {
+		i = len(r.files)
+		r.files = append(r.files, result)
+	}
+	if result.Error != "" {
+		if r.failed == nil {
+			r.failed = make(map[string]int)
+		}
+		r.failed[result.Dest] = i
+	}
+}
+
+// Resources returns the resources used by the process since NewReport, if they are known on this platform.
+func (r *Report) Resources() (ResourceUsage, bool) {
+	usage, ok := resourceUsage()
+	if !ok || r.startUsage == nil {
+		return ResourceUsage{}, false
+	}
+	return usage.since(*r.startUsage), true
+}
+
+// Files returns a copy of the results recorded so far.
+func (r *Report) Files() []FileResult {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]FileResult(nil), r.files...)
+}
+
+// WriteJSON writes the report to w. The elapsed time and the resources used cover the period from NewReport until
+// WriteJSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	payload := reportPayload{Files: r.Files(), ElapsedSeconds: time.Since(r.started).Seconds()}
+	if usage, ok := r.Resources(); ok {
+		payload.Resources = &usage
+	}
+	payload.FileCount = len(payload.Files)
+	for _, f := range payload.Files {
+		if f.Error != "" {
+			payload.FailedCount++
+			continue
+		}
+		payload.TotalBytes += f.Size
+		if f.DecompressedSize > 0 {
+			payload.TotalDecompressedBytes += f.DecompressedSize
+		} else {
+			payload.TotalDecompressedBytes += f.Size
+		}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(payload)
+}
+
+// WriteFile writes the report as JSON to path, or to stdout if path is "-".
+func (r *Report) WriteFile(path string) error {
+	if path == "-" {
+		return r.WriteJSON(os.Stdout)
+	}
+	file, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating report file %s: %w", path, err)
+	}
+	if err := r.WriteJSON(file); err != nil {
+		file.Close()
+		return fmt.Errorf("error writing report file %s: %w", path, err)
+	}
+	return file.Close()
+}
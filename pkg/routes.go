@@ -0,0 +1,104 @@
+package rpget
+
+import (
+	"bufio"
+	"io"
+	"mime"
+	"strings"
+
+	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/extract"
+)
+
+// A ConsumerRoute hands the files matching it to Consumer instead of the Getter's Consumer, so that e.g. archives
+// are extracted without annotating every manifest entry. A route with both ContentType and Format set only matches
+// the files matching both.
+type ConsumerRoute struct {
+	// ContentType matches the media type of the Content-Type of the response, ignoring parameters: either
+	// exactly, e.g. "application/x-tar", or by its type, e.g. "application/*".
+	ContentType string
+	// Format matches the format sniffed from the first bytes of the file, as reported by extract.Sniff, e.g. "tar",
+	// "zip" or "zstd".
+	Format   string
+	Consumer consumer.Consumer
+}
+
+func (route ConsumerRoute) matches(contentType string, format func() string) bool {
+	if route.ContentType != "" && !matchContentType(route.ContentType, contentType) {
+		return false
+	}
+	return route.Format == "" || strings.EqualFold(route.Format, format())
+}
+
+// matchContentType reports whether the Content-Type header contentType matches pattern, see
+// ConsumerRoute.ContentType.
+func matchContentType(pattern, contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	pattern, _, _ = strings.Cut(strings.ToLower(pattern), ";")
+	pattern = strings.TrimSpace(pattern)
+	if typ, ok := strings.CutSuffix(pattern, "/*"); ok {
+		return typ == "*" || strings.HasPrefix(mediaType, typ+"/")
+	}
+	return mediaType == pattern
+}
+
+// routeFor returns the consumer of entry, c, wrapped to follow Options.ConsumerRoutes, unless entry has its own
+// consumer.
+func (g *Getter) routeFor(entry ManifestEntry, c consumer.Consumer) consumer.Consumer {
+	if len(g.Options.ConsumerRoutes) == 0 || entry.Consumer != nil {
+		return c
+	}
+	return &routingConsumer{routes: g.Options.ConsumerRoutes, fallback: c}
+}
+
+// consumedBy returns the consumer c handed the file to, if it is a routingConsumer, otherwise c itself.
+func consumedBy(c consumer.Consumer) consumer.Consumer {
+	if r, ok := c.(*routingConsumer); ok && r.routed != nil {
+		return r.routed
+	}
+	return c
+}
+
+// routingConsumer hands a file to the consumer of the first route matching it, or to fallback if none does. It
+// consumes a single file.
+type routingConsumer struct {
+	routes   []ConsumerRoute
+	fallback consumer.Consumer
+	// contentType is the Content-Type of the response, if known when the file is consumed
+	contentType string
+	// routed is the consumer the file was handed to
+	routed consumer.Consumer
+}
+
+var _ consumer.DecompressingConsumer = &routingConsumer{}
+
+func (r *routingConsumer) Consume(reader io.Reader, destPath string, expectedBytes int64) error {
+	_, err := r.ConsumeDecompressed(reader, destPath, expectedBytes)
+	return err
+}
+
+func (r *routingConsumer) ConsumeDecompressed(reader io.Reader, destPath string, expectedBytes int64) (int64, error) {
+	buffered := bufio.NewReader(reader)
+	var format *string
+	sniff := func() string {
+		if format == nil {
+			sniffed := extract.Sniff(buffered)
+			format = &sniffed
+		}
+		return *format
+	}
+	r.routed = r.fallback
+	for _, route := range r.routes {
+		if route.matches(r.contentType, sniff) {
+			r.routed = route.Consumer
+			break
+		}
+	}
+	if dc, ok := r.routed.(consumer.DecompressingConsumer); ok {
+		return dc.ConsumeDecompressed(buffered, destPath, expectedBytes)
+	}
+	return 0, r.routed.Consume(buffered, destPath, expectedBytes)
+}
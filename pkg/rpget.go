@@ -3,23 +3,29 @@ package rpget
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"io"
 	"net/http"
+	"os"
+	"sync"
 	"sync/atomic"
 	"time"
 
-	"github.com/spf13/viper"
-
-	"github.com/emaballarin/rpget/pkg/config"
-	"github.com/emaballarin/rpget/pkg/version"
-
 	"github.com/dustin/go-humanize"
 	"golang.org/x/sync/errgroup"
 
+	"github.com/emaballarin/rpget/pkg/cas"
+	"github.com/emaballarin/rpget/pkg/client"
 	"github.com/emaballarin/rpget/pkg/consumer"
 	"github.com/emaballarin/rpget/pkg/download"
 	"github.com/emaballarin/rpget/pkg/logging"
+	"github.com/emaballarin/rpget/pkg/version"
+	"github.com/emaballarin/rpget/pkg/wal"
 )
 
 type MetricsPayload struct {
@@ -32,16 +38,104 @@ type Getter struct {
 	Downloader download.Strategy
 	Consumer   consumer.Consumer
 	Options    Options
+	// Report, if set, receives a FileResult for every file downloaded by this Getter.
+	Report *Report
+	// Batcher, if set, is used by DownloadFiles to fetch the files of origins supporting batch requests as
+	// tar streams rather than one request per file.
+	Batcher *download.BatchMode
+
+	onProgress func(ProgressEvent)
+	middleware []ResponseMiddleware
 }
 
 type Options struct {
 	MaxConcurrentFiles int
 	MetricsEndpoint    string
+	// BatchSize is the maximum number of files per batch request when a Batcher is set. Defaults to 256.
+	BatchSize int
+	// MaxConcurrentExtracts is the maximum number of entries DownloadFiles extracts at once, either while
+	// downloading them or with an ExtractAction. Defaults to the number of CPUs.
+	MaxConcurrentExtracts int
+	// Idempotent skips the files whose destination already exists and matches them (see ErrDestinationMismatch),
+	// along with their post actions, so that running the same downloads again succeeds without downloading anything.
+	Idempotent bool
+	// Hooks are called as files complete or fail.
+	Hooks Hooks
+	// SkipExisting, if set, skips the files whose destination already exists and is up to date, along with their
+	// post actions, asking the server whether the remote file changed since it was downloaded with a conditional
+	// request (or comparing sizes). Other existing destinations are downloaded again, replacing them. It takes
+	// precedence over Idempotent.
+	SkipExisting SkipExisting
+	// ContentCache, if set, stores the files written by a FileWriter by digest, and links the destinations of
+	// content it already holds instead of downloading them again (see package cas). FileWriters writing to
+	// destinations linked from it should have BreakHardlinks set, as the default Consumer has.
+	ContentCache *cas.Store
+	// OffsetWrites writes every chunk of a file straight to its offset in the destination as soon as it completes,
+	// rather than reassembling the chunks in order in memory first, when the Downloader and the consumer support
+	// it (see download.WriterAtStrategy and consumer.WriterAtConsumer) and no ResponseMiddleware is used. Memory
+	// use then no longer grows with the bandwidth-delay product. Checksums are verified by reading the file back.
+	OffsetWrites bool
+	// Schedule is the order in which DownloadFiles starts entries of equal Priority. Defaults to the order of the
+	// manifest.
+	Schedule Schedule
+	// MaxConcurrentFilesPerHost is the maximum number of files DownloadFiles downloads at once from each host, on
+	// top of MaxConcurrentFiles. Entries of busy hosts are passed over for those of hosts with a free slot. If it is
+	// zero, there is no limit.
+	MaxConcurrentFilesPerHost int
+	// ContinueOnError lets DownloadFiles carry on with the other entries when one fails, e.g. with a 404, instead of
+	// cancelling them. The failed entries are returned in a single error once every entry has been attempted.
+	// Entries failing verification never abort the run.
+	ContinueOnError bool
+	// ManifestRetries is the number of additional passes DownloadFiles makes over the entries which failed in the
+	// previous pass, e.g. for object stores where freshly uploaded files are briefly missing. Failed entries don't
+	// cancel the others while a pass is left. Passes start after WaitInterval, then twice as long after each pass.
+	ManifestRetries int
+	// WaitInterval is the interval WaitForFile first polls a file which doesn't exist yet at, and DownloadFiles
+	// first waits before retrying failed entries. Defaults to 1s.
+	WaitInterval time.Duration
+	// ConsumerRoutes hand the files matching them, by the Content-Type of the response or their sniffed format, to
+	// another consumer than the Getter's Consumer: the first matching route is used. Entries with their own
+	// Consumer aren't routed. Routed files bypass the ContentCache and can't be written by offset (see
+	// OffsetWrites), as what they are consumed by is only known once they are fetched.
+	ConsumerRoutes []ConsumerRoute
+	// PrefetchFirstChunks makes Prefetch fetch the first chunk of files and keep it for their download, rather than
+	// only their first byte.
+	PrefetchFirstChunks bool
 }
 
 type ManifestEntry struct {
 	URL  string
 	Dest string
+	// Checksum, if set, is verified once the file has been consumed: either "sha256:<hex>" or "size=<n>".
+	Checksum string
+	// Headers are added to every request made for this entry.
+	Headers map[string]string
+	// Mode, if non-zero, is applied to the written file once it has been verified. It is ignored unless the
+	// entry is consumed by a FileWriter.
+	Mode os.FileMode
+	// Consumer, if set, consumes this entry instead of the Getter's Consumer.
+	Consumer consumer.Consumer
+	// After lists the destinations of entries which must be downloaded (and verified) before this one starts. If
+	// one of them fails, this entry fails with ErrDependencyFailed. Only DownloadFiles honours After.
+	After []string
+	// Post actions are run in order once the entry has been consumed and verified.
+	Post []PostAction
+	// Priority orders the entries DownloadFiles starts: entries of higher priority are started first, whatever the
+	// Schedule. Dependencies (see After) still start before the entries depending on them.
+	Priority int
+	// VersionMarker, if set, is the URL of a small file identifying the version of the entry (e.g. a version number
+	// or a digest), fetched first: if it matches the marker stored locally when the entry was last downloaded, and
+	// the destination still exists, the entry and its post actions are skipped. Otherwise the entry is downloaded
+	// and the marker stored once it has been verified and its post actions have run, replacing an existing
+	// destination: a TarExtractor extracting over a previous version should overwrite, so that longer files are
+	// truncated.
+	VersionMarker string
+	// VersionMarkerFile is where the version marker is stored locally. Defaults to the destination followed by
+	// ".marker".
+	VersionMarkerFile string
+	// DownloadMode, if set, forces the mode this entry is fetched in when the Getter downloads in consistent
+	// hashing mode, taking precedence over the mode forced for its host (see download.Options.HostModes).
+	DownloadMode download.Mode
 }
 
 // A Manifest is a slice of ManifestEntry, with a helper method to add entries
@@ -51,27 +145,246 @@ func (m Manifest) AddEntry(url string, destination string) Manifest {
 	return append(m, ManifestEntry{URL: url, Dest: destination})
 }
 
+// multifileRun holds the state shared by the downloads of a single pass of a DownloadFiles call.
+type multifileRun struct {
+	totalSize atomic.Int64
+	// states of the entries other entries depend on, keyed by destination
+	states map[string]*entryState
+	// continueOnError is set if a failed entry doesn't cancel the others
+	continueOnError bool
+	// lastPass is set if failed entries aren't retried by another pass
+	lastPass bool
+
+	mu            sync.Mutex
+	failed        []error
+	failedEntries []ManifestEntry
+}
+
+// fail records an entry which failed without aborting the rest of the run.
+func (r *multifileRun) fail(entry ManifestEntry, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failed = append(r.failed, fmt.Errorf("%s: %w", entry.URL, err))
+	r.failedEntries = append(r.failedEntries, entry)
+}
+
+func (r *multifileRun) err() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.failed) == 0 {
+		return nil
+	}
+	return fmt.Errorf("%d file(s) failed: %w", len(r.failed), errors.Join(r.failed...))
+}
+
 func (g *Getter) DownloadFile(ctx context.Context, url string, dest string) (int64, time.Duration, error) {
+	return g.DownloadEntry(ctx, ManifestEntry{URL: url, Dest: dest})
+}
+
+// DownloadEntry downloads a single manifest entry as DownloadFiles would, honouring all its fields but After.
+func (g *Getter) DownloadEntry(ctx context.Context, entry ManifestEntry) (int64, time.Duration, error) {
+	size, elapsed, err := g.downloadEntry(ctx, entry)
+	g.fileDone(ctx, entry, err)
+	return size, elapsed, err
+}
+
+// DownloadFileWithMetadata is DownloadFile, also returning the metadata of the response. The metadata is empty if
+// the file wasn't fetched, e.g. because Options.Idempotent skipped it.
+func (g *Getter) DownloadFileWithMetadata(ctx context.Context, url string, dest string) (download.Metadata, int64, time.Duration, error) {
+	var md download.Metadata
+	size, elapsed, err := g.DownloadEntry(download.WithMetadata(ctx, &md), ManifestEntry{URL: url, Dest: dest})
+	return md, size, elapsed, err
+}
+
+// downloadEntry downloads a single manifest entry, verifying its checksum and recording it in the Report if set,
+// unless its version marker is unchanged or Options.SkipExisting finds it up to date.
+func (g *Getter) downloadEntry(ctx context.Context, entry ManifestEntry) (int64, time.Duration, error) {
+	ctx = download.WithMode(ctx, entry.DownloadMode)
+	if entry.VersionMarker == "" {
+		return g.fetchChanged(ctx, entry)
+	}
+	markerCtx := ctx
+	if len(entry.Headers) > 0 {
+		markerCtx = client.WithHeaders(ctx, entry.Headers)
+	}
+	marker, unchanged, err := g.checkVersionMarker(markerCtx, entry)
+	if err != nil || unchanged {
+		return 0, 0, err
+	}
+	fileSize, elapsed, err := g.fetchChanged(ctx, entry)
+	if err == nil {
+		err = storeVersionMarker(entry, marker)
+	}
+	return fileSize, elapsed, err
+}
+
+// fetchEntry downloads entry, see downloadEntry.
+func (g *Getter) fetchEntry(ctx context.Context, entry ManifestEntry) (int64, time.Duration, error) {
+	var v *verifier
+	if entry.Checksum != "" {
+		var err error
+		if v, err = newVerifier(entry.Checksum); err != nil {
+			return 0, 0, err
+		}
+	}
+	if len(entry.Headers) > 0 {
+		ctx = client.WithHeaders(ctx, entry.Headers)
+	}
+	c := g.consumerFor(entry)
+	if g.Options.Idempotent && g.Options.SkipExisting == "" {
+		if skip, err := g.skipExisting(ctx, entry, c); err != nil || skip {
+			return 0, 0, err
+		}
+	}
+	c = g.routeFor(entry, c)
+	if _, routed := c.(*routingConsumer); routed && download.MetadataFrom(ctx) == nil {
+		// routes may match the Content-Type of the response
+		ctx = download.WithMetadata(ctx, &download.Metadata{})
+	}
+	cache := g.contentCacheFor(c)
+	if cache != nil {
+		if fileSize, elapsed, hit, err := g.linkCached(ctx, entry, c, v); err != nil || hit {
+			return fileSize, elapsed, err
+		}
+		if download.MetadataFrom(ctx) == nil {
+			// the ETag of the response is recorded along with the content
+			ctx = download.WithMetadata(ctx, &download.Metadata{})
+		}
+	}
+	_, extract := c.(*consumer.TarExtractor)
+	defer wal.Begin(wal.Op{Kind: wal.KindDownload, URL: entry.URL, Dest: entry.Dest, Extract: extract}).Done()
+	var tee io.Writer
+	if v != nil {
+		tee = v
+	}
+	var hasher hash.Hash
+	if cache != nil || g.Report != nil {
+		// the checksum of the content is recorded along with it
+		hasher = sha256.New()
+		tee = teeWriter(hasher, v)
+	}
+	retries := new(atomic.Int64)
+	var fallback string
+	ctx = download.WithFallbackReason(ctx, &fallback)
+	startTime := time.Now()
+	fileSize, decompressed, _, err := g.downloadFile(client.WithRetryCounter(ctx, retries), entry.URL, entry.Dest, c, tee)
+	if err == nil {
+		err = g.finishEntry(entry, consumedBy(c), v)
+	}
+	if err == nil && cache != nil {
+		g.addToCache(ctx, cache, entry, digestOf(hasher), fileSize)
+	}
+	if err == nil {
+		err = g.runPostActions(ctx, entry)
+	}
+	elapsed := time.Since(startTime)
+	if g.Report == nil {
+		return fileSize, elapsed, err
+	}
+	result := FileResult{
+		URL:             entry.URL,
+		Dest:            entry.Dest,
+		Size:            fileSize,
+		DurationSeconds: elapsed.Seconds(),
+		Retries:         retries.Load(),
+		Fallback:        fallback,
+	}
+	if err != nil {
+		result.Error = err.Error()
+	} else {
+		result.BytesPerSecond = float64(fileSize) / elapsed.Seconds()
+		if decompressed > 0 {
+			result.DecompressedSize = decompressed
+			result.DecompressedBytesPerSecond = float64(decompressed) / elapsed.Seconds()
+			result.CompressionRatio = compressionRatio(decompressed, fileSize)
+		}
+		result.Checksum = digestOf(hasher)
+	}
+	g.Report.add(result)
+	return fileSize, elapsed, err
+}
+
+// teeWriter returns a writer writing to hasher and, if it isn't nil, to v.
+func teeWriter(hasher hash.Hash, v *verifier) io.Writer {
+	if v == nil {
+		return hasher
+	}
+	return io.MultiWriter(hasher, v)
+}
+
+// digestOf returns the sha256 checksum of the bytes written to hasher.
+func digestOf(hasher hash.Hash) string {
+	return checksumSHA256Prefix + hex.EncodeToString(hasher.Sum(nil))
+}
+
+// defaultConsumer returns the consumer of a Getter configured by opts without one: a FileWriter, breaking the
+// hardlinks of destinations written in place if they may be linked from the ContentCache.
+func defaultConsumer(opts Options) consumer.Consumer {
+	return &consumer.FileWriter{BreakHardlinks: opts.ContentCache != nil}
+}
+
+func (g *Getter) consumerFor(entry ManifestEntry) consumer.Consumer {
+	if entry.Consumer != nil {
+		return entry.Consumer
+	}
 	if g.Consumer == nil {
-		g.Consumer = &consumer.FileWriter{}
+		g.Consumer = defaultConsumer(g.Options)
 	}
+	return g.Consumer
+}
 
+// finishEntry verifies the content of entry consumed by c against v, which may be nil, and applies the entry's
+// mode. A file written to disk that fails verification is removed.
+func (g *Getter) finishEntry(entry ManifestEntry, c consumer.Consumer, v *verifier) error {
+	_, isFile := c.(*consumer.FileWriter)
+	if err := g.verify(entry, isFile, v); err != nil {
+		return err
+	}
+	if isFile && entry.Mode != 0 {
+		if err := os.Chmod(entry.Dest, entry.Mode); err != nil {
+			return fmt.Errorf("error setting mode of %s: %w", entry.Dest, err)
+		}
+	}
+	return nil
+}
+
+func (g *Getter) verify(entry ManifestEntry, isFile bool, v *verifier) error {
+	if v == nil {
+		return nil
+	}
+	err := v.verify()
+	if err == nil {
+		return nil
+	}
+	if isFile {
+		if removeErr := os.Remove(entry.Dest); removeErr != nil {
+			logger := logging.GetLogger()
+			logger.Warn().Err(removeErr).Str("dest", entry.Dest).Msg("Error removing unverified file")
+		}
+	}
+	return fmt.Errorf("error verifying %s: %w", entry.Dest, err)
+}
+
+// downloadFile fetches url and hands it to c. If tee is non-nil, every byte passed to c is also written to it. It
+// returns the size of the file and, if c decompressed it, its decompressed size.
+func (g *Getter) downloadFile(ctx context.Context, url string, dest string, c consumer.Consumer, tee io.Writer) (int64, int64, time.Duration, error) {
 	logger := logging.GetLogger()
 	downloadStartTime := time.Now()
-	buffer, fileSize, err := g.Downloader.Fetch(ctx, url)
+	ctx, tracker := g.track(ctx, url, dest)
+	var fileSize, decompressed int64
+	var err error
+	if s, wc, ok := g.offsetWriters(c); ok {
+		fileSize, err = g.fetchAt(ctx, s, wc, url, dest, tee, tracker)
+	} else {
+		fileSize, decompressed, err = g.fetchAndConsume(ctx, url, dest, c, tee, tracker)
+	}
 	if err != nil {
 		g.sendMetrics(url, fileSize, 0, err)
-		return fileSize, 0, err
+		return fileSize, 0, 0, err
 	}
 	// downloadElapsed := time.Since(downloadStartTime)
 	// writeStartTime := time.Now()
 
-	err = g.Consumer.Consume(buffer, dest, fileSize)
-	if err != nil {
-		g.sendMetrics(url, fileSize, 0, err)
-		return fileSize, 0, fmt.Errorf("error writing file: %w", err)
-	}
-
 	// writeElapsed := time.Since(writeStartTime)
 	totalElapsed := time.Since(downloadStartTime)
 
@@ -80,10 +393,19 @@ func (g *Getter) DownloadFile(ctx context.Context, url string, dest string) (int
 	size := humanize.Bytes(uint64(fileSize))
 	// downloadThroughput := humanize.Bytes(uint64(float64(fileSize) / downloadElapsed.Seconds()))
 	// writeThroughput := humanize.Bytes(uint64(float64(fileSize) / writeElapsed.Seconds()))
-	logger.Info().
+	event := logger.Info().
 		Str("dest", dest).
 		Str("url", url).
-		Str("size", size).
+		Str("size", size)
+	if decompressed > 0 {
+		// the throughput of a compressed file on the wire understates how fast its content was delivered
+		event = event.
+			Str("decompressed_size", humanize.Bytes(uint64(decompressed))).
+			Str("compression_ratio", fmt.Sprintf("%.2f", compressionRatio(decompressed, fileSize))).
+			Str("wire_throughput", fmt.Sprintf("%s/s", humanize.Bytes(uint64(float64(fileSize)/totalElapsed.Seconds())))).
+			Str("decompressed_throughput", fmt.Sprintf("%s/s", humanize.Bytes(uint64(float64(decompressed)/totalElapsed.Seconds()))))
+	}
+	event.
 		// Str("download_throughput", fmt.Sprintf("%s/s", downloadThroughput)).
 		// Str("download_elapsed", fmt.Sprintf("%.3fs", downloadElapsed.Seconds())).
 		// Str("write_throughput", fmt.Sprintf("%s/s", writeThroughput)).
@@ -91,63 +413,279 @@ func (g *Getter) DownloadFile(ctx context.Context, url string, dest string) (int
 		Str("total_elapsed", fmt.Sprintf("%.3fs", totalElapsed.Seconds())).
 		Msg("Complete")
 
-	return fileSize, totalElapsed, nil
+	return fileSize, decompressed, totalElapsed, nil
+}
+
+// fetchAndConsume fetches url, passes it through the middleware of g and streams it to c, see downloadFile.
+func (g *Getter) fetchAndConsume(ctx context.Context, url string, dest string, c consumer.Consumer, tee io.Writer, tracker *progressTracker) (int64, int64, error) {
+	buffer, fileSize, err := g.Downloader.Fetch(ctx, url)
+	if err != nil {
+		return fileSize, 0, err
+	}
+	if closer, ok := buffer.(io.Closer); ok {
+		// e.g. a response body, which a consumer failing before reading it all leaves open
+		defer closer.Close()
+	}
+	buffer = tracker.reader(buffer, fileSize)
+	body, err := g.transformBody(ctx, ResponseBody{URL: url, Dest: dest, Size: fileSize, Reader: buffer})
+	if err != nil {
+		return fileSize, 0, err
+	}
+	buffer = body.Reader
+
+	if tee != nil {
+		buffer = io.TeeReader(buffer, tee)
+	}
+	if r, ok := c.(*routingConsumer); ok {
+		if md := download.MetadataFrom(ctx); md != nil {
+			r.contentType = md.ContentType
+		}
+	}
+	var decompressed int64
+	if dc, ok := c.(consumer.DecompressingConsumer); ok {
+		decompressed, err = dc.ConsumeDecompressed(buffer, dest, body.Size)
+	} else {
+		err = c.Consume(buffer, dest, body.Size)
+	}
+	if err != nil {
+		return fileSize, 0, fmt.Errorf("error writing file: %w", err)
+	}
+	return fileSize, decompressed, nil
+}
+
+// offsetWriters returns the strategy and consumer of g and c as writing files by offset, if Options.OffsetWrites is
+// set and they both can. Bodies passed through middleware are streamed, as middleware may change their length.
+func (g *Getter) offsetWriters(c consumer.Consumer) (download.WriterAtStrategy, consumer.WriterAtConsumer, bool) {
+	if !g.Options.OffsetWrites || len(g.middleware) > 0 {
+		return nil, nil, false
+	}
+	s, ok := g.Downloader.(download.WriterAtStrategy)
+	if !ok {
+		return nil, nil, false
+	}
+	wc, ok := c.(consumer.WriterAtConsumer)
+	return s, wc, ok
+}
+
+// fetchAt downloads url with s straight to the offsets of the file wc opens for dest. If tee is non-nil, the file
+// is read back into it once complete, before it is committed.
+func (g *Getter) fetchAt(ctx context.Context, s download.WriterAtStrategy, wc consumer.WriterAtConsumer, url string, dest string, tee io.Writer, tracker *progressTracker) (int64, error) {
+	var file consumer.OffsetFile
+	fileSize, err := s.FetchAt(ctx, url, func(fileSize int64) (io.WriterAt, error) {
+		var err error
+		if file, err = wc.ConsumeAt(dest, fileSize); err != nil {
+			return nil, fmt.Errorf("error writing file: %w", err)
+		}
+		return tracker.writerAt(file, fileSize), nil
+	})
+	if err != nil {
+		if file != nil {
+			file.Abort()
+		}
+		return fileSize, err
+	}
+	if tee != nil {
+		if _, err := io.Copy(tee, io.NewSectionReader(file, 0, fileSize)); err != nil {
+			file.Abort()
+			return fileSize, fmt.Errorf("error reading back file: %w", err)
+		}
+	}
+	if err := file.Commit(); err != nil {
+		return fileSize, fmt.Errorf("error writing file: %w", err)
+	}
+	return fileSize, nil
+}
+
+// compressionRatio returns how many times larger a file of compressed bytes is once decompressed.
+func compressionRatio(decompressed, compressed int64) float64 {
+	if compressed == 0 {
+		return 0
+	}
+	return float64(decompressed) / float64(compressed)
 }
 
 func (g *Getter) DownloadFiles(ctx context.Context, manifest Manifest) (int64, time.Duration, error) {
 	if g.Consumer == nil {
-		g.Consumer = &consumer.FileWriter{}
+		g.Consumer = defaultConsumer(g.Options)
 	}
 
+	manifest, states, err := orderByDependencies(g.schedule(ctx, manifest))
+	if err != nil {
+		return 0, 0, fmt.Errorf("error ordering manifest: %w", err)
+	}
+	multifileDownloadStart := time.Now()
+	var totalSize int64
+	interval := g.Options.WaitInterval
+	if interval <= 0 {
+		interval = defaultWaitInterval
+	}
+	for pass := 0; ; pass++ {
+		retriesLeft := pass < g.Options.ManifestRetries
+		run := &multifileRun{states: states, continueOnError: g.Options.ContinueOnError || retriesLeft, lastPass: !retriesLeft}
+		if err := g.downloadPass(ctx, manifest, run); err != nil {
+			return 0, 0, err
+		}
+		totalSize += run.totalSize.Load()
+		if !retriesLeft || len(run.failedEntries) == 0 {
+			return totalSize, time.Since(multifileDownloadStart), run.err()
+		}
+
+		logger := logging.GetLogger()
+		logger.Warn().
+			Int("failed_count", len(run.failedEntries)).
+			Int("retry", pass+1).
+			Str("retry_in", interval.String()).
+			Msg("Retrying Failed Files")
+		select {
+		case <-ctx.Done():
+			return 0, 0, fmt.Errorf("error downloading files: %w", errors.Join(ctx.Err(), run.err()))
+		case <-time.After(interval):
+		}
+		interval = min(2*interval, maxWaitInterval)
+		// the failed entries keep their order, so the dependencies between them still hold
+		manifest, states = retryManifest(run.failedEntries, manifest)
+	}
+}
+
+// downloadPass downloads the entries of manifest, ordered by their dependencies, whose states are those of run.
+func (g *Getter) downloadPass(ctx context.Context, manifest Manifest, run *multifileRun) error {
 	errGroup, ctx := errgroup.WithContext(ctx)
+	ctx = withExtractWorkers(ctx, newExtractWorkers(g.Options.MaxConcurrentExtracts))
 
 	if g.Options.MaxConcurrentFiles != 0 {
 		errGroup.SetLimit(g.Options.MaxConcurrentFiles)
 	}
+	if g.Batcher != nil {
+		manifest = g.queueBatches(ctx, errGroup, manifest, run)
+	}
+	if err := g.downloadFilesFromManifest(ctx, errGroup, manifest, run); err != nil {
+		return fmt.Errorf("error initiating download of files from manifest: %w", err)
+	}
+	if err := errGroup.Wait(); err != nil {
+		return fmt.Errorf("error downloading files: %w", err)
+	}
+	return nil
+}
 
-	totalSize := new(atomic.Int64)
-	multifileDownloadStart := time.Now()
-
-	err := g.downloadFilesFromManifest(ctx, errGroup, manifest, totalSize)
-	if err != nil {
-		return 0, 0, fmt.Errorf("error initiating download of files from manifest: %w", err)
+// retryManifest returns the entries of ordered, a manifest ordered by dependencies, which are in failed, in the
+// same order, along with their states. Dependencies on entries which succeeded are dropped.
+func retryManifest(failed []ManifestEntry, ordered Manifest) (Manifest, map[string]*entryState) {
+	retry := make(map[string]bool, len(failed))
+	for _, entry := range failed {
+		retry[entry.Dest] = true
 	}
-	err = errGroup.Wait()
-	if err != nil {
-		return 0, 0, fmt.Errorf("error downloading files: %w", err)
+	entries := make(Manifest, 0, len(failed))
+	states := make(map[string]*entryState)
+	for _, entry := range ordered {
+		if !retry[entry.Dest] {
+			continue
+		}
+		var after []string
+		for _, dest := range entry.After {
+			if retry[dest] {
+				after = append(after, dest)
+				if _, ok := states[dest]; !ok {
+					states[dest] = &entryState{done: make(chan struct{})}
+				}
+			}
+		}
+		entry.After = after
+		entries = append(entries, entry)
 	}
-	elapsedTime := time.Since(multifileDownloadStart)
-	return totalSize.Load(), elapsedTime, nil
+	return entries, states
 }
 
-func (g *Getter) downloadFilesFromManifest(ctx context.Context, eg *errgroup.Group, entries []ManifestEntry, totalSize *atomic.Int64) error {
+func (g *Getter) downloadFilesFromManifest(ctx context.Context, eg *errgroup.Group, entries []ManifestEntry, run *multifileRun) error {
 	logger := logging.GetLogger()
 
-	for _, entry := range entries {
-		// Avoid the `entry` loop variable being captured by the
-		// goroutine by creating new variables
-		url, dest := entry.URL, entry.Dest
-		logger.Debug().Str("url", url).Str("dest", dest).Msg("Queueing Download")
+	if g.Options.MaxConcurrentFilesPerHost == 0 {
+		for _, entry := range entries {
+			logger.Debug().Str("url", entry.URL).Str("dest", entry.Dest).Msg("Queueing Download")
+
+			eg.Go(func() error {
+				return g.downloadAndMeasure(ctx, entry, run)
+			})
+		}
+		return nil
+	}
+
+	slots := newHostSlots(entries, g.Options.MaxConcurrentFilesPerHost, run.states)
+	for {
+		entry, ok, err := slots.next(ctx)
+		if err != nil {
+			// the entries left are not downloaded
+			eg.Go(func() error { return err })
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+		logger.Debug().Str("url", entry.URL).Str("dest", entry.Dest).Msg("Queueing Download")
 
 		eg.Go(func() error {
-			return g.downloadAndMeasure(ctx, url, dest, totalSize)
+			defer slots.release(entry)
+			return g.downloadAndMeasure(ctx, entry, run)
 		})
 	}
-	return nil
 }
 
-func (g *Getter) downloadAndMeasure(ctx context.Context, url, dest string, totalSize *atomic.Int64) error {
-	fileSize, _, err := g.DownloadFile(ctx, url, dest)
+func (g *Getter) downloadAndMeasure(ctx context.Context, entry ManifestEntry, run *multifileRun) error {
+	logger := logging.GetLogger()
+	if err := run.waitForDependencies(ctx, entry); err != nil {
+		run.finish(entry, err)
+		if !errors.Is(err, ErrDependencyFailed) {
+			return err
+		}
+		logger.Error().Err(err).Str("url", entry.URL).Str("dest", entry.Dest).Msg("Dependency Failed")
+		run.fail(entry, err)
+		if run.lastPass {
+			g.fileDone(ctx, entry, err)
+		}
+		return nil
+	}
+	if g.extractsWhileDownloading(entry) {
+		release, err := acquireExtractWorker(ctx)
+		if err != nil {
+			run.finish(entry, err)
+			return err
+		}
+		defer release()
+		// the entry's post actions extract with the worker it already holds
+		ctx = withExtractWorkers(ctx, nil)
+	}
+	fileSize, _, err := g.downloadEntry(ctx, entry)
+	run.finish(entry, err)
 	if err != nil {
+		return g.tolerate(ctx, run, entry, err)
+	}
+	run.totalSize.Add(fileSize)
+	g.fileDone(ctx, entry, nil)
+	return nil
+}
+
+// tolerate records err, the failure of entry, and returns nil if it fails only its own entry rather than the whole
+// run: if the file failed verification, or if the run continues on errors (see Options.ContinueOnError and
+// Options.ManifestRetries). Otherwise, or once ctx is done, it returns err.
+func (g *Getter) tolerate(ctx context.Context, run *multifileRun, entry ManifestEntry, err error) error {
+	logger := logging.GetLogger()
+	if run.lastPass {
+		g.fileDone(ctx, entry, err)
+	}
+	switch {
+	case errors.Is(err, ErrChecksumMismatch):
+		logger.Error().Err(err).Str("url", entry.URL).Str("dest", entry.Dest).Msg("Verification Failed")
+	case run.continueOnError && ctx.Err() == nil:
+		logger.Error().Err(err).Str("url", entry.URL).Str("dest", entry.Dest).Msg("Download Failed")
+	default:
 		return err
 	}
-	totalSize.Add(fileSize)
+	run.fail(entry, err)
 	return nil
 }
 
 func (g *Getter) sendMetrics(url string, size int64, throughput float64, err error) {
 	logger := logging.GetLogger()
-	endpoint := viper.GetString(config.OptMetricsEndpoint)
+	endpoint := g.Options.MetricsEndpoint
 	if endpoint == "" {
 		return
 	}
@@ -1,7 +1,14 @@
 package rpget_test
 
 import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"math/rand"
@@ -10,9 +17,15 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"testing/fstest"
 	"testing/iotest"
+	"time"
 
 	"github.com/dustin/go-humanize"
 	"github.com/rs/zerolog"
@@ -21,7 +34,9 @@ import (
 
 	rpget "github.com/emaballarin/rpget/pkg"
 	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/consumer"
 	"github.com/emaballarin/rpget/pkg/download"
+	"github.com/emaballarin/rpget/pkg/testserver"
 )
 
 var testFS = fstest.MapFS{
@@ -230,3 +245,1693 @@ func TestManifest_AddEntry(t *testing.T) {
 	assert.Equal(t, "/tmp/file2.txt", entries[1].Dest)
 
 }
+
+func TestDownloadFilesReport(t *testing.T) {
+	ts := httptest.NewServer(http.FileServer(http.FS(testFS)))
+	defer ts.Close()
+
+	outputDir, err := os.MkdirTemp("", "rpget-report-test")
+	require.NoError(t, err)
+	defer os.RemoveAll(outputDir)
+
+	manifest := make(rpget.Manifest, 0)
+	manifest = manifest.AddEntry(ts.URL+"/hello.txt", filepath.Join(outputDir, "hello.txt"))
+	manifest = manifest.AddEntry(ts.URL+"/missing.txt", filepath.Join(outputDir, "missing.txt"))
+
+	getter := makeGetter(defaultOpts)
+	// download sequentially so the failing entry doesn't cancel the successful one
+	getter.Options.MaxConcurrentFiles = 1
+	getter.Report = rpget.NewReport()
+
+	_, _, err = getter.DownloadFiles(context.Background(), manifest)
+	assert.Error(t, err)
+
+	results := make(map[string]rpget.FileResult)
+	for _, result := range getter.Report.Files() {
+		results[result.URL] = result
+	}
+	require.Len(t, results, 2)
+
+	hello := results[ts.URL+"/hello.txt"]
+	assert.Empty(t, hello.Error)
+	assert.Equal(t, int64(len(testFS["hello.txt"].Data)), hello.Size)
+	assert.Equal(t, "sha256:68e656b251e67e8358bef8483ab0d51c6619f3e7a1a9f0e75838d41ff368f728", hello.Checksum)
+
+	missing := results[ts.URL+"/missing.txt"]
+	assert.NotEmpty(t, missing.Error)
+	assert.Empty(t, missing.Checksum)
+
+	var out bytes.Buffer
+	require.NoError(t, getter.Report.WriteJSON(&out))
+	var decoded map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.EqualValues(t, 2, decoded["file_count"])
+	assert.EqualValues(t, 1, decoded["failed_count"])
+
+	if runtime.GOOS == "linux" || runtime.GOOS == "darwin" {
+		resources, ok := decoded["resources"].(map[string]any)
+		require.True(t, ok)
+		assert.Greater(t, resources["peak_rss_bytes"], float64(0))
+		assert.GreaterOrEqual(t, resources["user_cpu_seconds"], float64(0))
+		usage, ok := getter.Report.Resources()
+		require.True(t, ok)
+		assert.GreaterOrEqual(t, usage.VoluntaryContextSwitches, int64(0))
+	} else {
+		assert.NotContains(t, decoded, "resources")
+	}
+}
+
+func TestDownloadFilesReportDecompressed(t *testing.T) {
+	var archive bytes.Buffer
+	zw := gzip.NewWriter(&archive)
+	tw := tar.NewWriter(zw)
+	data := bytes.Repeat([]byte("compressible "), 10000)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "data.txt", Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	require.NoError(t, zw.Close())
+	ts := httptest.NewServer(http.FileServer(http.FS(fstest.MapFS{"data.tar.gz": {Data: archive.Bytes()}})))
+	defer ts.Close()
+
+	getter := makeGetter(defaultOpts)
+	getter.Report = rpget.NewReport()
+	_, _, err = getter.DownloadFiles(context.Background(), rpget.Manifest{
+		{URL: ts.URL + "/data.tar.gz", Dest: filepath.Join(t.TempDir(), "data"), Consumer: &consumer.TarExtractor{}},
+	})
+	require.NoError(t, err)
+
+	results := getter.Report.Files()
+	require.Len(t, results, 1)
+	assert.Equal(t, int64(archive.Len()), results[0].Size)
+	// the tar stream: a header block, the data padded to a block, and two zero blocks
+	assert.Equal(t, int64(512+len(data)+(512-len(data)%512)+1024), results[0].DecompressedSize)
+	assert.InDelta(t, float64(results[0].DecompressedSize)/float64(archive.Len()), results[0].CompressionRatio, 0.001)
+
+	var out bytes.Buffer
+	require.NoError(t, getter.Report.WriteJSON(&out))
+	var decoded map[string]any
+	require.NoError(t, json.Unmarshal(out.Bytes(), &decoded))
+	assert.EqualValues(t, results[0].DecompressedSize, decoded["total_decompressed_bytes"])
+}
+
+// batchOrigin serves testFS-style files individually and through a batch endpoint. The batch endpoint omits
+// files listed in skip, which the Getter must then fetch individually.
+func batchOrigin(t *testing.T, files fstest.MapFS, skip string, batchRequests *atomic.Int32) *httptest.Server {
+	fileServer := http.FileServer(http.FS(files))
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodOptions:
+			w.Header().Set(download.BatchEndpointHeader, "/_batch")
+		case r.Method == http.MethodPost && r.URL.Path == "/_batch":
+			batchRequests.Add(1)
+			var req download.BatchRequest
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			tw := tar.NewWriter(w)
+			for _, path := range req.Paths {
+				name := strings.TrimPrefix(path, "/")
+				if name == skip {
+					continue
+				}
+				data := files[name].Data
+				require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+				_, err := tw.Write(data)
+				require.NoError(t, err)
+			}
+			require.NoError(t, tw.Close())
+		default:
+			fileServer.ServeHTTP(w, r)
+		}
+	}))
+}
+
+func TestDownloadFilesBatch(t *testing.T) {
+	files := fstest.MapFS{
+		"a.txt": {Data: []byte("aaaa")},
+		"b.txt": {Data: []byte("bbbbbbbb")},
+		"c.txt": {Data: []byte("cc")},
+	}
+	batchRequests := new(atomic.Int32)
+	ts := batchOrigin(t, files, "c.txt", batchRequests)
+	defer ts.Close()
+
+	outputDir := t.TempDir()
+	manifest := make(rpget.Manifest, 0)
+	for _, name := range []string{"a.txt", "b.txt", "c.txt"} {
+		manifest = manifest.AddEntry(ts.URL+"/"+name, filepath.Join(outputDir, name))
+	}
+
+	getter := makeGetter(defaultOpts)
+	getter.Batcher = download.GetBatchMode(defaultOpts)
+	totalSize, _, err := getter.DownloadFiles(context.Background(), manifest)
+	require.NoError(t, err)
+
+	assert.Equal(t, int64(14), totalSize)
+	assert.Equal(t, int32(1), batchRequests.Load())
+	for name, file := range files {
+		assertFileHasContent(t, file.Data, filepath.Join(outputDir, name))
+	}
+
+	// files checked individually aren't batched
+	getter = makeGetter(defaultOpts)
+	getter.Batcher = download.GetBatchMode(defaultOpts)
+	getter.Options.Idempotent = true
+	_, _, err = getter.DownloadFiles(context.Background(), manifest)
+	require.NoError(t, err)
+	assert.Equal(t, int32(1), batchRequests.Load())
+}
+
+func TestDownloadFilesBatchQuery(t *testing.T) {
+	// a batch origin serving the version of a file given by its query
+	var batchPaths []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.Method == http.MethodOptions:
+			w.Header().Set(download.BatchEndpointHeader, "/_batch")
+		case r.Method == http.MethodPost:
+			var req download.BatchRequest
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			batchPaths = req.Paths
+			tw := tar.NewWriter(w)
+			for _, path := range req.Paths {
+				data := []byte(path)
+				require.NoError(t, tw.WriteHeader(&tar.Header{Name: strings.TrimPrefix(path, "/"), Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+				_, err := tw.Write(data)
+				require.NoError(t, err)
+			}
+			require.NoError(t, tw.Close())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	outputDir := t.TempDir()
+	manifest := rpget.Manifest{
+		{URL: ts.URL + "/a.txt?v=1", Dest: filepath.Join(outputDir, "a1.txt")},
+		{URL: ts.URL + "/a.txt?v=2", Dest: filepath.Join(outputDir, "a2.txt")},
+	}
+	getter := makeGetter(defaultOpts)
+	getter.Batcher = download.GetBatchMode(defaultOpts)
+	_, _, err := getter.DownloadFiles(context.Background(), manifest)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a.txt?v=1", "/a.txt?v=2"}, batchPaths)
+	assertFileHasContent(t, []byte("/a.txt?v=1"), filepath.Join(outputDir, "a1.txt"))
+	assertFileHasContent(t, []byte("/a.txt?v=2"), filepath.Join(outputDir, "a2.txt"))
+}
+
+func TestDownloadFilesChecksum(t *testing.T) {
+	ts := httptest.NewServer(http.FileServer(http.FS(testFS)))
+	defer ts.Close()
+
+	outputDir := t.TempDir()
+	good := filepath.Join(outputDir, "good.txt")
+	badDigest := filepath.Join(outputDir, "bad-digest.txt")
+	badSize := filepath.Join(outputDir, "bad-size.txt")
+	manifest := rpget.Manifest{
+		{URL: ts.URL + "/hello.txt", Dest: good, Checksum: "sha256:68e656b251e67e8358bef8483ab0d51c6619f3e7a1a9f0e75838d41ff368f728"},
+		{URL: ts.URL + "/hello.txt", Dest: badDigest, Checksum: "sha256:0000000000000000000000000000000000000000000000000000000000000000"},
+		{URL: ts.URL + "/hello.txt", Dest: badSize, Checksum: "size=5"},
+	}
+
+	getter := makeGetter(defaultOpts)
+	getter.Report = rpget.NewReport()
+	totalSize, _, err := getter.DownloadFiles(context.Background(), manifest)
+	require.ErrorIs(t, err, rpget.ErrChecksumMismatch)
+	assert.Equal(t, int64(len(testFS["hello.txt"].Data)), totalSize)
+
+	// the verified entry completes, the others fail individually and are removed
+	assertFileHasContent(t, testFS["hello.txt"].Data, good)
+	assert.NoFileExists(t, badDigest)
+	assert.NoFileExists(t, badSize)
+
+	failed := 0
+	for _, result := range getter.Report.Files() {
+		if result.Error != "" {
+			failed++
+		}
+	}
+	assert.Equal(t, 2, failed)
+}
+
+func TestDownloadFilesContinueOnError(t *testing.T) {
+	ts := httptest.NewServer(http.FileServer(http.FS(testFS)))
+	defer ts.Close()
+
+	outputDir := t.TempDir()
+	manifest := rpget.Manifest{
+		{URL: ts.URL + "/missing.txt", Dest: filepath.Join(outputDir, "missing.txt")},
+		{URL: ts.URL + "/hello.txt", Dest: filepath.Join(outputDir, "a.txt")},
+		{URL: ts.URL + "/hello.txt", Dest: filepath.Join(outputDir, "b.txt"), After: []string{filepath.Join(outputDir, "missing.txt")}},
+		{URL: ts.URL + "/hello.txt", Dest: filepath.Join(outputDir, "c.txt")},
+	}
+
+	getter := makeGetter(defaultOpts)
+	getter.Options.ContinueOnError = true
+	totalSize, _, err := getter.DownloadFiles(context.Background(), manifest)
+	require.ErrorIs(t, err, download.ErrUnexpectedHTTPStatus)
+	require.ErrorIs(t, err, rpget.ErrDependencyFailed)
+	assert.ErrorContains(t, err, "2 file(s) failed")
+	assert.ErrorContains(t, err, ts.URL+"/missing.txt: ")
+	assert.Equal(t, 2*int64(len(testFS["hello.txt"].Data)), totalSize)
+
+	// the files after the missing one are still downloaded
+	assertFileHasContent(t, testFS["hello.txt"].Data, filepath.Join(outputDir, "a.txt"))
+	assertFileHasContent(t, testFS["hello.txt"].Data, filepath.Join(outputDir, "c.txt"))
+	assert.NoFileExists(t, filepath.Join(outputDir, "b.txt"))
+}
+
+// chunkFailingServer serves content at every path, except that the second chunk of chunkSize bytes is not found for
+// the paths failing returns true for.
+func chunkFailingServer(content []byte, chunkSize int, failing func(path string) bool) *httptest.Server {
+	secondChunk := fmt.Sprintf("bytes=%d-%d", chunkSize, 2*chunkSize-1)
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == secondChunk && failing(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+}
+
+// downloadFilesWithin downloads manifest with getter within timeout, failing the test if DownloadFiles doesn't
+// return soon after its context is done.
+func downloadFilesWithin(t *testing.T, getter *rpget.Getter, manifest rpget.Manifest, timeout time.Duration) (int64, error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	type result struct {
+		size int64
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		size, _, err := getter.DownloadFiles(ctx, manifest)
+		done <- result{size, err}
+	}()
+	select {
+	case r := <-done:
+		return r.size, r.err
+	case <-time.After(timeout + 5*time.Second):
+		t.Fatal("DownloadFiles didn't return")
+		return 0, nil
+	}
+}
+
+func TestDownloadFilesContinueOnErrorMidFile(t *testing.T) {
+	content := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(content)
+	ts := chunkFailingServer(content, 100, func(path string) bool { return path != "/good.bin" })
+	defer ts.Close()
+
+	// the chunks of a failed file fetched after its failure are never read: they must not keep the workers and
+	// buffers the next files need
+	getter, err := rpget.New(
+		rpget.WithConcurrency(2),
+		rpget.WithChunkSize(100),
+		rpget.WithRetries(0),
+		rpget.WithContinueOnError(true),
+		rpget.WithMaxConcurrentFiles(1),
+	)
+	require.NoError(t, err)
+	outputDir := t.TempDir()
+	manifest := rpget.Manifest{
+		{URL: ts.URL + "/bad1.bin", Dest: filepath.Join(outputDir, "bad1.bin")},
+		{URL: ts.URL + "/bad2.bin", Dest: filepath.Join(outputDir, "bad2.bin")},
+		{URL: ts.URL + "/good.bin", Dest: filepath.Join(outputDir, "good.bin")},
+	}
+	totalSize, err := downloadFilesWithin(t, getter, manifest, 10*time.Second)
+	require.ErrorIs(t, err, download.ErrUnexpectedHTTPStatus)
+	assert.ErrorContains(t, err, "2 file(s) failed")
+	assert.Equal(t, int64(len(content)), totalSize)
+	assertFileHasContent(t, content, filepath.Join(outputDir, "good.bin"))
+}
+
+func TestDownloadFilesManifestRetries(t *testing.T) {
+	var attempts atomic.Int32
+	fileServer := http.FileServer(http.FS(testFS))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/eventual.txt" {
+			// the file is only found on the third attempt
+			if attempts.Add(1) <= 2 {
+				http.NotFound(w, r)
+				return
+			}
+			r.URL.Path = "/hello.txt"
+		}
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	outputDir := t.TempDir()
+	eventual := filepath.Join(outputDir, "eventual.txt")
+	manifest := rpget.Manifest{
+		{URL: ts.URL + "/eventual.txt", Dest: eventual},
+		{URL: ts.URL + "/hello.txt", Dest: filepath.Join(outputDir, "after.txt"), After: []string{eventual}},
+		{URL: ts.URL + "/hello.txt", Dest: filepath.Join(outputDir, "hello.txt")},
+	}
+
+	getter := makeGetter(defaultOpts)
+	getter.Options.ManifestRetries = 1
+	getter.Options.WaitInterval = time.Millisecond
+	_, _, err := getter.DownloadFiles(context.Background(), manifest)
+	require.ErrorIs(t, err, download.ErrUnexpectedHTTPStatus)
+	assertFileHasContent(t, testFS["hello.txt"].Data, filepath.Join(outputDir, "hello.txt"))
+	assert.NoFileExists(t, eventual)
+	assert.Equal(t, int32(2), attempts.Load())
+
+	attempts.Store(0)
+	require.NoError(t, os.Remove(filepath.Join(outputDir, "hello.txt")))
+	getter.Options.ManifestRetries = 2
+	getter.Report = rpget.NewReport()
+	totalSize, _, err := getter.DownloadFiles(context.Background(), manifest)
+	require.NoError(t, err)
+	assert.Equal(t, 3*int64(len(testFS["hello.txt"].Data)), totalSize)
+	for _, entry := range manifest {
+		assertFileHasContent(t, testFS["hello.txt"].Data, entry.Dest)
+	}
+	// the results of the retried files replace their failures
+	results := getter.Report.Files()
+	assert.Len(t, results, 3)
+	for _, result := range results {
+		assert.Empty(t, result.Error)
+	}
+}
+
+func TestDownloadFilesManifestRetriesMidFile(t *testing.T) {
+	content := make([]byte, 1000)
+	rand.New(rand.NewSource(1)).Read(content)
+	var failures atomic.Int32
+	// the second chunk of the flaky file fails on the first pass only
+	ts := chunkFailingServer(content, 100, func(path string) bool {
+		return path == "/flaky.bin" && failures.Add(1) == 1
+	})
+	defer ts.Close()
+
+	getter, err := rpget.New(
+		rpget.WithConcurrency(2),
+		rpget.WithChunkSize(100),
+		rpget.WithRetries(0),
+		rpget.WithManifestRetries(1),
+		rpget.WithWaitInterval(time.Millisecond),
+		rpget.WithMaxConcurrentFiles(1),
+	)
+	require.NoError(t, err)
+	outputDir := t.TempDir()
+	manifest := rpget.Manifest{
+		{URL: ts.URL + "/flaky.bin", Dest: filepath.Join(outputDir, "flaky.bin")},
+		{URL: ts.URL + "/a.bin", Dest: filepath.Join(outputDir, "a.bin")},
+		{URL: ts.URL + "/b.bin", Dest: filepath.Join(outputDir, "b.bin")},
+	}
+	totalSize, err := downloadFilesWithin(t, getter, manifest, 10*time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, int32(2), failures.Load())
+	assert.Equal(t, 3*int64(len(content)), totalSize)
+	for _, entry := range manifest {
+		assertFileHasContent(t, content, entry.Dest)
+	}
+}
+
+func TestDownloadFilesHooks(t *testing.T) {
+	var attempts atomic.Int32
+	fileServer := http.FileServer(http.FS(testFS))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/missing.txt" {
+			attempts.Add(1)
+		}
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	outputDir := t.TempDir()
+	missing := filepath.Join(outputDir, "missing.txt")
+	manifest := rpget.Manifest{
+		{URL: ts.URL + "/missing.txt", Dest: missing},
+		{URL: ts.URL + "/hello.txt", Dest: filepath.Join(outputDir, "a.txt")},
+		{URL: ts.URL + "/hello.txt", Dest: filepath.Join(outputDir, "b.txt"), After: []string{missing}},
+	}
+
+	var mu sync.Mutex
+	completed := make(map[string]int)
+	failed := make(map[string]error)
+	getter := makeGetter(defaultOpts)
+	getter.Options.Hooks = rpget.Hooks{
+		OnComplete: func(_ context.Context, entry rpget.ManifestEntry) {
+			mu.Lock()
+			defer mu.Unlock()
+			completed[entry.Dest]++
+		},
+		OnError: func(_ context.Context, entry rpget.ManifestEntry, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			assert.NotContains(t, failed, entry.Dest)
+			failed[entry.Dest] = err
+		},
+	}
+	getter.Options.ContinueOnError = true
+	getter.Options.ManifestRetries = 1
+	getter.Options.WaitInterval = time.Millisecond
+	_, _, err := getter.DownloadFiles(context.Background(), manifest)
+	require.Error(t, err)
+	assert.Equal(t, int32(2), attempts.Load())
+
+	// the failures are only reported once no pass retries them
+	assert.Equal(t, map[string]int{filepath.Join(outputDir, "a.txt"): 1}, completed)
+	require.Len(t, failed, 2)
+	assert.ErrorIs(t, failed[missing], download.ErrUnexpectedHTTPStatus)
+	assert.ErrorIs(t, failed[filepath.Join(outputDir, "b.txt")], rpget.ErrDependencyFailed)
+}
+
+func TestDownloadGroup(t *testing.T) {
+	ts := httptest.NewServer(http.FileServer(http.FS(testFS)))
+	defer ts.Close()
+
+	outputDir := t.TempDir()
+	getter := makeGetter(defaultOpts)
+	// download sequentially so that the failure happens before the successful download starts
+	getter.Options.MaxConcurrentFiles = 1
+
+	group := getter.DownloadGroup(context.Background(), rpget.CollectErrors)
+	group.Go(ts.URL+"/missing.txt", filepath.Join(outputDir, "missing.txt"))
+	group.Go(ts.URL+"/hello.txt", filepath.Join(outputDir, "hello.txt"))
+	totalSize, _, err := group.Wait()
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missing.txt")
+	// with CollectErrors, the failure doesn't stop the remaining downloads
+	assert.Equal(t, int64(len(testFS["hello.txt"].Data)), totalSize)
+	assertFileHasContent(t, testFS["hello.txt"].Data, filepath.Join(outputDir, "hello.txt"))
+
+	group = getter.DownloadGroup(context.Background(), rpget.FailFast)
+	group.Go(ts.URL+"/missing.txt", filepath.Join(outputDir, "missing.txt"))
+	group.Go(ts.URL+"/hello.txt", filepath.Join(outputDir, "hello-again.txt"))
+	totalSize, _, err = group.Wait()
+	require.Error(t, err)
+	// with FailFast, the second download runs on a cancelled context
+	assert.Zero(t, totalSize)
+	assert.NoFileExists(t, filepath.Join(outputDir, "hello-again.txt"))
+}
+
+func TestDownloadFilesEntryOptions(t *testing.T) {
+	fileServer := http.FileServer(http.FS(testFS))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/private.txt" {
+			if r.Header.Get("Authorization") != "Bearer xyz" {
+				w.WriteHeader(http.StatusForbidden)
+				return
+			}
+			r.URL.Path = "/hello.txt"
+		}
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	outputDir := t.TempDir()
+	dest := filepath.Join(outputDir, "private.txt")
+	manifest := rpget.Manifest{
+		{URL: ts.URL + "/private.txt", Dest: dest, Headers: map[string]string{"Authorization": "Bearer xyz"}, Mode: 0600},
+	}
+
+	getter := makeGetter(defaultOpts)
+	_, _, err := getter.DownloadFiles(context.Background(), manifest)
+	require.NoError(t, err)
+	assertFileHasContent(t, testFS["hello.txt"].Data, dest)
+	info, err := os.Stat(dest)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	// without the header, the origin refuses the request
+	_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/private.txt", filepath.Join(outputDir, "refused.txt"))
+	assert.Error(t, err)
+}
+
+func TestDownloadFilesDependencies(t *testing.T) {
+	var indexDone atomic.Bool
+	fileServer := http.FileServer(http.FS(testFS))
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/index.txt" {
+			r.URL.Path = "/hello.txt"
+			fileServer.ServeHTTP(w, r)
+			indexDone.Store(true)
+			return
+		}
+		// files governed by the index must only be requested once the index has been fetched
+		assert.True(t, indexDone.Load(), "%s requested before its dependency", r.URL.Path)
+		fileServer.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	outputDir := t.TempDir()
+	index := filepath.Join(outputDir, "index.txt")
+	badIndex := filepath.Join(outputDir, "bad-index.txt")
+	manifest := rpget.Manifest{
+		{URL: ts.URL + "/hello.txt", Dest: filepath.Join(outputDir, "a.txt"), After: []string{index}},
+		{URL: ts.URL + "/hello.txt", Dest: filepath.Join(outputDir, "b.txt"), After: []string{badIndex}},
+		{URL: ts.URL + "/index.txt", Dest: index},
+		{URL: ts.URL + "/index.txt", Dest: badIndex, Checksum: "size=1", After: []string{index}},
+	}
+
+	getter := makeGetter(defaultOpts)
+	_, _, err := getter.DownloadFiles(context.Background(), manifest)
+	require.ErrorIs(t, err, rpget.ErrDependencyFailed)
+	require.ErrorIs(t, err, rpget.ErrChecksumMismatch)
+
+	assertFileHasContent(t, testFS["hello.txt"].Data, index)
+	assertFileHasContent(t, testFS["hello.txt"].Data, filepath.Join(outputDir, "a.txt"))
+	assert.NoFileExists(t, badIndex)
+	assert.NoFileExists(t, filepath.Join(outputDir, "b.txt"))
+}
+
+func TestDownloadFilesDependencyErrors(t *testing.T) {
+	getter := makeGetter(defaultOpts)
+	_, _, err := getter.DownloadFiles(context.Background(), rpget.Manifest{
+		{URL: "http://example.com/a", Dest: "a", After: []string{"missing"}},
+	})
+	assert.ErrorContains(t, err, "not in the manifest")
+
+	_, _, err = getter.DownloadFiles(context.Background(), rpget.Manifest{
+		{URL: "http://example.com/a", Dest: "a", After: []string{"b"}},
+		{URL: "http://example.com/b", Dest: "b", After: []string{"a"}},
+	})
+	assert.ErrorContains(t, err, "dependency cycle")
+}
+
+func TestDownloadFilesPostActions(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	data := testFS["hello.txt"].Data
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	files := fstest.MapFS{"hello.tar": {Data: archive.Bytes()}}
+	ts := httptest.NewServer(http.FileServer(http.FS(files)))
+	defer ts.Close()
+
+	outputDir := t.TempDir()
+	dest := filepath.Join(outputDir, "hello.tar")
+	extractAction, err := rpget.NewExtractAction("{{.Dir}}/unpacked", false)
+	require.NoError(t, err)
+	runAction, err := rpget.NewRunAction([]string{"sh", "-c", `echo "$RPGET_URL" > "$1"`, "sh", "{{.Dest}}.url"})
+	require.NoError(t, err)
+	manifest := rpget.Manifest{{
+		URL:  ts.URL + "/hello.tar",
+		Dest: dest,
+		Post: []rpget.PostAction{extractAction, &rpget.ChmodAction{Mode: 0600}, runAction},
+	}}
+
+	getter := makeGetter(defaultOpts)
+	_, _, err = getter.DownloadFiles(context.Background(), manifest)
+	require.NoError(t, err)
+	assertFileHasContent(t, data, filepath.Join(outputDir, "unpacked", "hello.txt"))
+	info, err := os.Stat(dest)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+	assertFileHasContent(t, []byte(ts.URL+"/hello.tar\n"), dest+".url")
+
+	failing, err := rpget.NewRunAction([]string{"false"})
+	require.NoError(t, err)
+	_, _, err = getter.DownloadFiles(context.Background(), rpget.Manifest{
+		{URL: ts.URL + "/hello.tar", Dest: filepath.Join(outputDir, "failing.tar"), Post: []rpget.PostAction{failing}},
+	})
+	assert.ErrorContains(t, err, "post action")
+}
+
+func TestDownloadFilesConsumerRoutes(t *testing.T) {
+	data := testFS["hello.txt"].Data
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	_, err = zw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, zw.Close())
+
+	files := map[string]struct {
+		contentType string
+		data        []byte
+	}{
+		"/model.tar":  {"application/x-tar", archive.Bytes()},
+		"/weights.gz": {"application/octet-stream", compressed.Bytes()},
+		"/hello.txt":  {"text/plain; charset=utf-8", data},
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		file, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", file.contentType)
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(file.data))
+	}))
+	defer ts.Close()
+
+	outputDir := t.TempDir()
+	manifest := rpget.Manifest{
+		{URL: ts.URL + "/model.tar", Dest: filepath.Join(outputDir, "model")},
+		{URL: ts.URL + "/weights.gz", Dest: filepath.Join(outputDir, "weights.bin")},
+		{URL: ts.URL + "/hello.txt", Dest: filepath.Join(outputDir, "hello.txt"), Mode: 0600},
+		// an entry's own consumer isn't routed
+		{URL: ts.URL + "/model.tar", Dest: filepath.Join(outputDir, "model.tar"), Consumer: &consumer.FileWriter{}},
+	}
+	getter := makeGetter(defaultOpts)
+	getter.Options.ConsumerRoutes = []rpget.ConsumerRoute{
+		{ContentType: "application/x-tar", Consumer: &consumer.TarExtractor{}},
+		{ContentType: "application/*", Format: "gzip", Consumer: &consumer.Decompressor{}},
+		// the Content-Type of the archive matches first
+		{Format: "tar", Consumer: &consumer.NullWriter{}},
+	}
+	_, _, err = getter.DownloadFiles(context.Background(), manifest)
+	require.NoError(t, err)
+	assertFileHasContent(t, data, filepath.Join(outputDir, "model", "hello.txt"))
+	assertFileHasContent(t, data, filepath.Join(outputDir, "weights.bin"))
+	assertFileHasContent(t, data, filepath.Join(outputDir, "hello.txt"))
+	assertFileHasContent(t, archive.Bytes(), filepath.Join(outputDir, "model.tar"))
+	// files routed to no other consumer are finished as files
+	info, err := os.Stat(filepath.Join(outputDir, "hello.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestDownloadFilesSharedExtractWorkers(t *testing.T) {
+	var archive bytes.Buffer
+	tw := tar.NewWriter(&archive)
+	data := testFS["hello.txt"].Data
+	require.NoError(t, tw.WriteHeader(&tar.Header{Name: "hello.txt", Mode: 0644, Size: int64(len(data)), Typeflag: tar.TypeReg}))
+	_, err := tw.Write(data)
+	require.NoError(t, err)
+	require.NoError(t, tw.Close())
+	files := fstest.MapFS{"hello.tar": {Data: archive.Bytes()}}
+	ts := httptest.NewServer(http.FileServer(http.FS(files)))
+	defer ts.Close()
+
+	outputDir := t.TempDir()
+	var manifest rpget.Manifest
+	for i := 0; i < 4; i++ {
+		extractAction, err := rpget.NewExtractAction(fmt.Sprintf("{{.Dir}}/post-%d", i), false)
+		require.NoError(t, err)
+		manifest = append(manifest,
+			// extracted while downloading, and downloaded then extracted by a post action
+			rpget.ManifestEntry{
+				URL:      ts.URL + "/hello.tar",
+				Dest:     filepath.Join(outputDir, fmt.Sprintf("stream-%d", i)),
+				Consumer: &consumer.TarExtractor{},
+			},
+			rpget.ManifestEntry{
+				URL:  ts.URL + "/hello.tar",
+				Dest: filepath.Join(outputDir, fmt.Sprintf("hello-%d.tar", i)),
+				Post: []rpget.PostAction{extractAction},
+			})
+	}
+
+	getter := makeGetter(defaultOpts)
+	getter.Options.MaxConcurrentExtracts = 1
+	_, _, err = getter.DownloadFiles(context.Background(), manifest)
+	require.NoError(t, err)
+	for i := 0; i < 4; i++ {
+		assertFileHasContent(t, data, filepath.Join(outputDir, fmt.Sprintf("stream-%d", i), "hello.txt"))
+		assertFileHasContent(t, data, filepath.Join(outputDir, fmt.Sprintf("post-%d", i), "hello.txt"))
+	}
+}
+
+func TestNew(t *testing.T) {
+	content := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(content)
+	var rangeRequests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("X-Token") != "xyz" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		if r.URL.Path == "/unavailable" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			rangeRequests.Add(1)
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	getter, err := rpget.New(
+		rpget.WithConcurrency(2),
+		rpget.WithChunkSize(1000),
+		rpget.WithHeaders(map[string]string{"X-Token": "xyz"}),
+		rpget.WithRetries(0),
+	)
+	require.NoError(t, err)
+	dest := filepath.Join(t.TempDir(), "file.bin")
+	size, _, err := getter.DownloadFile(context.Background(), ts.URL+"/file.bin", dest)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	assertFileHasContent(t, content, dest)
+	assert.Equal(t, int32(10), rangeRequests.Load())
+
+	// without retries, a failing request fails the download right away
+	start := time.Now()
+	_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/unavailable", filepath.Join(t.TempDir(), "unavailable"))
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), time.Second)
+
+	report := rpget.NewReport()
+	getter, err = rpget.New(
+		rpget.WithHeaders(map[string]string{"X-Token": "xyz"}),
+		rpget.WithConsumer(&consumer.NullWriter{}),
+		rpget.WithReport(report),
+	)
+	require.NoError(t, err)
+	nullDest := filepath.Join(t.TempDir(), "null")
+	_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/file.bin", nullDest)
+	require.NoError(t, err)
+	assert.NoFileExists(t, nullDest)
+	require.Len(t, report.Files(), 1)
+	assert.Equal(t, int64(len(content)), report.Files()[0].Size)
+
+	_, err = rpget.New(rpget.WithConcurrency(-1))
+	assert.Error(t, err)
+	_, err = rpget.New(rpget.WithConsumer(nil))
+	assert.Error(t, err)
+}
+
+func TestOnProgress(t *testing.T) {
+	content := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(content)
+	ts := testserver.New(map[string][]byte{"/file.bin": content})
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var chunks []download.Chunk
+	var consumed []int64
+	getter, err := rpget.New(rpget.WithChunkSize(1000), rpget.WithConcurrency(4))
+	require.NoError(t, err)
+	getter.OnProgress(func(event rpget.ProgressEvent) {
+		mu.Lock()
+		defer mu.Unlock()
+		assert.Equal(t, ts.URL+"/file.bin", event.URL)
+		assert.Equal(t, int64(len(content)), event.TotalBytes)
+		if event.Chunk != nil {
+			chunks = append(chunks, *event.Chunk)
+		} else {
+			consumed = append(consumed, event.BytesDone)
+		}
+	})
+
+	dest := filepath.Join(t.TempDir(), "file.bin")
+	_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/file.bin", dest)
+	require.NoError(t, err)
+	assertFileHasContent(t, content, dest)
+
+	slices.SortFunc(chunks, func(a, b download.Chunk) int { return int(a.Start - b.Start) })
+	require.Len(t, chunks, 10)
+	for i, chunk := range chunks {
+		assert.Equal(t, download.Chunk{Start: int64(i) * 1000, End: int64(i)*1000 + 999}, chunk)
+	}
+	require.NotEmpty(t, consumed)
+	assert.True(t, slices.IsSorted(consumed))
+	assert.Equal(t, int64(len(content)), consumed[len(consumed)-1])
+}
+
+func TestDownloadFileIdempotent(t *testing.T) {
+	content := testFS["hello.txt"].Data
+	var fullRequests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "bytes=0-0" {
+			fullRequests.Add(1)
+		}
+		http.ServeContent(w, r, "hello.txt", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+	dir := t.TempDir()
+
+	getter, err := rpget.New(rpget.WithIdempotent(true), rpget.WithRetries(0))
+	require.NoError(t, err)
+
+	// a destination of the size of the remote file is left alone
+	matching := filepath.Join(dir, "matching")
+	require.NoError(t, os.WriteFile(matching, content, 0644))
+	_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/hello.txt", matching)
+	require.NoError(t, err)
+	assert.Equal(t, int32(0), fullRequests.Load())
+
+	// a missing destination is downloaded
+	missing := filepath.Join(dir, "missing")
+	_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/hello.txt", missing)
+	require.NoError(t, err)
+	assertFileHasContent(t, content, missing)
+	assert.Equal(t, int32(1), fullRequests.Load())
+
+	// a destination which doesn't match fails, unless it is overwritten
+	different := filepath.Join(dir, "different")
+	require.NoError(t, os.WriteFile(different, []byte("different"), 0644))
+	_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/hello.txt", different)
+	assert.ErrorIs(t, err, rpget.ErrDestinationMismatch)
+	getter.Consumer = &consumer.FileWriter{Overwrite: true}
+	_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/hello.txt", different)
+	require.NoError(t, err)
+	assertFileHasContent(t, content, different)
+
+	// with a checksum, the destination is compared with it, without any request
+	requests := fullRequests.Load()
+	sameSize := bytes.Repeat([]byte("x"), len(content))
+	require.NoError(t, os.WriteFile(different, sameSize, 0644))
+	manifest := rpget.Manifest{{URL: ts.URL + "/hello.txt", Dest: matching, Checksum: "sha256:68e656b251e67e8358bef8483ab0d51c6619f3e7a1a9f0e75838d41ff368f728"}}
+	_, _, err = getter.DownloadFiles(context.Background(), manifest)
+	require.NoError(t, err)
+	assert.Equal(t, requests, fullRequests.Load())
+	getter.Consumer = &consumer.FileWriter{}
+	manifest[0].Dest = different
+	_, _, err = getter.DownloadFiles(context.Background(), manifest)
+	assert.ErrorIs(t, err, rpget.ErrDestinationMismatch)
+
+	// an extraction destination can't be compared
+	_, _, err = getter.DownloadFiles(context.Background(), rpget.Manifest{{URL: ts.URL + "/hello.txt", Dest: dir, Consumer: &consumer.TarExtractor{}}})
+	assert.ErrorContains(t, err, "already exists")
+}
+
+func TestDownloadFileSkipExisting(t *testing.T) {
+	type version struct {
+		content []byte
+		etag    string
+		modTime time.Time
+	}
+	first := version{testFS["hello.txt"].Data, `"hello"`, time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)}
+	second := version{[]byte("hi!"), `"hi"`, first.modTime.Add(time.Hour)}
+	var current atomic.Pointer[version]
+	var fullRequests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.Header.Get("Range") != "bytes=0-0" {
+			fullRequests.Add(1)
+		}
+		v := current.Load()
+		w.Header().Set("ETag", v.etag)
+		http.ServeContent(w, r, "hello.txt", v.modTime, bytes.NewReader(v.content))
+	}))
+	defer ts.Close()
+
+	for _, mode := range []rpget.SkipExisting{rpget.SkipExistingETag, rpget.SkipExistingMTime, rpget.SkipExistingSize} {
+		t.Run(string(mode), func(t *testing.T) {
+			current.Store(&first)
+			fullRequests.Store(0)
+			dest := filepath.Join(t.TempDir(), "hello.txt")
+			getter, err := rpget.New(rpget.WithSkipExisting(mode), rpget.WithRetries(0))
+			require.NoError(t, err)
+
+			// a missing destination is downloaded
+			_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/hello.txt", dest)
+			require.NoError(t, err)
+			assertFileHasContent(t, first.content, dest)
+			assert.Equal(t, int32(1), fullRequests.Load())
+
+			// and skipped while it is up to date
+			_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/hello.txt", dest)
+			require.NoError(t, err)
+			assert.Equal(t, int32(1), fullRequests.Load())
+
+			// until the remote file changes, replacing the longer destination
+			current.Store(&second)
+			_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/hello.txt", dest)
+			require.NoError(t, err)
+			assertFileHasContent(t, second.content, dest)
+			assert.Equal(t, int32(2), fullRequests.Load())
+		})
+	}
+
+	_, err := rpget.New(rpget.WithSkipExisting("checksum"))
+	assert.ErrorContains(t, err, "unknown skip-existing mode checksum")
+}
+
+func TestStatAll(t *testing.T) {
+	content := testFS["hello.txt"].Data
+	var fullRequests atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello.txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "bytes=0-0" {
+			fullRequests.Add(1)
+		}
+		w.Header().Set("ETag", `"hello"`)
+		http.ServeContent(w, r, "hello.txt", time.Time{}, bytes.NewReader(content))
+	})
+	mux.Handle("/moved.txt", http.RedirectHandler("/hello.txt", http.StatusFound))
+	mux.HandleFunc("/no-ranges.txt", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write(content)
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	getter, err := rpget.New(rpget.WithRetries(0))
+	require.NoError(t, err)
+
+	info, err := getter.Stat(context.Background(), ts.URL+"/moved.txt")
+	require.NoError(t, err)
+	assert.Equal(t, download.FileInfo{
+		URL:          ts.URL + "/hello.txt",
+		Size:         int64(len(content)),
+		ETag:         `"hello"`,
+		AcceptRanges: true,
+	}, info)
+
+	manifest := rpget.Manifest{}.
+		AddEntry(ts.URL+"/hello.txt", "hello").
+		AddEntry(ts.URL+"/missing.txt", "missing").
+		AddEntry(ts.URL+"/no-ranges.txt", "no-ranges")
+	infos, err := getter.StatAll(context.Background(), manifest)
+	assert.ErrorContains(t, err, "/missing.txt")
+	require.Len(t, infos, 3)
+	assert.Equal(t, int64(len(content)), infos[0].Size)
+	assert.Equal(t, download.FileInfo{}, infos[1])
+	assert.Equal(t, download.FileInfo{URL: ts.URL + "/no-ranges.txt", Size: int64(len(content))}, infos[2])
+	assert.Equal(t, int32(0), fullRequests.Load())
+}
+
+func TestPrefetch(t *testing.T) {
+	content := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(content)
+	var mu sync.Mutex
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		ranges = append(ranges, r.Header.Get("Range"))
+		mu.Unlock()
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+	requested := func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return slices.Clone(ranges)
+	}
+
+	getter, err := rpget.New(rpget.WithChunkSize(4000), rpget.WithRetries(0), rpget.WithPrefetchFirstChunks(true))
+	require.NoError(t, err)
+	getter.Prefetch(context.Background(), ts.URL+"/file.bin")
+	assert.Eventually(t, func() bool { return len(requested()) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// the download starts with the prefetched first chunk
+	dest := filepath.Join(t.TempDir(), "file.bin")
+	size, _, err := getter.DownloadFile(context.Background(), ts.URL+"/file.bin", dest)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	assertFileHasContent(t, content, dest)
+	assert.ElementsMatch(t, []string{"bytes=0-3999", "bytes=4000-7999", "bytes=8000-9999"}, requested())
+
+	// which is only used once
+	_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/file.bin", dest)
+	require.NoError(t, err)
+	assert.Len(t, requested(), 6)
+
+	// without PrefetchFirstChunks, only the first byte is requested
+	getter, err = rpget.New(rpget.WithRetries(0))
+	require.NoError(t, err)
+	getter.Prefetch(context.Background(), ts.URL+"/file.bin")
+	assert.Eventually(t, func() bool { return len(requested()) == 7 }, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, "bytes=0-0", requested()[6])
+}
+
+func TestWaitForFile(t *testing.T) {
+	content := testFS["hello.txt"].Data
+	var attempts atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/published.txt", func(w http.ResponseWriter, r *http.Request) {
+		// the file is published after a few attempts
+		if attempts.Add(1) <= 3 {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "published.txt", time.Time{}, bytes.NewReader(content))
+	})
+	mux.HandleFunc("/authenticated.txt", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "authenticated.txt", time.Time{}, bytes.NewReader(content))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	getter, err := rpget.New(rpget.WithRetries(0), rpget.WithWaitInterval(time.Millisecond))
+	require.NoError(t, err)
+	info, err := getter.WaitForFile(context.Background(), ts.URL+"/published.txt")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), info.Size)
+	assert.Equal(t, int32(4), attempts.Load())
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = getter.WaitForFile(ctx, ts.URL+"/missing.txt")
+	assert.ErrorIs(t, err, download.ErrUnexpectedHTTPStatus)
+	assert.ErrorContains(t, err, "gave up waiting")
+
+	// entries are waited for with their headers
+	err = getter.WaitForFiles(context.Background(), rpget.Manifest{
+		{URL: ts.URL + "/published.txt", Dest: "published.txt"},
+		{URL: ts.URL + "/authenticated.txt", Dest: "authenticated.txt", Headers: map[string]string{"Authorization": "Bearer token"}},
+	})
+	require.NoError(t, err)
+
+	_, err = rpget.New(rpget.WithWaitInterval(-time.Second))
+	assert.Error(t, err)
+}
+
+func TestDownloadEntryVersionMarker(t *testing.T) {
+	content := testFS["hello.txt"].Data
+	var version atomic.Value
+	version.Store("v1\n")
+	var fileRequests atomic.Int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/VERSION", func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "VERSION", time.Time{}, strings.NewReader(version.Load().(string)))
+	})
+	mux.HandleFunc("/hello.txt", func(w http.ResponseWriter, r *http.Request) {
+		fileRequests.Add(1)
+		http.ServeContent(w, r, "hello.txt", time.Time{}, bytes.NewReader(content))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	dest := filepath.Join(t.TempDir(), "hello.txt")
+	entry := rpget.ManifestEntry{URL: ts.URL + "/hello.txt", Dest: dest, VersionMarker: ts.URL + "/VERSION"}
+	getter, err := rpget.New(rpget.WithRetries(0), rpget.WithConsumer(&consumer.FileWriter{Overwrite: true}))
+	require.NoError(t, err)
+
+	_, _, err = getter.DownloadEntry(context.Background(), entry)
+	require.NoError(t, err)
+	assertFileHasContent(t, content, dest)
+	assertFileHasContent(t, []byte("v1\n"), dest+".marker")
+	requests := fileRequests.Load()
+
+	// an unchanged marker skips the download
+	size, _, err := getter.DownloadEntry(context.Background(), entry)
+	require.NoError(t, err)
+	assert.Zero(t, size)
+	assert.Equal(t, requests, fileRequests.Load())
+
+	// a changed marker downloads the file again, as does a missing destination
+	version.Store("v2")
+	_, _, err = getter.DownloadEntry(context.Background(), entry)
+	require.NoError(t, err)
+	assert.Greater(t, fileRequests.Load(), requests)
+	assertFileHasContent(t, []byte("v2\n"), dest+".marker")
+	requests = fileRequests.Load()
+	require.NoError(t, os.Remove(dest))
+	_, _, err = getter.DownloadEntry(context.Background(), entry)
+	require.NoError(t, err)
+	assert.Greater(t, fileRequests.Load(), requests)
+	assertFileHasContent(t, content, dest)
+
+	// the marker may be stored elsewhere
+	entry.VersionMarkerFile = filepath.Join(t.TempDir(), "hello.version")
+	_, _, err = getter.DownloadEntry(context.Background(), entry)
+	require.NoError(t, err)
+	assertFileHasContent(t, []byte("v2\n"), entry.VersionMarkerFile)
+
+	entry.VersionMarker = ts.URL + "/missing"
+	_, _, err = getter.DownloadEntry(context.Background(), entry)
+	assert.ErrorContains(t, err, "error fetching version marker")
+
+	// without Overwrite, the new version replaces a longer previous one entirely
+	dest = filepath.Join(t.TempDir(), "hello.txt")
+	require.NoError(t, os.WriteFile(dest, []byte("a much longer previous version of the file"), 0644))
+	entry = rpget.ManifestEntry{URL: ts.URL + "/hello.txt", Dest: dest, VersionMarker: ts.URL + "/VERSION"}
+	getter, err = rpget.New(rpget.WithRetries(0), rpget.WithConsumer(&consumer.FileWriter{}))
+	require.NoError(t, err)
+	_, _, err = getter.DownloadEntry(context.Background(), entry)
+	require.NoError(t, err)
+	assertFileHasContent(t, content, dest)
+}
+
+func TestDownloadFileWithMetadata(t *testing.T) {
+	content := testFS["hello.txt"].Data
+	lastModified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("ETag", `"v1"`)
+		w.Header().Set("X-Amz-Meta-Model", "llama")
+		http.ServeContent(w, r, "hello.txt", lastModified, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	getter, err := rpget.New(rpget.WithRetries(0))
+	require.NoError(t, err)
+	dest := filepath.Join(t.TempDir(), "hello.txt")
+	md, size, _, err := getter.DownloadFileWithMetadata(context.Background(), ts.URL+"/hello.txt", dest)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	assertFileHasContent(t, content, dest)
+	assert.Equal(t, download.Metadata{
+		ContentType:  "text/plain",
+		ETag:         `"v1"`,
+		LastModified: lastModified,
+		Custom:       http.Header{"X-Amz-Meta-Model": {"llama"}},
+	}, md)
+}
+
+func TestDownloadFileContentCache(t *testing.T) {
+	content := testFS["hello.txt"].Data
+	var etag atomic.Value
+	etag.Store(`"v1"`)
+	var gets atomic.Int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") != "bytes=0-0" {
+			gets.Add(1)
+		}
+		w.Header().Set("ETag", etag.Load().(string))
+		http.ServeContent(w, r, "hello.txt", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	cacheDir := t.TempDir()
+	getter, err := rpget.New(rpget.WithRetries(0), rpget.WithContentCache(cacheDir), rpget.WithReport(rpget.NewReport()))
+	require.NoError(t, err)
+	dir := t.TempDir()
+	first := filepath.Join(dir, "first.txt")
+	_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/hello.txt", first)
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), gets.Load())
+
+	// the same URL with the same ETag is linked from the cache
+	second := filepath.Join(dir, "second.txt")
+	size, _, err := getter.DownloadFile(context.Background(), ts.URL+"/hello.txt", second)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), size)
+	assert.Equal(t, int64(1), gets.Load())
+	assertFileHasContent(t, content, second)
+	firstInfo, err := os.Stat(first)
+	require.NoError(t, err)
+	secondInfo, err := os.Stat(second)
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(firstInfo, secondInfo))
+
+	// so is another URL with the content's checksum
+	sum := sha256.Sum256(content)
+	third := filepath.Join(dir, "third.txt")
+	_, _, err = getter.DownloadFiles(context.Background(), rpget.Manifest{
+		{URL: ts.URL + "/other.txt", Dest: third, Checksum: "sha256:" + hex.EncodeToString(sum[:])},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), gets.Load())
+	assertFileHasContent(t, content, third)
+
+	// a destination given a mode of its own isn't hardlinked, so the others keep theirs
+	executable := filepath.Join(dir, "executable.txt")
+	_, _, err = getter.DownloadFiles(context.Background(), rpget.Manifest{
+		{URL: ts.URL + "/hello.txt", Dest: executable, Mode: 0755},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), gets.Load())
+	assertFileHasContent(t, content, executable)
+	executableInfo, err := os.Stat(executable)
+	require.NoError(t, err)
+	assert.False(t, os.SameFile(firstInfo, executableInfo))
+	firstInfo, err = os.Stat(first)
+	require.NoError(t, err)
+	assert.Equal(t, os.FileMode(0644), firstInfo.Mode().Perm())
+
+	// a changed ETag is downloaded again
+	etag.Store(`"v2"`)
+	_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/hello.txt", filepath.Join(dir, "fourth.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, int64(2), gets.Load())
+
+	files := getter.Report.Files()
+	require.Len(t, files, 5)
+	assert.Equal(t, []bool{false, true, true, true, false}, []bool{files[0].Cached, files[1].Cached, files[2].Cached, files[3].Cached, files[4].Cached})
+	assert.Equal(t, "sha256:"+hex.EncodeToString(sum[:]), files[1].Checksum)
+}
+
+func TestDownloadFileSkipExistingContentCache(t *testing.T) {
+	content := testFS["hello.txt"].Data
+	modTime := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	var fullRequests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodGet && r.Header.Get("Range") != "bytes=0-0" {
+			fullRequests.Add(1)
+		}
+		w.Header().Set("ETag", `"hello"`)
+		http.ServeContent(w, r, "hello.txt", modTime, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	for _, mode := range []rpget.SkipExisting{rpget.SkipExistingETag, rpget.SkipExistingMTime} {
+		t.Run(string(mode), func(t *testing.T) {
+			fullRequests.Store(0)
+			getter, err := rpget.New(rpget.WithSkipExisting(mode), rpget.WithContentCache(t.TempDir()), rpget.WithRetries(0))
+			require.NoError(t, err)
+			dir := t.TempDir()
+			first := filepath.Join(dir, "first.txt")
+			second := filepath.Join(dir, "second.txt")
+			for _, dest := range []string{first, second} {
+				_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/hello.txt", dest)
+				require.NoError(t, err)
+			}
+			assert.Equal(t, int32(1), fullRequests.Load())
+			firstInfo, err := os.Stat(first)
+			require.NoError(t, err)
+			secondInfo, err := os.Stat(second)
+			require.NoError(t, err)
+			require.True(t, os.SameFile(firstInfo, secondInfo))
+
+			// the destinations share their inode with the cache object: recording the version of one of them
+			// mustn't change it for the others
+			assert.False(t, firstInfo.ModTime().Equal(modTime))
+			if mode == rpget.SkipExistingETag {
+				assert.FileExists(t, first+".etag")
+				assert.FileExists(t, second+".etag")
+			}
+
+			// their versions are recorded all the same
+			for _, dest := range []string{first, second} {
+				_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/hello.txt", dest)
+				require.NoError(t, err)
+			}
+			assert.Equal(t, int32(1), fullRequests.Load())
+		})
+	}
+}
+
+// xorReader de-obfuscates a body obfuscated by XOR with key.
+type xorReader struct {
+	r   io.Reader
+	key byte
+}
+
+func (x xorReader) Read(p []byte) (int, error) {
+	n, err := x.r.Read(p)
+	for i := range p[:n] {
+		p[i] ^= x.key
+	}
+	return n, err
+}
+
+func TestResponseMiddleware(t *testing.T) {
+	content := testFS["hello.txt"].Data
+	obfuscated := bytes.Clone(content)
+	for i := range obfuscated {
+		obfuscated[i] ^= 0x5a
+	}
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "hello.bin", time.Time{}, bytes.NewReader(obfuscated))
+	}))
+	defer ts.Close()
+
+	var audited atomic.Int64
+	deobfuscate := func(_ context.Context, body rpget.ResponseBody) (rpget.ResponseBody, error) {
+		body.Reader = xorReader{r: body.Reader, key: 0x5a}
+		return body, nil
+	}
+	audit := func(_ context.Context, body rpget.ResponseBody) (rpget.ResponseBody, error) {
+		body.Reader = io.TeeReader(body.Reader, writerFunc(func(p []byte) (int, error) {
+			audited.Add(int64(len(p)))
+			return len(p), nil
+		}))
+		return body, nil
+	}
+	getter, err := rpget.New(rpget.WithRetries(0), rpget.WithResponseMiddleware(deobfuscate, audit))
+	require.NoError(t, err)
+
+	// checksums are verified against the transformed body
+	sum := sha256.Sum256(content)
+	dest := filepath.Join(t.TempDir(), "hello.txt")
+	_, _, err = getter.DownloadFiles(context.Background(), rpget.Manifest{
+		{URL: ts.URL + "/hello.bin", Dest: dest, Checksum: "sha256:" + hex.EncodeToString(sum[:])},
+	})
+	require.NoError(t, err)
+	assertFileHasContent(t, content, dest)
+	assert.Equal(t, int64(len(content)), audited.Load())
+
+	getter.Use(func(_ context.Context, body rpget.ResponseBody) (rpget.ResponseBody, error) {
+		return body, errors.New("rejected")
+	})
+	_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/hello.bin", filepath.Join(t.TempDir(), "hello.txt"))
+	assert.ErrorContains(t, err, "rejected")
+
+	_, err = rpget.New(rpget.WithResponseMiddleware(nil))
+	assert.Error(t, err)
+}
+
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+func TestDownloadFileServerFaults(t *testing.T) {
+	content := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(content)
+	ts := testserver.New(map[string][]byte{"/file.bin": content},
+		// a chunk whose body ends early is resumed
+		testserver.OnRange(3000, testserver.Times(1, testserver.CloseAfter(500))),
+		// a failing chunk is retried
+		testserver.OnRange(5000, testserver.Times(1, testserver.Status(http.StatusServiceUnavailable))),
+		testserver.SlowBody(300, time.Millisecond),
+	)
+	defer ts.Close()
+
+	getter, err := rpget.New(rpget.WithChunkSize(1000), rpget.WithConcurrency(4))
+	require.NoError(t, err)
+	dest := filepath.Join(t.TempDir(), "file.bin")
+	_, _, err = getter.DownloadFile(context.Background(), ts.URL+"/file.bin", dest)
+	require.NoError(t, err)
+	assertFileHasContent(t, content, dest)
+}
+
+func TestDownloadFilesOffsetWrites(t *testing.T) {
+	content := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(content)
+	sum := sha256.Sum256(content)
+	ts := testserver.New(map[string][]byte{"/file.bin": content},
+		testserver.OnRange(3000, testserver.Times(1, testserver.CloseAfter(500))),
+		testserver.OnRange(0, testserver.SlowBody(1000, 20*time.Millisecond)),
+	)
+	defer ts.Close()
+
+	var mu sync.Mutex
+	var bytesDone int64
+	getter, err := rpget.New(
+		rpget.WithChunkSize(1000),
+		rpget.WithConcurrency(4),
+		rpget.WithOffsetWrites(true),
+		rpget.WithProgress(func(event rpget.ProgressEvent) {
+			// events of concurrent writes may arrive out of order
+			mu.Lock()
+			defer mu.Unlock()
+			bytesDone = max(bytesDone, event.BytesDone)
+		}),
+	)
+	require.NoError(t, err)
+	dir := t.TempDir()
+	good := filepath.Join(dir, "good.bin")
+	bad := filepath.Join(dir, "bad.bin")
+	_, _, err = getter.DownloadFiles(context.Background(), rpget.Manifest{
+		{URL: ts.URL + "/file.bin", Dest: good, Checksum: "sha256:" + hex.EncodeToString(sum[:])},
+	})
+	require.NoError(t, err)
+	assertFileHasContent(t, content, good)
+	assert.Equal(t, int64(len(content)), bytesDone)
+
+	// files are verified by reading them back
+	_, _, err = getter.DownloadFiles(context.Background(), rpget.Manifest{
+		{URL: ts.URL + "/file.bin", Dest: bad, Checksum: "sha256:0000000000000000000000000000000000000000000000000000000000000000"},
+	})
+	require.ErrorIs(t, err, rpget.ErrChecksumMismatch)
+	assert.NoFileExists(t, bad)
+}
+
+// offsetCountingWriter is a FileWriter counting the files it is handed to write by offset.
+type offsetCountingWriter struct {
+	consumer.FileWriter
+	offsetFiles atomic.Int32
+}
+
+func (w *offsetCountingWriter) ConsumeAt(destPath string, expectedBytes int64) (consumer.OffsetFile, error) {
+	w.offsetFiles.Add(1)
+	return w.FileWriter.ConsumeAt(destPath, expectedBytes)
+}
+
+func TestDownloadFilesOffsetWritesSmallFileMode(t *testing.T) {
+	large := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(large)
+	small := large[:500]
+	ts := testserver.New(map[string][]byte{"/small.bin": small, "/large.bin": large})
+	defer ts.Close()
+
+	writer := &offsetCountingWriter{}
+	getter, err := rpget.New(rpget.WithOffsetWrites(true), rpget.WithConsumer(writer))
+	require.NoError(t, err)
+	opts := download.Options{Client: client.Options{}, ChunkSize: 1000, MaxConcurrency: 4}
+	getter.Downloader = download.GetSmallFileMode(opts, opts.ChunkSize, download.GetBufferMode(opts))
+
+	dir := t.TempDir()
+	_, _, err = getter.DownloadFiles(context.Background(), rpget.Manifest{
+		{URL: ts.URL + "/small.bin", Dest: filepath.Join(dir, "small.bin")},
+		{URL: ts.URL + "/large.bin", Dest: filepath.Join(dir, "large.bin")},
+	})
+	require.NoError(t, err)
+	assertFileHasContent(t, small, filepath.Join(dir, "small.bin"))
+	assertFileHasContent(t, large, filepath.Join(dir, "large.bin"))
+	// small files and those handed off are both written by offset
+	assert.Equal(t, int32(2), writer.offsetFiles.Load())
+}
+
+func TestDownloadFilesSchedule(t *testing.T) {
+	files := map[string][]byte{
+		"/small":  bytes.Repeat([]byte("s"), 10),
+		"/medium": bytes.Repeat([]byte("m"), 1000),
+		"/large":  bytes.Repeat([]byte("l"), 5000),
+		"/urgent": bytes.Repeat([]byte("u"), 100),
+	}
+	var mu sync.Mutex
+	var order []string
+	handler := testserver.Handler(files)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Stat requests only ask for the first byte
+		if r.Header.Get("Range") != "bytes=0-0" {
+			mu.Lock()
+			order = append(order, r.URL.Path)
+			mu.Unlock()
+		}
+		handler.ServeHTTP(w, r)
+	}))
+	defer ts.Close()
+
+	for schedule, expected := range map[rpget.Schedule][]string{
+		rpget.ScheduleManifest:      {"/urgent", "/small", "/large", "/medium", "/missing"},
+		rpget.ScheduleLargestFirst:  {"/urgent", "/large", "/medium", "/small", "/missing"},
+		rpget.ScheduleSmallestFirst: {"/urgent", "/small", "/medium", "/large", "/missing"},
+	} {
+		t.Run(string(schedule), func(t *testing.T) {
+			order = nil
+			outputDir := t.TempDir()
+			getter, err := rpget.New(
+				rpget.WithDownloader(download.GetBufferMode(defaultOpts)),
+				rpget.WithMaxConcurrentFiles(1),
+				rpget.WithSchedule(schedule),
+			)
+			require.NoError(t, err)
+			manifest := rpget.Manifest{
+				{URL: ts.URL + "/small", Dest: filepath.Join(outputDir, "small")},
+				// the size of a size checksum is used without asking for it
+				{URL: ts.URL + "/large", Dest: filepath.Join(outputDir, "large"), Checksum: "size=5000"},
+				{URL: ts.URL + "/medium", Dest: filepath.Join(outputDir, "medium")},
+				{URL: ts.URL + "/urgent", Dest: filepath.Join(outputDir, "urgent"), Priority: 1},
+				// its size is unknown, and its failure stops the run
+				{URL: ts.URL + "/missing", Dest: filepath.Join(outputDir, "missing")},
+			}
+			_, _, err = getter.DownloadFiles(context.Background(), manifest)
+			require.Error(t, err)
+			assert.Equal(t, expected, order)
+			assert.Equal(t, ts.URL+"/small", manifest[0].URL, "the manifest isn't reordered")
+		})
+	}
+
+	_, err := rpget.New(rpget.WithSchedule("random"))
+	assert.ErrorContains(t, err, "unknown schedule")
+}
+
+func TestDownloadFilesPerHostLimit(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 1000)
+	handler := testserver.Handler(map[string][]byte{"/file": content})
+	var started, running, maxRunning atomic.Int32
+	busyServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		started.Add(1)
+		n := running.Add(1)
+		defer running.Add(-1)
+		for m := maxRunning.Load(); n > m && !maxRunning.CompareAndSwap(m, n); m = maxRunning.Load() {
+		}
+		time.Sleep(50 * time.Millisecond)
+		handler.ServeHTTP(w, r)
+	}))
+	defer busyServer.Close()
+	var busyStartedBeforeIdle atomic.Int32
+	idleServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		busyStartedBeforeIdle.Store(started.Load())
+		handler.ServeHTTP(w, r)
+	}))
+	defer idleServer.Close()
+
+	outputDir := t.TempDir()
+	var manifest rpget.Manifest
+	for i := range 6 {
+		manifest = manifest.AddEntry(busyServer.URL+"/file", filepath.Join(outputDir, fmt.Sprintf("busy-%d", i)))
+	}
+	manifest = manifest.AddEntry(idleServer.URL+"/file", filepath.Join(outputDir, "idle"))
+	getter, err := rpget.New(
+		rpget.WithDownloader(download.GetBufferMode(defaultOpts)),
+		rpget.WithMaxConcurrentFiles(3),
+		rpget.WithMaxConcurrentFilesPerHost(2),
+	)
+	require.NoError(t, err)
+	_, _, err = getter.DownloadFiles(context.Background(), manifest)
+	require.NoError(t, err)
+	for _, entry := range manifest {
+		assertFileHasContent(t, content, entry.Dest)
+	}
+	assert.Equal(t, int32(2), maxRunning.Load())
+	// the file of the idle host isn't left waiting behind those of the busy one, which only have two slots
+	assert.LessOrEqual(t, busyStartedBeforeIdle.Load(), int32(2))
+}
+
+// TestDownloadFilesPerHostLimitDependencies checks that entries waiting for their dependencies don't hold the slots
+// those need: with two files at once, X would otherwise wait for the slot of its host, held by Y, then for one of
+// the two files at once, held by D1 and D2 which wait for X.
+func TestDownloadFilesPerHostLimitDependencies(t *testing.T) {
+	content := []byte("content")
+	handler := testserver.Handler(map[string][]byte{"/file": content})
+	var servers [3]*httptest.Server
+	for i := range servers {
+		servers[i] = httptest.NewServer(handler)
+		defer servers[i].Close()
+	}
+	a, b, c := servers[0].URL+"/file", servers[1].URL+"/file", servers[2].URL+"/file"
+
+	outputDir := t.TempDir()
+	x := filepath.Join(outputDir, "x")
+	manifest := rpget.Manifest{
+		{URL: a, Dest: filepath.Join(outputDir, "y")},
+		{URL: a, Dest: x},
+		{URL: b, Dest: filepath.Join(outputDir, "d1"), After: []string{x}},
+		{URL: c, Dest: filepath.Join(outputDir, "d2"), After: []string{x}},
+	}
+	getter, err := rpget.New(
+		rpget.WithDownloader(download.GetBufferMode(defaultOpts)),
+		rpget.WithMaxConcurrentFiles(2),
+		rpget.WithMaxConcurrentFilesPerHost(1),
+	)
+	require.NoError(t, err)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	_, _, err = getter.DownloadFiles(ctx, manifest)
+	require.NoError(t, err)
+	for _, entry := range manifest {
+		assertFileHasContent(t, content, entry.Dest)
+	}
+}
+
+func TestSampleChunks(t *testing.T) {
+	chunks := rpget.SampleChunks(100*humanize.MiByte, humanize.MiByte, 5)
+	assert.Len(t, chunks, 5)
+	assert.True(t, slices.IsSorted(chunks))
+	// the same chunks are sampled every time, and larger samples include smaller ones
+	assert.Equal(t, chunks, rpget.SampleChunks(100*humanize.MiByte, humanize.MiByte, 5))
+	for _, chunk := range chunks {
+		assert.Contains(t, rpget.SampleChunks(100*humanize.MiByte, humanize.MiByte, 20), chunk)
+	}
+	// at least one chunk is sampled
+	assert.Len(t, rpget.SampleChunks(10, 1000, 1), 1)
+	assert.Equal(t, []int64{0, 1, 2}, rpget.SampleChunks(2500, 1000, 100))
+
+	_, err := rpget.ParseSampleRate("0%")
+	assert.Error(t, err)
+	rate, err := rpget.ParseSampleRate("2.5%")
+	require.NoError(t, err)
+	assert.Equal(t, 2.5, rate)
+}
+
+func TestSample(t *testing.T) {
+	content := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(content)
+	changed := bytes.Clone(content)
+	changed[9999]++
+	ts := testserver.New(map[string][]byte{"/file.bin": content, "/mirror.bin": content, "/changed.bin": changed, "/no-ranges.bin": content},
+		testserver.OnPath("/no-ranges.bin", testserver.IgnoreRange()))
+	defer ts.Close()
+
+	getter, err := rpget.New(rpget.WithRetries(0))
+	require.NoError(t, err)
+	sample, err := getter.Sample(context.Background(), ts.URL+"/file.bin", 1000, 30)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(content)), sample.Size)
+	require.Len(t, sample.Chunks, 3)
+	for i, chunk := range sample.Chunks {
+		assert.Equal(t, rpget.SampleChunks(10000, 1000, 30)[i], chunk.Index)
+		sum := sha256.Sum256(content[chunk.Start : chunk.End+1])
+		assert.Equal(t, hex.EncodeToString(sum[:]), chunk.SHA256)
+	}
+
+	mirror, err := getter.Sample(context.Background(), ts.URL+"/mirror.bin", 1000, 30)
+	require.NoError(t, err)
+	assert.NoError(t, sample.Match(mirror))
+
+	// the last chunk is only compared once it is sampled
+	all, err := getter.Sample(context.Background(), ts.URL+"/file.bin", 1000, 100)
+	require.NoError(t, err)
+	changedSample, err := getter.Sample(context.Background(), ts.URL+"/changed.bin", 1000, 100)
+	require.NoError(t, err)
+	assert.ErrorContains(t, all.Match(changedSample), "chunk 9 (bytes 9000-9999)")
+
+	_, err = getter.Sample(context.Background(), ts.URL+"/no-ranges.bin", 1000, 100)
+	assert.ErrorIs(t, err, download.ErrRangeNotSupported)
+}
+
+func TestVerifyFiles(t *testing.T) {
+	content := testFS["hello.txt"].Data
+	var etag atomic.Value
+	etag.Store(`"hello"`)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/hello.txt", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", etag.Load().(string))
+		http.ServeContent(w, r, "hello.txt", time.Time{}, bytes.NewReader(content))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	dir := t.TempDir()
+	write := func(name string, data []byte) string {
+		dest := filepath.Join(dir, name)
+		require.NoError(t, os.WriteFile(dest, data, 0644))
+		return dest
+	}
+	sum := sha256.Sum256(content)
+	checksum := "sha256:" + hex.EncodeToString(sum[:])
+	url := ts.URL + "/hello.txt"
+	// the ETag of a file downloaded with SkipExistingETag is recorded
+	downloaded := filepath.Join(dir, "downloaded.txt")
+	getter, err := rpget.New(rpget.WithSkipExisting(rpget.SkipExistingETag), rpget.WithRetries(0))
+	require.NoError(t, err)
+	_, _, err = getter.DownloadFile(context.Background(), url, downloaded)
+	require.NoError(t, err)
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "extracted"), 0755))
+
+	manifest := rpget.Manifest{
+		{URL: url, Dest: write("checksum.txt", content), Checksum: checksum},
+		{URL: url, Dest: write("corrupt.txt", bytes.ToUpper(content)), Checksum: checksum},
+		{URL: url, Dest: write("size.txt", content)},
+		{URL: url, Dest: write("short.txt", content[1:])},
+		{URL: url, Dest: filepath.Join(dir, "missing.txt")},
+		{URL: ts.URL + "/gone.txt", Dest: write("gone.txt", content)},
+		{URL: url, Dest: downloaded},
+		{URL: url, Dest: filepath.Join(dir, "extracted")},
+	}
+	getter, err = rpget.New(rpget.WithRetries(0), rpget.WithMaxConcurrentFiles(2))
+	require.NoError(t, err)
+	statuses := func(entries rpget.Manifest, results []rpget.VerifyResult) []rpget.VerifyStatus {
+		var statuses []rpget.VerifyStatus
+		for i, result := range results {
+			assert.Equal(t, entries[i].Dest, result.Dest)
+			statuses = append(statuses, result.Status)
+		}
+		return statuses
+	}
+	results, err := getter.VerifyFiles(context.Background(), manifest)
+	require.ErrorIs(t, err, rpget.ErrVerificationFailed)
+	assert.ErrorContains(t, err, "4 of 8 file(s)")
+	assert.Equal(t, []rpget.VerifyStatus{
+		rpget.VerifyOK, rpget.VerifyMismatch, rpget.VerifyOK, rpget.VerifyMismatch,
+		rpget.VerifyMissing, rpget.VerifyError, rpget.VerifyOK, rpget.VerifySkipped,
+	}, statuses(manifest, results))
+	assert.Contains(t, results[1].Detail, rpget.ErrChecksumMismatch.Error())
+	assert.Equal(t, "etag", results[6].Detail)
+
+	// a remote file replaced by another of the same size is only caught by its ETag
+	etag.Store(`"other"`)
+	results, err = getter.VerifyFiles(context.Background(), manifest[6:7])
+	require.ErrorIs(t, err, rpget.ErrVerificationFailed)
+	assert.Equal(t, []rpget.VerifyStatus{rpget.VerifyMismatch}, statuses(manifest[6:7], results))
+	assert.Contains(t, results[0].Detail, `"other"`)
+
+	results, err = getter.VerifyFiles(context.Background(), manifest[:1])
+	require.NoError(t, err)
+	assert.Equal(t, []rpget.VerifyStatus{rpget.VerifyOK}, statuses(manifest[:1], results))
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !darwin
+
+package rpget
+
+// resourceUsage is only supported on Linux and macOS.
+func resourceUsage() (ResourceUsage, bool) {
+	return ResourceUsage{}, false
+}
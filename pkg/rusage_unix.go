@@ -0,0 +1,32 @@
+//go:build linux || darwin
+
+package rpget
+
+import (
+	"runtime"
+	"syscall"
+)
+
+// resourceUsage returns the resources used by rpget so far, from getrusage(2).
+func resourceUsage() (ResourceUsage, bool) {
+	var usage syscall.Rusage
+	if err := syscall.Getrusage(syscall.RUSAGE_SELF, &usage); err != nil {
+		return ResourceUsage{}, false
+	}
+	// the peak RSS is in bytes on macOS, in KiB on Linux
+	maxRSS := int64(usage.Maxrss)
+	if runtime.GOOS == "linux" {
+		maxRSS *= 1024
+	}
+	return ResourceUsage{
+		UserCPUSeconds:             float64(usage.Utime.Nano()) / 1e9,
+		SystemCPUSeconds:           float64(usage.Stime.Nano()) / 1e9,
+		PeakRSSBytes:               maxRSS,
+		MinorPageFaults:            int64(usage.Minflt),
+		MajorPageFaults:            int64(usage.Majflt),
+		BlockInputs:                int64(usage.Inblock),
+		BlockOutputs:               int64(usage.Oublock),
+		VoluntaryContextSwitches:   int64(usage.Nvcsw),
+		InvoluntaryContextSwitches: int64(usage.Nivcsw),
+	}, true
+}
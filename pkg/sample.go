@@ -0,0 +1,157 @@
+package rpget
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/emaballarin/rpget/pkg/download"
+)
+
+// sampleConcurrency is the number of chunks Getter.Sample downloads at once.
+const sampleConcurrency = 8
+
+// A Sample is the digests of a subset of the chunks of a remote file, see Getter.Sample.
+type Sample struct {
+	URL       string         `json:"url"`
+	Size      int64          `json:"size"`
+	ETag      string         `json:"etag,omitempty"`
+	ChunkSize int64          `json:"chunk_size"`
+	Chunks    []SampledChunk `json:"chunks"`
+}
+
+// A SampledChunk is a chunk of a Sample and its SHA-256 checksum.
+type SampledChunk struct {
+	Index int64 `json:"index"`
+	// Start and End are the first and last byte of the chunk.
+	Start  int64  `json:"start"`
+	End    int64  `json:"end"`
+	SHA256 string `json:"sha256"`
+}
+
+// ParseSampleRate parses the percentage of chunks to sample, e.g. "5%" (the percent sign is optional).
+func ParseSampleRate(value string) (float64, error) {
+	percent, err := strconv.ParseFloat(strings.TrimSuffix(strings.TrimSpace(value), "%"), 64)
+	if err != nil || percent <= 0 || percent > 100 {
+		return 0, fmt.Errorf("invalid sample rate %s, expected a percentage between 0 and 100, e.g. 5%%", value)
+	}
+	return percent, nil
+}
+
+// SampleChunks returns the indexes, in order, of the chunks a sample of percent % of a file of size bytes in chunks
+// of chunkSize includes: at least one chunk, chosen pseudo-randomly. They only depend on size, chunkSize and percent,
+// so the samples of the same file from different mirrors cover the same chunks.
+func SampleChunks(size, chunkSize int64, percent float64) []int64 {
+	if size <= 0 || chunkSize <= 0 {
+		return nil
+	}
+	count := (size + chunkSize - 1) / chunkSize
+	n := max(1, min(count, int64(float64(count)*percent/100+0.5)))
+	type ranked struct {
+		index, rank int64
+	}
+	chunks := make([]ranked, count)
+	var key [24]byte
+	binary.BigEndian.PutUint64(key[0:], uint64(size))
+	binary.BigEndian.PutUint64(key[8:], uint64(chunkSize))
+	for i := range count {
+		binary.BigEndian.PutUint64(key[16:], uint64(i))
+		h := fnv.New64a()
+		_, _ = h.Write(key[:])
+		chunks[i] = ranked{index: i, rank: int64(h.Sum64() >> 1)}
+	}
+	slices.SortFunc(chunks, func(a, b ranked) int {
+		return cmp.Or(cmp.Compare(a.rank, b.rank), cmp.Compare(a.index, b.index))
+	})
+	indexes := make([]int64, n)
+	for i := range indexes {
+		indexes[i] = chunks[i].index
+	}
+	slices.Sort(indexes)
+	return indexes
+}
+
+// Sample downloads percent % of the chunks of chunkSize of the file at url, chosen by SampleChunks, and returns their
+// checksums, to spot-check a large file without downloading all of it. The chunks are requested with g.Downloader,
+// taking the same route as a download, and fail with download.ErrRangeNotSupported if the server ignores ranges.
+func (g *Getter) Sample(ctx context.Context, url string, chunkSize int64, percent float64) (Sample, error) {
+	if chunkSize <= 0 {
+		return Sample{}, fmt.Errorf("invalid chunk size %d", chunkSize)
+	}
+	info, err := g.Stat(ctx, url)
+	if err != nil {
+		return Sample{}, err
+	}
+	sample := Sample{URL: url, Size: info.Size, ETag: info.ETag, ChunkSize: chunkSize}
+	indexes := SampleChunks(info.Size, chunkSize, percent)
+	sample.Chunks = make([]SampledChunk, len(indexes))
+	group, ctx := errgroup.WithContext(ctx)
+	group.SetLimit(sampleConcurrency)
+	for i, index := range indexes {
+		chunk := &sample.Chunks[i]
+		chunk.Index = index
+		chunk.Start = index * chunkSize
+		chunk.End = min(chunk.Start+chunkSize, info.Size) - 1
+		group.Go(func() error {
+			digest, err := g.sampleChunk(ctx, url, chunk.Start, chunk.End, info.Size)
+			if err != nil {
+				return fmt.Errorf("chunk %d: %w", chunk.Index, err)
+			}
+			chunk.SHA256 = digest
+			return nil
+		})
+	}
+	if err := group.Wait(); err != nil {
+		return Sample{}, err
+	}
+	return sample, nil
+}
+
+// sampleChunk returns the hex SHA-256 checksum of the bytes from start to end of the file of size bytes at url.
+func (g *Getter) sampleChunk(ctx context.Context, url string, start, end, size int64) (string, error) {
+	resp, err := g.Downloader.DoRequest(ctx, start, end, url)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent && (start != 0 || end != size-1) {
+		return "", fmt.Errorf("%w: %s returned %s", download.ErrRangeNotSupported, url, resp.Status)
+	}
+	h := sha256.New()
+	n, err := io.Copy(h, io.LimitReader(resp.Body, end-start+1))
+	if err != nil {
+		return "", err
+	}
+	if n != end-start+1 {
+		return "", fmt.Errorf("%w: got %d bytes of %d", io.ErrUnexpectedEOF, n, end-start+1)
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// Match returns an error describing the first difference between the contents sampled by s and other, e.g. samples
+// of the same file from two mirrors, or nil if they match.
+func (s Sample) Match(other Sample) error {
+	if s.Size != other.Size {
+		return fmt.Errorf("%s is %d bytes, %s is %d bytes", s.URL, s.Size, other.URL, other.Size)
+	}
+	if s.ChunkSize != other.ChunkSize || len(s.Chunks) != len(other.Chunks) {
+		return fmt.Errorf("%s and %s were sampled differently", s.URL, other.URL)
+	}
+	for i, chunk := range s.Chunks {
+		if chunk != other.Chunks[i] {
+			return fmt.Errorf("chunk %d (bytes %d-%d) of %s differs from %s", chunk.Index, chunk.Start, chunk.End, other.URL, s.URL)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,27 @@
+// Package sandbox restricts what the rpget process may do once it has started, limiting the harm a flaw exploited
+// through untrusted input, such as a crafted archive, could do.
+package sandbox
+
+import (
+	"errors"
+)
+
+// ErrUnsupported is returned by Apply when the platform, the kernel or the build of rpget can't enforce a Policy.
+var ErrUnsupported = errors.New("sandboxing is not supported")
+
+// Policy is what a sandboxed process may still do.
+type Policy struct {
+	// Writable lists the paths beneath which files may be written, created, renamed and removed; the rest of the
+	// filesystem is read-only. A path which doesn't exist yet is allowed through its closest existing parent.
+	Writable []string
+}
+
+// Apply restricts the process to p, irreversibly, along with the processes it starts afterwards. On Linux, the
+// filesystem is restricted with Landlock, and system calls a downloader never needs (e.g. ptrace, mount, bpf and
+// module loading) fail with EPERM through a seccomp filter. Files already open, such as stdout, are unaffected.
+//
+// It returns an error wrapping ErrUnsupported, leaving the process unrestricted, on other platforms, on kernels
+// without Landlock, and in builds using cgo, whose threads can't all be restricted.
+func Apply(p Policy) error {
+	return apply(p)
+}
@@ -0,0 +1,74 @@
+package sandbox_test
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"syscall"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/sys/unix"
+
+	"github.com/emaballarin/rpget/pkg/sandbox"
+)
+
+// sandboxing can't be undone, so it is tested in a child process running TestApply with these set
+const (
+	writableEnv = "RPGET_TEST_SANDBOX_WRITABLE"
+	readOnlyEnv = "RPGET_TEST_SANDBOX_READONLY"
+)
+
+func TestApply(t *testing.T) {
+	if writable := os.Getenv(writableEnv); writable != "" {
+		sandboxed(writable, os.Getenv(readOnlyEnv))
+		return
+	}
+	writable := filepath.Join(t.TempDir(), "writable")
+	readOnly := t.TempDir()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestApply$")
+	cmd.Env = append(os.Environ(), writableEnv+"="+filepath.Join(writable, "not", "yet"), readOnlyEnv+"="+readOnly)
+	require.NoError(t, os.Mkdir(writable, 0755))
+	out, err := cmd.CombinedOutput()
+	require.NoError(t, err, string(out))
+	if string(out) == "unsupported\n" {
+		t.Skip("sandboxing is not supported by this kernel or build")
+	}
+	assert.Equal(t, "writable: ok\nread-only: permission denied\nunshare: operation not permitted\n", string(out))
+	assert.DirExists(t, filepath.Join(writable, "not", "yet"))
+}
+
+func sandboxed(writable, readOnly string) {
+	err := sandbox.Apply(sandbox.Policy{Writable: []string{writable}})
+	if errors.Is(err, sandbox.ErrUnsupported) {
+		fmt.Println("unsupported")
+		os.Exit(0)
+	}
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	report := func(name string, err error) {
+		var errno syscall.Errno
+		switch {
+		case err == nil:
+			fmt.Printf("%s: ok\n", name)
+		case errors.As(err, &errno):
+			fmt.Printf("%s: %s\n", name, errno)
+		default:
+			fmt.Printf("%s: %s\n", name, err)
+		}
+	}
+	err = os.MkdirAll(writable, 0755)
+	if err == nil {
+		err = os.WriteFile(filepath.Join(writable, "file"), []byte("ok"), 0644)
+	}
+	report("writable", err)
+	_, err = os.Create(filepath.Join(readOnly, "file"))
+	report("read-only", err)
+	report("unshare", unix.Unshare(unix.CLONE_NEWUTS))
+	os.Exit(0)
+}
@@ -0,0 +1,10 @@
+package sandbox
+
+import "golang.org/x/sys/unix"
+
+const (
+	auditArch  = unix.AUDIT_ARCH_AARCH64
+	syscallBit = 0
+)
+
+var deniedSyscalls = commonDeniedSyscalls
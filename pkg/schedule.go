@@ -0,0 +1,219 @@
+package rpget
+
+import (
+	"cmp"
+	"context"
+	"fmt"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// Schedule is the order in which DownloadFiles starts the entries of a manifest of equal Priority.
+type Schedule string
+
+const (
+	// ScheduleManifest starts entries in the order of the manifest.
+	ScheduleManifest Schedule = "manifest"
+	// ScheduleLargestFirst starts the largest files first, so that a huge file doesn't start last and hold up the
+	// end of the run.
+	ScheduleLargestFirst Schedule = "largest-first"
+	// ScheduleSmallestFirst starts the smallest files first, so that as many files as possible are ready early.
+	ScheduleSmallestFirst Schedule = "smallest-first"
+)
+
+// ParseSchedule returns the Schedule named s, ScheduleManifest if s is empty.
+func ParseSchedule(s string) (Schedule, error) {
+	switch schedule := Schedule(s); schedule {
+	case "":
+		return ScheduleManifest, nil
+	case ScheduleManifest, ScheduleLargestFirst, ScheduleSmallestFirst:
+		return schedule, nil
+	}
+	return "", fmt.Errorf("unknown schedule %s, expected %s, %s or %s", s, ScheduleManifest, ScheduleLargestFirst, ScheduleSmallestFirst)
+}
+
+// schedule returns entries in the order DownloadFiles starts them: by decreasing Priority and then as
+// Options.Schedule says. Sizes are taken from the size checksums of entries, or else asked for with Stat; entries
+// whose size is unknown are started after the others of their priority. entries isn't modified.
+func (g *Getter) schedule(ctx context.Context, entries []ManifestEntry) []ManifestEntry {
+	bySize := g.Options.Schedule == ScheduleLargestFirst || g.Options.Schedule == ScheduleSmallestFirst
+	prioritised := slices.ContainsFunc(entries, func(entry ManifestEntry) bool { return entry.Priority != 0 })
+	if !bySize && !prioritised {
+		return entries
+	}
+	var sizes []int64
+	if bySize {
+		sizes = g.entrySizes(ctx, entries)
+	}
+	order := make([]int, len(entries))
+	for i := range order {
+		order[i] = i
+	}
+	slices.SortStableFunc(order, func(a, b int) int {
+		if c := cmp.Compare(entries[b].Priority, entries[a].Priority); c != 0 || !bySize {
+			return c
+		}
+		sizeA, sizeB := sizes[a], sizes[b]
+		switch {
+		case sizeA < 0 && sizeB < 0:
+			return 0
+		case sizeA < 0:
+			return 1
+		case sizeB < 0:
+			return -1
+		case g.Options.Schedule == ScheduleLargestFirst:
+			return cmp.Compare(sizeB, sizeA)
+		default:
+			return cmp.Compare(sizeA, sizeB)
+		}
+	})
+	scheduled := make([]ManifestEntry, len(entries))
+	for i, j := range order {
+		scheduled[i] = entries[j]
+	}
+	return scheduled
+}
+
+// entrySizes returns the size of every entry, -1 if it isn't known.
+func (g *Getter) entrySizes(ctx context.Context, entries []ManifestEntry) []int64 {
+	logger := logging.GetLogger()
+	sizes := make([]int64, len(entries))
+	var unknown Manifest
+	var unknownIndices []int
+	for i, entry := range entries {
+		if size, ok := strings.CutPrefix(entry.Checksum, checksumSizePrefix); ok {
+			if n, err := strconv.ParseInt(size, 10, 64); err == nil {
+				sizes[i] = n
+				continue
+			}
+		}
+		unknown = append(unknown, entry)
+		unknownIndices = append(unknownIndices, i)
+	}
+	if len(unknown) == 0 {
+		return sizes
+	}
+	infos, err := g.StatAll(ctx, unknown)
+	if err != nil {
+		logger.Debug().Err(err).Msg("Error getting file sizes for scheduling")
+	}
+	for k, i := range unknownIndices {
+		sizes[i] = -1
+		if infos[k].URL != "" {
+			sizes[i] = infos[k].Size
+		}
+	}
+	return sizes
+}
+
+// hostSlots hands out the entries of a manifest in order, starting at most limit of them at once from each host:
+// when the host of the next entry is busy, the first entry of a host which isn't is started instead. Entries are
+// only handed out once the entries they depend on have finished, so that they don't hold a slot of their host, nor
+// one of Options.MaxConcurrentFiles, which those entries need.
+type hostSlots struct {
+	limit int
+	// states of the entries depended on, see multifileRun
+	states map[string]*entryState
+
+	mu   sync.Mutex
+	cond *sync.Cond
+	// pending entries by host, in order
+	pending map[string][]scheduledEntry
+	running map[string]int
+	left    int
+}
+
+type scheduledEntry struct {
+	ManifestEntry
+	position int
+}
+
+func newHostSlots(entries []ManifestEntry, limit int, states map[string]*entryState) *hostSlots {
+	s := &hostSlots{
+		limit:   limit,
+		states:  states,
+		pending: make(map[string][]scheduledEntry),
+		running: make(map[string]int),
+		left:    len(entries),
+	}
+	s.cond = sync.NewCond(&s.mu)
+	for i, entry := range entries {
+		host := entryHost(entry)
+		s.pending[host] = append(s.pending[host], scheduledEntry{ManifestEntry: entry, position: i})
+	}
+	return s
+}
+
+// next returns the next entry to start, taking a slot of its host, waiting for one to be released if every host
+// with entries left is busy or has none whose dependencies have finished. The entries depended on release their
+// slot once finished, which wakes it up. It returns false once every entry was returned, or the context's error if
+// ctx is done first.
+func (s *hostSlots) next(ctx context.Context) (ManifestEntry, bool, error) {
+	stop := context.AfterFunc(ctx, func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		s.cond.Broadcast()
+	})
+	defer stop()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for s.left > 0 {
+		if err := ctx.Err(); err != nil {
+			return ManifestEntry{}, false, err
+		}
+		next, index, found := "", 0, false
+		for host, entries := range s.pending {
+			if s.running[host] >= s.limit {
+				continue
+			}
+			i := slices.IndexFunc(entries, s.ready)
+			if i >= 0 && (!found || entries[i].position < s.pending[next][index].position) {
+				next, index, found = host, i, true
+			}
+		}
+		if !found {
+			s.cond.Wait()
+			continue
+		}
+		entry := s.pending[next][index]
+		s.pending[next] = slices.Delete(s.pending[next], index, index+1)
+		s.running[next]++
+		s.left--
+		return entry.ManifestEntry, true, nil
+	}
+	return ManifestEntry{}, false, nil
+}
+
+// ready reports whether the entries entry depends on have all finished, successfully or not.
+func (s *hostSlots) ready(entry scheduledEntry) bool {
+	for _, after := range entry.After {
+		select {
+		case <-s.states[after].done:
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// release releases the slot taken for entry.
+func (s *hostSlots) release(entry ManifestEntry) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.running[entryHost(entry)]--
+	s.cond.Broadcast()
+}
+
+// entryHost returns the host of the URL of entry, with its port.
+func entryHost(entry ManifestEntry) string {
+	u, err := url.Parse(entry.URL)
+	if err != nil {
+		return ""
+	}
+	return strings.ToLower(u.Host)
+}
@@ -0,0 +1,87 @@
+// Package scratch manages the scratch directory of an rpget process: a directory under the --tmp-dir holding its
+// temporary files, removed when the process exits. Directories left behind by processes which crashed are removed
+// by the next process using the same --tmp-dir.
+package scratch
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+const dirPrefix = "rpget-"
+
+var dir string
+
+// Init creates the scratch directory of this process under root, after removing the scratch directories of rpget
+// processes which are no longer running. If root is empty, there is no scratch directory and temporary files are
+// created next to their destination.
+func Init(root string) error {
+	if root == "" {
+		return nil
+	}
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return fmt.Errorf("error creating temporary directory %s: %w", root, err)
+	}
+	sweep(root)
+	var err error
+	if dir, err = os.MkdirTemp(root, dirPrefix+strconv.Itoa(os.Getpid())+"-*"); err != nil {
+		return fmt.Errorf("error creating scratch directory in %s: %w", root, err)
+	}
+	return nil
+}
+
+// Dir returns the scratch directory of this process, or "" if there is none.
+func Dir() string {
+	return dir
+}
+
+// Cleanup removes the scratch directory of this process and everything in it.
+func Cleanup() error {
+	if dir == "" {
+		return nil
+	}
+	err := os.RemoveAll(dir)
+	dir = ""
+	return err
+}
+
+// sweep removes the scratch directories under root whose process is gone.
+func sweep(root string) {
+	logger := logging.GetLogger()
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		logger.Warn().Err(err).Str("dir", root).Msg("Error listing stale scratch directories")
+		return
+	}
+	for _, entry := range entries {
+		pid, ok := scratchPID(entry.Name())
+		if !ok || !entry.IsDir() || ProcessAlive(pid) {
+			continue
+		}
+		path := filepath.Join(root, entry.Name())
+		if err := os.RemoveAll(path); err != nil {
+			logger.Warn().Err(err).Str("dir", path).Msg("Error removing stale scratch directory")
+			continue
+		}
+		logger.Info().Str("dir", path).Int("pid", pid).Msg("Removed stale scratch directory")
+	}
+}
+
+// scratchPID returns the PID of the process owning the scratch directory name, rpget-<pid>-<random>.
+func scratchPID(name string) (int, bool) {
+	rest, ok := strings.CutPrefix(name, dirPrefix)
+	if !ok {
+		return 0, false
+	}
+	pidString, _, ok := strings.Cut(rest, "-")
+	if !ok {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(pidString)
+	return pid, err == nil && pid > 0
+}
@@ -0,0 +1,39 @@
+package scratch_test
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/scratch"
+)
+
+func TestScratchDir(t *testing.T) {
+	root := filepath.Join(t.TempDir(), "tmp")
+	require.NoError(t, scratch.Init(""))
+	assert.Empty(t, scratch.Dir())
+
+	// a directory left by a process that is gone, one of a live process, and an unrelated one
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "rpget-999999999-abc"), 0755))
+	live := filepath.Join(root, "rpget-"+strconv.Itoa(os.Getppid())+"-abc")
+	require.NoError(t, os.MkdirAll(live, 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(root, "other"), 0755))
+
+	require.NoError(t, scratch.Init(root))
+	dir := scratch.Dir()
+	assert.Equal(t, root, filepath.Dir(dir))
+	assert.True(t, strings.HasPrefix(filepath.Base(dir), "rpget-"+strconv.Itoa(os.Getpid())+"-"))
+	assert.NoDirExists(t, filepath.Join(root, "rpget-999999999-abc"))
+	assert.DirExists(t, live)
+	assert.DirExists(t, filepath.Join(root, "other"))
+
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "file"), []byte("data"), 0644))
+	require.NoError(t, scratch.Cleanup())
+	assert.NoDirExists(t, dir)
+	assert.Empty(t, scratch.Dir())
+}
@@ -0,0 +1,321 @@
+// Package grpc exposes a Getter as a gRPC service (see download.proto) so that sidecar containers can request
+// downloads programmatically, with streaming progress updates, backpressure and cancellation.
+package grpc
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync/atomic"
+	"time"
+
+	grpclib "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/types/known/structpb"
+
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/download"
+	"github.com/emaballarin/rpget/pkg/extract"
+	"github.com/emaballarin/rpget/pkg/fsutil"
+	"github.com/emaballarin/rpget/pkg/logging"
+	"github.com/emaballarin/rpget/pkg/scratch"
+)
+
+const (
+	ServiceName        = "rpget.v1.DownloadService"
+	DownloadFullMethod = "/" + ServiceName + "/Download"
+
+	StateRunning   = "running"
+	StateCompleted = "completed"
+	StateFailed    = "failed"
+
+	defaultProgressInterval = 250 * time.Millisecond
+)
+
+// Request describes a download. It is sent as a google.protobuf.Struct.
+type Request struct {
+	URL     string
+	Dest    string
+	Extract bool
+	Force   bool
+}
+
+// Progress is a progress update streamed back to the caller. It is sent as a google.protobuf.Struct.
+type Progress struct {
+	State      string
+	BytesDone  int64
+	TotalBytes int64
+	// EntriesExtracted and BytesExtracted are the archive entries and bytes written so far when extracting
+	EntriesExtracted int64
+	BytesExtracted   int64
+	Error            string
+}
+
+func (r Request) toStruct() (*structpb.Struct, error) {
+	return structpb.NewStruct(map[string]any{"url": r.URL, "dest": r.Dest, "extract": r.Extract, "force": r.Force})
+}
+
+func requestFromStruct(s *structpb.Struct) Request {
+	fields := s.GetFields()
+	return Request{
+		URL:     fields["url"].GetStringValue(),
+		Dest:    fields["dest"].GetStringValue(),
+		Extract: fields["extract"].GetBoolValue(),
+		Force:   fields["force"].GetBoolValue(),
+	}
+}
+
+func (p Progress) toStruct() (*structpb.Struct, error) {
+	return structpb.NewStruct(map[string]any{
+		"state":             p.State,
+		"bytes_done":        p.BytesDone,
+		"total_bytes":       p.TotalBytes,
+		"entries_extracted": p.EntriesExtracted,
+		"bytes_extracted":   p.BytesExtracted,
+		"error":             p.Error,
+	})
+}
+
+func progressFromStruct(s *structpb.Struct) Progress {
+	fields := s.GetFields()
+	return Progress{
+		State:            fields["state"].GetStringValue(),
+		BytesDone:        int64(fields["bytes_done"].GetNumberValue()),
+		TotalBytes:       int64(fields["total_bytes"].GetNumberValue()),
+		EntriesExtracted: int64(fields["entries_extracted"].GetNumberValue()),
+		BytesExtracted:   int64(fields["bytes_extracted"].GetNumberValue()),
+		Error:            fields["error"].GetStringValue(),
+	}
+}
+
+// Service implements DownloadService. All calls share the same download.Strategy.
+type Service struct {
+	Downloader download.Strategy
+	Options    rpget.Options
+	// ProgressInterval is the minimum interval between progress updates. Defaults to 250ms.
+	ProgressInterval time.Duration
+	// OutputRoot, if set, confines downloads to it, as Server.OutputRoot of pkg/server does.
+	OutputRoot string
+	// Token, if set, must be sent by every call as a bearer token in its authorization metadata, as Server.Token of
+	// pkg/server must. It is only checked by servers created with the options of ServerOptions.
+	Token string
+}
+
+type downloadServer interface {
+	download(req Request, stream grpclib.ServerStream) error
+}
+
+var serviceDesc = grpclib.ServiceDesc{
+	ServiceName: ServiceName,
+	HandlerType: (*downloadServer)(nil),
+	Streams: []grpclib.StreamDesc{
+		{
+			StreamName:    "Download",
+			Handler:       downloadHandler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "download.proto",
+}
+
+// Register registers the service on s.
+func (svc *Service) Register(s *grpclib.Server) {
+	s.RegisterService(&serviceDesc, svc)
+}
+
+// ServerOptions returns the options to create the server svc is registered on with, which check the Token of
+// every call.
+func (svc *Service) ServerOptions() []grpclib.ServerOption {
+	return []grpclib.ServerOption{
+		grpclib.UnaryInterceptor(func(ctx context.Context, req any, _ *grpclib.UnaryServerInfo, handler grpclib.UnaryHandler) (any, error) {
+			if err := svc.authorize(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpclib.StreamInterceptor(func(srv any, stream grpclib.ServerStream, _ *grpclib.StreamServerInfo, handler grpclib.StreamHandler) error {
+			if err := svc.authorize(stream.Context()); err != nil {
+				return err
+			}
+			return handler(srv, stream)
+		}),
+	}
+}
+
+// authorize checks that the call of ctx sent the Token of svc, if it has one.
+func (svc *Service) authorize(ctx context.Context) error {
+	if svc.Token == "" {
+		return nil
+	}
+	var auth string
+	if values := metadata.ValueFromIncomingContext(ctx, "authorization"); len(values) > 0 {
+		auth = values[0]
+	}
+	if subtle.ConstantTimeCompare([]byte(auth), []byte("Bearer "+svc.Token)) != 1 {
+		return status.Error(codes.Unauthenticated, "missing or invalid token")
+	}
+	return nil
+}
+
+// WithToken returns a copy of ctx sending token as the bearer token of the calls made with it, such as Download.
+func WithToken(ctx context.Context, token string) context.Context {
+	return metadata.AppendToOutgoingContext(ctx, "authorization", "Bearer "+token)
+}
+
+func downloadHandler(srv any, stream grpclib.ServerStream) error {
+	msg := new(structpb.Struct)
+	if err := stream.RecvMsg(msg); err != nil {
+		return err
+	}
+	return srv.(downloadServer).download(requestFromStruct(msg), stream)
+}
+
+func (svc *Service) download(req Request, stream grpclib.ServerStream) error {
+	logger := logging.GetLogger()
+	if req.URL == "" || req.Dest == "" {
+		return status.Error(codes.InvalidArgument, "url and dest are required")
+	}
+	if svc.OutputRoot != "" {
+		dest, err := fsutil.Confine(svc.OutputRoot, req.Dest)
+		if err != nil {
+			return status.Error(codes.PermissionDenied, err.Error())
+		}
+		req.Dest = dest
+	}
+	if _, err := os.Stat(req.Dest); !req.Force && !errors.Is(err, fs.ErrNotExist) {
+		return status.Errorf(codes.AlreadyExists, "destination %s already exists", req.Dest)
+	}
+
+	// the consumer is passed to the Getter as is, so that it writes it by offset, through the content cache or with
+	// the shared extract workers as it would over HTTP
+	counter := &progressCounter{}
+	var c consumer.Consumer = &consumer.FileWriter{
+		Overwrite:      req.Force,
+		TempDir:        scratch.Dir(),
+		BreakHardlinks: svc.Options.ContentCache != nil,
+	}
+	if req.Extract {
+		counter.extracted = new(extract.Progress)
+		c = &consumer.TarExtractor{Options: extract.Options{Overwrite: req.Force, TempDir: scratch.Dir(), Progress: counter.extracted}}
+	}
+	getter := &rpget.Getter{Downloader: svc.Downloader, Consumer: c, Options: svc.Options}
+	getter.OnProgress(counter.update)
+
+	// the download is cancelled when the client cancels the call or goes away
+	ctx := stream.Context()
+	done := make(chan error, 1)
+	go func() {
+		_, _, err := getter.DownloadFile(ctx, req.URL, req.Dest)
+		done <- err
+	}()
+
+	interval := svc.ProgressInterval
+	if interval == 0 {
+		interval = defaultProgressInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case err := <-done:
+			final := counter.progress(StateCompleted)
+			if err != nil {
+				final.State = StateFailed
+				final.Error = err.Error()
+			}
+			logger.Info().Str("url", req.URL).Str("dest", req.Dest).Str("state", final.State).Msg("gRPC Download")
+			return sendProgress(stream, final)
+		case <-ticker.C:
+			// SendMsg blocks while the client isn't reading (flow control). Updates are sampled rather than
+			// queued, so a slow client simply sees fewer of them and never slows the download down.
+			if err := sendProgress(stream, counter.progress(StateRunning)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func sendProgress(stream grpclib.ServerStream, p Progress) error {
+	msg, err := p.toStruct()
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+	return stream.SendMsg(msg)
+}
+
+// progressCounter tracks how many bytes of a download have been consumed, from the progress events of its Getter,
+// and, when extracting, how much has been extracted.
+type progressCounter struct {
+	done      atomic.Int64
+	total     atomic.Int64
+	extracted *extract.Progress
+}
+
+func (c *progressCounter) update(event rpget.ProgressEvent) {
+	c.total.Store(event.TotalBytes)
+	if event.Chunk != nil {
+		// downloaded, not consumed yet
+		return
+	}
+	// the events of concurrent offset writes may arrive out of order
+	for done := c.done.Load(); event.BytesDone > done; done = c.done.Load() {
+		if c.done.CompareAndSwap(done, event.BytesDone) {
+			break
+		}
+	}
+}
+
+func (c *progressCounter) progress(state string) Progress {
+	return Progress{
+		State:            state,
+		BytesDone:        c.done.Load(),
+		TotalBytes:       c.total.Load(),
+		EntriesExtracted: c.extracted.Entries(),
+		BytesExtracted:   c.extracted.Bytes(),
+	}
+}
+
+// Download calls DownloadService.Download on conn, invoking onProgress for every update received. It returns
+// the final update, or an error if the call failed or the download did not complete.
+func Download(ctx context.Context, conn grpclib.ClientConnInterface, req Request, onProgress func(Progress)) (Progress, error) {
+	msg, err := req.toStruct()
+	if err != nil {
+		return Progress{}, err
+	}
+	stream, err := conn.NewStream(ctx, &serviceDesc.Streams[0], DownloadFullMethod)
+	if err != nil {
+		return Progress{}, err
+	}
+	if err := stream.SendMsg(msg); err != nil {
+		return Progress{}, err
+	}
+	if err := stream.CloseSend(); err != nil {
+		return Progress{}, err
+	}
+	var last Progress
+	for {
+		update := new(structpb.Struct)
+		err := stream.RecvMsg(update)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return last, err
+		}
+		last = progressFromStruct(update)
+		if onProgress != nil {
+			onProgress(last)
+		}
+	}
+	if last.State != StateCompleted {
+		return last, fmt.Errorf("download of %s failed: %s", req.URL, last.Error)
+	}
+	return last, nil
+}
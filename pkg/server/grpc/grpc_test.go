@@ -0,0 +1,249 @@
+package grpc_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	grpclib "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/cas"
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/download"
+	grpcserver "github.com/emaballarin/rpget/pkg/server/grpc"
+)
+
+var testFS = fstest.MapFS{
+	"hello.txt": {Data: []byte("hello, world!")},
+}
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+func newClient(t *testing.T) *grpclib.ClientConn {
+	t.Helper()
+	return serve(t, &grpcserver.Service{
+		Downloader:       download.GetBufferMode(download.Options{Client: client.Options{}}),
+		Options:          rpget.Options{},
+		ProgressInterval: time.Millisecond,
+	})
+}
+
+// serve serves svc, returning a client connected to it.
+func serve(t *testing.T, svc *grpcserver.Service) *grpclib.ClientConn {
+	t.Helper()
+	listener := bufconn.Listen(1 << 20)
+	srv := grpclib.NewServer(svc.ServerOptions()...)
+	svc.Register(srv)
+	go func() { _ = srv.Serve(listener) }()
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpclib.NewClient("passthrough:///bufconn",
+		grpclib.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpclib.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func TestGRPCDownload(t *testing.T) {
+	origin := httptest.NewServer(http.FileServer(http.FS(testFS)))
+	defer origin.Close()
+	conn := newClient(t)
+
+	dest := filepath.Join(t.TempDir(), "hello.txt")
+	updates := 0
+	final, err := grpcserver.Download(context.Background(), conn,
+		grpcserver.Request{URL: origin.URL + "/hello.txt", Dest: dest},
+		func(grpcserver.Progress) { updates++ })
+	require.NoError(t, err)
+	assert.Equal(t, grpcserver.StateCompleted, final.State)
+	assert.Equal(t, int64(len(testFS["hello.txt"].Data)), final.BytesDone)
+	assert.Equal(t, int64(len(testFS["hello.txt"].Data)), final.TotalBytes)
+	assert.GreaterOrEqual(t, updates, 1)
+
+	content, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, testFS["hello.txt"].Data, content)
+
+	// the destination now exists, a second request without force must be rejected
+	_, err = grpcserver.Download(context.Background(), conn, grpcserver.Request{URL: origin.URL + "/hello.txt", Dest: dest}, nil)
+	assert.Equal(t, codes.AlreadyExists, status.Code(err))
+}
+
+func TestGRPCDownloadErrors(t *testing.T) {
+	origin := httptest.NewServer(http.FileServer(http.FS(testFS)))
+	defer origin.Close()
+	conn := newClient(t)
+
+	_, err := grpcserver.Download(context.Background(), conn, grpcserver.Request{URL: origin.URL + "/hello.txt"}, nil)
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+
+	final, err := grpcserver.Download(context.Background(), conn,
+		grpcserver.Request{URL: origin.URL + "/missing.txt", Dest: filepath.Join(t.TempDir(), "missing.txt")}, nil)
+	require.Error(t, err)
+	assert.Equal(t, grpcserver.StateFailed, final.State)
+	assert.NotEmpty(t, final.Error)
+}
+
+func TestGRPCDownloadExtractProgress(t *testing.T) {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, name := range []string{"a.txt", "b.txt"} {
+		require.NoError(t, tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: 3, Typeflag: tar.TypeReg}))
+		_, err := tw.Write([]byte("abc"))
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	origin := httptest.NewServer(http.FileServer(http.FS(fstest.MapFS{"hello.tar": {Data: buf.Bytes()}})))
+	defer origin.Close()
+	conn := newClient(t)
+
+	dest := filepath.Join(t.TempDir(), "hello")
+	final, err := grpcserver.Download(context.Background(), conn,
+		grpcserver.Request{URL: origin.URL + "/hello.tar", Dest: dest, Extract: true}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, grpcserver.StateCompleted, final.State)
+	assert.Equal(t, int64(2), final.EntriesExtracted)
+	assert.Equal(t, int64(6), final.BytesExtracted)
+}
+
+func TestGRPCDownloadOutputRoot(t *testing.T) {
+	origin := httptest.NewServer(http.FileServer(http.FS(testFS)))
+	defer origin.Close()
+	root := t.TempDir()
+	conn := serve(t, &grpcserver.Service{
+		Downloader: download.GetBufferMode(download.Options{Client: client.Options{}}),
+		OutputRoot: root,
+	})
+
+	outside := filepath.Join(t.TempDir(), "hello.txt")
+	for _, dest := range []string{outside, "../hello.txt"} {
+		_, err := grpcserver.Download(context.Background(), conn, grpcserver.Request{URL: origin.URL + "/hello.txt", Dest: dest}, nil)
+		assert.Equal(t, codes.PermissionDenied, status.Code(err), dest)
+	}
+	assert.NoFileExists(t, outside)
+
+	_, err := grpcserver.Download(context.Background(), conn, grpcserver.Request{URL: origin.URL + "/hello.txt", Dest: "hello.txt"}, nil)
+	require.NoError(t, err)
+	content, err := os.ReadFile(filepath.Join(root, "hello.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, testFS["hello.txt"].Data, content)
+}
+
+func TestGRPCDownloadContentCache(t *testing.T) {
+	origin := httptest.NewServer(http.FileServer(http.FS(testFS)))
+	defer origin.Close()
+	cache, err := cas.Open(t.TempDir())
+	require.NoError(t, err)
+	conn := serve(t, &grpcserver.Service{
+		Downloader: download.GetBufferMode(download.Options{Client: client.Options{}}),
+		Options:    rpget.Options{ContentCache: cache},
+	})
+
+	// the consumer reaches the Getter as a FileWriter, which fills the cache as it does over HTTP
+	final, err := grpcserver.Download(context.Background(), conn,
+		grpcserver.Request{URL: origin.URL + "/hello.txt", Dest: filepath.Join(t.TempDir(), "hello.txt")}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(testFS["hello.txt"].Data)), final.BytesDone)
+	sum := sha256.Sum256(testFS["hello.txt"].Data)
+	size, err := cache.Size("sha256:" + hex.EncodeToString(sum[:]))
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(testFS["hello.txt"].Data)), size)
+}
+
+func TestGRPCDownloadToken(t *testing.T) {
+	origin := httptest.NewServer(http.FileServer(http.FS(testFS)))
+	defer origin.Close()
+	conn := serve(t, &grpcserver.Service{
+		Downloader: download.GetBufferMode(download.Options{Client: client.Options{}}),
+		Token:      "secret",
+	})
+	dest := filepath.Join(t.TempDir(), "hello.txt")
+	req := grpcserver.Request{URL: origin.URL + "/hello.txt", Dest: dest}
+
+	_, err := grpcserver.Download(context.Background(), conn, req, nil)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "missing token")
+	_, err = grpcserver.Download(grpcserver.WithToken(context.Background(), "wrong"), conn, req, nil)
+	assert.Equal(t, codes.Unauthenticated, status.Code(err), "wrong token")
+	assert.NoFileExists(t, dest)
+
+	_, err = grpcserver.Download(grpcserver.WithToken(context.Background(), "secret"), conn, req, nil)
+	require.NoError(t, err)
+	assert.FileExists(t, dest)
+}
+
+// TestGRPCDownloadAfterFailure checks that downloads failing or cancelled part-way through don't keep the workers of
+// the service from the next ones.
+func TestGRPCDownloadAfterFailure(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 1000)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "bytes=100-199" {
+			switch r.URL.Path {
+			case "/bad.bin":
+				http.NotFound(w, r)
+				return
+			case "/slow.bin":
+				// until the call is cancelled
+				<-r.Context().Done()
+				return
+			}
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer origin.Close()
+	conn := serve(t, &grpcserver.Service{
+		Downloader:       download.GetBufferMode(download.Options{Client: client.Options{}, MaxConcurrency: 2, ChunkSize: 100}),
+		ProgressInterval: time.Millisecond,
+	})
+	dir := t.TempDir()
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	final, err := grpcserver.Download(ctx, conn, grpcserver.Request{URL: origin.URL + "/bad.bin", Dest: filepath.Join(dir, "bad.bin")}, nil)
+	require.Error(t, err)
+	assert.Equal(t, grpcserver.StateFailed, final.State)
+
+	final, err = grpcserver.Download(ctx, conn, grpcserver.Request{URL: origin.URL + "/good.bin", Dest: filepath.Join(dir, "good.bin")}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, grpcserver.StateCompleted, final.State)
+
+	// the call is cancelled once the first chunk is written, while the next is pending
+	callCtx, cancelCall := context.WithCancel(ctx)
+	_, err = grpcserver.Download(callCtx, conn, grpcserver.Request{URL: origin.URL + "/slow.bin", Dest: filepath.Join(dir, "slow.bin")},
+		func(p grpcserver.Progress) {
+			if p.BytesDone >= 100 {
+				cancelCall()
+			}
+		})
+	assert.Equal(t, codes.Canceled, status.Code(err))
+
+	final, err = grpcserver.Download(ctx, conn, grpcserver.Request{URL: origin.URL + "/good.bin", Dest: filepath.Join(dir, "good.bin"), Force: true}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, grpcserver.StateCompleted, final.State)
+	data, err := os.ReadFile(filepath.Join(dir, "good.bin"))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+}
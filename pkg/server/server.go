@@ -0,0 +1,364 @@
+// Package server exposes a Getter over a local HTTP API so that a long-lived rpget process can serve many
+// download requests while reusing connections, DNS results and cache-host state between them.
+package server
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"mime"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/download"
+	"github.com/emaballarin/rpget/pkg/extract"
+	"github.com/emaballarin/rpget/pkg/fsutil"
+	"github.com/emaballarin/rpget/pkg/logging"
+	"github.com/emaballarin/rpget/pkg/scratch"
+)
+
+type Status string
+
+const (
+	// defaultRetention and defaultMaxFinished are the defaults of Server.Retention and Server.MaxFinished
+	defaultRetention   = time.Hour
+	defaultMaxFinished = 1000
+	// maxRequestBody is the largest body accepted by `POST /downloads`
+	maxRequestBody = 1 << 20
+)
+
+const (
+	StatusRunning   Status = "running"
+	StatusCompleted Status = "completed"
+	StatusFailed    Status = "failed"
+	StatusCanceled  Status = "canceled"
+)
+
+// DownloadRequest is the body accepted by `POST /downloads`.
+type DownloadRequest struct {
+	URL string `json:"url"`
+	// Dest is relative to the output root of the server, if it has one.
+	Dest    string `json:"dest"`
+	Extract bool   `json:"extract,omitempty"`
+	Force   bool   `json:"force,omitempty"`
+}
+
+// Download is the state of a single download, as returned by the API.
+type Download struct {
+	ID          string     `json:"id"`
+	URL         string     `json:"url"`
+	Dest        string     `json:"dest"`
+	Status      Status     `json:"status"`
+	Size        int64      `json:"size,omitempty"`
+	Error       string     `json:"error,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Server is an http.Handler implementing the download API:
+//
+//	POST   /downloads       start a download, returns the Download
+//	GET    /downloads       list all downloads
+//	GET    /downloads/{id}  get the status of a download, with ?wait=true once it has finished
+//	DELETE /downloads/{id}  cancel a running download, or forget a finished one
+//
+// All downloads share the same download.Strategy, and therefore the same connection pools and work queue.
+//
+// Requests with an Origin header are rejected, as are those addressed to another host than localhost or a loopback
+// address unless the server has a Token, so that web pages can't reach the server, through DNS rebinding or
+// otherwise, and downloads must be posted as application/json, which web pages can't send without a preflight. The
+// Host header is set by clients, so this doesn't keep other machines out: a server without a Token must only listen
+// on a loopback address or a unix socket.
+type Server struct {
+	// Retention is how long finished downloads are kept, and MaxFinished how many of them are kept at most: older
+	// ones are forgotten, so that a long-running server doesn't grow without bound. New sets them to an hour and
+	// 1000; they must not be changed once the server is serving.
+	Retention   time.Duration
+	MaxFinished int
+	// Token, if set, must be sent by every request as a bearer token in its Authorization header.
+	Token string
+	// OutputRoot, if set, confines downloads to it: their destinations are relative to it, and may not escape it
+	// with `..` or through a symlink.
+	OutputRoot string
+
+	downloader download.Strategy
+	options    rpget.Options
+	ctx        context.Context
+
+	mu        sync.Mutex
+	downloads map[string]*Download
+	// finished lists the IDs of finished downloads in the order they finished, some of which may have been
+	// forgotten already
+	finished   []string
+	running    int
+	lastActive time.Time
+	wg         sync.WaitGroup
+	mux        *http.ServeMux
+}
+
+var _ http.Handler = &Server{}
+
+// New returns a Server. Cancelling ctx cancels all running downloads.
+func New(ctx context.Context, downloader download.Strategy, opts rpget.Options) *Server {
+	s := &Server{
+		Retention:   defaultRetention,
+		MaxFinished: defaultMaxFinished,
+		downloader:  downloader,
+		options:     opts,
+		ctx:         ctx,
+		downloads:   make(map[string]*Download),
+		lastActive:  time.Now(),
+		mux:         http.NewServeMux(),
+	}
+	s.mux.HandleFunc("POST /downloads", s.handleCreate)
+	s.mux.HandleFunc("GET /downloads", s.handleList)
+	s.mux.HandleFunc("GET /downloads/{id}", s.handleGet)
+	s.mux.HandleFunc("DELETE /downloads/{id}", s.handleDelete)
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Header.Get("Origin") != "":
+		writeError(w, http.StatusForbidden, errors.New("cross-origin requests are not allowed"))
+	case s.Token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte("Bearer "+s.Token)) != 1:
+		writeError(w, http.StatusUnauthorized, errors.New("missing or invalid token"))
+	case s.Token == "" && !isLoopbackHost(r.Host):
+		writeError(w, http.StatusForbidden, fmt.Errorf("requests to host %s are not allowed", r.Host))
+	default:
+		s.mux.ServeHTTP(w, r)
+	}
+}
+
+// isLoopbackHost reports whether host, the Host header of a request, is localhost or a loopback address.
+func isLoopbackHost(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// IdleFor returns how long the server has been without running downloads, or zero if a download is running.
+func (s *Server) IdleFor() time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.running > 0 {
+		return 0
+	}
+	return time.Since(s.lastActive)
+}
+
+// Wait blocks until all started downloads have finished.
+func (s *Server) Wait() {
+	s.wg.Wait()
+}
+
+func (s *Server) handleCreate(w http.ResponseWriter, r *http.Request) {
+	if mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err != nil || mediaType != "application/json" {
+		writeError(w, http.StatusUnsupportedMediaType, errors.New("the request body must be application/json"))
+		return
+	}
+	var req DownloadRequest
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBody)).Decode(&req); err != nil {
+		status := http.StatusBadRequest
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			status = http.StatusRequestEntityTooLarge
+		}
+		writeError(w, status, fmt.Errorf("invalid request body: %w", err))
+		return
+	}
+	if req.URL == "" || req.Dest == "" {
+		writeError(w, http.StatusBadRequest, errors.New("url and dest are required"))
+		return
+	}
+	if s.OutputRoot != "" {
+		dest, err := fsutil.Confine(s.OutputRoot, req.Dest)
+		if err != nil {
+			writeError(w, http.StatusForbidden, err)
+			return
+		}
+		req.Dest = dest
+	}
+	if _, err := os.Stat(req.Dest); !req.Force && !errors.Is(err, fs.ErrNotExist) {
+		writeError(w, http.StatusConflict, fmt.Errorf("destination %s already exists", req.Dest))
+		return
+	}
+
+	id, err := newID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	d := &Download{
+		ID:        id,
+		URL:       req.URL,
+		Dest:      req.Dest,
+		Status:    StatusRunning,
+		CreatedAt: time.Now(),
+		cancel:    cancel,
+		done:      make(chan struct{}),
+	}
+	s.mu.Lock()
+	s.downloads[id] = d
+	s.running++
+	snapshot := *d
+	s.mu.Unlock()
+
+	var c consumer.Consumer = &consumer.FileWriter{
+		Overwrite:      req.Force,
+		TempDir:        scratch.Dir(),
+		BreakHardlinks: s.options.ContentCache != nil,
+	}
+	if req.Extract {
+		c = &consumer.TarExtractor{Options: extract.Options{Overwrite: req.Force, TempDir: scratch.Dir()}}
+	}
+	getter := &rpget.Getter{Downloader: s.downloader, Consumer: c, Options: s.options}
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		defer cancel()
+		s.run(ctx, getter, d)
+	}()
+
+	writeJSON(w, http.StatusAccepted, snapshot)
+}
+
+func (s *Server) run(ctx context.Context, getter *rpget.Getter, d *Download) {
+	logger := logging.GetLogger()
+	size, _, err := getter.DownloadFile(ctx, d.URL, d.Dest)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer close(d.done)
+	now := time.Now()
+	s.running--
+	s.lastActive = now
+	d.CompletedAt = &now
+	d.Size = size
+	s.finished = append(s.finished, d.ID)
+	s.forgetFinished(now)
+	switch {
+	case err == nil:
+		d.Status = StatusCompleted
+	case errors.Is(ctx.Err(), context.Canceled):
+		d.Status = StatusCanceled
+		d.Error = err.Error()
+	default:
+		d.Status = StatusFailed
+		d.Error = err.Error()
+	}
+	logger.Info().
+		Str("id", d.ID).
+		Str("url", d.URL).
+		Str("dest", d.Dest).
+		Str("status", string(d.Status)).
+		Msg("Server Download")
+}
+
+// forgetFinished forgets the downloads which finished more than Retention before now, and the oldest finished ones
+// past MaxFinished. s.mu must be held.
+func (s *Server) forgetFinished(now time.Time) {
+	for len(s.finished) > 0 {
+		d, ok := s.downloads[s.finished[0]]
+		if ok && len(s.finished) <= s.MaxFinished && now.Sub(*d.CompletedAt) <= s.Retention {
+			return
+		}
+		delete(s.downloads, s.finished[0])
+		s.finished = s.finished[1:]
+	}
+}
+
+func (s *Server) handleList(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	s.forgetFinished(time.Now())
+	list := make([]Download, 0, len(s.downloads))
+	for _, d := range s.downloads {
+		list = append(list, *d)
+	}
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, list)
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	d, ok := s.downloads[r.PathValue("id")]
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("download %s not found", r.PathValue("id")))
+		return
+	}
+	if r.URL.Query().Get("wait") == "true" {
+		select {
+		case <-d.done:
+		case <-r.Context().Done():
+			return
+		}
+	}
+	s.mu.Lock()
+	snapshot := *d
+	s.mu.Unlock()
+	writeJSON(w, http.StatusOK, snapshot)
+}
+
+// handleDelete cancels a running download, or forgets a finished one.
+func (s *Server) handleDelete(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	d, ok := s.downloads[r.PathValue("id")]
+	var snapshot Download
+	status := http.StatusAccepted
+	if ok {
+		if d.CompletedAt == nil {
+			d.cancel()
+		} else {
+			delete(s.downloads, d.ID)
+			status = http.StatusOK
+		}
+		snapshot = *d
+	}
+	s.mu.Unlock()
+	if !ok {
+		writeError(w, http.StatusNotFound, fmt.Errorf("download %s not found", r.PathValue("id")))
+		return
+	}
+	writeJSON(w, status, snapshot)
+}
+
+func newID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error generating download id: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
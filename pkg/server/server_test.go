@@ -0,0 +1,252 @@
+package server_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	rpget "github.com/emaballarin/rpget/pkg"
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/download"
+	"github.com/emaballarin/rpget/pkg/server"
+)
+
+var testFS = fstest.MapFS{
+	"hello.txt": {Data: []byte("hello, world!")},
+}
+
+func init() {
+	zerolog.SetGlobalLevel(zerolog.WarnLevel)
+}
+
+func postDownload(t *testing.T, api *httptest.Server, req server.DownloadRequest) *http.Response {
+	body, err := json.Marshal(req)
+	require.NoError(t, err)
+	resp, err := http.Post(api.URL+"/downloads", "application/json", bytes.NewReader(body))
+	require.NoError(t, err)
+	return resp
+}
+
+func TestServerDownload(t *testing.T) {
+	origin := httptest.NewServer(http.FileServer(http.FS(testFS)))
+	defer origin.Close()
+
+	srv := server.New(context.Background(), download.GetBufferMode(download.Options{Client: client.Options{}}), rpget.Options{})
+	api := httptest.NewServer(srv)
+	defer api.Close()
+
+	dest := filepath.Join(t.TempDir(), "hello.txt")
+	resp := postDownload(t, api, server.DownloadRequest{URL: origin.URL + "/hello.txt", Dest: dest})
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	var created server.Download
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	assert.Equal(t, server.StatusRunning, created.Status)
+
+	srv.Wait()
+
+	statusResp, err := http.Get(api.URL + "/downloads/" + created.ID)
+	require.NoError(t, err)
+	defer statusResp.Body.Close()
+	var status server.Download
+	require.NoError(t, json.NewDecoder(statusResp.Body).Decode(&status))
+	assert.Equal(t, server.StatusCompleted, status.Status)
+	assert.Equal(t, int64(len(testFS["hello.txt"].Data)), status.Size)
+
+	content, err := os.ReadFile(dest)
+	require.NoError(t, err)
+	assert.Equal(t, testFS["hello.txt"].Data, content)
+
+	// the destination now exists, a second request without force must be rejected
+	conflict := postDownload(t, api, server.DownloadRequest{URL: origin.URL + "/hello.txt", Dest: dest})
+	defer conflict.Body.Close()
+	assert.Equal(t, http.StatusConflict, conflict.StatusCode)
+}
+
+func TestServerErrors(t *testing.T) {
+	srv := server.New(context.Background(), download.GetBufferMode(download.Options{Client: client.Options{}}), rpget.Options{})
+	api := httptest.NewServer(srv)
+	defer api.Close()
+
+	resp := postDownload(t, api, server.DownloadRequest{URL: "http://example.com/file"})
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	tooLarge, err := http.Post(api.URL+"/downloads", "application/json", strings.NewReader(`{"url": "`+strings.Repeat("a", 2<<20)+`"}`))
+	require.NoError(t, err)
+	defer tooLarge.Body.Close()
+	assert.Equal(t, http.StatusRequestEntityTooLarge, tooLarge.StatusCode)
+
+	notFound, err := http.Get(api.URL + "/downloads/does-not-exist")
+	require.NoError(t, err)
+	defer notFound.Body.Close()
+	assert.Equal(t, http.StatusNotFound, notFound.StatusCode)
+
+	req, err := http.NewRequest(http.MethodDelete, api.URL+"/downloads/does-not-exist", nil)
+	require.NoError(t, err)
+	cancelResp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer cancelResp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, cancelResp.StatusCode)
+}
+
+func TestServerForgetsFinishedDownloads(t *testing.T) {
+	origin := httptest.NewServer(http.FileServer(http.FS(testFS)))
+	defer origin.Close()
+
+	srv := server.New(context.Background(), download.GetBufferMode(download.Options{Client: client.Options{}}), rpget.Options{})
+	srv.MaxFinished = 1
+	api := httptest.NewServer(srv)
+	defer api.Close()
+
+	dir := t.TempDir()
+	var ids []string
+	for _, name := range []string{"a.txt", "b.txt"} {
+		resp := postDownload(t, api, server.DownloadRequest{URL: origin.URL + "/hello.txt", Dest: filepath.Join(dir, name)})
+		var created server.Download
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+		resp.Body.Close()
+		ids = append(ids, created.ID)
+		srv.Wait()
+	}
+	get := func(id string) int {
+		resp, err := http.Get(api.URL + "/downloads/" + id)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	// only the last finished download is kept, until it is deleted
+	assert.Equal(t, http.StatusNotFound, get(ids[0]))
+	assert.Equal(t, http.StatusOK, get(ids[1]))
+	req, err := http.NewRequest(http.MethodDelete, api.URL+"/downloads/"+ids[1], nil)
+	require.NoError(t, err)
+	deleteResp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	deleteResp.Body.Close()
+	assert.Equal(t, http.StatusOK, deleteResp.StatusCode)
+	assert.Equal(t, http.StatusNotFound, get(ids[1]))
+}
+
+func TestServerRejectsWebPages(t *testing.T) {
+	srv := server.New(context.Background(), download.GetBufferMode(download.Options{Client: client.Options{}}), rpget.Options{})
+	api := httptest.NewServer(srv)
+	defer api.Close()
+
+	do := func(header http.Header, host string) int {
+		req, err := http.NewRequest(http.MethodPost, api.URL+"/downloads", strings.NewReader(`{"url": "http://example.com/file"}`))
+		require.NoError(t, err)
+		req.Header = header
+		if host != "" {
+			req.Host = host
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.NoError(t, err)
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	jsonHeader := http.Header{"Content-Type": {"application/json"}}
+	// a request a web page could send without a preflight
+	assert.Equal(t, http.StatusUnsupportedMediaType, do(http.Header{"Content-Type": {"text/plain"}}, ""))
+	assert.Equal(t, http.StatusForbidden, do(http.Header{"Content-Type": {"application/json"}, "Origin": {"https://example.com"}}, ""))
+	// DNS rebinding: the request reaches the server, addressed to another host
+	assert.Equal(t, http.StatusForbidden, do(jsonHeader, "attacker.example.com"))
+	assert.Equal(t, http.StatusBadRequest, do(jsonHeader, "localhost:9099"))
+	assert.Equal(t, http.StatusBadRequest, do(jsonHeader, "[::1]:9099"))
+
+	// with a token, it is required from any host
+	srv.Token = "secret"
+	assert.Equal(t, http.StatusUnauthorized, do(jsonHeader, ""))
+	assert.Equal(t, http.StatusUnauthorized, do(http.Header{"Content-Type": {"application/json"}, "Authorization": {"Bearer wrong"}}, ""))
+	assert.Equal(t, http.StatusBadRequest, do(http.Header{"Content-Type": {"application/json"}, "Authorization": {"Bearer secret"}}, "rpget.example.com"))
+}
+
+func TestServerOutputRoot(t *testing.T) {
+	origin := httptest.NewServer(http.FileServer(http.FS(testFS)))
+	defer origin.Close()
+
+	root := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "escape")))
+	srv := server.New(context.Background(), download.GetBufferMode(download.Options{Client: client.Options{}}), rpget.Options{})
+	srv.OutputRoot = root
+	api := httptest.NewServer(srv)
+	defer api.Close()
+
+	for _, dest := range []string{filepath.Join(outside, "hello.txt"), "../hello.txt", "escape/hello.txt"} {
+		resp := postDownload(t, api, server.DownloadRequest{URL: origin.URL + "/hello.txt", Dest: dest})
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode, dest)
+	}
+
+	resp := postDownload(t, api, server.DownloadRequest{URL: origin.URL + "/hello.txt", Dest: "sub/hello.txt"})
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusAccepted, resp.StatusCode)
+	var created server.Download
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+	assert.Equal(t, filepath.Join(root, "sub", "hello.txt"), created.Dest)
+	srv.Wait()
+	content, err := os.ReadFile(filepath.Join(root, "sub", "hello.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, testFS["hello.txt"].Data, content)
+	assert.NoFileExists(t, filepath.Join(outside, "hello.txt"))
+}
+
+// TestServerFailedDownload checks that a download failing part-way through doesn't keep the workers of the server
+// from the next ones.
+func TestServerFailedDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("x"), 1000)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/bad.bin" && r.Header.Get("Range") == "bytes=100-199" {
+			http.NotFound(w, r)
+			return
+		}
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}))
+	defer origin.Close()
+
+	downloader := download.GetBufferMode(download.Options{Client: client.Options{}, MaxConcurrency: 2, ChunkSize: 100})
+	srv := server.New(context.Background(), downloader, rpget.Options{})
+	api := httptest.NewServer(srv)
+	defer api.Close()
+
+	dir := t.TempDir()
+	for _, file := range []struct {
+		name   string
+		status server.Status
+	}{{"bad.bin", server.StatusFailed}, {"good.bin", server.StatusCompleted}} {
+		resp := postDownload(t, api, server.DownloadRequest{URL: origin.URL + "/" + file.name, Dest: filepath.Join(dir, file.name)})
+		var created server.Download
+		require.NoError(t, json.NewDecoder(resp.Body).Decode(&created))
+		resp.Body.Close()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			srv.Wait()
+		}()
+		select {
+		case <-done:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("the download of %s didn't finish", file.name)
+		}
+		statusResp, err := http.Get(api.URL + "/downloads/" + created.ID)
+		require.NoError(t, err)
+		var status server.Download
+		require.NoError(t, json.NewDecoder(statusResp.Body).Decode(&status))
+		statusResp.Body.Close()
+		assert.Equal(t, file.status, status.Status, file.name)
+	}
+}
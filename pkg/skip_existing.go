@@ -0,0 +1,201 @@
+package rpget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/fs"
+	"maps"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/consumer"
+	"github.com/emaballarin/rpget/pkg/download"
+	"github.com/emaballarin/rpget/pkg/fsutil"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+// SkipExisting selects how Options.SkipExisting decides whether an existing destination is still up to date.
+type SkipExisting string
+
+const (
+	// SkipExistingETag sends the ETag of the file the destination was downloaded from in an If-None-Match header.
+	// The ETag is recorded in the user.rpget.etag extended attribute of the destination, or, on filesystems without
+	// extended attributes or if the destination is hardlinked (e.g. from a content cache), in a file next to it named
+	// after it followed by ".etag".
+	SkipExistingETag SkipExisting = "etag"
+	// SkipExistingMTime sends the modification time of the destination in an If-Modified-Since header. Downloaded
+	// destinations are given the Last-Modified time of the remote file, unless they are hardlinked: they keep the
+	// time they were written at, which is later.
+	SkipExistingMTime SkipExisting = "mtime"
+	// SkipExistingSize compares the size of the destination with that of the remote file. Only files written by a
+	// FileWriter can be compared.
+	SkipExistingSize SkipExisting = "size"
+)
+
+const (
+	etagXattr  = "user.rpget.etag"
+	etagSuffix = ".etag"
+)
+
+// ParseSkipExisting returns the SkipExisting named s. It is empty if s is.
+func ParseSkipExisting(s string) (SkipExisting, error) {
+	switch mode := SkipExisting(s); mode {
+	case "", SkipExistingETag, SkipExistingMTime, SkipExistingSize:
+		return mode, nil
+	}
+	return "", fmt.Errorf("unknown skip-existing mode %s, expected %s, %s or %s", s, SkipExistingETag, SkipExistingMTime, SkipExistingSize)
+}
+
+// fetchChanged downloads entry as fetchEntry does unless Options.SkipExisting finds its destination up to date, and
+// records what it compares the destination with next time once it has been downloaded.
+func (g *Getter) fetchChanged(ctx context.Context, entry ManifestEntry) (int64, time.Duration, error) {
+	if g.Options.SkipExisting == "" {
+		return g.fetchEntry(ctx, entry)
+	}
+	logger := logging.GetLogger()
+	unchanged, err := g.unchanged(ctx, entry)
+	if err != nil {
+		return 0, 0, fmt.Errorf("error comparing %s with %s: %w", entry.Dest, entry.URL, err)
+	}
+	if unchanged {
+		logger.Info().Str("url", entry.URL).Str("dest", entry.Dest).Msg("Unchanged, skipping")
+		return 0, 0, nil
+	}
+	if fileWriter, isFile := g.consumerFor(entry).(*consumer.FileWriter); isFile && !fileWriter.Overwrite {
+		// an outdated destination is replaced, whatever its size
+		replacing := *fileWriter
+		replacing.Overwrite = true
+		entry.Consumer = &replacing
+	}
+	md := download.MetadataFrom(ctx)
+	if md == nil {
+		md = &download.Metadata{}
+		ctx = download.WithMetadata(ctx, md)
+	}
+	fileSize, elapsed, err := g.fetchEntry(ctx, entry)
+	if err != nil {
+		return fileSize, elapsed, err
+	}
+	switch g.Options.SkipExisting {
+	case SkipExistingETag:
+		err = storeETag(entry.Dest, md.ETag)
+	case SkipExistingMTime:
+		if !md.LastModified.IsZero() && !hardlinked(entry.Dest) {
+			err = os.Chtimes(entry.Dest, time.Time{}, md.LastModified)
+		}
+	}
+	if err != nil {
+		// the file was downloaded all the same, it will just be downloaded again next time
+		logger.Warn().Err(err).Str("dest", entry.Dest).Msg("Error recording the version of the file")
+	}
+	return fileSize, elapsed, nil
+}
+
+// unchanged reports whether the destination of entry exists and is up to date, see Options.SkipExisting.
+func (g *Getter) unchanged(ctx context.Context, entry ManifestEntry) (bool, error) {
+	info, err := os.Stat(entry.Dest)
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	headers := maps.Clone(entry.Headers)
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	var etag string
+	switch g.Options.SkipExisting {
+	case SkipExistingETag:
+		if etag, err = loadETag(entry.Dest); err != nil || etag == "" {
+			// there is nothing to compare the destination with
+			return false, err
+		}
+		headers["If-None-Match"] = etag
+	case SkipExistingMTime:
+		headers["If-Modified-Since"] = info.ModTime().UTC().Format(http.TimeFormat)
+	case SkipExistingSize:
+		if _, isFile := g.consumerFor(entry).(*consumer.FileWriter); !isFile || !info.Mode().IsRegular() {
+			return false, fmt.Errorf("the size of %s can't be compared", entry.Dest)
+		}
+	}
+	remote, err := g.Stat(client.WithHeaders(ctx, headers), entry.URL)
+	if errors.Is(err, download.ErrNotModified) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	// the server ignored the condition
+	switch g.Options.SkipExisting {
+	case SkipExistingETag:
+		return remote.ETag == etag, nil
+	case SkipExistingMTime:
+		return !remote.LastModified.IsZero() && !remote.LastModified.After(info.ModTime()), nil
+	default:
+		return remote.Size == info.Size(), nil
+	}
+}
+
+// hardlinked reports whether dest has other hardlinks, e.g. to the objects of a content cache (see pkg/cas). Its
+// modification time and extended attributes are theirs too, so they aren't dest's to change, nor to rely on.
+func hardlinked(dest string) bool {
+	info, err := os.Stat(dest)
+	return err == nil && fsutil.LinkCount(info) > 1
+}
+
+// loadETag returns the ETag recorded for dest, or "" if there is none.
+func loadETag(dest string) (string, error) {
+	if !hardlinked(dest) {
+		if etag, err := getXattr(dest, etagXattr); err == nil && etag != "" {
+			return etag, nil
+		}
+	}
+	data, err := os.ReadFile(dest + etagSuffix)
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", nil
+	}
+	return strings.TrimSpace(string(data)), err
+}
+
+// storeETag records etag for dest, or forgets the one recorded if etag is empty.
+func storeETag(dest, etag string) error {
+	sidecar := dest + etagSuffix
+	linked := hardlinked(dest)
+	if etag == "" {
+		if !linked {
+			_ = removeXattr(dest, etagXattr)
+		}
+		if err := os.Remove(sidecar); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if !linked {
+		if err := setXattr(dest, etagXattr, etag); err == nil {
+			// a sidecar left by a previous download would be stale
+			if err := os.Remove(sidecar); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			return nil
+		}
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(sidecar), filepath.Base(sidecar)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.WriteString(etag + "\n"); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), sidecar)
+}
@@ -0,0 +1,46 @@
+package rpget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/download"
+)
+
+// Stat describes the file at url without downloading it.
+func (g *Getter) Stat(ctx context.Context, url string) (download.FileInfo, error) {
+	return download.Stat(ctx, g.Downloader, url)
+}
+
+// StatAll describes the files of manifest without downloading them, with the headers of their entries. They are
+// described concurrently, at most Options.MaxConcurrentFiles at a time if set, and returned in the order of
+// manifest. If some of them fail, the others are still described, and the error lists the failures.
+func (g *Getter) StatAll(ctx context.Context, manifest Manifest) ([]download.FileInfo, error) {
+	infos := make([]download.FileInfo, len(manifest))
+	errs := make([]error, len(manifest))
+	var group errgroup.Group
+	if g.Options.MaxConcurrentFiles != 0 {
+		group.SetLimit(g.Options.MaxConcurrentFiles)
+	}
+	for i, entry := range manifest {
+		group.Go(func() error {
+			ctx := ctx
+			if len(entry.Headers) > 0 {
+				ctx = client.WithHeaders(ctx, entry.Headers)
+			}
+			info, err := g.Stat(ctx, entry.URL)
+			if err != nil {
+				errs[i] = fmt.Errorf("%s: %w", entry.URL, err)
+				return nil
+			}
+			infos[i] = info
+			return nil
+		})
+	}
+	_ = group.Wait()
+	return infos, errors.Join(errs...)
+}
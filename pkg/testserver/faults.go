@@ -0,0 +1,263 @@
+package testserver
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// A Fault wraps the handler of a server to alter its responses.
+type Fault func(next http.Handler) http.Handler
+
+// Times applies fault to the first n requests it sees, and passes the later ones through unaltered, e.g. to fail
+// the first attempt of a request and let its retry succeed.
+func Times(n int, fault Fault) Fault {
+	return func(next http.Handler) http.Handler {
+		faulty := fault(next)
+		var seen atomic.Int64
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if seen.Add(1) <= int64(n) {
+				faulty.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// OnPath applies fault to the requests for path only.
+func OnPath(path string, fault Fault) Fault {
+	return func(next http.Handler) http.Handler {
+		faulty := fault(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == path {
+				faulty.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// OnRange applies fault to the requests whose Range header starts at offset start, e.g. to fail a single chunk.
+func OnRange(start int64, fault Fault) Fault {
+	return func(next http.Handler) http.Handler {
+		faulty := fault(next)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if first, _, ok := parseRange(r.Header.Get("Range")); ok && first == start {
+				faulty.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Status replies with code and an empty body instead of serving the file.
+func Status(code int) Fault {
+	return func(http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(code)
+		})
+	}
+}
+
+// Latency waits for d before serving every request.
+func Latency(d time.Duration) Fault {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !sleep(r, d) {
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// IgnoreRange serves whole files with 200 OK, as servers without range support do.
+func IgnoreRange() Fault {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.Header.Del("Range")
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// ShortRanges serves at most n bytes of every range requested, with a Content-Range describing what is served, as
+// servers capping the size of ranges do.
+func ShortRanges(n int64) Fault {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if start, end, ok := parseRange(r.Header.Get("Range")); ok && (end < 0 || end-start+1 > n) {
+				r.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, start+n-1))
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// WrongContentRange shifts the Content-Range of partial responses by offset bytes, without changing the bytes
+// served, as a misbehaving cache or proxy might.
+func WrongContentRange(offset int64) Fault {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&contentRangeWriter{ResponseWriter: w, offset: offset}, r)
+		})
+	}
+}
+
+type contentRangeWriter struct {
+	http.ResponseWriter
+	offset int64
+}
+
+func (w *contentRangeWriter) WriteHeader(code int) {
+	var start, end, size int64
+	if _, err := fmt.Sscanf(w.Header().Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size); err == nil {
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start+w.offset, end+w.offset, size))
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *contentRangeWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// SlowBody writes bodies size bytes at a time, waiting for delay before each write.
+func SlowBody(size int, delay time.Duration) Fault {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&slowWriter{ResponseWriter: w, r: r, size: size, delay: delay}, r)
+		})
+	}
+}
+
+type slowWriter struct {
+	http.ResponseWriter
+	r     *http.Request
+	size  int
+	delay time.Duration
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	written := 0
+	for written < len(p) {
+		if !sleep(w.r, w.delay) {
+			return written, w.r.Context().Err()
+		}
+		n, err := w.ResponseWriter.Write(p[written:min(written+w.size, len(p))])
+		written += n
+		if err != nil {
+			return written, err
+		}
+		_ = http.NewResponseController(w.ResponseWriter).Flush()
+	}
+	return written, nil
+}
+
+func (w *slowWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// ResetAfter resets the connection (closing it with a TCP RST) once n bytes of a body have been written, as a
+// crashing server or a middlebox dropping the connection would. The response headers announce the whole body.
+func ResetAfter(n int64) Fault {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&resetWriter{ResponseWriter: w, remaining: n, abort: true}, r)
+		})
+	}
+}
+
+// CloseAfter closes the connection cleanly once n bytes of a body have been written, so clients see the body end
+// early. The response headers announce the whole body.
+func CloseAfter(n int64) Fault {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			next.ServeHTTP(&resetWriter{ResponseWriter: w, remaining: n}, r)
+		})
+	}
+}
+
+// errReset is returned by the writes of a resetWriter once it has closed its connection.
+var errReset = errors.New("testserver: connection reset")
+
+type resetWriter struct {
+	http.ResponseWriter
+	remaining int64
+	// abort closes the connection with a RST rather than a FIN
+	abort bool
+	reset bool
+}
+
+func (w *resetWriter) Write(p []byte) (int, error) {
+	if w.reset {
+		return 0, errReset
+	}
+	if int64(len(p)) < w.remaining {
+		w.remaining -= int64(len(p))
+		return w.ResponseWriter.Write(p)
+	}
+	n, err := w.ResponseWriter.Write(p[:w.remaining])
+	if err != nil {
+		return n, err
+	}
+	w.reset = true
+	rc := http.NewResponseController(w.ResponseWriter)
+	_ = rc.Flush()
+	conn, _, err := rc.Hijack()
+	if err != nil {
+		return n, err
+	}
+	if tcp, ok := conn.(*net.TCPConn); ok && w.abort {
+		_ = tcp.SetLinger(0)
+	}
+	conn.Close()
+	return n, errReset
+}
+
+func (w *resetWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// parseRange parses a single range header, bytes=<start>-[<end>], returning an end of -1 if it is open.
+func parseRange(header string) (int64, int64, bool) {
+	spec, ok := strings.CutPrefix(header, "bytes=")
+	if !ok || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	first, last, ok := strings.Cut(spec, "-")
+	start, err := strconv.ParseInt(first, 10, 64)
+	if !ok || err != nil {
+		return 0, 0, false
+	}
+	if last == "" {
+		return start, -1, true
+	}
+	end, err := strconv.ParseInt(last, 10, 64)
+	if err != nil || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// sleep waits for d, returning false if the request is cancelled first.
+func sleep(r *http.Request, d time.Duration) bool {
+	if d <= 0 {
+		return true
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return true
+	case <-r.Context().Done():
+		return false
+	}
+}
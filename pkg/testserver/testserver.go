@@ -0,0 +1,75 @@
+// Package testserver provides deterministic HTTP servers for testing downloaders: they serve in-memory files with
+// range requests, like an object store or CDN would, and can inject the faults downloaders must survive, such as
+// truncated ranges, wrong Content-Range headers, slow bodies and connection resets.
+//
+//	ts := testserver.New(map[string][]byte{"/model.bin": content}, testserver.Times(1, testserver.CloseAfter(1024)))
+//	defer ts.Close()
+//	_, _, err := getter.DownloadFile(ctx, ts.URL+"/model.bin", dest)
+package testserver
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"time"
+)
+
+// Server is a running test server. Its files are served with an ETag derived from their content.
+type Server struct {
+	*httptest.Server
+	requests atomic.Int64
+}
+
+// New starts a server serving files, keyed by path (e.g. "/model.bin"), through faults: the first fault is
+// outermost, seeing every request first.
+func New(files map[string][]byte, faults ...Fault) *Server {
+	s := &Server{}
+	s.Server = httptest.NewServer(s.counting(Handler(files, faults...)))
+	return s
+}
+
+// NewTLS is New, serving over TLS. Clients must trust the certificate of Server.Client.
+func NewTLS(files map[string][]byte, faults ...Fault) *Server {
+	s := &Server{}
+	s.Server = httptest.NewTLSServer(s.counting(Handler(files, faults...)))
+	return s
+}
+
+func (s *Server) counting(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		s.requests.Add(1)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Requests returns the number of requests the server has received.
+func (s *Server) Requests() int64 {
+	return s.requests.Load()
+}
+
+// Handler returns the handler of New, for callers running their own server.
+func Handler(files map[string][]byte, faults ...Fault) http.Handler {
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("ETag", ETag(content))
+		w.Header().Set("Content-Type", "application/octet-stream")
+		http.ServeContent(w, r, r.URL.Path, time.Time{}, bytes.NewReader(content))
+	})
+	for i := len(faults) - 1; i >= 0; i-- {
+		h = faults[i](h)
+	}
+	return h
+}
+
+// ETag returns the ETag files with content are served with.
+func ETag(content []byte) string {
+	sum := sha256.Sum256(content)
+	return `"` + hex.EncodeToString(sum[:8]) + `"`
+}
@@ -0,0 +1,166 @@
+package testserver_test
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/testserver"
+)
+
+func get(t *testing.T, url, byteRange string) (*http.Response, []byte, error) {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	if byteRange != "" {
+		req.Header.Set("Range", byteRange)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return resp, body, err
+}
+
+func testContent() []byte {
+	content := make([]byte, 10000)
+	rand.New(rand.NewSource(1)).Read(content)
+	return content
+}
+
+func TestServer(t *testing.T) {
+	content := testContent()
+	ts := testserver.New(map[string][]byte{"/file.bin": content})
+	defer ts.Close()
+
+	resp, body, err := get(t, ts.URL+"/file.bin", "")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, content, body)
+	assert.Equal(t, testserver.ETag(content), resp.Header.Get("ETag"))
+	assert.Equal(t, "bytes", resp.Header.Get("Accept-Ranges"))
+
+	resp, body, err = get(t, ts.URL+"/file.bin", "bytes=1000-1999")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	assert.Equal(t, "bytes 1000-1999/10000", resp.Header.Get("Content-Range"))
+	assert.Equal(t, content[1000:2000], body)
+
+	resp, _, err = get(t, ts.URL+"/missing.bin", "")
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+	assert.Equal(t, int64(3), ts.Requests())
+}
+
+func TestFaults(t *testing.T) {
+	content := testContent()
+	files := map[string][]byte{"/file.bin": content, "/other.bin": content}
+
+	t.Run("Times", func(t *testing.T) {
+		ts := testserver.New(files, testserver.Times(2, testserver.Status(http.StatusServiceUnavailable)))
+		defer ts.Close()
+		for _, status := range []int{http.StatusServiceUnavailable, http.StatusServiceUnavailable, http.StatusOK} {
+			resp, _, err := get(t, ts.URL+"/file.bin", "")
+			require.NoError(t, err)
+			assert.Equal(t, status, resp.StatusCode)
+		}
+	})
+
+	t.Run("OnPath", func(t *testing.T) {
+		ts := testserver.New(files, testserver.OnPath("/other.bin", testserver.Status(http.StatusForbidden)))
+		defer ts.Close()
+		resp, _, err := get(t, ts.URL+"/other.bin", "")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+		resp, _, err = get(t, ts.URL+"/file.bin", "")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+	})
+
+	t.Run("OnRange", func(t *testing.T) {
+		ts := testserver.New(files, testserver.OnRange(1000, testserver.Status(http.StatusBadGateway)))
+		defer ts.Close()
+		resp, _, err := get(t, ts.URL+"/file.bin", "bytes=1000-1999")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusBadGateway, resp.StatusCode)
+		resp, _, err = get(t, ts.URL+"/file.bin", "bytes=0-999")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+	})
+
+	t.Run("Latency", func(t *testing.T) {
+		ts := testserver.New(files, testserver.Latency(50*time.Millisecond))
+		defer ts.Close()
+		start := time.Now()
+		_, _, err := get(t, ts.URL+"/file.bin", "")
+		require.NoError(t, err)
+		assert.GreaterOrEqual(t, time.Since(start), 50*time.Millisecond)
+	})
+
+	t.Run("IgnoreRange", func(t *testing.T) {
+		ts := testserver.New(files, testserver.IgnoreRange())
+		defer ts.Close()
+		resp, body, err := get(t, ts.URL+"/file.bin", "bytes=1000-1999")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, content, body)
+	})
+
+	t.Run("ShortRanges", func(t *testing.T) {
+		ts := testserver.New(files, testserver.ShortRanges(300))
+		defer ts.Close()
+		resp, body, err := get(t, ts.URL+"/file.bin", "bytes=1000-1999")
+		require.NoError(t, err)
+		assert.Equal(t, http.StatusPartialContent, resp.StatusCode)
+		assert.Equal(t, "bytes 1000-1299/10000", resp.Header.Get("Content-Range"))
+		assert.Equal(t, content[1000:1300], body)
+
+		// ranges within the limit are served whole
+		resp, body, err = get(t, ts.URL+"/file.bin", "bytes=0-99")
+		require.NoError(t, err)
+		assert.Equal(t, "bytes 0-99/10000", resp.Header.Get("Content-Range"))
+		assert.Equal(t, content[:100], body)
+	})
+
+	t.Run("WrongContentRange", func(t *testing.T) {
+		ts := testserver.New(files, testserver.WrongContentRange(10))
+		defer ts.Close()
+		resp, body, err := get(t, ts.URL+"/file.bin", "bytes=1000-1999")
+		require.NoError(t, err)
+		assert.Equal(t, "bytes 1010-2009/10000", resp.Header.Get("Content-Range"))
+		assert.Equal(t, content[1000:2000], body)
+	})
+
+	t.Run("SlowBody", func(t *testing.T) {
+		ts := testserver.New(files, testserver.SlowBody(1000, 10*time.Millisecond))
+		defer ts.Close()
+		start := time.Now()
+		_, body, err := get(t, ts.URL+"/file.bin", "")
+		require.NoError(t, err)
+		assert.Equal(t, content, body)
+		assert.GreaterOrEqual(t, time.Since(start), 100*time.Millisecond)
+	})
+
+	t.Run("ResetAfter", func(t *testing.T) {
+		ts := testserver.New(files, testserver.ResetAfter(4096))
+		defer ts.Close()
+		resp, body, err := get(t, ts.URL+"/file.bin", "")
+		require.Error(t, err)
+		assert.Equal(t, int64(len(content)), resp.ContentLength)
+		assert.Equal(t, content[:len(body)], body)
+		assert.LessOrEqual(t, len(body), 4096)
+	})
+
+	t.Run("CloseAfter", func(t *testing.T) {
+		ts := testserver.New(files, testserver.CloseAfter(4096))
+		defer ts.Close()
+		_, body, err := get(t, ts.URL+"/file.bin", "")
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+		assert.Equal(t, content[:4096], body)
+	})
+}
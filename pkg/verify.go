@@ -0,0 +1,136 @@
+package rpget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/consumer"
+)
+
+// ErrVerificationFailed is returned by Getter.VerifyFiles when destinations are missing, don't match their entry,
+// or couldn't be compared with it.
+var ErrVerificationFailed = errors.New("verification failed")
+
+// VerifyStatus is the outcome of verifying the destination of a manifest entry.
+type VerifyStatus string
+
+const (
+	VerifyOK       VerifyStatus = "ok"
+	VerifyMissing  VerifyStatus = "missing"
+	VerifyMismatch VerifyStatus = "mismatch"
+	// VerifyError is the status of destinations which couldn't be compared, e.g. because the remote file couldn't
+	// be described.
+	VerifyError VerifyStatus = "error"
+	// VerifySkipped is the status of destinations which aren't the file as downloaded, e.g. extracted archives.
+	VerifySkipped VerifyStatus = "skipped"
+)
+
+// VerifyResult is the outcome of verifying the destination of a manifest entry.
+type VerifyResult struct {
+	URL    string       `json:"url"`
+	Dest   string       `json:"dest"`
+	Status VerifyStatus `json:"status"`
+	// Detail explains the status: how a matching destination was compared (checksum, size or etag), how a
+	// mismatching one differs, or why it couldn't be compared.
+	Detail string `json:"detail,omitempty"`
+}
+
+// VerifyFiles checks the existing destinations of manifest without downloading them: against the checksum of their
+// entry if it has one, otherwise against the size of the remote file and, if the ETag of the remote file was
+// recorded by a previous download (see SkipExistingETag), against its ETag. They are verified concurrently, at most
+// Options.MaxConcurrentFiles at a time if set, and returned in the order of manifest. The error wraps
+// ErrVerificationFailed if any of them is missing, mismatches or couldn't be compared.
+func (g *Getter) VerifyFiles(ctx context.Context, manifest Manifest) ([]VerifyResult, error) {
+	results := make([]VerifyResult, len(manifest))
+	var group errgroup.Group
+	if g.Options.MaxConcurrentFiles != 0 {
+		group.SetLimit(g.Options.MaxConcurrentFiles)
+	}
+	for i, entry := range manifest {
+		group.Go(func() error {
+			status, detail := g.verifyEntry(ctx, entry)
+			results[i] = VerifyResult{URL: entry.URL, Dest: entry.Dest, Status: status, Detail: detail}
+			return nil
+		})
+	}
+	_ = group.Wait()
+	failed := 0
+	for _, result := range results {
+		if result.Status != VerifyOK && result.Status != VerifySkipped {
+			failed++
+		}
+	}
+	if failed > 0 {
+		return results, fmt.Errorf("%w: %d of %d file(s)", ErrVerificationFailed, failed, len(results))
+	}
+	return results, nil
+}
+
+func (g *Getter) verifyEntry(ctx context.Context, entry ManifestEntry) (VerifyStatus, string) {
+	if c := entry.Consumer; c != nil {
+		if _, isFile := c.(*consumer.FileWriter); !isFile {
+			return VerifySkipped, "not written as downloaded"
+		}
+	}
+	info, err := os.Stat(entry.Dest)
+	if errors.Is(err, fs.ErrNotExist) {
+		return VerifyMissing, ""
+	}
+	if err != nil {
+		return VerifyError, err.Error()
+	}
+	if info.IsDir() {
+		return VerifySkipped, "destination is a directory"
+	}
+	if !info.Mode().IsRegular() {
+		return VerifyMismatch, "destination is not a regular file"
+	}
+
+	if entry.Checksum != "" {
+		v, err := newVerifier(entry.Checksum)
+		if err != nil {
+			return VerifyError, err.Error()
+		}
+		f, err := os.Open(entry.Dest)
+		if err != nil {
+			return VerifyError, err.Error()
+		}
+		defer f.Close()
+		if _, err := io.Copy(v, f); err != nil {
+			return VerifyError, err.Error()
+		}
+		if err := v.verify(); err != nil {
+			return VerifyMismatch, err.Error()
+		}
+		return VerifyOK, "checksum"
+	}
+
+	if len(entry.Headers) > 0 {
+		ctx = client.WithHeaders(ctx, entry.Headers)
+	}
+	remote, err := g.Stat(ctx, entry.URL)
+	if err != nil {
+		return VerifyError, err.Error()
+	}
+	if remote.Size != info.Size() {
+		return VerifyMismatch, fmt.Sprintf("%d bytes, remote file is %d bytes", info.Size(), remote.Size)
+	}
+	etag, err := loadETag(entry.Dest)
+	if err != nil {
+		return VerifyError, err.Error()
+	}
+	if etag == "" || remote.ETag == "" {
+		return VerifyOK, "size"
+	}
+	if etag != remote.ETag {
+		return VerifyMismatch, fmt.Sprintf("downloaded as ETag %s, remote file is %s", etag, remote.ETag)
+	}
+	return VerifyOK, "etag"
+}
@@ -0,0 +1,83 @@
+package rpget
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"time"
+
+	"golang.org/x/sync/errgroup"
+
+	"github.com/emaballarin/rpget/pkg/client"
+	"github.com/emaballarin/rpget/pkg/download"
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+const (
+	defaultWaitInterval = time.Second
+	// maxWaitInterval caps the interval between two attempts of WaitForFile.
+	maxWaitInterval = 30 * time.Second
+)
+
+// WaitForFile waits for the file at url to exist, e.g. while a pipeline is still publishing it, and describes it.
+// The file is requested as Stat does until the server answers with a 2xx status, first after
+// Options.WaitInterval and then twice as long after each attempt, up to 30s. Other errors, such as a URL denied by
+// policy, are returned straight away. Bound ctx to stop waiting: once it is done, the error of the last attempt is
+// returned.
+func (g *Getter) WaitForFile(ctx context.Context, url string) (download.FileInfo, error) {
+	logger := logging.GetLogger()
+	interval := g.Options.WaitInterval
+	if interval <= 0 {
+		interval = defaultWaitInterval
+	}
+	start := time.Now()
+	for {
+		info, err := g.Stat(ctx, url)
+		if err == nil {
+			return info, nil
+		}
+		if !errors.Is(err, download.ErrUnexpectedHTTPStatus) {
+			return download.FileInfo{}, err
+		}
+		// a little jitter keeps clients waiting for the same file from polling in lockstep
+		delay := interval + rand.N(interval/10+1)
+		logger.Info().
+			Str("url", url).
+			Err(err).
+			Str("retry_in", delay.Round(time.Millisecond).String()).
+			Msg("Waiting for file")
+		select {
+		case <-ctx.Done():
+			return download.FileInfo{}, fmt.Errorf("gave up waiting for %s after %s: %w", url, time.Since(start).Round(time.Second), err)
+		case <-time.After(delay):
+		}
+		interval = min(2*interval, maxWaitInterval)
+	}
+}
+
+// WaitForFiles waits for every file of manifest to exist as WaitForFile does, with the headers of their entries. They
+// are waited for concurrently, at most Options.MaxConcurrentFiles at a time if set. It returns once they all exist,
+// or with the first error.
+func (g *Getter) WaitForFiles(ctx context.Context, manifest Manifest) error {
+	group, ctx := errgroup.WithContext(ctx)
+	if g.Options.MaxConcurrentFiles != 0 {
+		group.SetLimit(g.Options.MaxConcurrentFiles)
+	}
+	waiting := make(map[string]bool)
+	for _, entry := range manifest {
+		if waiting[entry.URL] {
+			continue
+		}
+		waiting[entry.URL] = true
+		group.Go(func() error {
+			ctx := ctx
+			if len(entry.Headers) > 0 {
+				ctx = client.WithHeaders(ctx, entry.Headers)
+			}
+			_, err := g.WaitForFile(ctx, entry.URL)
+			return err
+		})
+	}
+	return group.Wait()
+}
@@ -0,0 +1,146 @@
+package wal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+	"github.com/emaballarin/rpget/pkg/scratch"
+)
+
+// Recover replays the logs in dir of rpget processes which are no longer running. Files left incomplete by an
+// interrupted write are removed. Interrupted downloads are then passed to resume, in the order they started, or
+// only logged if resume is nil. A log is removed once all of its operations are recovered, otherwise it is kept so
+// that recovery can be retried. Recover returns the interrupted downloads.
+func Recover(dir string, resume func(Op) error) ([]Op, error) {
+	logger := logging.GetLogger()
+	entries, err := os.ReadDir(dir)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error listing WAL directory %s: %w", dir, err)
+	}
+	var downloads []Op
+	var errs []error
+	for _, entry := range entries {
+		pid, ok := logPID(entry.Name())
+		if !ok || pid == os.Getpid() || scratch.ProcessAlive(pid) {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		ops, err := readPending(path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		logger.Info().Str("wal", path).Int("pid", pid).Int("interrupted", len(ops)).Msg("Recovering")
+		interrupted, err := recoverOps(ops, resume)
+		downloads = append(downloads, interrupted...)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("error recovering %s: %w", path, err))
+			continue
+		}
+		if err := os.Remove(path); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return downloads, errors.Join(errs...)
+}
+
+// recoverOps removes the files of the interrupted writes, then resumes the interrupted downloads.
+func recoverOps(ops []Op, resume func(Op) error) ([]Op, error) {
+	logger := logging.GetLogger()
+	var downloads []Op
+	var errs []error
+	for _, op := range ops {
+		switch op.Kind {
+		case KindWrite:
+			err := os.Remove(op.Dest)
+			if errors.Is(err, os.ErrNotExist) {
+				continue
+			}
+			if err != nil {
+				errs = append(errs, fmt.Errorf("error removing incomplete file %s: %w", op.Dest, err))
+				continue
+			}
+			logger.Info().Str("dest", op.Dest).Msg("Removed incomplete file")
+		case KindDownload:
+			downloads = append(downloads, op)
+		default:
+			logger.Warn().Str("kind", string(op.Kind)).Str("dest", op.Dest).Msg("Unknown WAL operation")
+		}
+	}
+	for _, op := range downloads {
+		if resume == nil {
+			logger.Info().Str("url", op.URL).Str("dest", op.Dest).Bool("extract", op.Extract).Msg("Interrupted download")
+			continue
+		}
+		if err := resume(op); err != nil {
+			errs = append(errs, fmt.Errorf("error resuming download of %s: %w", op.URL, err))
+		}
+	}
+	return downloads, errors.Join(errs...)
+}
+
+// readPending returns the operations of the log at path which were never done, in the order they started. A
+// truncated last line, written as the process crashed, is ignored.
+func readPending(path string) ([]Op, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading WAL: %w", err)
+	}
+	defer file.Close()
+	var seqs []int64
+	pending := make(map[int64]Op)
+	scanner := bufio.NewScanner(file)
+	var parseErr error
+	for scanner.Scan() {
+		if parseErr != nil {
+			// only the last line may be truncated
+			return nil, parseErr
+		}
+		var r record
+		if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+			parseErr = fmt.Errorf("error parsing WAL %s: %w", path, err)
+			continue
+		}
+		switch {
+		case r.Done:
+			delete(pending, r.Seq)
+		case r.Op != nil:
+			seqs = append(seqs, r.Seq)
+			pending[r.Seq] = *r.Op
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, fmt.Errorf("error reading WAL %s: %w", path, err)
+	}
+	var ops []Op
+	for _, seq := range seqs {
+		if op, ok := pending[seq]; ok {
+			ops = append(ops, op)
+		}
+	}
+	return ops, nil
+}
+
+// logPID returns the PID of the process owning the log named name, rpget-<pid>.wal.
+func logPID(name string) (int, bool) {
+	rest, ok := strings.CutPrefix(name, filePrefix)
+	if !ok {
+		return 0, false
+	}
+	pidString, ok := strings.CutSuffix(rest, fileSuffix)
+	if !ok {
+		return 0, false
+	}
+	pid, err := strconv.Atoi(pidString)
+	return pid, err == nil && pid > 0
+}
@@ -0,0 +1,158 @@
+// Package wal journals the operations of an rpget process which leave the filesystem in an inconsistent state if the
+// process crashes: downloads, and files being written to their destination. Every process appends to its own log,
+// rpget-<pid>.wal, which is removed when the process exits cleanly. Recover replays the logs of crashed processes.
+package wal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/emaballarin/rpget/pkg/logging"
+)
+
+const (
+	filePrefix = "rpget-"
+	fileSuffix = ".wal"
+)
+
+type Kind string
+
+const (
+	// KindDownload is the download of URL to Dest, extracting it if Extract is set.
+	KindDownload Kind = "download"
+	// KindWrite is a file being written at Dest, which is incomplete until the operation is done.
+	KindWrite Kind = "write"
+)
+
+// Op is an operation recorded in the log.
+type Op struct {
+	Kind    Kind   `json:"kind"`
+	URL     string `json:"url,omitempty"`
+	Dest    string `json:"dest"`
+	Extract bool   `json:"extract,omitempty"`
+}
+
+// record is a line of the log: an operation starting, or the operation with the same sequence number being done.
+type record struct {
+	Seq  int64 `json:"seq"`
+	Op   *Op   `json:"op,omitempty"`
+	Done bool  `json:"done,omitempty"`
+}
+
+type journal struct {
+	mu      sync.Mutex
+	file    *os.File
+	seq     int64
+	pending int
+}
+
+var (
+	currentMu sync.Mutex
+	current   *journal
+)
+
+// Open creates the log of this process in dir. If dir is empty, operations are not journaled.
+func Open(dir string) error {
+	if dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("error creating WAL directory %s: %w", dir, err)
+	}
+	file, err := os.OpenFile(logPath(dir, os.Getpid()), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return fmt.Errorf("error creating WAL: %w", err)
+	}
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	current = &journal{file: file}
+	return nil
+}
+
+// Path returns the path of the log of this process, or "" if operations are not journaled.
+func Path() string {
+	currentMu.Lock()
+	defer currentMu.Unlock()
+	if current == nil {
+		return ""
+	}
+	return current.file.Name()
+}
+
+// Close closes the log of this process, removing it unless operations are still in progress.
+func Close() error {
+	currentMu.Lock()
+	l := current
+	current = nil
+	currentMu.Unlock()
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.file.Close(); err != nil {
+		return err
+	}
+	if l.pending > 0 {
+		return nil
+	}
+	return os.Remove(l.file.Name())
+}
+
+// Entry is an operation in progress.
+type Entry struct {
+	log *journal
+	seq int64
+}
+
+// Begin records that op is starting. The returned Entry is nil if there is no log; its methods are no-ops then.
+// Failing to write the log is logged rather than failing the operation.
+func Begin(op Op) *Entry {
+	currentMu.Lock()
+	l := current
+	currentMu.Unlock()
+	if l == nil {
+		return nil
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.seq++
+	l.pending++
+	l.append(record{Seq: l.seq, Op: &op})
+	return &Entry{log: l, seq: l.seq}
+}
+
+// Done records that the operation is over, whether it succeeded or not: only operations interrupted by a crash
+// are recovered.
+func (e *Entry) Done() {
+	if e == nil {
+		return
+	}
+	e.log.mu.Lock()
+	defer e.log.mu.Unlock()
+	e.log.pending--
+	e.log.append(record{Seq: e.seq, Done: true})
+}
+
+// append writes r to the log and syncs it, so that it survives a crash. l.mu must be held.
+func (l *journal) append(r record) {
+	line, err := json.Marshal(r)
+	if err == nil {
+		_, err = l.file.Write(append(line, '\n'))
+	}
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		logger := logging.GetLogger()
+		logger.Warn().Err(err).Str("wal", l.file.Name()).Msg("Error writing WAL")
+	}
+}
+
+func logPath(dir string, pid int) string {
+	return filepath.Join(dir, filePrefix+strconv.Itoa(pid)+fileSuffix)
+}
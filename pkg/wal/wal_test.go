@@ -0,0 +1,86 @@
+package wal_test
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/emaballarin/rpget/pkg/wal"
+)
+
+func TestLog(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "rpget-"+strconv.Itoa(os.Getpid())+".wal")
+
+	// without a log, entries are no-ops
+	wal.Begin(wal.Op{Kind: wal.KindWrite, Dest: "nowhere"}).Done()
+	assert.NoFileExists(t, path)
+
+	require.NoError(t, wal.Open(dir))
+	download := wal.Begin(wal.Op{Kind: wal.KindDownload, URL: "http://example.com/a", Dest: "a"})
+	wal.Begin(wal.Op{Kind: wal.KindWrite, Dest: "a"}).Done()
+	assert.FileExists(t, path)
+
+	// the log of a running process is left alone, including our own
+	downloads, err := wal.Recover(dir, nil)
+	require.NoError(t, err)
+	assert.Empty(t, downloads)
+
+	// a log with operations in progress is kept
+	require.NoError(t, wal.Close())
+	assert.FileExists(t, path)
+	download.Done()
+
+	require.NoError(t, wal.Open(dir))
+	wal.Begin(wal.Op{Kind: wal.KindDownload, URL: "http://example.com/b", Dest: "b"}).Done()
+	require.NoError(t, wal.Close())
+	assert.NoFileExists(t, path)
+}
+
+func TestRecover(t *testing.T) {
+	dir := t.TempDir()
+	files := t.TempDir()
+	incomplete := filepath.Join(files, "incomplete")
+	complete := filepath.Join(files, "complete")
+	require.NoError(t, os.WriteFile(incomplete, []byte("half"), 0644))
+	require.NoError(t, os.WriteFile(complete, []byte("whole"), 0644))
+
+	// the log of a crashed process, whose last line was being written
+	crashed := filepath.Join(dir, "rpget-999999999.wal")
+	log := `{"seq":1,"op":{"kind":"download","url":"http://example.com/complete","dest":"` + complete + `"}}
+{"seq":2,"op":{"kind":"write","dest":"` + complete + `"}}
+{"seq":2,"done":true}
+{"seq":1,"done":true}
+{"seq":3,"op":{"kind":"download","url":"http://example.com/archive","dest":"` + files + `","extract":true}}
+{"seq":4,"op":{"kind":"download","url":"http://example.com/incomplete","dest":"` + incomplete + `"}}
+{"seq":5,"op":{"kind":"write","dest":"` + incomplete + `"}}
+{"seq":6,"op":{"ki`
+	require.NoError(t, os.WriteFile(crashed, []byte(log), 0644))
+
+	var resumed []wal.Op
+	downloads, err := wal.Recover(dir, func(op wal.Op) error {
+		// incomplete files are removed before downloads are resumed
+		assert.NoFileExists(t, incomplete)
+		resumed = append(resumed, op)
+		return nil
+	})
+	require.NoError(t, err)
+	expected := []wal.Op{
+		{Kind: wal.KindDownload, URL: "http://example.com/archive", Dest: files, Extract: true},
+		{Kind: wal.KindDownload, URL: "http://example.com/incomplete", Dest: incomplete},
+	}
+	assert.Equal(t, expected, downloads)
+	assert.Equal(t, expected, resumed)
+	assert.FileExists(t, complete)
+	assert.NoFileExists(t, crashed)
+
+	// a log which can't be parsed is kept
+	require.NoError(t, os.WriteFile(crashed, []byte("garbage\n{\"seq\":1,\"done\":true}\n"), 0644))
+	_, err = wal.Recover(dir, nil)
+	assert.Error(t, err)
+	assert.FileExists(t, crashed)
+}
@@ -0,0 +1,17 @@
+//go:build !linux && !darwin
+
+package rpget
+
+import "errors"
+
+func getXattr(path, name string) (string, error) {
+	return "", errors.ErrUnsupported
+}
+
+func setXattr(path, name, value string) error {
+	return errors.ErrUnsupported
+}
+
+func removeXattr(path, name string) error {
+	return errors.ErrUnsupported
+}
@@ -0,0 +1,32 @@
+//go:build linux || darwin
+
+package rpget
+
+import (
+	"errors"
+
+	"golang.org/x/sys/unix"
+)
+
+func getXattr(path, name string) (string, error) {
+	buf := make([]byte, 256)
+	for {
+		n, err := unix.Getxattr(path, name, buf)
+		if errors.Is(err, unix.ERANGE) {
+			buf = make([]byte, 2*len(buf))
+			continue
+		}
+		if err != nil {
+			return "", err
+		}
+		return string(buf[:n]), nil
+	}
+}
+
+func setXattr(path, name, value string) error {
+	return unix.Setxattr(path, name, []byte(value), 0)
+}
+
+func removeXattr(path, name string) error {
+	return unix.Removexattr(path, name)
+}